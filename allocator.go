@@ -0,0 +1,47 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+const (
+	ALLOCATION_POLICY_DEFAULT    = core.ALLOCATION_POLICY_DEFAULT
+	ALLOCATION_POLICY_NEXT       = core.ALLOCATION_POLICY_NEXT
+	ALLOCATION_POLICY_FIRST_FIT  = core.ALLOCATION_POLICY_FIRST_FIT
+	ALLOCATION_POLICY_CONTIGUOUS = core.ALLOCATION_POLICY_CONTIGUOUS
+	ALLOCATION_POLICY_STRIPED    = core.ALLOCATION_POLICY_STRIPED
+)
+
+// Return the name of an allocation policy.
+func AllocationPolicyName(policy uint) string {
+	return core.AllocationPolicyName(policy)
+}
+
+// Return the allocation policy with the given name.
+func ParseAllocationPolicy(name string) (uint, error) {
+	return core.ParseAllocationPolicy(name)
+}
+
+// Set the default allocation policy of a device.
+func SetDeviceAllocationPolicy(device string, policy uint) error {
+	return core.SetDeviceAllocationPolicy(device, policy)
+}
+
+// Set the allocation policy of a volume. The default policy follows the device setting.
+func SetVolumeAllocationPolicy(device string, volumeName string, policy uint) error {
+	return core.SetVolumeAllocationPolicy(device, volumeName, policy)
+}
@@ -0,0 +1,94 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api is the supported API of the Direct Block Store. Devices, volumes and snapshots are reached through
+// the Device, Volume and Snapshot interfaces, and volumes open for I/O through Handle. Its types are its own,
+// holding what programs need, so they do not change with the device layout, and the package only grows.
+// Programs should move to it from the dbs package, which exposes every operation and setting.
+package api
+
+import (
+	"log/slog"
+
+	"github.com/Kampadais/dbs"
+)
+
+const (
+	BLOCK_SIZE  = dbs.BLOCK_SIZE
+	EXTENT_SIZE = dbs.EXTENT_SIZE
+
+	SYNC_POLICY_STRICT  = dbs.SYNC_POLICY_STRICT
+	SYNC_POLICY_RELAXED = dbs.SYNC_POLICY_RELAXED
+	SYNC_POLICY_UNSAFE  = dbs.SYNC_POLICY_UNSAFE
+)
+
+var (
+	ErrVolumeNotFound      = dbs.ErrVolumeNotFound
+	ErrVolumeExists        = dbs.ErrVolumeExists
+	ErrSnapshotNotFound    = dbs.ErrSnapshotNotFound
+	ErrSnapshotExists      = dbs.ErrSnapshotExists
+	ErrInvalidVolumeName   = dbs.ErrInvalidVolumeName
+	ErrReadOnly            = dbs.ErrReadOnly
+	ErrRetained            = dbs.ErrRetained
+	ErrNoSpace             = dbs.ErrNoSpace
+	ErrCorrupted           = dbs.ErrCorrupted
+	ErrWrongDevice         = dbs.ErrWrongDevice
+	ErrMaintenance         = dbs.ErrMaintenance
+	ErrVolumeClosed        = dbs.ErrVolumeClosed
+	ErrInvalidLabel        = dbs.ErrInvalidLabel
+	ErrLabelSpaceExhausted = dbs.ErrLabelSpaceExhausted
+)
+
+// Setting of a device, given when opening it.
+type Option struct {
+	opt dbs.Option
+}
+
+func options(opts []Option) []dbs.Option {
+	dopts := make([]dbs.Option, len(opts))
+	for i, o := range opts {
+		dopts[i] = o.opt
+	}
+	return dopts
+}
+
+// Log open, close and reload events to the given logger.
+func WithLogger(logger *slog.Logger) Option {
+	return Option{dbs.WithLogger(logger)}
+}
+
+// Cache the given number of recently read blocks of each open volume in memory.
+func WithReadCache(blocks uint) Option {
+	return Option{dbs.WithReadCache(blocks)}
+}
+
+// Use buffered instead of direct I/O, for filesystems that do not support the latter.
+func WithBufferedIO() Option {
+	return Option{dbs.WithBufferedIO()}
+}
+
+// Address open volumes in sectors of the given size, down to 512 bytes, for clients that assume small sectors.
+func WithSectorSize(size uint) Option {
+	return Option{dbs.WithSectorSize(size)}
+}
+
+// Make metadata updates durable as per the given SYNC_POLICY_* policy.
+func WithSyncPolicy(policy uint) Option {
+	return Option{dbs.WithSyncPolicy(policy)}
+}
+
+// Refuse devices whose identity differs from the given UUID.
+func WithDeviceUUID(uuid string) Option {
+	return Option{dbs.WithDeviceUUID(uuid)}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/Kampadais/dbs"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type APISuite struct{}
+
+var _ = Suite(&APISuite{})
+
+func (s *APISuite) TestDevice(c *C) {
+	name, err := dbs.CreateMemoryDevice("api", 100*1024*1024)
+	c.Assert(err, IsNil)
+	defer dbs.RemoveMemoryDevice("api")
+	_, err = Open(name)
+	c.Assert(err, NotNil)
+	c.Assert(Init(name), IsNil)
+	d, err := Open(name)
+	c.Assert(err, IsNil)
+
+	// Write, snapshot and read back through a clone
+	v, err := d.CreateVolume("vol1", 1024*1024*1024)
+	c.Assert(err, IsNil)
+	h, err := v.Open()
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{0xab}, BLOCK_SIZE)
+	c.Assert(h.WriteAt(data, EXTENT_SIZE), IsNil)
+	c.Assert(h.Close(), IsNil)
+	current, err := v.CreateSnapshot(&SnapshotOptions{Name: "next"})
+	c.Assert(err, IsNil)
+	found, err := d.FindSnapshot("next")
+	c.Assert(err, IsNil)
+	c.Assert(found.Id(), Equals, current.Id())
+	si, err := current.Info()
+	c.Assert(err, IsNil)
+	c.Assert(si.VolumeName, Equals, "vol1")
+	snap := d.Snapshot(si.ParentSnapshotId)
+	clone, err := snap.Clone("vol2")
+	c.Assert(err, IsNil)
+	h, err = clone.Open()
+	c.Assert(err, IsNil)
+	buf := make([]byte, BLOCK_SIZE)
+	c.Assert(h.ReadAt(buf, EXTENT_SIZE), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(h.Close(), IsNil)
+	h, err = snap.Open()
+	c.Assert(err, IsNil)
+	c.Assert(h.ReadOnly(), Equals, true)
+	c.Assert(h.Close(), IsNil)
+
+	// Handles follow renames
+	c.Assert(v.Rename("vol3"), IsNil)
+	vi, err := v.Info()
+	c.Assert(err, IsNil)
+	c.Assert(vi.VolumeName, Equals, "vol3")
+	_, err = d.Volume("vol1").Info()
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+	view, err := d.View()
+	c.Assert(err, IsNil)
+	c.Assert(view.Volumes, HasLen, 2)
+	c.Assert(view.Usage["vol3"], HasLen, 2)
+	c.Assert(view.Usage["vol3"][0].SnapshotId, Equals, current.Id())
+
+	// Clean up
+	c.Assert(snap.Delete(), IsNil)
+	_, err = snap.Info()
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+	c.Assert(v.Delete(), IsNil)
+	c.Assert(clone.Delete(), IsNil)
+	c.Assert(d.Vacuum(), IsNil)
+}
@@ -0,0 +1,111 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"github.com/Kampadais/dbs"
+)
+
+// Device holding volumes and their snapshots. Methods read the metadata anew on each call, so they see changes
+// made by other processes.
+type Device interface {
+	Name() string
+	Info() (*DeviceInfo, error)
+	View() (*DeviceSnapshotView, error)
+	Volumes() ([]VolumeInfo, error)
+	Volume(name string) Volume // Not checked to exist until used
+	CreateVolume(name string, size uint64) (Volume, error)
+	Snapshot(id uint) Snapshot // Not checked to exist until used
+	FindSnapshot(snapshot string) (Snapshot, error)
+	Vacuum() error
+}
+
+type device struct {
+	name string
+	opts []dbs.Option
+}
+
+// Initialize a device, or a file of at least 100 MB.
+func Init(name string, opts ...Option) error {
+	return dbs.InitDevice(name, options(opts)...)
+}
+
+// Return an initialized device. Options apply to all operations on it, including the volumes and snapshots
+// opened for I/O.
+func Open(name string, opts ...Option) (Device, error) {
+	if _, err := dbs.GetDeviceInfo(name); err != nil {
+		return nil, err
+	}
+	return &device{name: name, opts: options(opts)}, nil
+}
+
+func (d *device) Name() string {
+	return d.name
+}
+
+func (d *device) Info() (*DeviceInfo, error) {
+	di, err := dbs.GetDeviceInfo(d.name)
+	if err != nil {
+		return nil, err
+	}
+	return newDeviceInfo(di), nil
+}
+
+// Return a consistent view of the metadata, as of a single moment.
+func (d *device) View() (*DeviceSnapshotView, error) {
+	view, err := dbs.GetDeviceSnapshotView(d.name)
+	if err != nil {
+		return nil, err
+	}
+	return newDeviceSnapshotView(view), nil
+}
+
+// Return the volumes not in the trash.
+func (d *device) Volumes() ([]VolumeInfo, error) {
+	vi, err := dbs.GetVolumeInfo(d.name)
+	if err != nil {
+		return nil, err
+	}
+	return newVolumeInfos(vi), nil
+}
+
+func (d *device) Volume(name string) Volume {
+	return &volume{device: d, name: name}
+}
+
+func (d *device) CreateVolume(name string, size uint64) (Volume, error) {
+	if _, err := dbs.CreateVolume(d.name, name, size, d.opts...); err != nil {
+		return nil, err
+	}
+	return d.Volume(name), nil
+}
+
+func (d *device) Snapshot(id uint) Snapshot {
+	return &snapshot{device: d, id: id}
+}
+
+// Return a snapshot given by id or name.
+func (d *device) FindSnapshot(snapshot string) (Snapshot, error) {
+	id, err := dbs.ResolveSnapshot(d.name, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return d.Snapshot(id), nil
+}
+
+// Reclaim the space of deleted volumes and snapshots.
+func (d *device) Vacuum() error {
+	return dbs.VacuumDevice(d.name)
+}
@@ -0,0 +1,174 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+type DeviceInfo struct {
+	UUID                   string
+	DeviceSize             uint64
+	TotalDeviceExtents     uint
+	AllocatedDeviceExtents uint
+	VolumeCount            uint
+	Maintenance            bool // Set while volumes may not be changed
+}
+
+type VolumeInfo struct {
+	VolumeName    string
+	VolumeSize    uint64
+	SnapshotId    uint
+	CreatedAt     time.Time
+	SnapshotCount uint
+	Group         string    // Empty if not in a group
+	LastWriteTime time.Time // Zero if never written
+	LastReadTime  time.Time // Zero if never read
+	RetainUntil   time.Time // Written blocks may not change before this time
+}
+
+type SnapshotInfo struct {
+	SnapshotId       uint
+	Name             string // Empty if not named
+	Description      string // Empty if not described
+	ParentSnapshotId uint
+	CreatedAt        time.Time
+	UserCreated      bool
+	Labels           map[string]string
+	VolumeName       string // Volume whose chain includes the snapshot, empty if orphaned
+	VolumeDeleted    bool   // Set if the volume is in the trash
+}
+
+type SnapshotUsage struct {
+	SnapshotId    uint
+	Extents       uint // Allocated to the snapshot
+	UniqueExtents uint // Replaced in the child snapshot, so they are freed if the snapshot is deleted
+	SharedExtents uint // Read through the child snapshot, which takes them over if the snapshot is deleted
+}
+
+// Settings for a new snapshot. The zero value describes a snapshot taken now, by automation, without labels.
+type SnapshotOptions struct {
+	CreatedAt   time.Time // Recorded creation time, defaults to now
+	UserCreated bool      // Taken on user request
+	Labels      map[string]string
+	Name        string // Unique name
+	Description string // Why the snapshot was taken
+}
+
+// Metadata of a device as of a single moment.
+type DeviceSnapshotView struct {
+	Device         *DeviceInfo
+	Volumes        []VolumeInfo               // As returned by Device.Volumes
+	DeletedVolumes []VolumeInfo               // In the trash
+	Snapshots      []SnapshotInfo             // Of all volumes, ordered by id
+	Usage          map[string][]SnapshotUsage // Of each volume not in the trash, by name
+}
+
+func newDeviceInfo(di *dbs.DeviceInfo) *DeviceInfo {
+	return &DeviceInfo{
+		UUID:                   di.UUID,
+		DeviceSize:             di.DeviceSize,
+		TotalDeviceExtents:     di.TotalDeviceExtents,
+		AllocatedDeviceExtents: di.AllocatedDeviceExtents,
+		VolumeCount:            di.VolumeCount,
+		Maintenance:            di.Maintenance,
+	}
+}
+
+func newVolumeInfo(vi *dbs.VolumeInfo) VolumeInfo {
+	return VolumeInfo{
+		VolumeName:    vi.VolumeName,
+		VolumeSize:    vi.VolumeSize,
+		SnapshotId:    vi.SnapshotId,
+		CreatedAt:     vi.CreatedAt,
+		SnapshotCount: vi.SnapshotCount,
+		Group:         vi.Group,
+		LastWriteTime: vi.LastWriteTime,
+		LastReadTime:  vi.LastReadTime,
+		RetainUntil:   vi.RetainUntil,
+	}
+}
+
+func newVolumeInfos(dvi []dbs.VolumeInfo) []VolumeInfo {
+	vi := make([]VolumeInfo, len(dvi))
+	for i := range dvi {
+		vi[i] = newVolumeInfo(&dvi[i])
+	}
+	return vi
+}
+
+func newSnapshotInfo(si *dbs.SnapshotInfo) SnapshotInfo {
+	return SnapshotInfo{
+		SnapshotId:       si.SnapshotId,
+		Name:             si.Name,
+		Description:      si.Description,
+		ParentSnapshotId: si.ParentSnapshotId,
+		CreatedAt:        si.CreatedAt,
+		UserCreated:      si.UserCreated,
+		Labels:           si.Labels,
+		VolumeName:       si.VolumeName,
+		VolumeDeleted:    si.VolumeDeleted,
+	}
+}
+
+func newSnapshotInfos(dsi []dbs.SnapshotInfo) []SnapshotInfo {
+	si := make([]SnapshotInfo, len(dsi))
+	for i := range dsi {
+		si[i] = newSnapshotInfo(&dsi[i])
+	}
+	return si
+}
+
+func newSnapshotUsage(dsu []dbs.SnapshotUsage) []SnapshotUsage {
+	su := make([]SnapshotUsage, len(dsu))
+	for i, u := range dsu {
+		su[i] = SnapshotUsage{
+			SnapshotId:    u.SnapshotId,
+			Extents:       u.Extents,
+			UniqueExtents: u.UniqueExtents,
+			SharedExtents: u.SharedExtents,
+		}
+	}
+	return su
+}
+
+func newDeviceSnapshotView(dv *dbs.DeviceSnapshotView) *DeviceSnapshotView {
+	view := &DeviceSnapshotView{
+		Device:         newDeviceInfo(dv.Device),
+		Volumes:        newVolumeInfos(dv.Volumes),
+		DeletedVolumes: newVolumeInfos(dv.DeletedVolumes),
+		Snapshots:      newSnapshotInfos(dv.Snapshots),
+		Usage:          make(map[string][]SnapshotUsage, len(dv.Usage)),
+	}
+	for name, u := range dv.Usage {
+		view.Usage[name] = newSnapshotUsage(u)
+	}
+	return view
+}
+
+func (opts *SnapshotOptions) options() *dbs.SnapshotOptions {
+	if opts == nil {
+		return nil
+	}
+	return &dbs.SnapshotOptions{
+		CreatedAt:   opts.CreatedAt,
+		UserCreated: opts.UserCreated,
+		Labels:      opts.Labels,
+		Name:        opts.Name,
+		Description: opts.Description,
+	}
+}
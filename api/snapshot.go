@@ -0,0 +1,83 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Snapshot on a device, known by id.
+type Snapshot interface {
+	Id() uint
+	Info() (*SnapshotInfo, error)
+	SetName(name string) error
+	SetDescription(description string) error
+	Clone(newName string) (Volume, error)
+	Delete() error
+	Open() (Handle, error) // Read-only
+}
+
+type snapshot struct {
+	device *device
+	id     uint
+}
+
+func (s *snapshot) Id() uint {
+	return s.id
+}
+
+func (s *snapshot) Info() (*SnapshotInfo, error) {
+	si, _, err := dbs.ListSnapshots(s.device.name, &dbs.SnapshotQuery{StartId: s.id, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(si) == 0 || si[0].SnapshotId != s.id {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, s.id)
+	}
+	info := newSnapshotInfo(&si[0])
+	return &info, nil
+}
+
+// Name the snapshot, or clear its name if empty.
+func (s *snapshot) SetName(name string) error {
+	return dbs.SetSnapshotName(s.device.name, s.id, name)
+}
+
+// Describe the snapshot, or clear its description if empty.
+func (s *snapshot) SetDescription(description string) error {
+	return dbs.SetSnapshotDescription(s.device.name, s.id, description)
+}
+
+// Create a volume holding the data of the snapshot.
+func (s *snapshot) Clone(newName string) (Volume, error) {
+	if _, err := dbs.CloneSnapshot(s.device.name, newName, s.id); err != nil {
+		return nil, err
+	}
+	return s.device.Volume(newName), nil
+}
+
+func (s *snapshot) Delete() error {
+	return dbs.DeleteSnapshot(s.device.name, s.id)
+}
+
+func (s *snapshot) Open() (Handle, error) {
+	vc, err := dbs.OpenSnapshot(s.device.name, s.id, s.device.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &handle{vc: vc}, nil
+}
@@ -0,0 +1,167 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Volume on a device, known by name.
+type Volume interface {
+	Name() string
+	Info() (*VolumeInfo, error)
+	Snapshots() ([]SnapshotInfo, error) // Starting from the current one
+	Usage() ([]SnapshotUsage, error)    // Of each snapshot, starting from the current one
+	CreateSnapshot(opts *SnapshotOptions) (Snapshot, error)
+	Rename(newName string) error
+	Delete() error
+	Open() (Handle, error)
+	OpenAsOf(t time.Time) (Handle, error) // Read-only, at the snapshot created last at or before t
+}
+
+// Volume or snapshot open for I/O. Offsets and lengths are multiples of the sector size. Handles are not safe for
+// concurrent use.
+type Handle interface {
+	ReadAt(data []byte, offset uint64) error
+	WriteAt(data []byte, offset uint64) error
+	UnmapAt(length uint64, offset uint64) error
+	Sync() error
+	Refresh() error // Pick up snapshots taken since opening
+	Close() error
+	Size() uint64
+	SnapshotId() uint
+	ReadOnly() bool
+}
+
+type volume struct {
+	device *device
+	name   string
+}
+
+func (v *volume) Name() string {
+	return v.name
+}
+
+func (v *volume) Info() (*VolumeInfo, error) {
+	vi, err := dbs.GetVolumeInfo(v.device.name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vi {
+		if vi[i].VolumeName == v.name {
+			info := newVolumeInfo(&vi[i])
+			return &info, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, v.name)
+}
+
+func (v *volume) Snapshots() ([]SnapshotInfo, error) {
+	si, err := dbs.GetSnapshotInfo(v.device.name, v.name)
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshotInfos(si), nil
+}
+
+func (v *volume) Usage() ([]SnapshotUsage, error) {
+	su, err := dbs.GetSnapshotUsage(v.device.name, v.name)
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshotUsage(su), nil
+}
+
+// Snapshot the volume. The current snapshot is frozen, and a new one, returned, becomes current, with the labels
+// and name in the options. Options may be nil.
+func (v *volume) CreateSnapshot(opts *SnapshotOptions) (Snapshot, error) {
+	id, err := dbs.CreateSnapshot(v.device.name, v.name, opts.options())
+	if err != nil {
+		return nil, err
+	}
+	return v.device.Snapshot(id), nil
+}
+
+func (v *volume) Rename(newName string) error {
+	if err := dbs.RenameVolume(v.device.name, v.name, newName); err != nil {
+		return err
+	}
+	v.name = newName
+	return nil
+}
+
+// Delete the volume, moving it to the trash if the device keeps one.
+func (v *volume) Delete() error {
+	return dbs.DeleteVolume(v.device.name, v.name)
+}
+
+func (v *volume) Open() (Handle, error) {
+	vc, err := dbs.OpenVolume(v.device.name, v.name, v.device.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &handle{vc: vc}, nil
+}
+
+func (v *volume) OpenAsOf(t time.Time) (Handle, error) {
+	vc, err := dbs.OpenVolumeAsOf(v.device.name, v.name, t, v.device.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &handle{vc: vc}, nil
+}
+
+type handle struct {
+	vc *dbs.VolumeContext
+}
+
+func (h *handle) ReadAt(data []byte, offset uint64) error {
+	return h.vc.ReadAt(data, offset)
+}
+
+func (h *handle) WriteAt(data []byte, offset uint64) error {
+	return h.vc.WriteAt(data, offset, true)
+}
+
+func (h *handle) UnmapAt(length uint64, offset uint64) error {
+	return h.vc.UnmapAt(length, offset)
+}
+
+func (h *handle) Sync() error {
+	return h.vc.Sync()
+}
+
+func (h *handle) Refresh() error {
+	return h.vc.Refresh()
+}
+
+func (h *handle) Close() error {
+	return h.vc.CloseVolume()
+}
+
+func (h *handle) Size() uint64 {
+	return h.vc.VolumeSize()
+}
+
+func (h *handle) SnapshotId() uint {
+	return h.vc.SnapshotId()
+}
+
+func (h *handle) ReadOnly() bool {
+	return h.vc.ReadOnly()
+}
@@ -0,0 +1,51 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Storage holding a device. Offsets and lengths of data are multiples of BLOCK_SIZE, and buffers are aligned
+// with AlignedBlock.
+type BlockBackend = core.BlockBackend
+
+// Implemented by backends that coordinate metadata updates between processes sharing the device. Locks are
+// taken per handle, and taking a lock already held converts it, as with flock. Backends without it are
+// locked within the process only.
+type BackendLocker = core.BackendLocker
+
+// Implemented by backends with a cache that writes may stay in. Flush is called after each metadata update
+// and by VolumeContext.Sync, while Sync is called when the device is closed. Backends without it are synced.
+type BackendFlusher = core.BackendFlusher
+
+// Implemented by backends that can zero a range without writing zeroes to it, which is used to initialize the
+// extent metadata. ZeroRange returns false if the range could not be zeroed this way, in which case zeroes are
+// written.
+type BackendZeroer = core.BackendZeroer
+
+// Implemented by backends on block devices that can report the identity and state of the device. Health returns
+// nil if the backend is not on a block device.
+type BackendHealthReporter = core.BackendHealthReporter
+
+// Open the backend for a device name. Called for each context opened.
+type BackendOpener = core.BackendOpener
+
+// Register a backend for device names of the form "scheme://...", replacing any existing one. Names without
+// a scheme are local files or raw devices, and "mem://" and "nbd://" names are handled by the built-in memory
+// and NBD client backends. "mirror://" names are always handled by the built-in mirroring backend.
+func RegisterBackend(scheme string, opener BackendOpener) {
+	core.RegisterBackend(scheme, opener)
+}
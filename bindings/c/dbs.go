@@ -0,0 +1,281 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+enum {
+	DBS_OK = 0,
+	DBS_ERR_FAILURE = 1,
+	DBS_ERR_NOT_FOUND = 2,
+	DBS_ERR_NO_SPACE = 3,
+	DBS_ERR_CORRUPTED = 4,
+	DBS_ERR_EXISTS = 5,
+	DBS_ERR_INVALID_ARGUMENT = 6,
+	DBS_ERR_READ_ONLY = 7,
+	DBS_ERR_METADATA_NEEDS_UPDATE = 8,
+	DBS_ERR_CLOSED = 9,
+};
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/Kampadais/dbs"
+)
+
+var errorCodes = []struct {
+	err  error
+	code C.int
+}{
+	{dbs.ErrVolumeNotFound, C.DBS_ERR_NOT_FOUND},
+	{dbs.ErrSnapshotNotFound, C.DBS_ERR_NOT_FOUND},
+	{dbs.ErrNoSpace, C.DBS_ERR_NO_SPACE},
+	{dbs.ErrCorrupted, C.DBS_ERR_CORRUPTED},
+	{dbs.ErrVolumeExists, C.DBS_ERR_EXISTS},
+	{dbs.ErrDeviceInitialized, C.DBS_ERR_EXISTS},
+	{dbs.ErrInvalidVolumeName, C.DBS_ERR_INVALID_ARGUMENT},
+	{dbs.ErrReadOnly, C.DBS_ERR_READ_ONLY},
+	{dbs.ErrRetained, C.DBS_ERR_READ_ONLY},
+	{dbs.ErrMetadataNeedsUpdate, C.DBS_ERR_METADATA_NEEDS_UPDATE},
+	{dbs.ErrVolumeClosed, C.DBS_ERR_CLOSED},
+}
+
+// Convert an error to its code, passing the message to the caller.
+func result(err error, cerr **C.char) C.int {
+	if err == nil {
+		return C.DBS_OK
+	}
+	if cerr != nil {
+		*cerr = C.CString(err.Error())
+	}
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return C.DBS_ERR_FAILURE
+}
+
+// Pass a query result to the caller as JSON.
+func jsonResult(v any, err error, cjson **C.char, cerr **C.char) C.int {
+	if err != nil {
+		return result(err, cerr)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return result(err, cerr)
+	}
+	*cjson = C.CString(string(data))
+	return C.DBS_OK
+}
+
+var (
+	handlesMu  sync.Mutex
+	handles    = make(map[uint64]*dbs.VolumeContext)
+	nextHandle uint64
+)
+
+func addHandle(vc *dbs.VolumeContext, handle *C.uint64_t) {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	nextHandle++
+	handles[nextHandle] = vc
+	*handle = C.uint64_t(nextHandle)
+}
+
+func getHandle(handle C.uint64_t) (*dbs.VolumeContext, error) {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	vc, ok := handles[uint64(handle)]
+	if !ok {
+		return nil, fmt.Errorf("%w: handle %v", dbs.ErrVolumeClosed, handle)
+	}
+	return vc, nil
+}
+
+// View C memory as a byte slice.
+func bytesOf(buf unsafe.Pointer, length C.uint64_t) []byte {
+	return unsafe.Slice((*byte)(buf), int(length))
+}
+
+//export dbs_free
+func dbs_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+//export dbs_init_device
+func dbs_init_device(device *C.char, cerr **C.char) C.int {
+	return result(dbs.InitDevice(C.GoString(device)), cerr)
+}
+
+// Initialize a device even if it already is, deleting all its volumes.
+//
+//export dbs_force_init_device
+func dbs_force_init_device(device *C.char, cerr **C.char) C.int {
+	return result(dbs.InitDevice(C.GoString(device), dbs.WithForce()), cerr)
+}
+
+//export dbs_vacuum_device
+func dbs_vacuum_device(device *C.char, cerr **C.char) C.int {
+	return result(dbs.VacuumDevice(C.GoString(device)), cerr)
+}
+
+//export dbs_get_device_info
+func dbs_get_device_info(device *C.char, cjson **C.char, cerr **C.char) C.int {
+	di, err := dbs.GetDeviceInfo(C.GoString(device))
+	return jsonResult(di, err, cjson, cerr)
+}
+
+//export dbs_get_volume_info
+func dbs_get_volume_info(device *C.char, cjson **C.char, cerr **C.char) C.int {
+	vi, err := dbs.GetVolumeInfo(C.GoString(device))
+	return jsonResult(vi, err, cjson, cerr)
+}
+
+//export dbs_get_snapshot_info
+func dbs_get_snapshot_info(device *C.char, volumeName *C.char, cjson **C.char, cerr **C.char) C.int {
+	si, err := dbs.GetSnapshotInfo(C.GoString(device), C.GoString(volumeName))
+	return jsonResult(si, err, cjson, cerr)
+}
+
+//export dbs_list_all_snapshots
+func dbs_list_all_snapshots(device *C.char, cjson **C.char, cerr **C.char) C.int {
+	si, err := dbs.ListAllSnapshots(C.GoString(device))
+	return jsonResult(si, err, cjson, cerr)
+}
+
+//export dbs_create_volume
+func dbs_create_volume(device *C.char, volumeName *C.char, volumeSize C.uint64_t, cerr **C.char) C.int {
+	_, err := dbs.CreateVolume(C.GoString(device), C.GoString(volumeName), uint64(volumeSize))
+	return result(err, cerr)
+}
+
+//export dbs_rename_volume
+func dbs_rename_volume(device *C.char, volumeName *C.char, newVolumeName *C.char, cerr **C.char) C.int {
+	return result(dbs.RenameVolume(C.GoString(device), C.GoString(volumeName), C.GoString(newVolumeName)), cerr)
+}
+
+//export dbs_delete_volume
+func dbs_delete_volume(device *C.char, volumeName *C.char, cerr **C.char) C.int {
+	return result(dbs.DeleteVolume(C.GoString(device), C.GoString(volumeName)), cerr)
+}
+
+//export dbs_create_snapshot
+func dbs_create_snapshot(device *C.char, volumeName *C.char, snapshotId *C.uint64_t, cerr **C.char) C.int {
+	sid, err := dbs.CreateSnapshot(C.GoString(device), C.GoString(volumeName), &dbs.SnapshotOptions{UserCreated: true})
+	if err == nil && snapshotId != nil {
+		*snapshotId = C.uint64_t(sid)
+	}
+	return result(err, cerr)
+}
+
+//export dbs_clone_snapshot
+func dbs_clone_snapshot(device *C.char, newVolumeName *C.char, snapshotId C.uint64_t, cerr **C.char) C.int {
+	_, err := dbs.CloneSnapshot(C.GoString(device), C.GoString(newVolumeName), uint(snapshotId))
+	return result(err, cerr)
+}
+
+//export dbs_delete_snapshot
+func dbs_delete_snapshot(device *C.char, snapshotId C.uint64_t, cerr **C.char) C.int {
+	return result(dbs.DeleteSnapshot(C.GoString(device), uint(snapshotId)), cerr)
+}
+
+//export dbs_open_volume
+func dbs_open_volume(device *C.char, volumeName *C.char, handle *C.uint64_t, cerr **C.char) C.int {
+	vc, err := dbs.OpenVolume(C.GoString(device), C.GoString(volumeName))
+	if err != nil {
+		return result(err, cerr)
+	}
+	addHandle(vc, handle)
+	return C.DBS_OK
+}
+
+//export dbs_open_snapshot
+func dbs_open_snapshot(device *C.char, snapshotId C.uint64_t, handle *C.uint64_t, cerr **C.char) C.int {
+	vc, err := dbs.OpenSnapshot(C.GoString(device), uint(snapshotId))
+	if err != nil {
+		return result(err, cerr)
+	}
+	addHandle(vc, handle)
+	return C.DBS_OK
+}
+
+//export dbs_close_volume
+func dbs_close_volume(handle C.uint64_t, cerr **C.char) C.int {
+	handlesMu.Lock()
+	vc, ok := handles[uint64(handle)]
+	delete(handles, uint64(handle))
+	handlesMu.Unlock()
+	if !ok {
+		return result(fmt.Errorf("%w: handle %v", dbs.ErrVolumeClosed, handle), cerr)
+	}
+	return result(vc.CloseVolume(), cerr)
+}
+
+//export dbs_volume_size
+func dbs_volume_size(handle C.uint64_t, volumeSize *C.uint64_t, cerr **C.char) C.int {
+	vc, err := getHandle(handle)
+	if err != nil {
+		return result(err, cerr)
+	}
+	*volumeSize = C.uint64_t(vc.VolumeSize())
+	return C.DBS_OK
+}
+
+//export dbs_read_at
+func dbs_read_at(handle C.uint64_t, buf unsafe.Pointer, length C.uint64_t, offset C.uint64_t, cerr **C.char) C.int {
+	vc, err := getHandle(handle)
+	if err != nil {
+		return result(err, cerr)
+	}
+	return result(vc.ReadAt(bytesOf(buf, length), uint64(offset)), cerr)
+}
+
+//export dbs_write_at
+func dbs_write_at(handle C.uint64_t, buf unsafe.Pointer, length C.uint64_t, offset C.uint64_t, cerr **C.char) C.int {
+	vc, err := getHandle(handle)
+	if err != nil {
+		return result(err, cerr)
+	}
+	return result(vc.WriteAt(bytesOf(buf, length), uint64(offset), true), cerr)
+}
+
+//export dbs_unmap_at
+func dbs_unmap_at(handle C.uint64_t, length C.uint64_t, offset C.uint64_t, cerr **C.char) C.int {
+	vc, err := getHandle(handle)
+	if err != nil {
+		return result(err, cerr)
+	}
+	return result(vc.UnmapAt(uint64(length), uint64(offset)), cerr)
+}
+
+//export dbs_sync
+func dbs_sync(handle C.uint64_t, cerr **C.char) C.int {
+	vc, err := getHandle(handle)
+	if err != nil {
+		return result(err, cerr)
+	}
+	return result(vc.Sync(), cerr)
+}
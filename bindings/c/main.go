@@ -0,0 +1,24 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// C bindings for DBS. Build the shared library and header with:
+//
+//	go build -buildmode=c-shared -o libdbs.so ./bindings/c
+//
+// Functions return DBS_OK or an error code, and set *err, unless it is NULL, to a message to be released with
+// dbs_free. Queries return JSON documents with the fields of the Go info structures, also released with
+// dbs_free. Open volumes are referred to by handles.
+package main
+
+func main() {}
@@ -0,0 +1,186 @@
+# Copyright © 2024 FORTH-ICS
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+"""Python bindings for DBS, wrapping the shared library built from bindings/c.
+
+The library is loaded from the path in the DBS_LIBRARY environment variable, or
+as libdbs.so from the library search path.
+"""
+
+import ctypes
+import json
+import os
+
+_lib = ctypes.CDLL(os.environ.get('DBS_LIBRARY', 'libdbs.so'))
+
+_c_str = ctypes.c_char_p
+_c_err = ctypes.POINTER(ctypes.c_void_p)
+_c_u64 = ctypes.c_uint64
+_c_u64_p = ctypes.POINTER(ctypes.c_uint64)
+
+for _name, _args in {
+    'dbs_init_device': [_c_str, _c_err],
+    'dbs_force_init_device': [_c_str, _c_err],
+    'dbs_vacuum_device': [_c_str, _c_err],
+    'dbs_get_device_info': [_c_str, _c_err, _c_err],
+    'dbs_get_volume_info': [_c_str, _c_err, _c_err],
+    'dbs_get_snapshot_info': [_c_str, _c_str, _c_err, _c_err],
+    'dbs_list_all_snapshots': [_c_str, _c_err, _c_err],
+    'dbs_create_volume': [_c_str, _c_str, _c_u64, _c_err],
+    'dbs_rename_volume': [_c_str, _c_str, _c_str, _c_err],
+    'dbs_delete_volume': [_c_str, _c_str, _c_err],
+    'dbs_create_snapshot': [_c_str, _c_str, _c_u64_p, _c_err],
+    'dbs_clone_snapshot': [_c_str, _c_str, _c_u64, _c_err],
+    'dbs_delete_snapshot': [_c_str, _c_u64, _c_err],
+    'dbs_open_volume': [_c_str, _c_str, _c_u64_p, _c_err],
+    'dbs_open_snapshot': [_c_str, _c_u64, _c_u64_p, _c_err],
+    'dbs_close_volume': [_c_u64, _c_err],
+    'dbs_volume_size': [_c_u64, _c_u64_p, _c_err],
+    'dbs_read_at': [_c_u64, ctypes.c_void_p, _c_u64, _c_u64, _c_err],
+    'dbs_write_at': [_c_u64, ctypes.c_void_p, _c_u64, _c_u64, _c_err],
+    'dbs_unmap_at': [_c_u64, _c_u64, _c_u64, _c_err],
+    'dbs_sync': [_c_u64, _c_err],
+}.items():
+    _fn = getattr(_lib, _name)
+    _fn.argtypes = _args
+    _fn.restype = ctypes.c_int
+_lib.dbs_free.argtypes = [ctypes.c_void_p]
+_lib.dbs_free.restype = None
+
+# Error codes, as in libdbs.h
+ERR_FAILURE = 1
+ERR_NOT_FOUND = 2
+ERR_NO_SPACE = 3
+ERR_CORRUPTED = 4
+ERR_EXISTS = 5
+ERR_INVALID_ARGUMENT = 6
+ERR_READ_ONLY = 7
+ERR_METADATA_NEEDS_UPDATE = 8
+ERR_CLOSED = 9
+
+
+class DBSError(Exception):
+    def __init__(self, code, message):
+        super().__init__(message)
+        self.code = code
+
+
+def _take_string(p):
+    try:
+        return ctypes.string_at(p.value).decode()
+    finally:
+        _lib.dbs_free(p)
+
+
+def _call(fn, *args):
+    err = ctypes.c_void_p()
+    code = fn(*args, ctypes.byref(err))
+    if code != 0:
+        message = _take_string(err) if err.value else 'error %d' % code
+        raise DBSError(code, message)
+
+
+def _query(fn, *args):
+    out = ctypes.c_void_p()
+    _call(fn, *args, ctypes.byref(out))
+    return json.loads(_take_string(out))
+
+
+class Device:
+    """A DBS device, named as for the Go API (file, raw device, mem:// or nbd://)."""
+
+    def __init__(self, name):
+        self.name = name
+        self._name = name.encode()
+
+    def init(self, force=False):
+        _call(_lib.dbs_force_init_device if force else _lib.dbs_init_device, self._name)
+
+    def vacuum(self):
+        _call(_lib.dbs_vacuum_device, self._name)
+
+    def info(self):
+        return _query(_lib.dbs_get_device_info, self._name)
+
+    def volumes(self):
+        return _query(_lib.dbs_get_volume_info, self._name) or []
+
+    def snapshots(self, volume_name=None):
+        """Return the snapshots of a volume, or of all volumes if no name is given."""
+        if volume_name is None:
+            return _query(_lib.dbs_list_all_snapshots, self._name) or []
+        return _query(_lib.dbs_get_snapshot_info, self._name, volume_name.encode())
+
+    def create_volume(self, volume_name, volume_size):
+        _call(_lib.dbs_create_volume, self._name, volume_name.encode(), volume_size)
+
+    def rename_volume(self, volume_name, new_volume_name):
+        _call(_lib.dbs_rename_volume, self._name, volume_name.encode(), new_volume_name.encode())
+
+    def delete_volume(self, volume_name):
+        _call(_lib.dbs_delete_volume, self._name, volume_name.encode())
+
+    def create_snapshot(self, volume_name):
+        snapshot_id = ctypes.c_uint64()
+        _call(_lib.dbs_create_snapshot, self._name, volume_name.encode(), ctypes.byref(snapshot_id))
+        return snapshot_id.value
+
+    def clone_snapshot(self, new_volume_name, snapshot_id):
+        _call(_lib.dbs_clone_snapshot, self._name, new_volume_name.encode(), snapshot_id)
+
+    def delete_snapshot(self, snapshot_id):
+        _call(_lib.dbs_delete_snapshot, self._name, snapshot_id)
+
+    def open_volume(self, volume_name):
+        handle = ctypes.c_uint64()
+        _call(_lib.dbs_open_volume, self._name, volume_name.encode(), ctypes.byref(handle))
+        return Volume(handle.value)
+
+    def open_snapshot(self, snapshot_id):
+        handle = ctypes.c_uint64()
+        _call(_lib.dbs_open_snapshot, self._name, snapshot_id, ctypes.byref(handle))
+        return Volume(handle.value)
+
+
+class Volume:
+    """An open volume or snapshot. Usable as a context manager, closing it on exit."""
+
+    def __init__(self, handle):
+        self._handle = handle
+        size = ctypes.c_uint64()
+        _call(_lib.dbs_volume_size, handle, ctypes.byref(size))
+        self.size = size.value
+
+    def read(self, length, offset):
+        buf = ctypes.create_string_buffer(length)
+        _call(_lib.dbs_read_at, self._handle, buf, length, offset)
+        return buf.raw
+
+    def write(self, data, offset):
+        _call(_lib.dbs_write_at, self._handle, data, len(data), offset)
+
+    def unmap(self, length, offset):
+        _call(_lib.dbs_unmap_at, self._handle, length, offset)
+
+    def sync(self):
+        _call(_lib.dbs_sync, self._handle)
+
+    def close(self):
+        _call(_lib.dbs_close_volume, self._handle)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
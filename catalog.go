@@ -0,0 +1,43 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Version of the catalogs returned by ExportCatalog. Version 2 adds snapshot descriptions.
+const CATALOG_VERSION = core.CATALOG_VERSION
+
+// Snapshot metadata of a device, so that external inventories can be reconciled with it, and labels and names
+// carried over to a copy of the device. Catalogs are meant to be stored as JSON.
+type SnapshotCatalog = core.SnapshotCatalog
+
+// Snapshots of a catalog imported with ImportCatalog.
+type CatalogImport = core.CatalogImport
+
+// Return the metadata of all snapshots on the device.
+func ExportCatalog(device string) (*SnapshotCatalog, error) {
+	return core.ExportCatalog(device)
+}
+
+// Replace the labels, names and descriptions of snapshots with those in a catalog, keeping descriptions if the
+// catalog predates them. Snapshots are matched by id, parent and creation time, which are kept when a device is
+// copied as is, and others are skipped. Snapshots not in the catalog are left alone. Either all matching
+// snapshots are updated, or none is, if names clash with those of snapshots not updated, or labels do not fit in
+// the label region.
+func ImportCatalog(device string, catalog *SnapshotCatalog) (*CatalogImport, error) {
+	return core.ImportCatalog(device, catalog)
+}
@@ -0,0 +1,293 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/jawher/mow.cli"
+	"gopkg.in/yaml.v3"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Label marking snapshots taken by a manifest schedule. The value is the schedule interval.
+const SCHEDULE_LABEL = "dbsctl.schedule"
+
+// Desired state of a device. For example:
+//
+//	prune: true
+//	volumes:
+//	  - name: db1
+//	    size: 10G
+//	    previous_name: db     # renamed if it exists
+//	    allocation_policy: contiguous
+//	    tier: fast
+//	    max_iops: 1000
+//	    max_bandwidth: 100M
+//	    snapshots:
+//	      every: 24h          # snapshot taken by apply when the last is older
+//	      keep: 7             # older scheduled snapshots are deleted
+//
+// Volume sizes cannot be changed. Unset policies, tiers and limits are left as they are.
+type manifest struct {
+	Volumes []manifestVolume `yaml:"volumes"`
+	Prune   bool             `yaml:"prune"` // Delete volumes not in the manifest
+}
+
+type manifestVolume struct {
+	Name             string            `yaml:"name"`
+	Size             string            `yaml:"size"`
+	PreviousName     string            `yaml:"previous_name"`
+	AllocationPolicy string            `yaml:"allocation_policy"`
+	Tier             string            `yaml:"tier"`
+	MaxIops          *uint             `yaml:"max_iops"`
+	MaxBandwidth     *string           `yaml:"max_bandwidth"`
+	Snapshots        *manifestSchedule `yaml:"snapshots"`
+}
+
+type manifestSchedule struct {
+	Every time.Duration `yaml:"every"`
+	Keep  uint          `yaml:"keep"` // Zero to keep all
+}
+
+// A change to apply to the device.
+type action struct {
+	desc string
+	run  func() error
+}
+
+func loadManifest(name string) (*manifest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, mv := range m.Volumes {
+		if err := dbs.ValidateVolumeName(mv.Name); err != nil {
+			return nil, fmt.Errorf("volume %q: %w", mv.Name, err)
+		}
+		if names[mv.Name] {
+			return nil, fmt.Errorf("volume %v listed more than once", mv.Name)
+		}
+		names[mv.Name] = true
+		if mv.Snapshots != nil && mv.Snapshots.Every <= 0 {
+			return nil, fmt.Errorf("volume %v: snapshot interval must be positive", mv.Name)
+		}
+	}
+	return m, nil
+}
+
+// Compute the actions bringing the device to the state described by the manifest.
+func planManifest(m *manifest, now time.Time) ([]action, error) {
+	vi, err := dbs.GetVolumeInfo(*device)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*dbs.VolumeInfo, len(vi))
+	for i := range vi {
+		existing[vi[i].VolumeName] = &vi[i]
+	}
+	var renames, deletes, creates, updates []action
+	keep := make(map[string]bool)
+	for _, mv := range m.Volumes {
+		mv := mv
+		bytesSize, err := units.FromHumanSize(mv.Size)
+		if err != nil {
+			return nil, fmt.Errorf("volume %v: %w", mv.Name, err)
+		}
+		volumeSize := (uint64(bytesSize) / dbs.EXTENT_SIZE) * dbs.EXTENT_SIZE
+		keep[mv.Name] = true
+		v := existing[mv.Name]
+		if v == nil && mv.PreviousName != "" && existing[mv.PreviousName] != nil {
+			v = existing[mv.PreviousName]
+			keep[mv.PreviousName] = true
+			renames = append(renames, action{
+				desc: fmt.Sprintf("rename volume %v to %v", mv.PreviousName, mv.Name),
+				run:  func() error { return dbs.RenameVolume(*device, mv.PreviousName, mv.Name) },
+			})
+		}
+		if v == nil {
+			creates = append(creates, action{
+				desc: fmt.Sprintf("create volume %v of %v", mv.Name, units.HumanSize(float64(volumeSize))),
+				run: func() error {
+					_, err := dbs.CreateVolume(*device, mv.Name, volumeSize)
+					return err
+				},
+			})
+		} else if v.VolumeSize != volumeSize {
+			return nil, fmt.Errorf("volume %v: cannot change size from %v to %v", mv.Name, units.HumanSize(float64(v.VolumeSize)), units.HumanSize(float64(volumeSize)))
+		}
+		actions, err := planVolumeSettings(&mv, v)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, actions...)
+		if mv.Snapshots != nil {
+			actions, err := planSchedule(&mv, v, now)
+			if err != nil {
+				return nil, err
+			}
+			updates = append(updates, actions...)
+		}
+	}
+	if m.Prune {
+		for i := range vi {
+			volumeName := vi[i].VolumeName
+			if keep[volumeName] {
+				continue
+			}
+			deletes = append(deletes, action{
+				desc: fmt.Sprintf("delete volume %v", volumeName),
+				run:  func() error { return dbs.DeleteVolume(*device, volumeName) },
+			})
+		}
+	}
+	// Deletes go first to free space and names
+	return append(append(append(deletes, renames...), creates...), updates...), nil
+}
+
+// Plan allocation policy, tier and QoS changes for a volume, which may not exist yet.
+func planVolumeSettings(mv *manifestVolume, v *dbs.VolumeInfo) ([]action, error) {
+	var actions []action
+	if mv.AllocationPolicy != "" {
+		policy, err := dbs.ParseAllocationPolicy(mv.AllocationPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("volume %v: %w", mv.Name, err)
+		}
+		if v == nil || v.AllocationPolicy != dbs.AllocationPolicyName(policy) {
+			actions = append(actions, action{
+				desc: fmt.Sprintf("set allocation policy of volume %v to %v", mv.Name, mv.AllocationPolicy),
+				run:  func() error { return dbs.SetVolumeAllocationPolicy(*device, mv.Name, policy) },
+			})
+		}
+	}
+	if mv.Tier != "" {
+		tier, err := dbs.ParseTier(mv.Tier)
+		if err != nil {
+			return nil, fmt.Errorf("volume %v: %w", mv.Name, err)
+		}
+		if v == nil || v.Tier != dbs.TierName(tier) {
+			actions = append(actions, action{
+				desc: fmt.Sprintf("set tier of volume %v to %v", mv.Name, mv.Tier),
+				run:  func() error { return dbs.SetVolumeTier(*device, mv.Name, tier) },
+			})
+		}
+	}
+	if mv.MaxIops == nil && mv.MaxBandwidth == nil {
+		return actions, nil
+	}
+	var maxIops uint
+	var maxBandwidth uint64
+	if v != nil {
+		maxIops, maxBandwidth = v.MaxIops, v.MaxBandwidth
+	}
+	if mv.MaxIops != nil {
+		maxIops = *mv.MaxIops
+	}
+	if mv.MaxBandwidth != nil {
+		bytesPerSecond, err := units.FromHumanSize(*mv.MaxBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("volume %v: %w", mv.Name, err)
+		}
+		maxBandwidth = uint64(bytesPerSecond)
+	}
+	if v == nil || v.MaxIops != maxIops || v.MaxBandwidth != maxBandwidth {
+		actions = append(actions, action{
+			desc: fmt.Sprintf("set qos of volume %v to %v iops, %v bandwidth", mv.Name, humanLimit(uint64(maxIops), false), humanLimit(maxBandwidth, true)),
+			run:  func() error { return dbs.SetVolumeQoS(*device, mv.Name, maxIops, maxBandwidth) },
+		})
+	}
+	return actions, nil
+}
+
+// Plan the scheduled snapshot of a volume, if due, and the deletion of scheduled snapshots beyond the count to
+// keep. The volume may not exist yet, or be renamed first.
+func planSchedule(mv *manifestVolume, v *dbs.VolumeInfo, now time.Time) ([]action, error) {
+	var scheduled []dbs.SnapshotInfo
+	if v != nil {
+		// Newest first, following the chain
+		si, err := dbs.GetSnapshotInfo(*device, v.VolumeName)
+		if err != nil {
+			return nil, err
+		}
+		for i := range si {
+			if _, ok := si[i].Labels[SCHEDULE_LABEL]; ok {
+				scheduled = append(scheduled, si[i])
+			}
+		}
+	}
+	var actions []action
+	due := len(scheduled) == 0 || now.Sub(scheduled[0].CreatedAt) >= mv.Snapshots.Every
+	if due {
+		actions = append(actions, action{
+			desc: fmt.Sprintf("snapshot volume %v", mv.Name),
+			run: func() error {
+				_, err := dbs.CreateSnapshot(*device, mv.Name, &dbs.SnapshotOptions{
+					CreatedAt: now,
+					Labels:    map[string]string{SCHEDULE_LABEL: mv.Snapshots.Every.String()},
+				})
+				return err
+			},
+		})
+	}
+	if mv.Snapshots.Keep == 0 {
+		return actions, nil
+	}
+	kept := int(mv.Snapshots.Keep)
+	if due {
+		kept--
+	}
+	for i := max(kept, 0); i < len(scheduled); i++ {
+		snapshotId := scheduled[i].SnapshotId
+		actions = append(actions, action{
+			desc: fmt.Sprintf("delete snapshot %v of volume %v", snapshotId, mv.Name),
+			run:  func() error { return dbs.DeleteSnapshot(*device, snapshotId) },
+		})
+	}
+	return actions, nil
+}
+
+func cmdApply(cmd *cli.Cmd) {
+	cmd.Spec = "-f [--dry-run]"
+	file := cmd.StringOpt("f file", "", "Manifest describing volumes and snapshot schedules (YAML)")
+	dryRun := cmd.BoolOpt("dry-run", false, "Print changes without applying them")
+	cmd.Action = func() {
+		m, err := loadManifest(*file)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		actions, err := planManifest(m, time.Now())
+		if err != nil {
+			fail(err)
+		}
+		for _, a := range actions {
+			fmt.Println(a.desc)
+			if *dryRun {
+				continue
+			}
+			if err := a.run(); err != nil {
+				fail(err)
+			}
+		}
+	}
+}
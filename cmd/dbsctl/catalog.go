@@ -0,0 +1,78 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jawher/mow.cli"
+
+	"github.com/Kampadais/dbs"
+)
+
+func cmdExportCatalog(cmd *cli.Cmd) {
+	cmd.Spec = "[-f]"
+	file := cmd.StringOpt("f file", "", "Write the catalog to this file instead of the standard output")
+	cmd.Action = func() {
+		catalog, err := dbs.ExportCatalog(*device)
+		if err != nil {
+			fail(err)
+		}
+		data, err := json.MarshalIndent(catalog, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+		data = append(data, '\n')
+		if *file == "" {
+			_, err = os.Stdout.Write(data)
+		} else {
+			err = os.WriteFile(*file, data, 0644)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdImportCatalog(cmd *cli.Cmd) {
+	file := cmd.StringArg("FILE", "", "Catalog written by export_catalog, - for the standard input")
+	cmd.Action = func() {
+		var data []byte
+		var err error
+		if *file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*file)
+		}
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		var catalog dbs.SnapshotCatalog
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			fail(invalidArgument(fmt.Errorf("invalid catalog: %w", err)))
+		}
+		result, err := dbs.ImportCatalog(*device, &catalog)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Applied to %v snapshots\n", len(result.Applied))
+		for _, sid := range result.Skipped {
+			fmt.Printf("Skipped snapshot %v, not on the device with the same parent and creation time\n", sid)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+
+	"github.com/Kampadais/dbs/pkg/client"
+)
+
+// List the NBD connections to the dbssrv serving the device, with the requests of each, to find the clients
+// loading the device or failing. Connections are only known to the daemon, so the management API is needed.
+func cmdClients(cmd *cli.Cmd) {
+	cmd.Spec = "--api=<url> [--api-key=<key>]"
+	apiURL := cmd.StringOpt("api", "", "Management API URL of the dbssrv serving the device")
+	apiKey := cmd.StringOpt("api-key", "", "API key for the management API")
+	cmd.Action = func() {
+		cs, err := client.New(*apiURL, client.WithAPIKey(*apiKey)).ListConnections()
+		if err != nil {
+			fail(err)
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendRow(table.Row{"id", "remote_addr", "export", "connected", "reads", "writes", "flushes", "errors", "bytes_read", "bytes_written", "read_latency", "write_latency", "flush_latency", "max_latency"})
+		t.AppendSeparator()
+		for i := range cs {
+			t.AppendRow(table.Row{
+				cs[i].Id,
+				cs[i].RemoteAddr,
+				orDash(cs[i].Export),
+				time.Since(cs[i].ConnectedAt).Round(time.Second),
+				cs[i].Reads,
+				cs[i].Writes,
+				cs[i].Flushes,
+				cs[i].Errors,
+				units.HumanSize(float64(cs[i].BytesRead)),
+				units.HumanSize(float64(cs[i].BytesWritten)),
+				cs[i].ReadLatency,
+				cs[i].WriteLatency,
+				cs[i].FlushLatency,
+				cs[i].MaxLatency,
+			})
+		}
+		t.Render()
+	}
+}
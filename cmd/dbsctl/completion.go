@@ -0,0 +1,266 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Arguments of each command, by kind, for completion. Kinds are "volumes", "deleted_volumes", "snapshots",
+// "groups", "policies", "tiers", "switches" (on or off) and "files", while other arguments are not completed.
+// Commands must be listed to be completed.
+var commandArgs = map[string][]string{
+	"get_device_info":              nil,
+	"get_volume_info":              nil,
+	"get_snapshot_info":            {"volumes"},
+	"snapshot_usage":               {"volumes"},
+	"list_all_snapshots":           nil,
+	"init_device":                  nil,
+	"vacuum_device":                nil,
+	"export_catalog":               nil,
+	"import_catalog":               {"files"},
+	"scrub_device":                 nil,
+	"watch":                        nil,
+	"clients":                      nil,
+	"resync_mirror":                nil,
+	"defragment_volume":            {"volumes"},
+	"jobs":                         nil,
+	"resume_job":                   nil,
+	"cancel_job":                   nil,
+	"relocate_extent":              nil,
+	"preallocate_volume":           {"volumes"},
+	"set_device_allocation_policy": {"policies"},
+	"set_device_maintenance":       {"switches"},
+	"set_device_extent_times":      {"switches"},
+	"set_device_fast_region":       nil,
+	"rebalance_tiers":              nil,
+	"create_volume":                nil,
+	"rename_volume":                {"volumes"},
+	"concat_volumes":               {"", "volumes", "volumes"},
+	"split_volume":                 {"volumes"},
+	"set_volume_allocation_policy": {"volumes", "policies"},
+	"set_volume_tier":              {"volumes", "tiers"},
+	"set_volume_retention":         {"volumes"},
+	"set_volume_qos":               {"volumes"},
+	"reset_volume_errors":          {"volumes"},
+	"set_volume_group":             {"volumes", "groups"},
+	"set_group_quota":              {"groups"},
+	"get_group_info":               nil,
+	"create_snapshot":              {"volumes"},
+	"snapshot_group":               {"groups"},
+	"snapshot_and_clone":           {"volumes"},
+	"set_snapshot_name":            {"snapshots"},
+	"set_snapshot_description":     {"snapshots"},
+	"clone_snapshot":               {"", "snapshots"},
+	"provision":                    nil,
+	"estimate_clone_space":         {"snapshots"},
+	"delete_volume":                {"volumes"},
+	"delete_snapshot":              {"snapshots"},
+	"delete_snapshots":             {"volumes"},
+	"delete_group":                 {"groups"},
+	"list_deleted_volumes":         nil,
+	"undelete_volume":              {"deleted_volumes"},
+	"purge_volume":                 {"deleted_volumes"},
+	"set_trash_retention":          nil,
+	"apply":                        nil,
+	"extract":                      {"snapshots", "files"},
+	"inspect":                      {"inspect"},
+}
+
+var inspectCommands = []string{"superblock", "volumes", "snapshots", "labels", "stats", "extents"}
+
+// Options taking a value, which is skipped when counting arguments.
+var valueOpts = map[string]bool{
+	"-l": true, "--label": true,
+	"-f": true, "--file": true,
+	"-t": true, "--fstype": true,
+	"-p": true, "--partition": true,
+	"--iops": true, "--bandwidth": true, "--rate": true,
+	"-g": true, "--group": true,
+	"-n": true, "--name": true,
+	"-r": true, "--range": true,
+	"--reserve": true, "--interval": true,
+	"--volume": true, "--api": true, "--api-key": true,
+	"--after": true, "--before": true, "--at": true,
+	"--template": true, "--count": true, "--prefix": true, "--start": true,
+}
+
+// Print candidates for the last of the given words, which follow the program name on the command line. A single
+// ":files" line asks the shell to complete file names.
+func complete(words []string) {
+	// Skip options before the device
+	for len(words) > 1 && strings.HasPrefix(words[0], "-") {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return
+	}
+	cur := words[len(words)-1]
+	var candidates []string
+	switch len(words) {
+	case 1:
+		fmt.Println(":files")
+		return
+	case 2:
+		for command := range commandArgs {
+			candidates = append(candidates, command)
+		}
+	default:
+		device := words[0]
+		args, ok := commandArgs[words[1]]
+		if !ok || strings.HasPrefix(cur, "-") {
+			return
+		}
+		pos := 0
+		for i := 2; i < len(words)-1; i++ {
+			if strings.HasPrefix(words[i], "-") {
+				if valueOpts[words[i]] {
+					i++
+				}
+				continue
+			}
+			pos++
+		}
+		if pos >= len(args) {
+			return
+		}
+		switch args[pos] {
+		case "files":
+			fmt.Println(":files")
+			return
+		case "inspect":
+			candidates = inspectCommands
+		case "policies":
+			for policy := uint(0); dbs.AllocationPolicyName(policy) != "unknown"; policy++ {
+				candidates = append(candidates, dbs.AllocationPolicyName(policy))
+			}
+		case "tiers":
+			for tier := uint(0); dbs.TierName(tier) != "unknown"; tier++ {
+				candidates = append(candidates, dbs.TierName(tier))
+			}
+		case "switches":
+			candidates = []string{"on", "off"}
+		case "volumes":
+			vi, _ := dbs.GetVolumeInfo(device)
+			for i := range vi {
+				candidates = append(candidates, vi[i].VolumeName)
+			}
+		case "deleted_volumes":
+			vi, _ := dbs.ListDeletedVolumes(device)
+			for i := range vi {
+				candidates = append(candidates, vi[i].VolumeName)
+			}
+		case "groups":
+			gi, _ := dbs.GetGroupInfo(device)
+			for i := range gi {
+				candidates = append(candidates, gi[i].GroupName)
+			}
+		case "snapshots":
+			si, _ := dbs.ListAllSnapshots(device)
+			for i := range si {
+				candidates = append(candidates, strconv.Itoa(int(si[i].SnapshotId)))
+				if si[i].Name != "" {
+					candidates = append(candidates, si[i].Name)
+				}
+			}
+		}
+	}
+	sort.Strings(candidates)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, cur) {
+			fmt.Println(c)
+		}
+	}
+}
+
+const bashCompletion = `_dbsctl() {
+	local IFS=$'\n'
+	local out=($(dbsctl __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	if [[ "${out[0]}" == ":files" ]]; then
+		COMPREPLY=($(compgen -f -- "${COMP_WORDS[COMP_CWORD]}"))
+	else
+		COMPREPLY=("${out[@]}")
+	fi
+}
+complete -o filenames -F _dbsctl dbsctl
+`
+
+const zshCompletion = `#compdef dbsctl
+_dbsctl() {
+	local -a out
+	out=("${(@f)$(dbsctl __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ "${out[1]}" == ":files" ]]; then
+		_files
+	else
+		compadd -- "${out[@]}"
+	fi
+}
+compdef _dbsctl dbsctl
+`
+
+const fishCompletion = `function __dbsctl_complete
+	set -l out (dbsctl __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+	if test "$out[1]" = ":files"
+		__fish_complete_path (commandline -ct)
+	else
+		string join \n -- $out
+	end
+end
+complete -c dbsctl -f -a '(__dbsctl_complete)'
+`
+
+// Print the completion script for a shell.
+func printCompletion(shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+	default:
+		return fmt.Errorf("unsupported shell %v (expected bash, zsh or fish)", shell)
+	}
+	return nil
+}
+
+// Handle the completion commands, which come before the device argument. Return false for other commands.
+func runCompletion(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	switch args[1] {
+	case "completion":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "Usage: dbsctl completion bash|zsh|fish")
+			os.Exit(1)
+		}
+		if err := printCompletion(args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "__complete":
+		complete(args[2:])
+	default:
+		return false
+	}
+	return true
+}
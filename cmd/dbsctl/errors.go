@@ -0,0 +1,114 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jawher/mow.cli"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Exit codes. Failures not covered by a specific code exit with EXIT_FAILURE.
+const (
+	EXIT_FAILURE          = 1
+	EXIT_NOT_FOUND        = 2
+	EXIT_NO_SPACE         = 3
+	EXIT_CORRUPTED        = 4
+	EXIT_EXISTS           = 5
+	EXIT_INVALID_ARGUMENT = 6
+	EXIT_READ_ONLY        = 7
+	EXIT_USAGE            = 64 // Command line could not be parsed
+)
+
+var errInvalidArgument = errors.New("invalid argument")
+
+// Mark an error in a command line argument.
+func invalidArgument(err error) error {
+	return fmt.Errorf("%w: %w", errInvalidArgument, err)
+}
+
+// Classification of an error, with the exit code and a hint on how to resolve it.
+type errorKind struct {
+	err      error
+	code     string
+	exitCode int
+	hint     string
+}
+
+var errorKinds = []errorKind{
+	{os.ErrNotExist, "not_found", EXIT_NOT_FOUND, "check the device path, or create a file and initialize it with init_device"},
+	{os.ErrPermission, "permission_denied", EXIT_FAILURE, "run as a user with read and write access to the device"},
+	{dbs.ErrVolumeNotFound, "not_found", EXIT_NOT_FOUND, "list volumes with get_volume_info, or deleted ones with list_deleted_volumes"},
+	{dbs.ErrSnapshotNotFound, "not_found", EXIT_NOT_FOUND, "list snapshots with list_all_snapshots"},
+	{dbs.ErrVolumeExists, "exists", EXIT_EXISTS, "choose another name, or rename the existing volume with rename_volume"},
+	{dbs.ErrDeviceInitialized, "exists", EXIT_EXISTS, "pass --force to initialize it again, deleting all volumes"},
+	{dbs.ErrGroupNotFound, "not_found", EXIT_NOT_FOUND, "list groups with get_group_info"},
+	{dbs.ErrInvalidVolumeName, "invalid_argument", EXIT_INVALID_ARGUMENT, "use letters, digits, '.', '_' and '-', starting with a letter or digit"},
+	{dbs.ErrInvalidGroupName, "invalid_argument", EXIT_INVALID_ARGUMENT, "use letters, digits, '.', '_' and '-', starting with a letter or digit"},
+	{dbs.ErrInvalidSnapshotName, "invalid_argument", EXIT_INVALID_ARGUMENT, "use letters, digits, '.', '_' and '-', starting with a letter or digit, and not only digits"},
+	{dbs.ErrSnapshotExists, "exists", EXIT_EXISTS, "choose another name, or rename the existing snapshot with set_snapshot_name"},
+	{dbs.ErrQuotaExceeded, "no_space", EXIT_NO_SPACE, "raise the quota with set_group_quota, or delete volumes of the group"},
+	{dbs.ErrNoSpace, "no_space", EXIT_NO_SPACE, "free space with delete_volume, delete_snapshot or purge_volume, then run vacuum_device"},
+	{dbs.ErrCorrupted, "corrupted", EXIT_CORRUPTED, "inspect the metadata with inspect superblock"},
+	{dbs.ErrMediaError, "media_error", EXIT_FAILURE, "check the device for failing sectors, then clear the volume's errors with reset_volume_errors"},
+	{dbs.ErrMaintenance, "maintenance", EXIT_READ_ONLY, "wait for the maintenance to end, or end it with set_device_maintenance off"},
+	{dbs.ErrReadOnly, "read_only", EXIT_READ_ONLY, ""},
+	{dbs.ErrRetained, "retained", EXIT_READ_ONLY, "wait for the retention set with set_volume_retention to pass"},
+	{dbs.ErrUnsupportedFeature, "unsupported_feature", EXIT_FAILURE, "upgrade to a version supporting the features, as listed with inspect superblock"},
+	{dbs.ErrWrongDevice, "wrong_device", EXIT_FAILURE, "check the device path, and the identity of the device with get_device_info"},
+	{dbs.ErrJobNotFound, "not_found", EXIT_NOT_FOUND, "list jobs with jobs"},
+	{dbs.ErrJobNotResumable, "failure", EXIT_FAILURE, "check the state of the job with jobs, and cancel interrupted ones with cancel_job"},
+	{dbs.ErrInvalidLabel, "invalid_argument", EXIT_INVALID_ARGUMENT, "use keys of up to 255 bytes without '=' or control characters, and values of up to 64KiB"},
+	{dbs.ErrLabelSpaceExhausted, "no_space", EXIT_NO_SPACE, "free label space by deleting labeled snapshots with delete_snapshot or delete_snapshots"},
+	{dbs.ErrInvalidExtent, "invalid_argument", EXIT_INVALID_ARGUMENT, "list allocated extents with inspect extents"},
+	{errInvalidArgument, "invalid_argument", EXIT_INVALID_ARGUMENT, ""},
+}
+
+func classifyError(err error) errorKind {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k
+		}
+	}
+	return errorKind{code: "failure", exitCode: EXIT_FAILURE}
+}
+
+// Print errors as JSON objects, for automation.
+var jsonErrors *bool
+
+// Print an error, with a hint on how to resolve it if there is one, and exit with the code for its kind.
+func fail(err error) {
+	k := classifyError(err)
+	if jsonErrors != nil && *jsonErrors {
+		data, _ := json.Marshal(struct {
+			Error    string `json:"error"`
+			Code     string `json:"code"`
+			ExitCode int    `json:"exit_code"`
+			Hint     string `json:"hint,omitempty"`
+		}{err.Error(), k.code, k.exitCode, k.hint})
+		fmt.Fprintln(os.Stderr, string(data))
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if k.hint != "" {
+			fmt.Fprintf(os.Stderr, "Hint: %v\n", k.hint)
+		}
+	}
+	cli.Exit(k.exitCode)
+}
@@ -0,0 +1,134 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jawher/mow.cli"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Resolve a path inside the mounted filesystem, refusing paths that escape it through symbolic links.
+func resolvePath(root string, path string) (string, error) {
+	full := filepath.Join(root, filepath.Clean("/"+path))
+	if full == root {
+		return root, nil
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		return "", err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v leads outside the snapshot filesystem", path)
+	}
+	return filepath.Join(parent, filepath.Base(full)), nil
+}
+
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Copy a file or directory tree from the mounted filesystem to the destination, keeping its path. Symbolic links
+// are copied as links and special files are skipped.
+func extractPath(root string, dest string, path string) error {
+	src, err := resolvePath(root, path)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(p, target, info.Mode())
+		}
+		fmt.Printf("skipping special file %v\n", rel)
+		return nil
+	})
+}
+
+func cmdExtract(cmd *cli.Cmd) {
+	cmd.Spec = "[-t] [-p] SNAPSHOT DEST PATH..."
+	fstype := cmd.StringOpt("t fstype", "", "Filesystem type (detected if not set)")
+	partition := cmd.IntOpt("p partition", 0, "Partition number (0 for an unpartitioned volume)")
+	snapshot := cmd.StringArg("SNAPSHOT", "", "Snapshot id or name")
+	dest := cmd.StringArg("DEST", "", "Destination directory")
+	paths := cmd.StringsArg("PATH", nil, "Files or directories to extract")
+	cmd.Action = func() {
+		vc, err := dbs.OpenSnapshot(*device, resolveSnapshot(*snapshot))
+		if err != nil {
+			fail(err)
+		}
+		defer vc.CloseVolume()
+		root, detach, err := mountSnapshot(vc, *partition, *fstype)
+		if err != nil {
+			fail(err)
+		}
+		defer func() {
+			if err := detach(); err != nil {
+				fail(err)
+			}
+		}()
+		if root, err = filepath.EvalSymlinks(root); err != nil {
+			fail(err)
+		}
+		for _, path := range *paths {
+			if err := extractPath(root, *dest, path); err != nil {
+				fail(err)
+			}
+		}
+	}
+}
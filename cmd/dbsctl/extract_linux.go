@@ -0,0 +1,210 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (cgo || amd64)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	nbdclient "github.com/chazapis/go-nbd/pkg/client"
+	nbd "github.com/chazapis/go-nbd/pkg/server"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Filesystems tried when no type is given, with the options that keep them from replaying their journal.
+var mountOptions = []struct {
+	fstype string
+	data   string
+}{
+	{"ext4", "noload"},
+	{"xfs", "norecovery"},
+	{"btrfs", "nologreplay"},
+	{"vfat", ""},
+}
+
+type snapshotBackend struct {
+	vc *dbs.VolumeContext
+}
+
+func (b *snapshotBackend) ReadAt(p []byte, off int64) (int, error) {
+	return len(p), b.vc.ReadAt(p, uint64(off))
+}
+
+func (b *snapshotBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, dbs.ErrReadOnly
+}
+
+func (b *snapshotBackend) Size() (int64, error) {
+	return int64(b.vc.VolumeSize()), nil
+}
+
+func (b *snapshotBackend) Sync() error {
+	return nil
+}
+
+// Return a connected pair of sockets.
+func socketPair() (*net.UnixConn, *net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "nbd")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			if i > 0 {
+				conns[0].Close()
+			} else {
+				syscall.Close(fds[1])
+			}
+			return nil, nil, err
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1], nil
+}
+
+// Find an NBD device not in use. Requires the nbd kernel module.
+func findFreeNbdDevice() (string, error) {
+	devices, _ := filepath.Glob("/sys/block/nbd*")
+	if len(devices) == 0 {
+		return "", fmt.Errorf("no NBD devices found (is the nbd module loaded?)")
+	}
+	for _, d := range devices {
+		if _, err := os.Stat(filepath.Join(d, "pid")); errors.Is(err, os.ErrNotExist) {
+			return filepath.Join("/dev", filepath.Base(d)), nil
+		}
+	}
+	return "", fmt.Errorf("all NBD devices are in use")
+}
+
+// Wait for a device node to appear, as partitions are scanned asynchronously.
+func waitForDevice(path string) error {
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("device %v did not appear", path)
+}
+
+func mountFilesystem(source string, target string, fstype string) error {
+	if fstype != "" {
+		data := ""
+		for _, o := range mountOptions {
+			if o.fstype == fstype {
+				data = o.data
+			}
+		}
+		return syscall.Mount(source, target, fstype, syscall.MS_RDONLY, data)
+	}
+	var err error
+	for _, o := range mountOptions {
+		if err = syscall.Mount(source, target, o.fstype, syscall.MS_RDONLY, o.data); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot detect filesystem on %v: %w", source, err)
+}
+
+// Attach a snapshot to a free NBD device through an in-process server and mount it read-only in a temporary
+// directory. Returns the mount point and a function that undoes everything.
+func mountSnapshot(vc *dbs.VolumeContext, partition int, fstype string) (string, func() error, error) {
+	nbdDevice, err := findFreeNbdDevice()
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.OpenFile(nbdDevice, os.O_RDWR, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	serverConn, clientConn, err := socketPair()
+	if err != nil {
+		f.Close()
+		return "", nil, err
+	}
+	go nbd.Handle(
+		serverConn,
+		[]*nbd.Export{{Name: "snapshot", Backend: &snapshotBackend{vc: vc}}},
+		&nbd.Options{
+			ReadOnly:           true,
+			MinimumBlockSize:   dbs.BLOCK_SIZE,
+			PreferredBlockSize: dbs.BLOCK_SIZE,
+			MaximumBlockSize:   dbs.BLOCK_SIZE,
+		})
+
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- nbdclient.Connect(clientConn, f, &nbdclient.Options{
+			ExportName:  "snapshot",
+			BlockSize:   dbs.BLOCK_SIZE,
+			OnConnected: func() { close(ready) },
+		})
+	}()
+	detachDevice := func() error {
+		err := nbdclient.Disconnect(f)
+		<-done
+		clientConn.Close()
+		serverConn.Close()
+		f.Close()
+		return err
+	}
+	select {
+	case <-ready:
+	case err := <-done:
+		clientConn.Close()
+		serverConn.Close()
+		f.Close()
+		return "", nil, fmt.Errorf("cannot attach %v: %w", nbdDevice, err)
+	}
+
+	source := nbdDevice
+	if partition > 0 {
+		source = fmt.Sprintf("%vp%v", nbdDevice, partition)
+		if err := waitForDevice(source); err != nil {
+			detachDevice()
+			return "", nil, err
+		}
+	}
+	mountPoint, err := os.MkdirTemp("", "dbs-extract-")
+	if err != nil {
+		detachDevice()
+		return "", nil, err
+	}
+	if err := mountFilesystem(source, mountPoint, fstype); err != nil {
+		os.Remove(mountPoint)
+		detachDevice()
+		return "", nil, err
+	}
+	return mountPoint, func() error {
+		if err := syscall.Unmount(mountPoint, 0); err != nil {
+			return err
+		}
+		os.Remove(mountPoint)
+		return detachDevice()
+	}, nil
+}
@@ -0,0 +1,394 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"os"
+	"time"
+
+	"github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+
+	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Raw view of a device, parsed without any validation so that corrupted devices can be inspected.
+type rawDevice struct {
+	f      *dbs.DirectFile
+	layout format.Layout
+}
+
+func openRawDevice(device string) (*rawDevice, error) {
+	f, err := dbs.NewDirectFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %v: %w", device, err)
+	}
+	deviceSize, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rd := &rawDevice{f: f, layout: format.NewLayout(uint64(deviceSize))}
+	// The reserved region is left out of the data area, so the extent metadata is laid out accordingly
+	if sb, err := rd.readSuperblock(); err == nil && string(sb.Magic[:]) == format.MAGIC && sb.ReservedSize > 0 {
+		rd.layout = format.NewReservedLayout(uint64(deviceSize), sb.ReservedSize)
+	}
+	return rd, nil
+}
+
+func (rd *rawDevice) read(v any, offset uint64, size uint64) error {
+	start := (offset / format.BLOCK_SIZE) * format.BLOCK_SIZE
+	end := ((offset + size + format.BLOCK_SIZE - 1) / format.BLOCK_SIZE) * format.BLOCK_SIZE
+	buf := make([]byte, end-start)
+	if _, err := rd.f.ReadAt(buf, start); err != nil {
+		return err
+	}
+	return format.Unmarshal(buf[offset-start:], v)
+}
+
+func (rd *rawDevice) readSuperblock() (*format.Superblock, error) {
+	var sb format.Superblock
+	if err := rd.read(&sb, 0, format.SIZEOF_SUPERBLOCK); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+	return &sb, nil
+}
+
+// Return the offset of the active copy of the metadata area.
+func (rd *rawDevice) metadataOffset() (uint64, error) {
+	sb, err := rd.readSuperblock()
+	if err != nil {
+		return 0, err
+	}
+	return rd.layout.MetadataCopyOffset(sb.ActiveMetadata & 1), nil
+}
+
+// Return true if the checksum of a copy of the metadata area matches the superblock.
+func (rd *rawDevice) metadataValid(sb *format.Superblock, copy uint8) (bool, error) {
+	buf := make([]byte, rd.layout.MetadataSize)
+	if _, err := rd.f.ReadAt(buf, rd.layout.MetadataCopyOffset(copy)); err != nil {
+		return false, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return format.MetadataChecksum(buf) == sb.MetadataChecksums[copy], nil
+}
+
+func (rd *rawDevice) readVolumes() ([]format.VolumeMetadata, error) {
+	offset, err := rd.metadataOffset()
+	if err != nil {
+		return nil, err
+	}
+	vm := make([]format.VolumeMetadata, format.MAX_VOLUMES)
+	if err := rd.read(vm, offset, format.SIZEOF_VOLUME_METADATA*format.MAX_VOLUMES); err != nil {
+		return nil, fmt.Errorf("failed to read volume metadata: %w", err)
+	}
+	return vm, nil
+}
+
+func (rd *rawDevice) readSnapshots() ([]format.SnapshotMetadata, error) {
+	offset, err := rd.metadataOffset()
+	if err != nil {
+		return nil, err
+	}
+	sm := make([]format.SnapshotMetadata, format.MAX_SNAPSHOTS)
+	offset += format.SIZEOF_VOLUME_METADATA * format.MAX_VOLUMES
+	if err := rd.read(sm, offset, format.SIZEOF_SNAPSHOT_METADATA*format.MAX_SNAPSHOTS); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot metadata: %w", err)
+	}
+	return sm, nil
+}
+
+// Return the time each volume slot is write once until, all zero if the retention table is not in use.
+func (rd *rawDevice) readRetention() ([]uint32, error) {
+	sb, err := rd.readSuperblock()
+	if err != nil {
+		return nil, err
+	}
+	rt := make([]uint32, format.MAX_VOLUMES)
+	if sb.FeatureRoCompat&format.FEATURE_RO_COMPAT_RETENTION == 0 {
+		return rt, nil
+	}
+	offset := rd.layout.MetadataCopyOffset(sb.ActiveMetadata&1) + rd.layout.RetentionOffset
+	if err := rd.read(rt, offset, format.SIZEOF_RETENTION_TIME*format.MAX_VOLUMES); err != nil {
+		return nil, fmt.Errorf("failed to read retention table: %w", err)
+	}
+	return rt, nil
+}
+
+func (rd *rawDevice) readLabels() ([]format.Label, error) {
+	offset, err := rd.metadataOffset()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, format.LABEL_REGION_SIZE)
+	if _, err := rd.f.ReadAt(buf, offset+rd.layout.LabelOffset); err != nil {
+		return nil, fmt.Errorf("failed to read labels: %w", err)
+	}
+	return format.UnmarshalLabels(buf)
+}
+
+func (rd *rawDevice) readStats() ([]format.VolumeStats, error) {
+	vs := make([]format.VolumeStats, format.MAX_VOLUMES)
+	if err := rd.read(vs, rd.layout.StatsOffset, format.SIZEOF_VOLUME_STATS*format.MAX_VOLUMES); err != nil {
+		return nil, fmt.Errorf("failed to read volume stats: %w", err)
+	}
+	return vs, nil
+}
+
+func (rd *rawDevice) readExtents(start uint64, count uint64) ([]format.ExtentMetadata, error) {
+	em := make([]format.ExtentMetadata, count)
+	if err := rd.read(em, rd.layout.ExtentMetadataOffset(start), format.SIZEOF_EXTENT_METADATA*count); err != nil {
+		return nil, fmt.Errorf("failed to read extent metadata: %w", err)
+	}
+	return em, nil
+}
+
+func withRawDevice(fn func(rd *rawDevice) error) {
+	rd, err := openRawDevice(*device)
+	if err != nil {
+		fail(err)
+	}
+	defer rd.f.Close()
+	if err := fn(rd); err != nil {
+		fail(err)
+	}
+}
+
+func cmdInspectSuperblock(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		withRawDevice(func(rd *rawDevice) error {
+			sb, err := rd.readSuperblock()
+			if err != nil {
+				return err
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendRows([]table.Row{
+				{"magic", fmt.Sprintf("%q", sb.Magic[:])},
+				{"magic_valid", string(sb.Magic[:]) == format.MAGIC},
+				{"version", fmt.Sprintf("0x%08x (%v)", sb.Version, format.HumanVersion(sb.Version))},
+				{"allocated_device_extents", sb.AllocatedDeviceExtents},
+				{"device_size", sb.DeviceSize},
+				{"actual_device_size", rd.layout.DeviceSize},
+				{"allocation_policy", sb.AllocationPolicy},
+				{"trash_retention", sb.TrashRetention},
+				{"generation", sb.Generation},
+				{"active_metadata", sb.ActiveMetadata},
+				{"uuid", format.FormatUUID(sb.UUID)},
+				{"flags", fmt.Sprintf("0x%02x", sb.Flags)},
+				{"fast_extents", sb.FastExtents},
+				{"reserved_size", sb.ReservedSize},
+				{"feature_compat", fmt.Sprintf("0x%08x", sb.FeatureCompat)},
+				{"feature_ro_compat", fmt.Sprintf("0x%08x", sb.FeatureRoCompat)},
+				{"feature_incompat", fmt.Sprintf("0x%08x", sb.FeatureIncompat)},
+			})
+			for i := uint8(0); i < 2; i++ {
+				valid, err := rd.metadataValid(sb, i)
+				if err != nil {
+					return err
+				}
+				t.AppendRow(table.Row{fmt.Sprintf("metadata_checksum_%d", i), fmt.Sprintf("0x%08x (valid: %v)", sb.MetadataChecksums[i], valid)})
+			}
+			t.AppendSeparator()
+			t.AppendRows([]table.Row{
+				{"metadata_offset", rd.layout.MetadataOffset},
+				{"metadata_size", rd.layout.MetadataSize},
+				{"label_offset", rd.layout.LabelOffset},
+				{"stats_offset", rd.layout.StatsOffset},
+				{"extent_offset", rd.layout.ExtentOffset},
+				{"data_offset", rd.layout.DataOffset},
+				{"total_device_extents", rd.layout.TotalDeviceExtents},
+				{"reserved_offset", rd.layout.ReservedOffset},
+			})
+			t.Render()
+			return nil
+		})
+	}
+}
+
+func cmdInspectVolumes(cmd *cli.Cmd) {
+	all := cmd.BoolOpt("a all", false, "Include free slots")
+	cmd.Action = func() {
+		withRawDevice(func(rd *rawDevice) error {
+			vm, err := rd.readVolumes()
+			if err != nil {
+				return err
+			}
+			rt, err := rd.readRetention()
+			if err != nil {
+				return err
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendRow(table.Row{"index", "snapshot_id", "volume_size", "allocation_policy", "max_iops", "max_bandwidth", "deleted_at", "group_id", "tier", "retain_until", "volume_name"})
+			t.AppendSeparator()
+			for i := range vm {
+				if vm[i].SnapshotId == 0 && !*all {
+					continue
+				}
+				t.AppendRow(table.Row{
+					i,
+					vm[i].SnapshotId,
+					vm[i].VolumeSize,
+					vm[i].AllocationPolicy,
+					vm[i].MaxIops,
+					vm[i].MaxBandwidth,
+					vm[i].DeletedAt,
+					vm[i].GroupId,
+					vm[i].Tier,
+					rt[i],
+					fmt.Sprintf("%q", vm[i].Name()),
+				})
+			}
+			t.Render()
+			return nil
+		})
+	}
+}
+
+func cmdInspectSnapshots(cmd *cli.Cmd) {
+	all := cmd.BoolOpt("a all", false, "Include free slots")
+	cmd.Action = func() {
+		withRawDevice(func(rd *rawDevice) error {
+			sm, err := rd.readSnapshots()
+			if err != nil {
+				return err
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendRow(table.Row{"snapshot_id", "parent_snapshot_id", "created_at", "created_at_raw", "flags"})
+			t.AppendSeparator()
+			for i := range sm {
+				flags := fmt.Sprintf("0x%02x", sm[i].Flags)
+				if sm[i].CreatedAt == 0 {
+					if !*all {
+						continue
+					}
+					t.AppendRow(table.Row{i + 1, sm[i].ParentSnapshotId, "-", sm[i].CreatedAt, flags})
+					continue
+				}
+				t.AppendRow(table.Row{i + 1, sm[i].ParentSnapshotId, time.Unix(sm[i].CreatedAt, 0), sm[i].CreatedAt, flags})
+			}
+			t.Render()
+			return nil
+		})
+	}
+}
+
+func cmdInspectLabels(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		withRawDevice(func(rd *rawDevice) error {
+			labels, err := rd.readLabels()
+			if err != nil {
+				return err
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendRow(table.Row{"snapshot_id", "key", "value"})
+			t.AppendSeparator()
+			used := 0
+			for _, l := range labels {
+				t.AppendRow(table.Row{l.SnapshotId, fmt.Sprintf("%q", l.Key), fmt.Sprintf("%q", l.Value)})
+				used += format.SIZEOF_LABEL_HEADER + len(l.Key) + len(l.Value)
+			}
+			t.AppendFooter(table.Row{"", "bytes_used", fmt.Sprintf("%v/%v", used, format.LABEL_REGION_SIZE)})
+			t.Render()
+			return nil
+		})
+	}
+}
+
+func cmdInspectStats(cmd *cli.Cmd) {
+	all := cmd.BoolOpt("a all", false, "Include slots without stats")
+	cmd.Action = func() {
+		withRawDevice(func(rd *rawDevice) error {
+			vs, err := rd.readStats()
+			if err != nil {
+				return err
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendRow(table.Row{"index", "bytes_written", "bytes_read", "copied_extents", "last_write_time", "last_read_time", "media_errors", "failed_at"})
+			t.AppendSeparator()
+			for i := range vs {
+				if vs[i] == (format.VolumeStats{}) && !*all {
+					continue
+				}
+				t.AppendRow(table.Row{i, vs[i].BytesWritten, vs[i].BytesRead, vs[i].CopiedExtents, vs[i].LastWriteTime, vs[i].LastReadTime, vs[i].MediaErrors, vs[i].FailedAt})
+			}
+			t.Render()
+			return nil
+		})
+	}
+}
+
+func cmdInspectExtents(cmd *cli.Cmd) {
+	cmd.Spec = "[-a] START [COUNT]"
+	all := cmd.BoolOpt("a all", false, "Include free extents")
+	start := cmd.IntArg("START", 0, "First device extent")
+	count := cmd.IntArg("COUNT", 1, "Number of device extents")
+	cmd.Action = func() {
+		withRawDevice(func(rd *rawDevice) error {
+			if *start < 0 || *count <= 0 || uint64(*start+*count) > rd.layout.TotalDeviceExtents {
+				return fmt.Errorf("extent range out of bounds (device has %v extents)", rd.layout.TotalDeviceExtents)
+			}
+			em, err := rd.readExtents(uint64(*start), uint64(*count))
+			if err != nil {
+				return err
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendRow(table.Row{"device_extent", "snapshot_id", "volume_extent", "block_count", "block_bitmap", "flags"})
+			t.AppendSeparator()
+			for i := range em {
+				if em[i].SnapshotId == 0 && !*all {
+					continue
+				}
+				blockCount := 0
+				for _, b := range em[i].BlockBitmap {
+					blockCount += bits.OnesCount8(b)
+				}
+				t.AppendRow(table.Row{
+					*start + i,
+					em[i].SnapshotId,
+					em[i].ExtentPos,
+					blockCount,
+					hex.EncodeToString(em[i].BlockBitmap[:]),
+					fmt.Sprintf("0x%02x", em[i].Flags),
+				})
+			}
+			t.Render()
+			return nil
+		})
+	}
+}
+
+func cmdInspect(cmd *cli.Cmd) {
+	cmd.Command("superblock", "Dump raw superblock fields and device layout", cmdInspectSuperblock)
+	cmd.Command("volumes", "Dump the volume table", cmdInspectVolumes)
+	cmd.Command("snapshots", "Dump the snapshot table", cmdInspectSnapshots)
+	cmd.Command("labels", "Dump the label region", cmdInspectLabels)
+	cmd.Command("stats", "Dump the volume stats region", cmdInspectStats)
+	cmd.Command("extents", "Dump extent metadata for a range of device extents", cmdInspectExtents)
+}
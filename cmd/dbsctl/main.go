@@ -16,9 +16,16 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/jawher/mow.cli"
@@ -33,34 +40,94 @@ func cmdGetDeviceInfo(cmd *cli.Cmd) {
 	cmd.Action = func() {
 		di, err := dbs.GetDeviceInfo(*device)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fail(err)
 		}
 
 		t := table.NewWriter()
 		t.SetOutputMirror(os.Stdout)
 		t.AppendRows([]table.Row{
 			{"version", di.Version},
+			{"uuid", di.UUID},
 			{"device_size", units.HumanSize(float64(di.DeviceSize))},
 			{"total_device_extents", di.TotalDeviceExtents},
 			{"allocated_device_extents", di.AllocatedDeviceExtents},
 			{"volume_count", di.VolumeCount},
+			{"allocation_policy", di.AllocationPolicy},
+			{"trash_retention", di.TrashRetention},
+			{"maintenance", di.Maintenance},
+			{"fast_region", humanSize(di.FastRegion)},
+			{"extent_times", di.ExtentTimes},
+			{"reserved_region", reservedRegion(di)},
+			{"mirror_failed", orDash(di.MirrorFailed)},
+			{"label_space", fmt.Sprintf("%v/%v", units.HumanSize(float64(di.LabelSpaceUsed)), units.HumanSize(float64(di.LabelSpaceSize)))},
+			{"direct_io", di.DirectIO},
 		})
+		if h := di.Health; h != nil {
+			t.AppendRows([]table.Row{
+				{"model", orDash(h.Model)},
+				{"serial", orDash(h.Serial)},
+				{"state", orDash(h.State)},
+				{"rotational", h.Rotational},
+				{"block_device_size", humanSize(h.Size)},
+				{"sector_size", fmt.Sprintf("%v/%v", h.LogicalSectorSize, h.PhysicalSectorSize)},
+				{"discard_granularity", humanSize(h.DiscardGranularity)},
+			})
+		}
 		t.Render()
 	}
 }
 
+// Format the reserved region of a device as its byte range, if any.
+func reservedRegion(di *dbs.DeviceInfo) string {
+	if di.ReservedSize == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%v-%v (%v)", di.ReservedOffset, di.DeviceSize, units.HumanSize(float64(di.ReservedSize)))
+}
+
+// Format a string that may be unset.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Format a size that may be unset.
+func humanSize(size uint64) string {
+	if size == 0 {
+		return "-"
+	}
+	return units.HumanSize(float64(size))
+}
+
+func humanLimit(limit uint64, bytes bool) string {
+	if limit == 0 {
+		return "-"
+	}
+	if bytes {
+		return units.HumanSize(float64(limit)) + "/s"
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
 func cmdGetVolumeInfo(cmd *cli.Cmd) {
+	group := cmd.StringOpt("g group", "", "Only list volumes in this group")
 	cmd.Action = func() {
-		vi, err := dbs.GetVolumeInfo(*device)
+		var vi []dbs.VolumeInfo
+		var err error
+		if *group != "" {
+			vi, err = dbs.GetGroupVolumeInfo(*device, *group)
+		} else {
+			vi, err = dbs.GetVolumeInfo(*device)
+		}
 		if err != nil {
-			fmt.Println(err)
-			return
+			fail(err)
 		}
 
 		t := table.NewWriter()
 		t.SetOutputMirror(os.Stdout)
-		t.AppendRow(table.Row{"volume_name", "volume_size", "created_at", "snapshot_id", "snapshot_count"})
+		t.AppendRow(table.Row{"volume_name", "volume_size", "created_at", "snapshot_id", "snapshot_count", "allocation_policy", "tier", "max_iops", "max_bandwidth", "group", "bytes_written", "last_write_time", "last_read_time", "media_errors", "retain_until"})
 		t.AppendSeparator()
 		for i := range vi {
 			t.AppendRow(table.Row{
@@ -69,24 +136,102 @@ func cmdGetVolumeInfo(cmd *cli.Cmd) {
 				vi[i].CreatedAt,
 				vi[i].SnapshotId,
 				vi[i].SnapshotCount,
+				vi[i].AllocationPolicy,
+				vi[i].Tier,
+				humanLimit(uint64(vi[i].MaxIops), false),
+				humanLimit(vi[i].MaxBandwidth, true),
+				vi[i].Group,
+				units.HumanSize(float64(vi[i].BytesWritten)),
+				humanTime(vi[i].LastWriteTime),
+				humanTime(vi[i].LastReadTime),
+				humanMediaErrors(&vi[i]),
+				humanRetention(vi[i].RetainUntil),
 			})
 		}
 		t.Render()
 	}
 }
 
+// Format the end of the retention of a write once volume, noting if it has passed.
+func humanRetention(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	if t.Before(time.Now()) {
+		return fmt.Sprintf("%v (expired)", t)
+	}
+	return t.String()
+}
+
+// Format the media errors of a volume, noting if it was made read-only.
+func humanMediaErrors(vi *dbs.VolumeInfo) string {
+	if !vi.FailedAt.IsZero() {
+		return fmt.Sprintf("%v (read-only since %v)", vi.MediaErrors, vi.FailedAt)
+	}
+	return strconv.FormatUint(vi.MediaErrors, 10)
+}
+
+// Format a time that may be unset.
+func humanTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.String()
+}
+
+// Parse KEY=VALUE arguments into a label map.
+func parseLabels(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(args))
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q (expected KEY=VALUE)", arg)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// Return the id of a snapshot given by name or id.
+func resolveSnapshot(snapshot string) uint {
+	snapshotId, err := dbs.ResolveSnapshot(*device, snapshot)
+	if err != nil {
+		fail(err)
+	}
+	return snapshotId
+}
+
+// Return a snapshot name for display.
+func snapshotName(name string) string {
+	if name == "" {
+		return "-"
+	}
+	return name
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
 func cmdGetSnapshotInfo(cmd *cli.Cmd) {
 	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
 	cmd.Action = func() {
 		si, err := dbs.GetSnapshotInfo(*device, *volumeName)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fail(err)
 		}
 
 		t := table.NewWriter()
 		t.SetOutputMirror(os.Stdout)
-		t.AppendRow(table.Row{"snapshot_id", "parent_snapshot_id", "created_at"})
+		t.AppendRow(table.Row{"snapshot_id", "name", "parent_snapshot_id", "created_at", "user_created", "labels", "description"})
 		t.AppendSeparator()
 		for i := range si {
 			psid := strconv.Itoa(int(si[i].ParentSnapshotId))
@@ -95,42 +240,367 @@ func cmdGetSnapshotInfo(cmd *cli.Cmd) {
 			}
 			t.AppendRow(table.Row{
 				si[i].SnapshotId,
+				snapshotName(si[i].Name),
 				psid,
 				si[i].CreatedAt,
+				si[i].UserCreated,
+				formatLabels(si[i].Labels),
+				si[i].Description,
 			})
 		}
 		t.Render()
 	}
 }
 
+func cmdSnapshotUsage(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	cmd.Action = func() {
+		su, err := dbs.GetSnapshotUsage(*device, *volumeName)
+		if err != nil {
+			fail(err)
+		}
+
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendRow(table.Row{"snapshot_id", "extents", "unique_extents", "shared_extents", "reclaimable"})
+		t.AppendSeparator()
+		for i := range su {
+			t.AppendRow(table.Row{
+				su[i].SnapshotId,
+				su[i].Extents,
+				su[i].UniqueExtents,
+				su[i].SharedExtents,
+				units.HumanSize(float64(su[i].UniqueExtents * dbs.EXTENT_SIZE)),
+			})
+		}
+		t.Render()
+	}
+}
+
+func cmdListAllSnapshots(cmd *cli.Cmd) {
+	cmd.Spec = "[--volume=<name>] [--after=<time>] [--before=<time>] [-l...]"
+	volumeName := cmd.StringOpt("volume", "", "Only snapshots in the chain of a volume")
+	after := cmd.StringOpt("after", "", "Only snapshots created at or after a time (RFC 3339) or this long ago (e.g. 24h)")
+	before := cmd.StringOpt("before", "", "Only snapshots created before a time (RFC 3339) or this long ago (e.g. 720h)")
+	labels := cmd.StringsOpt("l label", nil, "Only snapshots with the label, as KEY=VALUE (repeatable)")
+	cmd.Action = func() {
+		q := &dbs.SnapshotQuery{VolumeName: *volumeName, After: parseTime(*after), Before: parseTime(*before)}
+		var err error
+		if q.Labels, err = parseLabels(*labels); err != nil {
+			fail(invalidArgument(err))
+		}
+
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendRow(table.Row{"snapshot_id", "name", "parent_snapshot_id", "volume_name", "created_at", "user_created", "labels", "description"})
+		t.AppendSeparator()
+		err = dbs.EachSnapshot(*device, q, func(si dbs.SnapshotInfo) bool {
+			psid := strconv.Itoa(int(si.ParentSnapshotId))
+			if psid == "0" {
+				psid = "-"
+			}
+			volumeName := si.VolumeName
+			if volumeName == "" {
+				volumeName = "orphaned"
+			} else if si.VolumeDeleted {
+				volumeName += " (deleted)"
+			}
+			t.AppendRow(table.Row{
+				si.SnapshotId,
+				snapshotName(si.Name),
+				psid,
+				volumeName,
+				si.CreatedAt,
+				si.UserCreated,
+				formatLabels(si.Labels),
+				si.Description,
+			})
+			return true
+		})
+		if err != nil {
+			fail(err)
+		}
+		t.Render()
+	}
+}
+
 func cmdInitDevice(cmd *cli.Cmd) {
+	cmd.Spec = "[--force] [--reserve=<size>]"
+	force := cmd.BoolOpt("force", false, "Initialize a device that already is, after confirmation, deleting all volumes")
+	reserve := cmd.StringOpt("reserve", "", "Leave a region of the given size at the end of the device to other uses (e.g. 64MB)")
 	cmd.Action = func() {
-		if err := dbs.InitDevice(*device); err != nil {
-			fmt.Println(err)
+		var opts []dbs.Option
+		if *reserve != "" {
+			bytesSize, err := units.RAMInBytes(*reserve)
+			if err != nil || bytesSize <= 0 {
+				fail(invalidArgument(fmt.Errorf("invalid reserved region size %v", *reserve)))
+			}
+			opts = append(opts, dbs.WithReservedRegion(uint64(bytesSize)))
+		}
+		err := dbs.InitDevice(*device, opts...)
+		if errors.Is(err, dbs.ErrDeviceInitialized) && *force {
+			if !confirm(fmt.Sprintf("%v is already initialized. Delete all volumes and snapshots?", *device)) {
+				fail(errors.New("aborted"))
+			}
+			err = dbs.InitDevice(*device, append(opts, dbs.WithForce())...)
 		}
+		if err != nil {
+			fail(err)
+		}
+	}
+}
+
+// Ask a yes or no question on the terminal, returning true if answered yes.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%v [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
 	}
+	return false
 }
 
 func cmdVacuumDevice(cmd *cli.Cmd) {
 	cmd.Action = func() {
-		if err := dbs.VacuumDevice(*device); err != nil {
-			fmt.Println(err)
+		waitJob(dbs.VacuumDeviceJob(*device))
+	}
+}
+
+// Wait for a job run by this process, failing unless it completes. Running as a job lets other invocations list
+// and cancel it, and resume it if this one is killed.
+func waitJob(ji *dbs.JobInfo, err error) *dbs.JobInfo {
+	if err != nil {
+		fail(err)
+	}
+	if ji, err = dbs.WaitJob(*device, ji.JobId); err != nil {
+		fail(err)
+	}
+	switch ji.State {
+	case dbs.JOB_COMPLETED:
+		return ji
+	case dbs.JOB_CANCELLED:
+		fail(fmt.Errorf("%w: %v", dbs.ErrJobCancelled, ji.JobId))
+	}
+	fail(errors.New(ji.Error))
+	return nil
+}
+
+func cmdJobs(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		ji, err := dbs.ListJobs(*device)
+		if err != nil {
+			fail(err)
+		}
+
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendRow(table.Row{"job_id", "type", "target", "state", "done", "total", "started_at", "finished_at", "error"})
+		t.AppendSeparator()
+		for i := range ji {
+			finishedAt := ""
+			if !ji[i].FinishedAt.IsZero() {
+				finishedAt = ji[i].FinishedAt.Format(time.RFC3339)
+			}
+			state := ji[i].State
+			if ji[i].Resumable {
+				state += " (resumable)"
+			}
+			t.AppendRow(table.Row{
+				ji[i].JobId,
+				ji[i].Type,
+				ji[i].Target,
+				state,
+				units.HumanSize(float64(ji[i].Done)),
+				units.HumanSize(float64(ji[i].Total)),
+				ji[i].StartedAt.Format(time.RFC3339),
+				finishedAt,
+				ji[i].Error,
+			})
+		}
+		t.Render()
+	}
+}
+
+func cmdResumeJob(cmd *cli.Cmd) {
+	jobId := cmd.IntArg("JOB_ID", 0, "")
+	cmd.Action = func() {
+		waitJob(dbs.ResumeJob(*device, uint64(*jobId)))
+	}
+}
+
+func cmdCancelJob(cmd *cli.Cmd) {
+	jobId := cmd.IntArg("JOB_ID", 0, "")
+	cmd.Action = func() {
+		if err := dbs.CancelJob(*device, uint64(*jobId)); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdScrubDevice(cmd *cli.Cmd) {
+	rate := cmd.StringOpt("rate", "0", "Maximum bytes read per second (0 for unlimited)")
+	cmd.Action = func() {
+		bytesPerSecond, err := units.FromHumanSize(*rate)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if bytesPerSecond < 0 {
+			fail(invalidArgument(fmt.Errorf("rate must not be negative")))
+		}
+		status, err := dbs.ScrubDevice(*device, uint64(bytesPerSecond))
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Scrubbed %v extents in %v: %v media errors, %v checksum errors\n", status.ExtentsScrubbed,
+			status.CompletedAt.Sub(status.StartedAt).Round(time.Millisecond), status.MediaErrors, status.ChecksumErrors)
+	}
+}
+
+func cmdResyncMirror(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		if err := dbs.ResyncMirror(*device); err != nil {
+			fail(err)
 		}
 	}
 }
 
+func cmdDefragmentVolume(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	cmd.Action = func() {
+		waitJob(dbs.DefragmentVolumeJob(*device, *volumeName))
+	}
+}
+
+func cmdRelocateExtent(cmd *cli.Cmd) {
+	source := cmd.IntArg("SOURCE", 0, "")
+	target := cmd.IntArg("TARGET", 0, "")
+	cmd.Action = func() {
+		if err := dbs.RelocateExtent(*device, uint(*source), uint(*target)); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdPreallocateVolume(cmd *cli.Cmd) {
+	cmd.Spec = "[--zero] VOLUME_NAME OFFSET LENGTH"
+	zero := cmd.BoolOpt("zero", false, "Also write zeroes to blocks not written yet")
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	offset := cmd.StringArg("OFFSET", "", "")
+	length := cmd.StringArg("LENGTH", "", "")
+	cmd.Action = func() {
+		bytesOffset, err := units.FromHumanSize(*offset)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		bytesLength, err := units.FromHumanSize(*length)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		vc, err := dbs.OpenVolume(*device, *volumeName)
+		if err != nil {
+			fail(err)
+		}
+		err = vc.Preallocate(uint64(bytesOffset), uint64(bytesLength), *zero)
+		if cerr := vc.CloseVolume(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetDeviceAllocationPolicy(cmd *cli.Cmd) {
+	policyName := cmd.StringArg("POLICY", "", "One of default, next, first_fit, contiguous, striped")
+	cmd.Action = func() {
+		policy, err := dbs.ParseAllocationPolicy(*policyName)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if err := dbs.SetDeviceAllocationPolicy(*device, policy); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetDeviceMaintenance(cmd *cli.Cmd) {
+	mode := cmd.StringArg("MODE", "", "on to stop changes to volumes, off to allow them again")
+	cmd.Action = func() {
+		var maintenance bool
+		switch *mode {
+		case "on":
+			maintenance = true
+		case "off":
+			maintenance = false
+		default:
+			fail(invalidArgument(fmt.Errorf("unknown maintenance mode %v (expected on or off)", *mode)))
+		}
+		if err := dbs.SetDeviceMaintenance(*device, maintenance); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetDeviceExtentTimes(cmd *cli.Cmd) {
+	mode := cmd.StringArg("MODE", "", "on to keep the time of the last write to each extent, off to stop")
+	cmd.Action = func() {
+		var enabled bool
+		switch *mode {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		default:
+			fail(invalidArgument(fmt.Errorf("unknown extent times mode %v (expected on or off)", *mode)))
+		}
+		if err := dbs.SetDeviceExtentTimes(*device, enabled); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetDeviceFastRegion(cmd *cli.Cmd) {
+	size := cmd.StringArg("SIZE", "", "Size of the fast region at the start of the device (0 to disable tiering)")
+	cmd.Action = func() {
+		bytesSize, err := units.FromHumanSize(*size)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if err := dbs.SetDeviceFastRegion(*device, uint64(bytesSize)); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdRebalanceTiers(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		moved, err := dbs.RebalanceTiers(*device)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Moved %v extents\n", moved)
+	}
+}
+
 func cmdCreateVolume(cmd *cli.Cmd) {
+	zeroed := cmd.BoolOpt("zeroed", false, "Zero extents when allocated, so no data of deleted volumes remains in them")
 	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
 	volumeSize := cmd.StringArg("VOLUME_SIZE", "", "")
 	cmd.Action = func() {
 		bytesSize, err := units.FromHumanSize(*volumeSize)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fail(invalidArgument(err))
 		}
-		if err := dbs.CreateVolume(*device, *volumeName, uint64(bytesSize)); err != nil {
-			fmt.Println(err)
+		var opts []dbs.Option
+		if *zeroed {
+			opts = append(opts, dbs.WithZeroedExtents())
 		}
+		vi, err := dbs.CreateVolume(*device, *volumeName, uint64(bytesSize), opts...)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(vi.SnapshotId)
 	}
 }
 
@@ -139,61 +609,578 @@ func cmdRenameVolume(cmd *cli.Cmd) {
 	newVolumeName := cmd.StringArg("NEW_VOLUME_NAME", "", "")
 	cmd.Action = func() {
 		if err := dbs.RenameVolume(*device, *volumeName, *newVolumeName); err != nil {
-			fmt.Println(err)
+			fail(err)
+		}
+	}
+}
+
+func cmdConcatVolumes(cmd *cli.Cmd) {
+	cmd.Spec = "NEW_VOLUME_NAME VOLUME_NAME..."
+	newVolumeName := cmd.StringArg("NEW_VOLUME_NAME", "", "")
+	volumeNames := cmd.StringsArg("VOLUME_NAME", nil, "Volumes to place one after the other, destroyed once concatenated")
+	cmd.Action = func() {
+		vi, err := dbs.ConcatVolumes(*device, *newVolumeName, *volumeNames)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(vi.SnapshotId)
+	}
+}
+
+func cmdSplitVolume(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	newVolumeName := cmd.StringArg("NEW_VOLUME_NAME", "", "")
+	offset := cmd.StringArg("OFFSET", "", "Where the new volume starts, in binary units (e.g. 512MB)")
+	cmd.Action = func() {
+		bytesOffset, err := units.RAMInBytes(*offset)
+		if err != nil || bytesOffset <= 0 {
+			fail(invalidArgument(fmt.Errorf("invalid offset %v", *offset)))
+		}
+		vi, err := dbs.SplitVolume(*device, *volumeName, *newVolumeName, uint64(bytesOffset))
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(vi.SnapshotId)
+	}
+}
+
+func cmdSetVolumeAllocationPolicy(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	policyName := cmd.StringArg("POLICY", "", "One of default, next, first_fit, contiguous, striped")
+	cmd.Action = func() {
+		policy, err := dbs.ParseAllocationPolicy(*policyName)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if err := dbs.SetVolumeAllocationPolicy(*device, *volumeName, policy); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetVolumeTier(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	tierName := cmd.StringArg("TIER", "", "One of any, fast, slow")
+	cmd.Action = func() {
+		tier, err := dbs.ParseTier(*tierName)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if err := dbs.SetVolumeTier(*device, *volumeName, tier); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetVolumeRetention(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	until := cmd.StringArg("UNTIL", "", "Time (RFC 3339) or duration from now (e.g. 8760h) to keep written blocks until, empty to turn write once off after it has passed")
+	cmd.Action = func() {
+		var t time.Time
+		if *until != "" {
+			var err error
+			if t, err = time.Parse(time.RFC3339, *until); err != nil {
+				d, err := time.ParseDuration(*until)
+				if err != nil || d <= 0 {
+					fail(invalidArgument(fmt.Errorf("invalid time %v", *until)))
+				}
+				t = time.Now().Add(d)
+			}
+		}
+		if err := dbs.SetVolumeRetention(*device, *volumeName, t); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetVolumeQoS(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	maxIops := cmd.IntOpt("iops", 0, "Maximum I/O operations per second (0 for unlimited)")
+	maxBandwidth := cmd.StringOpt("bandwidth", "0", "Maximum bytes per second (0 for unlimited)")
+	cmd.Action = func() {
+		bytesPerSecond, err := units.FromHumanSize(*maxBandwidth)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if *maxIops < 0 || bytesPerSecond < 0 {
+			fail(invalidArgument(fmt.Errorf("limits must not be negative")))
+		}
+		if err := dbs.SetVolumeQoS(*device, *volumeName, uint(*maxIops), uint64(bytesPerSecond)); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdResetVolumeErrors(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	cmd.Action = func() {
+		if err := dbs.ResetVolumeErrors(*device, *volumeName); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetVolumeGroup(cmd *cli.Cmd) {
+	cmd.Spec = "VOLUME_NAME [GROUP_NAME]"
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	groupName := cmd.StringArg("GROUP_NAME", "", "Group to move the volume to, none to remove it from its group")
+	cmd.Action = func() {
+		if err := dbs.SetVolumeGroup(*device, *volumeName, *groupName); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetGroupQuota(cmd *cli.Cmd) {
+	groupName := cmd.StringArg("GROUP_NAME", "", "")
+	quota := cmd.StringArg("QUOTA", "", "Total size of the volumes in the group (0 for unlimited)")
+	cmd.Action = func() {
+		bytesQuota, err := units.FromHumanSize(*quota)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if bytesQuota < 0 {
+			fail(invalidArgument(fmt.Errorf("quota must not be negative")))
+		}
+		if err := dbs.SetGroupQuota(*device, *groupName, uint64(bytesQuota)); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdGetGroupInfo(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		gi, err := dbs.GetGroupInfo(*device)
+		if err != nil {
+			fail(err)
+		}
+
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendRow(table.Row{"group_name", "volume_count", "volume_size", "quota"})
+		t.AppendSeparator()
+		for i := range gi {
+			quota := "-"
+			if gi[i].Quota != 0 {
+				quota = units.HumanSize(float64(gi[i].Quota))
+			}
+			t.AppendRow(table.Row{
+				gi[i].GroupName,
+				gi[i].VolumeCount,
+				units.HumanSize(float64(gi[i].VolumeSize)),
+				quota,
+			})
+		}
+		t.Render()
+	}
+}
+
+func cmdSnapshotGroup(cmd *cli.Cmd) {
+	cmd.Spec = "[-l...] GROUP_NAME"
+	labels := cmd.StringsOpt("l label", nil, "Label as KEY=VALUE (repeatable)")
+	groupName := cmd.StringArg("GROUP_NAME", "", "")
+	cmd.Action = func() {
+		opts := &dbs.SnapshotOptions{UserCreated: true}
+		var err error
+		if opts.Labels, err = parseLabels(*labels); err != nil {
+			fail(invalidArgument(err))
+		}
+		snapshots, err := dbs.SnapshotGroup(*device, *groupName, opts)
+		if err != nil {
+			fail(err)
+		}
+		volumeNames := make([]string, 0, len(snapshots))
+		for volumeName := range snapshots {
+			volumeNames = append(volumeNames, volumeName)
+		}
+		sort.Strings(volumeNames)
+		for _, volumeName := range volumeNames {
+			fmt.Println(volumeName, snapshots[volumeName])
+		}
+	}
+}
+
+func cmdDeleteGroup(cmd *cli.Cmd) {
+	groupName := cmd.StringArg("GROUP_NAME", "", "Group to delete, with all its volumes")
+	cmd.Action = func() {
+		if err := dbs.DeleteGroup(*device, *groupName); err != nil {
+			fail(err)
 		}
 	}
 }
 
 func cmdCreateSnapshot(cmd *cli.Cmd) {
+	cmd.Spec = "[-l...] [-n=<name>] [-d=<description>] VOLUME_NAME"
+	labels := cmd.StringsOpt("l label", nil, "Label as KEY=VALUE (repeatable)")
+	name := cmd.StringOpt("n name", "", "Unique name of the snapshot, usable instead of its id")
+	description := cmd.StringOpt("d description", "", "Why the snapshot is taken")
 	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
 	cmd.Action = func() {
-		if err := dbs.CreateSnapshot(*device, *volumeName); err != nil {
-			fmt.Println(err)
+		opts := &dbs.SnapshotOptions{UserCreated: true, Name: *name, Description: *description}
+		var err error
+		if opts.Labels, err = parseLabels(*labels); err != nil {
+			fail(invalidArgument(err))
+		}
+		snapshotId, err := dbs.CreateSnapshot(*device, *volumeName, opts)
+		if err != nil {
+			fail(err)
 		}
+		fmt.Println(snapshotId)
 	}
 }
 
 func cmdCloneSnapshot(cmd *cli.Cmd) {
+	cmd.Spec = "[-r...] [--rate=<bandwidth>] [--iops=<iops>] [--at=<time>] [--verify] NEW_VOLUME_NAME SNAPSHOT"
+	parts := cmd.StringsOpt("r range", nil, "Only clone a range of the snapshot, as OFFSET:LENGTH in binary units (e.g. 1MB:512MB), placing ranges one after the other (repeatable)")
+	rate := cmd.StringOpt("rate", "", "Maximum bytes copied per second (e.g. 100MB), copying in the background to leave bandwidth to other volumes")
+	iops := cmd.IntOpt("iops", 0, "Maximum reads and writes per second, copying in the background")
+	at := cmd.StringOpt("at", "", "Clone the snapshot of the volume given as SNAPSHOT created last at or before a time (RFC 3339) or this long ago (e.g. 24h)")
+	verify := cmd.BoolOpt("verify", false, "Read back the clone and the snapshot and compare them, failing if they differ (not with ranges)")
 	newVolumeName := cmd.StringArg("NEW_VOLUME_NAME", "", "")
-	snapshotId := cmd.IntArg("SNAPSHOT_ID", 0, "")
+	snapshot := cmd.StringArg("SNAPSHOT", "", "Snapshot id or name, or volume name with --at")
 	cmd.Action = func() {
-		if err := dbs.CloneSnapshot(*device, *newVolumeName, uint(*snapshotId)); err != nil {
-			fmt.Println(err)
+		var snapshotId uint
+		if *at != "" {
+			si, err := dbs.FindSnapshotAt(*device, *snapshot, parseTime(*at))
+			if err != nil {
+				fail(err)
+			}
+			snapshotId = si.SnapshotId
+		} else {
+			snapshotId = resolveSnapshot(*snapshot)
+		}
+		var ranges []dbs.VolumeRange
+		for _, part := range *parts {
+			offset, length, ok := strings.Cut(part, ":")
+			bytesOffset, err := units.RAMInBytes(offset)
+			if err != nil || !ok {
+				fail(invalidArgument(fmt.Errorf("invalid range %v", part)))
+			}
+			bytesLength, err := units.RAMInBytes(length)
+			if err != nil || bytesOffset < 0 || bytesLength <= 0 {
+				fail(invalidArgument(fmt.Errorf("invalid range %v", part)))
+			}
+			ranges = append(ranges, dbs.VolumeRange{Offset: uint64(bytesOffset), Length: uint64(bytesLength)})
+		}
+		if *verify && len(ranges) > 0 {
+			fail(invalidArgument(fmt.Errorf("clones of ranges cannot be verified")))
+		}
+		var vi *dbs.VolumeInfo
+		var err error
+		if *rate != "" || *iops != 0 {
+			opts := &dbs.CloneOptions{}
+			if *rate != "" {
+				bandwidth, err := units.FromHumanSize(*rate)
+				if err != nil || bandwidth <= 0 {
+					fail(invalidArgument(fmt.Errorf("invalid rate %v", *rate)))
+				}
+				opts.MaxBandwidth = uint64(bandwidth)
+			}
+			if *iops < 0 {
+				fail(invalidArgument(fmt.Errorf("invalid IOPS limit %v", *iops)))
+			}
+			opts.MaxIops = uint(*iops)
+			var ji *dbs.JobInfo
+			if vi, ji, err = dbs.CloneSnapshotJob(*device, *newVolumeName, snapshotId, ranges, opts); err != nil {
+				fail(err)
+			}
+			waitJob(ji, nil)
+		} else if len(ranges) > 0 {
+			vi, err = dbs.CloneSnapshotRanges(*device, *newVolumeName, snapshotId, ranges)
+		} else {
+			vi, err = dbs.CloneSnapshot(*device, *newVolumeName, snapshotId)
+		}
+		if err != nil {
+			fail(err)
+		}
+		if *verify {
+			verifyClone(*newVolumeName, snapshotId)
+		}
+		fmt.Println(vi.SnapshotId)
+	}
+}
+
+// Compare a clone with its snapshot, printing the parts that differ and failing if any does.
+func verifyClone(volumeName string, snapshotId uint) {
+	cv, err := dbs.VerifyClone(*device, volumeName, snapshotId)
+	if err != nil {
+		fail(err)
+	}
+	for _, r := range cv.Mismatches {
+		fmt.Fprintf(os.Stderr, "Mismatch at offset %v, %v bytes\n", r.Offset, r.Length)
+	}
+	if len(cv.Mismatches) > 0 {
+		fail(fmt.Errorf("clone %v differs from snapshot %v in %v ranges", volumeName, snapshotId, len(cv.Mismatches)))
+	}
+	fmt.Fprintf(os.Stderr, "Verified %v extents\n", cv.Extents)
+}
+
+func cmdEstimateCloneSpace(cmd *cli.Cmd) {
+	snapshot := cmd.StringArg("SNAPSHOT", "", "Snapshot id or name")
+	cmd.Action = func() {
+		extents, err := dbs.EstimateCloneSpace(*device, resolveSnapshot(*snapshot))
+		if err != nil {
+			fail(err)
+		}
+		di, err := dbs.GetDeviceInfo(*device)
+		if err != nil {
+			fail(err)
+		}
+		free := di.TotalDeviceExtents - min(di.AllocatedDeviceExtents, di.TotalDeviceExtents)
+		fmt.Printf("Clone needs %v extents (%v), %v free\n", extents, units.HumanSize(float64(extents*dbs.EXTENT_SIZE)), free)
+	}
+}
+
+func cmdSnapshotAndClone(cmd *cli.Cmd) {
+	cmd.Spec = "[-l...] [-n=<name>] [-d=<description>] VOLUME_NAME NEW_VOLUME_NAME"
+	labels := cmd.StringsOpt("l label", nil, "Label of the snapshot as KEY=VALUE (repeatable)")
+	name := cmd.StringOpt("n name", "", "Unique name of the snapshot, usable instead of its id")
+	description := cmd.StringOpt("d description", "", "Why the snapshot is taken")
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	newVolumeName := cmd.StringArg("NEW_VOLUME_NAME", "", "")
+	cmd.Action = func() {
+		opts := &dbs.SnapshotOptions{UserCreated: true, Name: *name, Description: *description}
+		var err error
+		if opts.Labels, err = parseLabels(*labels); err != nil {
+			fail(invalidArgument(err))
+		}
+		snapshotId, _, err := dbs.SnapshotAndClone(*device, *volumeName, *newVolumeName, opts)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(snapshotId)
+	}
+}
+
+func cmdSetSnapshotName(cmd *cli.Cmd) {
+	snapshot := cmd.StringArg("SNAPSHOT", "", "Snapshot id or name")
+	name := cmd.StringArg("NAME", "", "New name, empty to remove it")
+	cmd.Action = func() {
+		if err := dbs.SetSnapshotName(*device, resolveSnapshot(*snapshot), *name); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetSnapshotDescription(cmd *cli.Cmd) {
+	snapshot := cmd.StringArg("SNAPSHOT", "", "Snapshot id or name")
+	description := cmd.StringArg("DESCRIPTION", "", "New description, empty to remove it")
+	cmd.Action = func() {
+		if err := dbs.SetSnapshotDescription(*device, resolveSnapshot(*snapshot), *description); err != nil {
+			fail(err)
 		}
 	}
 }
 
 func cmdDeleteVolume(cmd *cli.Cmd) {
+	cmd.Spec = "[--secure [--random]] VOLUME_NAME"
+	secure := cmd.BoolOpt("secure", false, "Overwrite the extents of the volume and its snapshots with zeroes before releasing them")
+	random := cmd.BoolOpt("random", false, "Overwrite with random data instead of zeroes")
 	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
 	cmd.Action = func() {
+		if *secure {
+			waitJob(dbs.DeleteVolumeSecure(*device, *volumeName, *random))
+			return
+		}
 		if err := dbs.DeleteVolume(*device, *volumeName); err != nil {
-			fmt.Println(err)
+			fail(err)
+		}
+	}
+}
+
+func cmdListDeletedVolumes(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		vi, err := dbs.ListDeletedVolumes(*device)
+		if err != nil {
+			fail(err)
+		}
+
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendRow(table.Row{"volume_name", "volume_size", "deleted_at", "snapshot_id", "snapshot_count"})
+		t.AppendSeparator()
+		for i := range vi {
+			t.AppendRow(table.Row{
+				vi[i].VolumeName,
+				units.HumanSize(float64(vi[i].VolumeSize)),
+				vi[i].DeletedAt,
+				vi[i].SnapshotId,
+				vi[i].SnapshotCount,
+			})
+		}
+		t.Render()
+	}
+}
+
+func cmdUndeleteVolume(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	cmd.Action = func() {
+		if err := dbs.UndeleteVolume(*device, *volumeName); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdPurgeVolume(cmd *cli.Cmd) {
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+	cmd.Action = func() {
+		if err := dbs.PurgeDeletedVolume(*device, *volumeName); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func cmdSetTrashRetention(cmd *cli.Cmd) {
+	retention := cmd.StringArg("RETENTION", "", "Duration to keep deleted volumes (e.g. 24h, 0 to disable)")
+	cmd.Action = func() {
+		d, err := time.ParseDuration(*retention)
+		if err != nil {
+			fail(invalidArgument(err))
+		}
+		if err := dbs.SetTrashRetention(*device, d); err != nil {
+			fail(err)
 		}
 	}
 }
 
 func cmdDeleteSnapshot(cmd *cli.Cmd) {
-	snapshotId := cmd.IntArg("SNAPSHOT_ID", 0, "")
+	cmd.Spec = "[--cascade | --secure [--random]] SNAPSHOT"
+	cascade := cmd.BoolOpt("cascade", false, "Also delete all older snapshots of the volume")
+	secure := cmd.BoolOpt("secure", false, "Overwrite the extents released with zeroes before releasing them")
+	random := cmd.BoolOpt("random", false, "Overwrite with random data instead of zeroes")
+	snapshot := cmd.StringArg("SNAPSHOT", "", "Snapshot id or name")
+	cmd.Action = func() {
+		snapshotId := resolveSnapshot(*snapshot)
+		if *secure {
+			waitJob(dbs.DeleteSnapshotSecure(*device, snapshotId, *random))
+			return
+		}
+		if !*cascade {
+			if err := dbs.DeleteSnapshot(*device, snapshotId); err != nil {
+				fail(err)
+			}
+			return
+		}
+		si, err := dbs.ListAllSnapshots(*device)
+		if err != nil {
+			fail(err)
+		}
+		i := slices.IndexFunc(si, func(s dbs.SnapshotInfo) bool { return s.SnapshotId == snapshotId })
+		if i < 0 || si[i].VolumeName == "" || si[i].VolumeDeleted {
+			fail(fmt.Errorf("%w: %v", dbs.ErrSnapshotNotFound, *snapshot))
+		}
+		printDeleted(dbs.DeleteSnapshots(*device, si[i].VolumeName, &dbs.SnapshotSelector{Oldest: snapshotId}))
+	}
+}
+
+func cmdDeleteSnapshots(cmd *cli.Cmd) {
+	cmd.Spec = "[--before=<time>] [-l...] VOLUME_NAME"
+	before := cmd.StringOpt("before", "", "Only snapshots created before a time (RFC 3339) or this long ago (e.g. 720h)")
+	labels := cmd.StringsOpt("l label", nil, "Only snapshots with the label, as KEY=VALUE (repeatable)")
+	volumeName := cmd.StringArg("VOLUME_NAME", "", "")
 	cmd.Action = func() {
-		if err := dbs.DeleteSnapshot(*device, uint(*snapshotId)); err != nil {
-			fmt.Println(err)
+		sel := &dbs.SnapshotSelector{Before: parseTime(*before)}
+		var err error
+		if sel.Labels, err = parseLabels(*labels); err != nil {
+			fail(invalidArgument(err))
 		}
+		printDeleted(dbs.DeleteSnapshots(*device, *volumeName, sel))
+	}
+}
+
+// Parse a time given in RFC 3339 or as a duration before now, returning the zero time for an empty string.
+func parseTime(arg string) time.Time {
+	if arg == "" {
+		return time.Time{}
 	}
+	if t, err := time.Parse(time.RFC3339, arg); err == nil {
+		return t
+	} else if d, err := time.ParseDuration(arg); err == nil && d >= 0 {
+		return time.Now().Add(-d)
+	}
+	fail(invalidArgument(fmt.Errorf("invalid time %v", arg)))
+	return time.Time{}
+}
+
+// Print the outcome of a bulk snapshot deletion.
+func printDeleted(deleted []uint, released uint, err error) {
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("Deleted %v snapshots, released %v extents (%v)\n", len(deleted), released, units.HumanSize(float64(released*dbs.EXTENT_SIZE)))
 }
 
 func main() {
+	// Print shell completion scripts with "dbsctl completion SHELL"
+	if runCompletion(os.Args) {
+		return
+	}
 	app := cli.App("dbsctl", "DBS command line tool")
+	// Usage errors exit with EXIT_USAGE, as the default code is used for missing objects
+	app.ErrorHandling = flag.ContinueOnError
+	jsonErrors = app.Bool(cli.BoolOpt{
+		Name:   "json-errors",
+		Value:  false,
+		Desc:   "Print errors as JSON objects with a code, for automation",
+		EnvVar: "DBSCTL_JSON_ERRORS",
+	})
 	device = app.StringArg("DEVICE", "", "")
 	app.Command("get_device_info", "", cmdGetDeviceInfo)
 	app.Command("get_volume_info", "", cmdGetVolumeInfo)
 	app.Command("get_snapshot_info", "", cmdGetSnapshotInfo)
+	app.Command("snapshot_usage", "", cmdSnapshotUsage)
+	app.Command("list_all_snapshots", "", cmdListAllSnapshots)
 	app.Command("init_device", "", cmdInitDevice)
 	app.Command("vacuum_device", "", cmdVacuumDevice)
+	app.Command("export_catalog", "", cmdExportCatalog)
+	app.Command("import_catalog", "", cmdImportCatalog)
+	app.Command("scrub_device", "", cmdScrubDevice)
+	app.Command("watch", "", cmdWatch)
+	app.Command("clients", "", cmdClients)
+	app.Command("resync_mirror", "", cmdResyncMirror)
+	app.Command("defragment_volume", "", cmdDefragmentVolume)
+	app.Command("jobs", "", cmdJobs)
+	app.Command("resume_job", "", cmdResumeJob)
+	app.Command("cancel_job", "", cmdCancelJob)
+	app.Command("relocate_extent", "", cmdRelocateExtent)
+	app.Command("preallocate_volume", "", cmdPreallocateVolume)
+	app.Command("set_device_allocation_policy", "", cmdSetDeviceAllocationPolicy)
+	app.Command("set_device_maintenance", "", cmdSetDeviceMaintenance)
+	app.Command("set_device_fast_region", "", cmdSetDeviceFastRegion)
+	app.Command("set_device_extent_times", "", cmdSetDeviceExtentTimes)
+	app.Command("rebalance_tiers", "", cmdRebalanceTiers)
 	app.Command("create_volume", "", cmdCreateVolume)
 	app.Command("rename_volume", "", cmdRenameVolume)
+	app.Command("concat_volumes", "", cmdConcatVolumes)
+	app.Command("split_volume", "", cmdSplitVolume)
+	app.Command("set_volume_allocation_policy", "", cmdSetVolumeAllocationPolicy)
+	app.Command("set_volume_tier", "", cmdSetVolumeTier)
+	app.Command("set_volume_retention", "", cmdSetVolumeRetention)
+	app.Command("set_volume_qos", "", cmdSetVolumeQoS)
+	app.Command("reset_volume_errors", "", cmdResetVolumeErrors)
+	app.Command("set_volume_group", "", cmdSetVolumeGroup)
+	app.Command("set_group_quota", "", cmdSetGroupQuota)
+	app.Command("get_group_info", "", cmdGetGroupInfo)
 	app.Command("create_snapshot", "", cmdCreateSnapshot)
+	app.Command("snapshot_group", "", cmdSnapshotGroup)
+	app.Command("snapshot_and_clone", "", cmdSnapshotAndClone)
+	app.Command("set_snapshot_name", "", cmdSetSnapshotName)
+	app.Command("set_snapshot_description", "", cmdSetSnapshotDescription)
 	app.Command("clone_snapshot", "", cmdCloneSnapshot)
+	app.Command("provision", "", cmdProvision)
+	app.Command("estimate_clone_space", "", cmdEstimateCloneSpace)
 	app.Command("delete_volume", "", cmdDeleteVolume)
 	app.Command("delete_snapshot", "", cmdDeleteSnapshot)
-	app.Run(os.Args)
+	app.Command("delete_snapshots", "", cmdDeleteSnapshots)
+	app.Command("delete_group", "", cmdDeleteGroup)
+	app.Command("list_deleted_volumes", "", cmdListDeletedVolumes)
+	app.Command("undelete_volume", "", cmdUndeleteVolume)
+	app.Command("purge_volume", "", cmdPurgeVolume)
+	app.Command("set_trash_retention", "", cmdSetTrashRetention)
+	app.Command("apply", "Create, rename and delete volumes to match a manifest", cmdApply)
+	app.Command("extract", "Extract files from the filesystem in a snapshot", cmdExtract)
+	app.Command("inspect", "Low-level metadata inspection", cmdInspect)
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(EXIT_USAGE)
+	}
 }
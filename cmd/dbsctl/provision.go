@@ -0,0 +1,80 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jawher/mow.cli"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Volumes created by provision, printed as JSON for orchestration tools. Volumes have no identity of their own,
+// so they are known by name on the device with the UUID.
+type provisionResult struct {
+	DeviceUUID         string              `json:"device_uuid"`
+	TemplateSnapshotId uint                `json:"template_snapshot_id"`
+	Volumes            []provisionedVolume `json:"volumes"`
+}
+
+type provisionedVolume struct {
+	VolumeName string `json:"volume_name"`
+	VolumeSize uint64 `json:"volume_size"`
+	SnapshotId uint   `json:"snapshot_id"`
+}
+
+func cmdProvision(cmd *cli.Cmd) {
+	cmd.Spec = "--template=<snapshot> --count=<n> --prefix=<prefix> [--start=<n>]"
+	template := cmd.StringOpt("t template", "", "Snapshot id or name to clone")
+	count := cmd.IntOpt("n count", 0, "Number of volumes to create")
+	prefix := cmd.StringOpt("p prefix", "", "Prefix of the volume names, followed by a number")
+	start := cmd.IntOpt("start", 1, "Number of the first volume")
+	cmd.Action = func() {
+		if *count <= 0 || *count > dbs.MAX_VOLUMES {
+			fail(invalidArgument(fmt.Errorf("invalid count %v", *count)))
+		}
+		if *start < 0 {
+			fail(invalidArgument(fmt.Errorf("invalid start %v", *start)))
+		}
+		snapshotId := resolveSnapshot(*template)
+		names := make([]string, *count)
+		for i := range names {
+			names[i] = fmt.Sprintf("%v%v", *prefix, *start+i)
+		}
+		vi, err := dbs.CloneSnapshotMany(*device, snapshotId, names)
+		if err != nil {
+			fail(err)
+		}
+		di, err := dbs.GetDeviceInfo(*device)
+		if err != nil {
+			fail(err)
+		}
+		result := provisionResult{DeviceUUID: di.UUID, TemplateSnapshotId: snapshotId}
+		for i := range vi {
+			result.Volumes = append(result.Volumes, provisionedVolume{
+				VolumeName: vi[i].VolumeName,
+				VolumeSize: vi[i].VolumeSize,
+				SnapshotId: vi[i].SnapshotId,
+			})
+		}
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(string(data))
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+
+	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/client"
+)
+
+// Clear the terminal and move the cursor home.
+const CLEAR_SCREEN = "\033[H\033[2J"
+
+// Refresh a view of device and volume usage until interrupted, like watch(1) over get_device_info and
+// get_volume_info. The device is polled from this process, where metadata is only read again after it
+// changes, or, with --api, through the management API of the dbssrv serving it. Volume stats are written to
+// the device by dbssrv every STATS_FLUSH_INTERVAL, so watching a volume's I/O needs the API to be up to date.
+func cmdWatch(cmd *cli.Cmd) {
+	cmd.Spec = "[-n=<seconds>] [--volume=<name>] [--api=<url> [--api-key=<key>]]"
+	interval := cmd.IntOpt("n interval", 2, "Seconds between refreshes")
+	volumeName := cmd.StringOpt("volume", "", "Show the I/O of this volume")
+	apiURL := cmd.StringOpt("api", "", "Query the dbssrv serving the device through its management API at this URL")
+	apiKey := cmd.StringOpt("api-key", "", "API key for the management API")
+	cmd.Action = func() {
+		if *interval <= 0 {
+			fail(invalidArgument(fmt.Errorf("interval must be positive")))
+		}
+		var m client.Manager = client.NewLocal(*device)
+		if *apiURL != "" {
+			m = client.New(*apiURL, client.WithAPIKey(*apiKey))
+		}
+		every := time.Duration(*interval) * time.Second
+		header := fmt.Sprintf("Every %v: %v", every, strings.Join(os.Args[1:], " "))
+		var last *volumeSample
+		for {
+			var view strings.Builder
+			var err error
+			if *volumeName != "" {
+				last, err = renderVolumeIO(&view, m, *volumeName, last)
+			} else {
+				err = renderUsage(&view, m)
+			}
+			if err != nil {
+				fail(err)
+			}
+			fmt.Printf("%v%v%*v\n\n%v", CLEAR_SCREEN, header, max(0, 80-len(header)), time.Now().Format(time.TimeOnly), view.String())
+			time.Sleep(every)
+		}
+	}
+}
+
+func renderUsage(view *strings.Builder, m client.Manager) error {
+	di, err := m.GetDeviceInfo()
+	if err != nil {
+		return err
+	}
+	vi, err := m.GetVolumeInfo()
+	if err != nil {
+		return err
+	}
+	var allocated uint64
+	if di.TotalDeviceExtents > 0 {
+		allocated = uint64(di.AllocatedDeviceExtents) * 100 / uint64(di.TotalDeviceExtents)
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(view)
+	t.AppendRow(table.Row{"device_size", "allocated", "free", "volumes", "maintenance", "mirror_failed"})
+	t.AppendSeparator()
+	t.AppendRow(table.Row{
+		units.HumanSize(float64(di.DeviceSize)),
+		fmt.Sprintf("%v (%v%%)", units.HumanSize(float64(uint64(di.AllocatedDeviceExtents)*dbs.EXTENT_SIZE)), allocated),
+		units.HumanSize(float64(uint64(di.TotalDeviceExtents-di.AllocatedDeviceExtents) * dbs.EXTENT_SIZE)),
+		di.VolumeCount,
+		di.Maintenance,
+		orDash(di.MirrorFailed),
+	})
+	t.Render()
+	view.WriteString("\n")
+
+	t = table.NewWriter()
+	t.SetOutputMirror(view)
+	t.AppendRow(table.Row{"volume_name", "volume_size", "snapshot_count", "group", "bytes_written", "bytes_read", "last_write_time", "media_errors"})
+	t.AppendSeparator()
+	for i := range vi {
+		t.AppendRow(table.Row{
+			vi[i].VolumeName,
+			units.HumanSize(float64(vi[i].VolumeSize)),
+			vi[i].SnapshotCount,
+			vi[i].Group,
+			units.HumanSize(float64(vi[i].BytesWritten)),
+			units.HumanSize(float64(vi[i].BytesRead)),
+			humanTime(vi[i].LastWriteTime),
+			humanMediaErrors(&vi[i]),
+		})
+	}
+	t.Render()
+	return nil
+}
+
+// Counters of a volume at a refresh, to show rates since the previous one.
+type volumeSample struct {
+	at   time.Time
+	info dbs.VolumeInfo
+}
+
+func renderVolumeIO(view *strings.Builder, m client.Manager, volumeName string, last *volumeSample) (*volumeSample, error) {
+	vi, err := m.GetVolumeInfo()
+	if err != nil {
+		return nil, err
+	}
+	var sample *volumeSample
+	for i := range vi {
+		if vi[i].VolumeName == volumeName {
+			sample = &volumeSample{at: time.Now(), info: vi[i]}
+			break
+		}
+	}
+	if sample == nil {
+		return nil, fmt.Errorf("%w: %v", dbs.ErrVolumeNotFound, volumeName)
+	}
+	rate := func(now, before uint64) string {
+		if last == nil || now < before {
+			return "-"
+		}
+		return units.HumanSize(float64(now-before)/sample.at.Sub(last.at).Seconds()) + "/s"
+	}
+	info := &sample.info
+	var lastInfo dbs.VolumeInfo
+	if last != nil {
+		lastInfo = last.info
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(view)
+	t.AppendRows([]table.Row{
+		{"volume_name", info.VolumeName},
+		{"volume_size", units.HumanSize(float64(info.VolumeSize))},
+		{"write_rate", rate(info.BytesWritten, lastInfo.BytesWritten)},
+		{"read_rate", rate(info.BytesRead, lastInfo.BytesRead)},
+		{"bytes_written", units.HumanSize(float64(info.BytesWritten))},
+		{"bytes_read", units.HumanSize(float64(info.BytesRead))},
+		{"copied_extents", info.CopiedExtents},
+		{"last_write_time", humanTime(info.LastWriteTime)},
+		{"last_read_time", humanTime(info.LastReadTime)},
+		{"max_iops", humanLimit(uint64(info.MaxIops), false)},
+		{"max_bandwidth", humanLimit(info.MaxBandwidth, true)},
+		{"media_errors", humanMediaErrors(info)},
+	})
+	t.Render()
+	return sample, nil
+}
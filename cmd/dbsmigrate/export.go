@@ -0,0 +1,268 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/go-units"
+
+	"github.com/Kampadais/dbs"
+)
+
+const (
+	QCOW2_CLUSTER_BITS   = 16
+	QCOW2_CLUSTER_SIZE   = 1 << QCOW2_CLUSTER_BITS
+	QCOW2_REFCOUNT_ORDER = 4 // 16-bit refcounts
+	QCOW2_HEADER_LENGTH  = 104
+	QCOW2_COPIED         = 1 << 63
+)
+
+// Cluster of the guest set by an image.
+type qcow2Cluster struct {
+	index uint64
+	zero  bool // Reads as zeroes, without data
+}
+
+// Return the clusters covering the ranges set by a snapshot. Clusters with data, or zeroed only in part, are
+// copied from the snapshot, while those zeroed in full are only marked.
+func qcow2Clusters(size uint64, ranges []dbs.VolumeRange) []qcow2Cluster {
+	var clusters []qcow2Cluster
+	var zeroed uint64 // Bytes of the last cluster zeroed
+	settle := func() {
+		if n := len(clusters); n > 0 && clusters[n-1].zero {
+			clusters[n-1].zero = zeroed == min(QCOW2_CLUSTER_SIZE, size-clusters[n-1].index*QCOW2_CLUSTER_SIZE)
+		}
+	}
+	for _, r := range ranges {
+		for offset := r.Offset; offset < min(r.Offset+r.Length, size); {
+			index := offset / QCOW2_CLUSTER_SIZE
+			end := min((index+1)*QCOW2_CLUSTER_SIZE, r.Offset+r.Length, size)
+			if n := len(clusters); n == 0 || clusters[n-1].index != index {
+				settle()
+				clusters = append(clusters, qcow2Cluster{index: index, zero: true})
+				zeroed = 0
+			}
+			if r.Zeroed {
+				zeroed += end - offset
+			} else {
+				clusters[len(clusters)-1].zero = false
+			}
+			offset = end
+		}
+	}
+	settle()
+	return clusters
+}
+
+// Round up a size in bytes to clusters.
+func toClusters(size uint64) uint64 {
+	return (size + QCOW2_CLUSTER_SIZE - 1) / QCOW2_CLUSTER_SIZE
+}
+
+// Write a qcow2 image holding the given clusters of a snapshot, over a backing file if not empty. The image is
+// laid out as the header, the L1 table, the refcount table and blocks, the L2 tables and the data clusters.
+// Returns the bytes of data written.
+func writeQcow2(path string, backing string, clusters []qcow2Cluster, vc *dbs.VolumeContext) (uint64, error) {
+	size := vc.VolumeSize()
+	l2Entries := uint64(QCOW2_CLUSTER_SIZE / 8)
+	l1Size := (toClusters(size) + l2Entries - 1) / l2Entries
+	var l2Count, dataCount uint64
+	for i, c := range clusters {
+		if i == 0 || c.index/l2Entries != clusters[i-1].index/l2Entries {
+			l2Count++
+		}
+		if !c.zero {
+			dataCount++
+		}
+	}
+	// The refcount structures cover all clusters, themselves included
+	refcountsPerBlock := uint64(QCOW2_CLUSTER_SIZE * 8 >> QCOW2_REFCOUNT_ORDER)
+	l1Clusters := toClusters(l1Size * 8)
+	var rtClusters, rbCount, total uint64
+	for {
+		total = 1 + l1Clusters + rtClusters + rbCount + l2Count + dataCount
+		rb := (total + refcountsPerBlock - 1) / refcountsPerBlock
+		rt := toClusters(rb * 8)
+		if rb == rbCount && rt == rtClusters {
+			break
+		}
+		rbCount, rtClusters = rb, rt
+	}
+	l1Offset := uint64(QCOW2_CLUSTER_SIZE)
+	rtOffset := l1Offset + l1Clusters*QCOW2_CLUSTER_SIZE
+	rbOffset := rtOffset + rtClusters*QCOW2_CLUSTER_SIZE
+	l2Offset := rbOffset + rbCount*QCOW2_CLUSTER_SIZE
+	dataOffset := l2Offset + l2Count*QCOW2_CLUSTER_SIZE
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header, err := qcow2HeaderCluster(size, backing, l1Size, l1Offset, rtOffset, rtClusters)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return 0, err
+	}
+
+	// Data clusters, with the tables pointing to them
+	l1 := make([]uint64, l1Size)
+	var l2 []uint64
+	l2Next, dataNext := l2Offset, dataOffset
+	buf := make([]byte, QCOW2_CLUSTER_SIZE)
+	writeL2 := func(l1Index uint64) error {
+		l1[l1Index] = l2Next | QCOW2_COPIED
+		if _, err := f.WriteAt(qcow2Table(l2), int64(l2Next)); err != nil {
+			return err
+		}
+		l2Next += QCOW2_CLUSTER_SIZE
+		return nil
+	}
+	for i, c := range clusters {
+		if i == 0 || c.index/l2Entries != clusters[i-1].index/l2Entries {
+			if i > 0 {
+				if err := writeL2(clusters[i-1].index / l2Entries); err != nil {
+					return 0, err
+				}
+			}
+			l2 = make([]uint64, l2Entries)
+		}
+		if c.zero {
+			l2[c.index%l2Entries] = QCOW2_ZERO
+			continue
+		}
+		offset := c.index * QCOW2_CLUSTER_SIZE
+		length := min(QCOW2_CLUSTER_SIZE, size-offset)
+		clear(buf)
+		if err := vc.ReadAt(buf[:length], offset); err != nil {
+			return 0, err
+		}
+		if _, err := f.WriteAt(buf, int64(dataNext)); err != nil {
+			return 0, err
+		}
+		l2[c.index%l2Entries] = dataNext | QCOW2_COPIED
+		dataNext += QCOW2_CLUSTER_SIZE
+	}
+	if len(clusters) > 0 {
+		if err := writeL2(clusters[len(clusters)-1].index / l2Entries); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.WriteAt(qcow2Table(l1), int64(l1Offset)); err != nil {
+		return 0, err
+	}
+
+	// Every cluster up to the end is in use once
+	rt := make([]uint64, rtClusters*QCOW2_CLUSTER_SIZE/8)
+	refcounts := make([]byte, rbCount*QCOW2_CLUSTER_SIZE)
+	for i := uint64(0); i < rbCount; i++ {
+		rt[i] = rbOffset + i*QCOW2_CLUSTER_SIZE
+	}
+	for i := uint64(0); i < total; i++ {
+		binary.BigEndian.PutUint16(refcounts[i*2:], 1)
+	}
+	if _, err := f.WriteAt(qcow2Table(rt), int64(rtOffset)); err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(refcounts, int64(rbOffset)); err != nil {
+		return 0, err
+	}
+	if err := f.Truncate(int64(total * QCOW2_CLUSTER_SIZE)); err != nil {
+		return 0, err
+	}
+	return dataCount * QCOW2_CLUSTER_SIZE, f.Close()
+}
+
+func qcow2Table(entries []uint64) []byte {
+	buf := make([]byte, len(entries)*8)
+	for i, e := range entries {
+		binary.BigEndian.PutUint64(buf[i*8:], e)
+	}
+	return buf
+}
+
+// Return the first cluster of an image: the version 3 header, the header extension with the format of the
+// backing file, and the name of the backing file.
+func qcow2HeaderCluster(size uint64, backing string, l1Size uint64, l1Offset uint64, rtOffset uint64, rtClusters uint64) ([]byte, error) {
+	var ext bytes.Buffer
+	if backing != "" {
+		binary.Write(&ext, binary.BigEndian, []uint32{QCOW2_EXT_BACKING_FMT, 5})
+		ext.WriteString("qcow2\x00\x00\x00")
+	}
+	binary.Write(&ext, binary.BigEndian, []uint32{0, 0})
+	h := qcow2Header{
+		Magic:                 QCOW2_MAGIC,
+		Version:               3,
+		ClusterBits:           QCOW2_CLUSTER_BITS,
+		Size:                  size,
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         l1Offset,
+		RefcountTableOffset:   rtOffset,
+		RefcountTableClusters: uint32(rtClusters),
+		RefcountOrder:         QCOW2_REFCOUNT_ORDER,
+		HeaderLength:          QCOW2_HEADER_LENGTH,
+	}
+	if backing != "" {
+		h.BackingFileOffset = uint64(QCOW2_HEADER_LENGTH + ext.Len())
+		h.BackingFileSize = uint32(len(backing))
+	}
+	if QCOW2_HEADER_LENGTH+ext.Len()+len(backing) > QCOW2_CLUSTER_SIZE {
+		return nil, fmt.Errorf("backing file name too long")
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	buf.Write(make([]byte, QCOW2_HEADER_LENGTH-buf.Len()))
+	buf.Write(ext.Bytes())
+	buf.WriteString(backing)
+	return buf.Bytes(), nil
+}
+
+// Export the snapshots of a volume to a directory, as a qcow2 image per snapshot backed by the image of its
+// parent, named after the volume and snapshot. The image of the current snapshot is the top of the chain.
+func export(device string, volumeName string, dir string, opts []dbs.Option) error {
+	si, err := dbs.GetSnapshotInfo(device, volumeName)
+	if err != nil {
+		return err
+	}
+	backing := ""
+	for i := len(si) - 1; i >= 0; i-- {
+		ranges, err := dbs.GetSnapshotRanges(device, si[i].SnapshotId)
+		if err != nil {
+			return err
+		}
+		vc, err := dbs.OpenSnapshot(device, si[i].SnapshotId, opts...)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%v-%v.qcow2", volumeName, si[i].SnapshotId)
+		copied, err := writeQcow2(filepath.Join(dir, name), backing, qcow2Clusters(vc.VolumeSize(), ranges), vc)
+		if cerr := vc.CloseVolume(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		fmt.Printf("Snapshot %v: %v, %v copied\n", si[i].SnapshotId, name, units.HumanSize(float64(copied)))
+		backing = name
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Migration of qcow2 backing chains and LVM thin snapshots to DBS volumes and back, keeping the snapshots.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/jawher/mow.cli"
+
+	"github.com/Kampadais/dbs"
+)
+
+// A layer of a snapshot chain, holding the changes over the layers before it.
+type layer interface {
+	Name() string
+	Size() uint64
+	ModTime() time.Time // When the layer was last written, zero if unknown
+	// Call fn for each range the layer sets, in order, with its data, or nil if it reads as zeroes.
+	Ranges(fn func(offset uint64, length uint64, data []byte) error) error
+	Close() error
+}
+
+// Copy the layers, oldest first, to a new volume, snapshotting it after each layer but the last, so that the
+// volume holds the last layer and its snapshots the others. The volume is deleted if the migration fails.
+func migrate(device string, volumeName string, layers []layer, opts []dbs.Option) error {
+	var size uint64
+	for _, l := range layers {
+		size = max(size, l.Size())
+	}
+	// Volume sizes are whole extents
+	size = (size + dbs.EXTENT_SIZE - 1) / dbs.EXTENT_SIZE * dbs.EXTENT_SIZE
+	if _, err := dbs.CreateVolume(device, volumeName, size); err != nil {
+		return err
+	}
+	for i, l := range layers {
+		copied, err := copyLayer(device, volumeName, l, i == 0, opts)
+		if err != nil {
+			dbs.DeleteVolume(device, volumeName)
+			return fmt.Errorf("%v: %w", l.Name(), err)
+		}
+		fmt.Printf("Layer %v/%v %v: %v copied\n", i+1, len(layers), l.Name(), units.HumanSize(float64(copied)))
+		if i == len(layers)-1 {
+			break
+		}
+		// The next layer was started when this one was last written
+		snapshot := &dbs.SnapshotOptions{
+			CreatedAt:   l.ModTime(),
+			UserCreated: true,
+			Labels:      map[string]string{"source": filepath.Base(layers[i+1].Name())},
+		}
+		if _, err := dbs.CreateSnapshot(device, volumeName, snapshot); err != nil {
+			dbs.DeleteVolume(device, volumeName)
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the ranges of a layer to the volume, returning the bytes written. Zeroed ranges are unmapped, unless in
+// the first layer, where there is nothing to unmap.
+func copyLayer(device string, volumeName string, l layer, first bool, opts []dbs.Option) (uint64, error) {
+	vc, err := dbs.OpenVolume(device, volumeName, opts...)
+	if err != nil {
+		return 0, err
+	}
+	copied := uint64(0)
+	err = l.Ranges(func(offset uint64, length uint64, data []byte) error {
+		if data == nil {
+			if first {
+				return nil
+			}
+			return vc.UnmapAt(length, offset)
+		}
+		copied += length
+		return vc.WriteAt(data, offset, true)
+	})
+	if cerr := vc.CloseVolume(); err == nil {
+		err = cerr
+	}
+	return copied, err
+}
+
+// Migrate the layers opened, then close them.
+func run(device string, volumeName string, layers []layer, err error, opts []dbs.Option) {
+	if err == nil {
+		err = migrate(device, volumeName, layers, opts)
+	}
+	for _, l := range layers {
+		l.Close()
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	app := cli.App("dbsmigrate", "Import snapshot chains to DBS volumes, or export them")
+	app.Spec = "[OPTIONS] DEVICE"
+	device := app.StringArg("DEVICE", "", "")
+	buffered := app.BoolOpt("buffered", false, "Use buffered instead of direct I/O")
+	options := func() []dbs.Option {
+		if *buffered {
+			return []dbs.Option{dbs.WithBufferedIO()}
+		}
+		return nil
+	}
+	app.Command("qcow2", "Import a qcow2 image and its backing chain, with a snapshot per backing file", func(cmd *cli.Cmd) {
+		cmd.Spec = "VOLUME_NAME IMAGE"
+		volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+		image := cmd.StringArg("IMAGE", "", "Top image of the chain")
+		cmd.Action = func() {
+			layers, err := openQcow2Chain(*image)
+			run(*device, *volumeName, layers, err, options())
+		}
+	})
+	app.Command("lvm", "Import LVM thin snapshots of a volume, or other raw images, with a snapshot per image but the last", func(cmd *cli.Cmd) {
+		cmd.Spec = "VOLUME_NAME IMAGE..."
+		volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+		images := cmd.StringsArg("IMAGE", nil, "Activated snapshots, oldest first, then the origin")
+		cmd.Action = func() {
+			layers, err := openRawChain(*images)
+			run(*device, *volumeName, layers, err, options())
+		}
+	})
+	app.Command("export", "Export a volume as a qcow2 backing chain, with an image per snapshot", func(cmd *cli.Cmd) {
+		cmd.Spec = "VOLUME_NAME DIR"
+		volumeName := cmd.StringArg("VOLUME_NAME", "", "")
+		dir := cmd.StringArg("DIR", "", "Directory to write the images to")
+		cmd.Action = func() {
+			if err := export(*device, *volumeName, *dir, options()); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	})
+	app.Run(os.Args)
+}
@@ -0,0 +1,323 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	QCOW2_MAGIC = 0x514649fb // "QFI\xfb"
+
+	QCOW2_OFFSET_MASK     = 0x00fffffffffffe00
+	QCOW2_COMPRESSED      = 1 << 62
+	QCOW2_ZERO            = 1 << 0
+	QCOW2_EXT_BACKING_FMT = 0xe2792aca
+
+	// Incompatible features that can be ignored when reading: dirty and corrupt refcounts, and deflate
+	// compression declared explicitly
+	QCOW2_INCOMPAT_DIRTY       = 1 << 0
+	QCOW2_INCOMPAT_COMPRESSION = 1 << 3
+)
+
+var errUnsupported = errors.New("unsupported image")
+
+// Fields of the qcow2 header (version 2, and the start of version 3).
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// Image in a qcow2 backing chain. Only the clusters allocated in the image itself are returned as ranges, as
+// those of its backing file belong to the layer below.
+type qcow2Image struct {
+	f           *os.File
+	path        string
+	header      qcow2Header
+	clusterSize uint64
+	backing     string // Path of the backing file, empty if none
+	backingFmt  string // Format of the backing file, empty if not recorded
+	modTime     time.Time
+}
+
+func openQcow2(path string) (*qcow2Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img := &qcow2Image{f: f, path: path}
+	if err := img.readHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if fi, err := f.Stat(); err == nil {
+		img.modTime = fi.ModTime()
+	}
+	return img, nil
+}
+
+func (img *qcow2Image) readHeader() error {
+	h := &img.header
+	buf := make([]byte, binary.Size(h))
+	if _, err := img.f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, h); err != nil {
+		return err
+	}
+	if h.Magic != QCOW2_MAGIC {
+		return fmt.Errorf("%w: not a qcow2 image", errUnsupported)
+	}
+	headerLength := uint64(72)
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures, h.CompatibleFeatures, h.AutoclearFeatures = 0, 0, 0
+	case 3:
+		headerLength = uint64(h.HeaderLength)
+		if h.IncompatibleFeatures&^(QCOW2_INCOMPAT_DIRTY|QCOW2_INCOMPAT_COMPRESSION) != 0 {
+			return fmt.Errorf("%w: incompatible features %#x", errUnsupported, h.IncompatibleFeatures)
+		}
+		if h.IncompatibleFeatures&QCOW2_INCOMPAT_COMPRESSION != 0 {
+			ct := make([]byte, 1)
+			if _, err := img.f.ReadAt(ct, 104); err != nil {
+				return err
+			}
+			if ct[0] != 0 {
+				return fmt.Errorf("%w: compression type %v", errUnsupported, ct[0])
+			}
+		}
+	default:
+		return fmt.Errorf("%w: version %v", errUnsupported, h.Version)
+	}
+	if h.CryptMethod != 0 {
+		return fmt.Errorf("%w: encrypted", errUnsupported)
+	}
+	if h.ClusterBits < 9 || h.ClusterBits > 21 {
+		return fmt.Errorf("%w: cluster bits %v", errUnsupported, h.ClusterBits)
+	}
+	img.clusterSize = 1 << h.ClusterBits
+	if h.BackingFileOffset != 0 {
+		var err error
+		name := make([]byte, h.BackingFileSize)
+		if _, err = img.f.ReadAt(name, int64(h.BackingFileOffset)); err != nil {
+			return err
+		}
+		img.backing = string(name)
+		if !filepath.IsAbs(img.backing) {
+			img.backing = filepath.Join(filepath.Dir(img.path), img.backing)
+		}
+		if img.backingFmt, err = img.backingFormat(headerLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the format of the backing file from the header extensions, empty if not given.
+func (img *qcow2Image) backingFormat(offset uint64) (string, error) {
+	for {
+		var ext struct {
+			Type   uint32
+			Length uint32
+		}
+		buf := make([]byte, 8)
+		if _, err := img.f.ReadAt(buf, int64(offset)); err != nil {
+			return "", err
+		}
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, &ext)
+		switch ext.Type {
+		case 0:
+			return "", nil
+		case QCOW2_EXT_BACKING_FMT:
+			format := make([]byte, ext.Length)
+			if _, err := img.f.ReadAt(format, int64(offset+8)); err != nil {
+				return "", err
+			}
+			return string(format), nil
+		}
+		offset += 8 + (uint64(ext.Length)+7)/8*8
+	}
+}
+
+func (img *qcow2Image) Name() string {
+	return img.path
+}
+
+func (img *qcow2Image) Size() uint64 {
+	return img.header.Size
+}
+
+func (img *qcow2Image) ModTime() time.Time {
+	return img.modTime
+}
+
+func (img *qcow2Image) Close() error {
+	return img.f.Close()
+}
+
+func (img *qcow2Image) readTable(offset uint64, entries uint64) ([]uint64, error) {
+	buf := make([]byte, entries*8)
+	if _, err := img.f.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+// Read a compressed cluster, described by an L2 entry.
+func (img *qcow2Image) readCompressed(entry uint64, data []byte) error {
+	bits := 62 - (img.header.ClusterBits - 8)
+	offset := entry & (1<<bits - 1)
+	sectors := (entry>>bits)&(1<<(img.header.ClusterBits-8)-1) + 1
+	buf := make([]byte, sectors*512-(offset&511))
+	if _, err := img.f.ReadAt(buf, int64(offset)); err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(buf)), data); err != nil {
+		return fmt.Errorf("cannot decompress cluster at %v: %w", offset, err)
+	}
+	return nil
+}
+
+func (img *qcow2Image) Ranges(fn func(offset uint64, length uint64, data []byte) error) error {
+	l1, err := img.readTable(img.header.L1TableOffset, uint64(img.header.L1Size))
+	if err != nil {
+		return err
+	}
+	l2Entries := img.clusterSize / 8
+	data := make([]byte, img.clusterSize)
+	for i, l1e := range l1 {
+		if l1e&QCOW2_OFFSET_MASK == 0 {
+			continue
+		}
+		l2, err := img.readTable(l1e&QCOW2_OFFSET_MASK, l2Entries)
+		if err != nil {
+			return err
+		}
+		for j, l2e := range l2 {
+			offset := (uint64(i)*l2Entries + uint64(j)) * img.clusterSize
+			if offset >= img.header.Size {
+				return nil
+			}
+			length := min(img.clusterSize, img.header.Size-offset)
+			switch {
+			case l2e&QCOW2_COMPRESSED != 0:
+				if err := img.readCompressed(l2e&^QCOW2_COMPRESSED&^(1<<63), data); err != nil {
+					return err
+				}
+			case l2e&QCOW2_ZERO != 0 && img.header.Version >= 3:
+				if err := fn(offset, length, nil); err != nil {
+					return err
+				}
+				continue
+			case l2e&QCOW2_OFFSET_MASK == 0:
+				continue
+			default:
+				if _, err := img.f.ReadAt(data, int64(l2e&QCOW2_OFFSET_MASK)); err != nil && err != io.EOF {
+					return err
+				}
+			}
+			if err := fn(offset, length, data[:length]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return true if the image at the path does not start with the qcow2 magic.
+func isRaw(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var magic uint32
+	if err := binary.Read(f, binary.BigEndian, &magic); err != nil && err != io.EOF {
+		return false, err
+	}
+	return magic != QCOW2_MAGIC, nil
+}
+
+// Open a qcow2 image and its backing files, returning the layers of the chain with the base first. A raw base
+// image is compared to nothing, so only its non-zero blocks are copied.
+func openQcow2Chain(path string) ([]layer, error) {
+	var layers []layer
+	closeAll := func() {
+		for _, l := range layers {
+			l.Close()
+		}
+	}
+	for path != "" {
+		img, err := openQcow2(path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		layers = append([]layer{img}, layers...)
+		if len(layers) > 256 {
+			closeAll()
+			return nil, fmt.Errorf("%w: backing chain too long", errUnsupported)
+		}
+		path = img.backing
+		if path == "" {
+			break
+		}
+		raw := img.backingFmt == "raw"
+		if img.backingFmt == "" {
+			if raw, err = isRaw(path); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+		if raw {
+			raw, err := openRaw(path, nil)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			layers = append([]layer{raw}, layers...)
+			path = ""
+		}
+	}
+	return layers, nil
+}
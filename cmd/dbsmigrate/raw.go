@@ -0,0 +1,156 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Raw image of a volume, like an LVM thin snapshot or origin. Without access to the allocation of the image, the
+// blocks it sets are found by comparing it with the previous layer, so only blocks that differ are copied.
+type rawImage struct {
+	f       *os.File
+	path    string
+	size    uint64
+	prev    *rawImage // Previous layer, nil for the first
+	modTime time.Time // Zero for devices, as their times do not reflect the data
+}
+
+func openRaw(path string, prev *rawImage) (*rawImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// Seeking gives the size of block devices as well
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	img := &rawImage{f: f, path: path, size: uint64(size), prev: prev}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		img.modTime = fi.ModTime()
+	}
+	return img, nil
+}
+
+// Open raw images, oldest first, as the layers of a chain.
+func openRawChain(paths []string) ([]layer, error) {
+	var layers []layer
+	var prev *rawImage
+	for _, path := range paths {
+		img, err := openRaw(path, prev)
+		if err != nil {
+			for _, l := range layers {
+				l.Close()
+			}
+			return nil, err
+		}
+		layers = append(layers, img)
+		prev = img
+	}
+	return layers, nil
+}
+
+func (img *rawImage) Name() string {
+	return img.path
+}
+
+func (img *rawImage) Size() uint64 {
+	return img.size
+}
+
+func (img *rawImage) ModTime() time.Time {
+	return img.modTime
+}
+
+func (img *rawImage) Close() error {
+	return img.f.Close()
+}
+
+// Read part of the image, with zeroes past its end.
+func (img *rawImage) readAt(data []byte, offset uint64) error {
+	clear(data)
+	if offset >= img.size {
+		return nil
+	}
+	n := min(uint64(len(data)), img.size-offset)
+	_, err := img.f.ReadAt(data[:n], int64(offset))
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// Blocks of a layer, as compared with the previous one.
+const (
+	BLOCK_UNCHANGED = iota
+	BLOCK_CHANGED
+	BLOCK_ZEROED
+)
+
+func (img *rawImage) Ranges(fn func(offset uint64, length uint64, data []byte) error) error {
+	var zero [dbs.BLOCK_SIZE]byte
+	data := make([]byte, dbs.EXTENT_SIZE)
+	prev := make([]byte, dbs.EXTENT_SIZE) // Zeroes for the first layer
+	for offset := uint64(0); offset < img.size; offset += dbs.EXTENT_SIZE {
+		if err := img.readAt(data, offset); err != nil {
+			return err
+		}
+		if img.prev != nil {
+			if err := img.prev.readAt(prev, offset); err != nil {
+				return err
+			}
+		}
+		// Pass on runs of changed or zeroed blocks
+		length := min(uint64(dbs.EXTENT_SIZE), img.size-offset)
+		start, kind := uint64(0), BLOCK_UNCHANGED
+		flush := func(end uint64) error {
+			switch {
+			case end == start || kind == BLOCK_UNCHANGED:
+				return nil
+			case kind == BLOCK_ZEROED:
+				return fn(offset+start, end-start, nil)
+			default:
+				return fn(offset+start, end-start, data[start:end])
+			}
+		}
+		for b := uint64(0); b < length; b += dbs.BLOCK_SIZE {
+			end := min(b+dbs.BLOCK_SIZE, length)
+			k := BLOCK_UNCHANGED
+			if !bytes.Equal(data[b:end], prev[b:end]) {
+				k = BLOCK_CHANGED
+				if bytes.Equal(data[b:end], zero[:end-b]) {
+					k = BLOCK_ZEROED
+				}
+			}
+			if k != kind {
+				if err := flush(b); err != nil {
+					return err
+				}
+				start, kind = b, k
+			}
+		}
+		if err := flush(length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
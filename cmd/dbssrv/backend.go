@@ -0,0 +1,235 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Backend of an export. Exports of a volume are shared by all connections, so requests are ordered by the
+// extents they touch. The volume context is not safe for concurrent updates, so writes also exclude reads,
+// which may otherwise run in parallel.
+//
+// The volume context is opened on the first request, and closed once no requests arrive for the idle
+// timeout, so that exports not in use do not hold extent maps in memory.
+type NbdBackend struct {
+	sync.RWMutex
+	name     string // Of the export
+	open     func() (*dbs.VolumeContext, error)
+	size     uint64
+	extents  *extentLocks
+	idle     time.Duration // Zero to keep the volume context open
+	watchdog *watchdog     // Nil if requests are not watched
+	merger   *writeMerger  // Nil if writes are not merged
+
+	mu        sync.Mutex
+	vc        *dbs.VolumeContext // Nil while closed
+	users     int                // Requests using vc
+	timer     *time.Timer
+	lastErr   error // Of the last failed request, reported by the health endpoints
+	lastErrAt time.Time
+}
+
+func NewNbdBackend(name string, open func() (*dbs.VolumeContext, error), size uint64, idle time.Duration, watchdog *watchdog) *NbdBackend {
+	return &NbdBackend{
+		name:     name,
+		open:     open,
+		size:     size,
+		extents:  newExtentLocks(),
+		idle:     idle,
+		watchdog: watchdog,
+	}
+}
+
+// Return the volume context for a request, opening it if needed. Must be paired with release.
+func (b *NbdBackend) acquire() (*dbs.VolumeContext, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.vc == nil {
+		vc, err := b.open()
+		if err != nil {
+			return nil, err
+		}
+		b.vc = vc
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.users++
+	return b.vc, nil
+}
+
+func (b *NbdBackend) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users--
+	if b.users == 0 && b.idle > 0 {
+		b.timer = time.AfterFunc(b.idle, b.closeIdle)
+	}
+}
+
+// Close the volume context if no requests arrived since the timer was set.
+func (b *NbdBackend) closeIdle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.users > 0 || b.timer == nil {
+		return
+	}
+	b.timer = nil
+	if err := b.closeVolume(); err != nil {
+		fmt.Printf("Failed to close %v: %v\n", b.name, err)
+	}
+}
+
+// Must be called with mu held. The volume context is kept if it cannot be closed, as writes would be lost.
+func (b *NbdBackend) closeVolume() error {
+	if b.vc != nil {
+		if err := b.vc.CloseVolume(); err != nil {
+			return err
+		}
+		b.vc = nil
+	}
+	return nil
+}
+
+// Keep the error of a failed request, for the health endpoints.
+func (b *NbdBackend) noteError(err error) {
+	if err == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastErr = err
+	b.lastErrAt = time.Now()
+}
+
+// Close the volume context unless requests are using it. Returns false if they are, or if it cannot be closed.
+func (b *NbdBackend) Close() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.users > 0 {
+		return false
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return b.closeVolume() == nil
+}
+
+func (b *NbdBackend) ReadAt(p []byte, off int64) (n int, err error) {
+	ctx, span := tracer.Start(context.Background(), "nbd.read")
+	defer endSpan(span, &err)
+	req := b.watchdog.request("read", b.name, uint64(off), uint64(len(p)))
+	err = b.watchdog.run(req, func() error {
+		r := b.extents.lock(uint64(off), uint64(len(p)), false)
+		defer b.extents.unlock(r)
+		vc, err := b.acquire()
+		if err != nil {
+			return err
+		}
+		defer b.release()
+		b.RLock()
+		defer b.RUnlock()
+		req.locate(vc)
+		return vc.ReadAtContext(ctx, p, uint64(off))
+	})
+	b.noteError(err)
+	return len(p), err
+}
+
+func (b *NbdBackend) WriteAt(p []byte, off int64) (n int, err error) {
+	ctx, span := tracer.Start(context.Background(), "nbd.write")
+	defer endSpan(span, &err)
+	if b.merger != nil {
+		err = b.merger.submit(p, uint64(off))
+	} else {
+		err = b.write(ctx, p, uint64(off))
+	}
+	return len(p), err
+}
+
+// Write to the volume, after the requests before it touching the same extents.
+func (b *NbdBackend) write(ctx context.Context, p []byte, off uint64) error {
+	req := b.watchdog.request("write", b.name, off, uint64(len(p)))
+	err := b.watchdog.run(req, func() error {
+		r := b.extents.lock(off, uint64(len(p)), true)
+		defer b.extents.unlock(r)
+		vc, err := b.acquire()
+		if err != nil {
+			return err
+		}
+		defer b.release()
+		b.Lock()
+		defer b.Unlock()
+		req.locate(vc)
+		return vc.WriteAtContext(ctx, p, off, true)
+	})
+	b.noteError(err)
+	return err
+}
+
+func (b *NbdBackend) Size() (int64, error) {
+	return int64(b.size), nil
+}
+
+// Sync writes completed on any connection. Queued writes are submitted, and writes still running are waited
+// for, as are the requests before them. Reads are held up meanwhile, as staged writes may be written. Nothing
+// is pending if the volume context is closed.
+func (b *NbdBackend) Sync() error {
+	if b.merger != nil {
+		b.merger.flush()
+	}
+	err := b.watchdog.run(b.watchdog.request("flush", b.name, 0, 0), func() error {
+		r := b.extents.lock(0, 0, false)
+		defer b.extents.unlock(r)
+		b.mu.Lock()
+		vc := b.vc
+		if vc != nil {
+			b.users++
+		}
+		b.mu.Unlock()
+		if vc == nil {
+			return nil
+		}
+		defer b.release()
+		b.Lock()
+		defer b.Unlock()
+		return vc.Sync()
+	})
+	b.noteError(err)
+	return err
+}
+
+// Pick up metadata changes, once requests already received are done. A closed volume context is up to date
+// when opened.
+func (b *NbdBackend) Refresh() error {
+	r := b.extents.lock(0, 0, true)
+	defer b.extents.unlock(r)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.vc == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.vc.Refresh()
+}
@@ -0,0 +1,205 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Kampadais/dbs/pkg/client"
+	"github.com/chazapis/go-nbd/pkg/backend"
+	nbd "github.com/chazapis/go-nbd/pkg/server"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	OP_READ  = "read"
+	OP_WRITE = "write"
+	OP_FLUSH = "flush"
+)
+
+// NBD connections being served, with the requests of each, to find the clients loading the devices or
+// failing. Clients are identified by their address, as NBD is not served over TLS. Requests are also
+// counted in metrics, with the client address as an attribute.
+type connections struct {
+	mu       sync.Mutex
+	conns    map[uint64]*connStats
+	next     uint64
+	requests metric.Int64Counter
+	bytes    metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+func newConnections() *connections {
+	cs := &connections{conns: make(map[uint64]*connStats)}
+	meter := otel.Meter("github.com/Kampadais/dbs/cmd/dbssrv")
+	var err error
+	cs.requests, err = meter.Int64Counter("dbssrv.client.requests",
+		metric.WithDescription("NBD requests served, by client"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	cs.bytes, err = meter.Int64Counter("dbssrv.client.bytes",
+		metric.WithDescription("Data read and written by NBD requests, by client"),
+		metric.WithUnit("By"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	cs.duration, err = meter.Float64Histogram("dbssrv.client.duration",
+		metric.WithDescription("Duration of NBD requests, by client"),
+		metric.WithUnit("s"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return cs
+}
+
+// Register an accepted connection. Must be paired with remove once the connection is closed.
+func (cs *connections) add(conn net.Conn) *connStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.next++
+	c := &connStats{
+		conns: cs,
+		stats: client.ConnectionStats{Id: cs.next, RemoteAddr: conn.RemoteAddr().String(), ConnectedAt: time.Now()},
+	}
+	cs.conns[c.stats.Id] = c
+	return c
+}
+
+func (cs *connections) remove(c *connStats) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.conns, c.stats.Id)
+}
+
+// Return the statistics of the connections, oldest first.
+func (cs *connections) list() []client.ConnectionStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	result := make([]client.ConnectionStats, 0, len(cs.conns))
+	for _, c := range cs.conns {
+		result = append(result, c.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// Requests of a connection. Latencies are kept as totals and reported as means.
+type connStats struct {
+	conns     *connections
+	mu        sync.Mutex
+	stats     client.ConnectionStats
+	readTime  time.Duration
+	writeTime time.Duration
+	flushTime time.Duration
+}
+
+// Return the exports with their backends counting the requests of the connection.
+func (c *connStats) wrap(exports []*nbd.Export) []*nbd.Export {
+	result := make([]*nbd.Export, len(exports))
+	for i, e := range exports {
+		result[i] = &nbd.Export{Name: e.Name, Description: e.Description, Backend: &connBackend{Backend: e.Backend, export: e.Name, conn: c}}
+	}
+	return result
+}
+
+func (c *connStats) record(export string, op string, n int, d time.Duration, err error) {
+	c.mu.Lock()
+	c.stats.Export = export
+	switch op {
+	case OP_READ:
+		c.stats.Reads++
+		c.stats.BytesRead += uint64(n)
+		c.readTime += d
+	case OP_WRITE:
+		c.stats.Writes++
+		c.stats.BytesWritten += uint64(n)
+		c.writeTime += d
+	case OP_FLUSH:
+		c.stats.Flushes++
+		c.flushTime += d
+	}
+	if err != nil {
+		c.stats.Errors++
+	}
+	c.stats.MaxLatency = max(c.stats.MaxLatency, d)
+	c.mu.Unlock()
+
+	attrs := metric.WithAttributes(
+		attribute.String("client.address", c.stats.RemoteAddr),
+		attribute.String("nbd.export", export),
+		attribute.String("nbd.operation", op),
+		attribute.Bool("error", err != nil))
+	ctx := context.Background()
+	if c.conns.requests != nil {
+		c.conns.requests.Add(ctx, 1, attrs)
+	}
+	if c.conns.bytes != nil && n > 0 {
+		c.conns.bytes.Add(ctx, int64(n), attrs)
+	}
+	if c.conns.duration != nil {
+		c.conns.duration.Record(ctx, d.Seconds(), attrs)
+	}
+}
+
+func (c *connStats) snapshot() client.ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	if stats.Reads > 0 {
+		stats.ReadLatency = c.readTime / time.Duration(stats.Reads)
+	}
+	if stats.Writes > 0 {
+		stats.WriteLatency = c.writeTime / time.Duration(stats.Writes)
+	}
+	if stats.Flushes > 0 {
+		stats.FlushLatency = c.flushTime / time.Duration(stats.Flushes)
+	}
+	return stats
+}
+
+// Backend of an export for a single connection, counting its requests.
+type connBackend struct {
+	backend.Backend
+	export string
+	conn   *connStats
+}
+
+func (b *connBackend) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := b.Backend.ReadAt(p, off)
+	b.conn.record(b.export, OP_READ, n, time.Since(start), err)
+	return n, err
+}
+
+func (b *connBackend) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := b.Backend.WriteAt(p, off)
+	b.conn.record(b.export, OP_WRITE, n, time.Since(start), err)
+	return n, err
+}
+
+func (b *connBackend) Sync() error {
+	start := time.Now()
+	err := b.Backend.Sync()
+	b.conn.record(b.export, OP_FLUSH, 0, time.Since(start), err)
+	return err
+}
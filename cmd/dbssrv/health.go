@@ -0,0 +1,134 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Longest wait for a device's metadata when checking readiness, as the device may be locked by a long update.
+const HEALTH_TIMEOUT = 5 * time.Second
+
+// State of the daemon reported by the health endpoints.
+type healthStatus struct {
+	Status       string         `json:"status"` // "ok" or "failing"
+	Listening    bool           `json:"listening"`
+	SlowRequests int64          `json:"slow_requests"`     // Running past the --slow-io threshold
+	Devices      []deviceHealth `json:"devices,omitempty"` // Only checked for readiness
+}
+
+type deviceHealth struct {
+	Device        string     `json:"device"`
+	Open          bool       `json:"open"` // Metadata readable within HEALTH_TIMEOUT
+	Error         string     `json:"error,omitempty"`
+	Maintenance   bool       `json:"maintenance"`
+	Attached      int        `json:"attached"` // Exports with open volume contexts
+	LastIOError   string     `json:"last_io_error,omitempty"`
+	LastIOErrorAt *time.Time `json:"last_io_error_at,omitempty"`
+}
+
+// Serves /healthz and /readyz for service managers. The daemon is live unless requests are stuck past the slow
+// I/O threshold, which restarting may clear, and ready once it accepts NBD connections and the metadata of all
+// devices can be read.
+type healthHandler struct {
+	servers   []*Server
+	listening *atomic.Bool
+	watchdog  *watchdog // Nil if requests are not watched
+}
+
+// Add the state of the exports of a backend.
+func (b *NbdBackend) addHealth(h *deviceHealth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.vc != nil {
+		h.Attached++
+	}
+	if b.lastErr != nil && (h.LastIOErrorAt == nil || b.lastErrAt.After(*h.LastIOErrorAt)) {
+		at := b.lastErrAt
+		h.LastIOError = b.lastErr.Error()
+		h.LastIOErrorAt = &at
+	}
+}
+
+func (s *Server) health() deviceHealth {
+	h := deviceHealth{Device: s.device}
+	done := make(chan struct{})
+	var di *dbs.DeviceInfo
+	var err error
+	go func() {
+		di, err = dbs.GetDeviceInfo(s.device)
+		close(done)
+	}()
+	select {
+	case <-done:
+		if err != nil {
+			h.Error = err.Error()
+		} else {
+			h.Open = true
+			h.Maintenance = di.Maintenance
+		}
+	case <-time.After(HEALTH_TIMEOUT):
+		h.Error = fmt.Sprintf("metadata not read within %v", HEALTH_TIMEOUT)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.volumes {
+		b.addHealth(&h)
+	}
+	for _, b := range s.snapshots {
+		b.addHealth(&h)
+	}
+	return h
+}
+
+func (hh *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok", Listening: hh.listening.Load()}
+	if hh.watchdog != nil {
+		status.SlowRequests = hh.watchdog.slow.Load()
+	}
+	healthy := status.SlowRequests == 0
+	if r.URL.Path == "/readyz" {
+		healthy = healthy && status.Listening
+		for _, s := range hh.servers {
+			h := s.health()
+			healthy = healthy && h.Open
+			status.Devices = append(status.Devices, h)
+		}
+	}
+	code := http.StatusOK
+	if !healthy {
+		status.Status = "failing"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&status)
+}
+
+// Serve the health endpoints on their own address.
+func startHealthServer(addr string, hh *healthHandler) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", hh)
+	mux.Handle("/readyz", hh)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("Failed to serve health endpoints: %v\n", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Kampadais/dbs"
+)
+
+const (
+	DEFAULT_HOOK_TIMEOUT = 30 * time.Second
+	HOOK_QUEUE           = 1024 // Events waiting for a hook, further ones are dropped
+)
+
+// Hooks file contents. For example:
+//
+//	hooks:
+//	  - events: [volume_created, volume_deleted]   # all events if not set
+//	    exec: [/usr/local/bin/update-targets, --reload]
+//	  - events: [snapshot_created]
+//	    webhook: https://cmdb.example.com/dbs/events
+//	    timeout: 5s
+//
+// Commands get the event as JSON on the standard input, and its fields in the DBS_EVENT, DBS_DEVICE,
+// DBS_VOLUME, DBS_SNAPSHOT_ID and DBS_DETAIL environment variables. Webhooks get the event as a JSON POST
+// request. Only changes made through this daemon, as by the management API, fire hooks.
+type hooksFile struct {
+	Hooks []hookConfig `yaml:"hooks"`
+}
+
+type hookConfig struct {
+	Events  []string      `yaml:"events"`
+	Exec    []string      `yaml:"exec"`
+	Webhook string        `yaml:"webhook"`
+	Timeout time.Duration `yaml:"timeout"` // DEFAULT_HOOK_TIMEOUT if zero
+}
+
+// Hook run for events in the background, one at a time, in order.
+type eventHook struct {
+	hookConfig
+	queue chan dbs.Event
+}
+
+func loadHooks(name string) ([]*eventHook, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var hf hooksFile
+	if err := yaml.Unmarshal(data, &hf); err != nil {
+		return nil, fmt.Errorf("cannot parse hooks: %w", err)
+	}
+	hooks := make([]*eventHook, 0, len(hf.Hooks))
+	for i, hc := range hf.Hooks {
+		if (len(hc.Exec) == 0) == (hc.Webhook == "") {
+			return nil, fmt.Errorf("hook %v needs either a command or a webhook", i+1)
+		}
+		if hc.Timeout == 0 {
+			hc.Timeout = DEFAULT_HOOK_TIMEOUT
+		}
+		hooks = append(hooks, &eventHook{hookConfig: hc, queue: make(chan dbs.Event, HOOK_QUEUE)})
+	}
+	return hooks, nil
+}
+
+// Fire the hooks on events of the devices, until the daemon exits.
+func startHooks(hooks []*eventHook, devices []deviceConfig) {
+	for _, h := range hooks {
+		go h.run()
+		for _, d := range devices {
+			dbs.AddHook(d.path, h.enqueue)
+		}
+	}
+}
+
+func (h *eventHook) enqueue(e dbs.Event) {
+	if len(h.Events) > 0 && !slices.Contains(h.Events, e.Type) {
+		return
+	}
+	select {
+	case h.queue <- e:
+	default:
+		fmt.Printf("Hook %v: queue full, dropped %v event of %v\n", h, e.Type, e.Device)
+	}
+}
+
+func (h *eventHook) run() {
+	for e := range h.queue {
+		if err := h.fire(e); err != nil {
+			fmt.Printf("Hook %v: failed on %v event of %v: %v\n", h, e.Type, e.Device, err)
+		}
+	}
+}
+
+func (h *eventHook) String() string {
+	if h.Webhook != "" {
+		return h.Webhook
+	}
+	return h.Exec[0]
+}
+
+func (h *eventHook) fire(e dbs.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	if h.Webhook != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Webhook, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("status %v", resp.Status)
+		}
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"DBS_EVENT="+e.Type,
+		"DBS_DEVICE="+e.Device,
+		"DBS_VOLUME="+e.VolumeName,
+		fmt.Sprintf("DBS_SNAPSHOT_ID=%v", e.SnapshotId),
+		"DBS_DETAIL="+e.Detail,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
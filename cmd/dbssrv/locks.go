@@ -0,0 +1,82 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Orders requests to a volume shared by several connections. A request waits for earlier requests touching
+// the same extents, unless both only read, so overlapping requests complete in the order they arrive, while
+// requests to other extents are not held up by them.
+type extentLocks struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*extentRequest // Running and waiting requests, in arrival order
+}
+
+type extentRequest struct {
+	first, last uint64 // Range of extents
+	exclusive   bool
+}
+
+func newExtentLocks() *extentLocks {
+	l := &extentLocks{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Lock the extents holding a byte range. A zero length locks the whole volume.
+func (l *extentLocks) lock(offset uint64, length uint64, exclusive bool) *extentRequest {
+	r := &extentRequest{first: 0, last: ^uint64(0), exclusive: exclusive}
+	if length > 0 {
+		r.first = offset / dbs.EXTENT_SIZE
+		r.last = (offset + length - 1) / dbs.EXTENT_SIZE
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = append(l.pending, r)
+	for l.blocked(r) {
+		l.cond.Wait()
+	}
+	return r
+}
+
+// Return true if an earlier request conflicts with r.
+func (l *extentLocks) blocked(r *extentRequest) bool {
+	for _, p := range l.pending {
+		if p == r {
+			return false
+		}
+		if (p.exclusive || r.exclusive) && p.first <= r.last && r.first <= p.last {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *extentLocks) unlock(r *extentRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, p := range l.pending {
+		if p == r {
+			l.pending = append(l.pending[:i], l.pending[i+1:]...)
+			break
+		}
+	}
+	l.cond.Broadcast()
+}
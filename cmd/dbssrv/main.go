@@ -16,71 +16,302 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	nbd "github.com/chazapis/go-nbd/pkg/server"
+	"github.com/docker/go-units"
 	"github.com/jawher/mow.cli"
-	"golang.org/x/exp/slices"
 
 	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/server"
 )
 
-type NbdBackend struct {
-	sync.RWMutex
-	vc   *dbs.VolumeContext
-	size uint64
+const (
+	PREFERRED_BLOCK_SIZE = 128 * 1024       // Default preferred size of requests advertised to clients
+	MAX_REQUEST_SIZE     = 32 * 1024 * 1024 // Largest request the NBD server accepts
+)
+
+type Server struct {
+	device     string
+	prefix     string // Of the names of exports, as NAME/ for devices other than the main one
+	opts       []dbs.Option
+	volumeName string // Export only this volume, if set
+	lazy       bool
+	idle       time.Duration // Close volume contexts after no requests for this long, if not zero
+	sectorSize uint
+	blockSize  uint32        // Preferred size of requests advertised to clients
+	maxRequest uint32        // Largest request size advertised to clients
+	merge      time.Duration // Queue writes to volumes for this long to merge contiguous ones, if not zero
+	mu         sync.Mutex
+	volumes    map[string]*NbdBackend // Volume backends by name
+	snapshots  map[uint]*NbdBackend   // Snapshot backends
+	tokens     *server.Tokens         // Required to attach exports, if set
+	caches     map[string]string      // Cache devices by export name of volumes
+	watchdog   *watchdog              // Reports slow requests, if set
 }
 
-func NewNbdBackend(vc *dbs.VolumeContext, size uint64) *NbdBackend {
-	return &NbdBackend{
-		vc:   vc,
-		size: size,
+func NewServer(device string, volumeName string, lazy bool, idle time.Duration, sectorSize uint, opts []dbs.Option) *Server {
+	return &Server{
+		device:     device,
+		opts:       append(opts, dbs.WithSectorSize(sectorSize)),
+		volumeName: volumeName,
+		lazy:       lazy,
+		idle:       idle,
+		sectorSize: sectorSize,
+		blockSize:  PREFERRED_BLOCK_SIZE,
+		maxRequest: MAX_REQUEST_SIZE,
+		volumes:    make(map[string]*NbdBackend),
+		snapshots:  make(map[uint]*NbdBackend),
 	}
 }
 
-func (b *NbdBackend) ReadAt(p []byte, off int64) (n int, err error) {
-	b.RLock()
-	defer b.RUnlock()
-	return len(p), b.vc.ReadAt(p, uint64(off))
+// Return the backend for a volume. Must be called with mu held.
+func (s *Server) volumeBackend(volumeName string, size uint64) *NbdBackend {
+	if b, ok := s.volumes[volumeName]; ok {
+		return b
+	}
+	open := dbs.OpenVolume
+	if s.lazy {
+		open = dbs.OpenVolumeLazy
+	}
+	opts := s.opts
+	if cache, ok := s.caches[s.prefix+volumeName]; ok {
+		opts = append(opts[:len(opts):len(opts)], dbs.WithCacheDevice(cache))
+	}
+	b := NewNbdBackend(s.prefix+volumeName, func() (*dbs.VolumeContext, error) {
+		return open(s.device, volumeName, opts...)
+	}, size, s.idle, s.watchdog)
+	if s.merge > 0 {
+		b.merger = newWriteMerger(s.merge, b.write)
+	}
+	s.volumes[volumeName] = b
+	return b
 }
 
-func (b *NbdBackend) WriteAt(p []byte, off int64) (n int, err error) {
-	b.Lock()
-	defer b.Unlock()
-	return len(p), b.vc.WriteAt(p, uint64(off))
+// Return the backend for a snapshot. Backends already open are refreshed, as the snapshot may have been
+// merged with a deleted parent in the meantime. Must be called with mu held.
+func (s *Server) snapshotBackend(volumeName string, snapshotId uint, size uint64) *NbdBackend {
+	if b, ok := s.snapshots[snapshotId]; ok {
+		if err := b.Refresh(); err == nil {
+			return b
+		}
+		b.Close()
+	}
+	b := NewNbdBackend(fmt.Sprintf("%v%v@%v", s.prefix, volumeName, snapshotId), func() (*dbs.VolumeContext, error) {
+		return dbs.OpenSnapshot(s.device, snapshotId, s.opts...)
+	}, size, s.idle, s.watchdog)
+	s.snapshots[snapshotId] = b
+	return b
 }
 
-func (b *NbdBackend) Size() (int64, error) {
-	return int64(b.size), nil
+// Return the exports available to a new connection: each volume by name, and each of its snapshots
+// read-only, as volume@snapshotId and, if named, as volume@name. When serving a single volume, it is also the default export. Backends of
+// volumes and snapshots that no longer exist are dropped once idle. Names are prefixed for devices other than the main one.
+func (s *Server) exports() ([]*nbd.Export, error) {
+	volumeInfo, err := dbs.GetVolumeInfo(s.device)
+	if err != nil {
+		return nil, err
+	}
+	snapshotInfo, err := dbs.ListAllSnapshots(s.device)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var exports []*nbd.Export
+	volumes := make(map[string]*dbs.VolumeInfo)
+	for i := range volumeInfo {
+		vi := &volumeInfo[i]
+		if s.volumeName != "" && vi.VolumeName != s.volumeName {
+			continue
+		}
+		volumes[vi.VolumeName] = vi
+		b := s.volumeBackend(vi.VolumeName, vi.VolumeSize)
+		if s.volumeName != "" {
+			exports = append(exports, &nbd.Export{Name: "", Description: "DBS", Backend: b})
+		}
+		exports = append(exports, &nbd.Export{Name: s.prefix + vi.VolumeName, Description: "DBS", Backend: b})
+	}
+	if s.volumeName != "" && len(exports) == 0 {
+		return nil, fmt.Errorf("%w: %v", dbs.ErrVolumeNotFound, s.volumeName)
+	}
+	snapshots := make(map[uint]bool)
+	for _, si := range snapshotInfo {
+		vi, ok := volumes[si.VolumeName]
+		if !ok || si.VolumeDeleted || si.SnapshotId == vi.SnapshotId {
+			continue
+		}
+		snapshots[si.SnapshotId] = true
+		b := s.snapshotBackend(si.VolumeName, si.SnapshotId, vi.VolumeSize)
+		exports = append(exports, &nbd.Export{
+			Name:        fmt.Sprintf("%v%v@%v", s.prefix, si.VolumeName, si.SnapshotId),
+			Description: fmt.Sprintf("DBS snapshot of %v", si.CreatedAt),
+			Backend:     b,
+		})
+		if si.Name != "" {
+			exports = append(exports, &nbd.Export{
+				Name:        fmt.Sprintf("%v%v@%v", s.prefix, si.VolumeName, si.Name),
+				Description: fmt.Sprintf("DBS snapshot of %v", si.CreatedAt),
+				Backend:     b,
+			})
+		}
+	}
+	for volumeName, b := range s.volumes {
+		if _, ok := volumes[volumeName]; !ok && b.Close() {
+			delete(s.volumes, volumeName)
+		}
+	}
+	for snapshotId, b := range s.snapshots {
+		if !snapshots[snapshotId] && b.Close() {
+			delete(s.snapshots, snapshotId)
+		}
+	}
+	return exports, nil
 }
 
-func (b *NbdBackend) Sync() error {
-	return nil
+// Settings of the management API server. Without a certificate, the API is served over plain HTTP.
+type apiConfig struct {
+	addr     string
+	policy   *server.Policy // Nil to allow all requests
+	certFile string
+	keyFile  string
+	clientCA *x509.CertPool // Verifies client certificates, if set
 }
 
-func startServer(url *string, device *string, volumeName *string) error {
-	volumeInfo, err := dbs.GetVolumeInfo(*device)
-	if err != nil {
-		return err
+// A device served, with the name its exports are prefixed with, empty for the main device.
+type deviceConfig struct {
+	name string
+	path string
+	opts []dbs.Option
+}
+
+// Serve the management API of the devices, for the client package. The API of the main device is served at
+// the root, and that of others under /devices/NAME. The health endpoints are served alongside, without
+// authorization.
+func startAPIServer(config *apiConfig, devices []deviceConfig, apiServers []*server.Server, tokens *server.Tokens, conns *connections, hh *healthHandler) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", hh)
+	mux.Handle("/readyz", hh)
+	for i, d := range devices {
+		s := apiServers[i]
+		if config.policy != nil {
+			s.SetPolicy(config.policy)
+		}
+		if tokens != nil {
+			s.SetTokens(tokens)
+		}
+		s.SetConnections(conns.list)
+		if d.name == "" {
+			mux.Handle("/", s)
+		} else {
+			mux.Handle("/devices/"+d.name+"/", http.StripPrefix("/devices/"+d.name, s))
+		}
 	}
-	volumeIdx := slices.IndexFunc(volumeInfo, func(vi dbs.VolumeInfo) bool { return vi.VolumeName == *volumeName })
-	if volumeIdx == -1 {
-		return fmt.Errorf("volume %v not found", volumeName)
+	hs := &http.Server{Addr: config.addr, Handler: mux}
+	var err error
+	if config.certFile != "" {
+		if config.clientCA != nil {
+			hs.TLSConfig = &tls.Config{ClientCAs: config.clientCA, ClientAuth: tls.VerifyClientCertIfGiven}
+		}
+		err = hs.ListenAndServeTLS(config.certFile, config.keyFile)
+	} else {
+		err = hs.ListenAndServe()
 	}
-	vc, err := dbs.OpenVolume(*device, *volumeName)
 	if err != nil {
+		fmt.Printf("Failed to serve management API: %v\n", err)
+	}
+}
+
+func loadAPIConfig(addr string, policyFile string, certFile string, keyFile string, clientCAFile string) (*apiConfig, error) {
+	config := &apiConfig{addr: addr, certFile: certFile, keyFile: keyFile}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both a certificate and a key are needed to serve the API over TLS")
+	}
+	if policyFile != "" {
+		p, err := server.LoadPolicy(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.policy = p
+	}
+	if clientCAFile != "" {
+		if certFile == "" {
+			return nil, fmt.Errorf("client certificates need the API to be served over TLS")
+		}
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.clientCA = x509.NewCertPool()
+		if !config.clientCA.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", clientCAFile)
+		}
+	}
+	return config, nil
+}
+
+// Return the exports of all devices.
+// Close the volume contexts of the server, retrying those in use until the deadline, and check that the daemon
+// can exit without losing work on the device.
+func (s *Server) shutdown(deadline time.Time) error {
+	for {
+		busy := false
+		s.mu.Lock()
+		for _, b := range s.volumes {
+			busy = !b.Close() || busy
+		}
+		for _, b := range s.snapshots {
+			busy = !b.Close() || busy
+		}
+		s.mu.Unlock()
+		if !busy || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return dbs.QuiesceDevice(s.device, max(time.Until(deadline), 0))
+}
+
+func allExports(servers []*Server) ([]*nbd.Export, error) {
+	var exports []*nbd.Export
+	for _, s := range servers {
+		e, err := s.exports()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", s.device, err)
+		}
+		exports = append(exports, e...)
+	}
+	return exports, nil
+}
+
+// Serve the volumes of the devices, each by a server of its own. Options and tokens are those of the first.
+// Requests are counted per connection in conns, and listening is set once connections are accepted.
+func startServer(url string, servers []*Server, conns *connections, listening *atomic.Bool) error {
+	// Fail early if the devices or volume cannot be served
+	if _, err := allExports(servers); err != nil {
 		return err
 	}
-	backend := NewNbdBackend(vc, volumeInfo[volumeIdx].VolumeSize)
+	server := servers[0]
 
-	listener, err := net.Listen("tcp", *url)
+	listener, err := net.Listen("tcp", url)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
+	listening.Store(true)
 
 	for {
 		conn, err := listener.Accept()
@@ -91,21 +322,34 @@ func startServer(url *string, device *string, volumeName *string) error {
 		fmt.Printf("New connection from: %v\n", conn.RemoteAddr())
 		go func() {
 			defer conn.Close()
+			cs := conns.add(conn)
+			defer conns.remove(cs)
 
+			// Pick up volumes and snapshots created since the last connection
+			exports, err := allExports(servers)
+			if err != nil {
+				fmt.Printf("Failed to list exports: %v\n", err)
+				return
+			}
+			exports = cs.wrap(exports)
+			// With tokens, the connection serves the one export its token grants access to
+			nbdConn := conn
+			if server.tokens != nil {
+				all := exports
+				tc := newTokenConn(conn, func(name string, redeem bool) *nbd.Export {
+					return server.tokenExport(all, name, redeem)
+				})
+				nbdConn, exports = tc, []*nbd.Export{tc.export}
+			}
+			// Read-only is enforced by the snapshot backends, as options apply to all exports
 			if err := nbd.Handle(
-				conn,
-				[]*nbd.Export{
-					{
-						Name:        "",
-						Description: "DBS",
-						Backend:     backend,
-					},
-				},
+				nbdConn,
+				exports,
 				&nbd.Options{
 					ReadOnly:           false,
-					MinimumBlockSize:   dbs.BLOCK_SIZE,
-					PreferredBlockSize: dbs.BLOCK_SIZE,
-					MaximumBlockSize:   dbs.BLOCK_SIZE,
+					MinimumBlockSize:   uint32(server.sectorSize),
+					PreferredBlockSize: server.blockSize,
+					MaximumBlockSize:   server.maxRequest,
 				}); err != nil {
 				fmt.Printf("Failed to handle nbd connection: %v\n", err)
 			}
@@ -113,13 +357,297 @@ func startServer(url *string, device *string, volumeName *string) error {
 	}
 }
 
+// Resume the interrupted jobs of a device, reporting those that cannot be resumed.
+func resumeJobs(device string, opts []dbs.Option) {
+	ji, err := dbs.ListJobs(device)
+	if err != nil {
+		fmt.Printf("Cannot list jobs of %v: %v\n", device, err)
+		return
+	}
+	for i := range ji {
+		if ji[i].State != dbs.JOB_INTERRUPTED {
+			continue
+		}
+		if _, err := dbs.ResumeJob(device, ji[i].JobId, opts...); err != nil {
+			fmt.Printf("Cannot resume %v job %v of %v: %v\n", ji[i].Type, ji[i].JobId, device, err)
+			continue
+		}
+		fmt.Printf("Resumed %v job %v of %v\n", ji[i].Type, ji[i].JobId, device)
+	}
+}
+
 func main() {
 	app := cli.App("dbssrv", "NBD server for DBS")
 	url := app.StringOpt("u url", "localhost:10809", "Server URL")
-	device := app.StringArg("DEVICE", "", "")
-	volume := app.StringArg("VOLUME", "", "")
+	app.Spec = "[OPTIONS] [DEVICE [VOLUME]]"
+	device := app.StringArg("DEVICE", "", "Main device, whose volumes are exported by name")
+	volume := app.StringArg("VOLUME", "", "Volume of the main device to export, all volumes if not given")
+	extraDevices := app.StringsOpt("d device", nil, "Also serve the volumes of a device, as NAME=PATH, exported as NAME/VOLUME (repeatable)")
+	readCache := app.IntOpt("read-cache", 0, "Number of blocks to cache in memory per export")
+	cacheDevices := app.StringsOpt("cache-device", nil, "Cache extents read from a volume on a local file or device, as EXPORT=PATH (repeatable)")
+	verbose := app.BoolOpt("v verbose", false, "Log volume events")
+	buffered := app.BoolOpt("buffered", false, "Use buffered instead of direct I/O")
+	lazy := app.BoolOpt("lazy", false, "Start serving while the volume's extent map is loaded")
+	idleTimeout := app.StringOpt("idle-timeout", "0", "Close volumes after no requests for this long (e.g. 5m, 0 to keep them open)")
+	apiURL := app.StringOpt("api", "", "Address to serve the management API on (e.g. localhost:10810)")
+	apiPolicy := app.StringOpt("api-policy", "", "Roles of API keys and client certificates (YAML), all requests allowed if not given")
+	apiCert := app.StringOpt("api-cert", "", "Certificate to serve the management API over TLS")
+	apiKey := app.StringOpt("api-key", "", "Private key of the API certificate")
+	apiClientCA := app.StringOpt("api-client-ca", "", "CA certificates verifying API client certificates")
+	healthURL := app.StringOpt("health", "", "Address to serve /healthz and /readyz on, besides the management API (e.g. localhost:10811)")
+	coalesce := app.BoolOpt("coalesce-writes", false, "Coalesce writes to parts of a block until the client flushes")
+	deviceUUID := app.StringOpt("device-uuid", "", "Refuse to serve the main device unless it has this UUID")
+	blockCoW := app.BoolOpt("block-cow", false, "Copy only overwritten blocks of snapshotted extents")
+	syncPolicy := app.StringOpt("sync", "strict", "When metadata updates are flushed: strict, relaxed or unsafe")
+	requireTokens := app.BoolOpt("require-tokens", false, "Require clients to attach exports as NAME#TOKEN, with tokens issued through the management API")
+	tokensFile := app.StringOpt("tokens", "", "Long-lived export tokens (YAML), implies --require-tokens")
+	ioRetries := app.IntOpt("io-retries", 0, "Retry device reads and writes failing with transient errors this many times")
+	ioRetryBackoff := app.StringOpt("io-retry-backoff", "10ms", "Wait before the first retry, doubled before each next one")
+	maxMediaErrors := app.IntOpt("max-media-errors", 0, "Make volumes read-only after this many media errors (0 to never)")
+	slowIO := app.StringOpt("slow-io", "0", "Log requests taking longer than this, with their device offset (e.g. 30s, 0 to disable)")
+	cancelSlowIO := app.BoolOpt("cancel-slow-io", false, "Fail requests taking longer than --slow-io instead of waiting for them")
+	otlp := app.BoolOpt("otlp", false, "Export traces and latency metrics over OTLP, configured by the OTEL_EXPORTER_OTLP_* variables")
+	hooksFile := app.StringOpt("hooks", "", "Commands and webhooks fired on volume and snapshot events (YAML)")
+	scrubInterval := app.StringOpt("scrub-interval", "0", "Read all allocated extents of the devices this often, reporting media errors (e.g. 24h, 0 to disable)")
+	scrubRate := app.StringOpt("scrub-rate", "0", "Maximum bytes read per second when scrubbing (0 for unlimited)")
+	sectorSize := app.IntOpt("sector-size", dbs.BLOCK_SIZE, "Minimum block size advertised to clients (512 for legacy clients)")
+	blockSize := app.StringOpt("block-size", "128K", "Preferred block size advertised to clients, a power of two from the sector size up")
+	maxRequest := app.StringOpt("max-request-size", "32M", "Largest request size advertised to clients, up to 32M")
+	mergeWindow := app.StringOpt("merge-window", "0", "Queue writes for this long to submit contiguous ones together (e.g. 200us, 0 to disable)")
+	resume := app.BoolOpt("resume-jobs", false, "Resume jobs of the devices interrupted when a previous process exited")
+	shutdownTimeout := app.StringOpt("shutdown-timeout", "30s", "On termination, wait this long for requests and jobs to finish before exiting with an error")
 	app.Action = func() {
-		if err := startServer(url, device, volume); err != nil {
+		var stopTelemetry func(context.Context) error
+		var apiServers []*server.Server
+		idle, err := time.ParseDuration(*idleTimeout)
+		if err != nil || idle < 0 {
+			fmt.Printf("Error: invalid idle timeout %v\n", *idleTimeout)
+			os.Exit(1)
+		}
+		shutdownWait, err := time.ParseDuration(*shutdownTimeout)
+		if err != nil || shutdownWait < 0 {
+			fmt.Printf("Error: invalid shutdown timeout %v\n", *shutdownTimeout)
+			os.Exit(1)
+		}
+		slow, err := time.ParseDuration(*slowIO)
+		if err != nil || slow < 0 {
+			fmt.Printf("Error: invalid slow I/O threshold %v\n", *slowIO)
+			os.Exit(1)
+		}
+		if *cancelSlowIO && slow == 0 {
+			fmt.Printf("Error: --cancel-slow-io needs a --slow-io threshold\n")
+			os.Exit(1)
+		}
+		scrubEvery, err := time.ParseDuration(*scrubInterval)
+		if err != nil || scrubEvery < 0 {
+			fmt.Printf("Error: invalid scrub interval %v\n", *scrubInterval)
+			os.Exit(1)
+		}
+		scrubBytes, err := units.FromHumanSize(*scrubRate)
+		if err != nil || scrubBytes < 0 {
+			fmt.Printf("Error: invalid scrub rate %v\n", *scrubRate)
+			os.Exit(1)
+		}
+		backoff, err := time.ParseDuration(*ioRetryBackoff)
+		if err != nil || backoff < 0 || *ioRetries < 0 || *maxMediaErrors < 0 {
+			fmt.Printf("Error: invalid retry policy\n")
+			os.Exit(1)
+		}
+		if *sectorSize < dbs.MIN_SECTOR_SIZE || *sectorSize > dbs.BLOCK_SIZE || *sectorSize&(*sectorSize-1) != 0 {
+			fmt.Printf("Error: invalid sector size %v\n", *sectorSize)
+			os.Exit(1)
+		}
+		preferred, err := units.RAMInBytes(*blockSize)
+		if err != nil || preferred < int64(*sectorSize) || preferred&(preferred-1) != 0 {
+			fmt.Printf("Error: invalid block size %v\n", *blockSize)
+			os.Exit(1)
+		}
+		maximum, err := units.RAMInBytes(*maxRequest)
+		if err != nil || maximum < preferred || maximum > MAX_REQUEST_SIZE || maximum%int64(*sectorSize) != 0 {
+			fmt.Printf("Error: invalid maximum request size %v\n", *maxRequest)
+			os.Exit(1)
+		}
+		merge, err := time.ParseDuration(*mergeWindow)
+		if err != nil || merge < 0 {
+			fmt.Printf("Error: invalid merge window %v\n", *mergeWindow)
+			os.Exit(1)
+		}
+		if *device == "" && len(*extraDevices) == 0 {
+			fmt.Printf("Error: no device to serve\n")
+			os.Exit(1)
+		}
+		var devices []deviceConfig
+		names := make(map[string]bool)
+		for _, d := range *extraDevices {
+			name, path, ok := strings.Cut(d, "=")
+			if !ok || path == "" || dbs.ValidateVolumeName(name) != nil || names[name] {
+				fmt.Printf("Error: invalid device %v\n", d)
+				os.Exit(1)
+			}
+			names[name] = true
+			devices = append(devices, deviceConfig{name: name, path: path})
+		}
+		caches := make(map[string]string)
+		for _, cd := range *cacheDevices {
+			exportName, path, ok := strings.Cut(cd, "=")
+			if !ok || exportName == "" || path == "" {
+				fmt.Printf("Error: invalid cache device %v\n", cd)
+				os.Exit(1)
+			}
+			caches[exportName] = path
+		}
+		policy, err := dbs.ParseSyncPolicy(*syncPolicy)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts := []dbs.Option{
+			dbs.WithReadCache(uint(max(*readCache, 0))),
+			dbs.WithSyncPolicy(policy),
+			dbs.WithRetryPolicy(dbs.RetryPolicy{
+				Attempts:  uint(*ioRetries),
+				Backoff:   backoff,
+				MaxErrors: uint(*maxMediaErrors),
+			}),
+		}
+		if *buffered {
+			opts = append(opts, dbs.WithBufferedIO())
+		}
+		if *coalesce {
+			opts = append(opts, dbs.WithWriteCoalescing())
+		}
+		var mainOpts []dbs.Option
+		if *deviceUUID != "" && *device == "" {
+			fmt.Printf("Error: --device-uuid needs a main device\n")
+			os.Exit(1)
+		}
+		if *deviceUUID != "" {
+			// Volumes are opened with the expected identity, but the device is listed without
+			di, err := dbs.GetDeviceInfo(*device)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if di.UUID != strings.ToLower(*deviceUUID) {
+				fmt.Printf("Error: %v: found %v, expected %v\n", dbs.ErrWrongDevice, di.UUID, *deviceUUID)
+				os.Exit(1)
+			}
+			mainOpts = append(mainOpts, dbs.WithDeviceUUID(*deviceUUID))
+		}
+		if *blockCoW {
+			opts = append(opts, dbs.WithBlockCoW())
+		}
+		if *verbose {
+			opts = append(opts, dbs.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, nil))))
+		}
+		if *otlp {
+			stopTelemetry, err = startTelemetry(context.Background())
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		var tokens *server.Tokens
+		if *requireTokens || *tokensFile != "" {
+			tokens = server.NewTokens()
+			if *tokensFile != "" {
+				if err := tokens.Load(*tokensFile); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+		}
+		for i := range devices {
+			devices[i].opts = opts
+		}
+		if *device != "" {
+			devices = append([]deviceConfig{{path: *device, opts: append(mainOpts, opts...)}}, devices...)
+		}
+		if *hooksFile != "" {
+			hooks, err := loadHooks(*hooksFile)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			startHooks(hooks, devices)
+		}
+		var apiConf *apiConfig
+		if *apiURL != "" {
+			apiConf, err = loadAPIConfig(*apiURL, *apiPolicy, *apiCert, *apiKey, *apiClientCA)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if *resume {
+			for _, d := range devices {
+				resumeJobs(d.path, d.opts)
+			}
+		}
+		if scrubEvery > 0 {
+			for _, d := range devices {
+				dbs.StartScrubber(d.path, scrubEvery, uint64(scrubBytes), d.opts...)
+			}
+		}
+		var servers []*Server
+		var wd *watchdog
+		if slow > 0 {
+			wd = &watchdog{threshold: slow, cancel: *cancelSlowIO}
+		}
+		for _, d := range devices {
+			server := NewServer(d.path, "", *lazy, idle, uint(*sectorSize), d.opts)
+			if d.name == "" {
+				server.volumeName = *volume
+			} else {
+				server.prefix = d.name + "/"
+			}
+			server.tokens = tokens
+			server.caches = caches
+			server.watchdog = wd
+			server.blockSize = uint32(preferred)
+			server.maxRequest = uint32(maximum)
+			server.merge = merge
+			servers = append(servers, server)
+		}
+		var listening atomic.Bool
+		conns := newConnections()
+		hh := &healthHandler{servers: servers, listening: &listening, watchdog: wd}
+		if apiConf != nil {
+			for _, d := range devices {
+				apiServers = append(apiServers, server.New(d.path, d.opts...))
+			}
+			go startAPIServer(apiConf, devices, apiServers, tokens, conns, hh)
+		}
+		if *healthURL != "" {
+			go startHealthServer(*healthURL, hh)
+		}
+		// Close volumes and wait for jobs on termination, so that no writes are lost, and flush pending spans
+		// and metrics. A second signal exits right away.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+			code := 0
+			for _, s := range apiServers {
+				if err := s.Close(); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					code = 1
+				}
+			}
+			deadline := time.Now().Add(shutdownWait)
+			for _, s := range servers {
+				if err := s.shutdown(deadline); err != nil {
+					fmt.Printf("Error: %v: %v\n", s.device, err)
+					code = 1
+				}
+			}
+			if stopTelemetry != nil {
+				stopTelemetry(context.Background())
+			}
+			os.Exit(code)
+		}()
+		if err := startServer(*url, servers, conns, &listening); err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
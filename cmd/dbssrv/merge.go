@@ -0,0 +1,127 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Largest write submitted after merging.
+const MAX_MERGED_WRITE = 4 * 1024 * 1024
+
+// Queues the writes of a backend for a short window, and submits those that are contiguous as a single
+// write, as guests mostly send small writes, each otherwise costing a write to the device. Writes are only
+// acknowledged once submitted. Overlapping writes are not merged: a write overlapping a queued one submits
+// the queue first, so that writes to the same data are applied in the order they arrive.
+type writeMerger struct {
+	window time.Duration
+	write  func(ctx context.Context, p []byte, off uint64) error
+
+	mu    sync.Mutex
+	queue []*queuedWrite
+	bytes uint64
+	timer *time.Timer // Set while writes are queued
+}
+
+type queuedWrite struct {
+	off  uint64
+	data []byte
+	done chan error
+}
+
+func newWriteMerger(window time.Duration, write func(ctx context.Context, p []byte, off uint64) error) *writeMerger {
+	return &writeMerger{window: window, write: write}
+}
+
+// Queue a write and wait until it is submitted.
+func (m *writeMerger) submit(p []byte, off uint64) error {
+	qw := &queuedWrite{off: off, data: p, done: make(chan error, 1)}
+	m.mu.Lock()
+	for _, q := range m.queue {
+		if q.off < off+uint64(len(p)) && off < q.off+uint64(len(q.data)) {
+			batch := m.take()
+			m.mu.Unlock()
+			m.run(batch)
+			m.mu.Lock()
+			break
+		}
+	}
+	m.queue = append(m.queue, qw)
+	m.bytes += uint64(len(p))
+	var batch []*queuedWrite
+	if m.bytes >= MAX_MERGED_WRITE {
+		batch = m.take()
+	} else if m.timer == nil {
+		m.timer = time.AfterFunc(m.window, m.flush)
+	}
+	m.mu.Unlock()
+	m.run(batch)
+	return <-qw.done
+}
+
+// Submit the queued writes and wait for them.
+func (m *writeMerger) flush() {
+	m.mu.Lock()
+	batch := m.take()
+	m.mu.Unlock()
+	m.run(batch)
+}
+
+// Return the queued writes, emptying the queue. Must be called with mu held.
+func (m *writeMerger) take() []*queuedWrite {
+	batch := m.queue
+	m.queue = nil
+	m.bytes = 0
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	return batch
+}
+
+// Submit writes, merging those that are contiguous, and pass each its result.
+func (m *writeMerger) run(batch []*queuedWrite) {
+	sort.Slice(batch, func(i, j int) bool { return batch[i].off < batch[j].off })
+	for start := 0; start < len(batch); {
+		end := start + 1
+		length := uint64(len(batch[start].data))
+		for end < len(batch) && batch[end].off == batch[start].off+length && length+uint64(len(batch[end].data)) <= MAX_MERGED_WRITE {
+			length += uint64(len(batch[end].data))
+			end++
+		}
+		var err error
+		if end-start == 1 {
+			err = m.write(context.Background(), batch[start].data, batch[start].off)
+		} else {
+			data := make([]byte, 0, length)
+			for _, qw := range batch[start:end] {
+				data = append(data, qw.data...)
+			}
+			ctx, span := tracer.Start(context.Background(), "nbd.merged_write")
+			span.SetAttributes(attribute.Int("nbd.requests", end-start))
+			err = m.write(ctx, data, batch[start].off)
+			endSpan(span, &err)
+		}
+		for _, qw := range batch[start:end] {
+			qw.done <- err
+		}
+		start = end
+	}
+}
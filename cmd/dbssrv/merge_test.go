@@ -0,0 +1,164 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MergeSuite struct{}
+
+var _ = Suite(&MergeSuite{})
+
+type mergeWrite struct {
+	off    uint64
+	length int
+}
+
+// Queue writes with a merger one after the other, waiting for each to be queued, and return the writes passed
+// to the backend, the final contents of a device of the given size, and the result of each write.
+func runMerger(c *C, writes []mergeWrite, failOff int64, flush bool, size int) ([]mergeWrite, []byte, []error) {
+	var mu sync.Mutex
+	var submitted []mergeWrite
+	device := make([]byte, size)
+	m := newWriteMerger(time.Hour, func(ctx context.Context, p []byte, off uint64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		submitted = append(submitted, mergeWrite{off, len(p)})
+		if int64(off) == failOff {
+			return errors.New("write failed")
+		}
+		copy(device[off:], p)
+		return nil
+	})
+	errs := make([]error, len(writes))
+	done := make([]chan struct{}, len(writes))
+	for i, w := range writes {
+		p := bytes.Repeat([]byte{byte(i + 1)}, w.length)
+		done[i] = make(chan struct{})
+		go func(i int) {
+			defer close(done[i])
+			errs[i] = m.submit(p, w.off)
+		}(i)
+		// Wait until the write is queued, or submitted along with a full queue
+		for deadline := time.Now().Add(time.Second); ; {
+			m.mu.Lock()
+			queued := false
+			for _, q := range m.queue {
+				queued = queued || &q.data[0] == &p[0]
+			}
+			m.mu.Unlock()
+			select {
+			case <-done[i]:
+				queued = true
+			default:
+			}
+			if queued {
+				break
+			}
+			c.Assert(time.Now().Before(deadline), Equals, true)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if flush {
+		m.flush()
+	}
+	for i := range done {
+		select {
+		case <-done[i]:
+		case <-time.After(time.Second):
+			c.Fatalf("write %v not acknowledged", i)
+		}
+	}
+	return submitted, device, errs
+}
+
+func (s *MergeSuite) TestWriteMerger(c *C) {
+	const max = MAX_MERGED_WRITE
+	for _, t := range []struct {
+		name      string
+		writes    []mergeWrite
+		failOff   int64 // Offset of the backend write that fails, negative for none
+		flush     bool
+		submitted []mergeWrite
+		failed    []bool
+	}{
+		{
+			name:      "contiguous writes are merged in offset order",
+			writes:    []mergeWrite{{4096, 4096}, {0, 4096}, {8192, 4096}},
+			failOff:   -1,
+			flush:     true,
+			submitted: []mergeWrite{{0, 12288}},
+			failed:    []bool{false, false, false},
+		},
+		{
+			name:      "writes with gaps are submitted separately",
+			writes:    []mergeWrite{{0, 4096}, {16384, 4096}},
+			failOff:   -1,
+			flush:     true,
+			submitted: []mergeWrite{{0, 4096}, {16384, 4096}},
+			failed:    []bool{false, false},
+		},
+		{
+			name:      "an overlapping write submits the queue first",
+			writes:    []mergeWrite{{0, 4096}, {4096, 4096}, {2048, 4096}},
+			failOff:   -1,
+			flush:     true,
+			submitted: []mergeWrite{{0, 8192}, {2048, 4096}},
+			failed:    []bool{false, false, false},
+		},
+		{
+			name:      "each request gets the result of its merged write",
+			writes:    []mergeWrite{{0, 4096}, {4096, 4096}, {16384, 4096}},
+			failOff:   0,
+			flush:     true,
+			submitted: []mergeWrite{{0, 8192}, {16384, 4096}},
+			failed:    []bool{true, true, false},
+		},
+		{
+			name:      "a full queue is submitted without waiting",
+			writes:    []mergeWrite{{0, max / 2}, {max / 2, max / 2}},
+			failOff:   -1,
+			flush:     false,
+			submitted: []mergeWrite{{0, max}},
+			failed:    []bool{false, false},
+		},
+	} {
+		c.Log(t.name)
+		submitted, device, errs := runMerger(c, t.writes, t.failOff, t.flush, max+16384)
+		c.Assert(submitted, DeepEquals, t.submitted)
+		for i := range errs {
+			c.Assert(errs[i] != nil, Equals, t.failed[i])
+		}
+		if t.failOff >= 0 {
+			continue
+		}
+		// Writes are applied in the order they arrived
+		expected := make([]byte, len(device))
+		for i, w := range t.writes {
+			copy(expected[w.off:], bytes.Repeat([]byte{byte(i + 1)}, w.length))
+		}
+		c.Assert(bytes.Equal(device, expected), Equals, true)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/chazapis/go-nbd/pkg/protocol"
+	nbd "github.com/chazapis/go-nbd/pkg/server"
+)
+
+const (
+	// Separator of the token in export names, as in volume#token or volume@snapshotId#token.
+	TOKEN_SEPARATOR = "#"
+	// Name of the export listed to clients when tokens are required.
+	TOKEN_EXPORT_NAME = "token-required"
+	// Largest negotiation option read ahead, as clients send little more than an export name.
+	MAX_OPTION_LENGTH = 64 * 1024
+)
+
+var errTokenRequired = errors.New("export token required")
+
+// Backend of the token export while no valid token has been presented. The NBD server gets the size of the
+// export on a successful negotiation, which fails the connection.
+type deniedBackend struct{}
+
+func (deniedBackend) ReadAt(p []byte, off int64) (int, error)  { return 0, errTokenRequired }
+func (deniedBackend) WriteAt(p []byte, off int64) (int, error) { return 0, errTokenRequired }
+func (deniedBackend) Size() (int64, error)                     { return 0, errTokenRequired }
+func (deniedBackend) Sync() error                              { return errTokenRequired }
+
+// Connection reading the NBD negotiation ahead of the server, so that the export a client asks for is checked
+// against its token before the server looks it up. The server is given the single export of the connection,
+// which becomes the export asked for if the token grants access to it, and denies access otherwise.
+type tokenConn struct {
+	net.Conn
+	resolve     func(name string, redeem bool) *nbd.Export
+	export      *nbd.Export
+	buf         []byte
+	started     bool // Client flags read
+	negotiating bool
+}
+
+func newTokenConn(conn net.Conn, resolve func(name string, redeem bool) *nbd.Export) *tokenConn {
+	return &tokenConn{
+		Conn:        conn,
+		resolve:     resolve,
+		export:      &nbd.Export{Name: TOKEN_EXPORT_NAME, Description: "DBS, attach as NAME#TOKEN", Backend: deniedBackend{}},
+		negotiating: true,
+	}
+}
+
+func (c *tokenConn) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 && c.negotiating {
+		if err := c.readAhead(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// Read the client flags, or the next option with its data, and update the export if it asks for one.
+func (c *tokenConn) readAhead() error {
+	if !c.started {
+		c.buf = make([]byte, 4)
+		c.started = true
+		_, err := io.ReadFull(c.Conn, c.buf)
+		return err
+	}
+	var header protocol.NegotiationOptionHeader
+	if err := binary.Read(c.Conn, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.OptionMagic != protocol.NEGOTIATION_MAGIC_OPTION || header.Length > MAX_OPTION_LENGTH {
+		return fmt.Errorf("invalid negotiation option")
+	}
+	data := make([]byte, header.Length)
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &header)
+	c.buf = append(buf.Bytes(), data...)
+	switch header.ID {
+	case protocol.NEGOTIATION_ID_OPTION_INFO, protocol.NEGOTIATION_ID_OPTION_GO:
+		name := ""
+		if len(data) >= 4 {
+			if n := binary.BigEndian.Uint32(data); uint64(n) <= uint64(len(data)-4) {
+				name = string(data[4 : 4+n])
+			}
+		}
+		// Only attaching redeems one-time tokens
+		redeem := header.ID == protocol.NEGOTIATION_ID_OPTION_GO
+		if e := c.resolve(name, redeem); e != nil {
+			*c.export = *e
+			c.export.Name = name
+			// Transmission follows
+			c.negotiating = !redeem
+		} else {
+			// Never matches the name asked for, and a previously found export is no longer served
+			c.export.Name = name + "\x00"
+			c.export.Backend = deniedBackend{}
+		}
+	case protocol.NEGOTIATION_ID_OPTION_ABORT:
+		c.negotiating = false
+	}
+	return nil
+}
+
+// Return the export for a name with a token, as NAME#TOKEN, or nil if the token does not grant access to it.
+func (s *Server) tokenExport(exports []*nbd.Export, name string, redeem bool) *nbd.Export {
+	exportName, token, ok := strings.Cut(name, TOKEN_SEPARATOR)
+	if !ok || token == "" {
+		return nil
+	}
+	// The default export, when serving a single volume, is the volume
+	if exportName == "" {
+		exportName = s.volumeName
+	}
+	for _, e := range exports {
+		if e.Name == exportName && s.tokens.Check(exportName, token, redeem) {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+var errRequestTimedOut = errors.New("request timed out")
+
+// Reports NBD requests running for longer than a threshold, which usually point to a failing disk, and
+// optionally fails them, so that clients get an error instead of hanging. I/O on the device cannot be
+// interrupted, so a failed request keeps running in the background, holding the locks of the extents it
+// touches, until the device completes or fails it.
+type watchdog struct {
+	threshold time.Duration
+	cancel    bool
+	slow      atomic.Int64 // Requests running past the threshold
+}
+
+// Request being watched.
+type watchedRequest struct {
+	op           string
+	export       string
+	offset       uint64
+	length       uint64
+	deviceOffset atomic.Int64 // Of the first byte, -1 if not known or not allocated
+}
+
+func (r *watchedRequest) String() string {
+	if r.op == "flush" {
+		return fmt.Sprintf("flush of %v", r.export)
+	}
+	s := fmt.Sprintf("%v of %v at offset %v, length %v", r.op, r.export, r.offset, r.length)
+	if deviceOffset := r.deviceOffset.Load(); deviceOffset >= 0 {
+		s += fmt.Sprintf(", device offset %v", deviceOffset)
+	}
+	return s
+}
+
+// Return a request to watch, or nil without a watchdog.
+func (w *watchdog) request(op string, export string, offset uint64, length uint64) *watchedRequest {
+	if w == nil {
+		return nil
+	}
+	r := &watchedRequest{op: op, export: export, offset: offset, length: length}
+	r.deviceOffset.Store(-1)
+	return r
+}
+
+// Note where the request goes on the device. Must be called with the volume context locked for the request.
+func (r *watchedRequest) locate(vc *dbs.VolumeContext) {
+	if r == nil {
+		return
+	}
+	if deviceOffset, ok, err := vc.DeviceOffset(r.offset); err == nil && ok {
+		r.deviceOffset.Store(int64(deviceOffset))
+	}
+}
+
+// Run a request, reporting it if it takes longer than the threshold.
+func (w *watchdog) run(r *watchedRequest, fn func() error) error {
+	if w == nil {
+		return fn()
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	timer := time.NewTimer(w.threshold)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	fmt.Printf("Slow %v: running for over %v\n", r, w.threshold)
+	w.slow.Add(1)
+	finish := func() error {
+		err := <-done
+		w.slow.Add(-1)
+		if err != nil {
+			fmt.Printf("Slow %v: failed after %v: %v\n", r, time.Since(start), err)
+		} else {
+			fmt.Printf("Slow %v: completed after %v\n", r, time.Since(start))
+		}
+		return err
+	}
+	if w.cancel {
+		go finish()
+		return fmt.Errorf("%w: %v", errRequestTimedOut, r)
+	}
+	return finish()
+}
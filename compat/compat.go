@@ -0,0 +1,116 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compat adapts the API of the former cgo bindings onto the dbs package, so code written against them
+// can migrate incrementally. Volumes are accessed through a Context in 512-byte blocks, as before.
+//
+// Deprecated: use the dbs package directly.
+package compat
+
+import (
+	"github.com/Kampadais/dbs"
+)
+
+// Size of blocks addressed by Context.
+const BLOCK_SIZE = 512
+
+func InitDevice(device string) error {
+	return dbs.InitDevice(device)
+}
+
+func VacuumDevice(device string) error {
+	return dbs.VacuumDevice(device)
+}
+
+func GetDeviceInfo(device string) (*dbs.DeviceInfo, error) {
+	return dbs.GetDeviceInfo(device)
+}
+
+func GetVolumeInfo(device string) ([]dbs.VolumeInfo, error) {
+	return dbs.GetVolumeInfo(device)
+}
+
+func GetSnapshotInfo(device string, volumeName string) ([]dbs.SnapshotInfo, error) {
+	return dbs.GetSnapshotInfo(device, volumeName)
+}
+
+// Create a volume. Information about it is no longer returned.
+func CreateVolume(device string, volumeName string, volumeSize uint64) error {
+	_, err := dbs.CreateVolume(device, volumeName, volumeSize)
+	return err
+}
+
+func RenameVolume(device string, volumeName string, newVolumeName string) error {
+	return dbs.RenameVolume(device, volumeName, newVolumeName)
+}
+
+// Snapshot a volume, without labels or options.
+func CreateSnapshot(device string, volumeName string) error {
+	_, err := dbs.CreateSnapshot(device, volumeName, nil)
+	return err
+}
+
+func CloneSnapshot(device string, newVolumeName string, snapshotId uint) error {
+	_, err := dbs.CloneSnapshot(device, newVolumeName, snapshotId)
+	return err
+}
+
+func DeleteVolume(device string, volumeName string) error {
+	return dbs.DeleteVolume(device, volumeName)
+}
+
+func DeleteSnapshot(device string, snapshotId uint) error {
+	return dbs.DeleteSnapshot(device, snapshotId)
+}
+
+// Open volume, with I/O in 512-byte blocks.
+type Context struct {
+	vc *dbs.VolumeContext
+}
+
+func OpenVolume(device string, volumeName string) (*Context, error) {
+	vc, err := dbs.OpenVolume(device, volumeName, dbs.WithSectorSize(BLOCK_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	return &Context{vc: vc}, nil
+}
+
+// Return the volume context, to move code to the dbs package gradually.
+func (c *Context) VolumeContext() *dbs.VolumeContext {
+	return c.vc
+}
+
+func (c *Context) VolumeSize() uint64 {
+	return c.vc.VolumeSize()
+}
+
+func (c *Context) CloseVolume() error {
+	return c.vc.CloseVolume()
+}
+
+// Read the 512-byte block at the given index.
+func (c *Context) ReadBlock(block uint64, data []byte) error {
+	return c.vc.ReadSector(data, block)
+}
+
+// Write the 512-byte block at the given index. The rest of the underlying block is read and written back.
+func (c *Context) WriteBlock(block uint64, data []byte) error {
+	return c.vc.WriteSector(data, block, true)
+}
+
+// Unmap the 512-byte block at the given index. The underlying block is zeroed, until all of it is unmapped.
+func (c *Context) UnmapBlock(block uint64) error {
+	return c.vc.UnmapSector(block)
+}
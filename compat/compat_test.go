@@ -0,0 +1,61 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat
+
+import (
+	"bytes"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/Kampadais/dbs"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type CompatSuite struct{}
+
+var _ = Suite(&CompatSuite{})
+
+func (s *CompatSuite) TestContext(c *C) {
+	device, err := dbs.CreateMemoryDevice("compat", 100*1024*1024)
+	c.Assert(err, IsNil)
+	defer dbs.RemoveMemoryDevice("compat")
+	c.Assert(InitDevice(device), IsNil)
+	c.Assert(CreateVolume(device, "vol1", 1024*1024*1024), IsNil)
+
+	ctx, err := OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	defer ctx.CloseVolume()
+	data := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	c.Assert(ctx.WriteBlock(3, data), IsNil)
+	c.Assert(ctx.WriteBlock(4, bytes.Repeat([]byte{2}, BLOCK_SIZE)), IsNil)
+	buf := make([]byte, BLOCK_SIZE)
+	c.Assert(ctx.ReadBlock(3, buf), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(ctx.ReadBlock(2, buf), IsNil)
+	c.Assert(buf, DeepEquals, make([]byte, BLOCK_SIZE))
+	c.Assert(ctx.ReadBlock(2, buf[:10]), NotNil)
+
+	// Unmapping leaves the neighbouring blocks in place
+	c.Assert(ctx.UnmapBlock(3), IsNil)
+	c.Assert(ctx.ReadBlock(3, buf), IsNil)
+	c.Assert(buf, DeepEquals, make([]byte, BLOCK_SIZE))
+	c.Assert(ctx.ReadBlock(4, buf), IsNil)
+	c.Assert(buf, DeepEquals, bytes.Repeat([]byte{2}, BLOCK_SIZE))
+	all := make([]byte, dbs.BLOCK_SIZE)
+	c.Assert(ctx.VolumeContext().ReadAt(all, 0), IsNil)
+	c.Assert(all[4*BLOCK_SIZE], Equals, byte(2))
+}
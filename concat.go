@@ -0,0 +1,35 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Create a volume out of others, placed one after the other in the given order, and return its information.
+// The extents of the volumes are handed over to the new one, which takes the settings of the first, without
+// copying any data, and the volumes are destroyed. They must not have snapshots besides the current one, or be
+// open, and must be in the same group, if any.
+func ConcatVolumes(device string, newVolumeName string, volumeNames []string) (*VolumeInfo, error) {
+	return core.ConcatVolumes(device, newVolumeName, volumeNames)
+}
+
+// Split a volume in two at an offset, which must be a multiple of EXTENT_SIZE, and return the information of
+// the new volume, holding the part of the volume from the offset on. The volume keeps the part before it. The
+// extents of the part are handed over to the new volume, which takes the settings of the volume, without
+// copying any data. The volume must not have snapshots besides the current one, or be open.
+func SplitVolume(device string, volumeName string, newVolumeName string, offset uint64) (*VolumeInfo, error) {
+	return core.SplitVolume(device, volumeName, newVolumeName, offset)
+}
@@ -0,0 +1,66 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Types of events sent to watchers and hooks.
+const (
+	EVENT_DEVICE_INITIALIZED = core.EVENT_DEVICE_INITIALIZED
+	EVENT_VOLUME_CREATED     = core.EVENT_VOLUME_CREATED
+	EVENT_VOLUME_CLONED      = core.EVENT_VOLUME_CLONED
+	EVENT_VOLUME_RENAMED     = core.EVENT_VOLUME_RENAMED
+	EVENT_VOLUME_DELETED     = core.EVENT_VOLUME_DELETED
+	EVENT_VOLUME_UNDELETED   = core.EVENT_VOLUME_UNDELETED
+	EVENT_VOLUME_PURGED      = core.EVENT_VOLUME_PURGED
+	EVENT_SNAPSHOT_CREATED   = core.EVENT_SNAPSHOT_CREATED
+	EVENT_SNAPSHOT_DELETED   = core.EVENT_SNAPSHOT_DELETED
+	EVENT_SPACE_LOW          = core.EVENT_SPACE_LOW
+	EVENT_VOLUME_FAILED      = core.EVENT_VOLUME_FAILED
+	EVENT_MIRROR_DEGRADED    = core.EVENT_MIRROR_DEGRADED
+	EVENT_MIRROR_RESYNCED    = core.EVENT_MIRROR_RESYNCED
+	EVENT_SCRUB_ERROR        = core.EVENT_SCRUB_ERROR
+	EVENT_SCRUB_COMPLETED    = core.EVENT_SCRUB_COMPLETED
+	EVENT_ERROR              = core.EVENT_ERROR
+
+	DEFAULT_WATCH_BUFFER = core.DEFAULT_WATCH_BUFFER
+)
+
+// A change to a device made by the process, or a condition found while using it.
+type Event = core.Event
+
+// Settings of a watcher. The zero value receives all events except EVENT_SPACE_LOW.
+type WatchOptions = core.WatchOptions
+
+// Function called with each event of a device, as registered with AddHook.
+type Hook = core.Hook
+
+// Receive events for a device, as changed by this process through any API call, until the returned function is
+// called, which closes the channel. The device is identified by the path given to the other calls. Events are
+// sent after the change is written, and dropped if the buffer of a watcher is full. Options may be nil.
+func Watch(device string, opts *WatchOptions) (<-chan Event, func()) {
+	return core.Watch(device, opts)
+}
+
+// Call a function with each event of a device, as sent to watchers without a space threshold, until the returned
+// function is called. Unlike watchers, hooks get every event, but are called by the API call making the change,
+// after it is written, which waits for them to return. Hooks that take long, like those running commands or
+// calling services when volumes are created or deleted, should hand events over to another goroutine. Hooks may
+// not make API calls on the device themselves.
+func AddHook(device string, fn Hook) func() {
+	return core.AddHook(device, fn)
+}
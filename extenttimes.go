@@ -0,0 +1,29 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Start or stop keeping the time of the last write to each extent, which tools can use for time-based
+// incremental copies or to tell hot from cold data without diffing snapshots. Times are kept in a table taking
+// the last extents of the data area, so these must be free, as after vacuuming the device. Times are recorded
+// when extents are allocated and, for writes to extents already allocated, with the volume stats, so they may
+// lag behind by up to STATS_FLUSH_INTERVAL while the volume is open. Versions that do not know of them can only
+// open such devices read-only.
+func SetDeviceExtentTimes(device string, enabled bool) error {
+	return core.SetDeviceExtentTimes(device, enabled)
+}
@@ -15,63 +15,32 @@
 package dbs
 
 import (
-	"fmt"
-	"io"
 	"os"
 
-	"github.com/ncw/directio"
+	"github.com/Kampadais/dbs/internal/core"
 )
 
-// Wrapper to file object supporting direct I/O
-type DirectFile struct {
-	*os.File
-	Name string
-}
+// Alignment of buffers, offsets and sizes for direct I/O.
+const ALIGN_SIZE = core.ALIGN_SIZE
 
-func NewDirectFile(name string, flag int, perm os.FileMode) (*DirectFile, error) {
-	file, err := directio.OpenFile(name, flag, perm)
-	if err != nil {
-		return nil, err
-	}
-	df := &DirectFile{
-		File: file,
-		Name: name,
-	}
-	return df, nil
-}
+var ErrUnsupportedSectorSize = core.ErrUnsupportedSectorSize
 
-func (file *DirectFile) Size() (int64, error) {
-	pos, err := file.File.Seek(0, io.SeekEnd)
-	if err != nil {
-		return 0, fmt.Errorf("cannot seek in %v: %w", file.Name, err)
-	}
-	return pos, nil
-}
+// Wrapper to file object supporting direct I/O
+type DirectFile = core.DirectFile
 
-// Read using direct I/O
-func (file *DirectFile) ReadAt(data []byte, offset uint64) (int, error) {
-	if directio.IsAligned(data) {
-		return file.File.ReadAt(data, int64(offset))
-	}
-	buf := directio.AlignedBlock(len(data))
-	n, err := file.File.ReadAt(buf, int64(offset))
-	if err == nil {
-		copy(data, buf)
-	}
-	return n, err
+// Open a file for direct I/O. Where direct I/O is not supported, the file is opened with synchronous writes.
+// Devices whose sectors are larger than a block cannot be accessed with direct I/O and are rejected.
+func NewDirectFile(name string, flag int, perm os.FileMode) (*DirectFile, error) {
+	return core.NewDirectFile(name, flag, perm)
 }
 
-// Write using direct I/O
-func (file *DirectFile) WriteAt(data []byte, offset uint64) (int, error) {
-	if directio.IsAligned(data) {
-		return file.File.WriteAt(data, int64(offset))
-	}
-	buf := directio.AlignedBlock(len(data))
-	copy(buf, data)
-	return file.File.WriteAt(buf, int64(offset))
+// Open a file for buffered I/O, for filesystems that do not support direct I/O. Writes are made durable with
+// explicit syncs.
+func NewBufferedFile(name string, flag int, perm os.FileMode) (*DirectFile, error) {
+	return core.NewBufferedFile(name, flag, perm)
 }
 
-func (file *DirectFile) Close() error {
-	// file.File.Sync()
-	return file.File.Close()
+// Return a buffer of the given size, aligned in memory for direct I/O.
+func AlignedBlock(size int) []byte {
+	return core.AlignedBlock(size)
 }
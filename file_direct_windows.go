@@ -0,0 +1,29 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+const (
+	FILE_FLAG_NO_BUFFERING  = core.FILE_FLAG_NO_BUFFERING
+	FILE_FLAG_WRITE_THROUGH = core.FILE_FLAG_WRITE_THROUGH
+
+	IOCTL_DISK_GET_LENGTH_INFO    = core.IOCTL_DISK_GET_LENGTH_INFO
+	IOCTL_DISK_GET_DRIVE_GEOMETRY = core.IOCTL_DISK_GET_DRIVE_GEOMETRY
+)
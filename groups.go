@@ -0,0 +1,59 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+var (
+	ErrGroupNotFound = core.ErrGroupNotFound
+	ErrQuotaExceeded = core.ErrQuotaExceeded
+)
+
+type GroupInfo = core.GroupInfo
+
+// Move a volume to a group, created if it does not exist, or out of its group if the group name is empty. The
+// volume must fit in the quota of the group.
+func SetVolumeGroup(device string, volumeName string, groupName string) error {
+	return core.SetVolumeGroup(device, volumeName, groupName)
+}
+
+// Limit the total size of the volumes in a group, creating the group if it does not exist. Zero removes the
+// limit. The quota cannot be set below the size of the volumes already in the group.
+func SetGroupQuota(device string, groupName string, quota uint64) error {
+	return core.SetGroupQuota(device, groupName, quota)
+}
+
+func GetGroupInfo(device string) ([]GroupInfo, error) {
+	return core.GetGroupInfo(device)
+}
+
+// Return information about the volumes in a group, excluding those in the trash.
+func GetGroupVolumeInfo(device string, groupName string) ([]VolumeInfo, error) {
+	return core.GetGroupVolumeInfo(device, groupName)
+}
+
+// Snapshot all volumes of a group in a single metadata update, so that the snapshots are consistent with each
+// other. Returns the new current snapshot of each volume, by volume name. Options may be nil.
+func SnapshotGroup(device string, groupName string, opts *SnapshotOptions) (map[string]uint, error) {
+	return core.SnapshotGroup(device, groupName, opts)
+}
+
+// Delete all volumes of a group, and the group. Volumes go to the trash if it is enabled, as with
+// DeleteVolume, but no longer belong to the group when undeleted.
+func DeleteGroup(device string, groupName string) error {
+	return core.DeleteGroup(device, groupName)
+}
@@ -0,0 +1,234 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/kelindar/bitmap"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+const (
+	ALLOCATION_POLICY_DEFAULT    = format.ALLOCATION_POLICY_DEFAULT
+	ALLOCATION_POLICY_NEXT       = format.ALLOCATION_POLICY_NEXT
+	ALLOCATION_POLICY_FIRST_FIT  = format.ALLOCATION_POLICY_FIRST_FIT
+	ALLOCATION_POLICY_CONTIGUOUS = format.ALLOCATION_POLICY_CONTIGUOUS
+	ALLOCATION_POLICY_STRIPED    = format.ALLOCATION_POLICY_STRIPED
+)
+
+var allocationPolicyNames = []string{"default", "next", "first_fit", "contiguous", "striped"}
+
+// Return the name of an allocation policy.
+func AllocationPolicyName(policy uint) string {
+	if policy >= uint(len(allocationPolicyNames)) {
+		return "unknown"
+	}
+	return allocationPolicyNames[policy]
+}
+
+// Return the allocation policy with the given name.
+func ParseAllocationPolicy(name string) (uint, error) {
+	for i, n := range allocationPolicyNames {
+		if n == name {
+			return uint(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown allocation policy %v", name)
+}
+
+// Free device extents below the allocation mark. Loaded on first use, as it requires a scan of all extent metadata.
+type freeExtents struct {
+	loaded bool
+	bitmap bitmap.Bitmap
+}
+
+func (dc *DeviceContext) loadFreeExtents() error {
+	if dc.free.loaded {
+		return nil
+	}
+	if err := dc.loadExtentIndex(); err != nil {
+		return err
+	}
+	for i, sid := range dc.index.owners[:min(dc.totalDeviceExtents, uint(dc.superblock.AllocatedDeviceExtents))] {
+		if sid == 0 {
+			dc.free.bitmap.Set(uint32(i))
+		}
+	}
+	dc.free.loaded = true
+	return nil
+}
+
+func (dc *DeviceContext) isFreeExtent(pos uint32) bool {
+	return pos >= dc.superblock.AllocatedDeviceExtents || dc.free.bitmap.Contains(pos)
+}
+
+// Find the first free extent at or after the given position. Returns false if there is none.
+func (dc *DeviceContext) findFreeExtent(pos uint32) (uint32, bool) {
+	for ; pos < dc.superblock.AllocatedDeviceExtents; pos++ {
+		if dc.free.bitmap.Contains(pos) {
+			return pos, true
+		}
+	}
+	if pos >= uint32(dc.totalDeviceExtents) {
+		return 0, false
+	}
+	return pos, true
+}
+
+// Mark an extent as used, moving the allocation mark if needed. Extents skipped over are free.
+func (dc *DeviceContext) takeExtent(pos uint32) uint32 {
+	if pos < dc.superblock.AllocatedDeviceExtents {
+		dc.free.bitmap.Remove(pos)
+		return pos
+	}
+	for p := dc.superblock.AllocatedDeviceExtents; p < pos; p++ {
+		dc.free.bitmap.Set(p)
+	}
+	dc.superblock.AllocatedDeviceExtents = pos + 1
+	return pos
+}
+
+// Note that an extent is no longer used, so it can be reallocated. Its data is discarded.
+func (dc *DeviceContext) ReleaseExtent(pos uint32) {
+	if dc.free.loaded {
+		dc.free.bitmap.Set(pos)
+	}
+	dc.trimExtents(uint(pos), 1)
+}
+
+// Discard the data of unused extents. Failures are only logged, as the data is never read again.
+func (dc *DeviceContext) trimExtents(pos uint, count uint) {
+	if count == 0 {
+		return
+	}
+	if err := dc.f.Trim(uint64(dc.dataOffset+(pos*EXTENT_SIZE)), uint64(count*EXTENT_SIZE)); err != nil {
+		dc.opts.Logger.Debug("cannot trim extents", "position", pos, "count", count, "error", err)
+	}
+}
+
+// Return the allocation policy in effect for a volume.
+func (dc *DeviceContext) AllocationPolicy(v *VolumeMetadata) uint8 {
+	if v != nil && v.AllocationPolicy != ALLOCATION_POLICY_DEFAULT {
+		return v.AllocationPolicy
+	}
+	if dc.superblock.AllocationPolicy != ALLOCATION_POLICY_DEFAULT {
+		return dc.superblock.AllocationPolicy
+	}
+	return ALLOCATION_POLICY_NEXT
+}
+
+// Allocate a device extent for the given volume extent of the map, according to the map's allocation policy.
+// On tiered devices, extents of volumes with a tier are allocated in its region, unless it is full.
+func (dc *DeviceContext) AllocateExtent(em *ExtentMap, eidx uint32) (uint32, error) {
+	pos, err := dc.allocateExtent(em, eidx)
+	if err != nil {
+		return 0, err
+	}
+	return pos, dc.touchExtent(pos)
+}
+
+func (dc *DeviceContext) allocateExtent(em *ExtentMap, eidx uint32) (uint32, error) {
+	if pos, ok, err := dc.tierExtent(em.tier); err != nil {
+		return 0, err
+	} else if ok {
+		return dc.takeExtent(pos), nil
+	}
+	mark := dc.superblock.AllocatedDeviceExtents
+	if em.allocationPolicy == ALLOCATION_POLICY_NEXT && uint(mark) < dc.totalDeviceExtents {
+		return dc.takeExtent(mark), nil
+	}
+	if err := dc.loadFreeExtents(); err != nil {
+		return 0, err
+	}
+
+	switch em.allocationPolicy {
+	case ALLOCATION_POLICY_CONTIGUOUS:
+		if eidx > 0 && em.get(eidx-1).SnapshotId != 0 {
+			if pos := em.get(eidx-1).ExtentPos + 1; uint(pos) < dc.totalDeviceExtents && dc.isFreeExtent(pos) {
+				return dc.takeExtent(pos), nil
+			}
+		}
+		if uint(eidx+1) < em.totalVolumeExtents && em.get(eidx+1).SnapshotId != 0 {
+			if pos := em.get(eidx + 1).ExtentPos; pos > 0 && dc.isFreeExtent(pos-1) {
+				return dc.takeExtent(pos - 1), nil
+			}
+		}
+		if uint(mark) < dc.totalDeviceExtents {
+			return dc.takeExtent(mark), nil
+		}
+	case ALLOCATION_POLICY_STRIPED:
+		target := uint32((uint64(eidx) * uint64(dc.totalDeviceExtents)) / uint64(em.totalVolumeExtents))
+		if pos, ok := dc.findFreeExtent(target); ok {
+			return dc.takeExtent(pos), nil
+		}
+	}
+	if pos, ok := dc.findFreeExtent(0); ok {
+		return dc.takeExtent(pos), nil
+	}
+	dc.notifyError(ErrNoSpace)
+	return 0, ErrNoSpace
+}
+
+// Zero the data of an extent allocated to a snapshot with SNAPSHOT_FLAG_ZEROED, which may still hold data of
+// the volume it was last allocated to. Extents filled by copies need not be zeroed.
+func (dc *DeviceContext) zeroNewExtent(pos uint32, snapshotId uint16) error {
+	if dc.snapshots[snapshotId-1].Flags&SNAPSHOT_FLAG_ZEROED == 0 {
+		return nil
+	}
+	if err := dc.zeroRange(uint64(dc.dataOffset)+uint64(pos)*EXTENT_SIZE, EXTENT_SIZE); err != nil {
+		return fmt.Errorf("failed to zero extent: %w", err)
+	}
+	return nil
+}
+
+// Set the default allocation policy of a device.
+func SetDeviceAllocationPolicy(device string, policy uint) error {
+	if policy >= uint(len(allocationPolicyNames)) {
+		return fmt.Errorf("unknown allocation policy %v", policy)
+	}
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	dc.superblock.AllocationPolicy = uint8(policy)
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Set the allocation policy of a volume. The default policy follows the device setting.
+func SetVolumeAllocationPolicy(device string, volumeName string, policy uint) error {
+	if policy >= uint(len(allocationPolicyNames)) {
+		return fmt.Errorf("unknown allocation policy %v", policy)
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	v.AllocationPolicy = uint8(policy)
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
@@ -0,0 +1,1707 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The implementation of the dbs package. It also exports the types operations are built from, like
+// DeviceContext and ExtentMap, which follow the device layout and change with it, so they stay internal.
+//
+// Device layout:
+//   - Bytes [0, 4096) contain the the superblock
+//   - Bytes [4096, StatsOffset) hold two copies of the volume, snapshot and group metadata and the snapshot
+//     labels, one of which is active
+//   - Bytes [StatsOffset, ExtentOffset) hold the volume stats
+//   - Bytes [ExtentOffset, DataOffset) hold the extent metadata (DataOffset is extent aligned)
+//   - Bytes [DataOffset, ReservedOffset) hold the data
+//   - Bytes [ReservedOffset, DeviceSize) are reserved for foreign data, if declared with WithReservedRegion
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kelindar/bitmap"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+const (
+	MAGIC   = format.MAGIC
+	VERSION = format.VERSION
+
+	MAX_VOLUMES          = format.MAX_VOLUMES
+	MAX_SNAPSHOTS        = format.MAX_SNAPSHOTS
+	MAX_VOLUME_NAME_SIZE = format.MAX_VOLUME_NAME_SIZE
+	MAX_GROUPS           = format.MAX_GROUPS
+	MAX_GROUP_NAME_SIZE  = format.MAX_GROUP_NAME_SIZE
+
+	BLOCK_SIZE           = format.BLOCK_SIZE
+	EXTENT_SIZE          = format.EXTENT_SIZE
+	EXTENT_BITMAP_SIZE   = format.EXTENT_BITMAP_SIZE
+	BLOCK_BITS_IN_EXTENT = 8
+	BLOCK_MASK_IN_EXTENT = 0xFF
+	MIN_SECTOR_SIZE      = 512
+
+	SNAPSHOT_FLAG_USER_CREATED  = format.SNAPSHOT_FLAG_USER_CREATED
+	SNAPSHOT_FLAG_ZEROED        = format.SNAPSHOT_FLAG_ZEROED
+	SNAPSHOT_FLAG_SHRED         = format.SNAPSHOT_FLAG_SHRED
+	SNAPSHOT_FLAG_SHRED_RANDOM  = format.SNAPSHOT_FLAG_SHRED_RANDOM
+	SUPERBLOCK_FLAG_MAINTENANCE = format.SUPERBLOCK_FLAG_MAINTENANCE
+	EXTENT_FLAG_PARTIAL         = format.EXTENT_FLAG_PARTIAL
+
+	FEATURE_INCOMPAT_RESERVED_REGION = format.FEATURE_INCOMPAT_RESERVED_REGION
+	FEATURE_COMPAT_JOB_TABLE         = format.FEATURE_COMPAT_JOB_TABLE
+	FEATURE_RO_COMPAT_EXTENT_TIMES   = format.FEATURE_RO_COMPAT_EXTENT_TIMES
+	FEATURE_RO_COMPAT_RETENTION      = format.FEATURE_RO_COMPAT_RETENTION
+)
+
+// The on-disk structures are defined in the format package, so external tools can use them.
+type (
+	Superblock       = format.Superblock
+	VolumeMetadata   = format.VolumeMetadata
+	SnapshotMetadata = format.SnapshotMetadata
+	GroupMetadata    = format.GroupMetadata
+	ExtentMetadata   = format.ExtentMetadata
+	Label            = format.Label
+)
+
+// Query API
+
+type DeviceInfo struct {
+	Version                string
+	DeviceSize             uint64
+	TotalDeviceExtents     uint
+	AllocatedDeviceExtents uint
+	VolumeCount            uint
+	AllocationPolicy       string
+	TrashRetention         time.Duration
+	Generation             uint64
+	DirectIO               bool
+	UUID                   string
+	Maintenance            bool          // Set while volumes may not be changed
+	FastRegion             uint64        // Size of the fast region at the start of the data area, zero if not tiered
+	ExtentTimes            bool          // Set if the time of the last write to each extent is kept
+	ReservedOffset         uint64        // Start of the region at the end of the device not managed by DBS
+	ReservedSize           uint64        // Zero if no region is reserved
+	MirrorFailed           string        // Copy of a mirrored device no longer written, until resynced with ResyncMirror
+	LabelSpaceUsed         uint64        // Bytes of the label region used by snapshot labels and names
+	LabelSpaceSize         uint64        // Of the label region, of which LABEL_NAME_RESERVE is kept for names
+	Health                 *DeviceHealth // Of the block device holding the device, nil for files and other backends
+	Scrub                  *ScrubStatus  // Of the running or last scrub in this process, nil if none
+}
+
+type VolumeInfo struct {
+	VolumeName       string
+	VolumeSize       uint64
+	SnapshotId       uint
+	CreatedAt        time.Time
+	SnapshotCount    uint
+	AllocationPolicy string
+	Tier             string
+	MaxIops          uint
+	MaxBandwidth     uint64
+	DeletedAt        time.Time // Only set for volumes in the trash
+	Group            string    // Empty if not in a group
+	BytesWritten     uint64    // Since the volume was created
+	BytesRead        uint64
+	CopiedExtents    uint64    // Extents copied from a previous snapshot on write
+	LastWriteTime    time.Time // Zero if never written
+	LastReadTime     time.Time // Zero if never read
+	MediaErrors      uint64    // Block reads and writes that failed with I/O errors, after retries
+	FailedAt         time.Time // When made read-only after media errors, zero if writable
+	Zeroed           bool      // Set if extents are zeroed when allocated, as with WithZeroedExtents
+	RetainUntil      time.Time // Written blocks may not change before this time, as set with SetVolumeRetention
+}
+
+type SnapshotInfo struct {
+	SnapshotId       uint
+	Name             string // Empty if not named
+	Description      string // Empty if not described
+	ParentSnapshotId uint
+	CreatedAt        time.Time
+	UserCreated      bool
+	Labels           map[string]string
+	VolumeName       string // Volume whose chain includes the snapshot, empty if orphaned
+	VolumeDeleted    bool   // Set if the volume is in the trash
+}
+
+func GetDeviceInfo(device string) (*DeviceInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	di := dc.deviceInfo()
+	dc.Close()
+	return di, nil
+}
+
+func (dc *DeviceContext) deviceInfo() *DeviceInfo {
+	return &DeviceInfo{
+		Version:                format.HumanVersion(dc.superblock.Version),
+		DeviceSize:             dc.superblock.DeviceSize,
+		TotalDeviceExtents:     dc.totalDeviceExtents,
+		AllocatedDeviceExtents: uint(dc.superblock.AllocatedDeviceExtents),
+		VolumeCount:            dc.CountVolumes(),
+		AllocationPolicy:       AllocationPolicyName(uint(dc.AllocationPolicy(nil))),
+		TrashRetention:         time.Duration(dc.superblock.TrashRetention) * time.Second,
+		Maintenance:            dc.inMaintenance(),
+		FastRegion:             uint64(dc.superblock.FastExtents) * EXTENT_SIZE,
+		ExtentTimes:            dc.extentTimeOffset != 0,
+		ReservedOffset:         dc.superblock.DeviceSize - dc.superblock.ReservedSize,
+		ReservedSize:           dc.superblock.ReservedSize,
+		MirrorFailed:           dc.mirrorFailed(),
+		LabelSpaceUsed:         dc.labelSpaceUsed(),
+		LabelSpaceSize:         LABEL_REGION_SIZE,
+		Health:                 dc.f.Health(),
+		Scrub:                  scrubStatus(dc.device),
+		Generation:             dc.superblock.Generation,
+		DirectIO:               dc.f.DirectIO(),
+		UUID:                   format.FormatUUID(dc.superblock.UUID),
+	}
+}
+
+func (dc *DeviceContext) volumeInfo(v *VolumeMetadata) VolumeInfo {
+	vi := VolumeInfo{
+		VolumeName:       v.Name(),
+		VolumeSize:       v.VolumeSize,
+		SnapshotId:       uint(v.SnapshotId),
+		CreatedAt:        time.Unix(dc.snapshots[v.SnapshotId-1].CreatedAt, 0),
+		SnapshotCount:    dc.CountSnapshots(v),
+		AllocationPolicy: AllocationPolicyName(uint(v.AllocationPolicy)),
+		Tier:             TierName(uint(v.Tier)),
+		MaxIops:          uint(v.MaxIops),
+		MaxBandwidth:     v.MaxBandwidth,
+		Zeroed:           dc.snapshots[v.SnapshotId-1].Flags&SNAPSHOT_FLAG_ZEROED != 0,
+	}
+	if v.DeletedAt != 0 {
+		vi.DeletedAt = time.Unix(v.DeletedAt, 0)
+	}
+	if v.GroupId != 0 {
+		vi.Group = dc.groups[v.GroupId-1].Name()
+	}
+	if retainUntil := dc.retainUntil(v); retainUntil != 0 {
+		vi.RetainUntil = time.Unix(retainUntil, 0)
+	}
+	return vi
+}
+
+func GetVolumeInfo(device string) ([]VolumeInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	stats, err := dc.ReadAllVolumeStats()
+	if err != nil {
+		return nil, err
+	}
+	vi := make([]VolumeInfo, dc.CountVolumes())
+	viidx := 0
+	for i := 0; i < MAX_VOLUMES; i++ {
+		if dc.volumes[i].SnapshotId == 0 || dc.volumes[i].DeletedAt != 0 {
+			continue
+		}
+		vi[viidx] = dc.volumeInfo(&dc.volumes[i])
+		dc.addPendingStats(&stats[i], vi[viidx].VolumeName)
+		vi[viidx].setStats(&stats[i])
+		viidx++
+	}
+	dc.Close()
+	return vi, nil
+}
+
+func GetSnapshotInfo(device string, volumeName string) ([]SnapshotInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	si := make([]SnapshotInfo, dc.CountSnapshots(v))
+	siidx := 0
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		si[siidx] = dc.snapshotInfo(sid, v)
+		siidx++
+	}
+	dc.Close()
+	return si, nil
+}
+
+func (dc *DeviceContext) snapshotInfo(sid uint16, v *VolumeMetadata) SnapshotInfo {
+	si := SnapshotInfo{
+		SnapshotId:       uint(sid),
+		ParentSnapshotId: uint(dc.snapshots[sid-1].ParentSnapshotId),
+		CreatedAt:        time.Unix(dc.snapshots[sid-1].CreatedAt, 0),
+		UserCreated:      dc.snapshots[sid-1].Flags&SNAPSHOT_FLAG_USER_CREATED != 0,
+		Labels:           dc.SnapshotLabels(sid),
+		Name:             dc.SnapshotName(sid),
+		Description:      dc.SnapshotDescription(sid),
+	}
+	if v != nil {
+		si.VolumeName = v.Name()
+		si.VolumeDeleted = v.DeletedAt != 0
+	}
+	return si
+}
+
+// Return all snapshots on the device, ordered by id. Snapshots shared by clones are reported with one of the
+// volumes, preferring those not in the trash, and snapshots not in any volume's chain are orphaned.
+func ListAllSnapshots(device string) ([]SnapshotInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	si := dc.listAllSnapshots()
+	dc.Close()
+	return si, nil
+}
+
+// Return the volume each snapshot is reported with, indexed by snapshot id minus one.
+func (dc *DeviceContext) snapshotOwners() *[MAX_SNAPSHOTS]*VolumeMetadata {
+	var owners [MAX_SNAPSHOTS]*VolumeMetadata
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 {
+			continue
+		}
+		for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+			if owners[sid-1] == nil || owners[sid-1].DeletedAt != 0 && v.DeletedAt == 0 {
+				owners[sid-1] = v
+			}
+		}
+	}
+	return &owners
+}
+
+func (dc *DeviceContext) listAllSnapshots() []SnapshotInfo {
+	owners := dc.snapshotOwners()
+	var si []SnapshotInfo
+	for i := 0; i < MAX_SNAPSHOTS; i++ {
+		if dc.snapshots[i].CreatedAt == 0 {
+			continue
+		}
+		si = append(si, dc.snapshotInfo(uint16(i+1), owners[i]))
+	}
+	return si
+}
+
+// Management API
+
+func InitDevice(device string, opts ...Option) error {
+	dc, err := NewDeviceContext(device, opts...)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	if err := dc.f.Lock(true); err != nil {
+		return err
+	}
+	if !dc.opts.Force {
+		initialized, err := dc.initialized()
+		if err != nil {
+			return err
+		}
+		if initialized {
+			return fmt.Errorf("%w: %v", ErrDeviceInitialized, device)
+		}
+	}
+	if err := dc.newIdentity(); err != nil {
+		return err
+	}
+	// Zero the extent metadata at once if the backend can, instead of writing zeroes in batches
+	length := (dc.totalDeviceExtents*SIZEOF_EXTENT_METADATA + BLOCK_SIZE - 1) / BLOCK_SIZE * BLOCK_SIZE
+	zeroed, err := dc.f.ZeroRange(uint64(dc.extentOffset), uint64(length))
+	if err != nil {
+		return err
+	}
+	if !zeroed {
+		eb := make([]ExtentMetadata, dc.extentBatch)
+		for offset := uint(0); offset < dc.totalDeviceExtents; offset += dc.extentBatch {
+			size := min(dc.totalDeviceExtents-offset, dc.extentBatch)
+			if err := dc.WriteExtents(eb[:size], offset); err != nil {
+				return err
+			}
+		}
+	}
+	// Write both copies of the metadata area, so either can be used
+	for i := 0; i < 2; i++ {
+		if err := dc.WriteMetadata(); err != nil {
+			return err
+		}
+	}
+	dc.opts.Logger.Info("initialized device", "device", device, "extents", dc.totalDeviceExtents, "zeroed", zeroed)
+	dc.notify(EVENT_DEVICE_INITIALIZED, "", 0)
+	return dc.Close()
+}
+
+// Create a volume and return its information.
+func CreateVolume(device string, volumeName string, volumeSize uint64, opts ...Option) (*VolumeInfo, error) {
+	if volumeSize/EXTENT_SIZE == 0 {
+		return nil, fmt.Errorf("volume with zero size")
+	}
+	dc, err := getMutableDeviceContext(device, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v, err := dc.AddVolume(volumeName, volumeSize)
+	if err != nil {
+		return nil, err
+	}
+	if dc.opts.Zeroed {
+		dc.snapshots[v.SnapshotId-1].Flags |= SNAPSHOT_FLAG_ZEROED
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	dc.notify(EVENT_VOLUME_CREATED, volumeName, 0)
+	vi := dc.volumeInfo(v)
+	return &vi, dc.Close()
+}
+
+func RenameVolume(device string, volumeName string, newVolumeName string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if err := dc.checkVolumeName(newVolumeName, v); err != nil {
+		return err
+	}
+	v.SetName(newVolumeName)
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	notify(dc.device, Event{Type: EVENT_VOLUME_RENAMED, VolumeName: newVolumeName, Detail: volumeName})
+	return dc.Close()
+}
+
+// Settings for a new snapshot. The zero value describes a snapshot taken now, by automation, without labels.
+type SnapshotOptions struct {
+	CreatedAt   time.Time // Recorded creation time, defaults to now
+	UserCreated bool      // Taken on user request
+	Labels      map[string]string
+	Name        string // Unique name, as set with SetSnapshotName (not supported by SnapshotGroup)
+	Description string // Why the snapshot was taken, as set with SetSnapshotDescription
+}
+
+// Snapshot a volume. The current snapshot is frozen and a new one, returned, becomes the current snapshot of
+// the volume. Options may be nil.
+func CreateSnapshot(device string, volumeName string, opts *SnapshotOptions) (uint, error) {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return 0, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	createdAt := opts.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	sid, err := dc.AddSnapshot(v.SnapshotId, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	if opts.UserCreated {
+		dc.snapshots[sid-1].Flags |= SNAPSHOT_FLAG_USER_CREATED
+	}
+	if err := dc.SetSnapshotLabels(sid, opts.Labels); err != nil {
+		return 0, err
+	}
+	if err := dc.setSnapshotName(sid, opts.Name); err != nil {
+		return 0, err
+	}
+	if err := dc.setSnapshotDescription(sid, opts.Description); err != nil {
+		return 0, err
+	}
+	v.SnapshotId = uint16(sid)
+	if err := dc.WriteMetadata(); err != nil {
+		return 0, err
+	}
+	dc.notify(EVENT_SNAPSHOT_CREATED, volumeName, sid)
+	return uint(sid), dc.Close()
+}
+
+// Create a volume from a snapshot and return its information. The volume gets a copy of every extent visible at
+// the snapshot, with the blocks partial extents inherit from ancestors copied in, so it does not depend on the
+// source volume.
+func CloneSnapshot(device string, newVolumeName string, snapshotId uint) (*VolumeInfo, error) {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	// Check before building the extent map, which may take a while
+	if err := dc.checkVolumeName(newVolumeName, nil); err != nil {
+		return nil, err
+	}
+	vsrc := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if vsrc == nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	vem, err := GetVolumeExtentMap(dc, vsrc.VolumeSize, uint16(snapshotId))
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.checkCloneSpace(uint(vem.extentBitmap.Count())); err != nil {
+		return nil, err
+	}
+	vdst, err := dc.AddVolume(newVolumeName, vsrc.VolumeSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	vem.allocationPolicy = dc.AllocationPolicy(vdst)
+	vem.tier = vdst.Tier
+	if err := vem.CopyAllToSnapshot(vdst.SnapshotId); err != nil {
+		return nil, err
+	}
+	if err := dc.WriteSuperblock(); err != nil {
+		return nil, err
+	}
+	dc.notify(EVENT_VOLUME_CLONED, newVolumeName, uint16(snapshotId))
+	vi := dc.volumeInfo(vdst)
+	return &vi, dc.Close()
+}
+
+// Fail with ErrNoSpace if the given number of extents cannot be allocated for a clone.
+func (dc *DeviceContext) checkCloneSpace(extents uint) error {
+	free := dc.totalDeviceExtents - min(uint(dc.superblock.AllocatedDeviceExtents), dc.totalDeviceExtents)
+	if extents > free {
+		return fmt.Errorf("%w: clone needs %v extents, %v free", ErrNoSpace, extents, free)
+	}
+	return nil
+}
+
+// Return the number of extents cloning a snapshot would allocate, which is every extent visible at the
+// snapshot, so that space can be checked before calling CloneSnapshot.
+func EstimateCloneSpace(device string, snapshotId uint) (uint, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+	v := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if v == nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, uint16(snapshotId))
+	if err != nil {
+		return 0, err
+	}
+	return uint(vem.extentBitmap.Count()), dc.Close()
+}
+
+// Create several volumes from a snapshot, as with CloneSnapshot, adding them in a single metadata update, as
+// used to provision volumes from a template. Either all volumes are added, or none is, if a name is taken,
+// there is no space for all of them, or copying fails, in which case those added are destroyed. Returns the
+// information of the volumes, in the order of the names.
+func CloneSnapshotMany(device string, snapshotId uint, newVolumeNames []string) (vi []VolumeInfo, err error) {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := dc.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for i, name := range newVolumeNames {
+		if err := dc.checkVolumeName(name, nil); err != nil {
+			return nil, err
+		}
+		for _, other := range newVolumeNames[:i] {
+			if other == name {
+				return nil, fmt.Errorf("volume %v given twice", name)
+			}
+		}
+	}
+	vsrc := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if vsrc == nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	vem, err := GetVolumeExtentMap(dc, vsrc.VolumeSize, uint16(snapshotId))
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.checkCloneSpace(uint(vem.extentBitmap.Count()) * uint(len(newVolumeNames))); err != nil {
+		return nil, err
+	}
+	vdsts := make([]*VolumeMetadata, len(newVolumeNames))
+	for i, name := range newVolumeNames {
+		if vdsts[i], err = dc.AddVolume(name, vsrc.VolumeSize); err != nil {
+			return nil, err
+		}
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	// Each copy leaves the map pointing to the clone, which holds the same data, so it is reused for the next
+	for _, vdst := range vdsts {
+		vem.allocationPolicy = dc.AllocationPolicy(vdst)
+		vem.tier = vdst.Tier
+		if err := vem.CopyAllToSnapshot(vdst.SnapshotId); err != nil {
+			return nil, dc.destroyClones(vdsts, err)
+		}
+		if err := dc.WriteSuperblock(); err != nil {
+			return nil, dc.destroyClones(vdsts, err)
+		}
+	}
+	vi = make([]VolumeInfo, len(vdsts))
+	for i, vdst := range vdsts {
+		dc.notify(EVENT_VOLUME_CLONED, newVolumeNames[i], uint16(snapshotId))
+		vi[i] = dc.volumeInfo(vdst)
+	}
+	return vi, nil
+}
+
+// Destroy the volumes added by a clone that failed, releasing the extents copied to them so far, and return the
+// error it failed with.
+func (dc *DeviceContext) destroyClones(vdsts []*VolumeMetadata, cause error) error {
+	for _, v := range vdsts {
+		name := v.Name()
+		if err := dc.DestroyVolume(v); err != nil {
+			return fmt.Errorf("%w (cannot destroy volume %v: %v)", cause, name, err)
+		}
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return fmt.Errorf("%w (cannot destroy volumes: %v)", cause, err)
+	}
+	return cause
+}
+
+// Snapshot a volume and clone it as a new volume, holding its data as of the snapshot, in a single metadata
+// update. The snapshot is only taken if the clone can be created, so it is not left behind when there is no
+// space for the clone. Options apply to the snapshot, and the new current snapshot of the volume is returned
+// as with CreateSnapshot, along with the information of the clone.
+func SnapshotAndClone(device string, volumeName string, newVolumeName string, opts *SnapshotOptions) (uint, *VolumeInfo, error) {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer dc.Close()
+	if err := dc.checkVolumeName(newVolumeName, nil); err != nil {
+		return 0, nil, err
+	}
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := dc.checkCloneSpace(uint(vem.extentBitmap.Count())); err != nil {
+		return 0, nil, err
+	}
+	createdAt := opts.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	sid, err := dc.AddSnapshot(v.SnapshotId, createdAt)
+	if err != nil {
+		return 0, nil, err
+	}
+	if opts.UserCreated {
+		dc.snapshots[sid-1].Flags |= SNAPSHOT_FLAG_USER_CREATED
+	}
+	if err := dc.SetSnapshotLabels(sid, opts.Labels); err != nil {
+		return 0, nil, err
+	}
+	if err := dc.setSnapshotName(sid, opts.Name); err != nil {
+		return 0, nil, err
+	}
+	if err := dc.setSnapshotDescription(sid, opts.Description); err != nil {
+		return 0, nil, err
+	}
+	snapshotId := v.SnapshotId
+	v.SnapshotId = uint16(sid)
+	vdst, err := dc.AddVolume(newVolumeName, v.VolumeSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return 0, nil, err
+	}
+	dc.notify(EVENT_SNAPSHOT_CREATED, volumeName, sid)
+	vem.allocationPolicy = dc.AllocationPolicy(vdst)
+	vem.tier = vdst.Tier
+	if err := vem.CopyAllToSnapshot(vdst.SnapshotId); err != nil {
+		return 0, nil, err
+	}
+	if err := dc.WriteSuperblock(); err != nil {
+		return 0, nil, err
+	}
+	dc.notify(EVENT_VOLUME_CLONED, newVolumeName, snapshotId)
+	vi := dc.volumeInfo(vdst)
+	return uint(sid), &vi, dc.Close()
+}
+
+func DeleteVolume(device string, volumeName string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if err := dc.checkRetention(v); err != nil {
+		return err
+	}
+	if dc.superblock.TrashRetention > 0 {
+		v.DeletedAt = time.Now().Unix()
+	} else if err := dc.DestroyVolume(v); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	dc.notify(EVENT_VOLUME_DELETED, volumeName, 0)
+	return dc.Close()
+}
+
+func DeleteSnapshot(device string, snapshotId uint) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	if v.SnapshotId == uint16(snapshotId) {
+		return fmt.Errorf("cannot delete current snapshot")
+	}
+	if _, err := dc.deleteSnapshot(v, uint16(snapshotId)); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	dc.notify(EVENT_SNAPSHOT_DELETED, v.Name(), uint16(snapshotId))
+	return dc.Close()
+}
+
+// Merge a snapshot that is not current into its child and release the extents the child replaced. Returns the
+// number of extents released. Metadata is not written to the device.
+func (dc *DeviceContext) deleteSnapshot(v *VolumeMetadata, snapshotId uint16) (uint, error) {
+	if err := dc.checkSnapshotRetention(snapshotId); err != nil {
+		return 0, err
+	}
+	sem, err := GetSnapshotExtentMap(dc, v.VolumeSize, snapshotId)
+	if err != nil {
+		return 0, err
+	}
+	childSnapshotId := dc.FindChildSnapshot(snapshotId)
+	if childSnapshotId == 0 {
+		return 0, fmt.Errorf("cannot delete top-level snapshot")
+	}
+	cem, err := GetSnapshotExtentMap(dc, v.VolumeSize, childSnapshotId)
+	if err != nil {
+		return 0, err
+	}
+	if err := sem.MergeAllInto(cem, childSnapshotId); err != nil {
+		return 0, err
+	}
+	released := uint(sem.extentBitmap.Count())
+	if err := sem.ClearAll(); err != nil {
+		return 0, err
+	}
+	dc.snapshots[childSnapshotId-1].ParentSnapshotId = dc.snapshots[snapshotId-1].ParentSnapshotId
+	dc.snapshots[snapshotId-1] = SnapshotMetadata{}
+	dc.removeSnapshotLabels(snapshotId)
+	return released, nil
+}
+
+// Selects snapshots of a volume for deletion. Snapshots must match all criteria set.
+type SnapshotSelector struct {
+	Before time.Time         // Created before this time, if not zero
+	Labels map[string]string // Having all these labels, with the same values
+	Oldest uint              // This snapshot and all older ones in the chain, if not zero
+}
+
+func (dc *DeviceContext) selectSnapshot(sid uint16, sel *SnapshotSelector, older bool) bool {
+	if !sel.Before.IsZero() && dc.snapshots[sid-1].CreatedAt >= sel.Before.Unix() {
+		return false
+	}
+	if sel.Oldest != 0 && !older {
+		return false
+	}
+	labels := dc.SnapshotLabels(sid)
+	for k, v := range sel.Labels {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete the snapshots of a volume matching the selector, in a single metadata update. The current snapshot is
+// never deleted. Returns the ids of the deleted snapshots, newest first, and the number of extents released,
+// which vacuuming frees. A nil selector, or one without criteria, matches all snapshots.
+func DeleteSnapshots(device string, volumeName string, sel *SnapshotSelector) ([]uint, uint, error) {
+	if sel == nil {
+		sel = &SnapshotSelector{}
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	var selected []uint16
+	older := false
+	for sid := dc.snapshots[v.SnapshotId-1].ParentSnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		older = older || uint(sid) == sel.Oldest
+		if dc.selectSnapshot(sid, sel, older) {
+			selected = append(selected, sid)
+		}
+	}
+	if sel.Oldest != 0 && !older {
+		return nil, 0, fmt.Errorf("%w: %v", ErrSnapshotNotFound, sel.Oldest)
+	}
+	if len(selected) > 0 {
+		if err := dc.checkRetention(v); err != nil {
+			return nil, 0, err
+		}
+	}
+	var deleted []uint
+	released := uint(0)
+	for _, sid := range selected {
+		n, err := dc.deleteSnapshot(v, sid)
+		if err != nil {
+			return nil, 0, err
+		}
+		deleted = append(deleted, uint(sid))
+		released += n
+	}
+	if len(deleted) == 0 {
+		return nil, 0, dc.Close()
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, 0, err
+	}
+	for _, sid := range deleted {
+		dc.notify(EVENT_SNAPSHOT_DELETED, volumeName, uint16(sid))
+	}
+	return deleted, released, dc.Close()
+}
+
+// Block API
+
+type VolumeContext struct {
+	dc          *DeviceContext
+	volume      *VolumeMetadata
+	vem         *ExtentMap
+	qos         volumeQoS
+	volumeName  string
+	snapshotId  uint16        // Current snapshot when the extent map was built
+	generation  uint64        // Metadata generation when the extent map was built
+	readOnly    bool          // Opened at a snapshot, which never changes
+	failed      atomic.Bool   // Made read-only after media errors
+	destroyed   atomic.Bool   // Volume destroyed by this process while open, so its stats are no longer reported
+	mediaErrors atomic.Uint64 // Of the volume, including those before it was opened
+	cache       *blockCache
+	extentCache *extentCache // On the cache device, if set
+	builder     *mapBuilder  // Builds the extent map of a lazily opened volume
+	stats       *volumeStats
+	staged      *stagedBlock // Block written in part, with write coalescing
+	sectorSize  uint64       // Logical sector size, emulated on blocks if smaller
+	relocation  sync.RWMutex // Held by reads, and by vacuuming while moving extents they may use
+}
+
+var emptyBlock [BLOCK_SIZE]byte
+
+// Return the logical sector size set in the options.
+func volumeSectorSize(opts []Option) (uint64, error) {
+	size := uint64(newOptions(opts).SectorSize)
+	if size == 0 {
+		return BLOCK_SIZE, nil
+	}
+	if size < MIN_SECTOR_SIZE || size > BLOCK_SIZE || size&(size-1) != 0 {
+		return 0, fmt.Errorf("unsupported sector size %v", size)
+	}
+	return size, nil
+}
+
+// Open a volume for I/O. The device is not locked while the volume is open, except for short periods when
+// metadata is updated.
+func OpenVolume(device string, volumeName string, opts ...Option) (*VolumeContext, error) {
+	sectorSize, err := volumeSectorSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := GetSharedDeviceContext(device, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFeatures(dc.superblock, true); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		dc.Close()
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	vem.allocationPolicy = dc.AllocationPolicy(v)
+	vem.tier = v.Tier
+	vc := &VolumeContext{
+		dc:         dc,
+		volume:     v,
+		vem:        vem,
+		qos:        newVolumeQoS(v),
+		volumeName: volumeName,
+		snapshotId: v.SnapshotId,
+		generation: dc.superblock.Generation,
+		cache:      newBlockCache(dc.opts.ReadCache),
+		stats:      newVolumeStats(),
+		sectorSize: sectorSize,
+	}
+	vs, _, _, _, err := dc.readVolumeStats(dc.volumeIndex(v))
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	vc.mediaErrors.Store(vs.MediaErrors)
+	vc.failed.Store(vs.FailedAt != 0)
+	if vc.extentCache, err = newExtentCache(dc); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	registerVolume(vc)
+	if err := dc.UnlockMetadata(); err != nil {
+		unregisterVolume(vc)
+		vc.extentCache.close()
+		dc.Close()
+		return nil, err
+	}
+	dc.opts.Logger.Info("opened volume", "volume", volumeName, "snapshot", v.SnapshotId, "sync", SyncPolicyName(dc.opts.SyncPolicy))
+	return vc, nil
+}
+
+// Open a snapshot for reading. Writes and unmaps fail with ErrReadOnly. The current snapshot of a volume can be
+// opened as well, but its data may change while open.
+func OpenSnapshot(device string, snapshotId uint, opts ...Option) (*VolumeContext, error) {
+	sectorSize, err := volumeSectorSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := GetSharedDeviceContext(device, opts...)
+	if err != nil {
+		return nil, err
+	}
+	v := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if v == nil {
+		dc.Close()
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, uint16(snapshotId))
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	vc := &VolumeContext{
+		dc:         dc,
+		volume:     v,
+		vem:        vem,
+		qos:        newVolumeQoS(v),
+		volumeName: v.Name(),
+		snapshotId: uint16(snapshotId),
+		generation: dc.superblock.Generation,
+		readOnly:   true,
+		cache:      newBlockCache(dc.opts.ReadCache),
+		sectorSize: sectorSize,
+	}
+	if vc.extentCache, err = newExtentCache(dc); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	registerVolume(vc)
+	if err := dc.UnlockMetadata(); err != nil {
+		unregisterVolume(vc)
+		vc.extentCache.close()
+		dc.Close()
+		return nil, err
+	}
+	dc.opts.Logger.Info("opened snapshot", "volume", vc.volumeName, "snapshot", snapshotId)
+	return vc, nil
+}
+
+// Open a volume for reading as of a time, by opening the snapshot found with FindSnapshotAt. If that is the
+// current snapshot of the volume, its data may still change while open, as with OpenSnapshot.
+func OpenVolumeAsOf(device string, volumeName string, t time.Time, opts ...Option) (*VolumeContext, error) {
+	si, err := FindSnapshotAt(device, volumeName, t)
+	if err != nil {
+		return nil, err
+	}
+	return OpenSnapshot(device, si.SnapshotId, opts...)
+}
+
+// Rebuild the extent map of a snapshot opened read-only, which may have been merged or moved since.
+func (vc *VolumeContext) reloadSnapshot() error {
+	v := vc.dc.FindVolumeWithSnapshot(vc.snapshotId)
+	if v == nil {
+		return fmt.Errorf("snapshot %v no longer exists", vc.snapshotId)
+	}
+	vem, err := GetVolumeExtentMap(vc.dc, v.VolumeSize, vc.snapshotId)
+	if err != nil {
+		return err
+	}
+	vc.volume = v
+	vc.vem = vem
+	vc.volumeName = v.Name()
+	vc.generation = vc.dc.superblock.Generation
+	return nil
+}
+
+// Reload metadata and rebuild the extent map if others changed the device since they were loaded.
+// Must be called with the metadata lock held.
+func (vc *VolumeContext) reload() error {
+	if vc.dc.superblock.Generation == vc.generation {
+		return nil
+	}
+	if err := vc.dc.ReadMetadata(); err != nil {
+		return err
+	}
+	vc.dc.opts.Logger.Info("reloading metadata", "volume", vc.volumeName, "generation", vc.dc.superblock.Generation)
+	vc.cache.clear()
+	vc.extentCache.clear()
+	if vc.readOnly {
+		return vc.reloadSnapshot()
+	}
+	// The volume slot must still hold the same volume (it may have been renamed or snapshotted)
+	v := vc.volume
+	if v.SnapshotId == 0 || v.DeletedAt != 0 {
+		return fmt.Errorf("volume %v no longer exists", vc.volumeName)
+	}
+	if v.Name() != vc.volumeName {
+		found := false
+		for sid := v.SnapshotId; sid > 0 && !found; sid = vc.dc.snapshots[sid-1].ParentSnapshotId {
+			found = sid == vc.snapshotId
+		}
+		if !found {
+			return fmt.Errorf("volume %v no longer exists", vc.volumeName)
+		}
+		vc.volumeName = v.Name()
+	}
+	vem, err := GetVolumeExtentMap(vc.dc, v.VolumeSize, v.SnapshotId)
+	if err != nil {
+		return err
+	}
+	vem.allocationPolicy = vc.dc.AllocationPolicy(v)
+	vem.tier = v.Tier
+	if uint64(v.MaxIops) != vc.qos.iops.limit() || v.MaxBandwidth != vc.qos.bandwidth.limit() {
+		vc.qos = newVolumeQoS(v)
+	}
+	vc.vem = vem
+	vc.snapshotId = v.SnapshotId
+	vc.generation = vc.dc.superblock.Generation
+	return nil
+}
+
+// Pick up metadata changes made by others while the volume is open, like a new snapshot of the volume.
+// Writes and unmaps do this automatically, so new data never ends up in a snapshot taken meanwhile.
+func (vc *VolumeContext) Refresh() error {
+	// Metadata cannot change while the map of a lazily opened volume is built under the shared lock
+	if vc.builder != nil && !vc.builder.isReady() {
+		return nil
+	}
+	if err := vc.waitMap(); err != nil {
+		return err
+	}
+	if err := vc.dc.LockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	if err := vc.reload(); err != nil {
+		return err
+	}
+	return vc.flushStaged(context.Background())
+}
+
+// Lock metadata for an update and reload them if needed.
+func (vc *VolumeContext) lockMetadata() error {
+	if err := vc.waitMap(); err != nil {
+		return err
+	}
+	if err := vc.dc.LockMetadata(); err != nil {
+		return err
+	}
+	if err := vc.reload(); err != nil {
+		vc.dc.UnlockMetadata()
+		return err
+	}
+	return nil
+}
+
+// Close the volume, writing any staged block and the stats. If the staged block cannot be written, or metadata
+// updates not flushed as per the sync policy cannot be, the volume stays open and ErrShutdownPending is
+// returned, so that closing can be retried.
+func (vc *VolumeContext) CloseVolume() error {
+	if err := vc.syncStaged(); err != nil {
+		return fmt.Errorf("%w: cannot write staged block of %v: %v", ErrShutdownPending, vc.volumeName, err)
+	}
+	if err := vc.syncStats(); err != nil {
+		vc.dc.opts.Logger.Warn("cannot write volume stats", "volume", vc.volumeName, "error", err)
+	}
+	if vc.dc.unflushed {
+		if err := vc.dc.f.Sync(); err != nil {
+			return fmt.Errorf("%w: cannot sync metadata updates of %v: %v", ErrShutdownPending, vc.volumeName, err)
+		}
+		vc.dc.unflushed = false
+	}
+	if vc.builder != nil {
+		vc.builder.closing.Store(true)
+		vc.builder.wait()
+	}
+	var err error
+	unregisterVolume(vc)
+	vc.dc.opts.Logger.Info("closed volume", "volume", vc.volumeName)
+	if cerr := vc.extentCache.close(); err == nil {
+		err = cerr
+	}
+	if cerr := vc.dc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Make writes durable, and write the volume stats. Writes are only cached with buffered I/O, as direct I/O
+// writes go straight to the device, and with write coalescing, for blocks written in part.
+func (vc *VolumeContext) Sync() (err error) {
+	defer func() { vc.countMediaError(err) }()
+	if err := vc.syncStaged(); err != nil {
+		return err
+	}
+	if err := vc.syncStats(); err != nil {
+		return err
+	}
+	return vc.dc.flush()
+}
+
+// Return the name of the volume, or of the volume the snapshot belongs to.
+func (vc *VolumeContext) VolumeName() string {
+	return vc.volumeName
+}
+
+// Return the size of the volume in bytes.
+func (vc *VolumeContext) VolumeSize() uint64 {
+	return vc.volume.VolumeSize
+}
+
+// Return the snapshot the volume context reads from.
+func (vc *VolumeContext) SnapshotId() uint {
+	return uint(vc.snapshotId)
+}
+
+// Return true if the volume context was opened at a snapshot.
+func (vc *VolumeContext) ReadOnly() bool {
+	return vc.readOnly || vc.failed.Load()
+}
+
+// Return the logical sector size, which is BLOCK_SIZE unless set with WithSectorSize.
+func (vc *VolumeContext) SectorSize() uint {
+	return uint(vc.sectorSize)
+}
+
+func (vc *VolumeContext) checkSector(data []byte) error {
+	if uint64(len(data)) < vc.sectorSize {
+		return fmt.Errorf("sector buffer of %v bytes, need %v", len(data), vc.sectorSize)
+	}
+	return nil
+}
+
+// Read a logical sector. Sectors smaller than a block are read from the block holding them.
+func (vc *VolumeContext) ReadSector(data []byte, sector uint64) error {
+	if err := vc.checkSector(data); err != nil {
+		return err
+	}
+	return vc.ReadAt(data[:vc.sectorSize], sector*vc.sectorSize)
+}
+
+// Write a logical sector. Sectors smaller than a block are written with read-modify-write of the block.
+func (vc *VolumeContext) WriteSector(data []byte, sector uint64, updateMetadata bool) error {
+	if err := vc.checkSector(data); err != nil {
+		return err
+	}
+	return vc.WriteAt(data[:vc.sectorSize], sector*vc.sectorSize, updateMetadata)
+}
+
+// Unmap a logical sector. Sectors smaller than a block are zeroed, and the block is unmapped once all of them
+// are.
+func (vc *VolumeContext) UnmapSector(sector uint64) error {
+	return vc.UnmapAt(vc.sectorSize, sector*vc.sectorSize)
+}
+
+func (vc *VolumeContext) ReadBlock(data []byte, block uint64) error {
+	vc.qos.throttle(BLOCK_SIZE)
+	vc.stats.read(BLOCK_SIZE)
+	err := vc.readBlock(data, block)
+	vc.countMediaError(err)
+	return err
+}
+
+// Return the extent holding the data of a block and the index of the block in it, or false if the block is
+// not allocated.
+func (vc *VolumeContext) locateBlock(block uint64) (ExtentMetadata, uint, bool, error) {
+	eidx := uint(block >> BLOCK_BITS_IN_EXTENT)
+	if eidx >= vc.vem.totalVolumeExtents {
+		return ExtentMetadata{}, 0, false, fmt.Errorf("block offset out of bounds")
+	}
+	e, err := vc.lookupExtent(uint32(eidx))
+	if err != nil {
+		return ExtentMetadata{}, 0, false, err
+	}
+	bidx := uint(block & BLOCK_MASK_IN_EXTENT)
+	bb := bitmap.FromBytes(e.BlockBitmap[:])
+	// Block inherited from a previous snapshot
+	if e.Flags&EXTENT_FLAG_PARTIAL != 0 && !bb.Contains(uint32(bidx)) {
+		if err := vc.waitMap(); err != nil {
+			return ExtentMetadata{}, 0, false, err
+		}
+		if ie, ok := vc.vem.inheritedBlock(uint32(eidx), uint32(bidx)); ok {
+			e = ie
+			bb = bitmap.FromBytes(e.BlockBitmap[:])
+		}
+	}
+	// Unallocated extent or block
+	if e.SnapshotId == 0 || !bb.Contains(uint32(bidx)) {
+		return ExtentMetadata{}, 0, false, nil
+	}
+	return e, bidx, true, nil
+}
+
+// Return the offset on the device of the data at an offset of the volume, or false if it is not allocated.
+// Like reads, it may run concurrently with other reads, but not with writes. The data may be moved elsewhere
+// by vacuuming once it returns.
+func (vc *VolumeContext) DeviceOffset(offset uint64) (uint64, bool, error) {
+	vc.relocation.RLock()
+	defer vc.relocation.RUnlock()
+	e, bidx, ok, err := vc.locateBlock(offset / BLOCK_SIZE)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return vc.dc.blockOffset(uint(e.ExtentPos), bidx) + offset%BLOCK_SIZE, true, nil
+}
+
+func (vc *VolumeContext) readBlock(data []byte, block uint64) error {
+	vc.relocation.RLock()
+	defer vc.relocation.RUnlock()
+	e, bidx, ok, err := vc.locateBlock(block)
+	if err != nil {
+		return err
+	}
+	return vc.readLocatedBlock(data, block, e, bidx, ok)
+}
+
+// Read a block found with locateBlock. Must be called with the relocation lock held.
+func (vc *VolumeContext) readLocatedBlock(data []byte, block uint64, e ExtentMetadata, bidx uint, ok bool) error {
+	if !ok {
+		copy(data, emptyBlock[:])
+		vc.overlayStaged(data, block)
+		return nil
+	}
+	if !vc.cache.get(data, block) {
+		if !vc.extentCache.get(data, block) {
+			// Read data from device
+			if err := vc.dc.ReadBlockData(data, uint(e.ExtentPos), bidx); err != nil {
+				return err
+			}
+			vc.extentCache.put(data, block)
+		}
+		vc.cache.put(data, block)
+	}
+	vc.overlayStaged(data, block)
+	return nil
+}
+
+func (vc *VolumeContext) ReadAt(data []byte, offset uint64) error {
+	return vc.ReadAtContext(context.Background(), data, offset)
+}
+
+// Read as with ReadAt, traced as part of the span in the context.
+func (vc *VolumeContext) ReadAtContext(ctx context.Context, data []byte, offset uint64) error {
+	_, op := vc.startOp(ctx, OP_READ, offset, uint64(len(data)))
+	err := vc.readAt(data, offset)
+	vc.countMediaError(err)
+	op.end(err)
+	return err
+}
+
+func (vc *VolumeContext) readAt(data []byte, offset uint64) error {
+	vc.qos.throttle(uint64(len(data)))
+	vc.stats.read(uint64(len(data)))
+	doffset := uint64(0)
+	for remaining := uint64(len(data)); remaining > 0; remaining = uint64(len(data)) - doffset {
+		block := (offset + doffset) / BLOCK_SIZE
+		boffset := (offset + doffset) % BLOCK_SIZE
+		if boffset == 0 && remaining >= BLOCK_SIZE {
+			count, err := vc.readBlocks(data[doffset:doffset+remaining/BLOCK_SIZE*BLOCK_SIZE], block)
+			if err != nil {
+				return err
+			}
+			doffset += count * BLOCK_SIZE
+		} else {
+			buf := make([]byte, BLOCK_SIZE)
+			if err := vc.readBlock(buf, block); err != nil {
+				return err
+			}
+			dlength := BLOCK_SIZE - boffset
+			if remaining < dlength {
+				copy(data[doffset:doffset+remaining], buf[boffset:boffset+remaining])
+				doffset += remaining
+			} else {
+				copy(data[doffset:doffset+dlength], buf[boffset:boffset+dlength])
+				doffset += dlength
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	ErrMetadataNeedsUpdate = errors.New("metadata needs update")
+	ErrReadOnly            = errors.New("volume is read-only")
+	ErrVolumeNotFound      = errors.New("volume not found")
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrNoSpace             = errors.New("no space left on device")
+	ErrCorrupted           = errors.New("metadata corrupted")
+	ErrDeviceInitialized   = errors.New("device already initialized")
+	ErrWrongDevice         = errors.New("device identity mismatch")
+)
+
+func (vc *VolumeContext) WriteBlock(data []byte, block uint64, updateMetadata bool) (err error) {
+	defer func() { vc.countMediaError(err) }()
+	if err := vc.checkWritable(); err != nil {
+		return err
+	}
+	vc.qos.throttle(BLOCK_SIZE)
+	if err := vc.lockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	vc.discardStaged(block)
+	if err := vc.writeBlock(context.Background(), data, block, updateMetadata); err != nil {
+		return err
+	}
+	vc.stats.write(BLOCK_SIZE)
+	return vc.maybeFlushStats()
+}
+
+// Write pending counters if they are due. Must be called with the metadata lock held.
+func (vc *VolumeContext) maybeFlushStats() error {
+	if !vc.stats.due(false) {
+		return nil
+	}
+	return vc.flushStats()
+}
+
+func (vc *VolumeContext) writeBlock(ctx context.Context, data []byte, block uint64, updateMetadata bool) error {
+	eidx := uint(block >> BLOCK_BITS_IN_EXTENT)
+	if eidx >= vc.vem.totalVolumeExtents {
+		return fmt.Errorf("block offset out of bounds")
+	}
+	if err := vc.checkRetainedBlock(block); err != nil {
+		return err
+	}
+	e := vc.vem.extent(uint32(eidx))
+	bidx := uint(block & BLOCK_MASK_IN_EXTENT)
+	bb := bitmap.FromBytes(e.BlockBitmap[:])
+	if (e.SnapshotId != vc.volume.SnapshotId || !bb.Contains(uint32(bidx))) && !updateMetadata {
+		return ErrMetadataNeedsUpdate
+	}
+	// Unallocated or previous snapshot extent
+	if e.SnapshotId != vc.volume.SnapshotId {
+		if vc.dc.inMaintenance() {
+			return ErrMaintenance
+		}
+		// Allocate new extent
+		if e.SnapshotId == 0 {
+			if err := vc.vem.NewExtentToSnapshot(uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+		} else if vc.dc.opts.BlockCoW {
+			if err := vc.vem.NewPartialExtentToSnapshot(uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+		} else {
+			if err := vc.vem.copyExtentToSnapshot(ctx, uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+			vc.stats.copied()
+		}
+		// Update allocation count
+		if err := vc.dc.writeSuperblock(ctx); err != nil {
+			return err
+		}
+	}
+	// Write data to device
+	if err := vc.dc.WriteBlockData(data, uint(e.ExtentPos), bidx); err != nil {
+		vc.cache.remove(block)
+		vc.extentCache.remove(block)
+		return err
+	}
+	vc.cache.put(data, block)
+	vc.extentCache.update(data, block)
+	if vc.dc.extentTimeOffset != 0 {
+		vc.stats.modify(uint32(eidx))
+	}
+	// Update metadata
+	if bb.Contains(uint32(bidx)) {
+		return nil
+	}
+	bb.Set(uint32(bidx))
+	if err := vc.vem.WriteExtent(uint32(eidx)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (vc *VolumeContext) WriteAt(data []byte, offset uint64, updateMetadata bool) error {
+	return vc.WriteAtContext(context.Background(), data, offset, updateMetadata)
+}
+
+// Write as with WriteAt, traced as part of the span in the context.
+func (vc *VolumeContext) WriteAtContext(ctx context.Context, data []byte, offset uint64, updateMetadata bool) error {
+	ctx, op := vc.startOp(ctx, OP_WRITE, offset, uint64(len(data)))
+	err := vc.writeAt(ctx, data, offset, updateMetadata)
+	vc.countMediaError(err)
+	op.end(err)
+	return err
+}
+
+func (vc *VolumeContext) writeAt(ctx context.Context, data []byte, offset uint64, updateMetadata bool) error {
+	if err := vc.checkWritable(); err != nil {
+		return err
+	}
+	vc.qos.throttle(uint64(len(data)))
+	if err := vc.lockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	doffset := uint64(0)
+	for remaining := uint64(len(data)); remaining > 0; remaining = uint64(len(data)) - doffset {
+		block := (offset + doffset) / BLOCK_SIZE
+		boffset := (offset + doffset) % BLOCK_SIZE
+		if boffset == 0 && remaining >= BLOCK_SIZE {
+			count, err := vc.writeBlocks(ctx, data[doffset:doffset+remaining/BLOCK_SIZE*BLOCK_SIZE], block, updateMetadata)
+			if err != nil {
+				return err
+			}
+			doffset += count * BLOCK_SIZE
+		} else if vc.dc.opts.Coalesce && updateMetadata {
+			dlength := min(BLOCK_SIZE-boffset, remaining)
+			if err := vc.stageWrite(ctx, block, boffset, data[doffset:doffset+dlength]); err != nil {
+				return err
+			}
+			doffset += dlength
+		} else {
+			buf := make([]byte, BLOCK_SIZE)
+			if err := vc.readBlock(buf, block); err != nil {
+				return err
+			}
+			dlength := BLOCK_SIZE - boffset
+			if remaining < dlength {
+				copy(buf[boffset:boffset+remaining], data[doffset:doffset+remaining])
+				doffset += remaining
+			} else {
+				copy(buf[boffset:boffset+dlength], data[doffset:doffset+dlength])
+				doffset += dlength
+			}
+			if err := vc.writeBlock(ctx, buf, block, updateMetadata); err != nil {
+				return err
+			}
+			// Staged writes were read along with the block
+			vc.discardStaged(block)
+		}
+	}
+	vc.stats.write(uint64(len(data)))
+	return vc.maybeFlushStats()
+}
+
+func (vc *VolumeContext) UnmapBlock(block uint64) (err error) {
+	defer func() { vc.countMediaError(err) }()
+	if err := vc.checkWritable(); err != nil {
+		return err
+	}
+	vc.qos.throttle(0)
+	if err := vc.lockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	if vc.dc.inMaintenance() {
+		return ErrMaintenance
+	}
+	if err := vc.flushStaged(context.Background()); err != nil {
+		return err
+	}
+	return vc.unmapBlock(context.Background(), block)
+}
+
+func (vc *VolumeContext) unmapBlock(ctx context.Context, block uint64) error {
+	eidx := uint(block >> BLOCK_BITS_IN_EXTENT)
+	if eidx >= vc.vem.totalVolumeExtents {
+		return fmt.Errorf("block offset out of bounds")
+	}
+	// Unallocated extent
+	if vc.vem.get(uint32(eidx)).SnapshotId == 0 {
+		return nil
+	}
+	if err := vc.checkRetainedBlock(block); err != nil {
+		return err
+	}
+	e := vc.vem.extent(uint32(eidx))
+	bidx := uint(block & BLOCK_MASK_IN_EXTENT)
+	bb := bitmap.FromBytes(e.BlockBitmap[:])
+	partial := e.Flags&EXTENT_FLAG_PARTIAL != 0
+	// Unallocated block
+	if !bb.Contains(uint32(bidx)) {
+		if !partial {
+			return nil
+		}
+		if _, ok := vc.vem.inheritedBlock(uint32(eidx), uint32(bidx)); !ok {
+			return nil
+		}
+	}
+	vc.cache.remove(block)
+	vc.extentCache.remove(block)
+	// Previous snapshot extent, which must not change
+	if e.SnapshotId != vc.volume.SnapshotId {
+		// Data is only copied if other blocks remain
+		if bb.Count() == 1 && !partial {
+			if err := vc.vem.NewExtentToSnapshot(uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+		} else {
+			if err := vc.vem.copyExtentToSnapshot(ctx, uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+			vc.stats.copied()
+		}
+		if err := vc.dc.writeSuperblock(ctx); err != nil {
+			return err
+		}
+	} else if partial {
+		// Inherited blocks cannot be hidden, so the extent is made whole
+		if err := vc.vem.materialize(uint32(eidx)); err != nil {
+			return err
+		}
+	}
+	// Update metadata
+	bb.Remove(uint32(bidx))
+	if bb.Count() == 0 && vc.dc.snapshots[vc.volume.SnapshotId-1].ParentSnapshotId == 0 {
+		// Release if not used, unless it hides an extent of a previous snapshot
+		e.SnapshotId = 0
+		vc.vem.extentBitmap.Remove(uint32(eidx))
+	}
+	if err := vc.vem.WriteExtent(uint32(eidx)); err != nil {
+		return err
+	}
+	if e.SnapshotId == 0 {
+		vc.dc.ReleaseExtent(e.ExtentPos)
+		vc.vem.remove(uint32(eidx))
+	} else if vc.dc.extentTimeOffset != 0 {
+		vc.stats.modify(uint32(eidx))
+	}
+	return nil
+}
+
+func (vc *VolumeContext) UnmapAt(length uint64, offset uint64) error {
+	return vc.UnmapAtContext(context.Background(), length, offset)
+}
+
+// Unmap as with UnmapAt, traced as part of the span in the context.
+func (vc *VolumeContext) UnmapAtContext(ctx context.Context, length uint64, offset uint64) error {
+	ctx, op := vc.startOp(ctx, OP_UNMAP, offset, length)
+	err := vc.unmapAt(ctx, length, offset)
+	vc.countMediaError(err)
+	op.end(err)
+	return err
+}
+
+func (vc *VolumeContext) unmapAt(ctx context.Context, length uint64, offset uint64) error {
+	if err := vc.checkWritable(); err != nil {
+		return err
+	}
+	vc.qos.throttle(0)
+	if err := vc.lockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	if vc.dc.inMaintenance() {
+		return ErrMaintenance
+	}
+	if err := vc.flushStaged(ctx); err != nil {
+		return err
+	}
+	doffset := uint64(0)
+	for remaining := length; remaining > 0; remaining = length - doffset {
+		block := (offset + doffset) / BLOCK_SIZE
+		boffset := (offset + doffset) % BLOCK_SIZE
+		eidx := block >> BLOCK_BITS_IN_EXTENT
+		if (offset+doffset)%EXTENT_SIZE == 0 && remaining >= EXTENT_SIZE && eidx < uint64(vc.vem.totalVolumeExtents) && vc.vem.get(uint32(eidx)).SnapshotId == 0 {
+			// Skip unallocated extents
+			doffset += EXTENT_SIZE
+		} else if boffset == 0 && remaining >= BLOCK_SIZE {
+			if err := vc.unmapBlock(ctx, block); err != nil {
+				return err
+			}
+			doffset += BLOCK_SIZE
+		} else {
+			dlength := min(BLOCK_SIZE-boffset, remaining)
+			if vc.sectorSize < BLOCK_SIZE {
+				if err := vc.unmapSectors(ctx, block, boffset, dlength); err != nil {
+					return err
+				}
+			}
+			doffset += dlength
+		}
+	}
+	return nil
+}
+
+// Zero the sectors fully within a range of a block, unmapping the block if no data is left in it.
+func (vc *VolumeContext) unmapSectors(ctx context.Context, block uint64, boffset uint64, length uint64) error {
+	start := (boffset + vc.sectorSize - 1) / vc.sectorSize * vc.sectorSize
+	end := (boffset + length) / vc.sectorSize * vc.sectorSize
+	if start >= end {
+		return nil
+	}
+	buf := make([]byte, BLOCK_SIZE)
+	if err := vc.readBlock(buf, block); err != nil {
+		return err
+	}
+	clear(buf[start:end])
+	if bytes.Equal(buf, emptyBlock[:]) {
+		return vc.unmapBlock(ctx, block)
+	}
+	return vc.writeBlock(ctx, buf, block, true)
+}
+
+// Allocate the extents covering a range in the current snapshot ahead of writes, copying those of previous
+// snapshots, so that writes to the range need no allocation or copy. With zero set, blocks of the range not
+// written yet are also written with zeroes, so that writes to them need no metadata update either.
+func (vc *VolumeContext) Preallocate(offset uint64, length uint64, zero bool) (err error) {
+	defer func() { vc.countMediaError(err) }()
+	if err := vc.checkWritable(); err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+	if offset+length > vc.volume.VolumeSize {
+		return fmt.Errorf("range out of bounds")
+	}
+	// Zeroes would take up blocks of a write once volume
+	if zero && vc.dc.retained(vc.volume) {
+		return fmt.Errorf("%w: cannot zero blocks of volume %v", ErrRetained, vc.volumeName)
+	}
+	if err := vc.lockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	if vc.dc.inMaintenance() {
+		return ErrMaintenance
+	}
+	firstBlock := offset / BLOCK_SIZE
+	lastBlock := (offset + length - 1) / BLOCK_SIZE
+	allocated := false
+	for eidx := firstBlock >> BLOCK_BITS_IN_EXTENT; eidx <= lastBlock>>BLOCK_BITS_IN_EXTENT; eidx++ {
+		e := vc.vem.get(uint32(eidx))
+		if e.SnapshotId == 0 {
+			if err := vc.vem.NewExtentToSnapshot(uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+			allocated = true
+		} else if e.SnapshotId != vc.volume.SnapshotId {
+			if err := vc.vem.CopyExtentToSnapshot(uint32(eidx), vc.volume.SnapshotId); err != nil {
+				return err
+			}
+			vc.stats.copied()
+			allocated = true
+		}
+		if zero {
+			start := max(firstBlock, eidx<<BLOCK_BITS_IN_EXTENT) & BLOCK_MASK_IN_EXTENT
+			end := min(lastBlock, (eidx<<BLOCK_BITS_IN_EXTENT)|BLOCK_MASK_IN_EXTENT) & BLOCK_MASK_IN_EXTENT
+			if err := vc.zeroBlocks(uint32(eidx), uint32(start), uint32(end)); err != nil {
+				return err
+			}
+		}
+	}
+	if allocated {
+		// Update allocation count
+		return vc.dc.WriteSuperblock()
+	}
+	return nil
+}
+
+// Write zeroes to the blocks of an extent of the current snapshot in a range, inclusive, that hold no data.
+func (vc *VolumeContext) zeroBlocks(eidx uint32, start uint32, end uint32) error {
+	e := vc.vem.extent(eidx)
+	bb := bitmap.FromBytes(e.BlockBitmap[:])
+	updated := false
+	for bidx := start; bidx <= end; bidx++ {
+		if bb.Contains(bidx) {
+			continue
+		}
+		// Blocks inherited by partial extents hold data
+		if _, ok := vc.vem.inheritedBlock(eidx, bidx); ok {
+			continue
+		}
+		if err := vc.dc.WriteBlockData(emptyBlock[:], uint(e.ExtentPos), uint(bidx)); err != nil {
+			return err
+		}
+		bb.Set(bidx)
+		updated = true
+	}
+	if !updated {
+		return nil
+	}
+	return vc.vem.WriteExtent(eidx)
+}
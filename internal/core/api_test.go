@@ -0,0 +1,4604 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chazapis/go-nbd/pkg/server"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slices"
+	. "gopkg.in/check.v1"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+const (
+	MEGABYTE = 1024 * 1024
+	GIGABYTE = MEGABYTE * 1024
+
+	DEVICE      = "test.img"
+	DEVICE_SIZE = MEGABYTE * 100
+)
+
+func Test(t *testing.T) {
+	if err := os.Truncate(DEVICE, DEVICE_SIZE); err != nil {
+		f, err := os.Create(DEVICE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Truncate(DEVICE_SIZE)
+		f.Close()
+	}
+	InitDevice(DEVICE, WithForce())
+	TestingT(t)
+}
+
+type TestSuite struct{}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestDevice(c *C) {
+	err := InitDevice(DEVICE)
+	c.Assert(errors.Is(err, ErrDeviceInitialized), Equals, true)
+	err = InitDevice(DEVICE, WithForce())
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, uint(0))
+	c.Assert(deviceInfo.VolumeCount, Equals, uint(0))
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 0)
+}
+
+func assertVolume(c *C, vi *VolumeInfo, volumeName string, volumeSize uint64, snapshotCount uint16) {
+	c.Assert(vi.VolumeName, Equals, volumeName)
+	c.Assert(vi.VolumeSize, Equals, volumeSize)
+	if time.Now().Add(-5 * time.Minute).After(vi.CreatedAt) {
+		c.FailNow()
+	}
+	c.Assert(vi.VolumeName, Equals, volumeName)
+}
+
+func (s *TestSuite) TestVolume(c *C) {
+	// Create a volume
+	createdVolumeInfo, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	c.Assert(*createdVolumeInfo, DeepEquals, volumeInfo[0])
+
+	// Create multiple volumes
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, NotNil)
+	_, err = CreateVolume(DEVICE, "vol2", 2*GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol3", 3*GIGABYTE)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 3)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol2", 2*GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[2], "vol3", 3*GIGABYTE, 1)
+
+	// Delete a volume
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol3", 3*GIGABYTE, 1)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	// Create volume again (goes in empty spot)
+	_, err = CreateVolume(DEVICE, "vol2new", 2*GIGABYTE)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 3)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol2new", 2*GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[2], "vol3", 3*GIGABYTE, 1)
+
+	// Rename volume
+	err = RenameVolume(DEVICE, "vol2new", "vol2renamed")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 3)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol2renamed", 2*GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[2], "vol3", 3*GIGABYTE, 1)
+
+	// Names must be valid and unique
+	err = RenameVolume(DEVICE, "vol2renamed", "vol3")
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+	err = RenameVolume(DEVICE, "vol2renamed", "vol2renamed")
+	c.Assert(err, IsNil)
+	for _, name := range []string{"", "-vol", "vol/2", "vol@2", strings.Repeat("v", MAX_VOLUME_NAME_SIZE+1)} {
+		_, err = CreateVolume(DEVICE, name, GIGABYTE)
+		c.Assert(errors.Is(err, ErrInvalidVolumeName), Equals, true)
+		err = RenameVolume(DEVICE, "vol3", name)
+		c.Assert(errors.Is(err, ErrInvalidVolumeName), Equals, true)
+	}
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	_, err = CloneSnapshot(DEVICE, "vol3", snapshotInfo[0].SnapshotId)
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 3)
+
+	// Delete multiple volumes
+	err = DeleteVolume(DEVICE, "vol2renamed")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol3")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 0)
+}
+
+func (s *TestSuite) TestSnapshot(c *C) {
+	// Create a volume
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	volumeSnapshotIdx := slices.IndexFunc(volumeInfo, func(vi VolumeInfo) bool { return vi.VolumeName == "vol1" })
+	volumeSnapshotId := volumeInfo[volumeSnapshotIdx].SnapshotId
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+	if snapshotInfo[0].SnapshotId == 0 {
+		c.FailNow()
+	}
+	c.Assert(snapshotInfo[0].ParentSnapshotId, Equals, uint(0))
+	initialSnapshotId := snapshotInfo[0].SnapshotId
+	c.Assert(volumeSnapshotId, Equals, initialSnapshotId)
+
+	// Create a snapshot
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	volumeSnapshotIdx = slices.IndexFunc(volumeInfo, func(vi VolumeInfo) bool { return vi.VolumeName == "vol1" })
+	volumeSnapshotId = volumeInfo[volumeSnapshotIdx].SnapshotId
+	if volumeSnapshotId == initialSnapshotId {
+		c.FailNow()
+	}
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 2)
+	initialSnapshotIdx := slices.IndexFunc(snapshotInfo, func(si SnapshotInfo) bool { return si.ParentSnapshotId == 0 })
+	if initialSnapshotIdx == -1 {
+		c.FailNow()
+	}
+	initialSnapshot := snapshotInfo[initialSnapshotIdx]
+	c.Assert(initialSnapshot.SnapshotId, Equals, initialSnapshotId)
+	currentSnapshotIdx := slices.IndexFunc(snapshotInfo, func(si SnapshotInfo) bool { return si.ParentSnapshotId != 0 })
+	if currentSnapshotIdx == -1 {
+		c.FailNow()
+	}
+	currentSnapshot := snapshotInfo[currentSnapshotIdx]
+	c.Assert(currentSnapshot.SnapshotId, Equals, volumeSnapshotId)
+	c.Assert(currentSnapshot.ParentSnapshotId, Equals, initialSnapshotId)
+
+	// Create multiple snapshots
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	volumeSnapshotIdx = slices.IndexFunc(volumeInfo, func(vi VolumeInfo) bool { return vi.VolumeName == "vol1" })
+	volumeSnapshotId = volumeInfo[volumeSnapshotIdx].SnapshotId
+	if volumeSnapshotId == initialSnapshotId {
+		c.FailNow()
+	}
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 5)
+	initialSnapshotIdx = slices.IndexFunc(snapshotInfo, func(si SnapshotInfo) bool { return si.ParentSnapshotId == 0 })
+	if initialSnapshotIdx == -1 {
+		c.FailNow()
+	}
+	initialSnapshot = snapshotInfo[initialSnapshotIdx]
+	c.Assert(initialSnapshot.SnapshotId, Equals, initialSnapshotId)
+	currentSnapshotIdx = slices.IndexFunc(snapshotInfo, func(si SnapshotInfo) bool { return si.ParentSnapshotId != volumeSnapshotId })
+	if currentSnapshotIdx == -1 {
+		c.FailNow()
+	}
+	currentSnapshot = snapshotInfo[currentSnapshotIdx]
+	c.Assert(currentSnapshot.SnapshotId, Equals, volumeSnapshotId)
+	if currentSnapshot.ParentSnapshotId == initialSnapshotId {
+		c.FailNow()
+	}
+
+	// Delete a snapshot
+	err = DeleteSnapshot(DEVICE, currentSnapshot.SnapshotId)
+	c.Assert(err, NotNil)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 5)
+	err = DeleteSnapshot(DEVICE, initialSnapshot.SnapshotId)
+	c.Assert(err, IsNil)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 4)
+
+	// Create snapshot again
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	volumeSnapshotIdx = slices.IndexFunc(volumeInfo, func(vi VolumeInfo) bool { return vi.VolumeName == "vol1" })
+	volumeSnapshotId = volumeInfo[volumeSnapshotIdx].SnapshotId
+	if volumeSnapshotId == currentSnapshot.SnapshotId {
+		c.FailNow()
+	}
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 5)
+
+	// Delete multiple snapshots
+	for i, _ := range snapshotInfo {
+		if snapshotInfo[i].SnapshotId == volumeSnapshotId {
+			continue
+		}
+		err = DeleteSnapshot(DEVICE, snapshotInfo[i].SnapshotId)
+		c.Assert(err, IsNil)
+	}
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+	c.Assert(snapshotInfo[0].SnapshotId, Equals, volumeSnapshotId)
+	c.Assert(snapshotInfo[0].ParentSnapshotId, Equals, uint(0))
+
+	// Clone latest snapshot
+	_, err = CloneSnapshot(DEVICE, "vol2cloned", volumeSnapshotId)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol2cloned", GIGABYTE, 1)
+	err = DeleteVolume(DEVICE, "vol2cloned")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+
+	// Snapshot and clone both the previous snapshot and latest snapshot
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	for i, _ := range snapshotInfo {
+		_, err = CloneSnapshot(DEVICE, fmt.Sprintf("vol2clone%d", i+1), snapshotInfo[i].SnapshotId)
+		c.Assert(err, IsNil)
+	}
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 3)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol2clone1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[2], "vol2clone2", GIGABYTE, 1)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2clone1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2clone2")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 0)
+}
+
+func loadBlocks() [][]byte {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		panic("")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		panic("")
+	}
+	blockCount := len(data) / BLOCK_SIZE
+	blockData := make([][]byte, blockCount)
+	for i := 0; i < blockCount; i++ {
+		blockData[i] = data[i*BLOCK_SIZE : (i+1)*BLOCK_SIZE]
+	}
+	return blockData
+}
+
+func readBlocks(c *C, vc *VolumeContext, blockIndices []int, blockData [][]byte) {
+	data := make([]byte, BLOCK_SIZE)
+	blockCount := len(blockData)
+	for i, _ := range blockIndices {
+		err := vc.ReadBlock(data, uint64(blockIndices[i]))
+		c.Assert(err, IsNil)
+		c.Assert(data, DeepEquals, blockData[i%blockCount])
+	}
+}
+
+func writeBlocks(c *C, vc *VolumeContext, blockIndices []int, blockData [][]byte) {
+	blockCount := len(blockData)
+	for i, _ := range blockIndices {
+		err := vc.WriteBlock(blockData[i%blockCount], uint64(blockIndices[i]), true)
+		c.Assert(err, IsNil)
+	}
+}
+
+func unmapBlocks(c *C, vc *VolumeContext, blockIndices []int) {
+	for i, _ := range blockIndices {
+		err := vc.UnmapBlock(uint64(blockIndices[i]))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) TestVolumeIO(c *C) {
+	repeats := 10
+	spread := 100
+	positions := []int{0, 3, 43, 53, 92}
+
+	blockData := loadBlocks()
+	blockIndices := make([]int, len(positions)*repeats)
+	i := 0
+	for r := 0; r < repeats; r++ {
+		for _, p := range positions {
+			blockIndices[i] = p + (r * spread)
+			i++
+		}
+	}
+
+	// Create a volume and open it
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+
+	// Read (should get empty data)
+	emptyBlock := make([]byte, BLOCK_SIZE)
+	readBlocks(c, vc, blockIndices, [][]byte{emptyBlock})
+
+	// Write and read back
+	writeBlocks(c, vc, blockIndices, blockData)
+	readBlocks(c, vc, blockIndices, blockData)
+
+	// Read other (should get empty data)
+	otherBlockIndices := make([]int, len(blockIndices)*2)
+	for i := 0; i < len(blockIndices)*2; i += 2 {
+		otherBlockIndices[i] = blockIndices[i/2] - 1
+		otherBlockIndices[i+1] = blockIndices[i/2] + 1
+	}
+	sort.Ints(otherBlockIndices[:])
+	otherBlockIndices = otherBlockIndices[1:]
+	readBlocks(c, vc, otherBlockIndices, [][]byte{emptyBlock})
+
+	// Unmap and read back
+	unmapBlocks(c, vc, blockIndices)
+	readBlocks(c, vc, blockIndices, [][]byte{emptyBlock})
+	vc.CloseVolume()
+
+	// Validate metadata and clean up
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotIO(c *C) {
+	repeats := 10
+	spread := 100
+	positions := []int{0, 3, 43, 53, 92}
+
+	blockData := loadBlocks()
+	blockIndices := make([]int, len(positions)*repeats)
+	i := 0
+	for r := 0; r < repeats; r++ {
+		for _, p := range positions {
+			blockIndices[i] = p + (r * spread)
+			i++
+		}
+	}
+
+	// Create a volume and open it
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+
+	// Write
+	writeBlocks(c, vc, blockIndices, blockData)
+	vc.CloseVolume()
+
+	// Snapshot, open again and read back
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blockIndices, blockData)
+
+	// Overwrite and read back
+	dummyBlock := make([]byte, BLOCK_SIZE)
+	for i := 0; i < BLOCK_SIZE; i++ {
+		dummyBlock[i] = 0xF0
+	}
+	writeBlocks(c, vc, blockIndices, [][]byte{dummyBlock})
+	readBlocks(c, vc, blockIndices, [][]byte{dummyBlock})
+	vc.CloseVolume()
+
+	// Clone volume and open
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 2)
+	initialSnapshotIdx := slices.IndexFunc(snapshotInfo, func(si SnapshotInfo) bool { return si.ParentSnapshotId == 0 })
+	if initialSnapshotIdx == -1 {
+		c.FailNow()
+	}
+	initialSnapshotId := snapshotInfo[initialSnapshotIdx].SnapshotId
+	cloneInfo, err := CloneSnapshot(DEVICE, "vol1clone", initialSnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(cloneInfo.VolumeName, Equals, "vol1clone")
+	c.Assert(cloneInfo.SnapshotCount, Equals, uint(1))
+	vc, err = OpenVolume(DEVICE, "vol1clone")
+	c.Assert(err, IsNil)
+
+	// Read original blocks from clone
+	readBlocks(c, vc, blockIndices, blockData)
+	vc.CloseVolume()
+
+	// Delete initial snapshot, open again and read back
+	err = DeleteSnapshot(DEVICE, initialSnapshotId)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blockIndices, [][]byte{dummyBlock})
+
+	// Validate metadata and clean up
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	assertVolume(c, &volumeInfo[0], "vol1", GIGABYTE, 1)
+	assertVolume(c, &volumeInfo[1], "vol1clone", GIGABYTE, 1)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1clone")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestDefragment(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	// Create two volumes and interleave their extents, writing the first volume in reverse order
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	var blockIndices []int
+	for e := 3; e >= 0; e-- {
+		blockIndices = append(blockIndices, e*extentBlocks+e)
+		vc1, err := OpenVolume(DEVICE, "vol1")
+		c.Assert(err, IsNil)
+		writeBlocks(c, vc1, blockIndices[len(blockIndices)-1:], blockData[len(blockIndices)-1:])
+		vc1.CloseVolume()
+		vc2, err := OpenVolume(DEVICE, "vol2")
+		c.Assert(err, IsNil)
+		writeBlocks(c, vc2, []int{e * extentBlocks}, blockData)
+		vc2.CloseVolume()
+	}
+
+	// Delete the second volume and defragment the first
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = DefragmentVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+
+	// Extents should be contiguous and in order
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(dc.superblock.AllocatedDeviceExtents, Equals, uint32(4))
+	v := dc.FindVolume("vol1")
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+	c.Assert(err, IsNil)
+	for e := 0; e < 4; e++ {
+		c.Assert(vem.get(uint32(e)).ExtentPos, Equals, uint32(e))
+	}
+	dc.Close()
+
+	// Read back and clean up
+	vc1, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	for i := range blockIndices {
+		readBlocks(c, vc1, blockIndices[i:i+1], blockData[i:i+1])
+	}
+	vc1.CloseVolume()
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, uint(0))
+}
+
+func (s *TestSuite) TestAllocationPolicy(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	extentPositions := func(volumeName string) []uint32 {
+		dc, err := GetDeviceContext(DEVICE)
+		c.Assert(err, IsNil)
+		defer dc.Close()
+		v := dc.FindVolume(volumeName)
+		vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+		c.Assert(err, IsNil)
+		var positions []uint32
+		vem.extentBitmap.Range(func(x uint32) {
+			positions = append(positions, vem.get(x).ExtentPos)
+		})
+		return positions
+	}
+	writeExtents := func(volumeName string, extents ...int) {
+		vc, err := OpenVolume(DEVICE, volumeName)
+		c.Assert(err, IsNil)
+		for _, e := range extents {
+			writeBlocks(c, vc, []int{e * extentBlocks}, blockData)
+		}
+		vc.CloseVolume()
+	}
+
+	// Leave a hole of two extents at the start of the device
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	writeExtents("vol1", 0, 1)
+	writeExtents("vol2", 0)
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{2})
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+
+	// Default policy appends, first fit reuses the hole
+	writeExtents("vol2", 4)
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{2, 3})
+	err = SetVolumeAllocationPolicy(DEVICE, "vol2", ALLOCATION_POLICY_FIRST_FIT)
+	c.Assert(err, IsNil)
+	writeExtents("vol2", 1)
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{2, 0, 3})
+
+	// Contiguous places extents next to their neighbors
+	err = SetVolumeAllocationPolicy(DEVICE, "vol2", ALLOCATION_POLICY_CONTIGUOUS)
+	c.Assert(err, IsNil)
+	writeExtents("vol2", 2, 5)
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{2, 0, 1, 3, 4})
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].AllocationPolicy, Equals, "contiguous")
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestVolumeQoS(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	err = SetVolumeQoS(DEVICE, "vol1", 20, 0)
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].MaxIops, Equals, uint(20))
+	c.Assert(volumeInfo[0].MaxBandwidth, Equals, uint64(0))
+
+	// The first second worth of operations is not throttled, the next ones are
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	data := make([]byte, BLOCK_SIZE)
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		err = vc.ReadAt(data, 0)
+		c.Assert(err, IsNil)
+	}
+	elapsed := time.Since(start)
+	c.Assert(elapsed > 400*time.Millisecond, Equals, true)
+	c.Assert(elapsed < 2*time.Second, Equals, true)
+	vc.CloseVolume()
+
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestTrash(c *C) {
+	err := SetTrashRetention(DEVICE, time.Hour)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.TrashRetention, Equals, time.Hour)
+
+	// Delete moves the volume to the trash
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 0)
+	deletedVolumeInfo, err := ListDeletedVolumes(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deletedVolumeInfo, HasLen, 1)
+	c.Assert(deletedVolumeInfo[0].VolumeName, Equals, "vol1")
+
+	// Undelete fails while the name is taken
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	err = UndeleteVolume(DEVICE, "vol1")
+	c.Assert(err, NotNil)
+	err = RenameVolume(DEVICE, "vol1", "vol2")
+	c.Assert(err, IsNil)
+	err = UndeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+
+	// Reaping keeps volumes within the retention period, purging destroys them
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	count, err := ReapDeletedVolumes(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint(0))
+	err = PurgeDeletedVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	deletedVolumeInfo, err = ListDeletedVolumes(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deletedVolumeInfo, HasLen, 1)
+
+	// Clean up
+	err = SetTrashRetention(DEVICE, 0)
+	c.Assert(err, IsNil)
+	count, err = ReapDeletedVolumes(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint(1))
+	deletedVolumeInfo, err = ListDeletedVolumes(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deletedVolumeInfo, HasLen, 0)
+}
+
+func (s *TestSuite) TestListAllSnapshots(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	snapshotId, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	_, err = CloneSnapshot(DEVICE, "vol2", snapshotId)
+	c.Assert(err, IsNil)
+
+	// Every snapshot is listed with its volume
+	snapshotInfo, err := ListAllSnapshots(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 3)
+	c.Assert(snapshotInfo[1].SnapshotId, Equals, snapshotId)
+	c.Assert(snapshotInfo[0].VolumeName, Equals, "vol1")
+	c.Assert(snapshotInfo[1].VolumeName, Equals, "vol1")
+	c.Assert(snapshotInfo[2].VolumeName, Equals, "vol2")
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	snapshotInfo, err = ListAllSnapshots(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+
+	// Volumes in the trash still own their snapshots
+	err = SetTrashRetention(DEVICE, time.Hour)
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	snapshotInfo, err = ListAllSnapshots(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+	for _, si := range snapshotInfo {
+		c.Assert(si.VolumeName, Equals, "vol2")
+		c.Assert(si.VolumeDeleted, Equals, true)
+	}
+
+	// Clean up
+	err = SetTrashRetention(DEVICE, 0)
+	c.Assert(err, IsNil)
+	_, err = ReapDeletedVolumes(DEVICE)
+	c.Assert(err, IsNil)
+	snapshotInfo, err = ListAllSnapshots(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 0)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestConcurrentAccess(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	// Two open volumes must not allocate the same extents
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc1, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	vc2, err := OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+
+	// Query while writing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := 0; e < 4; e++ {
+			writeBlocks(c, vc1, []int{e * extentBlocks}, blockData[0:1])
+			writeBlocks(c, vc2, []int{e * extentBlocks}, blockData[1:2])
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+			volumeInfo, err := GetVolumeInfo(DEVICE)
+			c.Assert(err, IsNil)
+			c.Assert(volumeInfo, HasLen, 2)
+		}
+	}
+	for e := 0; e < 4; e++ {
+		readBlocks(c, vc1, []int{e * extentBlocks}, blockData[0:1])
+		readBlocks(c, vc2, []int{e * extentBlocks}, blockData[1:2])
+	}
+	vc1.CloseVolume()
+	vc2.CloseVolume()
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, uint(8))
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotWhileOpen(c *C) {
+	blockData := loadBlocks()
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1}, blockData[0:2])
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	initialSnapshotId := snapshotInfo[0].SnapshotId
+
+	// Snapshot while open, then overwrite
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[2:3])
+	readBlocks(c, vc, []int{0, 1}, [][]byte{blockData[2], blockData[1]})
+	c.Assert(vc.Refresh(), IsNil)
+	vc.CloseVolume()
+
+	// The snapshot keeps the data before the overwrite
+	_, err = CloneSnapshot(DEVICE, "vol1clone", initialSnapshotId)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1clone")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1}, blockData[0:2])
+	vc.CloseVolume()
+
+	// Writes fail once the volume is deleted
+	vc, err = OpenVolume(DEVICE, "vol1clone")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1clone")
+	c.Assert(err, IsNil)
+	err = vc.WriteBlock(blockData[0], 0, true)
+	c.Assert(err, NotNil)
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestOpenSnapshot(c *C) {
+	blockData := loadBlocks()
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1}, blockData[0:2])
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	initialSnapshotId := snapshotInfo[0].SnapshotId
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[2:3])
+
+	// The snapshot shows the data before the overwrite and cannot be modified
+	svc, err := OpenSnapshot(DEVICE, initialSnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(svc.ReadOnly(), Equals, true)
+	c.Assert(svc.VolumeName(), Equals, "vol1")
+	c.Assert(svc.VolumeSize(), Equals, uint64(GIGABYTE))
+	readBlocks(c, svc, []int{0, 1}, blockData[0:2])
+	err = svc.WriteBlock(blockData[3], 0, true)
+	c.Assert(err, Equals, ErrReadOnly)
+	err = svc.UnmapAt(BLOCK_SIZE, 0)
+	c.Assert(err, Equals, ErrReadOnly)
+	readBlocks(c, vc, []int{0, 1}, [][]byte{blockData[2], blockData[1]})
+	svc.CloseVolume()
+	vc.CloseVolume()
+
+	_, err = OpenSnapshot(DEVICE, 0)
+	c.Assert(err, NotNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestOptions(c *C) {
+	blockData := loadBlocks()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1", WithLogger(logger), WithReadCache(2))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(logs.String(), "opened volume"), Equals, true)
+
+	// Cached blocks follow writes and unmaps
+	writeBlocks(c, vc, []int{0, 1, 2}, blockData[0:3])
+	readBlocks(c, vc, []int{0, 1, 2, 0}, [][]byte{blockData[0], blockData[1], blockData[2], blockData[0]})
+	writeBlocks(c, vc, []int{0}, blockData[3:4])
+	readBlocks(c, vc, []int{0}, blockData[3:4])
+	unmapBlocks(c, vc, []int{1})
+	readBlocks(c, vc, []int{1}, [][]byte{make([]byte, BLOCK_SIZE)})
+	c.Assert(vc.cache.lru.Len() <= 2, Equals, true)
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestCacheDevice(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+	cacheDevice, err := CreateMemoryDevice("cache", 2*EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(cacheDevice)
+	smallDevice, err := CreateMemoryDevice("small", BLOCK_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(smallDevice)
+
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = OpenVolume(DEVICE, "vol1", WithCacheDevice("mem://missing"))
+	c.Assert(err, NotNil)
+	_, err = OpenVolume(DEVICE, "vol1", WithCacheDevice(smallDevice))
+	c.Assert(err, NotNil)
+	vc, err := OpenVolume(DEVICE, "vol1", WithCacheDevice(cacheDevice))
+	c.Assert(err, IsNil)
+
+	// Writes do not fill the cache, reads do, evicting the least recently read extent
+	blocks := []int{0, extentBlocks, 2 * extentBlocks}
+	writeBlocks(c, vc, blocks, blockData[0:3])
+	c.Assert(vc.extentCache.lru.Len(), Equals, 0)
+	readBlocks(c, vc, blocks, blockData[0:3])
+	c.Assert(vc.extentCache.lru.Len(), Equals, 2)
+	_, ok := vc.extentCache.extents[0]
+	c.Assert(ok, Equals, false)
+
+	// Cached extents follow writes and unmaps
+	readBlocks(c, vc, blocks[1:], blockData[1:3])
+	writeBlocks(c, vc, blocks[2:], blockData[3:4])
+	readBlocks(c, vc, blocks[2:], blockData[3:4])
+	cached := make([]byte, BLOCK_SIZE)
+	mf, err := openMemoryFile(cacheDevice)
+	c.Assert(err, IsNil)
+	_, err = mf.ReadAt(cached, vc.extentCache.offset(vc.extentCache.extents[2].Value.(*cachedExtent), 0))
+	c.Assert(err, IsNil)
+	c.Assert(cached, DeepEquals, blockData[3])
+	unmapBlocks(c, vc, blocks[1:2])
+	readBlocks(c, vc, blocks[1:2], [][]byte{make([]byte, BLOCK_SIZE)})
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotOptions(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Options are recorded with the new snapshot
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	labels := map[string]string{"app": "db", "tier": ""}
+	snapshotId, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{CreatedAt: createdAt, UserCreated: true, Labels: labels})
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].SnapshotId, Equals, snapshotId)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].SnapshotId, Equals, snapshotId)
+	c.Assert(snapshotInfo[0].CreatedAt.Equal(createdAt), Equals, true)
+	c.Assert(snapshotInfo[0].UserCreated, Equals, true)
+	c.Assert(snapshotInfo[0].Labels, DeepEquals, labels)
+	c.Assert(snapshotInfo[1].UserCreated, Equals, false)
+	c.Assert(snapshotInfo[1].Labels, IsNil)
+
+	// Invalid labels are rejected
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Labels: map[string]string{"": "x"}})
+	c.Assert(err, NotNil)
+
+	// Labels go away with the snapshot and do not reappear when its id is reused
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	err = DeleteSnapshot(DEVICE, snapshotId)
+	c.Assert(err, IsNil)
+	newSnapshotId, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(newSnapshotId, Equals, snapshotId)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	for _, si := range snapshotInfo {
+		c.Assert(si.Labels, IsNil)
+	}
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestLabelLimits(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Keys and values are validated
+	for _, labels := range []map[string]string{
+		{"a=b": "x"},
+		{"a\nb": "x"},
+		{strings.Repeat("k", MAX_LABEL_KEY_SIZE+1): "x"},
+		{"k": strings.Repeat("v", MAX_LABEL_VALUE_SIZE+1)},
+		{SNAPSHOT_NAME_LABEL: "x"},
+	} {
+		_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Labels: labels})
+		c.Assert(errors.Is(err, ErrInvalidLabel), Equals, true)
+	}
+
+	// Labels may fill the region up to the part reserved for names
+	value := strings.Repeat("v", 61430)
+	labels := map[string]string{"k1": value, "k2": value, "k3": value, "k4": value}
+	sid, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Labels: labels})
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.LabelSpaceUsed, Equals, uint64(4*(format.SIZEOF_LABEL_HEADER+2+61430)))
+	c.Assert(deviceInfo.LabelSpaceSize, Equals, uint64(LABEL_REGION_SIZE))
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Labels: map[string]string{"k": strings.Repeat("v", 20)}})
+	c.Assert(errors.Is(err, ErrLabelSpaceExhausted), Equals, true)
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Name: "named"})
+	c.Assert(err, IsNil)
+	c.Assert(SetSnapshotName(DEVICE, sid, "labeled"), IsNil)
+	deviceInfo, err = GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.LabelSpaceUsed > LABEL_REGION_SIZE-LABEL_NAME_RESERVE, Equals, true)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+	deviceInfo, err = GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.LabelSpaceUsed, Equals, uint64(0))
+}
+
+func (s *TestSuite) TestStaleLabels(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Leave labels of a snapshot not in use, as older versions did on deletion
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	stale := uint16(1)
+	for dc.snapshots[stale-1].CreatedAt != 0 {
+		stale++
+	}
+	dc.labels = append(dc.labels, Label{SnapshotId: stale, Key: "k", Value: "v"}, Label{SnapshotId: stale, Key: SNAPSHOT_NAME_LABEL, Value: "old"})
+	c.Assert(dc.WriteMetadata(), IsNil)
+	c.Assert(dc.Close(), IsNil)
+
+	// Stale names do not resolve or block reuse, and stale labels do not attach to a snapshot reusing the id
+	_, err = ResolveSnapshot(DEVICE, "old")
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+	sid, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	for _, si := range snapshotInfo {
+		c.Assert(si.Labels, IsNil)
+		c.Assert(si.Name, Equals, "")
+	}
+	c.Assert(SetSnapshotName(DEVICE, sid, "old"), IsNil)
+
+	// Vacuuming removes them
+	dc, err = GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	for stale = 1; dc.snapshots[stale-1].CreatedAt != 0; stale++ {
+	}
+	dc.labels = append(dc.labels, Label{SnapshotId: stale, Key: "k", Value: "v"})
+	c.Assert(dc.WriteMetadata(), IsNil)
+	c.Assert(dc.Close(), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+	dc, err = GetSharedDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(dc.labels, HasLen, 1)
+	c.Assert(dc.Close(), IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotDescription(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	sid, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Labels: map[string]string{"k": "v"}, Name: "daily", Description: "before upgrade"})
+	c.Assert(err, IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].SnapshotId, Equals, sid)
+	c.Assert(snapshotInfo[0].Description, Equals, "before upgrade")
+	c.Assert(snapshotInfo[0].Labels, DeepEquals, map[string]string{"k": "v"})
+
+	// Descriptions are kept when labels are replaced, and are not labels themselves
+	dc, err := getMutableDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(dc.SetSnapshotLabels(uint16(sid), map[string]string{"k": "w"}), IsNil)
+	err = dc.SetSnapshotLabels(uint16(sid), map[string]string{SNAPSHOT_DESCRIPTION_LABEL: "x"})
+	c.Assert(errors.Is(err, ErrInvalidLabel), Equals, true)
+	c.Assert(dc.WriteMetadata(), IsNil)
+	c.Assert(dc.Close(), IsNil)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].Description, Equals, "before upgrade")
+	c.Assert(snapshotInfo[0].Labels, DeepEquals, map[string]string{"k": "w"})
+
+	// Update, limit and clear
+	c.Assert(SetSnapshotDescription(DEVICE, sid, "after upgrade"), IsNil)
+	err = SetSnapshotDescription(DEVICE, sid, strings.Repeat("x", MAX_SNAPSHOT_DESCRIPTION_SIZE+1))
+	c.Assert(errors.Is(err, ErrInvalidLabel), Equals, true)
+	err = SetSnapshotDescription(DEVICE, MAX_SNAPSHOTS, "x")
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].Description, Equals, "after upgrade")
+	c.Assert(SetSnapshotDescription(DEVICE, sid, ""), IsNil)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].Description, Equals, "")
+	c.Assert(snapshotInfo[0].Name, Equals, "daily")
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestBufferedIO(c *C) {
+	blockData := loadBlocks()
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1", WithBufferedIO())
+	c.Assert(err, IsNil)
+	c.Assert(vc.dc.f.DirectIO(), Equals, false)
+	writeBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	c.Assert(vc.Sync(), IsNil)
+	vc.CloseVolume()
+
+	// Data written with buffered I/O is visible with direct I/O
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.DirectIO, Equals, true)
+	c.Assert(deviceInfo.Health, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.dc.f.BlockBackend.(*DirectFile).SectorSize <= BLOCK_SIZE, Equals, true)
+	readBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSectorSize(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = OpenVolume(DEVICE, "vol1", WithSectorSize(1000))
+	c.Assert(err, NotNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.SectorSize(), Equals, uint(BLOCK_SIZE))
+	vc.CloseVolume()
+
+	vc, err = OpenVolume(DEVICE, "vol1", WithSectorSize(512))
+	c.Assert(err, IsNil)
+	c.Assert(vc.SectorSize(), Equals, uint(512))
+	sector := make([]byte, 512)
+	for i := uint64(8); i < 16; i++ {
+		sector[0] = byte(i)
+		c.Assert(vc.WriteSector(sector, i, true), IsNil)
+	}
+	c.Assert(vc.ReadSector(sector[:100], 9), NotNil)
+	c.Assert(vc.ReadSector(sector, 9), IsNil)
+	c.Assert(sector[0], Equals, byte(9))
+	block := make([]byte, BLOCK_SIZE)
+	c.Assert(vc.ReadBlock(block, 1), IsNil)
+	c.Assert(block[512], Equals, byte(9))
+
+	// Unmapping sectors zeroes them, until the block is unmapped
+	c.Assert(vc.UnmapSector(9), IsNil)
+	c.Assert(vc.ReadSector(sector, 9), IsNil)
+	c.Assert(sector, DeepEquals, make([]byte, 512))
+	c.Assert(vc.ReadSector(sector, 10), IsNil)
+	c.Assert(sector[0], Equals, byte(10))
+	c.Assert(vc.UnmapAt(BLOCK_SIZE-512, BLOCK_SIZE+512), IsNil)
+	c.Assert(vc.vem.get(0).SnapshotId, Not(Equals), uint16(0))
+	c.Assert(vc.UnmapSector(8), IsNil)
+	c.Assert(vc.vem.get(0).SnapshotId, Equals, uint16(0))
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestVolumeStats(c *C) {
+	blockData := loadBlocks()
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].BytesWritten, Equals, uint64(0))
+	c.Assert(volumeInfo[0].LastWriteTime.IsZero(), Equals, true)
+
+	// Counters are written on sync and close, but seen before by the process that has the volume open
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1}, blockData[0:2])
+	readBlocks(c, vc, []int{0}, blockData[0:1])
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].BytesWritten, Equals, uint64(2*BLOCK_SIZE))
+	c.Assert(vc.Sync(), IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].BytesWritten, Equals, uint64(2*BLOCK_SIZE))
+	c.Assert(volumeInfo[0].BytesRead, Equals, uint64(BLOCK_SIZE))
+	c.Assert(volumeInfo[0].LastWriteTime.IsZero(), Equals, false)
+	c.Assert(volumeInfo[0].LastReadTime.IsZero(), Equals, false)
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[2:3])
+	vc.CloseVolume()
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].BytesWritten, Equals, uint64(3*BLOCK_SIZE))
+	c.Assert(volumeInfo[0].CopiedExtents, Equals, uint64(1))
+
+	// Snapshots are not counted
+	vc, err = OpenSnapshot(DEVICE, volumeInfo[0].SnapshotId-1)
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0}, blockData[0:1])
+	vc.CloseVolume()
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].BytesRead, Equals, uint64(BLOCK_SIZE))
+
+	// A new volume in the same slot starts over, even with the same name and the old one still open
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0}, blockData[2:3])
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].BytesWritten, Equals, uint64(0))
+	c.Assert(volumeInfo[0].BytesRead, Equals, uint64(0))
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestBlockCoW(c *C) {
+	blockData := loadBlocks()
+	zeroData := [][]byte{make([]byte, BLOCK_SIZE)}
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1, 2}, blockData[0:3])
+	vc.CloseVolume()
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	sid1 := volumeInfo[0].SnapshotId
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+
+	// Only the written block is copied
+	vc, err = OpenVolume(DEVICE, "vol1", WithBlockCoW())
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{1}, blockData[3:4])
+	readBlocks(c, vc, []int{0, 1, 2}, [][]byte{blockData[0], blockData[3], blockData[2]})
+	c.Assert(vc.vem.get(0).Flags, Equals, uint8(EXTENT_FLAG_PARTIAL))
+	vc.CloseVolume()
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].CopiedExtents, Equals, uint64(0))
+	sid2 := volumeInfo[0].SnapshotId
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1", WithBlockCoW())
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{2}, blockData[4:5])
+	vc.CloseVolume()
+
+	// Inherited blocks are found when opening normally, lazily, or at a snapshot
+	expected := [][]byte{blockData[0], blockData[3], blockData[4]}
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 2}, expected)
+	vc.CloseVolume()
+	vc, err = OpenVolumeLazy(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 2}, expected)
+	vc.CloseVolume()
+	vc, err = OpenSnapshot(DEVICE, sid1)
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 2}, blockData[0:3])
+	vc.CloseVolume()
+
+	// Deleting a snapshot passes its blocks to the partial extent of its child
+	c.Assert(DeleteSnapshot(DEVICE, sid2), IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 2}, expected)
+
+	// Clones and unmaps of inherited blocks copy the extent in full
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	_, err = CloneSnapshot(DEVICE, "vol2", volumeInfo[0].SnapshotId)
+	c.Assert(err, IsNil)
+	unmapBlocks(c, vc, []int{0})
+	c.Assert(vc.vem.get(0).Flags, Equals, uint8(0))
+	readBlocks(c, vc, []int{0, 1, 2}, [][]byte{zeroData[0], blockData[3], blockData[4]})
+	vc.CloseVolume()
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	c.Assert(vc.vem.get(0).Flags, Equals, uint8(0))
+	readBlocks(c, vc, []int{0, 1, 2}, expected)
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestZeroedVolume(c *C) {
+	// Leave data in the extents allocated next, as a deleted volume would
+	data := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	next := uint(dc.superblock.AllocatedDeviceExtents)
+	for pos := next; pos < next+2; pos++ {
+		c.Assert(dc.WriteBlockData(data, pos, 1), IsNil)
+	}
+	c.Assert(dc.Close(), IsNil)
+
+	// Only extents of zeroed volumes are cleared
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vi, err := CreateVolume(DEVICE, "vol2", GIGABYTE, WithZeroedExtents())
+	c.Assert(err, IsNil)
+	c.Assert(vi.Zeroed, Equals, true)
+	for _, volumeName := range []string{"vol1", "vol2"} {
+		vc, err := OpenVolume(DEVICE, volumeName)
+		c.Assert(err, IsNil)
+		c.Assert(vc.WriteBlock(data, 0, true), IsNil)
+		c.Assert(vc.CloseVolume(), IsNil)
+	}
+	dc, err = GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	buf := make([]byte, BLOCK_SIZE)
+	c.Assert(dc.ReadBlockData(buf, next, 1), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(dc.ReadBlockData(buf, next+1, 1), IsNil)
+	c.Assert(buf, DeepEquals, make([]byte, BLOCK_SIZE))
+	c.Assert(dc.Close(), IsNil)
+
+	// Snapshots keep the setting
+	_, err = CreateSnapshot(DEVICE, "vol2", nil)
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	c.Assert(volumeInfo[0].Zeroed, Equals, false)
+	c.Assert(volumeInfo[1].Zeroed, Equals, true)
+
+	// Clean up
+	for _, volumeName := range []string{"vol1", "vol2"} {
+		err = DeleteVolume(DEVICE, volumeName)
+		c.Assert(err, IsNil)
+	}
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestPreallocate(c *C) {
+	blockData := loadBlocks()
+	zeroData := [][]byte{make([]byte, BLOCK_SIZE)}
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[0:1])
+	vc.CloseVolume()
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+
+	// Extents are allocated or copied, but blocks still need metadata updates
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.Preallocate(0, 2*EXTENT_SIZE, false), IsNil)
+	c.Assert(vc.vem.get(0).SnapshotId, Equals, vc.volume.SnapshotId)
+	c.Assert(vc.vem.get(1).SnapshotId, Equals, vc.volume.SnapshotId)
+	c.Assert(vc.WriteBlock(blockData[1], 256, false), Equals, ErrMetadataNeedsUpdate)
+	readBlocks(c, vc, []int{0}, blockData[0:1])
+
+	// Zeroed blocks do not
+	c.Assert(vc.Preallocate(EXTENT_SIZE+1, BLOCK_SIZE, true), IsNil)
+	readBlocks(c, vc, []int{256, 257}, zeroData)
+	c.Assert(vc.WriteBlock(blockData[1], 256, false), IsNil)
+	c.Assert(vc.WriteBlock(blockData[2], 257, false), IsNil)
+	c.Assert(vc.WriteBlock(blockData[3], 258, false), Equals, ErrMetadataNeedsUpdate)
+	readBlocks(c, vc, []int{0, 256, 257}, blockData[0:3])
+	c.Assert(vc.Preallocate(GIGABYTE-BLOCK_SIZE, 2*BLOCK_SIZE, false), NotNil)
+	vc.CloseVolume()
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].CopiedExtents, Equals, uint64(1))
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestTuning(c *C) {
+	blockData := loadBlocks()
+
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(dc.extentBatch, Equals, dc.totalDeviceExtents)
+	dc.Close()
+	_, err = GetDeviceContext(DEVICE, WithCopyBufferSize(1000))
+	c.Assert(err, NotNil)
+	os.Setenv(ENV_EXTENT_BATCH, "many")
+	_, err = GetDeviceContext(DEVICE)
+	c.Assert(err, NotNil)
+	os.Setenv(ENV_EXTENT_BATCH, "3")
+	dc, err = GetDeviceContext(DEVICE, WithExtentBatch(5))
+	c.Assert(err, IsNil)
+	c.Assert(dc.extentBatch, Equals, uint(5))
+	dc.Close()
+	dc, err = GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(dc.extentBatch, Equals, uint(3))
+	dc.Close()
+	os.Unsetenv(ENV_EXTENT_BATCH)
+
+	// Extents are found across batches, and copied in parts
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	blocks := []int{0, 256, 512, 768, 1024, 1280, 1536, 1792}
+	vc, err := OpenVolume(DEVICE, "vol1", WithExtentBatch(3))
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, blocks, blockData)
+	vc.CloseVolume()
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1", WithExtentBatch(3), WithCopyBufferSize(BLOCK_SIZE))
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{1}, blockData[len(blocks):])
+	readBlocks(c, vc, blocks, blockData)
+	vc.CloseVolume()
+	vc, err = OpenVolumeLazy(DEVICE, "vol1", WithExtentBatch(3))
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blocks, blockData)
+	readBlocks(c, vc, []int{1}, blockData[len(blocks):])
+	vc.CloseVolume()
+
+	// Scans with one or many readers find the same extents
+	dc, err = GetDeviceContext(DEVICE, WithExtentBatch(3), WithScanReaders(1))
+	c.Assert(err, IsNil)
+	sequential, err := dc.ReadAllExtents()
+	c.Assert(err, IsNil)
+	dc.Close()
+	dc, err = GetDeviceContext(DEVICE, WithExtentBatch(3), WithScanReaders(16))
+	c.Assert(err, IsNil)
+	parallel, err := dc.ReadAllExtents()
+	c.Assert(err, IsNil)
+	dc.Close()
+	c.Assert(parallel, DeepEquals, sequential)
+	vc, err = OpenVolume(DEVICE, "vol1", WithExtentBatch(3), WithScanReaders(16))
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blocks, blockData)
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+// Backend counting ranges zeroed, which are not zeroed if unsupported is set.
+type zeroRecorder struct {
+	BlockBackend
+	unsupported bool
+	zeroes      int
+}
+
+func (zr *zeroRecorder) ZeroRange(offset uint64, length uint64) (bool, error) {
+	if zr.unsupported {
+		return false, nil
+	}
+	zr.zeroes++
+	return zr.BlockBackend.(BackendZeroer).ZeroRange(offset, length)
+}
+
+func (s *TestSuite) TestInitZeroRange(c *C) {
+	device, err := CreateMemoryDevice("zero", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	zr := &zeroRecorder{}
+	RegisterBackend("zero", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "zero://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		zr.BlockBackend = mf
+		return zr, nil
+	})
+
+	// Extent metadata left over from a previous use is cleared either way
+	for _, unsupported := range []bool{false, true} {
+		c.Assert(InitDevice("zero://zero", WithForce()), IsNil)
+		_, err = CreateVolume("zero://zero", "vol1", GIGABYTE)
+		c.Assert(err, IsNil)
+		vc, err := OpenVolume("zero://zero", "vol1")
+		c.Assert(err, IsNil)
+		writeBlocks(c, vc, []int{0, 256, 512}, loadBlocks())
+		vc.CloseVolume()
+
+		zr.unsupported = unsupported
+		zr.zeroes = 0
+		c.Assert(InitDevice("zero://zero", WithForce()), IsNil)
+		if unsupported {
+			c.Assert(zr.zeroes, Equals, 0)
+		} else {
+			c.Assert(zr.zeroes, Equals, 1)
+		}
+		dc, err := GetDeviceContext("zero://zero")
+		c.Assert(err, IsNil)
+		em := make([]ExtentMetadata, dc.totalDeviceExtents)
+		c.Assert(dc.ReadExtents(em, 0), IsNil)
+		for i := range em {
+			c.Assert(em[i], Equals, ExtentMetadata{})
+		}
+		dc.Close()
+	}
+}
+
+func (s *TestSuite) TestDeviceIdentity(c *C) {
+	device, err := CreateMemoryDevice("identity", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	c.Assert(InitDevice(device), IsNil)
+	deviceInfo, err := GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	uuid, err := format.ParseUUID(deviceInfo.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(uuid[6]>>4, Equals, byte(4))
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Volumes are only opened on the expected device
+	vc, err := OpenVolume(device, "vol1", WithDeviceUUID(deviceInfo.UUID))
+	c.Assert(err, IsNil)
+	vc.CloseVolume()
+	_, err = OpenVolume(device, "vol1", WithDeviceUUID("0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e04"))
+	c.Assert(errors.Is(err, ErrWrongDevice), Equals, true)
+	_, err = OpenVolumeLazy(device, "vol1", WithDeviceUUID("0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e04"))
+	c.Assert(errors.Is(err, ErrWrongDevice), Equals, true)
+	_, err = OpenVolume(device, "vol1", WithDeviceUUID("vol1"))
+	c.Assert(err, NotNil)
+
+	// Devices can be initialized with a given identity
+	c.Assert(InitDevice(device, WithForce(), WithDeviceUUID("0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e04")), IsNil)
+	deviceInfo, err = GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.UUID, Equals, "0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e04")
+}
+
+func (s *TestSuite) TestMergeOverlapping(c *C) {
+	blockData := make([][]byte, 17)
+	for i := range blockData {
+		blockData[i] = bytes.Repeat([]byte{byte(i + 1)}, BLOCK_SIZE)
+	}
+	zeroBlock := make([]byte, BLOCK_SIZE)
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	snapshot := func() uint {
+		volumeInfo, err := GetVolumeInfo(DEVICE)
+		c.Assert(err, IsNil)
+		_, err = CreateSnapshot(DEVICE, "vol1", nil)
+		c.Assert(err, IsNil)
+		return volumeInfo[0].SnapshotId
+	}
+	write := func(blocks []int, data [][]byte, blockCoW bool) {
+		var opts []Option
+		if blockCoW {
+			opts = append(opts, WithBlockCoW())
+		}
+		vc, err := OpenVolume(DEVICE, "vol1", opts...)
+		c.Assert(err, IsNil)
+		for i, b := range blocks {
+			if data[i] == nil {
+				c.Assert(vc.UnmapBlock(uint64(b)), IsNil)
+			} else {
+				c.Assert(vc.WriteBlock(data[i], uint64(b), true), IsNil)
+			}
+		}
+		vc.CloseVolume()
+	}
+
+	// Grandparent
+	write([]int{512, 513, 514, 768, 769, 1024, 1025}, blockData[0:7], false)
+	sid0 := snapshot()
+	// Parent, with partial extents 2 and 3 and a block of extent 4 unmapped
+	write([]int{0, 1, 256, 257}, blockData[7:11], false)
+	write([]int{513, 769}, blockData[11:13], true)
+	write([]int{1024}, [][]byte{nil}, false)
+	sid1 := snapshot()
+	// Child, with a full extent 0 with a block unmapped and partial extents 1, 2 and 4
+	write([]int{0, 1}, [][]byte{blockData[13], nil}, false)
+	write([]int{256, 514, 1025}, blockData[14:17], true)
+
+	blocks := []int{0, 1, 256, 257, 512, 513, 514, 768, 769, 1024, 1025}
+	expected := [][]byte{
+		blockData[13], zeroBlock, // Child blocks, unmapped blocks stay so
+		blockData[14], blockData[10], // Blocks inherited from the parent
+		blockData[0], blockData[11], blockData[15], // Blocks inherited through the parent
+		blockData[3], blockData[12], // Partial extent of the parent, moved to the child
+		zeroBlock, blockData[16], // Block unmapped in the parent, hiding the grandparent
+	}
+	check := func() {
+		for _, lazy := range []bool{false, true} {
+			var vc *VolumeContext
+			if lazy {
+				vc, err = OpenVolumeLazy(DEVICE, "vol1")
+			} else {
+				vc, err = OpenVolume(DEVICE, "vol1")
+			}
+			c.Assert(err, IsNil)
+			for i, b := range blocks {
+				readBlocks(c, vc, []int{b}, expected[i:i+1])
+			}
+			vc.CloseVolume()
+		}
+	}
+	check()
+	c.Assert(DeleteSnapshot(DEVICE, sid1), IsNil)
+	check()
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+	check()
+	c.Assert(DeleteSnapshot(DEVICE, sid0), IsNil)
+	check()
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	for eidx := uint32(0); eidx < 5; eidx++ {
+		c.Assert(vc.vem.get(eidx).Flags, Equals, uint8(0))
+	}
+	vc.CloseVolume()
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestClonePartialExtents(c *C) {
+	blockData := make([][]byte, 8)
+	for i := range blockData {
+		blockData[i] = bytes.Repeat([]byte{byte(i + 1)}, BLOCK_SIZE)
+	}
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	snapshot := func() uint {
+		volumeInfo, err := GetVolumeInfo(DEVICE)
+		c.Assert(err, IsNil)
+		_, err = CreateSnapshot(DEVICE, "vol1", nil)
+		c.Assert(err, IsNil)
+		return volumeInfo[0].SnapshotId
+	}
+	write := func(blocks []int, data [][]byte) {
+		vc, err := OpenVolume(DEVICE, "vol1", WithBlockCoW())
+		c.Assert(err, IsNil)
+		writeBlocks(c, vc, blocks, data)
+		vc.CloseVolume()
+	}
+	write([]int{0, 1, 2, 256}, blockData[0:4])
+	snapshot()
+	write([]int{1, 257}, blockData[4:6])
+	sid1 := snapshot()
+	write([]int{2}, blockData[6:7])
+
+	// Clones of the head and of a snapshot hold all blocks of their view, in full extents
+	blocks := []int{0, 1, 2, 256, 257}
+	views := map[string][][]byte{
+		"head": {blockData[0], blockData[4], blockData[6], blockData[3], blockData[5]},
+		"snap": {blockData[0], blockData[4], blockData[2], blockData[3], blockData[5]},
+	}
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	_, err = CloneSnapshot(DEVICE, "head", volumeInfo[0].SnapshotId)
+	c.Assert(err, IsNil)
+	_, err = CloneSnapshot(DEVICE, "snap", sid1)
+	c.Assert(err, IsNil)
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+	for name, expected := range views {
+		vc, err := OpenVolume(DEVICE, name)
+		c.Assert(err, IsNil)
+		for i, b := range blocks {
+			readBlocks(c, vc, []int{b}, expected[i:i+1])
+		}
+		c.Assert(vc.vem.get(0).Flags, Equals, uint8(0))
+		c.Assert(vc.vem.get(1).Flags, Equals, uint8(0))
+		vc.CloseVolume()
+	}
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "head")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "snap")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+// Backend counting bytes read.
+type readRecorder struct {
+	BlockBackend
+	read int
+}
+
+func (rr *readRecorder) ReadAt(data []byte, offset uint64) (int, error) {
+	rr.read += len(data)
+	return rr.BlockBackend.ReadAt(data, offset)
+}
+
+func (s *TestSuite) TestMetadataCache(c *C) {
+	device, err := CreateMemoryDevice("metacache", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	rr := &readRecorder{}
+	RegisterBackend("metacache", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "metacache://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		rr.BlockBackend = mf
+		return rr, nil
+	})
+	c.Assert(InitDevice("metacache://metacache"), IsNil)
+	_, err = CreateVolume("metacache://metacache", "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Repeated queries read only the superblock and the stats
+	queryRead := BLOCK_SIZE + (SIZEOF_VOLUME_STATS*MAX_VOLUMES+BLOCK_SIZE-1)/BLOCK_SIZE*BLOCK_SIZE
+	for i := 0; i < 3; i++ {
+		rr.read = 0
+		volumeInfo, err := GetVolumeInfo("metacache://metacache")
+		c.Assert(err, IsNil)
+		c.Assert(volumeInfo, HasLen, 1)
+		c.Assert(rr.read <= queryRead, Equals, true)
+	}
+
+	// Metadata written by others is read again
+	stale := metadataCache["metacache://metacache"]
+	_, err = CreateVolume("metacache://metacache", "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	metadataCache["metacache://metacache"] = stale
+	rr.read = 0
+	volumeInfo, err := GetVolumeInfo("metacache://metacache")
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	c.Assert(rr.read > queryRead, Equals, true)
+	c.Assert(InitDevice("metacache://metacache", WithForce()), IsNil)
+	metadataCache["metacache://metacache"] = stale
+	volumeInfo, err = GetVolumeInfo("metacache://metacache")
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 0)
+}
+
+func (s *TestSuite) TestWatch(c *C) {
+	device, err := CreateMemoryDevice("events", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	events, cancel := Watch(device, &WatchOptions{SpaceThreshold: 5})
+	other, cancelOther := Watch(DEVICE, nil)
+	defer cancelOther()
+	next := func(eventType string, volumeName string) Event {
+		select {
+		case e := <-events:
+			c.Assert(e.Type, Equals, eventType)
+			c.Assert(e.VolumeName, Equals, volumeName)
+			c.Assert(e.Device, Equals, device)
+			return e
+		case <-time.After(time.Second):
+			c.Fatalf("no %v event", eventType)
+		}
+		return Event{}
+	}
+
+	// Lifecycle changes
+	c.Assert(InitDevice(device), IsNil)
+	next(EVENT_DEVICE_INITIALIZED, "")
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	next(EVENT_VOLUME_CREATED, "vol1")
+	c.Assert(RenameVolume(device, "vol1", "vol2"), IsNil)
+	c.Assert(next(EVENT_VOLUME_RENAMED, "vol2").Detail, Equals, "vol1")
+	sid, err := CreateSnapshot(device, "vol2", nil)
+	c.Assert(err, IsNil)
+	c.Assert(next(EVENT_SNAPSHOT_CREATED, "vol2").SnapshotId, Equals, sid)
+	_, err = CloneSnapshot(device, "vol3", 1)
+	c.Assert(err, IsNil)
+	c.Assert(next(EVENT_VOLUME_CLONED, "vol3").SnapshotId, Equals, uint(1))
+	c.Assert(DeleteSnapshot(device, 1), IsNil)
+	c.Assert(next(EVENT_SNAPSHOT_DELETED, "vol2").SnapshotId, Equals, uint(1))
+	c.Assert(SetTrashRetention(device, time.Hour), IsNil)
+	c.Assert(DeleteVolume(device, "vol3"), IsNil)
+	next(EVENT_VOLUME_DELETED, "vol3")
+	c.Assert(UndeleteVolume(device, "vol3"), IsNil)
+	next(EVENT_VOLUME_UNDELETED, "vol3")
+	c.Assert(DeleteVolume(device, "vol3"), IsNil)
+	next(EVENT_VOLUME_DELETED, "vol3")
+	c.Assert(PurgeDeletedVolume(device, "vol3"), IsNil)
+	next(EVENT_VOLUME_PURGED, "vol3")
+
+	// Space is reported once when the threshold is reached
+	vc, err := OpenVolume(device, "vol2")
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	threshold := (5*vc.dc.totalDeviceExtents + 99) / 100
+	for i := uint(0); i < threshold+2; i++ {
+		c.Assert(vc.WriteBlock(data, uint64(i)<<BLOCK_BITS_IN_EXTENT, true), IsNil)
+	}
+	c.Assert(vc.CloseVolume(), IsNil)
+	c.Assert(next(EVENT_SPACE_LOW, "").Detail, Equals, fmt.Sprintf("%v of %v extents allocated", threshold, vc.dc.totalDeviceExtents))
+
+	// Nothing is sent for other devices or after cancelling
+	cancel()
+	_, err = CreateVolume(device, "vol4", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, ok := <-events
+	c.Assert(ok, Equals, false)
+	c.Assert(other, HasLen, 0)
+}
+
+func (s *TestSuite) TestSnapshotRanges(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	for _, block := range []uint64{0, 2, 256} {
+		c.Assert(vc.WriteBlock(data, block, true), IsNil)
+	}
+	c.Assert(vc.CloseVolume(), IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	sid1 := volumeInfo[0].SnapshotId
+	sid2, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+
+	// Unmapped blocks are zeroed only over blocks of previous snapshots, and partial extents hold their own blocks
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.WriteBlock(data, 2, true), IsNil)
+	c.Assert(vc.UnmapBlock(0), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1", WithBlockCoW())
+	c.Assert(err, IsNil)
+	c.Assert(vc.WriteBlock(data, 257, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	ranges, err := GetSnapshotRanges(DEVICE, sid1)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, DeepEquals, []VolumeRange{
+		{Offset: 0, Length: BLOCK_SIZE},
+		{Offset: 2 * BLOCK_SIZE, Length: BLOCK_SIZE},
+		{Offset: EXTENT_SIZE, Length: BLOCK_SIZE},
+	})
+	ranges, err = GetSnapshotRanges(DEVICE, sid2)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, DeepEquals, []VolumeRange{
+		{Offset: 0, Length: BLOCK_SIZE, Zeroed: true},
+		{Offset: 2 * BLOCK_SIZE, Length: BLOCK_SIZE},
+		{Offset: EXTENT_SIZE + BLOCK_SIZE, Length: BLOCK_SIZE},
+	})
+	_, err = GetSnapshotRanges(DEVICE, 999)
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestGroups(c *C) {
+	for _, volumeName := range []string{"vol1", "vol2", "vol3"} {
+		_, err := CreateVolume(DEVICE, volumeName, GIGABYTE)
+		c.Assert(err, IsNil)
+	}
+	err := SetGroupQuota(DEVICE, "tenant1", 2*GIGABYTE)
+	c.Assert(err, IsNil)
+	err = SetVolumeGroup(DEVICE, "vol1", "tenant1")
+	c.Assert(err, IsNil)
+	err = SetVolumeGroup(DEVICE, "vol2", "tenant1")
+	c.Assert(err, IsNil)
+	err = SetVolumeGroup(DEVICE, "vol3", "tenant1")
+	c.Assert(errors.Is(err, ErrQuotaExceeded), Equals, true)
+	err = SetVolumeGroup(DEVICE, "vol3", "tenant2")
+	c.Assert(err, IsNil)
+	err = SetGroupQuota(DEVICE, "tenant1", GIGABYTE)
+	c.Assert(errors.Is(err, ErrQuotaExceeded), Equals, true)
+	err = SetVolumeGroup(DEVICE, "vol3", "-bad")
+	c.Assert(errors.Is(err, ErrInvalidGroupName), Equals, true)
+
+	groupInfo, err := GetGroupInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(groupInfo, DeepEquals, []GroupInfo{
+		{GroupName: "tenant1", Quota: 2 * GIGABYTE, VolumeCount: 2, VolumeSize: 2 * GIGABYTE},
+		{GroupName: "tenant2", VolumeCount: 1, VolumeSize: GIGABYTE},
+	})
+	volumeInfo, err := GetGroupVolumeInfo(DEVICE, "tenant1")
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	c.Assert(volumeInfo[0].VolumeName, Equals, "vol1")
+	c.Assert(volumeInfo[0].Group, Equals, "tenant1")
+	_, err = GetGroupVolumeInfo(DEVICE, "tenant3")
+	c.Assert(errors.Is(err, ErrGroupNotFound), Equals, true)
+
+	// Snapshots of a group share the creation time and labels
+	createdAt := time.Unix(1700000000, 0)
+	snapshots, err := SnapshotGroup(DEVICE, "tenant1", &SnapshotOptions{CreatedAt: createdAt, Labels: map[string]string{"app": "db"}})
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 2)
+	for _, volumeName := range []string{"vol1", "vol2"} {
+		snapshotInfo, err := GetSnapshotInfo(DEVICE, volumeName)
+		c.Assert(err, IsNil)
+		c.Assert(snapshotInfo, HasLen, 2)
+		c.Assert(snapshotInfo[0].SnapshotId, Equals, snapshots[volumeName])
+		c.Assert(snapshotInfo[0].CreatedAt.Equal(createdAt), Equals, true)
+		c.Assert(snapshotInfo[0].Labels, DeepEquals, map[string]string{"app": "db"})
+	}
+
+	// Deleting a group deletes its volumes only
+	err = SetVolumeGroup(DEVICE, "vol2", "")
+	c.Assert(err, IsNil)
+	err = DeleteGroup(DEVICE, "tenant1")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+	c.Assert(volumeInfo[0].VolumeName, Equals, "vol2")
+	c.Assert(volumeInfo[0].Group, Equals, "")
+	groupInfo, err = GetGroupInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(groupInfo, HasLen, 1)
+
+	// Clean up
+	err = DeleteGroup(DEVICE, "tenant2")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestTelemetry(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	vc, err := OpenVolume(DEVICE, "vol1", WithTracerProvider(tp), WithMeterProvider(mp))
+	c.Assert(err, IsNil)
+
+	// Not traced without a parent span
+	data := bytes.Repeat([]byte{0x01}, BLOCK_SIZE)
+	err = vc.WriteAt(data, 0, true)
+	c.Assert(err, IsNil)
+	c.Assert(exporter.GetSpans(), HasLen, 0)
+
+	// Device operations are children of the volume operation
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	err = vc.WriteAtContext(ctx, data, EXTENT_SIZE, true)
+	c.Assert(err, IsNil)
+	err = vc.ReadAtContext(ctx, data, 0)
+	c.Assert(err, IsNil)
+	parent.End()
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range exporter.GetSpans().Snapshots() {
+		spans[span.Name()] = span
+	}
+	c.Assert(spans["dbs.write"], NotNil)
+	c.Assert(spans["dbs.write"].Parent().SpanID(), Equals, parent.SpanContext().SpanID())
+	c.Assert(spans["dbs.write"].Attributes(), DeepEquals, []attribute.KeyValue{
+		attribute.String("dbs.volume", "vol1"),
+		attribute.Int64("dbs.offset", EXTENT_SIZE),
+		attribute.Int64("dbs.length", BLOCK_SIZE),
+	})
+	c.Assert(spans["dbs.superblock_write"], NotNil)
+	c.Assert(spans["dbs.superblock_write"].Parent().SpanID(), Equals, spans["dbs.write"].SpanContext().SpanID())
+	c.Assert(spans["dbs.read"], NotNil)
+	c.Assert(spans["dbs.block_read"], IsNil)
+
+	// All operations are timed
+	var rm metricdata.ResourceMetrics
+	err = reader.Collect(context.Background(), &rm)
+	c.Assert(err, IsNil)
+	c.Assert(rm.ScopeMetrics, HasLen, 1)
+	c.Assert(rm.ScopeMetrics[0].Metrics, HasLen, 1)
+	histogram := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64])
+	counts := map[string]uint64{}
+	for _, dp := range histogram.DataPoints {
+		op, _ := dp.Attributes.Value("dbs.operation")
+		counts[op.AsString()] = dp.Count
+	}
+	c.Assert(counts[OP_WRITE], Equals, uint64(2))
+	c.Assert(counts[OP_READ], Equals, uint64(1))
+	c.Assert(counts[OP_BLOCK_READ] > 0, Equals, true)
+	c.Assert(counts[OP_SUPERBLOCK_WRITE] > 0, Equals, true)
+
+	// Clean up
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestTelemetryConcurrent(c *C) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	volumeNames := []string{"vol1", "vol2"}
+	vcs := make([]*VolumeContext, len(volumeNames))
+	for i, volumeName := range volumeNames {
+		_, err := CreateVolume(DEVICE, volumeName, GIGABYTE)
+		c.Assert(err, IsNil)
+		vcs[i], err = OpenVolume(DEVICE, volumeName, WithTracerProvider(tp))
+		c.Assert(err, IsNil)
+	}
+
+	// Device operations of writes to volumes sharing the device are children of their own write
+	parents := make([]trace.Span, len(vcs))
+	errs := make(chan error, len(vcs))
+	for i, vc := range vcs {
+		var ctx context.Context
+		ctx, parents[i] = tp.Tracer("test").Start(context.Background(), volumeNames[i])
+		go func(ctx context.Context, vc *VolumeContext) {
+			data := bytes.Repeat([]byte{0x01}, BLOCK_SIZE)
+			for e := 0; e < 8; e++ {
+				if err := vc.WriteAtContext(ctx, data, uint64(e)*EXTENT_SIZE, true); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(ctx, vc)
+	}
+	for range vcs {
+		c.Assert(<-errs, IsNil)
+	}
+	for _, parent := range parents {
+		parent.End()
+	}
+	spans := exporter.GetSpans().Snapshots()
+	superblockWrites := map[trace.SpanID]int{}
+	for _, span := range spans {
+		if span.Name() == "dbs.write" {
+			superblockWrites[span.SpanContext().SpanID()] = 0
+		}
+	}
+	c.Assert(superblockWrites, HasLen, 16)
+	for _, span := range spans {
+		if span.Name() == "dbs.superblock_write" {
+			superblockWrites[span.Parent().SpanID()]++
+		}
+	}
+	c.Assert(superblockWrites, HasLen, 16)
+	for _, count := range superblockWrites {
+		c.Assert(count, Equals, 1)
+	}
+
+	// Clean up
+	for i, vc := range vcs {
+		err := vc.CloseVolume()
+		c.Assert(err, IsNil)
+		err = DeleteVolume(DEVICE, volumeNames[i])
+		c.Assert(err, IsNil)
+	}
+	err := VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestDeviceOffset(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	_, ok, err := vc.DeviceOffset(EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	data := bytes.Repeat([]byte{0x5a}, BLOCK_SIZE)
+	err = vc.WriteAt(data, EXTENT_SIZE, true)
+	c.Assert(err, IsNil)
+
+	// The data is found on the device, also through a snapshot
+	offset, ok, err := vc.DeviceOffset(EXTENT_SIZE + 10)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	f, err := os.Open(DEVICE)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	buf := make([]byte, BLOCK_SIZE-10)
+	_, err = f.ReadAt(buf, int64(offset))
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, data[10:])
+	_, ok, err = vc.DeviceOffset(EXTENT_SIZE + BLOCK_SIZE)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	_, _, err = vc.DeviceOffset(GIGABYTE)
+	c.Assert(err, NotNil)
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	snapshotId, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenSnapshot(DEVICE, snapshotId)
+	c.Assert(err, IsNil)
+	snapshotOffset, ok, err := vc.DeviceOffset(EXTENT_SIZE + 10)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(snapshotOffset, Equals, offset)
+
+	// Clean up
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+// Backend failing reads and writes of a block with EIO.
+type faultyBackend struct {
+	BlockBackend
+	offset   atomic.Uint64
+	failures atomic.Int32 // Left to fail, negative to fail all
+}
+
+func (fb *faultyBackend) fail(offset uint64) bool {
+	if offset != fb.offset.Load() {
+		return false
+	}
+	for {
+		n := fb.failures.Load()
+		if n <= 0 || fb.failures.CompareAndSwap(n, n-1) {
+			return n != 0
+		}
+	}
+}
+
+func (fb *faultyBackend) ReadAt(data []byte, offset uint64) (int, error) {
+	if fb.fail(offset) {
+		return 0, &os.PathError{Op: "read", Path: "faulty", Err: syscall.EIO}
+	}
+	return fb.BlockBackend.ReadAt(data, offset)
+}
+
+func (fb *faultyBackend) WriteAt(data []byte, offset uint64) (int, error) {
+	if fb.fail(offset) {
+		return 0, &os.PathError{Op: "write", Path: "faulty", Err: syscall.EIO}
+	}
+	return fb.BlockBackend.WriteAt(data, offset)
+}
+
+func (s *TestSuite) TestRetryPolicy(c *C) {
+	device, err := CreateMemoryDevice("faulty", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	RegisterBackend("faulty", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "faulty://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		return &faultyBackend{BlockBackend: mf}, nil
+	})
+	c.Assert(InitDevice("faulty://faulty"), IsNil)
+	_, err = CreateVolume("faulty://faulty", "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	events, cancel := Watch("faulty://faulty", nil)
+	defer cancel()
+	policy := RetryPolicy{Attempts: 2, Backoff: time.Millisecond, MaxErrors: 2}
+	vc, err := OpenVolume("faulty://faulty", "vol1", WithRetryPolicy(policy))
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{0x01}, BLOCK_SIZE)
+	err = vc.WriteAt(data, 0, true)
+	c.Assert(err, IsNil)
+	offset, _, err := vc.DeviceOffset(0)
+	c.Assert(err, IsNil)
+	fb := vc.dc.f.BlockBackend.(*faultyBackend)
+	fb.offset.Store(offset)
+
+	// Transient errors are retried
+	fb.failures.Store(2)
+	buf := make([]byte, BLOCK_SIZE)
+	err = vc.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, data)
+	fb.failures.Store(3)
+	err = vc.ReadAt(buf, 0)
+	c.Assert(errors.Is(err, ErrMediaError), Equals, true)
+	c.Assert(errors.Is(err, syscall.EIO), Equals, true)
+	c.Assert(vc.ExtentErrors(), HasLen, 1)
+
+	// The volume is made read-only once errors reach the limit
+	fb.failures.Store(-1)
+	err = vc.WriteAt(data, 0, true)
+	c.Assert(errors.Is(err, ErrMediaError), Equals, true)
+	c.Assert(vc.ReadOnly(), Equals, true)
+	fb.failures.Store(0)
+	err = vc.WriteAt(data, 0, true)
+	c.Assert(errors.Is(err, ErrReadOnly), Equals, true)
+	err = vc.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	for _, n := range vc.ExtentErrors() {
+		c.Assert(n, Equals, uint64(2))
+	}
+	// Errors are also sent before
+	for failed := false; !failed; {
+		select {
+		case e := <-events:
+			failed = e.Type == EVENT_VOLUME_FAILED
+			c.Assert(e.Type == EVENT_ERROR || e.VolumeName == "vol1", Equals, true)
+		case <-time.After(time.Second):
+			c.Fatalf("no volume_failed event")
+		}
+	}
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo("faulty://faulty")
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].MediaErrors, Equals, uint64(2))
+	c.Assert(volumeInfo[0].FailedAt.IsZero(), Equals, false)
+
+	// It stays read-only until its errors are reset
+	vc, err = OpenVolume("faulty://faulty", "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.ReadOnly(), Equals, true)
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	err = ResetVolumeErrors("faulty://faulty", "vol1")
+	c.Assert(err, IsNil)
+	volumeInfo, err = GetVolumeInfo("faulty://faulty")
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].MediaErrors, Equals, uint64(0))
+	c.Assert(volumeInfo[0].FailedAt.IsZero(), Equals, true)
+
+	// Without a policy, the first error fails the request
+	vc, err = OpenVolume("faulty://faulty", "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.ReadOnly(), Equals, false)
+	fb = vc.dc.f.BlockBackend.(*faultyBackend)
+	fb.offset.Store(offset)
+	fb.failures.Store(1)
+	err = vc.ReadAt(buf, 0)
+	c.Assert(errors.Is(err, ErrMediaError), Equals, true)
+	err = vc.WriteAt(data, 0, true)
+	c.Assert(err, IsNil)
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestMaintenance(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{0x01}, BLOCK_SIZE)
+	err = vc.WriteAt(data, 0, true)
+	c.Assert(err, IsNil)
+	err = SetDeviceMaintenance(DEVICE, true)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.Maintenance, Equals, true)
+
+	// Volumes cannot be changed
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, Equals, ErrMaintenance)
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, Equals, ErrMaintenance)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, Equals, ErrMaintenance)
+
+	// Open volumes can only overwrite allocated blocks
+	err = vc.WriteAt(data, BLOCK_SIZE, true)
+	c.Assert(err, IsNil)
+	err = vc.WriteAt(data, EXTENT_SIZE, true)
+	c.Assert(err, Equals, ErrMaintenance)
+	err = vc.UnmapAt(BLOCK_SIZE, 0)
+	c.Assert(err, Equals, ErrMaintenance)
+	err = vc.Preallocate(EXTENT_SIZE, EXTENT_SIZE, false)
+	c.Assert(err, Equals, ErrMaintenance)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+	err = SetDeviceMaintenance(DEVICE, false)
+	c.Assert(err, IsNil)
+	err = vc.WriteAt(data, EXTENT_SIZE, true)
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestOnlineVacuum(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+	extents := VACUUM_STEP_EXTENTS + 4
+
+	// Interleave the extents of two volumes, so deleting the second leaves holes to fill in more than one step
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc1, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	vc2, err := OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	var blockIndices []int
+	for e := 0; e < extents; e++ {
+		blockIndices = append(blockIndices, e*extentBlocks+e)
+		writeBlocks(c, vc2, []int{e * extentBlocks}, blockData)
+		writeBlocks(c, vc1, blockIndices[e:], blockData[e:])
+	}
+	err = vc2.CloseVolume()
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	snapshotId, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	snap, err := OpenSnapshot(DEVICE, snapshotId)
+	c.Assert(err, IsNil)
+
+	// Read the volume while vacuuming
+	stop := make(chan struct{})
+	failed := make(chan error, 1)
+	go func() {
+		defer close(failed)
+		data := make([]byte, BLOCK_SIZE)
+		for {
+			for i, block := range blockIndices {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := vc1.ReadBlock(data, uint64(block)); err != nil {
+					failed <- err
+					return
+				}
+				if !bytes.Equal(data, blockData[i]) {
+					failed <- fmt.Errorf("block %v changed while vacuuming", block)
+					return
+				}
+			}
+		}
+	}()
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+	close(stop)
+	c.Assert(<-failed, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, uint(extents))
+
+	// Open contexts follow the moved extents, and new extents do not overwrite them
+	readBlocks(c, snap, blockIndices, blockData)
+	writeBlocks(c, vc1, []int{0, extents * extentBlocks}, blockData[1:])
+	readBlocks(c, vc1, []int{0}, blockData[1:])
+	readBlocks(c, vc1, blockIndices[1:], blockData[1:])
+	readBlocks(c, snap, blockIndices, blockData)
+	err = snap.CloseVolume()
+	c.Assert(err, IsNil)
+	err = vc1.CloseVolume()
+	c.Assert(err, IsNil)
+	vc1, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc1, []int{0, extents * extentBlocks}, blockData[1:])
+	readBlocks(c, vc1, blockIndices[1:], blockData[1:])
+	err = vc1.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestRelocateExtent(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	blockIndices := []int{1, extentBlocks + 2}
+	writeBlocks(c, vc, blockIndices, blockData)
+
+	// Only allocated extents can be moved, and only to free positions
+	err = RelocateExtent(DEVICE, 2, 3)
+	c.Assert(errors.Is(err, ErrInvalidExtent), Equals, true)
+	err = RelocateExtent(DEVICE, 0, 1)
+	c.Assert(errors.Is(err, ErrInvalidExtent), Equals, true)
+	err = RelocateExtent(DEVICE, 0, 1<<20)
+	c.Assert(errors.Is(err, ErrInvalidExtent), Equals, true)
+
+	// Move an extent past the allocation mark, while the volume is open
+	err = RelocateExtent(DEVICE, 0, 4)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, uint(5))
+	readBlocks(c, vc, blockIndices, blockData)
+	writeBlocks(c, vc, []int{2 * extentBlocks}, blockData[2:])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// New extents are allocated after the moved one, and data is read back
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	v := dc.FindVolume("vol1")
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(vem.get(0).ExtentPos, Equals, uint32(4))
+	c.Assert(vem.get(1).ExtentPos, Equals, uint32(1))
+	c.Assert(vem.get(2).ExtentPos, Equals, uint32(5))
+	dc.Close()
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blockIndices, blockData)
+	readBlocks(c, vc, []int{2 * extentBlocks}, blockData[2:])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestExtentTimes(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	err = SetDeviceExtentTimes(DEVICE, true)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.ExtentTimes, Equals, true)
+
+	// Allocated extents are stamped
+	start := time.Now().Truncate(time.Second)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	c.Assert(vc.WriteBlock(data, 0, true), IsNil)
+	c.Assert(vc.WriteBlock(data, 256, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	sid := volumeInfo[0].SnapshotId
+	ranges, err := GetSnapshotRanges(DEVICE, sid)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 2)
+	for _, r := range ranges {
+		c.Assert(r.ModifiedAt.Before(start), Equals, false)
+	}
+
+	// Writes to allocated extents are recorded when the volume stats are written
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(dc.writeExtentTimes(map[uint32]int64{0: 1000, 1: 1000}), IsNil)
+	c.Assert(dc.Close(), IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.WriteBlock(data, 257, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	ranges, err = GetSnapshotRanges(DEVICE, sid)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 2)
+	c.Assert(ranges[0].ModifiedAt, Equals, time.Unix(1000, 0))
+	c.Assert(ranges[1].ModifiedAt.Before(start), Equals, false)
+	c.Assert(ranges[1].Length, Equals, uint64(2*BLOCK_SIZE))
+
+	// Times follow relocated extents
+	err = RelocateExtent(DEVICE, 0, 5)
+	c.Assert(err, IsNil)
+	ranges, err = GetSnapshotRanges(DEVICE, sid)
+	c.Assert(err, IsNil)
+	c.Assert(ranges[0].ModifiedAt, Equals, time.Unix(1000, 0))
+
+	// Times are no longer reported once disabled
+	err = SetDeviceExtentTimes(DEVICE, false)
+	c.Assert(err, IsNil)
+	ranges, err = GetSnapshotRanges(DEVICE, sid)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, DeepEquals, []VolumeRange{
+		{Offset: 0, Length: BLOCK_SIZE},
+		{Offset: EXTENT_SIZE, Length: 2 * BLOCK_SIZE},
+	})
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestTiering(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	extentPositions := func(volumeName string) []uint32 {
+		dc, err := GetDeviceContext(DEVICE)
+		c.Assert(err, IsNil)
+		defer dc.Close()
+		v := dc.FindVolume(volumeName)
+		vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+		c.Assert(err, IsNil)
+		var positions []uint32
+		vem.extentBitmap.Range(func(x uint32) {
+			positions = append(positions, vem.get(x).ExtentPos)
+		})
+		return positions
+	}
+	writeExtents := func(vc *VolumeContext, extents ...int) {
+		for _, e := range extents {
+			writeBlocks(c, vc, []int{e * extentBlocks}, blockData[e:])
+		}
+	}
+
+	err := SetDeviceFastRegion(DEVICE, DEVICE_SIZE)
+	c.Assert(err, NotNil)
+	err = SetDeviceFastRegion(DEVICE, 8*EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.FastRegion, Equals, uint64(8*EXTENT_SIZE))
+
+	// Fill the fast region before the volumes get a tier
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc1, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeExtents(vc1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	vc2, err := OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	writeExtents(vc2, 0, 1)
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{10, 11})
+	err = SetVolumeTier(DEVICE, "vol1", TIER_SLOW)
+	c.Assert(err, IsNil)
+	err = SetVolumeTier(DEVICE, "vol2", TIER_FAST)
+	c.Assert(err, IsNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[1].Tier, Equals, "fast")
+
+	// Slow extents leave the fast region, making room for fast ones, while the volumes are open
+	moved, err := RebalanceTiers(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(moved, Equals, uint(10))
+	c.Assert(extentPositions("vol1"), DeepEquals, []uint32{12, 13, 14, 15, 16, 17, 18, 19, 8, 9})
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{0, 1})
+	moved, err = RebalanceTiers(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(moved, Equals, uint(0))
+	for e := 0; e < 10; e++ {
+		readBlocks(c, vc1, []int{e * extentBlocks}, blockData[e:e+1])
+	}
+	readBlocks(c, vc2, []int{0, extentBlocks}, blockData[0:2])
+
+	// New extents are allocated in the region of their tier
+	writeExtents(vc2, 2)
+	writeExtents(vc1, 10)
+	c.Assert(extentPositions("vol2"), DeepEquals, []uint32{0, 1, 2})
+	c.Assert(extentPositions("vol1")[10], Equals, uint32(10))
+
+	// Clean up
+	err = vc1.CloseVolume()
+	c.Assert(err, IsNil)
+	err = vc2.CloseVolume()
+	c.Assert(err, IsNil)
+	err = SetDeviceFastRegion(DEVICE, 0)
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotUsage(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := GetSnapshotUsage(DEVICE, "vol1")
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+	_, err = CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks, 2 * extentBlocks}, blockData[0:3])
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[3:4])
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{extentBlocks}, blockData[4:5])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// The oldest snapshot shares the extents its child did not replace
+	su, err := GetSnapshotUsage(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(su, HasLen, 3)
+	c.Assert(su[0].Extents, Equals, uint(1))
+	c.Assert(su[0].UniqueExtents, Equals, uint(1))
+	c.Assert(su[1].Extents, Equals, uint(1))
+	c.Assert(su[1].SharedExtents, Equals, uint(1))
+	c.Assert(su[2].Extents, Equals, uint(3))
+	c.Assert(su[2].UniqueExtents, Equals, uint(1))
+	c.Assert(su[2].SharedExtents, Equals, uint(2))
+
+	// Deleting a snapshot frees its unique extents
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	allocated := deviceInfo.AllocatedDeviceExtents
+	err = DeleteSnapshot(DEVICE, su[2].SnapshotId)
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+	deviceInfo, err = GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, allocated-su[2].UniqueExtents)
+	su, err = GetSnapshotUsage(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(su, HasLen, 2)
+	c.Assert(su[1].Extents, Equals, uint(3))
+	c.Assert(su[1].SharedExtents, Equals, uint(2))
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestDeviceSnapshotView(c *C) {
+	blockData := loadBlocks()
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1}, blockData[0:2])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	sid, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	_, err = CloneSnapshot(DEVICE, "vol2", sid)
+	c.Assert(err, IsNil)
+
+	// The view matches the separate calls made while nothing changes
+	view, err := GetDeviceSnapshotView(DEVICE)
+	c.Assert(err, IsNil)
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(view.Device, DeepEquals, deviceInfo)
+	vi, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(view.Volumes, DeepEquals, vi)
+	c.Assert(view.DeletedVolumes, HasLen, 0)
+	si, err := ListAllSnapshots(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(view.Snapshots, DeepEquals, si)
+	c.Assert(view.Usage, HasLen, 2)
+	for _, name := range []string{"vol1", "vol2"} {
+		su, err := GetSnapshotUsage(DEVICE, name)
+		c.Assert(err, IsNil)
+		c.Assert(view.Usage[name], DeepEquals, su)
+	}
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestDeleteSnapshots(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		writeBlocks(c, vc, []int{0, (i + 1) * extentBlocks}, blockData[i:i+2])
+		labels := map[string]string{"daily": "true"}
+		if i%2 == 1 {
+			labels = nil
+		}
+		_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{CreatedAt: start.Add(time.Duration(i) * time.Hour), Labels: labels})
+		c.Assert(err, IsNil)
+		c.Assert(vc.Refresh(), IsNil)
+	}
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 5)
+
+	// Selectors combine, and only extents replaced by children are released
+	deleted, released, err := DeleteSnapshots(DEVICE, "vol1", &SnapshotSelector{
+		Before: start.Add(3 * time.Hour),
+		Labels: map[string]string{"daily": "true"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, DeepEquals, []uint{snapshotInfo[1].SnapshotId, snapshotInfo[3].SnapshotId})
+	c.Assert(released, Equals, uint(1))
+	_, _, err = DeleteSnapshots(DEVICE, "vol1", &SnapshotSelector{Oldest: snapshotInfo[3].SnapshotId})
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+
+	// Cascading deletes the snapshot and older ones, leaving the current one
+	deleted, _, err = DeleteSnapshots(DEVICE, "vol1", &SnapshotSelector{Oldest: snapshotInfo[2].SnapshotId})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, DeepEquals, []uint{snapshotInfo[2].SnapshotId, snapshotInfo[4].SnapshotId})
+	deleted, _, err = DeleteSnapshots(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 0)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+	readBlocks(c, vc, []int{0}, blockData[3:4])
+	for i := 0; i < 4; i++ {
+		readBlocks(c, vc, []int{(i + 1) * extentBlocks}, blockData[i+1:i+2])
+	}
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotNames(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	sid1, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Name: "daily-1", Labels: map[string]string{"k": "v"}})
+	c.Assert(err, IsNil)
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Name: "daily-1"})
+	c.Assert(errors.Is(err, ErrSnapshotExists), Equals, true)
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Name: "123"})
+	c.Assert(errors.Is(err, ErrInvalidSnapshotName), Equals, true)
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Labels: map[string]string{SNAPSHOT_NAME_LABEL: "x"}})
+	c.Assert(err, NotNil)
+	sid2, err := CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+
+	// Names are shown apart from labels, and resolve like ids
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[1].Name, Equals, "daily-1")
+	c.Assert(snapshotInfo[1].Labels, DeepEquals, map[string]string{"k": "v"})
+	sid, err := ResolveSnapshot(DEVICE, "daily-1")
+	c.Assert(err, IsNil)
+	c.Assert(sid, Equals, sid1)
+	sid, err = ResolveSnapshot(DEVICE, fmt.Sprint(sid2))
+	c.Assert(err, IsNil)
+	c.Assert(sid, Equals, sid2)
+	_, err = ResolveSnapshot(DEVICE, "weekly-1")
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+	_, err = ResolveSnapshot(DEVICE, "999")
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+
+	// Names move and go away with their snapshot
+	err = SetSnapshotName(DEVICE, sid2, "daily-1")
+	c.Assert(errors.Is(err, ErrSnapshotExists), Equals, true)
+	err = SetSnapshotName(DEVICE, sid1, "")
+	c.Assert(err, IsNil)
+	err = SetSnapshotName(DEVICE, sid2, "daily-1")
+	c.Assert(err, IsNil)
+	err = DeleteSnapshot(DEVICE, sid1)
+	c.Assert(err, IsNil)
+	sid, err = ResolveSnapshot(DEVICE, "daily-1")
+	c.Assert(err, IsNil)
+	c.Assert(sid, Equals, sid2)
+	_, err = CloneSnapshot(DEVICE, "vol2", sid)
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	_, err = ResolveSnapshot(DEVICE, "daily-1")
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSnapshotAndClone(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks}, blockData[0:2])
+
+	// Nothing changes if the clone cannot be created
+	_, _, err = SnapshotAndClone(DEVICE, "vol1", "vol1", nil)
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+
+	// The clone needs the extents visible at the snapshot
+	extents, err := EstimateCloneSpace(DEVICE, snapshotInfo[0].SnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(extents, Equals, uint(2))
+	_, err = EstimateCloneSpace(DEVICE, 999)
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+
+	// The clone holds the data as of the snapshot
+	sid, vi, err := SnapshotAndClone(DEVICE, "vol1", "vol2", &SnapshotOptions{Name: "promoted"})
+	c.Assert(err, IsNil)
+	c.Assert(vi.VolumeName, Equals, "vol2")
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 2)
+	c.Assert(snapshotInfo[0].SnapshotId, Equals, sid)
+	c.Assert(snapshotInfo[0].Name, Equals, "promoted")
+	c.Assert(vc.Refresh(), IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[2:3])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, extentBlocks}, blockData[0:2])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestCloneSnapshotRanges(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks + 5, extentBlocks + 6, 3 * extentBlocks}, blockData[0:4])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	sid := snapshotInfo[0].SnapshotId
+
+	_, err = CloneSnapshotRanges(DEVICE, "vol2", sid, []VolumeRange{{Offset: 1, Length: BLOCK_SIZE}})
+	c.Assert(err, NotNil)
+	_, err = CloneSnapshotRanges(DEVICE, "vol2", sid, []VolumeRange{{Offset: GIGABYTE, Length: BLOCK_SIZE}})
+	c.Assert(err, NotNil)
+	_, err = CloneSnapshotRanges(DEVICE, "vol1", sid, []VolumeRange{{Offset: 0, Length: BLOCK_SIZE}})
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+
+	// Ranges are placed one after the other, copying only blocks with data
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	allocated := deviceInfo.AllocatedDeviceExtents
+	vi, err := CloneSnapshotRanges(DEVICE, "vol2", sid, []VolumeRange{
+		{Offset: EXTENT_SIZE, Length: EXTENT_SIZE},
+		{Offset: 3 * EXTENT_SIZE, Length: BLOCK_SIZE},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(vi.VolumeSize, Equals, uint64(2*EXTENT_SIZE))
+	deviceInfo, err = GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, allocated+2)
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 5, 6, extentBlocks}, [][]byte{make([]byte, BLOCK_SIZE), blockData[1], blockData[2], blockData[3]})
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestCloneSnapshotMany(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := CreateVolume(DEVICE, "golden", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "golden")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks + 5}, blockData[0:2])
+	c.Assert(vc.CloseVolume(), IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "golden")
+	c.Assert(err, IsNil)
+	sid := snapshotInfo[0].SnapshotId
+
+	// Nothing is added if any name is taken
+	_, err = CloneSnapshotMany(DEVICE, sid, []string{"vm-1", "golden"})
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+	_, err = CloneSnapshotMany(DEVICE, sid, []string{"vm-1", "vm-1"})
+	c.Assert(err, NotNil)
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+
+	// Each volume gets its own copy of the data
+	names := []string{"vm-1", "vm-2", "vm-3"}
+	vi, err := CloneSnapshotMany(DEVICE, sid, names)
+	c.Assert(err, IsNil)
+	c.Assert(vi, HasLen, 3)
+	for i, name := range names {
+		c.Assert(vi[i].VolumeName, Equals, name)
+		c.Assert(vi[i].VolumeSize, Equals, uint64(GIGABYTE))
+		vc, err = OpenVolume(DEVICE, name)
+		c.Assert(err, IsNil)
+		readBlocks(c, vc, []int{0, extentBlocks + 5}, blockData[0:2])
+		writeBlocks(c, vc, []int{0}, blockData[2+i:3+i])
+		c.Assert(vc.CloseVolume(), IsNil)
+	}
+	vc, err = OpenVolume(DEVICE, "vm-1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0}, blockData[2:3])
+	c.Assert(vc.CloseVolume(), IsNil)
+	vc, err = OpenVolume(DEVICE, "golden")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0}, blockData[0:1])
+	c.Assert(vc.CloseVolume(), IsNil)
+
+	// Clean up
+	for _, name := range append(names, "golden") {
+		c.Assert(DeleteVolume(DEVICE, name), IsNil)
+	}
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestCloneSnapshotManyFailure(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+	_, err := CreateMemoryDevice("clonefail", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice("clonefail")
+	var failOffset atomic.Uint64
+	var failures atomic.Int32
+	RegisterBackend("clonefail", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "clonefail://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		fb := &faultyBackend{BlockBackend: mf}
+		fb.offset.Store(failOffset.Load())
+		fb.failures.Store(failures.Load())
+		return fb, nil
+	})
+	device := "clonefail://clonefail"
+	c.Assert(InitDevice(device), IsNil)
+	_, err = CreateVolume(device, "golden", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(device, "golden")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks + 5}, blockData[0:2])
+	offset, _, err := vc.DeviceOffset(0)
+	c.Assert(err, IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	snapshotInfo, err := GetSnapshotInfo(device, "golden")
+	c.Assert(err, IsNil)
+	sid := snapshotInfo[0].SnapshotId
+
+	// Copying to the second volume fails, after the first is copied, and both are destroyed
+	failOffset.Store(offset + 4*EXTENT_SIZE)
+	failures.Store(-1)
+	names := []string{"vm-1", "vm-2"}
+	_, err = CloneSnapshotMany(device, sid, names)
+	c.Assert(errors.Is(err, syscall.EIO), Equals, true)
+	failures.Store(0)
+	volumeInfo, err := GetVolumeInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+	c.Assert(volumeInfo[0].VolumeName, Equals, "golden")
+
+	// The extents copied are released, and the names can be used again
+	c.Assert(VacuumDevice(device), IsNil)
+	deviceInfo, err := GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, uint(2))
+	_, err = CloneSnapshotMany(device, sid, names)
+	c.Assert(err, IsNil)
+	for _, name := range names {
+		vc, err = OpenVolume(device, name)
+		c.Assert(err, IsNil)
+		readBlocks(c, vc, []int{0, extentBlocks + 5}, blockData[0:2])
+		c.Assert(vc.CloseVolume(), IsNil)
+	}
+}
+
+func (s *TestSuite) TestVerifyClone(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks + 5}, blockData[0:2])
+	c.Assert(vc.CloseVolume(), IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	sid := snapshotInfo[0].SnapshotId
+	_, err = CloneSnapshot(DEVICE, "vol2", sid)
+	c.Assert(err, IsNil)
+
+	cv, err := VerifyClone(DEVICE, "vol2", sid)
+	c.Assert(err, IsNil)
+	c.Assert(cv.Extents, Equals, uint(2))
+	c.Assert(cv.Mismatches, HasLen, 0)
+
+	// Changes to the clone, including in extents the snapshot does not have, are reported as ranges
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{1, 2, extentBlocks + 5, 3 * extentBlocks}, blockData[2:6])
+	c.Assert(vc.CloseVolume(), IsNil)
+	cv, err = VerifyClone(DEVICE, "vol2", sid)
+	c.Assert(err, IsNil)
+	c.Assert(cv.Extents, Equals, uint(3))
+	c.Assert(cv.Mismatches, DeepEquals, []VolumeRange{
+		{Offset: BLOCK_SIZE, Length: 2 * BLOCK_SIZE},
+		{Offset: EXTENT_SIZE + 5*BLOCK_SIZE, Length: BLOCK_SIZE},
+		{Offset: 3 * EXTENT_SIZE, Length: BLOCK_SIZE},
+	})
+
+	_, err = VerifyClone(DEVICE, "vol3", sid)
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	// Clean up
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(DeleteVolume(DEVICE, "vol2"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestCloneJob(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+	blocks := []int{0, extentBlocks + 5, 3 * extentBlocks, 5 * extentBlocks}
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, blocks, blockData[0:4])
+	c.Assert(vc.CloseVolume(), IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	sid := snapshotInfo[0].SnapshotId
+
+	_, _, err = CloneSnapshotJob(DEVICE, "vol1", sid, nil, nil)
+	c.Assert(errors.Is(err, ErrVolumeExists), Equals, true)
+	_, err = GetJob(DEVICE, 0)
+	c.Assert(errors.Is(err, ErrJobNotFound), Equals, true)
+
+	// The volume exists right away, and has the data once the job completes, copied within the limits
+	start := time.Now()
+	vi, ji, err := CloneSnapshotJob(DEVICE, "vol2", sid, nil, &CloneOptions{MaxBandwidth: 2 * BLOCK_SIZE})
+	c.Assert(err, IsNil)
+	c.Assert(vi.VolumeSize, Equals, uint64(GIGABYTE))
+	c.Assert(ji.Type, Equals, JOB_CLONE)
+	c.Assert(ji.Target, Equals, "vol2")
+	c.Assert(ji.Total, Equals, uint64(4*BLOCK_SIZE))
+	ji, err = WaitJob(DEVICE, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= 500*time.Millisecond, Equals, true)
+	c.Assert(ji.State, Equals, JOB_COMPLETED)
+	c.Assert(ji.Done, Equals, ji.Total)
+	c.Assert(ji.FinishedAt.IsZero(), Equals, false)
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blocks, blockData[0:4])
+	c.Assert(vc.CloseVolume(), IsNil)
+
+	// Cancelled clones are destroyed
+	_, ji, err = CloneSnapshotJob(DEVICE, "vol3", sid, nil, &CloneOptions{MaxIops: 2})
+	c.Assert(err, IsNil)
+	err = QuiesceDevice(DEVICE, 0)
+	c.Assert(errors.Is(err, ErrShutdownPending), Equals, true)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(".*jobs running: %v", ji.JobId))
+	c.Assert(CancelJob(DEVICE, ji.JobId), IsNil)
+	c.Assert(QuiesceDevice(DEVICE, 10*time.Second), IsNil)
+	ji, err = WaitJob(DEVICE, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_CANCELLED)
+	c.Assert(ji.Done < ji.Total, Equals, true)
+	_, err = OpenVolume(DEVICE, "vol3")
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+	jobs, err := ListJobs(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(len(jobs) >= 2, Equals, true)
+	c.Assert(jobs[len(jobs)-1].JobId, Equals, ji.JobId)
+
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(DeleteVolume(DEVICE, "vol2"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestJobTable(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+	blocks := []int{0, extentBlocks + 5, 3 * extentBlocks, 5 * extentBlocks}
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, blocks, blockData[0:4])
+	c.Assert(vc.CloseVolume(), IsNil)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	sid := snapshotInfo[0].SnapshotId
+
+	// A clone interrupted after copying the first block, as left by a process that exited
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, blocks[0:1], blockData[4:5])
+	c.Assert(vc.CloseVolume(), IsNil)
+	_, err = CreateVolume(DEVICE, "vol3", GIGABYTE)
+	c.Assert(err, IsNil)
+	past := time.Now().Add(-2 * JOB_STALE_AFTER).Unix()
+	clone, err := volumeJobRecord(DEVICE, JOB_TYPE_CLONE, "vol2")
+	c.Assert(err, IsNil)
+	clone.JobId = 1000
+	clone.State = JOB_STATE_RUNNING
+	clone.SnapshotId = uint16(sid)
+	clone.Done = BLOCK_SIZE
+	clone.Total = 4 * BLOCK_SIZE
+	clone.StartedAt = past
+	clone.UpdatedAt = past
+	ranged, err := volumeJobRecord(DEVICE, JOB_TYPE_CLONE, "vol3")
+	c.Assert(err, IsNil)
+	ranged.JobId = 1001
+	ranged.State = JOB_STATE_RUNNING
+	ranged.Flags = JOB_FLAG_RANGES
+	ranged.StartedAt = past
+	ranged.UpdatedAt = past
+	foreign := JobRecord{JobId: 1002, Type: JOB_TYPE_SCRUB, State: JOB_STATE_RUNNING, StartedAt: past, UpdatedAt: time.Now().Unix()}
+	err = updateJobTable(DEVICE, nil, func(records []JobRecord) error {
+		records[MAX_JOB_RECORDS-3] = clone
+		records[MAX_JOB_RECORDS-2] = ranged
+		records[MAX_JOB_RECORDS-1] = foreign
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	ji, err := GetJob(DEVICE, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_INTERRUPTED)
+	c.Assert(ji.Type, Equals, JOB_CLONE)
+	c.Assert(ji.Target, Equals, "vol2")
+	c.Assert(ji.Resumable, Equals, true)
+	jobs, err := ListJobs(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(len(jobs) >= 3, Equals, true)
+	c.Assert(jobs[len(jobs)-1].JobId, Equals, uint64(1002))
+	c.Assert(jobs[len(jobs)-1].State, Equals, JOB_RUNNING)
+
+	// Resuming skips the data already copied
+	ji, err = ResumeJob(DEVICE, 1000)
+	c.Assert(err, IsNil)
+	ji, err = WaitJob(DEVICE, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_COMPLETED)
+	c.Assert(ji.Done, Equals, ji.Total)
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, blocks, append(blockData[4:5:5], blockData[1:4]...))
+	c.Assert(vc.CloseVolume(), IsNil)
+	_, err = ResumeJob(DEVICE, 1000)
+	c.Assert(errors.Is(err, ErrJobNotResumable), Equals, true)
+
+	// Clones of ranges cannot be resumed, but cancelling them destroys the volume
+	ji, err = GetJob(DEVICE, 1001)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_INTERRUPTED)
+	c.Assert(ji.Resumable, Equals, false)
+	_, err = ResumeJob(DEVICE, 1001)
+	c.Assert(errors.Is(err, ErrJobNotResumable), Equals, true)
+	c.Assert(CancelJob(DEVICE, 1001), IsNil)
+	ji, err = GetJob(DEVICE, 1001)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_CANCELLED)
+	_, err = OpenVolume(DEVICE, "vol3")
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	// Jobs of live processes are asked to stop through the table
+	c.Assert(CancelJob(DEVICE, 1002), IsNil)
+	_, rec, info, err := findJobRecord(DEVICE, 1002)
+	c.Assert(err, IsNil)
+	c.Assert(info.State, Equals, JOB_RUNNING)
+	c.Assert(rec.Flags&JOB_FLAG_CANCEL, Equals, uint8(JOB_FLAG_CANCEL))
+
+	// New jobs get higher ids, and background vacuums clean up
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(DeleteVolume(DEVICE, "vol2"), IsNil)
+	ji, err = VacuumDeviceJob(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(ji.JobId, Equals, uint64(1003))
+	ji, err = WaitJob(DEVICE, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_COMPLETED)
+	err = updateJobTable(DEVICE, nil, func(records []JobRecord) error {
+		for i := range records {
+			records[i] = JobRecord{}
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestConcatSplitVolumes(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	_, err := CreateVolume(DEVICE, "vol1", 2*EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", 3*EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, extentBlocks + 1}, blockData[0:2])
+	_, err = ConcatVolumes(DEVICE, "vol3", []string{"vol1", "vol2"})
+	c.Assert(err, NotNil)
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol2")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{2*extentBlocks + 2}, blockData[2:3])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	_, err = ConcatVolumes(DEVICE, "vol3", []string{"vol1", "vol1"})
+	c.Assert(err, NotNil)
+	_, err = ConcatVolumes(DEVICE, "vol3", []string{"vol1", "vol4"})
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	// Extents are handed over without allocating new ones
+	deviceInfo, err := GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	allocated := deviceInfo.AllocatedDeviceExtents
+	vi, err := ConcatVolumes(DEVICE, "vol3", []string{"vol1", "vol2"})
+	c.Assert(err, IsNil)
+	c.Assert(vi.VolumeSize, Equals, uint64(5*EXTENT_SIZE))
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+	deviceInfo, err = GetDeviceInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, allocated)
+	vc, err = OpenVolume(DEVICE, "vol3")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, extentBlocks + 1, 4*extentBlocks + 2}, blockData[0:3])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Splitting takes the extents from the offset on
+	_, err = SplitVolume(DEVICE, "vol3", "vol4", BLOCK_SIZE)
+	c.Assert(err, NotNil)
+	_, err = CreateSnapshot(DEVICE, "vol3", nil)
+	c.Assert(err, IsNil)
+	_, err = SplitVolume(DEVICE, "vol3", "vol4", EXTENT_SIZE)
+	c.Assert(err, NotNil)
+	_, _, err = DeleteSnapshots(DEVICE, "vol3", nil)
+	c.Assert(err, IsNil)
+	vi, err = SplitVolume(DEVICE, "vol3", "vol4", EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	c.Assert(vi.VolumeSize, Equals, uint64(4*EXTENT_SIZE))
+	vc, err = OpenVolume(DEVICE, "vol3")
+	c.Assert(err, IsNil)
+	c.Assert(vc.VolumeSize(), Equals, uint64(EXTENT_SIZE))
+	readBlocks(c, vc, []int{0}, blockData[0:1])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol4")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{1, 3*extentBlocks + 2}, blockData[1:3])
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+
+	// Clean up
+	err = DeleteVolume(DEVICE, "vol3")
+	c.Assert(err, IsNil)
+	err = DeleteVolume(DEVICE, "vol4")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestReservedRegion(c *C) {
+	device, err := CreateMemoryDevice("reserved", DEVICE_SIZE+8*EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	c.Assert(InitDevice(device, WithReservedRegion(9*EXTENT_SIZE)), NotNil)
+	c.Assert(InitDevice(device), IsNil)
+	deviceInfo, err := GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.ReservedSize, Equals, uint64(0))
+	c.Assert(deviceInfo.ReservedOffset, Equals, deviceInfo.DeviceSize)
+	totalExtents := deviceInfo.TotalDeviceExtents
+
+	// The region is left out of the data area
+	c.Assert(InitDevice(device, WithForce(), WithReservedRegion(8*EXTENT_SIZE-BLOCK_SIZE)), IsNil)
+	deviceInfo, err = GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.ReservedSize, Equals, uint64(8*EXTENT_SIZE))
+	c.Assert(deviceInfo.ReservedOffset, Equals, uint64(DEVICE_SIZE))
+	c.Assert(deviceInfo.TotalDeviceExtents, Equals, totalExtents-8)
+	foreign := memoryDevices["reserved"].data[DEVICE_SIZE:]
+	for i := range foreign {
+		foreign[i] = 0xff
+	}
+
+	// Filling the device never touches it
+	_, err = CreateVolume(device, "vol1", uint64(deviceInfo.TotalDeviceExtents)*EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.Preallocate(0, vc.VolumeSize(), true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	_, err = CreateVolume(device, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(device, "vol2")
+	c.Assert(err, IsNil)
+	c.Assert(errors.Is(vc.WriteBlock(make([]byte, BLOCK_SIZE), 0, true), ErrNoSpace), Equals, true)
+	c.Assert(vc.CloseVolume(), IsNil)
+	deviceInfo, err = GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.AllocatedDeviceExtents, Equals, deviceInfo.TotalDeviceExtents)
+	c.Assert(bytes.Count(foreign, []byte{0xff}), Equals, len(foreign))
+}
+
+func (s *TestSuite) TestFeatureFlags(c *C) {
+	device, err := CreateMemoryDevice("features", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	c.Assert(InitDevice(device), IsNil)
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	sid, err := CreateSnapshot(device, "vol1", nil)
+	c.Assert(err, IsNil)
+	// Written directly, as devices with unknown incompatible features cannot be opened
+	setFeatures := func(compat uint32, roCompat uint32, incompat uint32) {
+		data := memoryDevices["features"].data
+		var sb Superblock
+		c.Assert(format.Unmarshal(data, &sb), IsNil)
+		sb.FeatureCompat = compat
+		sb.FeatureRoCompat = roCompat
+		sb.FeatureIncompat = incompat
+		buf, err := format.Marshal(&sb)
+		c.Assert(err, IsNil)
+		copy(data, buf)
+	}
+
+	// Unknown compatible features are ignored
+	setFeatures(0x80000000, 0, 0)
+	_, err = CreateVolume(device, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Unknown read-only compatible features allow reading only
+	setFeatures(0, 0x80000000, 0)
+	_, err = GetVolumeInfo(device)
+	c.Assert(err, IsNil)
+	vc, err := OpenSnapshot(device, uint(sid-1))
+	c.Assert(err, IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	_, err = CreateVolume(device, "vol3", GIGABYTE)
+	c.Assert(errors.Is(err, ErrUnsupportedFeature), Equals, true)
+	_, err = OpenVolume(device, "vol1")
+	c.Assert(errors.Is(err, ErrUnsupportedFeature), Equals, true)
+
+	// Unknown incompatible features prevent any use
+	setFeatures(0, 0, 0x80000000)
+	_, err = GetVolumeInfo(device)
+	c.Assert(errors.Is(err, ErrUnsupportedFeature), Equals, true)
+	_, err = OpenSnapshot(device, uint(sid-1))
+	c.Assert(errors.Is(err, ErrUnsupportedFeature), Equals, true)
+	setFeatures(0, 0, 0)
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+}
+
+func (s *TestSuite) TestMirror(c *C) {
+	for _, name := range []string{"mirror0", "mirror1"} {
+		_, err := CreateMemoryDevice(name, DEVICE_SIZE)
+		c.Assert(err, IsNil)
+		defer RemoveMemoryDevice(name)
+	}
+	RegisterBackend("faulty", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "faulty://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		return &faultyBackend{BlockBackend: mf}, nil
+	})
+	device := "mirror://mem://mirror0,faulty://mirror1"
+	defer delete(mirrorStates, device)
+	inSync := func() bool {
+		return bytes.Equal(memoryDevices["mirror0"].data, memoryDevices["mirror1"].data)
+	}
+	c.Assert(InitDevice(device), IsNil)
+	_, err := CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	events, cancel := Watch(device, nil)
+	defer cancel()
+	vc, err := OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{0x01}, BLOCK_SIZE)
+	c.Assert(vc.WriteAt(data, 0, true), IsNil)
+	c.Assert(inSync(), Equals, true)
+
+	// Writes go on to the other copy after one fails
+	offset, _, err := vc.DeviceOffset(0)
+	c.Assert(err, IsNil)
+	fb := vc.dc.f.BlockBackend.(*mirrorBackend).copies[1].BlockBackend.(*faultyBackend)
+	fb.offset.Store(offset)
+	fb.failures.Store(-1)
+	data = bytes.Repeat([]byte{0x02}, BLOCK_SIZE)
+	c.Assert(vc.WriteAt(data, 0, true), IsNil)
+	select {
+	case e := <-events:
+		c.Assert(e.Type, Equals, EVENT_MIRROR_DEGRADED)
+		c.Assert(strings.HasPrefix(e.Detail, "faulty://mirror1"), Equals, true)
+	case <-time.After(time.Second):
+		c.Fatal("no event")
+	}
+	fb.failures.Store(0)
+	c.Assert(vc.WriteAt(data, EXTENT_SIZE, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	deviceInfo, err := GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.MirrorFailed, Equals, "faulty://mirror1")
+	c.Assert(inSync(), Equals, false)
+
+	// A copy left behind is found by its superblock when the mirror is opened again
+	delete(mirrorStates, device)
+	deviceInfo, err = GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.MirrorFailed, Equals, "faulty://mirror1")
+
+	c.Assert(ResyncMirror(device), IsNil)
+	c.Assert(inSync(), Equals, true)
+	deviceInfo, err = GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.MirrorFailed, Equals, "")
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	buf := make([]byte, BLOCK_SIZE)
+	c.Assert(vc.ReadAt(buf, EXTENT_SIZE), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(vc.CloseVolume(), IsNil)
+	c.Assert(ResyncMirror(DEVICE), NotNil)
+
+	// The extent time table, past the allocation mark, is resynced as well
+	c.Assert(SetDeviceExtentTimes(device, true), IsNil)
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	fb = vc.dc.f.BlockBackend.(*mirrorBackend).copies[1].BlockBackend.(*faultyBackend)
+	fb.offset.Store(offset)
+	fb.failures.Store(-1)
+	c.Assert(vc.WriteAt(data, 0, true), IsNil)
+	fb.failures.Store(0)
+	start := time.Now().Truncate(time.Second)
+	c.Assert(vc.WriteAt(data, 2*EXTENT_SIZE, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	c.Assert(ResyncMirror(device), IsNil)
+	c.Assert(inSync(), Equals, true)
+	volumeInfo, err := GetVolumeInfo("mem://mirror1")
+	c.Assert(err, IsNil)
+	ranges, err := GetSnapshotRanges("mem://mirror1", volumeInfo[0].SnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 3)
+	c.Assert(ranges[2].ModifiedAt.Before(start), Equals, false)
+}
+
+func (s *TestSuite) TestScrub(c *C) {
+	_, err := CreateMemoryDevice("scrub", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice("scrub")
+	var failAt atomic.Uint64
+	RegisterBackend("faulty", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "faulty://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		fb := &faultyBackend{BlockBackend: mf}
+		if offset := failAt.Load(); offset != 0 {
+			fb.offset.Store(offset)
+			fb.failures.Store(-1)
+		}
+		return fb, nil
+	})
+	device := "faulty://scrub"
+	defer delete(scrubStatuses, device)
+	c.Assert(InitDevice(device), IsNil)
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{0x01}, BLOCK_SIZE)
+	for i := uint64(0); i < 3; i++ {
+		c.Assert(vc.WriteAt(data, i*EXTENT_SIZE, true), IsNil)
+	}
+	offset, _, err := vc.DeviceOffset(EXTENT_SIZE)
+	c.Assert(err, IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	deviceInfo, err := GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.Scrub, IsNil)
+
+	events, cancel := Watch(device, nil)
+	defer cancel()
+	status, err := ScrubDevice(device, 0)
+	c.Assert(err, IsNil)
+	c.Assert(status.Running, Equals, false)
+	c.Assert(status.ExtentsScrubbed, Equals, uint(3))
+	c.Assert(status.MediaErrors, Equals, uint(0))
+	c.Assert(status.ChecksumErrors, Equals, uint(0))
+	c.Assert((<-events).Type, Equals, EVENT_SCRUB_COMPLETED)
+
+	// Damage an extent and the previous copy of the metadata
+	dc, err := GetSharedDeviceContext(device)
+	c.Assert(err, IsNil)
+	inactive := uint(1 - dc.superblock.ActiveMetadata)
+	memoryDevices["scrub"].data[dc.metadataOffset+inactive*dc.metadataSize] ^= 0xff
+	c.Assert(dc.Close(), IsNil)
+	failAt.Store(offset)
+	stop := StartScrubber(device, 10*time.Millisecond, 0)
+	var problems []string
+	for e := range events {
+		if e.Type == EVENT_SCRUB_COMPLETED {
+			break
+		}
+		c.Assert(e.Type, Equals, EVENT_SCRUB_ERROR)
+		problems = append(problems, e.Detail)
+	}
+	stop()
+	c.Assert(problems, HasLen, 2)
+	c.Assert(problems[0], Equals, fmt.Sprintf("checksum mismatch in metadata copy %v", inactive))
+	c.Assert(strings.Contains(problems[1], fmt.Sprintf("at device offset %v: ", offset)), Equals, true)
+	deviceInfo, err = GetDeviceInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(deviceInfo.Scrub.Running, Equals, false)
+	c.Assert(deviceInfo.Scrub.CompletedAt.IsZero(), Equals, false)
+	c.Assert(deviceInfo.Scrub.ExtentsScrubbed, Equals, uint(3))
+	c.Assert(deviceInfo.Scrub.MediaErrors, Equals, uint(1))
+	c.Assert(deviceInfo.Scrub.ChecksumErrors, Equals, uint(1))
+}
+
+func (s *TestSuite) TestSnapshotCatalog(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	sid1, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Name: "daily-1", Labels: map[string]string{"k": "v"}})
+	c.Assert(err, IsNil)
+	sid2, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{Name: "daily-2"})
+	c.Assert(err, IsNil)
+	catalog, err := ExportCatalog(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(catalog.Snapshots, HasLen, 3)
+	data, err := json.Marshal(catalog)
+	c.Assert(err, IsNil)
+	catalog = &SnapshotCatalog{}
+	c.Assert(json.Unmarshal(data, catalog), IsNil)
+
+	// Labels and names are put back, even if names moved between snapshots
+	c.Assert(SetSnapshotName(DEVICE, sid1, ""), IsNil)
+	c.Assert(SetSnapshotName(DEVICE, sid2, "daily-1"), IsNil)
+	catalog.Snapshots[1].Labels["k2"] = "v2"
+	catalog.Snapshots = append(catalog.Snapshots, SnapshotInfo{SnapshotId: 100, CreatedAt: time.Now()})
+	result, err := ImportCatalog(DEVICE, catalog)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, HasLen, 3)
+	c.Assert(result.Skipped, DeepEquals, []uint{100})
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].Name, Equals, "daily-2")
+	c.Assert(snapshotInfo[1].Name, Equals, "daily-1")
+	c.Assert(snapshotInfo[1].Labels, DeepEquals, map[string]string{"k": "v", "k2": "v2"})
+
+	// Snapshots with the same id but created at another time are skipped, and names not in the catalog kept
+	catalog.Snapshots = catalog.Snapshots[1:3]
+	catalog.Snapshots[0].Name = "weekly-1"
+	catalog.Snapshots[1].CreatedAt = catalog.Snapshots[1].CreatedAt.Add(-time.Hour)
+	catalog.Snapshots[1].Name = "weekly-2"
+	result, err = ImportCatalog(DEVICE, catalog)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, DeepEquals, []uint{sid1})
+	c.Assert(result.Skipped, DeepEquals, []uint{sid2})
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[0].Name, Equals, "daily-2")
+	c.Assert(snapshotInfo[1].Name, Equals, "weekly-1")
+
+	// Nothing is changed if a name clashes with a snapshot left alone
+	catalog.Snapshots = catalog.Snapshots[:1]
+	catalog.Snapshots[0].Name = "daily-2"
+	catalog.Snapshots[0].Labels = nil
+	_, err = ImportCatalog(DEVICE, catalog)
+	c.Assert(errors.Is(err, ErrSnapshotExists), Equals, true)
+	snapshotInfo, err = GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo[1].Name, Equals, "weekly-1")
+	c.Assert(snapshotInfo[1].Labels, HasLen, 2)
+	catalog.CatalogVersion = CATALOG_VERSION + 1
+	_, err = ImportCatalog(DEVICE, catalog)
+	c.Assert(err, NotNil)
+
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestHooks(c *C) {
+	device, err := CreateMemoryDevice("hooks", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	c.Assert(InitDevice(device), IsNil)
+	var events []Event
+	remove := AddHook(device, func(e Event) {
+		events = append(events, e)
+	})
+	defer remove()
+	otherRemove := AddHook(DEVICE, func(e Event) {
+		c.Errorf("event of another device: %v", e.Type)
+	})
+	defer otherRemove()
+
+	// Hooks have run when the call returns
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Type, Equals, EVENT_VOLUME_CREATED)
+	c.Assert(events[0].VolumeName, Equals, "vol1")
+	c.Assert(events[0].Device, Equals, device)
+	sid, err := CreateSnapshot(device, "vol1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[1].Type, Equals, EVENT_SNAPSHOT_CREATED)
+	c.Assert(events[1].SnapshotId, Equals, sid)
+
+	// Hooks may remove themselves
+	var removeSelf func()
+	calls := 0
+	removeSelf = AddHook(device, func(e Event) {
+		calls++
+		removeSelf()
+	})
+	c.Assert(DeleteVolume(device, "vol1"), IsNil)
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[2].Type, Equals, EVENT_VOLUME_DELETED)
+	remove()
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 3)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *TestSuite) TestListSnapshots(c *C) {
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	base := time.Unix(1700000000, 0)
+	for i := 0; i < 4; i++ {
+		labels := map[string]string{"tier": "hourly"}
+		if i%2 == 0 {
+			labels["keep"] = "yes"
+		}
+		opts := &SnapshotOptions{CreatedAt: base.Add(time.Duration(i) * time.Hour), Labels: labels}
+		_, err = CreateSnapshot(DEVICE, "vol1", opts)
+		c.Assert(err, IsNil)
+	}
+	_, err = CreateSnapshot(DEVICE, "vol2", &SnapshotOptions{CreatedAt: base, Labels: map[string]string{"keep": "yes"}})
+	c.Assert(err, IsNil)
+	all, err := ListAllSnapshots(DEVICE)
+	c.Assert(err, IsNil)
+
+	// The zero query lists everything, and pages continue where the previous one stopped
+	si, next, err := ListSnapshots(DEVICE, nil)
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, uint(0))
+	c.Assert(si, DeepEquals, all)
+	si, next, err = ListSnapshots(DEVICE, &SnapshotQuery{Limit: 3})
+	c.Assert(err, IsNil)
+	c.Assert(si, DeepEquals, all[:3])
+	c.Assert(next, Equals, all[3].SnapshotId)
+	c.Assert(all, HasLen, 7)
+	si, next, err = ListSnapshots(DEVICE, &SnapshotQuery{StartId: next, Limit: 4})
+	c.Assert(err, IsNil)
+	c.Assert(si, DeepEquals, all[3:])
+	c.Assert(next, Equals, uint(0))
+
+	// Filters combine
+	si, _, err = ListSnapshots(DEVICE, &SnapshotQuery{VolumeName: "vol1", Labels: map[string]string{"keep": "yes"}})
+	c.Assert(err, IsNil)
+	c.Assert(si, HasLen, 2)
+	for i := range si {
+		c.Assert(si[i].VolumeName, Equals, "vol1")
+		c.Assert(si[i].Labels["keep"], Equals, "yes")
+	}
+	si, _, err = ListSnapshots(DEVICE, &SnapshotQuery{After: base.Add(time.Hour), Before: base.Add(3 * time.Hour)})
+	c.Assert(err, IsNil)
+	c.Assert(si, HasLen, 2)
+	c.Assert(si[0].CreatedAt.Equal(base.Add(time.Hour)), Equals, true)
+	c.Assert(si[1].CreatedAt.Equal(base.Add(2*time.Hour)), Equals, true)
+	_, _, err = ListSnapshots(DEVICE, &SnapshotQuery{VolumeName: "vol3"})
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	// Iteration stops when asked to or at the limit
+	var ids []uint
+	err = EachSnapshot(DEVICE, &SnapshotQuery{Labels: map[string]string{"keep": "yes"}}, func(si SnapshotInfo) bool {
+		ids = append(ids, si.SnapshotId)
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 3)
+	ids = nil
+	err = EachSnapshot(DEVICE, &SnapshotQuery{Limit: 4}, func(si SnapshotInfo) bool {
+		ids = append(ids, si.SnapshotId)
+		return len(ids) < 2
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []uint{all[0].SnapshotId, all[1].SnapshotId})
+
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(DeleteVolume(DEVICE, "vol2"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestFindSnapshotAt(c *C) {
+	base := time.Unix(1700000000, 0)
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	var sids []uint
+	for i := 0; i < 3; i++ {
+		sid, err := CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{CreatedAt: base.Add(time.Duration(i) * time.Hour)})
+		c.Assert(err, IsNil)
+		sids = append(sids, sid)
+	}
+
+	// The latest snapshot not after the time, inclusive
+	si, err := FindSnapshotAt(DEVICE, "vol1", base.Add(90*time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(si.SnapshotId, Equals, sids[1])
+	c.Assert(si.VolumeName, Equals, "vol1")
+	si, err = FindSnapshotAt(DEVICE, "vol1", base.Add(2*time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(si.SnapshotId, Equals, sids[2])
+	si, err = FindSnapshotAt(DEVICE, "vol1", base)
+	c.Assert(err, IsNil)
+	c.Assert(si.SnapshotId, Equals, sids[0])
+
+	// The first snapshot of the volume was created now, after those given older times
+	vi, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	si, err = FindSnapshotAt(DEVICE, "vol1", time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(si.SnapshotId, Not(Equals), vi[0].SnapshotId)
+	c.Assert(si.ParentSnapshotId, Equals, uint(0))
+
+	_, err = FindSnapshotAt(DEVICE, "vol1", base.Add(-time.Second))
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+	_, err = FindSnapshotAt(DEVICE, "vol2", base)
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestOpenVolumeAsOf(c *C) {
+	blockData := loadBlocks()
+	start := time.Now()
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+
+	// Each snapshot holds the writes made from its creation until the next one
+	writeBlocks(c, vc, []int{0}, blockData[0:1])
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{CreatedAt: start.Add(time.Hour)})
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[1:2])
+	_, err = CreateSnapshot(DEVICE, "vol1", &SnapshotOptions{CreatedAt: start.Add(2 * time.Hour)})
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[2:3])
+
+	for i, t := range []time.Time{start.Add(time.Minute), start.Add(90 * time.Minute), start.Add(3 * time.Hour)} {
+		svc, err := OpenVolumeAsOf(DEVICE, "vol1", t)
+		c.Assert(err, IsNil)
+		c.Assert(svc.ReadOnly(), Equals, true)
+		readBlocks(c, svc, []int{0}, blockData[i:i+1])
+		svc.CloseVolume()
+	}
+	_, err = OpenVolumeAsOf(DEVICE, "vol1", start.Add(-time.Hour))
+	c.Assert(errors.Is(err, ErrSnapshotNotFound), Equals, true)
+	vc.CloseVolume()
+
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+func (s *TestSuite) TestVolumeRetention(c *C) {
+	blockData := loadBlocks()
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[0:1])
+	featureRoCompat := func() uint32 {
+		dc, err := GetDeviceContext(DEVICE)
+		c.Assert(err, IsNil)
+		defer dc.Close()
+		return dc.superblock.FeatureRoCompat
+	}
+	c.Assert(featureRoCompat()&FEATURE_RO_COMPAT_RETENTION, Equals, uint32(0))
+	until := time.Now().Add(time.Hour)
+	c.Assert(SetVolumeRetention(DEVICE, "vol1", until), IsNil)
+	c.Assert(featureRoCompat()&FEATURE_RO_COMPAT_RETENTION, Not(Equals), uint32(0))
+	volumeInfo, err := GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].RetainUntil.Equal(time.Unix(until.Unix(), 0)), Equals, true)
+	err = SetVolumeRetention(DEVICE, "vol1", time.Unix(1<<33, 0))
+	c.Assert(err, NotNil)
+
+	// Blocks are written once, in full or in part, and cannot be unmapped
+	err = vc.WriteAt(blockData[1], 0, true)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	err = vc.WriteAt(blockData[1][:512], 512, true)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	err = vc.UnmapAt(BLOCK_SIZE, 0)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	c.Assert(vc.Preallocate(0, EXTENT_SIZE, true), NotNil)
+	writeBlocks(c, vc, []int{1, 2, 3}, blockData[1:4])
+	err = vc.WriteAt(bytes.Join(blockData[0:2], nil), 2*BLOCK_SIZE, true)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	c.Assert(vc.UnmapAt(BLOCK_SIZE, 4*BLOCK_SIZE), IsNil)
+	readBlocks(c, vc, []int{0, 1, 2, 3}, blockData[0:4])
+
+	// Including those of previous snapshots, which cannot be deleted, nor the volume
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	err = vc.WriteAt(blockData[1], 0, true)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	snapshotInfo, err := GetSnapshotInfo(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = DeleteSnapshot(DEVICE, snapshotInfo[1].SnapshotId)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	_, _, err = DeleteSnapshots(DEVICE, "vol1", nil)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	_, err = DeleteSnapshotSecure(DEVICE, snapshotInfo[1].SnapshotId, false)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	_, err = DeleteVolumeSecure(DEVICE, "vol1", false)
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+
+	// Retention can only be extended while it lasts
+	err = SetVolumeRetention(DEVICE, "vol1", until.Add(-time.Minute))
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	err = SetVolumeRetention(DEVICE, "vol1", time.Time{})
+	c.Assert(errors.Is(err, ErrRetained), Equals, true)
+	c.Assert(SetVolumeRetention(DEVICE, "vol1", until.Add(time.Hour)), IsNil)
+
+	// Once it has passed, the volume can be changed again
+	dc, err := GetDeviceContext(DEVICE)
+	c.Assert(err, IsNil)
+	dc.setRetainUntil(dc.FindVolume("vol1"), uint32(time.Now().Add(-time.Second).Unix()))
+	c.Assert(dc.WriteMetadata(), IsNil)
+	c.Assert(dc.Close(), IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[1:2])
+	vc.CloseVolume()
+
+	// Without write once volumes, the device can be changed by versions that do not know of retention
+	c.Assert(SetVolumeRetention(DEVICE, "vol1", time.Time{}), IsNil)
+	c.Assert(featureRoCompat()&FEATURE_RO_COMPAT_RETENTION, Equals, uint32(0))
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[0].RetainUntil.IsZero(), Equals, true)
+
+	c.Assert(DeleteVolume(DEVICE, "vol1"), IsNil)
+	c.Assert(VacuumDevice(DEVICE), IsNil)
+}
+
+// Backend counting syncs, which are also the flushes of a backend without a cache.
+type syncRecorder struct {
+	BlockBackend
+	syncs int
+	fail  bool // Fail syncs with EIO
+}
+
+func (sr *syncRecorder) Sync() error {
+	sr.syncs++
+	if sr.fail {
+		return &os.PathError{Op: "sync", Path: "sync", Err: syscall.EIO}
+	}
+	return sr.BlockBackend.Sync()
+}
+
+func (s *TestSuite) TestSyncPolicy(c *C) {
+	blockData := loadBlocks()
+	extentBlocks := 1 << BLOCK_BITS_IN_EXTENT
+
+	device, err := CreateMemoryDevice("sync", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	var sr *syncRecorder
+	RegisterBackend("sync", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "sync://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		sr = &syncRecorder{BlockBackend: mf}
+		return sr, nil
+	})
+	c.Assert(InitDevice("sync://sync"), IsNil)
+	_, err = CreateVolume("sync://sync", "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = OpenVolume("sync://sync", "vol1", WithSyncPolicy(3))
+	c.Assert(err, NotNil)
+
+	// Each allocation updates the superblock and the extent metadata twice
+	syncs := func(policy uint) int {
+		vc, err := OpenVolume("sync://sync", "vol1", WithSyncPolicy(policy))
+		c.Assert(err, IsNil)
+		defer vc.CloseVolume()
+		start := sr.syncs
+		for i := 0; i < 4; i++ {
+			writeBlocks(c, vc, []int{(int(policy)*4 + i) * extentBlocks}, blockData)
+		}
+		n := sr.syncs - start
+		c.Assert(vc.Sync(), IsNil)
+		c.Assert(sr.syncs > start+n, Equals, true)
+		return n
+	}
+	c.Assert(syncs(SYNC_POLICY_STRICT), Equals, 12)
+	c.Assert(syncs(SYNC_POLICY_RELAXED), Equals, 1)
+	c.Assert(syncs(SYNC_POLICY_UNSAFE), Equals, 0)
+
+	// Volumes with updates not flushed stay open if they cannot be
+	vc, err := OpenVolume("sync://sync", "vol1", WithSyncPolicy(SYNC_POLICY_UNSAFE))
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{16 * extentBlocks}, blockData)
+	sr.fail = true
+	err = vc.CloseVolume()
+	c.Assert(errors.Is(err, ErrShutdownPending), Equals, true)
+	err = QuiesceDevice("sync://sync", 0)
+	c.Assert(errors.Is(err, ErrShutdownPending), Equals, true)
+	c.Assert(err, ErrorMatches, ".*volumes open: vol1")
+	sr.fail = false
+	c.Assert(vc.CloseVolume(), IsNil)
+	c.Assert(QuiesceDevice("sync://sync", 0), IsNil)
+
+	name, err := ParseSyncPolicy("relaxed")
+	c.Assert(err, IsNil)
+	c.Assert(SyncPolicyName(name), Equals, "relaxed")
+	_, err = ParseSyncPolicy("never")
+	c.Assert(err, NotNil)
+}
+
+// Backend counting writes.
+type writeRecorder struct {
+	BlockBackend
+	writes int
+}
+
+func (wr *writeRecorder) WriteAt(data []byte, offset uint64) (int, error) {
+	wr.writes++
+	return wr.BlockBackend.WriteAt(data, offset)
+}
+
+func (s *TestSuite) TestWriteCoalescing(c *C) {
+	device, err := CreateMemoryDevice("coalesce", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	var wr *writeRecorder
+	RegisterBackend("coalesce", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "coalesce://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		wr = &writeRecorder{BlockBackend: mf}
+		return wr, nil
+	})
+	c.Assert(InitDevice("coalesce://coalesce"), IsNil)
+	_, err = CreateVolume("coalesce://coalesce", "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Writes of a block in sectors take one write of data and one of extent metadata
+	writeSectors := func(vc *VolumeContext, block uint64) int {
+		start := wr.writes
+		sector := make([]byte, 512)
+		for i := uint64(0); i < 8; i++ {
+			sector[0] = byte(block*8 + i)
+			c.Assert(vc.WriteSector(sector, block*8+i, true), IsNil)
+		}
+		return wr.writes - start
+	}
+	vc, err := OpenVolume("coalesce://coalesce", "vol1", WithSectorSize(512))
+	c.Assert(err, IsNil)
+	c.Assert(writeSectors(vc, 0) > 1, Equals, true)
+	c.Assert(writeSectors(vc, 1), Equals, 9)
+	vc.CloseVolume()
+	vc, err = OpenVolume("coalesce://coalesce", "vol1", WithSectorSize(512), WithWriteCoalescing())
+	c.Assert(err, IsNil)
+	c.Assert(writeSectors(vc, 2), Equals, 2)
+
+	// Staged writes are read back, and written on sync
+	sector := make([]byte, 512)
+	sector[0] = 100
+	c.Assert(vc.WriteSector(sector, 25, true), IsNil)
+	c.Assert(vc.staged, NotNil)
+	c.Assert(vc.ReadSector(sector, 25), IsNil)
+	c.Assert(sector[0], Equals, byte(100))
+	c.Assert(vc.ReadSector(sector, 24), IsNil)
+	c.Assert(sector[0], Equals, byte(0))
+	c.Assert(vc.Sync(), IsNil)
+	c.Assert(vc.staged, IsNil)
+
+	// Staged writes are written before others to the block, and on close
+	sector[0] = 101
+	c.Assert(vc.WriteSector(sector, 26, true), IsNil)
+	sector[0] = 102
+	c.Assert(vc.WriteAt(sector, 27*512, false), IsNil)
+	c.Assert(vc.staged, IsNil)
+	sector[0] = 103
+	c.Assert(vc.WriteSector(sector, 28, true), IsNil)
+	vc.CloseVolume()
+	vc, err = OpenVolume("coalesce://coalesce", "vol1", WithSectorSize(512))
+	c.Assert(err, IsNil)
+	for i, v := range []byte{16, 20, 23, 100, 101, 102, 103} {
+		c.Assert(vc.ReadSector(sector, []uint64{16, 20, 23, 25, 26, 27, 28}[i]), IsNil)
+		c.Assert(sector[0], Equals, v)
+	}
+	vc.CloseVolume()
+}
+
+func (s *TestSuite) TestMultiBlockIO(c *C) {
+	device, err := CreateMemoryDevice("multiblock", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	var wr *writeRecorder
+	RegisterBackend("multiblock", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "multiblock://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		wr = &writeRecorder{BlockBackend: mf}
+		return wr, nil
+	})
+	c.Assert(InitDevice("multiblock://multiblock"), IsNil)
+	_, err = CreateVolume("multiblock://multiblock", "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume("multiblock://multiblock", "vol1")
+	c.Assert(err, IsNil)
+
+	// Once the extent is allocated, a run of blocks takes one write of data and one of extent metadata
+	expected := make([]byte, 4*EXTENT_SIZE)
+	writes := 0
+	write := func(offset uint64, length uint64) int {
+		writes++
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = byte(i/BLOCK_SIZE + i%251 + writes)
+		}
+		copy(expected[offset:], data)
+		start := wr.writes
+		c.Assert(vc.WriteAt(data, offset, true), IsNil)
+		return wr.writes - start
+	}
+	write(EXTENT_SIZE, BLOCK_SIZE)
+	c.Assert(write(EXTENT_SIZE, 64*BLOCK_SIZE), Equals, 2)
+	c.Assert(write(EXTENT_SIZE, 64*BLOCK_SIZE), Equals, 1)
+
+	// Runs across extents, partial blocks and unallocated blocks read back as written
+	write(EXTENT_SIZE-3*BLOCK_SIZE-100, EXTENT_SIZE+200*BLOCK_SIZE)
+	write(3*EXTENT_SIZE+10*BLOCK_SIZE, 20*BLOCK_SIZE)
+	check := func(vc *VolumeContext) {
+		data := make([]byte, len(expected))
+		c.Assert(vc.ReadAt(data, 0), IsNil)
+		c.Assert(bytes.Equal(data, expected), Equals, true)
+		c.Assert(vc.ReadAt(data[0:EXTENT_SIZE], BLOCK_SIZE+512), IsNil)
+		c.Assert(bytes.Equal(data[0:EXTENT_SIZE], expected[BLOCK_SIZE+512:EXTENT_SIZE+BLOCK_SIZE+512]), Equals, true)
+	}
+	check(vc)
+
+	// Runs are copied on write after a snapshot, and the snapshot keeps its data
+	c.Assert(vc.CloseVolume(), IsNil)
+	vi, err := GetVolumeInfo("multiblock://multiblock")
+	c.Assert(err, IsNil)
+	_, err = CreateSnapshot("multiblock://multiblock", "vol1", nil)
+	c.Assert(err, IsNil)
+	before := slices.Clone(expected)
+	vc, err = OpenVolume("multiblock://multiblock", "vol1")
+	c.Assert(err, IsNil)
+	write(EXTENT_SIZE/2, 2*EXTENT_SIZE)
+	check(vc)
+	c.Assert(vc.CloseVolume(), IsNil)
+	vc, err = OpenSnapshot("multiblock://multiblock", vi[0].SnapshotId)
+	c.Assert(err, IsNil)
+	expected = before
+	check(vc)
+	c.Assert(vc.CloseVolume(), IsNil)
+}
+
+func (s *TestSuite) TestMemoryDevice(c *C) {
+	blockData := loadBlocks()
+
+	device, err := CreateMemoryDevice("test", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	_, err = CreateMemoryDevice("test", DEVICE_SIZE)
+	c.Assert(err, NotNil)
+	err = InitDevice(device)
+	c.Assert(err, IsNil)
+
+	// The full API works on the memory device
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	snapshotInfo, err := GetSnapshotInfo(device, "vol1")
+	c.Assert(err, IsNil)
+	_, err = CreateSnapshot(device, "vol1", nil)
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0}, blockData[3:4])
+	vc.CloseVolume()
+	_, err = CloneSnapshot(device, "vol1clone", snapshotInfo[0].SnapshotId)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(device, "vol1clone")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	vc.CloseVolume()
+	volumeInfo, err := GetVolumeInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+
+	// The file device is not affected
+	volumeInfo, err = GetVolumeInfo(DEVICE)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 0)
+
+	err = RemoveMemoryDevice(device)
+	c.Assert(err, IsNil)
+	_, err = GetVolumeInfo(device)
+	c.Assert(err, NotNil)
+}
+
+// Backend recording trimmed ranges.
+type trimRecorder struct {
+	BlockBackend
+	trimmed uint64
+}
+
+func (tr *trimRecorder) Trim(offset uint64, length uint64) error {
+	tr.trimmed += length
+	return tr.BlockBackend.Trim(offset, length)
+}
+
+func (s *TestSuite) TestBackends(c *C) {
+	blockData := loadBlocks()
+
+	// Serve a memory device over NBD
+	device, err := CreateMemoryDevice("nbd", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	mf, err := openMemoryFile(device)
+	c.Assert(err, IsNil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.Handle(conn, []*server.Export{{Name: "test", Backend: &nbdExport{mf}}}, nil)
+		}
+	}()
+
+	nbdDevice := "nbd://" + l.Addr().String() + "/test"
+	err = InitDevice(nbdDevice)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(nbdDevice, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(nbdDevice, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	vc.CloseVolume()
+
+	// The same contents are visible through the memory device
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	vc.CloseVolume()
+
+	_, err = GetVolumeInfo("nbd://" + l.Addr().String() + "/missing")
+	c.Assert(err, NotNil)
+	_, err = GetVolumeInfo("unknown://test")
+	c.Assert(err, ErrorMatches, ".*unsupported storage backend unknown")
+
+	// Released extents are trimmed
+	var tr *trimRecorder
+	RegisterBackend("trim", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "trim://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		tr = &trimRecorder{BlockBackend: mf}
+		return tr, nil
+	})
+	err = DeleteVolume("trim://nbd", "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(tr.trimmed, Equals, uint64(2*EXTENT_SIZE))
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, NotNil)
+}
+
+// Adapter serving a backend over NBD.
+type nbdExport struct {
+	BlockBackend
+}
+
+func (ne *nbdExport) ReadAt(p []byte, off int64) (int, error) {
+	return ne.BlockBackend.ReadAt(p, uint64(off))
+}
+
+func (ne *nbdExport) WriteAt(p []byte, off int64) (int, error) {
+	return ne.BlockBackend.WriteAt(p, uint64(off))
+}
+
+// Backend keeping the data of released extents, as devices without discard support do.
+type noTrimBackend struct {
+	BlockBackend
+}
+
+func (nt *noTrimBackend) Trim(offset uint64, length uint64) error {
+	return nil
+}
+
+func (s *TestSuite) TestSecureDelete(c *C) {
+	_, err := CreateMemoryDevice("shred", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(MEMORY_DEVICE_PREFIX + "shred")
+	RegisterBackend("notrim", func(name string, opts *Options) (BlockBackend, error) {
+		mf, err := openMemoryFile(strings.Replace(name, "notrim://", MEMORY_DEVICE_PREFIX, 1))
+		if err != nil {
+			return nil, err
+		}
+		return &noTrimBackend{BlockBackend: mf}, nil
+	})
+	device := "notrim://shred"
+	err = InitDevice(device)
+	c.Assert(err, IsNil)
+	data := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	blockAt := func(pos uint) []byte {
+		dc, err := GetSharedDeviceContext(device)
+		c.Assert(err, IsNil)
+		defer dc.Close()
+		buf := make([]byte, BLOCK_SIZE)
+		c.Assert(dc.ReadBlockData(buf, pos, 0), IsNil)
+		return buf
+	}
+
+	// The first extent is copied on write after the snapshot, so the snapshot releases it
+	vi, err := CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.WriteBlock(data, 0, true), IsNil)
+	c.Assert(vc.WriteBlock(data, 256, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	_, err = CreateSnapshot(device, "vol1", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vc.WriteBlock(data, 0, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	for pos := uint(0); pos < 3; pos++ {
+		c.Assert(blockAt(pos), DeepEquals, data)
+	}
+	ji, err := DeleteSnapshotSecure(device, vi.SnapshotId, false)
+	c.Assert(err, IsNil)
+	ji, err = WaitJob(device, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_COMPLETED)
+	c.Assert(ji.Type, Equals, JOB_SHRED)
+	c.Assert(ji.Done, Equals, uint64(EXTENT_SIZE))
+	c.Assert(blockAt(0), DeepEquals, make([]byte, BLOCK_SIZE))
+	c.Assert(blockAt(1), DeepEquals, data)
+	snapshotInfo, err := GetSnapshotInfo(device, "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+	vc, err = OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	buf := make([]byte, BLOCK_SIZE)
+	c.Assert(vc.ReadBlock(buf, 256), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(vc.CloseVolume(), IsNil)
+
+	// The volume is overwritten with random data, and cannot be restored meanwhile
+	ji, err = DeleteVolumeSecure(device, "vol1", true)
+	c.Assert(err, IsNil)
+	ji, err = WaitJob(device, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_COMPLETED)
+	c.Assert(ji.Done, Equals, uint64(2*EXTENT_SIZE))
+	for _, pos := range []uint{1, 2} {
+		c.Assert(blockAt(pos), Not(DeepEquals), data)
+		c.Assert(blockAt(pos), Not(DeepEquals), make([]byte, BLOCK_SIZE))
+	}
+	deleted, err := ListDeletedVolumes(device)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 0)
+	err = UndeleteVolume(device, "vol1")
+	c.Assert(errors.Is(err, ErrVolumeNotFound), Equals, true)
+
+	// Blocks a partial extent still reads from the snapshot are kept, also by contexts open meanwhile
+	vi, err = CreateVolume(device, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(device, "vol2")
+	c.Assert(err, IsNil)
+	c.Assert(vc.WriteBlock(data, 0, true), IsNil)
+	c.Assert(vc.WriteBlock(data, 1, true), IsNil)
+	c.Assert(vc.CloseVolume(), IsNil)
+	_, err = CreateSnapshot(device, "vol2", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(device, "vol2", WithBlockCoW())
+	c.Assert(err, IsNil)
+	written := bytes.Repeat([]byte{2}, BLOCK_SIZE)
+	c.Assert(vc.WriteBlock(written, 0, true), IsNil)
+	ji, err = DeleteSnapshotSecure(device, vi.SnapshotId, false)
+	c.Assert(err, IsNil)
+	ji, err = WaitJob(device, ji.JobId)
+	c.Assert(err, IsNil)
+	c.Assert(ji.State, Equals, JOB_COMPLETED)
+	c.Assert(ji.Done, Equals, uint64(EXTENT_SIZE))
+	for i := 0; i < 2; i++ {
+		c.Assert(vc.ReadBlock(buf, 0), IsNil)
+		c.Assert(buf, DeepEquals, written)
+		c.Assert(vc.ReadBlock(buf, 1), IsNil)
+		c.Assert(buf, DeepEquals, data)
+		c.Assert(vc.CloseVolume(), IsNil)
+		vc, err = OpenVolume(device, "vol2")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(vc.CloseVolume(), IsNil)
+	snapshotInfo, err = GetSnapshotInfo(device, "vol2")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotInfo, HasLen, 1)
+}
+
+func (s *TestSuite) TestTornMetadata(c *C) {
+	device, err := CreateMemoryDevice("torn", DEVICE_SIZE)
+	c.Assert(err, IsNil)
+	defer RemoveMemoryDevice(device)
+	err = InitDevice(device)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(device, "vol2", GIGABYTE)
+	c.Assert(err, IsNil)
+
+	// Damage part of the active copy, as if its last write was torn
+	dc, err := GetSharedDeviceContext(device)
+	c.Assert(err, IsNil)
+	active := dc.superblock.ActiveMetadata
+	offset := dc.metadataOffset + uint(active)*dc.metadataSize
+	dc.Close()
+	md := memoryDevices["torn"]
+	copy(md.data[offset+BLOCK_SIZE:], bytes.Repeat([]byte{0xff}, BLOCK_SIZE))
+	// The metadata cached by the process is only valid while it is the last to write the device
+	delete(metadataCache, device)
+
+	// The previous metadata is used
+	volumeInfo, err := GetVolumeInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 1)
+	c.Assert(volumeInfo[0].VolumeName, Equals, "vol1")
+
+	// Updates replace the damaged copy
+	_, err = CreateVolume(device, "vol3", GIGABYTE)
+	c.Assert(err, IsNil)
+	dc, err = GetSharedDeviceContext(device)
+	c.Assert(err, IsNil)
+	c.Assert(dc.superblock.ActiveMetadata, Equals, active)
+	dc.Close()
+	volumeInfo, err = GetVolumeInfo(device)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo, HasLen, 2)
+
+	// Both copies damaged
+	for i := uint(0); i < 2; i++ {
+		copy(md.data[dc.metadataOffset+i*dc.metadataSize:], bytes.Repeat([]byte{0xff}, BLOCK_SIZE))
+	}
+	delete(metadataCache, device)
+	_, err = GetVolumeInfo(device)
+	c.Assert(err, ErrorMatches, "metadata corrupted: checksum mismatch in both copies")
+	c.Assert(errors.Is(err, ErrCorrupted), Equals, true)
+}
+
+func (s *TestSuite) TestExtentMapPaging(c *C) {
+	blockData := loadBlocks()
+	volumeSize := uint64(16 * 1024 * GIGABYTE)
+	lastBlock := int(volumeSize/BLOCK_SIZE) - 1
+
+	_, err := CreateVolume(DEVICE, "vol1", volumeSize)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, lastBlock}, blockData[0:2])
+	vc.CloseVolume()
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+
+	// Only pages with extents are allocated
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	pages := 0
+	for _, p := range vc.vem.pages {
+		if p != nil {
+			pages++
+		}
+	}
+	c.Assert(pages, Equals, 2)
+	c.Assert(vc.vem.pages[0].extents, HasLen, 1)
+	readBlocks(c, vc, []int{0, lastBlock}, blockData[0:2])
+	err = vc.UnmapAt(volumeSize, 0)
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, lastBlock}, [][]byte{make([]byte, BLOCK_SIZE), make([]byte, BLOCK_SIZE)})
+	vc.CloseVolume()
+
+	// Pages of a volume without snapshots are released once empty
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	_, err = CreateVolume(DEVICE, "vol1", volumeSize)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1 << BLOCK_BITS_IN_EXTENT}, blockData[0:2])
+	c.Assert(vc.vem.pages[0].extents, HasLen, 2)
+	c.Assert(vc.vem.get(1).BlockBitmap[0], Equals, uint8(1))
+	c.Assert(vc.UnmapAt(EXTENT_SIZE, 0), IsNil)
+	c.Assert(vc.vem.pages[0].extents, HasLen, 1)
+	c.Assert(vc.UnmapAt(EXTENT_SIZE, EXTENT_SIZE), IsNil)
+	c.Assert(vc.vem.pages[0], IsNil)
+	vc.CloseVolume()
+
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestLazyOpen(c *C) {
+	blockData := loadBlocks()
+
+	_, err := CreateVolume(DEVICE, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vc, err := OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{0, 1, 300}, blockData[0:3])
+	vc.CloseVolume()
+	_, err = CreateSnapshot(DEVICE, "vol1", nil)
+	c.Assert(err, IsNil)
+	vc, err = OpenVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	writeBlocks(c, vc, []int{1}, blockData[3:4])
+	vc.CloseVolume()
+
+	// Reads see both the current snapshot and its parent, and writes wait for the map
+	vc, err = OpenVolumeLazy(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	readBlocks(c, vc, []int{0, 1, 300}, [][]byte{blockData[0], blockData[3], blockData[2]})
+	writeBlocks(c, vc, []int{300}, blockData[4:5])
+	readBlocks(c, vc, []int{300}, blockData[4:5])
+	err = vc.Refresh()
+	c.Assert(err, IsNil)
+	vc.CloseVolume()
+
+	// Closing right away stops building the map
+	vc, err = OpenVolumeLazy(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = vc.CloseVolume()
+	c.Assert(err, IsNil)
+	_, err = OpenVolumeLazy(DEVICE, "missing")
+	c.Assert(err, NotNil)
+
+	err = DeleteVolume(DEVICE, "vol1")
+	c.Assert(err, IsNil)
+	err = VacuumDevice(DEVICE)
+	c.Assert(err, IsNil)
+}
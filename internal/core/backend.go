@@ -0,0 +1,212 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Storage holding a device. Offsets and lengths of data are multiples of BLOCK_SIZE, and buffers are aligned
+// with AlignedBlock.
+type BlockBackend interface {
+	ReadAt(data []byte, offset uint64) (int, error)
+	WriteAt(data []byte, offset uint64) (int, error)
+	Size() (int64, error)
+	// Make all writes durable.
+	Sync() error
+	// Discard the data in the given range, which is no longer used. May have no effect.
+	Trim(offset uint64, length uint64) error
+	Close() error
+}
+
+// Implemented by backends that coordinate metadata updates between processes sharing the device. Locks are
+// taken per handle, and taking a lock already held converts it, as with flock. Backends without it are
+// locked within the process only.
+type BackendLocker interface {
+	Lock(exclusive bool) error
+	Unlock() error
+}
+
+// Implemented by backends with a cache that writes may stay in. Flush is called after each metadata update
+// and by VolumeContext.Sync, while Sync is called when the device is closed. Backends without it are synced.
+type BackendFlusher interface {
+	DirectIO() bool
+	Flush() error
+}
+
+// Implemented by backends that can zero a range without writing zeroes to it, which is used to initialize the
+// extent metadata. ZeroRange returns false if the range could not be zeroed this way, in which case zeroes are
+// written.
+type BackendZeroer interface {
+	ZeroRange(offset uint64, length uint64) (bool, error)
+}
+
+// Implemented by backends on block devices that can report the identity and state of the device. Health returns
+// nil if the backend is not on a block device.
+type BackendHealthReporter interface {
+	Health() *DeviceHealth
+}
+
+// Open the backend for a device name. Called for each context opened.
+type BackendOpener func(device string, opts *Options) (BlockBackend, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]BackendOpener{
+		"":    openFileBackend,
+		"mem": openMemoryBackend,
+		"nbd": openNbdBackend,
+	}
+)
+
+// Register a backend for device names of the form "scheme://...", replacing any existing one. Names without
+// a scheme are local files or raw devices, and "mem://" and "nbd://" names are handled by the built-in memory
+// and NBD client backends. "mirror://" names are always handled by the built-in mirroring backend.
+func RegisterBackend(scheme string, opener BackendOpener) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[scheme] = opener
+}
+
+func openFileBackend(device string, opts *Options) (BlockBackend, error) {
+	return openFile(device, os.O_RDWR, 0660, opts.BufferedIO)
+}
+
+func openMemoryBackend(device string, opts *Options) (BlockBackend, error) {
+	return openMemoryFile(device)
+}
+
+// Open the backend for a device name, according to its scheme.
+func openBackend(device string, opts *Options) (*deviceBackend, error) {
+	scheme, _, ok := strings.Cut(device, "://")
+	if !ok {
+		scheme = ""
+	}
+	backendsMu.Lock()
+	opener, ok := backends[scheme]
+	backendsMu.Unlock()
+	// Mirrors open the backends of their copies, so they are not in the table
+	if scheme == "mirror" {
+		opener, ok = openMirrorBackend, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage backend %v", scheme)
+	}
+	b, err := opener(device, opts)
+	if err != nil {
+		return nil, err
+	}
+	db := &deviceBackend{BlockBackend: b}
+	if l, ok := b.(BackendLocker); ok {
+		db.locker = l
+	} else {
+		db.locker = newProcessLock(device)
+	}
+	return db, nil
+}
+
+// Backend with defaults for the optional interfaces.
+type deviceBackend struct {
+	BlockBackend
+	locker BackendLocker
+}
+
+func (db *deviceBackend) Lock(exclusive bool) error {
+	return db.locker.Lock(exclusive)
+}
+
+func (db *deviceBackend) Unlock() error {
+	return db.locker.Unlock()
+}
+
+// Return true if writes bypass any cache.
+func (db *deviceBackend) DirectIO() bool {
+	if f, ok := db.BlockBackend.(BackendFlusher); ok {
+		return f.DirectIO()
+	}
+	return true
+}
+
+// Make writes durable if they may be cached.
+func (db *deviceBackend) Flush() error {
+	if f, ok := db.BlockBackend.(BackendFlusher); ok {
+		return f.Flush()
+	}
+	return db.BlockBackend.Sync()
+}
+
+// Zero a range if the backend can do it without writing zeroes. Returns false otherwise.
+func (db *deviceBackend) ZeroRange(offset uint64, length uint64) (bool, error) {
+	if z, ok := db.BlockBackend.(BackendZeroer); ok {
+		return z.ZeroRange(offset, length)
+	}
+	return false, nil
+}
+
+func (db *deviceBackend) Close() error {
+	db.locker.Unlock()
+	return db.BlockBackend.Close()
+}
+
+// Lock shared by all handles of a device in the process, equivalent to flock on a file.
+type processLock struct {
+	lock   *sync.RWMutex
+	locked int // 0 when unlocked, 1 when shared, 2 when exclusive
+}
+
+var (
+	processLocksMu sync.Mutex
+	processLocks   = make(map[string]*sync.RWMutex)
+)
+
+func newProcessLock(device string) *processLock {
+	processLocksMu.Lock()
+	defer processLocksMu.Unlock()
+	lock, ok := processLocks[device]
+	if !ok {
+		lock = &sync.RWMutex{}
+		processLocks[device] = lock
+	}
+	return &processLock{lock: lock}
+}
+
+// Take the lock. As with flock, a lock already held by the handle is converted.
+func (pl *processLock) Lock(exclusive bool) error {
+	if pl.locked != 0 {
+		pl.Unlock()
+	}
+	if exclusive {
+		pl.lock.Lock()
+		pl.locked = 2
+	} else {
+		pl.lock.RLock()
+		pl.locked = 1
+	}
+	return nil
+}
+
+func (pl *processLock) Unlock() error {
+	switch pl.locked {
+	case 1:
+		pl.lock.RUnlock()
+	case 2:
+		pl.lock.Unlock()
+	}
+	pl.locked = 0
+	return nil
+}
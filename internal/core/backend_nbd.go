@@ -0,0 +1,258 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/chazapis/go-nbd/pkg/protocol"
+)
+
+const (
+	NBD_DEFAULT_PORT = "10809"
+
+	nbdClientFlagFixedNewstyle = uint32(1 << 0)
+	nbdFlagReadOnly            = uint16(1 << 1)
+	nbdFlagSendFlush           = uint16(1 << 2)
+	nbdFlagSendTrim            = uint16(1 << 5)
+	nbdFlagSendWriteZeroes     = uint16(1 << 6)
+	nbdRequestFlush            = uint16(3)
+	nbdRequestTrim             = uint16(4)
+	nbdRequestWriteZeroes      = uint16(6)
+	nbdMaxRequestSize          = 32 * 1024 * 1024
+)
+
+// Client for a device exported by an NBD server, named "nbd://host[:port]/export". Requests are sent one at
+// a time over a single connection. Metadata updates are locked within the process only, so a remote device
+// must not be managed from more than one process at a time.
+type nbdBackend struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	name   string
+	size   uint64
+	flags  uint16
+	handle uint64
+}
+
+func openNbdBackend(device string, opts *Options) (BlockBackend, error) {
+	u, err := url.Parse(device)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), NBD_DEFAULT_PORT)
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	nb := &nbdBackend{conn: conn, name: device}
+	if err := nb.negotiate(strings.TrimPrefix(u.Path, "/")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot negotiate with %v: %w", address, err)
+	}
+	if nb.flags&nbdFlagReadOnly != 0 {
+		nb.Close()
+		return nil, fmt.Errorf("export %v is read-only", device)
+	}
+	return nb, nil
+}
+
+// Select the export with the fixed newstyle handshake.
+func (nb *nbdBackend) negotiate(export string) error {
+	var hdr protocol.NegotiationNewstyleHeader
+	if err := binary.Read(nb.conn, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.OldstyleMagic != protocol.NEGOTIATION_MAGIC_OLDSTYLE || hdr.OptionMagic != protocol.NEGOTIATION_MAGIC_OPTION {
+		return fmt.Errorf("invalid handshake magic")
+	}
+	if hdr.HandshakeFlags&protocol.NEGOTIATION_HANDSHAKE_FLAG_FIXED_NEWSTYLE == 0 {
+		return fmt.Errorf("server does not support fixed newstyle negotiation")
+	}
+	if err := binary.Write(nb.conn, binary.BigEndian, nbdClientFlagFixedNewstyle); err != nil {
+		return err
+	}
+
+	// Request the export with no additional information
+	option := []any{
+		protocol.NegotiationOptionHeader{
+			OptionMagic: protocol.NEGOTIATION_MAGIC_OPTION,
+			ID:          protocol.NEGOTIATION_ID_OPTION_GO,
+			Length:      uint32(4 + len(export) + 2),
+		},
+		uint32(len(export)),
+		[]byte(export),
+		uint16(0),
+	}
+	for _, v := range option {
+		if err := binary.Write(nb.conn, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	haveInfo := false
+	for {
+		var reply protocol.NegotiationReplyHeader
+		if err := binary.Read(nb.conn, binary.BigEndian, &reply); err != nil {
+			return err
+		}
+		if reply.ReplyMagic != protocol.NEGOTIATION_MAGIC_REPLY {
+			return fmt.Errorf("invalid reply magic")
+		}
+		data := make([]byte, reply.Length)
+		if _, err := io.ReadFull(nb.conn, data); err != nil {
+			return err
+		}
+		switch {
+		case reply.Type == protocol.NEGOTIATION_TYPE_REPLY_INFO:
+			if len(data) < 12 || binary.BigEndian.Uint16(data) != protocol.NEGOTIATION_TYPE_INFO_EXPORT {
+				continue
+			}
+			nb.size = binary.BigEndian.Uint64(data[2:])
+			nb.flags = binary.BigEndian.Uint16(data[10:])
+			haveInfo = true
+		case reply.Type == protocol.NEGOTIATION_TYPE_REPLY_ACK:
+			if !haveInfo {
+				return fmt.Errorf("no export information received")
+			}
+			return nil
+		case reply.Type&(1<<31) != 0:
+			return fmt.Errorf("export %q refused with error %#x", export, reply.Type)
+		default:
+			return fmt.Errorf("unexpected reply type %#x", reply.Type)
+		}
+	}
+}
+
+// Send a request and wait for the reply. Data is sent for writes and received for reads.
+func (nb *nbdBackend) request(typ uint16, offset uint64, length uint32, data []byte) error {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	nb.handle++
+	if err := binary.Write(nb.conn, binary.BigEndian, protocol.TransmissionRequestHeader{
+		RequestMagic: protocol.TRANSMISSION_MAGIC_REQUEST,
+		Type:         typ,
+		Handle:       nb.handle,
+		Offset:       offset,
+		Length:       length,
+	}); err != nil {
+		return err
+	}
+	if typ == protocol.TRANSMISSION_TYPE_REQUEST_WRITE {
+		if _, err := nb.conn.Write(data); err != nil {
+			return err
+		}
+	}
+	var reply protocol.TransmissionReplyHeader
+	if err := binary.Read(nb.conn, binary.BigEndian, &reply); err != nil {
+		return err
+	}
+	if reply.ReplyMagic != protocol.TRANSMISSION_MAGIC_REPLY || reply.Handle != nb.handle {
+		return fmt.Errorf("invalid reply from %v", nb.name)
+	}
+	if reply.Error != 0 {
+		return syscall.Errno(reply.Error)
+	}
+	if typ == protocol.TRANSMISSION_TYPE_REQUEST_READ {
+		if _, err := io.ReadFull(nb.conn, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split data into requests of at most the maximum size.
+func (nb *nbdBackend) transfer(typ uint16, data []byte, offset uint64) (int, error) {
+	for done := 0; done < len(data); {
+		size := min(len(data)-done, nbdMaxRequestSize)
+		if err := nb.request(typ, offset+uint64(done), uint32(size), data[done:done+size]); err != nil {
+			return done, err
+		}
+		done += size
+	}
+	return len(data), nil
+}
+
+func (nb *nbdBackend) ReadAt(data []byte, offset uint64) (int, error) {
+	return nb.transfer(protocol.TRANSMISSION_TYPE_REQUEST_READ, data, offset)
+}
+
+func (nb *nbdBackend) WriteAt(data []byte, offset uint64) (int, error) {
+	return nb.transfer(protocol.TRANSMISSION_TYPE_REQUEST_WRITE, data, offset)
+}
+
+func (nb *nbdBackend) Size() (int64, error) {
+	return int64(nb.size), nil
+}
+
+// Flush the server's cache. Servers without flush support are expected to write through.
+func (nb *nbdBackend) Sync() error {
+	if nb.flags&nbdFlagSendFlush == 0 {
+		return nil
+	}
+	return nb.request(nbdRequestFlush, 0, 0, nil)
+}
+
+// Discard data, if the server supports it.
+func (nb *nbdBackend) Trim(offset uint64, length uint64) error {
+	if nb.flags&nbdFlagSendTrim == 0 {
+		return nil
+	}
+	for length > 0 {
+		size := min(length, nbdMaxRequestSize)
+		if err := nb.request(nbdRequestTrim, offset, uint32(size), nil); err != nil {
+			return err
+		}
+		offset += size
+		length -= size
+	}
+	return nil
+}
+
+// Zero a range with write-zeroes requests, if the server supports them.
+func (nb *nbdBackend) ZeroRange(offset uint64, length uint64) (bool, error) {
+	if nb.flags&nbdFlagSendWriteZeroes == 0 {
+		return false, nil
+	}
+	for length > 0 {
+		size := min(length, nbdMaxRequestSize)
+		if err := nb.request(nbdRequestWriteZeroes, offset, uint32(size), nil); err != nil {
+			return false, err
+		}
+		offset += size
+		length -= size
+	}
+	return true, nil
+}
+
+// Disconnect from the server, which does not reply.
+func (nb *nbdBackend) Close() error {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	binary.Write(nb.conn, binary.BigEndian, protocol.TransmissionRequestHeader{
+		RequestMagic: protocol.TRANSMISSION_MAGIC_REQUEST,
+		Type:         protocol.TRANSMISSION_TYPE_REQUEST_DISC,
+	})
+	return nb.conn.Close()
+}
@@ -0,0 +1,130 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+
+	"github.com/kelindar/bitmap"
+)
+
+// Requests spanning many blocks are served with a single device request for each run of blocks stored
+// consecutively in an extent, instead of one for each block. Runs bypass the block caches, which are kept
+// for the hot blocks of small requests, and those written are dropped from them.
+
+// Read whole blocks from a block on, as many as are stored consecutively in an extent, or are unallocated,
+// up to the length of data. Returns the number of blocks read, at least one.
+func (vc *VolumeContext) readBlocks(data []byte, block uint64) (uint64, error) {
+	vc.relocation.RLock()
+	defer vc.relocation.RUnlock()
+	e, bidx, ok, err := vc.locateBlock(block)
+	if err != nil {
+		return 0, err
+	}
+	count := uint64(1)
+	limit := uint64(len(data)) / BLOCK_SIZE
+	if ok {
+		limit = min(limit, uint64(BLOCK_MASK_IN_EXTENT+1-bidx))
+	}
+	for ; count < limit; count++ {
+		ne, nbidx, nok, err := vc.locateBlock(block + count)
+		if err != nil {
+			return 0, err
+		}
+		if nok != ok || (ok && (ne.ExtentPos != e.ExtentPos || nbidx != bidx+uint(count))) {
+			break
+		}
+	}
+	if count == 1 {
+		return 1, vc.readLocatedBlock(data[0:BLOCK_SIZE], block, e, bidx, ok)
+	}
+	if ok {
+		if err := vc.dc.ReadBlocksData(data[0:count*BLOCK_SIZE], uint(e.ExtentPos), bidx); err != nil {
+			return 0, err
+		}
+	} else {
+		clear(data[0 : count*BLOCK_SIZE])
+	}
+	for i := uint64(0); i < count; i++ {
+		vc.overlayStaged(data[i*BLOCK_SIZE:(i+1)*BLOCK_SIZE], block+i)
+	}
+	return count, nil
+}
+
+// Write whole blocks from a block on, as many as fit in its extent, up to the length of data. Returns the
+// number of blocks written, at least one. Blocks of extents not yet in the current snapshot are written one
+// at a time, as the extent is allocated or copied by the first. Must be called with the metadata lock held.
+func (vc *VolumeContext) writeBlocks(ctx context.Context, data []byte, block uint64, updateMetadata bool) (uint64, error) {
+	eidx := uint(block >> BLOCK_BITS_IN_EXTENT)
+	bidx := uint(block & BLOCK_MASK_IN_EXTENT)
+	count := min(uint64(len(data))/BLOCK_SIZE, uint64(BLOCK_MASK_IN_EXTENT+1-bidx))
+	if count > 1 && eidx < vc.vem.totalVolumeExtents {
+		e := vc.vem.extent(uint32(eidx))
+		bb := bitmap.FromBytes(e.BlockBitmap[:])
+		// Without updating metadata, only blocks already written may be
+		if !updateMetadata {
+			for i := uint64(0); i < count; i++ {
+				if !bb.Contains(uint32(bidx) + uint32(i)) {
+					count = i
+					break
+				}
+			}
+		}
+		if e.SnapshotId == vc.volume.SnapshotId && count > 1 {
+			for i := uint64(0); i < count; i++ {
+				if err := vc.checkRetainedBlock(block + i); err != nil {
+					return 0, err
+				}
+			}
+			return count, vc.writeRun(data[0:count*BLOCK_SIZE], block, e, bb)
+		}
+	}
+	vc.discardStaged(block)
+	return 1, vc.writeBlock(ctx, data[0:BLOCK_SIZE], block, updateMetadata)
+}
+
+// Write a run of blocks to an extent of the current snapshot, updating its metadata once.
+func (vc *VolumeContext) writeRun(data []byte, block uint64, e *ExtentMetadata, bb bitmap.Bitmap) error {
+	eidx := uint32(block >> BLOCK_BITS_IN_EXTENT)
+	bidx := uint32(block & BLOCK_MASK_IN_EXTENT)
+	count := uint64(len(data)) / BLOCK_SIZE
+	for i := uint64(0); i < count; i++ {
+		vc.discardStaged(block + i)
+		vc.cache.remove(block + i)
+	}
+	if err := vc.dc.WriteBlocksData(data, uint(e.ExtentPos), uint(bidx)); err != nil {
+		for i := uint64(0); i < count; i++ {
+			vc.extentCache.remove(block + i)
+		}
+		return err
+	}
+	for i := uint64(0); i < count; i++ {
+		vc.extentCache.update(data[i*BLOCK_SIZE:(i+1)*BLOCK_SIZE], block+i)
+	}
+	if vc.dc.extentTimeOffset != 0 {
+		vc.stats.modify(eidx)
+	}
+	updated := false
+	for i := uint32(0); i < uint32(count); i++ {
+		if !bb.Contains(bidx + i) {
+			bb.Set(bidx + i)
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
+	}
+	return vc.vem.WriteExtent(eidx)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"container/list"
+	"sync"
+)
+
+type cachedBlock struct {
+	block uint64
+	data  []byte
+}
+
+// LRU cache of volume blocks. A nil cache holds nothing.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity uint
+	lru      *list.List
+	blocks   map[uint64]*list.Element
+}
+
+func newBlockCache(capacity uint) *blockCache {
+	if capacity == 0 {
+		return nil
+	}
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[uint64]*list.Element),
+	}
+}
+
+// Copy a cached block into data. Returns false if the block is not cached.
+func (bc *blockCache) get(data []byte, block uint64) bool {
+	if bc == nil {
+		return false
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	e, ok := bc.blocks[block]
+	if !ok {
+		return false
+	}
+	bc.lru.MoveToFront(e)
+	copy(data, e.Value.(*cachedBlock).data)
+	return true
+}
+
+// Add or replace a block, evicting the least recently used one if full.
+func (bc *blockCache) put(data []byte, block uint64) {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if e, ok := bc.blocks[block]; ok {
+		bc.lru.MoveToFront(e)
+		copy(e.Value.(*cachedBlock).data, data)
+		return
+	}
+	var cb *cachedBlock
+	if uint(bc.lru.Len()) >= bc.capacity {
+		e := bc.lru.Back()
+		cb = bc.lru.Remove(e).(*cachedBlock)
+		delete(bc.blocks, cb.block)
+	} else {
+		cb = &cachedBlock{data: make([]byte, BLOCK_SIZE)}
+	}
+	cb.block = block
+	copy(cb.data, data)
+	bc.blocks[block] = bc.lru.PushFront(cb)
+}
+
+func (bc *blockCache) remove(block uint64) {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if e, ok := bc.blocks[block]; ok {
+		bc.lru.Remove(e)
+		delete(bc.blocks, block)
+	}
+}
+
+func (bc *blockCache) clear() {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.lru.Init()
+	clear(bc.blocks)
+}
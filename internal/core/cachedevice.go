@@ -0,0 +1,182 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/kelindar/bitmap"
+)
+
+type cachedExtent struct {
+	eidx   uint32
+	slot   uint32
+	blocks bitmap.Bitmap // Blocks of the slot holding data
+}
+
+// Cache of volume extents on a local device, for devices on remote or slow backends. The cache device is split
+// in slots of EXTENT_SIZE, each holding the blocks read from an extent of the volume. Writes go through to
+// cached extents. Only the index is kept in memory, so the cache starts empty whenever the volume is opened.
+// A nil cache holds nothing.
+type extentCache struct {
+	mu      sync.Mutex
+	f       *deviceBackend
+	dc      *DeviceContext
+	name    string
+	slots   uint32
+	lru     *list.List
+	extents map[uint32]*list.Element // By volume extent
+}
+
+func newExtentCache(dc *DeviceContext) (*extentCache, error) {
+	name := dc.opts.CacheDevice
+	if name == "" {
+		return nil, nil
+	}
+	f, err := openBackend(name, dc.opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open cache device %v: %w", name, err)
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot open cache device %v: %w", name, err)
+	}
+	if size < EXTENT_SIZE {
+		f.Close()
+		return nil, fmt.Errorf("cache device %v is smaller than an extent", name)
+	}
+	return &extentCache{
+		f:       f,
+		dc:      dc,
+		name:    name,
+		slots:   uint32(size / EXTENT_SIZE),
+		lru:     list.New(),
+		extents: make(map[uint32]*list.Element),
+	}, nil
+}
+
+func (ec *extentCache) offset(ce *cachedExtent, bidx uint32) uint64 {
+	return uint64(ce.slot)*EXTENT_SIZE + uint64(bidx)*BLOCK_SIZE
+}
+
+// Return the cached extent holding a block, if any. Must be called with mu held.
+func (ec *extentCache) lookup(block uint64) (*cachedExtent, uint32, bool) {
+	e, ok := ec.extents[uint32(block>>BLOCK_BITS_IN_EXTENT)]
+	if !ok {
+		return nil, 0, false
+	}
+	ec.lru.MoveToFront(e)
+	return e.Value.(*cachedExtent), uint32(block & BLOCK_MASK_IN_EXTENT), true
+}
+
+// Stop caching a block whose slot could not be read or written, as the cache may hold stale data.
+// Must be called with mu held.
+func (ec *extentCache) drop(ce *cachedExtent, bidx uint32, err error) {
+	ec.dc.opts.Logger.Warn("cache device failed", "device", ec.name, "error", err)
+	ce.blocks.Remove(bidx)
+}
+
+// Copy a cached block into data. Returns false if the block is not cached.
+func (ec *extentCache) get(data []byte, block uint64) bool {
+	if ec == nil {
+		return false
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ce, bidx, ok := ec.lookup(block)
+	if !ok || !ce.blocks.Contains(bidx) {
+		return false
+	}
+	if _, err := ec.f.ReadAt(data[0:BLOCK_SIZE], ec.offset(ce, bidx)); err != nil {
+		ec.drop(ce, bidx, err)
+		return false
+	}
+	return true
+}
+
+// Add a block read from the device, taking the slot of the least recently used extent if the cache is full.
+func (ec *extentCache) put(data []byte, block uint64) {
+	if ec == nil {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ce, bidx, ok := ec.lookup(block)
+	if !ok {
+		if uint32(ec.lru.Len()) >= ec.slots {
+			e := ec.lru.Back()
+			ce = ec.lru.Remove(e).(*cachedExtent)
+			delete(ec.extents, ce.eidx)
+			ce.blocks.Clear()
+		} else {
+			ce = &cachedExtent{slot: uint32(ec.lru.Len())}
+		}
+		ce.eidx = uint32(block >> BLOCK_BITS_IN_EXTENT)
+		ec.extents[ce.eidx] = ec.lru.PushFront(ce)
+	}
+	ec.write(ce, bidx, data)
+}
+
+// Write a block through to the cache, if its extent is cached.
+func (ec *extentCache) update(data []byte, block uint64) {
+	if ec == nil {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ce, bidx, ok := ec.lookup(block); ok {
+		ec.write(ce, bidx, data)
+	}
+}
+
+// Must be called with mu held.
+func (ec *extentCache) write(ce *cachedExtent, bidx uint32, data []byte) {
+	if _, err := ec.f.WriteAt(data[0:BLOCK_SIZE], ec.offset(ce, bidx)); err != nil {
+		ec.drop(ce, bidx, err)
+		return
+	}
+	ce.blocks.Set(bidx)
+}
+
+func (ec *extentCache) remove(block uint64) {
+	if ec == nil {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if e, ok := ec.extents[uint32(block>>BLOCK_BITS_IN_EXTENT)]; ok {
+		e.Value.(*cachedExtent).blocks.Remove(uint32(block & BLOCK_MASK_IN_EXTENT))
+	}
+}
+
+func (ec *extentCache) clear() {
+	if ec == nil {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.lru.Init()
+	clear(ec.extents)
+}
+
+func (ec *extentCache) close() error {
+	if ec == nil {
+		return nil
+	}
+	return ec.f.Close()
+}
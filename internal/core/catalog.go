@@ -0,0 +1,115 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Version of the catalogs returned by ExportCatalog. Version 2 adds snapshot descriptions.
+const CATALOG_VERSION = 2
+
+// Snapshot metadata of a device, so that external inventories can be reconciled with it, and labels and names
+// carried over to a copy of the device. Catalogs are meant to be stored as JSON.
+type SnapshotCatalog struct {
+	CatalogVersion uint
+	DeviceUUID     string
+	Generation     uint64 // Of the metadata exported
+	ExportedAt     time.Time
+	Snapshots      []SnapshotInfo // As returned by ListAllSnapshots
+}
+
+// Snapshots of a catalog imported with ImportCatalog.
+type CatalogImport struct {
+	Applied []uint // Snapshots whose labels, name and description were replaced
+	Skipped []uint // Snapshots not on the device, or with a different parent or creation time
+}
+
+// Return the metadata of all snapshots on the device.
+func ExportCatalog(device string) (*SnapshotCatalog, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	catalog := &SnapshotCatalog{
+		CatalogVersion: CATALOG_VERSION,
+		DeviceUUID:     format.FormatUUID(dc.superblock.UUID),
+		Generation:     dc.superblock.Generation,
+		ExportedAt:     time.Now(),
+		Snapshots:      dc.listAllSnapshots(),
+	}
+	return catalog, dc.Close()
+}
+
+// Replace the labels, names and descriptions of snapshots with those in a catalog, keeping descriptions if the
+// catalog predates them. Snapshots are matched by id, parent and creation time, which are kept when a device is
+// copied as is, and others are skipped. Snapshots not in the catalog are left alone. Either all matching
+// snapshots are updated, or none is, if names clash with those of snapshots not updated, or labels do not fit in
+// the label region.
+func ImportCatalog(device string, catalog *SnapshotCatalog) (*CatalogImport, error) {
+	if catalog.CatalogVersion == 0 || catalog.CatalogVersion > CATALOG_VERSION {
+		return nil, fmt.Errorf("unsupported catalog version %v", catalog.CatalogVersion)
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	result := &CatalogImport{}
+	var matched []*SnapshotInfo
+	for i := range catalog.Snapshots {
+		si := &catalog.Snapshots[i]
+		if si.SnapshotId == 0 || si.SnapshotId > MAX_SNAPSHOTS {
+			result.Skipped = append(result.Skipped, si.SnapshotId)
+			continue
+		}
+		sm := &dc.snapshots[si.SnapshotId-1]
+		if sm.CreatedAt == 0 || sm.CreatedAt != si.CreatedAt.Unix() || uint(sm.ParentSnapshotId) != si.ParentSnapshotId {
+			result.Skipped = append(result.Skipped, si.SnapshotId)
+			continue
+		}
+		matched = append(matched, si)
+	}
+	// Names are cleared first, so that they can move between snapshots
+	for _, si := range matched {
+		if err := dc.setSnapshotName(uint16(si.SnapshotId), ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, si := range matched {
+		if err := dc.SetSnapshotLabels(uint16(si.SnapshotId), si.Labels); err != nil {
+			return nil, err
+		}
+		if err := dc.setSnapshotName(uint16(si.SnapshotId), si.Name); err != nil {
+			return nil, err
+		}
+		if catalog.CatalogVersion >= 2 {
+			if err := dc.setSnapshotDescription(uint16(si.SnapshotId), si.Description); err != nil {
+				return nil, err
+			}
+		}
+		result.Applied = append(result.Applied, si.SnapshotId)
+	}
+	if len(matched) > 0 {
+		if err := dc.WriteMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	return result, dc.Close()
+}
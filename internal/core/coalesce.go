@@ -0,0 +1,123 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"math/bits"
+)
+
+// Block written in parts, kept in memory while later writes to it are coalesced. The parts not written are
+// read when the block is written to the volume, unless the writes covered the whole block.
+type stagedBlock struct {
+	block   uint64
+	data    []byte
+	written [BLOCK_SIZE / 64]uint64 // Bitmap of the bytes of data written
+}
+
+func (sb *stagedBlock) write(boffset uint64, data []byte) {
+	copy(sb.data[boffset:], data)
+	for i := boffset; i < boffset+uint64(len(data)); i++ {
+		sb.written[i/64] |= 1 << (i % 64)
+	}
+}
+
+func (sb *stagedBlock) complete() bool {
+	for _, w := range sb.written {
+		if w != ^uint64(0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy the written parts of the block over data read from the volume.
+func (sb *stagedBlock) overlay(data []byte) {
+	for w, word := range sb.written {
+		for word != 0 {
+			i := uint64(w*64 + bits.TrailingZeros64(word))
+			data[i] = sb.data[i]
+			word &= word - 1
+		}
+	}
+}
+
+// Apply the staged writes to a block read from the volume.
+func (vc *VolumeContext) overlayStaged(data []byte, block uint64) {
+	if vc.staged != nil && vc.staged.block == block {
+		vc.staged.overlay(data)
+	}
+}
+
+// Stage a write within a block, writing out any other block staged before. Must be called with the metadata
+// lock held.
+func (vc *VolumeContext) stageWrite(ctx context.Context, block uint64, boffset uint64, data []byte) error {
+	if err := vc.checkRetainedBlock(block); err != nil {
+		return err
+	}
+	if vc.staged != nil && vc.staged.block != block {
+		if err := vc.flushStaged(ctx); err != nil {
+			return err
+		}
+	}
+	if vc.staged == nil {
+		vc.staged = &stagedBlock{block: block, data: make([]byte, BLOCK_SIZE)}
+	}
+	vc.staged.write(boffset, data)
+	if vc.staged.complete() {
+		return vc.flushStaged(ctx)
+	}
+	return nil
+}
+
+// Drop the staged block if it is about to be overwritten in full.
+func (vc *VolumeContext) discardStaged(block uint64) {
+	if vc.staged != nil && vc.staged.block == block {
+		vc.staged = nil
+	}
+}
+
+// Write the staged block to the volume. Must be called with the metadata lock held.
+func (vc *VolumeContext) flushStaged(ctx context.Context) error {
+	sb := vc.staged
+	if sb == nil {
+		return nil
+	}
+	buf := sb.data
+	if !sb.complete() {
+		buf = make([]byte, BLOCK_SIZE)
+		if err := vc.readBlock(buf, sb.block); err != nil {
+			return err
+		}
+	}
+	vc.staged = nil
+	if err := vc.writeBlock(ctx, buf, sb.block, true); err != nil {
+		vc.staged = sb
+		return err
+	}
+	return nil
+}
+
+// Write the staged block outside a write, taking the metadata lock.
+func (vc *VolumeContext) syncStaged() error {
+	if vc.staged == nil {
+		return nil
+	}
+	if err := vc.lockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	return vc.flushStaged(context.Background())
+}
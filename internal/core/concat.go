@@ -0,0 +1,179 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+)
+
+// Return true if a volume, or a snapshot of it, is open in this process.
+func (dc *DeviceContext) volumeOpen(v *VolumeMetadata) bool {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	for _, vc := range openVolumes[dc.device] {
+		if vc.volumeName == v.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// Find a volume whose extents are to be handed over to another one, which requires that it has no snapshots
+// besides the current one and is not open.
+func (dc *DeviceContext) findMovableVolume(volumeName string) (*VolumeMetadata, error) {
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if dc.snapshots[v.SnapshotId-1].ParentSnapshotId != 0 {
+		return nil, fmt.Errorf("volume %v has snapshots", volumeName)
+	}
+	if dc.volumeOpen(v) {
+		return nil, fmt.Errorf("volume %v is open", volumeName)
+	}
+	if err := dc.checkRetention(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Hand over the extents of the current snapshot of a volume from the given extent on to another snapshot,
+// moving them by shift extents. Only extent metadata is rewritten.
+func (dc *DeviceContext) moveExtents(v *VolumeMetadata, from uint32, snapshotId uint16, shift int64) error {
+	sem, err := GetSnapshotExtentMap(dc, v.VolumeSize, v.SnapshotId)
+	if err != nil {
+		return err
+	}
+	var cbErr error
+	sem.extentBitmap.Range(func(eidx uint32) {
+		if cbErr != nil || eidx < from {
+			return
+		}
+		e := sem.get(eidx)
+		pos := e.ExtentPos
+		e.SnapshotId = snapshotId
+		e.ExtentPos = uint32(int64(eidx) + shift)
+		cbErr = dc.WriteExtent(&e, uint(pos))
+	})
+	return cbErr
+}
+
+// Create a volume out of others, placed one after the other in the given order, and return its information.
+// The extents of the volumes are handed over to the new one, which takes the settings of the first, without
+// copying any data, and the volumes are destroyed. They must not have snapshots besides the current one, or be
+// open, and must be in the same group, if any.
+func ConcatVolumes(device string, newVolumeName string, volumeNames []string) (*VolumeInfo, error) {
+	if len(volumeNames) == 0 {
+		return nil, fmt.Errorf("no volumes to concatenate")
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	var vsrcs []*VolumeMetadata
+	size := uint64(0)
+	for _, name := range volumeNames {
+		v, err := dc.findMovableVolume(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, vsrc := range vsrcs {
+			if vsrc == v {
+				return nil, fmt.Errorf("volume %v given twice", name)
+			}
+		}
+		if len(vsrcs) > 0 && v.GroupId != vsrcs[0].GroupId {
+			return nil, fmt.Errorf("volume %v is in another group", name)
+		}
+		vsrcs = append(vsrcs, v)
+		size += v.VolumeSize
+	}
+	vdst, err := dc.AddVolume(newVolumeName, size)
+	if err != nil {
+		return nil, err
+	}
+	vdst.AllocationPolicy = vsrcs[0].AllocationPolicy
+	vdst.MaxIops = vsrcs[0].MaxIops
+	vdst.MaxBandwidth = vsrcs[0].MaxBandwidth
+	vdst.GroupId = vsrcs[0].GroupId
+	vdst.Tier = vsrcs[0].Tier
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	dc.notify(EVENT_VOLUME_CREATED, newVolumeName, 0)
+	base := int64(0)
+	for _, v := range vsrcs {
+		if err := dc.moveExtents(v, 0, vdst.SnapshotId, base); err != nil {
+			return nil, err
+		}
+		base += int64(v.VolumeSize / EXTENT_SIZE)
+	}
+	for _, v := range vsrcs {
+		if err := dc.DestroyVolume(v); err != nil {
+			return nil, err
+		}
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	for _, name := range volumeNames {
+		dc.notify(EVENT_VOLUME_DELETED, name, 0)
+	}
+	vi := dc.volumeInfo(vdst)
+	return &vi, dc.Close()
+}
+
+// Split a volume in two at an offset, which must be a multiple of EXTENT_SIZE, and return the information of
+// the new volume, holding the part of the volume from the offset on. The volume keeps the part before it. The
+// extents of the part are handed over to the new volume, which takes the settings of the volume, without
+// copying any data. The volume must not have snapshots besides the current one, or be open.
+func SplitVolume(device string, volumeName string, newVolumeName string, offset uint64) (*VolumeInfo, error) {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v, err := dc.findMovableVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if offset%EXTENT_SIZE != 0 || offset == 0 || offset >= v.VolumeSize {
+		return nil, fmt.Errorf("invalid split offset %v, not extent aligned or beyond the volume", offset)
+	}
+	vdst, err := dc.AddVolume(newVolumeName, v.VolumeSize-offset)
+	if err != nil {
+		return nil, err
+	}
+	vdst.AllocationPolicy = v.AllocationPolicy
+	vdst.MaxIops = v.MaxIops
+	vdst.MaxBandwidth = v.MaxBandwidth
+	vdst.GroupId = v.GroupId
+	vdst.Tier = v.Tier
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	from := uint32(offset / EXTENT_SIZE)
+	if err := dc.moveExtents(v, from, vdst.SnapshotId, -int64(from)); err != nil {
+		return nil, err
+	}
+	v.VolumeSize = offset
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	dc.notify(EVENT_VOLUME_CREATED, newVolumeName, 0)
+	vi := dc.volumeInfo(vdst)
+	return &vi, dc.Close()
+}
@@ -0,0 +1,651 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+const (
+	SIZEOF_EXTENT_METADATA = format.SIZEOF_EXTENT_METADATA
+	SIZEOF_VOLUME_STATS    = format.SIZEOF_VOLUME_STATS
+	SIZEOF_JOB_RECORD      = format.SIZEOF_JOB_RECORD
+	SIZEOF_EXTENT_TIME     = format.SIZEOF_EXTENT_TIME
+)
+
+// The device context holds the device file descriptor and all metadata except extents.
+type DeviceContext struct {
+	device             string
+	f                  *deviceBackend
+	superblock         *Superblock
+	volumes            [MAX_VOLUMES]VolumeMetadata
+	snapshots          [MAX_SNAPSHOTS]SnapshotMetadata
+	groups             [MAX_GROUPS]GroupMetadata
+	retention          [MAX_VOLUMES]uint32 // Time each volume slot is write once until, zero if not write once
+	labels             []Label
+	metadataOffset     uint
+	metadataSize       uint
+	groupOffset        uint // In each copy of the metadata area
+	retentionOffset    uint // In each copy of the metadata area
+	labelOffset        uint // In each copy of the metadata area
+	statsOffset        uint
+	extentOffset       uint
+	totalDeviceExtents uint
+	dataOffset         uint
+	extentTimeOffset   uint // Of the extent time table, zero if not in use
+	extentBatch        uint // Extents read or written at once when scanning extent metadata
+	free               freeExtents
+	index              extentIndex
+	closed             bool
+	opts               *Options
+	telemetry          *telemetry
+	extentErrors       extentErrors
+	flushedAt          time.Time // Last flush of metadata updates
+	unflushed          bool      // Set if metadata updates were not flushed, as per the sync policy
+}
+
+// Initialize a new, empty device context.
+func NewDeviceContext(device string, opts ...Option) (*DeviceContext, error) {
+	o := newOptions(opts)
+	if o.SyncPolicy >= uint(len(syncPolicyNames)) {
+		return nil, fmt.Errorf("unknown sync policy %v", o.SyncPolicy)
+	}
+	if err := o.tune(); err != nil {
+		return nil, err
+	}
+	f, err := openBackend(device, o)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %v: %w", device, err)
+	}
+	if !f.DirectIO() && !o.BufferedIO {
+		o.Logger.Info("direct I/O not supported, using buffered I/O", "device", device)
+	}
+	deviceSize, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if deviceSize == 0 {
+		f.Close()
+		return nil, fmt.Errorf("device with zero size")
+	}
+	if deviceSize < (100 * (1 << 20)) {
+		f.Close()
+		return nil, fmt.Errorf("device size less than 100 MB")
+	}
+
+	dc := &DeviceContext{
+		device: device,
+		f:      f,
+		superblock: &Superblock{
+			Version:    VERSION,
+			DeviceSize: uint64(deviceSize),
+		},
+		opts:      o,
+		telemetry: newTelemetry(o),
+	}
+	copy(dc.superblock.Magic[:], []byte(MAGIC))
+	if o.ReservedSize > 0 {
+		layout := format.NewReservedLayout(dc.superblock.DeviceSize, o.ReservedSize)
+		if layout.TotalDeviceExtents == 0 || layout.ReservedOffset < 100*(1<<20) {
+			f.Close()
+			return nil, fmt.Errorf("reserved region of %v bytes leaves less than 100 MB", o.ReservedSize)
+		}
+		dc.superblock.ReservedSize = layout.DeviceSize - layout.ReservedOffset
+		dc.superblock.FeatureIncompat |= FEATURE_INCOMPAT_RESERVED_REGION
+	}
+	dc.setLayout()
+	dc.extentBatch = o.extentBatch(dc.totalDeviceExtents)
+	return dc, nil
+}
+
+// Set the offsets of the device areas, as per the size of the device and its reserved region.
+func (dc *DeviceContext) setLayout() {
+	layout := format.NewReservedLayout(dc.superblock.DeviceSize, dc.superblock.ReservedSize)
+	dc.metadataOffset = uint(layout.MetadataOffset)
+	dc.metadataSize = uint(layout.MetadataSize)
+	dc.groupOffset = uint(layout.GroupOffset)
+	dc.retentionOffset = uint(layout.RetentionOffset)
+	dc.labelOffset = uint(layout.LabelOffset)
+	dc.statsOffset = uint(layout.StatsOffset)
+	dc.extentOffset = uint(layout.ExtentOffset)
+	dc.totalDeviceExtents = uint(layout.TotalDeviceExtents)
+	dc.dataOffset = uint(layout.DataOffset)
+	dc.extentTimeOffset = 0
+	if dc.superblock.FeatureRoCompat&FEATURE_RO_COMPAT_EXTENT_TIMES != 0 {
+		extents, offset := layout.ExtentTimeTable()
+		dc.extentTimeOffset = uint(offset)
+		dc.totalDeviceExtents -= uint(extents)
+	}
+}
+
+func getDeviceContext(device string, exclusive bool, opts []Option) (*DeviceContext, error) {
+	dc, err := NewDeviceContext(device, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.f.Lock(exclusive); err != nil {
+		dc.f.Close()
+		return nil, err
+	}
+	if err := dc.ReadSuperblock(); err != nil {
+		dc.f.Close()
+		return nil, err
+	}
+	if err := checkFeatures(dc.superblock, exclusive); err != nil {
+		dc.f.Close()
+		return nil, err
+	}
+	if err := dc.checkIdentity(); err != nil {
+		dc.f.Close()
+		return nil, err
+	}
+	if err := dc.ReadMetadata(); err != nil {
+		dc.f.Close()
+		return nil, err
+	}
+	dc.opts.Logger.Debug("opened device", "device", device, "exclusive", exclusive, "generation", dc.superblock.Generation)
+	return dc, nil
+}
+
+// Open an initialized device and read its metadata. An exclusive lock is held until the context is closed,
+// so metadata can be updated without interference.
+func GetDeviceContext(device string, opts ...Option) (*DeviceContext, error) {
+	return getDeviceContext(device, true, opts)
+}
+
+// Open an initialized device and read its metadata, holding a shared lock until the context is closed.
+// Used by queries, so they observe consistent metadata while other processes update it.
+func GetSharedDeviceContext(device string, opts ...Option) (*DeviceContext, error) {
+	return getDeviceContext(device, false, opts)
+}
+
+// Lock metadata for an update by a long-lived context and reload the superblock, which others may have changed.
+func (dc *DeviceContext) LockMetadata() error {
+	if err := dc.f.Lock(true); err != nil {
+		return err
+	}
+	allocated := dc.superblock.AllocatedDeviceExtents
+	if err := dc.ReadSuperblock(); err != nil {
+		dc.f.Unlock()
+		return err
+	}
+	if err := checkFeatures(dc.superblock, true); err != nil {
+		dc.f.Unlock()
+		return err
+	}
+	if dc.superblock.AllocatedDeviceExtents != allocated {
+		dc.free = freeExtents{}
+	}
+	return nil
+}
+
+func (dc *DeviceContext) UnlockMetadata() error {
+	dc.index = extentIndex{}
+	return dc.f.Unlock()
+}
+
+func (dc *DeviceContext) ReadSuperblock() error {
+	var sb Superblock
+	abuf := AlignedBlock(BLOCK_SIZE)
+	if _, err := dc.f.ReadAt(abuf, 0); err != nil {
+		return fmt.Errorf("failed to read superblock: %w", err)
+	}
+	if err := format.Unmarshal(abuf, &sb); err != nil {
+		return fmt.Errorf("failed to deserialize superblock: %w", err)
+	}
+	if dc.superblock.Magic != sb.Magic {
+		return fmt.Errorf("device not initialized")
+	}
+	if dc.superblock.Version != sb.Version {
+		return fmt.Errorf("version mismatch in superblock")
+	}
+	if dc.superblock.DeviceSize != sb.DeviceSize {
+		return fmt.Errorf("%w: device size mismatch in superblock", ErrCorrupted)
+	}
+	if err := checkFeatures(&sb, false); err != nil {
+		return err
+	}
+	relayout := sb.ReservedSize != dc.superblock.ReservedSize ||
+		(sb.FeatureRoCompat^dc.superblock.FeatureRoCompat)&FEATURE_RO_COMPAT_EXTENT_TIMES != 0
+	dc.superblock = &sb
+	if relayout {
+		dc.setLayout()
+		dc.extentBatch = dc.opts.extentBatch(dc.totalDeviceExtents)
+	}
+	return nil
+}
+
+// Return true if the device holds a superblock of any version.
+func (dc *DeviceContext) initialized() (bool, error) {
+	var sb Superblock
+	abuf := AlignedBlock(BLOCK_SIZE)
+	if _, err := dc.f.ReadAt(abuf, 0); err != nil {
+		return false, fmt.Errorf("failed to read superblock: %w", err)
+	}
+	if err := format.Unmarshal(abuf, &sb); err != nil {
+		return false, fmt.Errorf("failed to deserialize superblock: %w", err)
+	}
+	return sb.Magic == dc.superblock.Magic, nil
+}
+
+// Read a copy of the metadata area, returning false if its checksum does not match.
+func (dc *DeviceContext) readMetadataCopy(abuf []byte, copy uint8) (bool, error) {
+	if _, err := dc.f.ReadAt(abuf, uint64(dc.metadataOffset+uint(copy)*dc.metadataSize)); err != nil {
+		return false, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return format.MetadataChecksum(abuf) == dc.superblock.MetadataChecksums[copy], nil
+}
+
+// Read the active copy of the metadata area. If it is damaged, the other copy is used, holding the metadata
+// as of the previous update.
+func (dc *DeviceContext) ReadMetadata() error {
+	if dc.loadCachedMetadata() {
+		return nil
+	}
+	abuf := AlignedBlock(int(dc.metadataSize))
+	active := dc.superblock.ActiveMetadata
+	valid, err := dc.readMetadataCopy(abuf, active)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		if valid, err = dc.readMetadataCopy(abuf, 1-active); err != nil {
+			return err
+		}
+		if !valid {
+			err := fmt.Errorf("%w: checksum mismatch in both copies", ErrCorrupted)
+			dc.notifyError(err)
+			return err
+		}
+		dc.opts.Logger.Warn("metadata checksum mismatch, using previous copy", "copy", active)
+		dc.notifyError(fmt.Errorf("%w: checksum mismatch, using previous copy", ErrCorrupted))
+		dc.superblock.ActiveMetadata = 1 - active
+	}
+	if err := format.Unmarshal(abuf, dc.volumes[:]); err != nil {
+		return fmt.Errorf("failed to deserialize volume metadata: %w", err)
+	}
+	if err := format.Unmarshal(abuf[binary.Size(dc.volumes):], dc.snapshots[:]); err != nil {
+		return fmt.Errorf("failed to deserialize snapshot metadata: %w", err)
+	}
+	if err := format.Unmarshal(abuf[dc.groupOffset:], dc.groups[:]); err != nil {
+		return fmt.Errorf("failed to deserialize group metadata: %w", err)
+	}
+	dc.retention = [MAX_VOLUMES]uint32{}
+	if dc.superblock.FeatureRoCompat&FEATURE_RO_COMPAT_RETENTION != 0 {
+		if err := format.Unmarshal(abuf[dc.retentionOffset:], dc.retention[:]); err != nil {
+			return fmt.Errorf("failed to deserialize retention table: %w", err)
+		}
+	}
+	labels, err := format.UnmarshalLabels(abuf[dc.labelOffset:])
+	if err != nil {
+		return fmt.Errorf("%w: failed to deserialize labels: %w", ErrCorrupted, err)
+	}
+	dc.labels = labels
+	dc.cacheMetadata()
+	return nil
+}
+
+func (dc *DeviceContext) ReadExtents(eb []ExtentMetadata, eidx uint) error {
+	offset := uint64(dc.extentOffset + (eidx * SIZEOF_EXTENT_METADATA))
+	size := uint64(binary.Size(eb))
+	blocks := ((offset + size) / BLOCK_SIZE) - (offset / BLOCK_SIZE) + 1
+	abuf := AlignedBlock(int(BLOCK_SIZE * blocks))
+	if _, err := dc.f.ReadAt(abuf, (offset/BLOCK_SIZE)*BLOCK_SIZE); err != nil {
+		return fmt.Errorf("failed to read extent metadata: %w", err)
+	}
+	if err := format.Unmarshal(abuf[offset%BLOCK_SIZE:(offset%BLOCK_SIZE)+size], eb); err != nil {
+		return fmt.Errorf("failed to deserialize extent metadata: %w", err)
+	}
+	return nil
+}
+
+// Return the offset on the device of a block of an extent.
+func (dc *DeviceContext) blockOffset(epos uint, bidx uint) uint64 {
+	return uint64(dc.dataOffset + (epos * EXTENT_SIZE) + (bidx * BLOCK_SIZE))
+}
+
+func (dc *DeviceContext) ReadBlockData(data []byte, epos uint, bidx uint) error {
+	return dc.ReadBlocksData(data[0:BLOCK_SIZE], epos, bidx)
+}
+
+// Read consecutive blocks of an extent with a single request. The length of data must be a multiple of
+// BLOCK_SIZE, and the blocks must not go past the end of the extent.
+func (dc *DeviceContext) ReadBlocksData(data []byte, epos uint, bidx uint) error {
+	_, op := dc.telemetry.start(context.Background(), OP_BLOCK_READ)
+	offset := dc.blockOffset(epos, bidx)
+	err := dc.retryIO(OP_BLOCK_READ, epos, func() error {
+		_, err := dc.f.ReadAt(data, offset)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to read block: %w", err)
+		op.end(err)
+		dc.notifyError(err)
+		return err
+	}
+	op.end(nil)
+	return nil
+}
+
+func (dc *DeviceContext) WriteSuperblock() error {
+	return dc.writeSuperblock(context.Background())
+}
+
+// Write the superblock, traced as part of the span in the context.
+func (dc *DeviceContext) writeSuperblock(ctx context.Context) (err error) {
+	op := dc.startOp(ctx, OP_SUPERBLOCK_WRITE)
+	defer func() { op.end(err) }()
+	buf, err := format.Marshal(dc.superblock)
+	if err != nil {
+		return fmt.Errorf("failed to serialize superblock: %w", err)
+	}
+	abuf := AlignedBlock(BLOCK_SIZE)
+	copy(abuf[0:], buf)
+	if _, err := dc.f.WriteAt(abuf, 0); err != nil {
+		return fmt.Errorf("failed to write superblock: %w", err)
+	}
+	if err := dc.flushMetadata(); err != nil {
+		return err
+	}
+	dc.checkSpace()
+	return nil
+}
+
+// Write the volume, snapshot, and group metadata, and the labels, to the copy of the metadata area not in use. The
+// copy is synced before the superblock is updated to make it active, with an incremented generation so that
+// open volumes notice the change.
+func (dc *DeviceContext) WriteMetadata() (err error) {
+	op := dc.startOp(context.Background(), OP_METADATA_WRITE)
+	defer func() { op.end(err) }()
+	vbuf, err := format.Marshal(dc.volumes)
+	if err != nil {
+		return fmt.Errorf("failed to serialize volume metadata: %w", err)
+	}
+	sbuf, err := format.Marshal(dc.snapshots)
+	if err != nil {
+		return fmt.Errorf("failed to serialize snapshot metadata: %w", err)
+	}
+	gbuf, err := format.Marshal(dc.groups)
+	if err != nil {
+		return fmt.Errorf("failed to serialize group metadata: %w", err)
+	}
+	lbuf, err := format.MarshalLabels(dc.labels)
+	if err != nil {
+		return fmt.Errorf("failed to serialize labels: %w", err)
+	}
+	abuf := AlignedBlock(int(dc.metadataSize))
+	copy(abuf[0:], vbuf)
+	copy(abuf[len(vbuf):], sbuf)
+	copy(abuf[dc.groupOffset:], gbuf)
+	if dc.superblock.FeatureRoCompat&FEATURE_RO_COMPAT_RETENTION != 0 {
+		rbuf, err := format.Marshal(dc.retention)
+		if err != nil {
+			return fmt.Errorf("failed to serialize retention table: %w", err)
+		}
+		copy(abuf[dc.retentionOffset:], rbuf)
+	}
+	copy(abuf[dc.labelOffset:], lbuf)
+	target := 1 - dc.superblock.ActiveMetadata
+	if _, err := dc.f.WriteAt(abuf, uint64(dc.metadataOffset+uint(target)*dc.metadataSize)); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	if err := dc.barrier(); err != nil {
+		return err
+	}
+	dc.superblock.MetadataChecksums[target] = format.MetadataChecksum(abuf)
+	dc.superblock.ActiveMetadata = target
+	dc.superblock.Generation++
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	dc.cacheMetadata()
+	return nil
+}
+
+func (dc *DeviceContext) WriteExtents(eb []ExtentMetadata, eidx uint) error {
+	buf, err := format.Marshal(eb)
+	if err != nil {
+		return fmt.Errorf("failed to serialize extent metadata: %w", err)
+	}
+	offset := uint64(dc.extentOffset + (eidx * SIZEOF_EXTENT_METADATA))
+	size := uint64(binary.Size(eb))
+	blocks := ((offset + size) / BLOCK_SIZE) - (offset / BLOCK_SIZE) + 1
+	abuf := AlignedBlock(int(BLOCK_SIZE * blocks))
+	if _, err := dc.f.ReadAt(abuf, (offset/BLOCK_SIZE)*BLOCK_SIZE); err != nil {
+		return fmt.Errorf("failed to read extent metadata: %w", err)
+	}
+	copy(abuf[offset%BLOCK_SIZE:(offset%BLOCK_SIZE)+size], buf)
+	if _, err := dc.f.WriteAt(abuf, (offset/BLOCK_SIZE)*BLOCK_SIZE); err != nil {
+		return fmt.Errorf("failed to write extent metadata: %w", err)
+	}
+	dc.updateExtentIndex(eb, eidx)
+	return dc.flushMetadata()
+}
+
+func (dc *DeviceContext) WriteExtent(e *ExtentMetadata, eidx uint) error {
+	return dc.WriteExtents([]ExtentMetadata{*e}, eidx)
+}
+
+func (dc *DeviceContext) WriteBlockData(data []byte, epos uint, bidx uint) error {
+	return dc.WriteBlocksData(data[0:BLOCK_SIZE], epos, bidx)
+}
+
+// Write consecutive blocks of an extent with a single request, as with ReadBlocksData.
+func (dc *DeviceContext) WriteBlocksData(data []byte, epos uint, bidx uint) error {
+	offset := dc.blockOffset(epos, bidx)
+	err := dc.retryIO(OP_BLOCK_WRITE, epos, func() error {
+		_, err := dc.f.WriteAt(data, offset)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to write block: %w", err)
+		dc.notifyError(err)
+		return err
+	}
+	return nil
+}
+
+func (dc *DeviceContext) CopyExtentData(esrc uint, edst uint) error {
+	return dc.copyExtentData(context.Background(), esrc, edst)
+}
+
+// Copy the data of an extent, traced as part of the span in the context.
+func (dc *DeviceContext) copyExtentData(ctx context.Context, esrc uint, edst uint) (err error) {
+	op := dc.startOp(ctx, OP_EXTENT_COPY)
+	defer func() { op.end(err) }()
+	size := dc.opts.copyBufferSize()
+	abuf := AlignedBlock(int(size))
+	for offset := uint(0); offset < EXTENT_SIZE; offset += size {
+		err := dc.retryIO(OP_EXTENT_COPY, esrc, func() error {
+			_, err := dc.f.ReadAt(abuf, uint64(dc.dataOffset+(esrc*EXTENT_SIZE)+offset))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read extent data: %w", err)
+		}
+		err = dc.retryIO(OP_EXTENT_COPY, edst, func() error {
+			_, err := dc.f.WriteAt(abuf, uint64(dc.dataOffset+(edst*EXTENT_SIZE)+offset))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write extent data: %w", err)
+		}
+	}
+	return nil
+}
+
+// Zero a range of the device, writing zeroes if the backend cannot do it otherwise.
+func (dc *DeviceContext) zeroRange(offset uint64, length uint64) error {
+	if zeroed, err := dc.f.ZeroRange(offset, length); err != nil || zeroed {
+		return err
+	}
+	abuf := AlignedBlock(EXTENT_SIZE)
+	for done := uint64(0); done < length; done += EXTENT_SIZE {
+		if _, err := dc.f.WriteAt(abuf[:min(EXTENT_SIZE, length-done)], offset+done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the volume metadata for the given volume name. Returns nil if not found.
+func (dc *DeviceContext) FindVolume(volumeName string) *VolumeMetadata {
+	var vname [MAX_VOLUME_NAME_SIZE + 1]byte
+	copy(vname[:], volumeName)
+	for i := 0; i < MAX_VOLUMES; i++ {
+		if dc.volumes[i].SnapshotId == 0 || dc.volumes[i].DeletedAt != 0 {
+			continue
+		}
+		if dc.volumes[i].VolumeName == vname {
+			return &dc.volumes[i]
+		}
+	}
+	return nil
+}
+
+// Find the most recently deleted volume in the trash with the given name. Returns nil if not found.
+func (dc *DeviceContext) FindDeletedVolume(volumeName string) *VolumeMetadata {
+	var vname [MAX_VOLUME_NAME_SIZE + 1]byte
+	copy(vname[:], volumeName)
+	var v *VolumeMetadata
+	for i := 0; i < MAX_VOLUMES; i++ {
+		if dc.volumes[i].SnapshotId == 0 || dc.volumes[i].DeletedAt == 0 {
+			continue
+		}
+		if dc.volumes[i].VolumeName == vname && (v == nil || dc.volumes[i].DeletedAt > v.DeletedAt) {
+			v = &dc.volumes[i]
+		}
+	}
+	return v
+}
+
+// Find the descendant of the snapshot with the given identifier. Returns 0 if not found.
+func (dc *DeviceContext) FindChildSnapshot(snapshotId uint16) uint16 {
+	for i := 0; i < MAX_SNAPSHOTS; i++ {
+		if dc.snapshots[i].CreatedAt == 0 {
+			continue
+		}
+		if dc.snapshots[i].ParentSnapshotId == snapshotId {
+			return uint16(i + 1)
+		}
+	}
+	return 0
+}
+
+// Find the volume metadata for the given snapshot identifier. Returns nil if not found, or if the volume is in the trash.
+func (dc *DeviceContext) FindVolumeWithSnapshot(snapshotId uint16) *VolumeMetadata {
+	for sid := snapshotId; sid > 0; sid = dc.FindChildSnapshot(sid) {
+		for i := 0; i < MAX_VOLUMES; i++ {
+			if dc.volumes[i].SnapshotId == sid && dc.volumes[i].DeletedAt == 0 {
+				return &dc.volumes[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (dc *DeviceContext) CountVolumes() uint {
+	count := uint(0)
+	for i := 0; i < MAX_VOLUMES; i++ {
+		if dc.volumes[i].SnapshotId == 0 || dc.volumes[i].DeletedAt != 0 {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func (dc *DeviceContext) CountSnapshots(v *VolumeMetadata) uint {
+	count := uint(0)
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		count++
+	}
+	return count
+}
+
+// Add a new volume (and corresponding snapshot). Return a pointer to the volume metadata.
+func (dc *DeviceContext) AddVolume(volumeName string, volumeSize uint64) (*VolumeMetadata, error) {
+	if err := dc.checkVolumeName(volumeName, nil); err != nil {
+		return nil, err
+	}
+	var vidx uint
+	for vidx = 0; vidx < MAX_VOLUMES && dc.volumes[vidx].SnapshotId != 0; vidx++ {
+	}
+	if vidx == MAX_VOLUMES {
+		return nil, fmt.Errorf("%w: max volume count reached", ErrNoSpace)
+	}
+
+	sid, err := dc.AddSnapshot(0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.resetVolumeStats(vidx); err != nil {
+		return nil, err
+	}
+	dc.volumes[vidx].SnapshotId = uint16(sid)
+	dc.volumes[vidx].VolumeSize = (volumeSize / EXTENT_SIZE) * EXTENT_SIZE
+	dc.volumes[vidx].SetName(volumeName)
+	return &dc.volumes[vidx], nil
+}
+
+// Add a new snapshot, keeping the SNAPSHOT_FLAG_ZEROED flag of its parent. Labels left by a deleted snapshot
+// with the same identifier are removed. Return the snapshot identifier.
+func (dc *DeviceContext) AddSnapshot(parentSnapshotId uint16, createdAt time.Time) (uint16, error) {
+	if createdAt.Unix() <= 0 {
+		return 0, fmt.Errorf("invalid snapshot creation time %v", createdAt)
+	}
+	var sidx uint
+	for sidx = 0; sidx < MAX_SNAPSHOTS && dc.snapshots[sidx].CreatedAt != 0; sidx++ {
+	}
+	if sidx == MAX_SNAPSHOTS {
+		return 0, fmt.Errorf("%w: max snapshot count reached", ErrNoSpace)
+	}
+
+	dc.snapshots[sidx] = SnapshotMetadata{
+		ParentSnapshotId: parentSnapshotId,
+		CreatedAt:        createdAt.Unix(),
+	}
+	if parentSnapshotId != 0 {
+		dc.snapshots[sidx].Flags = dc.snapshots[parentSnapshotId-1].Flags & SNAPSHOT_FLAG_ZEROED
+	}
+	dc.removeSnapshotLabels(uint16(sidx) + 1)
+	return uint16(sidx) + 1, nil
+}
+
+// Close the device file descriptor, releasing any lock held. Closing more than once has no effect. If metadata
+// updates were not flushed, as per the sync policy, and cannot be, the device is left open and
+// ErrShutdownPending is returned, so that closing can be retried.
+func (dc *DeviceContext) Close() error {
+	if dc.closed {
+		return nil
+	}
+	if err := dc.f.Sync(); err != nil {
+		if dc.unflushed {
+			return fmt.Errorf("%w: cannot sync metadata updates: %v", ErrShutdownPending, err)
+		}
+		dc.closed = true
+		dc.f.Close()
+		return fmt.Errorf("cannot sync device: %w", err)
+	}
+	dc.closed = true
+	dc.f.Close()
+	return nil
+}
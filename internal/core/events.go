@@ -0,0 +1,213 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of events sent to watchers and hooks.
+const (
+	EVENT_DEVICE_INITIALIZED = "device_initialized"
+	EVENT_VOLUME_CREATED     = "volume_created"
+	EVENT_VOLUME_CLONED      = "volume_cloned"
+	EVENT_VOLUME_RENAMED     = "volume_renamed"
+	EVENT_VOLUME_DELETED     = "volume_deleted"
+	EVENT_VOLUME_UNDELETED   = "volume_undeleted"
+	EVENT_VOLUME_PURGED      = "volume_purged"
+	EVENT_SNAPSHOT_CREATED   = "snapshot_created"
+	EVENT_SNAPSHOT_DELETED   = "snapshot_deleted"
+	EVENT_SPACE_LOW          = "space_low"
+	EVENT_VOLUME_FAILED      = "volume_failed"
+	EVENT_MIRROR_DEGRADED    = "mirror_degraded"
+	EVENT_MIRROR_RESYNCED    = "mirror_resynced"
+	EVENT_SCRUB_ERROR        = "scrub_error"
+	EVENT_SCRUB_COMPLETED    = "scrub_completed"
+	EVENT_ERROR              = "error"
+
+	DEFAULT_WATCH_BUFFER = 64
+)
+
+// A change to a device made by the process, or a condition found while using it.
+type Event struct {
+	Type       string
+	Time       time.Time
+	Device     string
+	VolumeName string // Volume the event refers to, with its new name if renamed
+	SnapshotId uint   // Snapshot created (as returned by CreateSnapshot), deleted, or cloned
+	// Previous name of a renamed volume, usage for EVENT_SPACE_LOW, media errors for EVENT_VOLUME_FAILED, the
+	// failed copy for EVENT_MIRROR_DEGRADED and EVENT_MIRROR_RESYNCED, the problem found for EVENT_SCRUB_ERROR,
+	// a summary for EVENT_SCRUB_COMPLETED, or the error for EVENT_ERROR
+	Detail string
+}
+
+// Settings of a watcher. The zero value receives all events except EVENT_SPACE_LOW.
+type WatchOptions struct {
+	Buffer         uint // Events kept until received, further ones are dropped (DEFAULT_WATCH_BUFFER if zero)
+	SpaceThreshold uint // Percentage of device extents allocated at which EVENT_SPACE_LOW is sent (none if zero)
+}
+
+type watcher struct {
+	ch        chan Event
+	threshold uint
+	spaceLow  bool // Set while allocation is over the threshold, so the event is sent once per crossing
+}
+
+// Function called with each event of a device, as registered with AddHook.
+type Hook func(e Event)
+
+type hook struct {
+	fn Hook
+}
+
+var (
+	watchersMu sync.Mutex
+	watchers   = make(map[string][]*watcher)
+	hooks      = make(map[string][]*hook)
+	watching   atomic.Int32 // Number of watchers and hooks of all devices, to skip notifications when zero
+)
+
+// Receive events for a device, as changed by this process through any API call, until the returned function is
+// called, which closes the channel. The device is identified by the path given to the other calls. Events are
+// sent after the change is written, and dropped if the buffer of a watcher is full. Options may be nil.
+func Watch(device string, opts *WatchOptions) (<-chan Event, func()) {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	buffer := opts.Buffer
+	if buffer == 0 {
+		buffer = DEFAULT_WATCH_BUFFER
+	}
+	w := &watcher{ch: make(chan Event, buffer), threshold: opts.SpaceThreshold}
+	watchersMu.Lock()
+	watchers[device] = append(watchers[device], w)
+	watchersMu.Unlock()
+	watching.Add(1)
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			watchersMu.Lock()
+			defer watchersMu.Unlock()
+			ws := watchers[device]
+			for i := range ws {
+				if ws[i] == w {
+					watchers[device] = append(ws[:i:i], ws[i+1:]...)
+					break
+				}
+			}
+			if len(watchers[device]) == 0 {
+				delete(watchers, device)
+			}
+			watching.Add(-1)
+			close(w.ch)
+		})
+	}
+}
+
+// Call a function with each event of a device, as sent to watchers without a space threshold, until the returned
+// function is called. Unlike watchers, hooks get every event, but are called by the API call making the change,
+// after it is written, which waits for them to return. Hooks that take long, like those running commands or
+// calling services when volumes are created or deleted, should hand events over to another goroutine. Hooks may
+// not make API calls on the device themselves.
+func AddHook(device string, fn Hook) func() {
+	h := &hook{fn: fn}
+	watchersMu.Lock()
+	hooks[device] = append(hooks[device], h)
+	watchersMu.Unlock()
+	watching.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			watchersMu.Lock()
+			defer watchersMu.Unlock()
+			hs := hooks[device]
+			for i := range hs {
+				if hs[i] == h {
+					hooks[device] = append(hs[:i:i], hs[i+1:]...)
+					break
+				}
+			}
+			if len(hooks[device]) == 0 {
+				delete(hooks, device)
+			}
+			watching.Add(-1)
+		})
+	}
+}
+
+// Send an event to the watchers and hooks of a device.
+func notify(device string, e Event) {
+	if watching.Load() == 0 {
+		return
+	}
+	e.Device = device
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	watchersMu.Lock()
+	for _, w := range watchers[device] {
+		select {
+		case w.ch <- e:
+		default:
+		}
+	}
+	hs := hooks[device]
+	watchersMu.Unlock()
+	// Called unlocked, so that hooks may add or remove hooks and watchers
+	for _, h := range hs {
+		h.fn(e)
+	}
+}
+
+func (dc *DeviceContext) notify(eventType string, volumeName string, snapshotId uint16) {
+	notify(dc.device, Event{Type: eventType, VolumeName: volumeName, SnapshotId: uint(snapshotId)})
+}
+
+func (dc *DeviceContext) notifyError(err error) {
+	notify(dc.device, Event{Type: EVENT_ERROR, Detail: err.Error()})
+}
+
+// Send EVENT_SPACE_LOW to watchers whose threshold the allocated extents reached since the last check. Allocation
+// is measured by the allocation mark, as in DeviceInfo.
+func (dc *DeviceContext) checkSpace() {
+	if watching.Load() == 0 {
+		return
+	}
+	allocated := uint(dc.superblock.AllocatedDeviceExtents)
+	e := Event{
+		Type:   EVENT_SPACE_LOW,
+		Time:   time.Now(),
+		Device: dc.device,
+		Detail: fmt.Sprintf("%v of %v extents allocated", allocated, dc.totalDeviceExtents),
+	}
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for _, w := range watchers[dc.device] {
+		if w.threshold == 0 {
+			continue
+		}
+		low := allocated*100 >= w.threshold*dc.totalDeviceExtents
+		if low && !w.spaceLow {
+			select {
+			case w.ch <- e:
+			default:
+			}
+		}
+		w.spaceLow = low
+	}
+}
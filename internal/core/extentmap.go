@@ -0,0 +1,443 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"math/bits"
+
+	"github.com/kelindar/bitmap"
+)
+
+const (
+	EXTENT_BATCH     = 65536
+	EXTENT_PAGE_SIZE = 1024 // Extents per page of an extent map
+)
+
+// Extents of a page of an extent map, holding only those in the map, in order. The bitmap marks which
+// extents of the page they are.
+type extentPage struct {
+	present [EXTENT_PAGE_SIZE / 64]uint64
+	extents []ExtentMetadata
+}
+
+// Return the index in extents of an extent of the page, and whether it is present.
+func (p *extentPage) find(i uint32) (int, bool) {
+	w, bit := i/64, uint64(1)<<(i%64)
+	n := bits.OnesCount64(p.present[w] & (bit - 1))
+	for _, word := range p.present[:w] {
+		n += bits.OnesCount64(word)
+	}
+	return n, p.present[w]&bit != 0
+}
+
+// Map of the whole volume. Empty extents have an empty snapshot identifier. The extent bitmap is used to speed up operations.
+// Extents are kept in pages allocated on demand, each holding only the extents in the map, so sparse volumes
+// take little memory. Partial extents have the extents of previous snapshots they inherit blocks from kept
+// separately, most recent first.
+type ExtentMap struct {
+	dc                 *DeviceContext
+	totalVolumeExtents uint
+	extentBitmap       bitmap.Bitmap
+	pages              []*extentPage
+	inherited          map[uint32][]ExtentMetadata
+	allocationPolicy   uint8
+	tier               uint8
+}
+
+func newExtentMap(dc *DeviceContext, deviceSize uint64) *ExtentMap {
+	em := &ExtentMap{
+		dc:                 dc,
+		totalVolumeExtents: uint(deviceSize / EXTENT_SIZE),
+		inherited:          make(map[uint32][]ExtentMetadata),
+		allocationPolicy:   dc.AllocationPolicy(nil),
+	}
+	em.extentBitmap.Grow(uint32(em.totalVolumeExtents - 1))
+	em.pages = make([]*extentPage, (em.totalVolumeExtents+EXTENT_PAGE_SIZE-1)/EXTENT_PAGE_SIZE)
+	return em
+}
+
+// Return the metadata of an extent, empty if not in the map.
+func (em *ExtentMap) get(eidx uint32) ExtentMetadata {
+	if p := em.pages[eidx/EXTENT_PAGE_SIZE]; p != nil {
+		if n, ok := p.find(eidx % EXTENT_PAGE_SIZE); ok {
+			return p.extents[n]
+		}
+	}
+	return ExtentMetadata{}
+}
+
+// Return a pointer to the metadata of an extent, to be updated in place, adding an empty one if not in the
+// map. The pointer is valid until another extent of the same page is added or removed.
+func (em *ExtentMap) extent(eidx uint32) *ExtentMetadata {
+	p := em.pages[eidx/EXTENT_PAGE_SIZE]
+	if p == nil {
+		p = new(extentPage)
+		em.pages[eidx/EXTENT_PAGE_SIZE] = p
+	}
+	i := eidx % EXTENT_PAGE_SIZE
+	n, ok := p.find(i)
+	if !ok {
+		p.extents = append(p.extents, ExtentMetadata{})
+		copy(p.extents[n+1:], p.extents[n:])
+		p.extents[n] = ExtentMetadata{}
+		p.present[i/64] |= 1 << (i % 64)
+	}
+	return &p.extents[n]
+}
+
+// Drop an extent from the map, releasing its page when empty.
+func (em *ExtentMap) remove(eidx uint32) {
+	em.extentBitmap.Remove(eidx)
+	p := em.pages[eidx/EXTENT_PAGE_SIZE]
+	if p == nil {
+		return
+	}
+	i := eidx % EXTENT_PAGE_SIZE
+	n, ok := p.find(i)
+	if !ok {
+		return
+	}
+	delete(em.inherited, eidx)
+	p.extents = append(p.extents[:n], p.extents[n+1:]...)
+	p.present[i/64] &^= 1 << (i % 64)
+	if len(p.extents) == 0 {
+		em.pages[eidx/EXTENT_PAGE_SIZE] = nil
+	}
+}
+
+// Return true if blocks of an extent may be inherited from an extent of an older snapshot than those
+// already known.
+func (em *ExtentMap) inherits(eidx uint32) bool {
+	if chain := em.inherited[eidx]; len(chain) > 0 {
+		return chain[len(chain)-1].Flags&EXTENT_FLAG_PARTIAL != 0
+	}
+	return em.get(eidx).Flags&EXTENT_FLAG_PARTIAL != 0
+}
+
+// Return the extent of a previous snapshot holding a block not in the bitmap of a partial extent.
+func (em *ExtentMap) inheritedBlock(eidx uint32, bidx uint32) (ExtentMetadata, bool) {
+	for _, e := range em.inherited[eidx] {
+		bb := bitmap.FromBytes(e.BlockBitmap[:])
+		if bb.Contains(bidx) {
+			return e, true
+		}
+		if e.Flags&EXTENT_FLAG_PARTIAL == 0 {
+			break
+		}
+	}
+	return ExtentMetadata{}, false
+}
+
+// Point a volume extent, or an extent it inherits from, at the device position an extent was moved to.
+func (em *ExtentMap) relocate(eidx uint32, psrc uint32, pdst uint32) {
+	if uint(eidx) >= em.totalVolumeExtents || !em.extentBitmap.Contains(eidx) {
+		return
+	}
+	if e := em.extent(eidx); e.ExtentPos == psrc {
+		e.ExtentPos = pdst
+		return
+	}
+	for i := range em.inherited[eidx] {
+		if em.inherited[eidx][i].ExtentPos == psrc {
+			em.inherited[eidx][i].ExtentPos = pdst
+		}
+	}
+}
+
+// Take the block bitmap and flags of an extent, or an extent it inherits from, at the device position of the given
+// extent, after blocks were merged into it.
+func (em *ExtentMap) merged(eidx uint32, me ExtentMetadata) {
+	if uint(eidx) >= em.totalVolumeExtents || !em.extentBitmap.Contains(eidx) {
+		return
+	}
+	if e := em.extent(eidx); e.ExtentPos == me.ExtentPos {
+		e.BlockBitmap = me.BlockBitmap
+		e.Flags = me.Flags
+		if e.Flags&EXTENT_FLAG_PARTIAL == 0 {
+			delete(em.inherited, eidx)
+		}
+		return
+	}
+	for i := range em.inherited[eidx] {
+		if em.inherited[eidx][i].ExtentPos == me.ExtentPos {
+			em.inherited[eidx][i].BlockBitmap = me.BlockBitmap
+			em.inherited[eidx][i].Flags = me.Flags
+		}
+	}
+}
+
+// Add the extents of a snapshot to the map. Unless replace is set, extents already in the map are kept, and
+// snapshots must be loaded from the most recent, so that partial extents get the extents they inherit from.
+func (em *ExtentMap) load(snapshotId uint16, replace bool) error {
+	positions, err := em.dc.snapshotExtents(snapshotId)
+	if err != nil {
+		return err
+	}
+	return em.dc.readExtentsAt(positions, func(pos uint32, e *ExtentMetadata) {
+		eidx := e.ExtentPos
+		if e.SnapshotId != snapshotId || uint(eidx) >= em.totalVolumeExtents {
+			return
+		}
+		if top := em.get(eidx); !replace && top.SnapshotId != 0 {
+			if top.SnapshotId != snapshotId && em.inherits(eidx) {
+				ie := *e
+				ie.ExtentPos = pos
+				em.inherited[eidx] = append(em.inherited[eidx], ie)
+			}
+			return
+		}
+		em.extentBitmap.Set(eidx)
+		*em.extent(eidx) = *e
+		// Convert ExtentPos from position in volume to position in device
+		em.extent(eidx).ExtentPos = pos
+	})
+}
+
+// Get the map of a specific snapshot.
+func GetSnapshotExtentMap(dc *DeviceContext, deviceSize uint64, snapshotId uint16) (*ExtentMap, error) {
+	sem := newExtentMap(dc, deviceSize)
+	if err := sem.load(snapshotId, true); err != nil {
+		return nil, err
+	}
+	return sem, nil
+}
+
+// Get the map of a volume starting at a snapshot and including all ancestors.
+func GetVolumeExtentMap(dc *DeviceContext, deviceSize uint64, snapshotId uint16) (*ExtentMap, error) {
+	vem, err := GetSnapshotExtentMap(dc, deviceSize, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	for sid := dc.snapshots[snapshotId-1].ParentSnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		if err := vem.load(sid, false); err != nil {
+			return nil, err
+		}
+	}
+	return vem, nil
+}
+
+// Write extent metadata to the device.
+func (em *ExtentMap) WriteExtent(eidx uint32) error {
+	e := em.get(eidx)
+	// Convert ExtentPos from position in device to position in volume
+	e.ExtentPos = eidx
+	return em.dc.WriteExtent(&e, uint(em.get(eidx).ExtentPos))
+}
+
+// Allocate a new extent into the map.
+func (em *ExtentMap) NewExtentToSnapshot(eidx uint32, snapshotId uint16) error {
+	pdst, err := em.dc.AllocateExtent(em, eidx)
+	if err != nil {
+		return err
+	}
+	if err := em.dc.zeroNewExtent(pdst, snapshotId); err != nil {
+		return err
+	}
+	e := em.extent(eidx)
+	e.SnapshotId = snapshotId
+	e.ExtentPos = pdst
+	em.extentBitmap.Set(eidx)
+	return em.WriteExtent(eidx)
+}
+
+// Allocate a new partial extent into the map, inheriting all blocks from the extent it replaces, which
+// belongs to a previous snapshot.
+func (em *ExtentMap) NewPartialExtentToSnapshot(eidx uint32, snapshotId uint16) error {
+	pdst, err := em.dc.AllocateExtent(em, eidx)
+	if err != nil {
+		return err
+	}
+	if err := em.dc.zeroNewExtent(pdst, snapshotId); err != nil {
+		return err
+	}
+	em.inherited[eidx] = append([]ExtentMetadata{em.get(eidx)}, em.inherited[eidx]...)
+	e := em.extent(eidx)
+	e.SnapshotId = snapshotId
+	e.ExtentPos = pdst
+	e.BlockBitmap = [EXTENT_BITMAP_SIZE]byte{}
+	e.Flags = EXTENT_FLAG_PARTIAL
+	em.extentBitmap.Set(eidx)
+	return em.WriteExtent(eidx)
+}
+
+// Copy the blocks a partial extent inherits into it, so that it no longer depends on previous snapshots.
+func (em *ExtentMap) materialize(eidx uint32) error {
+	e := em.extent(eidx)
+	if e.Flags&EXTENT_FLAG_PARTIAL == 0 {
+		return nil
+	}
+	bb := bitmap.FromBytes(e.BlockBitmap[:])
+	data := make([]byte, BLOCK_SIZE)
+	for bidx := uint32(0); bidx < 1<<BLOCK_BITS_IN_EXTENT; bidx++ {
+		if bb.Contains(bidx) {
+			continue
+		}
+		ie, ok := em.inheritedBlock(eidx, bidx)
+		if !ok {
+			continue
+		}
+		if err := em.dc.ReadBlockData(data, uint(ie.ExtentPos), uint(bidx)); err != nil {
+			return err
+		}
+		if err := em.dc.WriteBlockData(data, uint(e.ExtentPos), uint(bidx)); err != nil {
+			return err
+		}
+		bb.Set(bidx)
+	}
+	e.Flags &^= EXTENT_FLAG_PARTIAL
+	delete(em.inherited, eidx)
+	return em.WriteExtent(eidx)
+}
+
+// Copy over all data from an extent to another snapshot and update the map. Blocks inherited by partial
+// extents are copied as well.
+func (em *ExtentMap) CopyExtentToSnapshot(eidx uint32, snapshotId uint16) error {
+	return em.copyExtentToSnapshot(context.Background(), eidx, snapshotId)
+}
+
+// Copy an extent to another snapshot as with CopyExtentToSnapshot, traced as part of the span in the context.
+func (em *ExtentMap) copyExtentToSnapshot(ctx context.Context, eidx uint32, snapshotId uint16) error {
+	psrc := em.get(eidx).ExtentPos
+	pdst, err := em.dc.AllocateExtent(em, eidx)
+	if err != nil {
+		return err
+	}
+	if err := em.dc.copyExtentData(ctx, uint(psrc), uint(pdst)); err != nil {
+		return err
+	}
+	e := em.extent(eidx)
+	e.SnapshotId = snapshotId
+	e.ExtentPos = pdst
+	em.extentBitmap.Set(eidx)
+	if e.Flags&EXTENT_FLAG_PARTIAL != 0 {
+		return em.materialize(eidx)
+	}
+	return em.WriteExtent(eidx)
+}
+
+// Copy the whole map to another snapshot.
+func (em *ExtentMap) CopyAllToSnapshot(snapshotId uint16) error {
+	var cbErr error
+	em.extentBitmap.Range(func(x uint32) {
+		if cbErr != nil {
+			return
+		}
+		if err := em.CopyExtentToSnapshot(x, snapshotId); err != nil {
+			cbErr = err
+			return
+		}
+	})
+	if cbErr != nil {
+		return cbErr
+	}
+	return nil
+
+}
+
+// Merge the map of a snapshot being deleted into the map of its child, assigning extents to the given snapshot.
+// Extents are combined at block granularity:
+//   - Extents missing from the child are moved to it, keeping their blocks, and are dropped from the source
+//     map, so that ClearAll only releases the rest.
+//   - Full extents of the child already hold all of its blocks, as blocks missing from them were unmapped,
+//     so the source extents are left to be released.
+//   - Partial extents of the child take over the blocks they inherit from the source extents, which are
+//     copied into them.
+func (em *ExtentMap) MergeAllInto(emdst *ExtentMap, snapshotId uint16) error {
+	var merged []uint32
+	var cbErr error
+	em.extentBitmap.Range(func(x uint32) {
+		if cbErr != nil {
+			return
+		}
+		if emdst.get(x).SnapshotId != 0 {
+			cbErr = em.mergeBlocksInto(emdst, x)
+			return
+		}
+		e := emdst.extent(x)
+		*e = em.get(x)
+		e.SnapshotId = snapshotId
+		emdst.extentBitmap.Set(x)
+		if err := emdst.WriteExtent(x); err != nil {
+			cbErr = err
+			return
+		}
+		merged = append(merged, x)
+	})
+	for _, x := range merged {
+		em.remove(x)
+	}
+	return cbErr
+}
+
+// Copy the blocks of an extent missing from a partial extent of the destination map into it. The destination
+// extent stays partial only if the source extent is, as it then inherits the rest from the same extents of
+// older snapshots. Otherwise, blocks missing from both read as zero, as blocks unmapped from the source did.
+// Blocks are written before the metadata, so the destination extent is unchanged if interrupted.
+func (em *ExtentMap) mergeBlocksInto(emdst *ExtentMap, eidx uint32) error {
+	e := emdst.extent(eidx)
+	if e.Flags&EXTENT_FLAG_PARTIAL == 0 {
+		return nil
+	}
+	src := em.get(eidx)
+	sbb := bitmap.FromBytes(src.BlockBitmap[:])
+	bb := bitmap.FromBytes(e.BlockBitmap[:])
+	data := make([]byte, BLOCK_SIZE)
+	var cbErr error
+	sbb.Range(func(bidx uint32) {
+		if cbErr != nil || bb.Contains(bidx) {
+			return
+		}
+		if cbErr = em.dc.ReadBlockData(data, uint(src.ExtentPos), uint(bidx)); cbErr != nil {
+			return
+		}
+		if cbErr = em.dc.WriteBlockData(data, uint(e.ExtentPos), uint(bidx)); cbErr != nil {
+			return
+		}
+		bb.Set(bidx)
+	})
+	if cbErr != nil {
+		return cbErr
+	}
+	if src.Flags&EXTENT_FLAG_PARTIAL == 0 {
+		e.Flags &^= EXTENT_FLAG_PARTIAL
+	}
+	return emdst.WriteExtent(eidx)
+}
+
+// Clear all metadata included in the map, overwriting the data of extents of snapshots being securely deleted.
+func (em *ExtentMap) ClearAll() error {
+	var e ExtentMetadata
+	var cbErr error
+	em.extentBitmap.Range(func(x uint32) {
+		if cbErr != nil {
+			return
+		}
+		eidx := em.get(x).ExtentPos
+		if err := em.dc.maybeShredExtent(eidx, em.get(x).SnapshotId); err != nil {
+			cbErr = err
+			return
+		}
+		if err := em.dc.WriteExtent(&e, uint(eidx)); err != nil {
+			cbErr = err
+			return
+		}
+		em.dc.ReleaseExtent(eidx)
+	})
+	if cbErr != nil {
+		return cbErr
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Start or stop keeping the time of the last write to each extent, which tools can use for time-based
+// incremental copies or to tell hot from cold data without diffing snapshots. Times are kept in a table taking
+// the last extents of the data area, so these must be free, as after vacuuming the device. Times are recorded
+// when extents are allocated and, for writes to extents already allocated, with the volume stats, so they may
+// lag behind by up to STATS_FLUSH_INTERVAL while the volume is open. Versions that do not know of them can only
+// open such devices read-only.
+func SetDeviceExtentTimes(device string, enabled bool) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	if enabled == (dc.extentTimeOffset != 0) {
+		return dc.Close()
+	}
+	if enabled {
+		layout := format.NewReservedLayout(dc.superblock.DeviceSize, dc.superblock.ReservedSize)
+		extents, offset := layout.ExtentTimeTable()
+		total := uint32(dc.totalDeviceExtents - uint(extents))
+		if extents == 0 || dc.superblock.AllocatedDeviceExtents > total {
+			return fmt.Errorf("%w: extent time table needs the last %v extents (vacuum the device first)", ErrNoSpace, extents)
+		}
+		if dc.superblock.FastExtents > total {
+			return fmt.Errorf("%w: extent time table overlaps the fast region", ErrNoSpace)
+		}
+		if err := dc.zeroRange(offset, extents*EXTENT_SIZE); err != nil {
+			return fmt.Errorf("failed to clear extent time table: %w", err)
+		}
+		dc.superblock.FeatureRoCompat |= FEATURE_RO_COMPAT_EXTENT_TIMES
+	} else {
+		dc.superblock.FeatureRoCompat &^= FEATURE_RO_COMPAT_EXTENT_TIMES
+	}
+	dc.setLayout()
+	dc.extentBatch = dc.opts.extentBatch(dc.totalDeviceExtents)
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Write the times of the last writes to the extents at the given device positions, as seconds since the
+// epoch. Must be called with the metadata lock held. Writes are flushed with the next metadata update.
+func (dc *DeviceContext) writeExtentTimes(times map[uint32]int64) error {
+	if dc.extentTimeOffset == 0 || len(times) == 0 {
+		return nil
+	}
+	blocks := make(map[uint64][]uint32)
+	for pos := range times {
+		if uint(pos) >= dc.totalDeviceExtents {
+			continue
+		}
+		start := dc.extentTimeEntry(pos) / BLOCK_SIZE * BLOCK_SIZE
+		blocks[start] = append(blocks[start], pos)
+	}
+	abuf := AlignedBlock(BLOCK_SIZE)
+	for start, positions := range blocks {
+		if _, err := dc.f.ReadAt(abuf, start); err != nil {
+			return fmt.Errorf("failed to read extent times: %w", err)
+		}
+		for _, pos := range positions {
+			binary.LittleEndian.PutUint32(abuf[dc.extentTimeEntry(pos)-start:], uint32(times[pos]))
+		}
+		if _, err := dc.f.WriteAt(abuf, start); err != nil {
+			return fmt.Errorf("failed to write extent times: %w", err)
+		}
+	}
+	dc.unflushed = true
+	return nil
+}
+
+// Record that the extent at a device position was written now, as when it is allocated.
+func (dc *DeviceContext) touchExtent(pos uint32) error {
+	return dc.writeExtentTimes(map[uint32]int64{pos: time.Now().Unix()})
+}
+
+// Move the time of the extent at a device position to another, as when the extent is relocated.
+func (dc *DeviceContext) moveExtentTime(psrc uint32, pdst uint32) error {
+	if dc.extentTimeOffset == 0 {
+		return nil
+	}
+	r := extentTimeReader{dc: dc}
+	t, err := r.time(psrc)
+	if err != nil {
+		return err
+	}
+	times := map[uint32]int64{psrc: 0, pdst: 0}
+	if !t.IsZero() {
+		times[pdst] = t.Unix()
+	}
+	return dc.writeExtentTimes(times)
+}
+
+// Offset in the device of the time of the extent at a device position.
+func (dc *DeviceContext) extentTimeEntry(pos uint32) uint64 {
+	return uint64(dc.extentTimeOffset) + uint64(pos)*SIZEOF_EXTENT_TIME
+}
+
+// Reads extent times, keeping the last block read, as extents are usually looked up in order.
+type extentTimeReader struct {
+	dc    *DeviceContext
+	start uint64 // Offset of the block in buf
+	buf   []byte
+}
+
+// Return the time of the last write to the extent at a device position, zero if not known.
+func (r *extentTimeReader) time(pos uint32) (time.Time, error) {
+	if r.dc.extentTimeOffset == 0 || uint(pos) >= r.dc.totalDeviceExtents {
+		return time.Time{}, nil
+	}
+	offset := r.dc.extentTimeEntry(pos)
+	start := offset / BLOCK_SIZE * BLOCK_SIZE
+	if r.buf == nil || r.start != start {
+		if r.buf == nil {
+			r.buf = AlignedBlock(BLOCK_SIZE)
+		}
+		if _, err := r.dc.f.ReadAt(r.buf, start); err != nil {
+			r.buf = nil
+			return time.Time{}, fmt.Errorf("failed to read extent times: %w", err)
+		}
+		r.start = start
+	}
+	t := binary.LittleEndian.Uint32(r.buf[offset-start:])
+	if t == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(t), 0), nil
+}
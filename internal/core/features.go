@@ -0,0 +1,37 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+var ErrUnsupportedFeature = errors.New("unsupported device feature")
+
+// Check that the features of a device are known, so that it can be used, or, for writing, also changed. Devices
+// with unknown incompatible features cannot be used at all, and with unknown read-only compatible features can
+// only be read. Unknown compatible features are ignored.
+func checkFeatures(sb *Superblock, write bool) error {
+	if unknown := sb.FeatureIncompat &^ format.FEATURE_INCOMPAT_SUPPORTED; unknown != 0 {
+		return fmt.Errorf("%w: incompatible features 0x%x", ErrUnsupportedFeature, unknown)
+	}
+	if unknown := sb.FeatureRoCompat &^ format.FEATURE_RO_COMPAT_SUPPORTED; write && unknown != 0 {
+		return fmt.Errorf("%w: features 0x%x only allow reading", ErrUnsupportedFeature, unknown)
+	}
+	return nil
+}
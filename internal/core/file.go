@@ -0,0 +1,167 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Alignment of buffers, offsets and sizes for direct I/O.
+const ALIGN_SIZE = 4096
+
+var ErrUnsupportedSectorSize = errors.New("sector size larger than block size")
+
+// Wrapper to file object supporting direct I/O
+type DirectFile struct {
+	*os.File
+	Name       string
+	Direct     bool // False if writes go through the page cache
+	SectorSize uint // Alignment required for direct I/O, zero if unknown
+	buffered   bool // Writes are not synchronous, so metadata updates are followed by an explicit sync
+}
+
+// Open a file for direct I/O. Where direct I/O is not supported, the file is opened with synchronous writes.
+// Devices whose sectors are larger than a block cannot be accessed with direct I/O and are rejected.
+func NewDirectFile(name string, flag int, perm os.FileMode) (*DirectFile, error) {
+	file, direct, err := openDirect(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	df := &DirectFile{
+		File:   file,
+		Name:   name,
+		Direct: direct,
+	}
+	if size, err := sectorSize(file); err == nil {
+		df.SectorSize = size
+	}
+	if direct && df.SectorSize > BLOCK_SIZE {
+		file.Close()
+		return nil, fmt.Errorf("%w: %v has %v-byte sectors", ErrUnsupportedSectorSize, name, df.SectorSize)
+	}
+	return df, nil
+}
+
+// Open a file for buffered I/O, for filesystems that do not support direct I/O. Writes are made durable with
+// explicit syncs.
+func NewBufferedFile(name string, flag int, perm os.FileMode) (*DirectFile, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectFile{File: file, Name: name, buffered: true}, nil
+}
+
+// Open a file for direct I/O, or buffered I/O if requested or if the filesystem rejects direct I/O.
+func openFile(name string, flag int, perm os.FileMode, buffered bool) (*DirectFile, error) {
+	if !buffered {
+		df, err := NewDirectFile(name, flag, perm)
+		if !errors.Is(err, syscall.EINVAL) {
+			return df, err
+		}
+	}
+	return NewBufferedFile(name, flag, perm)
+}
+
+// Return a buffer of the given size, aligned in memory for direct I/O.
+func AlignedBlock(size int) []byte {
+	block := make([]byte, size+ALIGN_SIZE)
+	offset := 0
+	if a := alignment(block); a != 0 {
+		offset = ALIGN_SIZE - a
+	}
+	return block[offset : offset+size : offset+size]
+}
+
+func alignment(block []byte) int {
+	if len(block) == 0 {
+		return 0
+	}
+	return int(uintptr(unsafe.Pointer(&block[0])) & uintptr(ALIGN_SIZE-1))
+}
+
+// Return the size of the file or device. Raw devices are asked through ioctls, as seeking to the end is
+// unreliable on some and meaningless for character devices.
+func (file *DirectFile) Size() (int64, error) {
+	if fi, err := file.File.Stat(); err == nil && fi.Mode()&os.ModeDevice != 0 {
+		size, err := deviceSize(file.File)
+		if err == nil {
+			return size, nil
+		}
+		if fi.Mode()&os.ModeCharDevice != 0 {
+			return 0, fmt.Errorf("cannot get size of %v: %w", file.Name, err)
+		}
+	}
+	pos, err := file.File.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("cannot seek in %v: %w", file.Name, err)
+	}
+	if pos == 0 {
+		// Raw devices on some platforms report their size only through ioctls
+		if size, err := deviceSize(file.File); err == nil {
+			return size, nil
+		}
+	}
+	return pos, nil
+}
+
+// Read using direct I/O
+func (file *DirectFile) ReadAt(data []byte, offset uint64) (int, error) {
+	if alignment(data) == 0 {
+		return file.File.ReadAt(data, int64(offset))
+	}
+	buf := AlignedBlock(len(data))
+	n, err := file.File.ReadAt(buf, int64(offset))
+	if err == nil {
+		copy(data, buf)
+	}
+	return n, err
+}
+
+// Write using direct I/O
+func (file *DirectFile) WriteAt(data []byte, offset uint64) (int, error) {
+	if alignment(data) == 0 {
+		return file.File.WriteAt(data, int64(offset))
+	}
+	buf := AlignedBlock(len(data))
+	copy(buf, data)
+	return file.File.WriteAt(buf, int64(offset))
+}
+
+// Return true if the file bypasses the page cache.
+func (file *DirectFile) DirectIO() bool {
+	return file.Direct
+}
+
+// Sync writes to the device if they are buffered.
+func (file *DirectFile) Flush() error {
+	if !file.buffered {
+		return nil
+	}
+	if err := file.File.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %v: %w", file.Name, err)
+	}
+	return nil
+}
+
+func (file *DirectFile) Close() error {
+	// file.File.Sync()
+	return file.File.Close()
+}
@@ -0,0 +1,64 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	DKIOCGETBLOCKSIZE  = 0x40046418
+	DKIOCGETBLOCKCOUNT = 0x40086419
+)
+
+// Open with F_NOCACHE set, which bypasses the buffer cache like O_DIRECT.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, bool, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_NOCACHE, 1); errno != 0 {
+		file.Close()
+		return nil, false, fmt.Errorf("cannot set F_NOCACHE on %v: %w", name, errno)
+	}
+	return file, true, nil
+}
+
+// Return the size of a raw disk, which reports zero when seeking to the end.
+func deviceSize(file *os.File) (int64, error) {
+	var blockSize uint32
+	var blockCount uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), DKIOCGETBLOCKSIZE, uintptr(unsafe.Pointer(&blockSize))); errno != 0 {
+		return 0, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), DKIOCGETBLOCKCOUNT, uintptr(unsafe.Pointer(&blockCount))); errno != 0 {
+		return 0, errno
+	}
+	return int64(blockSize) * int64(blockCount), nil
+}
+
+// Return the sector size of a raw disk.
+func sectorSize(file *os.File) (uint, error) {
+	var blockSize uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), DKIOCGETBLOCKSIZE, uintptr(unsafe.Pointer(&blockSize))); errno != 0 {
+		return 0, errno
+	}
+	return uint(blockSize), nil
+}
@@ -0,0 +1,39 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !freebsd && !netbsd && !dragonfly && !darwin && !windows
+
+package core
+
+import (
+	"errors"
+	"os"
+)
+
+// Direct I/O is not supported on this platform. Fall back to buffered I/O with synchronous writes.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, bool, error) {
+	file, err := os.OpenFile(name, flag|os.O_SYNC, perm)
+	if err != nil {
+		return nil, false, err
+	}
+	return file, false, nil
+}
+
+func deviceSize(file *os.File) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func sectorSize(file *os.File) (uint, error) {
+	return 0, errors.ErrUnsupported
+}
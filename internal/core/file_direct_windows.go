@@ -0,0 +1,111 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package core
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	FILE_FLAG_NO_BUFFERING  = 0x20000000
+	FILE_FLAG_WRITE_THROUGH = 0x80000000
+
+	IOCTL_DISK_GET_LENGTH_INFO    = 0x7405c
+	IOCTL_DISK_GET_DRIVE_GEOMETRY = 0x70000
+)
+
+type diskGeometry struct {
+	Cylinders         int64
+	MediaType         uint32
+	TracksPerCylinder uint32
+	SectorsPerTrack   uint32
+	BytesPerSector    uint32
+}
+
+// Open with caching disabled and writes going straight to the device. The file is shared with other processes,
+// which coordinate through locks.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, bool, error) {
+	pathp, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, false, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = syscall.GENERIC_READ
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	}
+	createmode := uint32(syscall.OPEN_EXISTING)
+	if flag&os.O_CREATE != 0 {
+		createmode = syscall.OPEN_ALWAYS
+	}
+	h, err := syscall.CreateFile(
+		pathp,
+		access,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil,
+		createmode,
+		syscall.FILE_ATTRIBUTE_NORMAL|FILE_FLAG_NO_BUFFERING|FILE_FLAG_WRITE_THROUGH,
+		0)
+	if err != nil {
+		return nil, false, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(h), name), true, nil
+}
+
+// Return the size of a physical drive or volume, which reports zero when seeking to the end.
+func deviceSize(file *os.File) (int64, error) {
+	var length int64
+	var returned uint32
+	err := syscall.DeviceIoControl(
+		syscall.Handle(file.Fd()),
+		IOCTL_DISK_GET_LENGTH_INFO,
+		nil,
+		0,
+		(*byte)(unsafe.Pointer(&length)),
+		uint32(unsafe.Sizeof(length)),
+		&returned,
+		nil)
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// Return the sector size of a physical drive or volume.
+func sectorSize(file *os.File) (uint, error) {
+	var geometry diskGeometry
+	var returned uint32
+	err := syscall.DeviceIoControl(
+		syscall.Handle(file.Fd()),
+		IOCTL_DISK_GET_DRIVE_GEOMETRY,
+		nil,
+		0,
+		(*byte)(unsafe.Pointer(&geometry)),
+		uint32(unsafe.Sizeof(geometry)),
+		&returned,
+		nil)
+	if err != nil {
+		return 0, err
+	}
+	return uint(geometry.BytesPerSector), nil
+}
@@ -0,0 +1,74 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Return the identity and state of a raw device, as found in sysfs. Attributes of the whole disk are used for
+// partitions.
+func (file *DirectFile) Health() *DeviceHealth {
+	fi, err := file.File.Stat()
+	if err != nil || fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return nil
+	}
+	h := &DeviceHealth{}
+	if size, err := deviceSize(file.File); err == nil {
+		h.Size = uint64(size)
+	}
+	rdev := uint64(fi.Sys().(*syscall.Stat_t).Rdev)
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(rdev), unix.Minor(rdev)))
+	if err != nil {
+		return h
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		dir = filepath.Dir(dir)
+	}
+	h.Model = sysfsAttribute(dir, "device/model")
+	h.Serial = sysfsAttribute(dir, "device/serial", "serial", "device/wwid")
+	h.State = sysfsAttribute(dir, "device/state")
+	h.Rotational = sysfsAttribute(dir, "queue/rotational") == "1"
+	h.LogicalSectorSize = uint(sysfsNumber(dir, "queue/logical_block_size"))
+	h.PhysicalSectorSize = uint(sysfsNumber(dir, "queue/physical_block_size"))
+	h.DiscardGranularity = sysfsNumber(dir, "queue/discard_granularity")
+	return h
+}
+
+// Return the first of the given attributes found under a sysfs directory, trimmed, or an empty string.
+func sysfsAttribute(dir string, names ...string) string {
+	for _, name := range names {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			if value := strings.TrimSpace(string(data)); value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+func sysfsNumber(dir string, name string) uint64 {
+	n, _ := strconv.ParseUint(sysfsAttribute(dir, name), 10, 64)
+	return n
+}
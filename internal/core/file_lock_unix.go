@@ -0,0 +1,48 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix && !solaris && !aix
+
+package core
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Take an advisory lock on the whole file, blocking until it is available.
+func (file *DirectFile) Lock(exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.File.Fd()), how)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot lock %v: %w", file.Name, err)
+		}
+		return nil
+	}
+}
+
+// Release the advisory lock.
+func (file *DirectFile) Unlock() error {
+	if err := syscall.Flock(int(file.File.Fd()), syscall.LOCK_UN); err != nil {
+		return fmt.Errorf("cannot unlock %v: %w", file.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package core
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows locks are mandatory, so lock a single byte far beyond the end of any device. Other processes can still
+// do I/O, but take the same lock to coordinate.
+var lockRange = windows.Overlapped{Offset: 0xFFFFFFFF, OffsetHigh: 0x7FFFFFFF}
+
+// Take the device lock, blocking until it is available.
+func (file *DirectFile) Lock(exclusive bool) error {
+	flags := uint32(0)
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := lockRange
+	if err := windows.LockFileEx(windows.Handle(file.File.Fd()), flags, 0, 1, 0, &ol); err != nil {
+		return fmt.Errorf("cannot lock %v: %w", file.Name, err)
+	}
+	return nil
+}
+
+// Release the device lock.
+func (file *DirectFile) Unlock() error {
+	ol := lockRange
+	if err := windows.UnlockFileEx(windows.Handle(file.File.Fd()), 0, 1, 0, &ol); err != nil {
+		return fmt.Errorf("cannot unlock %v: %w", file.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build freebsd || netbsd || dragonfly
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// Raw devices report their size when seeking to the end.
+func deviceSize(file *os.File) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
+
+func sectorSize(file *os.File) (uint, error) {
+	return 0, syscall.ENOTSUP
+}
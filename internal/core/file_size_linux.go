@@ -0,0 +1,56 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package core
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	_BLKSSZGET    = 0x1268
+	_BLKGETSIZE64 = 0x80081272
+)
+
+// Return the size of a block device.
+func deviceSize(file *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), _BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+// Return the logical sector size of a block device, or the direct I/O alignment of a file where the kernel
+// reports it.
+func sectorSize(file *os.File) (uint, error) {
+	var size int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), _BLKSSZGET, uintptr(unsafe.Pointer(&size))); errno == 0 {
+		return uint(size), nil
+	}
+	var stx unix.Statx_t
+	if err := unix.Statx(int(file.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_DIOALIGN, &stx); err != nil {
+		return 0, err
+	}
+	if stx.Mask&unix.STATX_DIOALIGN == 0 {
+		return 0, syscall.ENOTSUP
+	}
+	return uint(max(stx.Dio_offset_align, stx.Dio_mem_align)), nil
+}
@@ -0,0 +1,51 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_BLKDISCARD           = 0x1277
+	_FALLOC_FL_KEEP_SIZE  = 0x1
+	_FALLOC_FL_PUNCH_HOLE = 0x2
+)
+
+// Discard data, with BLKDISCARD on raw devices and by punching a hole in files. Filesystems without hole
+// punching support leave the data in place.
+func (file *DirectFile) Trim(offset uint64, length uint64) error {
+	fi, err := file.File.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		r := [2]uint64{offset, length}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.File.Fd(), _BLKDISCARD, uintptr(unsafe.Pointer(&r))); errno != 0 && errno != syscall.EOPNOTSUPP {
+			return fmt.Errorf("cannot discard data in %v: %w", file.Name, errno)
+		}
+		return nil
+	}
+	err = syscall.Fallocate(int(file.File.Fd()), _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, int64(offset), int64(length))
+	if err != nil && err != syscall.EOPNOTSUPP {
+		return fmt.Errorf("cannot punch hole in %v: %w", file.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_BLKZEROOUT           = 0x127f
+	_FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// Zero a range with BLKZEROOUT on raw devices and FALLOC_FL_ZERO_RANGE on files. Returns false if the device
+// or filesystem does not support it.
+func (file *DirectFile) ZeroRange(offset uint64, length uint64) (bool, error) {
+	fi, err := file.File.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		r := [2]uint64{offset, length}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.File.Fd(), _BLKZEROOUT, uintptr(unsafe.Pointer(&r))); errno != 0 {
+			err = errno
+		}
+	} else {
+		err = syscall.Fallocate(int(file.File.Fd()), _FALLOC_FL_ZERO_RANGE, int64(offset), int64(length))
+	}
+	switch err {
+	case nil:
+		return true, nil
+	case syscall.EOPNOTSUPP, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS:
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot zero range in %v: %w", file.Name, err)
+}
@@ -0,0 +1,317 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+const (
+	FUZZ_VOLUME_EXTENTS   = 4
+	FUZZ_MAX_VOLUMES      = 4
+	FUZZ_MAX_SNAPSHOTS    = 3 // Per volume, excluding the current one
+	FUZZ_BLOCKS_IN_EXTENT = 4 // Blocks used in each extent, so that operations overlap
+	FUZZ_MAX_OPERATIONS   = 256
+)
+
+// Reference model of volume and snapshot contents. Blocks missing from a map are zero.
+type fuzzVolume struct {
+	name       string
+	snapshotId uint
+	blocks     map[uint64]byte
+}
+
+type fuzzModel struct {
+	t         *testing.T
+	device    string
+	volumes   []*fuzzVolume
+	snapshots map[uint]map[uint64]byte // Contents of all snapshots except the current ones
+	owners    map[uint]*fuzzVolume     // Volume owning each snapshot
+	count     int                      // Volumes ever created, to generate names
+}
+
+func newFuzzModel(t *testing.T, device string) *fuzzModel {
+	return &fuzzModel{
+		t:         t,
+		device:    device,
+		snapshots: make(map[uint]map[uint64]byte),
+		owners:    make(map[uint]*fuzzVolume),
+	}
+}
+
+// Decode a block number from a byte, spreading blocks over the extents of a volume.
+func fuzzBlock(b byte) uint64 {
+	extent := uint64(b/FUZZ_BLOCKS_IN_EXTENT) % FUZZ_VOLUME_EXTENTS
+	return extent<<BLOCK_BITS_IN_EXTENT + uint64(b%FUZZ_BLOCKS_IN_EXTENT)
+}
+
+func fuzzData(value byte) []byte {
+	return bytes.Repeat([]byte{value}, BLOCK_SIZE)
+}
+
+// Return the snapshot identifiers of the model in order.
+func (m *fuzzModel) snapshotIds() []uint {
+	var sids []uint
+	for sid := range m.snapshots {
+		sids = append(sids, sid)
+	}
+	slices.Sort(sids)
+	return sids
+}
+
+func (m *fuzzModel) snapshotCount(fv *fuzzVolume) int {
+	count := 0
+	for _, owner := range m.owners {
+		if owner == fv {
+			count++
+		}
+	}
+	return count
+}
+
+// Apply the operation encoded at the start of the input to both the device and the model, returning the
+// number of bytes consumed.
+func (m *fuzzModel) apply(input []byte) (int, string, error) {
+	arg := func(i int) byte {
+		if i < len(input) {
+			return input[i]
+		}
+		return 0
+	}
+	var fv *fuzzVolume
+	if len(m.volumes) > 0 {
+		fv = m.volumes[int(arg(1))%len(m.volumes)]
+	}
+	switch op := input[0] % 7; {
+	case op == 0 || fv == nil:
+		if len(m.volumes) == FUZZ_MAX_VOLUMES {
+			return 1, "", nil
+		}
+		m.count++
+		name := fmt.Sprintf("vol%v", m.count)
+		vi, err := CreateVolume(m.device, name, FUZZ_VOLUME_EXTENTS*EXTENT_SIZE)
+		if err != nil {
+			return 1, "", err
+		}
+		m.volumes = append(m.volumes, &fuzzVolume{name: name, snapshotId: vi.SnapshotId, blocks: make(map[uint64]byte)})
+		return 1, "create " + name, nil
+	case op == 1:
+		block := fuzzBlock(arg(2))
+		value := arg(3) | 1
+		vc, err := OpenVolume(m.device, fv.name)
+		if err != nil {
+			return 4, "", err
+		}
+		defer vc.CloseVolume()
+		if err := vc.WriteBlock(fuzzData(value), block, true); err != nil {
+			return 4, "", err
+		}
+		fv.blocks[block] = value
+		return 4, fmt.Sprintf("write %v block %v value %v", fv.name, block, value), nil
+	case op == 2:
+		block := fuzzBlock(arg(2))
+		vc, err := OpenVolume(m.device, fv.name)
+		if err != nil {
+			return 3, "", err
+		}
+		defer vc.CloseVolume()
+		if err := vc.UnmapBlock(block); err != nil {
+			return 3, "", err
+		}
+		delete(fv.blocks, block)
+		return 3, fmt.Sprintf("unmap %v block %v", fv.name, block), nil
+	case op == 3:
+		if m.snapshotCount(fv) == FUZZ_MAX_SNAPSHOTS {
+			return 2, "", nil
+		}
+		sid, err := CreateSnapshot(m.device, fv.name, nil)
+		if err != nil {
+			return 2, "", err
+		}
+		m.snapshots[fv.snapshotId] = maps.Clone(fv.blocks)
+		m.owners[fv.snapshotId] = fv
+		desc := fmt.Sprintf("snapshot %v as %v", fv.name, fv.snapshotId)
+		fv.snapshotId = sid
+		return 2, desc, nil
+	case op == 4:
+		sids := m.snapshotIds()
+		if len(sids) == 0 || len(m.volumes) == FUZZ_MAX_VOLUMES {
+			return 2, "", nil
+		}
+		sid := sids[int(arg(1))%len(sids)]
+		m.count++
+		name := fmt.Sprintf("vol%v", m.count)
+		vi, err := CloneSnapshot(m.device, name, sid)
+		if err != nil {
+			return 2, "", err
+		}
+		m.volumes = append(m.volumes, &fuzzVolume{name: name, snapshotId: vi.SnapshotId, blocks: maps.Clone(m.snapshots[sid])})
+		return 2, fmt.Sprintf("clone %v to %v", sid, name), nil
+	case op == 5:
+		sids := m.snapshotIds()
+		if len(sids) == 0 {
+			return 2, "", nil
+		}
+		sid := sids[int(arg(1))%len(sids)]
+		if err := DeleteSnapshot(m.device, sid); err != nil {
+			return 2, "", err
+		}
+		delete(m.snapshots, sid)
+		delete(m.owners, sid)
+		return 2, fmt.Sprintf("delete snapshot %v", sid), nil
+	default:
+		if err := DeleteVolume(m.device, fv.name); err != nil {
+			return 2, "", err
+		}
+		m.volumes = slices.DeleteFunc(m.volumes, func(v *fuzzVolume) bool { return v == fv })
+		for sid, owner := range m.owners {
+			if owner == fv {
+				delete(m.snapshots, sid)
+				delete(m.owners, sid)
+			}
+		}
+		return 2, "delete " + fv.name, nil
+	}
+}
+
+// Compare all blocks used by the model with the contents of a volume or snapshot.
+func (m *fuzzModel) checkContents(vc *VolumeContext, what string, blocks map[uint64]byte) error {
+	defer vc.CloseVolume()
+	data := make([]byte, BLOCK_SIZE)
+	for b := 0; b < FUZZ_BLOCKS_IN_EXTENT*FUZZ_VOLUME_EXTENTS; b++ {
+		block := fuzzBlock(byte(b))
+		if err := vc.ReadBlock(data, block); err != nil {
+			return err
+		}
+		if !bytes.Equal(data, fuzzData(blocks[block])) {
+			return fmt.Errorf("%v block %v: expected %v, found %v", what, block, blocks[block], data[0])
+		}
+	}
+	return nil
+}
+
+// Check that the device matches the model.
+func (m *fuzzModel) check() error {
+	for _, fv := range m.volumes {
+		vc, err := OpenVolume(m.device, fv.name)
+		if err != nil {
+			return err
+		}
+		if err := m.checkContents(vc, fv.name, fv.blocks); err != nil {
+			return err
+		}
+	}
+	for sid, blocks := range m.snapshots {
+		vc, err := OpenSnapshot(m.device, sid)
+		if err != nil {
+			return err
+		}
+		if err := m.checkContents(vc, fmt.Sprintf("snapshot %v", sid), blocks); err != nil {
+			return err
+		}
+	}
+	return checkExtents(m.device)
+}
+
+// Check that every extent in use belongs to a snapshot of an existing volume, and that no snapshot has
+// more than one extent for a volume position.
+func checkExtents(device string) error {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	extents, err := dc.ReadAllExtents()
+	if err != nil {
+		return err
+	}
+	owners := make(map[uint16]*VolumeMetadata)
+	for i := range dc.volumes {
+		v := &dc.volumes[i]
+		for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+			owners[sid] = v
+		}
+	}
+	type position struct {
+		snapshotId uint16
+		extentPos  uint32
+	}
+	seen := make(map[position]bool)
+	for i, e := range extents {
+		if e.SnapshotId == 0 {
+			continue
+		}
+		v, ok := owners[e.SnapshotId]
+		if !ok {
+			return fmt.Errorf("extent %v belongs to missing snapshot %v", i, e.SnapshotId)
+		}
+		if uint64(e.ExtentPos) >= v.VolumeSize/EXTENT_SIZE {
+			return fmt.Errorf("extent %v out of volume bounds", i)
+		}
+		p := position{e.SnapshotId, e.ExtentPos}
+		if seen[p] {
+			return fmt.Errorf("extent %v duplicates position %v of snapshot %v", i, e.ExtentPos, e.SnapshotId)
+		}
+		seen[p] = true
+	}
+	return dc.Close()
+}
+
+// Run the operations encoded in the input, checking the device against the model after each one.
+func (m *fuzzModel) run(input []byte) {
+	var history []string
+	for i, ops := 0, 0; i < len(input) && ops < FUZZ_MAX_OPERATIONS; ops++ {
+		n, desc, err := m.apply(input[i:])
+		if desc != "" {
+			history = append(history, desc)
+		}
+		if err == nil {
+			err = m.check()
+		}
+		if err != nil {
+			m.t.Fatalf("%v\noperations:\n%v", err, history)
+		}
+		i += n
+	}
+}
+
+func FuzzExtentMap(f *testing.F) {
+	device, err := CreateMemoryDevice("fuzz", DEVICE_SIZE)
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer RemoveMemoryDevice(device)
+
+	f.Add([]byte{0, 1, 0, 0, 9, 3, 0, 1, 0, 0, 17, 5, 0})
+	f.Add([]byte{0, 1, 0, 4, 9, 3, 0, 2, 0, 4, 4, 0, 1, 1, 4, 7, 5, 0})
+	f.Add([]byte{0, 1, 0, 0, 9, 3, 0, 1, 0, 0, 17, 3, 0, 2, 0, 0, 5, 1})
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 4; i++ {
+		input := make([]byte, 192)
+		r.Read(input)
+		f.Add(input)
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		if err := InitDevice(device, WithForce()); err != nil {
+			t.Fatal(err)
+		}
+		newFuzzModel(t, device).run(input)
+	})
+}
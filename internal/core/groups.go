@@ -0,0 +1,287 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrGroupNotFound = errors.New("group not found")
+	ErrQuotaExceeded = errors.New("group quota exceeded")
+)
+
+type GroupInfo struct {
+	GroupName   string
+	Quota       uint64 // Zero for unlimited
+	VolumeCount uint   // Including volumes in the trash
+	VolumeSize  uint64 // Total size of the volumes, counted against the quota
+}
+
+// Return the id and metadata of the group with the given name, or zero and nil if there is none.
+func (dc *DeviceContext) findGroup(groupName string) (uint8, *GroupMetadata) {
+	for i := 0; i < MAX_GROUPS; i++ {
+		if dc.groups[i].GroupName[0] != 0 && dc.groups[i].Name() == groupName {
+			return uint8(i + 1), &dc.groups[i]
+		}
+	}
+	return 0, nil
+}
+
+// Return the group with the given name, adding it if it does not exist. Metadata is not written to the device.
+func (dc *DeviceContext) addGroup(groupName string) (uint8, *GroupMetadata, error) {
+	if gid, g := dc.findGroup(groupName); g != nil {
+		return gid, g, nil
+	}
+	if err := ValidateGroupName(groupName); err != nil {
+		return 0, nil, err
+	}
+	for i := 0; i < MAX_GROUPS; i++ {
+		if dc.groups[i].GroupName[0] == 0 {
+			dc.groups[i].SetName(groupName)
+			return uint8(i + 1), &dc.groups[i], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: no free group slots", ErrNoSpace)
+}
+
+// Return the number and total size of the volumes in a group. Volumes in the trash are included, so that
+// undeleting them never exceeds the quota.
+func (dc *DeviceContext) groupUsage(gid uint8) (uint, uint64) {
+	count, size := uint(0), uint64(0)
+	for i := 0; i < MAX_VOLUMES; i++ {
+		if dc.volumes[i].SnapshotId != 0 && dc.volumes[i].GroupId == gid {
+			count++
+			size += dc.volumes[i].VolumeSize
+		}
+	}
+	return count, size
+}
+
+// Move a volume to a group, created if it does not exist, or out of its group if the group name is empty. The
+// volume must fit in the quota of the group.
+func SetVolumeGroup(device string, volumeName string, groupName string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if groupName == "" {
+		v.GroupId = 0
+	} else {
+		gid, g, err := dc.addGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if v.GroupId != gid {
+			_, size := dc.groupUsage(gid)
+			if g.Quota != 0 && size+v.VolumeSize > g.Quota {
+				return fmt.Errorf("%w: %v", ErrQuotaExceeded, groupName)
+			}
+			v.GroupId = gid
+		}
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Limit the total size of the volumes in a group, creating the group if it does not exist. Zero removes the
+// limit. The quota cannot be set below the size of the volumes already in the group.
+func SetGroupQuota(device string, groupName string, quota uint64) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	gid, g, err := dc.addGroup(groupName)
+	if err != nil {
+		return err
+	}
+	if _, size := dc.groupUsage(gid); quota != 0 && size > quota {
+		return fmt.Errorf("%w: %v holds %v bytes", ErrQuotaExceeded, groupName, size)
+	}
+	g.Quota = quota
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+func GetGroupInfo(device string) ([]GroupInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	gi := dc.groupInfo()
+	dc.Close()
+	return gi, nil
+}
+
+func (dc *DeviceContext) groupInfo() []GroupInfo {
+	var gi []GroupInfo
+	for i := 0; i < MAX_GROUPS; i++ {
+		g := &dc.groups[i]
+		if g.GroupName[0] == 0 {
+			continue
+		}
+		count, size := dc.groupUsage(uint8(i + 1))
+		gi = append(gi, GroupInfo{
+			GroupName:   g.Name(),
+			Quota:       g.Quota,
+			VolumeCount: count,
+			VolumeSize:  size,
+		})
+	}
+	return gi
+}
+
+// Return information about the volumes in a group, excluding those in the trash.
+func GetGroupVolumeInfo(device string, groupName string) ([]VolumeInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	gid, g := dc.findGroup(groupName)
+	if g == nil {
+		return nil, fmt.Errorf("%w: %v", ErrGroupNotFound, groupName)
+	}
+	stats, err := dc.ReadAllVolumeStats()
+	if err != nil {
+		return nil, err
+	}
+	var vi []VolumeInfo
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || v.DeletedAt != 0 || v.GroupId != gid {
+			continue
+		}
+		info := dc.volumeInfo(v)
+		dc.addPendingStats(&stats[i], info.VolumeName)
+		info.setStats(&stats[i])
+		vi = append(vi, info)
+	}
+	dc.Close()
+	return vi, nil
+}
+
+// Snapshot all volumes of a group in a single metadata update, so that the snapshots are consistent with each
+// other. Returns the new current snapshot of each volume, by volume name. Options may be nil.
+func SnapshotGroup(device string, groupName string, opts *SnapshotOptions) (map[string]uint, error) {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	if opts.Name != "" {
+		return nil, fmt.Errorf("%w: snapshots of a group cannot share a name", ErrInvalidSnapshotName)
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	gid, g := dc.findGroup(groupName)
+	if g == nil {
+		return nil, fmt.Errorf("%w: %v", ErrGroupNotFound, groupName)
+	}
+	createdAt := opts.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	snapshots := make(map[string]uint)
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || v.DeletedAt != 0 || v.GroupId != gid {
+			continue
+		}
+		sid, err := dc.AddSnapshot(v.SnapshotId, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if opts.UserCreated {
+			dc.snapshots[sid-1].Flags |= SNAPSHOT_FLAG_USER_CREATED
+		}
+		if err := dc.SetSnapshotLabels(sid, opts.Labels); err != nil {
+			return nil, err
+		}
+		if err := dc.setSnapshotDescription(sid, opts.Description); err != nil {
+			return nil, err
+		}
+		v.SnapshotId = uint16(sid)
+		snapshots[v.Name()] = uint(sid)
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	for volumeName, sid := range snapshots {
+		dc.notify(EVENT_SNAPSHOT_CREATED, volumeName, uint16(sid))
+	}
+	return snapshots, dc.Close()
+}
+
+// Delete all volumes of a group, and the group. Volumes go to the trash if it is enabled, as with
+// DeleteVolume, but no longer belong to the group when undeleted.
+func DeleteGroup(device string, groupName string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	gid, g := dc.findGroup(groupName)
+	if g == nil {
+		return fmt.Errorf("%w: %v", ErrGroupNotFound, groupName)
+	}
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId != 0 && v.GroupId == gid && v.DeletedAt == 0 {
+			if err := dc.checkRetention(v); err != nil {
+				return err
+			}
+		}
+	}
+	var deleted []string
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || v.GroupId != gid {
+			continue
+		}
+		v.GroupId = 0
+		if v.DeletedAt != 0 {
+			continue
+		}
+		deleted = append(deleted, v.Name())
+		if dc.superblock.TrashRetention > 0 {
+			v.DeletedAt = time.Now().Unix()
+		} else if err := dc.DestroyVolume(v); err != nil {
+			return err
+		}
+	}
+	*g = GroupMetadata{}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	for _, volumeName := range deleted {
+		dc.notify(EVENT_VOLUME_DELETED, volumeName, 0)
+	}
+	return dc.Close()
+}
@@ -0,0 +1,37 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+// Identity and state of the block device holding a device, as reported by the operating system. Fields not
+// reported are left empty. Health attributes kept by the drive itself, like S.M.A.R.T. counters, need
+// privileged commands and are left to dedicated tools.
+type DeviceHealth struct {
+	Model              string
+	Serial             string
+	State              string // As reported by the driver, e.g. "running" or "offline"
+	Rotational         bool
+	Size               uint64 // Of the whole block device, which may exceed the size DBS uses
+	LogicalSectorSize  uint
+	PhysicalSectorSize uint
+	DiscardGranularity uint64 // Zero if discards are not supported
+}
+
+// Return the health of the block device holding a device, or nil if it is a file or not backed by one.
+func (db *deviceBackend) Health() *DeviceHealth {
+	if h, ok := db.BlockBackend.(BackendHealthReporter); ok {
+		return h.Health()
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Set the identity of a device being initialized, as given with WithDeviceUUID or a random (version 4) UUID.
+func (dc *DeviceContext) newIdentity() error {
+	if dc.opts.DeviceUUID != "" {
+		uuid, err := format.ParseUUID(dc.opts.DeviceUUID)
+		if err != nil {
+			return err
+		}
+		dc.superblock.UUID = uuid
+		return nil
+	}
+	if _, err := rand.Read(dc.superblock.UUID[:]); err != nil {
+		return err
+	}
+	dc.superblock.UUID[6] = dc.superblock.UUID[6]&0x0f | 0x40
+	dc.superblock.UUID[8] = dc.superblock.UUID[8]&0x3f | 0x80
+	return nil
+}
+
+// Check that the device has the identity given with WithDeviceUUID, if any.
+func (dc *DeviceContext) checkIdentity() error {
+	if dc.opts.DeviceUUID == "" {
+		return nil
+	}
+	uuid, err := format.ParseUUID(dc.opts.DeviceUUID)
+	if err != nil {
+		return err
+	}
+	if uuid != dc.superblock.UUID {
+		return fmt.Errorf("%w: found %v, expected %v", ErrWrongDevice, format.FormatUUID(dc.superblock.UUID), dc.opts.DeviceUUID)
+	}
+	return nil
+}
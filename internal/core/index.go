@@ -0,0 +1,88 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+// Snapshot owning each device extent, so that the extents of a snapshot are found without reading all extent
+// metadata again. Loaded with a single scan on first use and kept up to date as extent metadata is written.
+// Others may change extents once the metadata lock is released, so it is dropped then.
+type extentIndex struct {
+	loaded bool
+	owners []uint16
+}
+
+func (dc *DeviceContext) loadExtentIndex() error {
+	if dc.index.loaded {
+		return nil
+	}
+	owners := make([]uint16, dc.totalDeviceExtents)
+	err := dc.scanExtents(func(offset uint, eb []ExtentMetadata) error {
+		for i := range eb {
+			owners[offset+uint(i)] = eb[i].SnapshotId
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dc.index = extentIndex{loaded: true, owners: owners}
+	return nil
+}
+
+// Note the owners of extent metadata written to the device.
+func (dc *DeviceContext) updateExtentIndex(eb []ExtentMetadata, eidx uint) {
+	if !dc.index.loaded {
+		return
+	}
+	for i := range eb {
+		dc.index.owners[eidx+uint(i)] = eb[i].SnapshotId
+	}
+}
+
+// Return the device positions of the extents of a snapshot, in ascending order.
+func (dc *DeviceContext) snapshotExtents(snapshotId uint16) ([]uint32, error) {
+	if err := dc.loadExtentIndex(); err != nil {
+		return nil, err
+	}
+	var positions []uint32
+	for pos, sid := range dc.index.owners {
+		if sid == snapshotId {
+			positions = append(positions, uint32(pos))
+		}
+	}
+	return positions, nil
+}
+
+// Read the metadata of the extents at the given device positions, in ascending order. Nearby extents are read
+// in batches.
+func (dc *DeviceContext) readExtentsAt(positions []uint32, fn func(pos uint32, e *ExtentMetadata)) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	eb := make([]ExtentMetadata, min(uint(positions[len(positions)-1]-positions[0])+1, dc.extentBatch))
+	for i := 0; i < len(positions); {
+		start := positions[i]
+		j := i + 1
+		for j < len(positions) && uint(positions[j]-start) < dc.extentBatch {
+			j++
+		}
+		if err := dc.ReadExtents(eb[:positions[j-1]-start+1], uint(start)); err != nil {
+			return err
+		}
+		for ; i < j; i++ {
+			fn(positions[i], &eb[positions[i]-start])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,679 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Types and states of jobs.
+const (
+	JOB_CLONE      = "clone"
+	JOB_VACUUM     = "vacuum"
+	JOB_DEFRAGMENT = "defragment"
+	JOB_SCRUB      = "scrub"
+	JOB_SHRED      = "shred"
+
+	JOB_RUNNING     = "running"
+	JOB_COMPLETED   = "completed"
+	JOB_FAILED      = "failed"
+	JOB_CANCELLED   = "cancelled"
+	JOB_INTERRUPTED = "interrupted" // Was running in a process that exited, and may be resumed or cancelled
+
+	MAX_FINISHED_JOBS   = 64              // Finished jobs kept in memory per device, dropping the oldest
+	JOB_UPDATE_INTERVAL = 5 * time.Second // Progress of running jobs is written to the job table this often
+	JOB_STALE_AFTER     = time.Minute     // Running jobs not updated for this long were interrupted
+)
+
+var (
+	ErrJobNotFound     = errors.New("job not found")
+	ErrJobCancelled    = errors.New("job cancelled")
+	ErrJobNotResumable = errors.New("job cannot be resumed")
+	ErrTooManyJobs     = errors.New("too many running jobs")
+)
+
+const (
+	JOB_TYPE_CLONE      = format.JOB_TYPE_CLONE
+	JOB_TYPE_VACUUM     = format.JOB_TYPE_VACUUM
+	JOB_TYPE_DEFRAGMENT = format.JOB_TYPE_DEFRAGMENT
+	JOB_TYPE_SCRUB      = format.JOB_TYPE_SCRUB
+	JOB_TYPE_SHRED      = format.JOB_TYPE_SHRED
+
+	JOB_STATE_RUNNING   = format.JOB_STATE_RUNNING
+	JOB_STATE_COMPLETED = format.JOB_STATE_COMPLETED
+	JOB_STATE_FAILED    = format.JOB_STATE_FAILED
+	JOB_STATE_CANCELLED = format.JOB_STATE_CANCELLED
+
+	JOB_FLAG_RANGES = format.JOB_FLAG_RANGES
+	JOB_FLAG_CANCEL = format.JOB_FLAG_CANCEL
+
+	MAX_JOB_RECORDS = format.MAX_JOB_RECORDS
+)
+
+type JobRecord = format.JobRecord
+
+// Names of job types and states, indexed by their codes in the job table.
+var (
+	jobTypeNames  = []string{"", JOB_CLONE, JOB_VACUUM, JOB_DEFRAGMENT, JOB_SCRUB, JOB_SHRED}
+	jobStateNames = []string{"", JOB_RUNNING, JOB_COMPLETED, JOB_FAILED, JOB_CANCELLED}
+)
+
+// Progress of an operation running in the background. Jobs are kept in the job table of the device, so they
+// can be listed by other processes, and resumed or cancelled if the process running them exits.
+type JobInfo struct {
+	JobId      uint64
+	Type       string
+	Target     string // Volume the job works on, empty if none or no longer found
+	State      string
+	Done       uint64 // Bytes processed so far
+	Total      uint64 // Bytes to process, zero if not known
+	StartedAt  time.Time
+	FinishedAt time.Time // Zero while running
+	Error      string    // Why the job failed, if it ran in this process
+	Resumable  bool      // Interrupted, and can be continued with ResumeJob
+}
+
+type job struct {
+	mu        sync.Mutex
+	persistMu sync.Mutex // Serializes updates of the record, so the final state is written last
+	device    string
+	opts      []Option
+	slot      int       // In the job table
+	record    JobRecord // As last written
+	info      JobInfo
+	cancel    chan struct{} // Closed to ask the job to stop
+	done      chan struct{} // Closed when the job finished
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]map[uint64]*job) // Jobs run by this process
+)
+
+// Return the offset of the job table on the device.
+func (dc *DeviceContext) jobTableOffset() uint64 {
+	return uint64(dc.statsOffset + SIZEOF_VOLUME_STATS*MAX_VOLUMES)
+}
+
+// Read the job table, with all records free if it is not initialized. Returns the records, along with the
+// blocks holding them and the offset of the blocks on the device.
+func (dc *DeviceContext) readJobTable() ([]JobRecord, []byte, uint64, error) {
+	offset := dc.jobTableOffset()
+	start := offset / BLOCK_SIZE * BLOCK_SIZE
+	abuf := AlignedBlock(int(uint64(dc.extentOffset) - start))
+	if _, err := dc.f.ReadAt(abuf, start); err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to read job table: %w", err)
+	}
+	records := make([]JobRecord, MAX_JOB_RECORDS)
+	if dc.superblock.FeatureCompat&FEATURE_COMPAT_JOB_TABLE != 0 {
+		if err := format.Unmarshal(abuf[offset-start:], records); err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to deserialize job table: %w", err)
+		}
+	}
+	return records, abuf, start, nil
+}
+
+// Read-modify-write the job table, initializing it on first use. Must be called with the metadata lock held.
+func (dc *DeviceContext) updateJobTable(fn func(records []JobRecord) error) error {
+	records, abuf, start, err := dc.readJobTable()
+	if err != nil {
+		return err
+	}
+	if err := fn(records); err != nil {
+		return err
+	}
+	buf, err := format.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to serialize job table: %w", err)
+	}
+	copy(abuf[dc.jobTableOffset()-start:], buf)
+	if _, err := dc.f.WriteAt(abuf, start); err != nil {
+		return fmt.Errorf("failed to write job table: %w", err)
+	}
+	if dc.superblock.FeatureCompat&FEATURE_COMPAT_JOB_TABLE == 0 {
+		dc.superblock.FeatureCompat |= FEATURE_COMPAT_JOB_TABLE
+		if err := dc.WriteSuperblock(); err != nil {
+			return err
+		}
+	}
+	return dc.flushMetadata()
+}
+
+// Update the job table of a device under the metadata lock, without reading the rest of the metadata.
+func updateJobTable(device string, opts []Option, fn func(records []JobRecord) error) error {
+	dc, err := NewDeviceContext(device, opts...)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	if err := dc.LockMetadata(); err != nil {
+		return err
+	}
+	err = dc.updateJobTable(fn)
+	if uerr := dc.UnlockMetadata(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Return true if a running job was not updated for JOB_STALE_AFTER, so the process running it exited.
+func staleJob(rec *JobRecord) bool {
+	return rec.State == JOB_STATE_RUNNING && time.Since(time.Unix(rec.UpdatedAt, 0)) > JOB_STALE_AFTER
+}
+
+// Return the oldest snapshot in the chain of a snapshot.
+func (dc *DeviceContext) rootSnapshot(snapshotId uint16) uint16 {
+	for snapshotId > 0 && dc.snapshots[snapshotId-1].ParentSnapshotId != 0 {
+		snapshotId = dc.snapshots[snapshotId-1].ParentSnapshotId
+	}
+	return snapshotId
+}
+
+// Return the volume a job works on, or nil if none or it is gone.
+func (dc *DeviceContext) jobVolume(rec *JobRecord) *VolumeMetadata {
+	if rec.VolumeSlot == 0 || rec.VolumeSlot > MAX_VOLUMES {
+		return nil
+	}
+	v := &dc.volumes[rec.VolumeSlot-1]
+	if v.SnapshotId == 0 || v.DeletedAt != 0 || dc.rootSnapshot(v.SnapshotId) != rec.RootSnapshotId {
+		return nil
+	}
+	return v
+}
+
+// Return a record for a job working on a volume.
+func volumeJobRecord(device string, jobType uint8, volumeName string) (JobRecord, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return JobRecord{}, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return JobRecord{}, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	rec := JobRecord{
+		Type:           jobType,
+		VolumeSlot:     uint16(dc.volumeIndex(v) + 1),
+		RootSnapshotId: dc.rootSnapshot(v.SnapshotId),
+	}
+	return rec, dc.Close()
+}
+
+// Return the information of a job in the job table, which is not run by this process.
+func (dc *DeviceContext) jobInfo(rec *JobRecord) JobInfo {
+	ji := JobInfo{
+		JobId:     rec.JobId,
+		Done:      rec.Done,
+		Total:     rec.Total,
+		StartedAt: time.Unix(rec.StartedAt, 0),
+	}
+	if int(rec.Type) < len(jobTypeNames) {
+		ji.Type = jobTypeNames[rec.Type]
+	}
+	if int(rec.State) < len(jobStateNames) {
+		ji.State = jobStateNames[rec.State]
+	}
+	if rec.State != JOB_STATE_RUNNING {
+		ji.FinishedAt = time.Unix(rec.UpdatedAt, 0)
+	}
+	v := dc.jobVolume(rec)
+	if v != nil {
+		ji.Target = v.Name()
+	}
+	if staleJob(rec) {
+		ji.State = JOB_INTERRUPTED
+		needsVolume := rec.Type == JOB_TYPE_CLONE || rec.Type == JOB_TYPE_DEFRAGMENT
+		ji.Resumable = rec.Flags&JOB_FLAG_RANGES == 0 && (v != nil || !needsVolume)
+	}
+	return ji
+}
+
+// Start a job in the background, adding its record to the job table. The function reports progress with
+// advance, and should return ErrJobCancelled once cancelled is true.
+func startJob(device string, rec JobRecord, target string, opts []Option, run func(j *job) error) (*JobInfo, error) {
+	now := time.Now().Unix()
+	rec.State = JOB_STATE_RUNNING
+	rec.StartedAt = now
+	rec.UpdatedAt = now
+	jobsMu.Lock()
+	for id := range jobs[device] {
+		rec.JobId = max(rec.JobId, id)
+	}
+	jobsMu.Unlock()
+	slot := -1
+	err := updateJobTable(device, opts, func(records []JobRecord) error {
+		// Use a free record, or reuse that of the job that finished first
+		for i := range records {
+			rec.JobId = max(rec.JobId, records[i].JobId)
+			switch {
+			case records[i].State == JOB_STATE_RUNNING:
+			case slot < 0, records[slot].JobId != 0 && (records[i].JobId == 0 || records[i].UpdatedAt < records[slot].UpdatedAt):
+				slot = i
+			}
+		}
+		if slot < 0 {
+			return fmt.Errorf("%w: %v", ErrTooManyJobs, len(records))
+		}
+		rec.JobId++
+		records[slot] = rec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	j := newJob(device, opts, slot, rec, target)
+	return runJob(j, run), nil
+}
+
+func newJob(device string, opts []Option, slot int, rec JobRecord, target string) *job {
+	return &job{
+		device: device,
+		opts:   opts,
+		slot:   slot,
+		record: rec,
+		info: JobInfo{
+			JobId:     rec.JobId,
+			Type:      jobTypeNames[rec.Type],
+			Target:    target,
+			State:     JOB_RUNNING,
+			Done:      rec.Done,
+			Total:     rec.Total,
+			StartedAt: time.Unix(rec.StartedAt, 0),
+		},
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Run a job whose record is in the job table, updating the record as it makes progress and when it finishes.
+func runJob(j *job, run func(j *job) error) *JobInfo {
+	jobsMu.Lock()
+	if jobs[j.device] == nil {
+		jobs[j.device] = make(map[uint64]*job)
+	}
+	jobs[j.device][j.info.JobId] = j
+	pruneJobs(j.device)
+	jobsMu.Unlock()
+
+	info := j.status()
+	go j.update()
+	go func() {
+		err := run(j)
+		j.mu.Lock()
+		switch {
+		case err == nil:
+			j.info.State = JOB_COMPLETED
+		case errors.Is(err, ErrJobCancelled):
+			j.info.State = JOB_CANCELLED
+		default:
+			j.info.State = JOB_FAILED
+			j.info.Error = err.Error()
+		}
+		j.info.FinishedAt = time.Now()
+		j.mu.Unlock()
+		if err := j.persist(); err != nil {
+			notify(j.device, Event{Type: EVENT_ERROR, Detail: fmt.Sprintf("cannot update job %v: %v", j.info.JobId, err)})
+		}
+		close(j.done)
+	}()
+	return &info
+}
+
+// Write the progress of a job to the job table every JOB_UPDATE_INTERVAL, until it finishes.
+func (j *job) update() {
+	ticker := time.NewTicker(JOB_UPDATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			if err := j.persist(); err != nil {
+				notify(j.device, Event{Type: EVENT_ERROR, Detail: fmt.Sprintf("cannot update job %v: %v", j.info.JobId, err)})
+			}
+		}
+	}
+}
+
+// Write the state of a job to its record, and pick up cancellation requested by other processes.
+func (j *job) persist() error {
+	j.persistMu.Lock()
+	defer j.persistMu.Unlock()
+	j.mu.Lock()
+	rec := j.record
+	rec.Done = j.info.Done
+	rec.Total = j.info.Total
+	for code, name := range jobStateNames {
+		if name == j.info.State {
+			rec.State = uint8(code)
+		}
+	}
+	j.mu.Unlock()
+	rec.UpdatedAt = time.Now().Unix()
+	cancel := false
+	err := updateJobTable(j.device, j.opts, func(records []JobRecord) error {
+		if records[j.slot].JobId != rec.JobId {
+			return fmt.Errorf("record of job %v was taken over", rec.JobId)
+		}
+		cancel = records[j.slot].Flags&JOB_FLAG_CANCEL != 0
+		rec.Flags |= records[j.slot].Flags & JOB_FLAG_CANCEL
+		records[j.slot] = rec
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.record = rec
+	j.mu.Unlock()
+	if cancel {
+		j.requestCancel()
+	}
+	return nil
+}
+
+// Drop the oldest finished jobs of a device beyond MAX_FINISHED_JOBS. Called with jobsMu held.
+func pruneJobs(device string) {
+	var finished []*job
+	for _, j := range jobs[device] {
+		select {
+		case <-j.done:
+			finished = append(finished, j)
+		default:
+		}
+	}
+	if len(finished) <= MAX_FINISHED_JOBS {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool { return finished[a].info.JobId < finished[b].info.JobId })
+	for _, j := range finished[:len(finished)-MAX_FINISHED_JOBS] {
+		delete(jobs[device], j.info.JobId)
+	}
+}
+
+func (j *job) status() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+// Account for processed bytes. Does nothing outside a job, as with the other methods used while running.
+func (j *job) advance(n uint64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.info.Done += n
+	j.mu.Unlock()
+}
+
+func (j *job) setTotal(n uint64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.info.Total = n
+	j.mu.Unlock()
+}
+
+func (j *job) cancelled() bool {
+	if j == nil {
+		return false
+	}
+	select {
+	case <-j.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *job) requestCancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	select {
+	case <-j.cancel:
+	default:
+		close(j.cancel)
+	}
+}
+
+// Return a job run by this process.
+func localJob(device string, jobId uint64) *job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[device][jobId]
+}
+
+// Return the record of a job in the job table, and its information.
+func findJobRecord(device string, jobId uint64) (int, JobRecord, JobInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return 0, JobRecord{}, JobInfo{}, err
+	}
+	defer dc.Close()
+	records, _, _, err := dc.readJobTable()
+	if err != nil {
+		return 0, JobRecord{}, JobInfo{}, err
+	}
+	for i := range records {
+		if records[i].JobId == jobId && jobId != 0 {
+			return i, records[i], dc.jobInfo(&records[i]), dc.Close()
+		}
+	}
+	return 0, JobRecord{}, JobInfo{}, fmt.Errorf("%w: %v", ErrJobNotFound, jobId)
+}
+
+// Return the jobs of a device, as kept in its job table, along with those run by this process whose records
+// were reused since. Jobs are ordered by id.
+func ListJobs(device string) ([]JobInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	records, _, _, err := dc.readJobTable()
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[uint64]JobInfo)
+	for i := range records {
+		if records[i].JobId != 0 {
+			byId[records[i].JobId] = dc.jobInfo(&records[i])
+		}
+	}
+	jobsMu.Lock()
+	for id, j := range jobs[device] {
+		byId[id] = j.status()
+	}
+	jobsMu.Unlock()
+	ji := make([]JobInfo, 0, len(byId))
+	for _, info := range byId {
+		ji = append(ji, info)
+	}
+	sort.Slice(ji, func(a, b int) bool { return ji[a].JobId < ji[b].JobId })
+	return ji, dc.Close()
+}
+
+func GetJob(device string, jobId uint64) (*JobInfo, error) {
+	if j := localJob(device, jobId); j != nil {
+		info := j.status()
+		return &info, nil
+	}
+	_, _, info, err := findJobRecord(device, jobId)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Wait for a job to stop running and return its final state. Jobs run by other processes are polled.
+func WaitJob(device string, jobId uint64) (*JobInfo, error) {
+	if j := localJob(device, jobId); j != nil {
+		<-j.done
+		info := j.status()
+		return &info, nil
+	}
+	for {
+		info, err := GetJob(device, jobId)
+		if err != nil || info.State != JOB_RUNNING {
+			return info, err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Ask a job to stop, without waiting for it. Jobs run by other processes are flagged in the job table, and
+// stop on their next update. Interrupted jobs are cancelled right away, destroying the volume of a clone.
+// Cancelling a finished job has no effect.
+func CancelJob(device string, jobId uint64) error {
+	if j := localJob(device, jobId); j != nil {
+		j.requestCancel()
+		return nil
+	}
+	_, rec, info, err := findJobRecord(device, jobId)
+	if err != nil {
+		return err
+	}
+	if info.State == JOB_INTERRUPTED && rec.Type == JOB_TYPE_CLONE {
+		if err := destroyJobVolume(device, &rec); err != nil {
+			return err
+		}
+	}
+	return updateJobTable(device, nil, func(records []JobRecord) error {
+		for i := range records {
+			if records[i].JobId != jobId || records[i].State != JOB_STATE_RUNNING {
+				continue
+			}
+			if staleJob(&records[i]) {
+				records[i].State = JOB_STATE_CANCELLED
+				records[i].UpdatedAt = time.Now().Unix()
+			} else {
+				records[i].Flags |= JOB_FLAG_CANCEL
+			}
+		}
+		return nil
+	})
+}
+
+// Destroy the volume a job was cloning into, if it is still there.
+func destroyJobVolume(device string, rec *JobRecord) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.jobVolume(rec)
+	if v == nil {
+		return dc.Close()
+	}
+	if err := dc.DestroyVolume(v); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Continue an interrupted job in this process, with the limits it was started with. Clones carry on from the
+// data already copied, except for clones of parts of a snapshot, which cannot be resumed, while other jobs
+// start over, overwriting again any extents a secure deletion had. Options apply to the device, as when starting the job.
+func ResumeJob(device string, jobId uint64, opts ...Option) (*JobInfo, error) {
+	if localJob(device, jobId) != nil {
+		return nil, fmt.Errorf("%w: job %v is run by this process", ErrJobNotResumable, jobId)
+	}
+	slot, rec, info, err := findJobRecord(device, jobId)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Resumable {
+		return nil, fmt.Errorf("%w: job %v is %v", ErrJobNotResumable, jobId, info.State)
+	}
+	// Take the job over, unless another process did meanwhile
+	err = updateJobTable(device, opts, func(records []JobRecord) error {
+		if records[slot].JobId != jobId || !staleJob(&records[slot]) {
+			return fmt.Errorf("%w: job %v was taken over", ErrJobNotResumable, jobId)
+		}
+		records[slot].UpdatedAt = time.Now().Unix()
+		records[slot].Flags &^= JOB_FLAG_CANCEL
+		rec = records[slot]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var run func(j *job) error
+	switch rec.Type {
+	case JOB_TYPE_CLONE:
+		run = func(j *job) error {
+			return resumeClone(j, info.Target, uint(rec.SnapshotId), rec.Done, &CloneOptions{MaxBandwidth: rec.MaxBandwidth, MaxIops: uint(rec.MaxIops)})
+		}
+	case JOB_TYPE_VACUUM:
+		run = func(j *job) error {
+			return vacuumDevice(device, j)
+		}
+	case JOB_TYPE_DEFRAGMENT:
+		run = func(j *job) error {
+			return defragmentVolume(device, info.Target, j)
+		}
+	case JOB_TYPE_SCRUB:
+		run = func(j *job) error {
+			_, err := scrubDevice(device, rec.MaxBandwidth, opts, j)
+			return err
+		}
+	case JOB_TYPE_SHRED:
+		run = func(j *job) error {
+			return shred(device, rec, j)
+		}
+	}
+	return runJob(newJob(device, opts, slot, rec, info.Target), run), nil
+}
+
+// Vacuum a device in the background, as with VacuumDevice.
+func VacuumDeviceJob(device string) (*JobInfo, error) {
+	return startJob(device, JobRecord{Type: JOB_TYPE_VACUUM}, "", nil, func(j *job) error {
+		return vacuumDevice(device, j)
+	})
+}
+
+// Defragment a volume in the background, as with DefragmentVolume.
+func DefragmentVolumeJob(device string, volumeName string) (*JobInfo, error) {
+	rec, err := volumeJobRecord(device, JOB_TYPE_DEFRAGMENT, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return startJob(device, rec, volumeName, nil, func(j *job) error {
+		return defragmentVolume(device, volumeName, j)
+	})
+}
+
+// Scrub a device in the background, as with ScrubDevice.
+func ScrubDeviceJob(device string, rate uint64, opts ...Option) (*JobInfo, error) {
+	return startJob(device, JobRecord{Type: JOB_TYPE_SCRUB, MaxBandwidth: rate}, "", opts, func(j *job) error {
+		_, err := scrubDevice(device, rate, opts, j)
+		return err
+	})
+}
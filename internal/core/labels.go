@@ -0,0 +1,288 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+const (
+	// Labels holding the name and description of a snapshot. They are not returned with the other labels, and
+	// cannot be set as ones.
+	SNAPSHOT_NAME_LABEL        = "dbs.name"
+	SNAPSHOT_DESCRIPTION_LABEL = "dbs.description"
+
+	MAX_SNAPSHOT_DESCRIPTION_SIZE = 512
+
+	LABEL_REGION_SIZE    = format.LABEL_REGION_SIZE
+	MAX_LABEL_KEY_SIZE   = format.MAX_LABEL_KEY_SIZE
+	MAX_LABEL_VALUE_SIZE = format.MAX_LABEL_VALUE_SIZE
+
+	// Part of the label region only snapshot names may use, so that snapshots can still be named once other
+	// labels fill the rest. Enough for over 200 names of the largest size.
+	LABEL_NAME_RESERVE = 16384
+)
+
+var (
+	ErrInvalidLabel        = errors.New("invalid label")
+	ErrLabelSpaceExhausted = errors.New("label space exhausted")
+)
+
+// Check that labels can be set. Keys must be valid UTF-8 of up to MAX_LABEL_KEY_SIZE bytes, without control
+// characters or '=', which separates keys from values on the command line and in queries. Values may be
+// empty, and up to MAX_LABEL_VALUE_SIZE bytes.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || len(k) > MAX_LABEL_KEY_SIZE || !utf8.ValidString(k) || strings.ContainsRune(k, '=') ||
+			strings.IndexFunc(k, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%w: key %q", ErrInvalidLabel, k)
+		}
+		if reservedLabel(k) {
+			return fmt.Errorf("%w: %v is reserved", ErrInvalidLabel, k)
+		}
+		if len(v) > MAX_LABEL_VALUE_SIZE {
+			return fmt.Errorf("%w: value of %v is %v bytes, up to %v allowed", ErrInvalidLabel, k, len(v), MAX_LABEL_VALUE_SIZE)
+		}
+	}
+	return nil
+}
+
+func reservedLabel(key string) bool {
+	return key == SNAPSHOT_NAME_LABEL || key == SNAPSHOT_DESCRIPTION_LABEL
+}
+
+// Return the bytes of the label region used by labels, including snapshot names and descriptions.
+func (dc *DeviceContext) labelSpaceUsed() uint64 {
+	return uint64(format.LabelsSize(dc.labels))
+}
+
+// Return the labels of a snapshot, or nil if it has none.
+func (dc *DeviceContext) SnapshotLabels(snapshotId uint16) map[string]string {
+	var labels map[string]string
+	for _, l := range dc.labels {
+		if l.SnapshotId != snapshotId || reservedLabel(l.Key) {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[l.Key] = l.Value
+	}
+	return labels
+}
+
+// Replace the labels of a snapshot, keeping its name and description. Fails with ErrLabelSpaceExhausted if they would use the
+// part of the label region reserved for names, unless they take no more space than those they replace.
+// Metadata is not written to the device.
+func (dc *DeviceContext) SetSnapshotLabels(snapshotId uint16, labels map[string]string) error {
+	if err := ValidateLabels(labels); err != nil {
+		return fmt.Errorf("cannot set labels of snapshot %v: %w", snapshotId, err)
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	updated := make([]Label, 0, len(dc.labels)+len(labels))
+	for _, l := range dc.labels {
+		if l.SnapshotId != snapshotId || reservedLabel(l.Key) {
+			updated = append(updated, l)
+		}
+	}
+	for _, k := range keys {
+		updated = append(updated, Label{SnapshotId: snapshotId, Key: k, Value: labels[k]})
+	}
+	return dc.updateLabels(snapshotId, updated, LABEL_REGION_SIZE-LABEL_NAME_RESERVE)
+}
+
+// Replace the labels, if they take up to limit bytes of the label region, or no more than before.
+func (dc *DeviceContext) updateLabels(snapshotId uint16, updated []Label, limit uint64) error {
+	size := uint64(format.LabelsSize(updated))
+	if size > limit && size > dc.labelSpaceUsed() {
+		return fmt.Errorf("%w: labels of snapshot %v would take %v of %v bytes", ErrLabelSpaceExhausted, snapshotId, size, limit)
+	}
+	if _, err := format.MarshalLabels(updated); err != nil {
+		return fmt.Errorf("cannot set labels of snapshot %v: %w", snapshotId, err)
+	}
+	dc.labels = updated
+	return nil
+}
+
+// Remove the labels, name and description of a snapshot. Metadata is not written to the device.
+func (dc *DeviceContext) removeSnapshotLabels(snapshotId uint16) {
+	updated := make([]Label, 0, len(dc.labels))
+	for _, l := range dc.labels {
+		if l.SnapshotId != snapshotId {
+			updated = append(updated, l)
+		}
+	}
+	dc.labels = updated
+}
+
+// Remove labels left by deleted snapshots, as written by versions not removing them along with the snapshot.
+// Returns the number of labels removed. Metadata is not written to the device.
+func (dc *DeviceContext) pruneLabels() int {
+	updated := make([]Label, 0, len(dc.labels))
+	for _, l := range dc.labels {
+		if l.SnapshotId <= MAX_SNAPSHOTS && dc.snapshots[l.SnapshotId-1].CreatedAt != 0 {
+			updated = append(updated, l)
+		}
+	}
+	pruned := len(dc.labels) - len(updated)
+	dc.labels = updated
+	return pruned
+}
+
+// Return the name of a snapshot, or an empty string if it has none.
+func (dc *DeviceContext) SnapshotName(snapshotId uint16) string {
+	for _, l := range dc.labels {
+		if l.SnapshotId == snapshotId && l.Key == SNAPSHOT_NAME_LABEL {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Return the snapshot with the given name, or zero if there is none. Names left by deleted snapshots are ignored.
+func (dc *DeviceContext) FindSnapshotByName(name string) uint16 {
+	for _, l := range dc.labels {
+		if l.Key == SNAPSHOT_NAME_LABEL && l.Value == name && dc.snapshots[l.SnapshotId-1].CreatedAt != 0 {
+			return l.SnapshotId
+		}
+	}
+	return 0
+}
+
+// Name a snapshot, replacing any name it had, or remove its name if empty. Names must be valid and not used
+// by another snapshot. Metadata is not written to the device.
+func (dc *DeviceContext) setSnapshotName(snapshotId uint16, name string) error {
+	if name != "" {
+		if err := ValidateSnapshotName(name); err != nil {
+			return err
+		}
+		if other := dc.FindSnapshotByName(name); other != 0 && other != snapshotId {
+			return fmt.Errorf("%w: %v", ErrSnapshotExists, name)
+		}
+	}
+	updated := make([]Label, 0, len(dc.labels)+1)
+	for _, l := range dc.labels {
+		if l.SnapshotId != snapshotId || l.Key != SNAPSHOT_NAME_LABEL {
+			updated = append(updated, l)
+		}
+	}
+	if name != "" {
+		updated = append(updated, Label{SnapshotId: snapshotId, Key: SNAPSHOT_NAME_LABEL, Value: name})
+	}
+	return dc.updateLabels(snapshotId, updated, LABEL_REGION_SIZE)
+}
+
+// Name a snapshot, or remove its name if empty. Names can be used instead of snapshot ids, which are reused once
+// snapshots are deleted, by resolving them with ResolveSnapshot.
+func SetSnapshotName(device string, snapshotId uint, name string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	if snapshotId == 0 || snapshotId > MAX_SNAPSHOTS || dc.snapshots[snapshotId-1].CreatedAt == 0 {
+		return fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	if err := dc.setSnapshotName(uint16(snapshotId), name); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Return the description of a snapshot, or an empty string if it has none.
+func (dc *DeviceContext) SnapshotDescription(snapshotId uint16) string {
+	for _, l := range dc.labels {
+		if l.SnapshotId == snapshotId && l.Key == SNAPSHOT_DESCRIPTION_LABEL {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Describe a snapshot, replacing any description it had, or remove its description if empty. Descriptions are
+// free-form UTF-8 text of up to MAX_SNAPSHOT_DESCRIPTION_SIZE bytes, and take space in the label region like
+// labels. Metadata is not written to the device.
+func (dc *DeviceContext) setSnapshotDescription(snapshotId uint16, description string) error {
+	if len(description) > MAX_SNAPSHOT_DESCRIPTION_SIZE || !utf8.ValidString(description) {
+		return fmt.Errorf("%w: description of snapshot %v must be UTF-8 of up to %v bytes", ErrInvalidLabel, snapshotId, MAX_SNAPSHOT_DESCRIPTION_SIZE)
+	}
+	updated := make([]Label, 0, len(dc.labels)+1)
+	for _, l := range dc.labels {
+		if l.SnapshotId != snapshotId || l.Key != SNAPSHOT_DESCRIPTION_LABEL {
+			updated = append(updated, l)
+		}
+	}
+	if description != "" {
+		updated = append(updated, Label{SnapshotId: snapshotId, Key: SNAPSHOT_DESCRIPTION_LABEL, Value: description})
+	}
+	return dc.updateLabels(snapshotId, updated, LABEL_REGION_SIZE-LABEL_NAME_RESERVE)
+}
+
+// Describe a snapshot, to record why it was taken, or remove its description if empty.
+func SetSnapshotDescription(device string, snapshotId uint, description string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	if snapshotId == 0 || snapshotId > MAX_SNAPSHOTS || dc.snapshots[snapshotId-1].CreatedAt == 0 {
+		return fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	if err := dc.setSnapshotDescription(uint16(snapshotId), description); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Return the id of a snapshot given as a name or a numeric id, as accepted by commands taking snapshots.
+// Fails with ErrSnapshotNotFound if no snapshot has the name or id.
+func ResolveSnapshot(device string, snapshot string) (uint, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+	sid, ok := dc.resolveSnapshot(snapshot)
+	if !ok {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshot)
+	}
+	return uint(sid), dc.Close()
+}
+
+func (dc *DeviceContext) resolveSnapshot(snapshot string) (uint16, bool) {
+	if id, err := strconv.ParseUint(snapshot, 10, 16); err == nil {
+		return uint16(id), id > 0 && dc.snapshots[id-1].CreatedAt != 0
+	}
+	sid := dc.FindSnapshotByName(snapshot)
+	return sid, sid != 0
+}
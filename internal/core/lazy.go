@@ -0,0 +1,213 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrVolumeClosed = errors.New("volume closed")
+
+// Builds the extent map of a volume in the background, in a single parallel pass over the extent metadata. Extents
+// of the current snapshot can be used as soon as the pass reaches them, while other lookups wait for the pass
+// to finish, as extents of an ancestor may be superseded by ones found later.
+type mapBuilder struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	vem       *ExtentMap
+	snapshots map[uint16]int // Depth of each snapshot in the chain, the current one at zero
+	current   uint16
+	partial   bool // Partial extents were found, which need the extents they inherit from
+	done      bool
+	err       error
+	closing   atomic.Bool
+	ready     chan struct{}
+}
+
+func newMapBuilder(dc *DeviceContext, vem *ExtentMap, snapshotId uint16) *mapBuilder {
+	b := &mapBuilder{
+		vem:       vem,
+		snapshots: make(map[uint16]int),
+		current:   snapshotId,
+		ready:     make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	depth := 0
+	for sid := snapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		b.snapshots[sid] = depth
+		depth++
+	}
+	return b
+}
+
+// Scan the extent metadata, then release the metadata lock held since the volume was opened.
+func (b *mapBuilder) run(dc *DeviceContext) {
+	err := b.scan(dc)
+	if uerr := dc.UnlockMetadata(); err == nil {
+		err = uerr
+	}
+	b.mu.Lock()
+	b.done = true
+	b.err = err
+	b.mu.Unlock()
+	b.cond.Broadcast()
+	close(b.ready)
+}
+
+func (b *mapBuilder) scan(dc *DeviceContext) error {
+	err := dc.scanExtents(func(offset uint, eb []ExtentMetadata) error {
+		if b.closing.Load() {
+			return ErrVolumeClosed
+		}
+		b.mu.Lock()
+		for i := range eb {
+			b.add(&eb[i], uint32(offset+uint(i)))
+		}
+		b.mu.Unlock()
+		b.cond.Broadcast()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !b.partial {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sid := dc.snapshots[b.current-1].ParentSnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		if err := b.vem.load(sid, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add an extent found at a device position, unless the map has one of a more recent snapshot.
+func (b *mapBuilder) add(e *ExtentMetadata, pos uint32) {
+	depth, ok := b.snapshots[e.SnapshotId]
+	if !ok || uint(e.ExtentPos) >= b.vem.totalVolumeExtents {
+		return
+	}
+	if e.Flags&EXTENT_FLAG_PARTIAL != 0 {
+		b.partial = true
+	}
+	eidx := e.ExtentPos
+	if existing := b.vem.get(eidx); existing.SnapshotId != 0 && b.snapshots[existing.SnapshotId] <= depth {
+		return
+	}
+	b.vem.extentBitmap.Set(eidx)
+	me := b.vem.extent(eidx)
+	*me = *e
+	// Convert ExtentPos from position in volume to position in device
+	me.ExtentPos = pos
+}
+
+func (b *mapBuilder) isReady() bool {
+	select {
+	case <-b.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Return the metadata of a volume extent, waiting until it is known.
+func (b *mapBuilder) lookup(eidx uint32) (ExtentMetadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.done && b.vem.get(eidx).SnapshotId != b.current {
+		b.cond.Wait()
+	}
+	if b.done && b.err != nil {
+		return ExtentMetadata{}, b.err
+	}
+	return b.vem.get(eidx), nil
+}
+
+// Wait for the map to be built.
+func (b *mapBuilder) wait() error {
+	<-b.ready
+	return b.err
+}
+
+// Open a volume for I/O, returning before its extent map is built. The map is built in the background, while
+// holding a shared lock on the device metadata. Reads of extents of the current snapshot proceed as soon as
+// they are found, and other reads wait for the map to be built, as do writes, unmaps and refreshes.
+func OpenVolumeLazy(device string, volumeName string, opts ...Option) (*VolumeContext, error) {
+	sectorSize, err := volumeSectorSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := GetSharedDeviceContext(device, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFeatures(dc.superblock, true); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		dc.Close()
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	vem := newExtentMap(dc, v.VolumeSize)
+	vem.allocationPolicy = dc.AllocationPolicy(v)
+	vem.tier = v.Tier
+	vc := &VolumeContext{
+		dc:         dc,
+		volume:     v,
+		vem:        vem,
+		qos:        newVolumeQoS(v),
+		volumeName: volumeName,
+		snapshotId: v.SnapshotId,
+		generation: dc.superblock.Generation,
+		cache:      newBlockCache(dc.opts.ReadCache),
+		builder:    newMapBuilder(dc, vem, v.SnapshotId),
+		stats:      newVolumeStats(),
+		sectorSize: sectorSize,
+	}
+	if vc.extentCache, err = newExtentCache(dc); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	registerVolume(vc)
+	go vc.builder.run(dc)
+	dc.opts.Logger.Info("opened volume", "volume", volumeName, "snapshot", v.SnapshotId, "lazy", true, "sync", SyncPolicyName(dc.opts.SyncPolicy))
+	return vc, nil
+}
+
+// Return the metadata of a volume extent. For lazily opened volumes, waits until it is known.
+func (vc *VolumeContext) lookupExtent(eidx uint32) (ExtentMetadata, error) {
+	if vc.builder != nil && !vc.builder.isReady() {
+		return vc.builder.lookup(eidx)
+	}
+	if vc.builder != nil && vc.builder.err != nil {
+		return ExtentMetadata{}, vc.builder.err
+	}
+	return vc.vem.get(eidx), nil
+}
+
+// Wait for the extent map of a lazily opened volume to be built.
+func (vc *VolumeContext) waitMap() error {
+	if vc.builder == nil {
+		return nil
+	}
+	return vc.builder.wait()
+}
@@ -0,0 +1,121 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Prefix of device names referring to in-memory devices.
+const MEMORY_DEVICE_PREFIX = "mem://"
+
+// Device contents kept in memory, shared by all handles that open it.
+type memoryDevice struct {
+	mu   sync.RWMutex
+	data []byte
+	lock sync.RWMutex // Device lock, equivalent to flock on a file
+}
+
+var (
+	memoryDevicesMu sync.Mutex
+	memoryDevices   = make(map[string]*memoryDevice)
+)
+
+// Create an in-memory device of the given size and return its device name, to be passed to any API call in the
+// same process. Intended for testing, as contents are lost on exit. The device is not initialized.
+func CreateMemoryDevice(name string, size uint64) (string, error) {
+	memoryDevicesMu.Lock()
+	defer memoryDevicesMu.Unlock()
+	if _, ok := memoryDevices[name]; ok {
+		return "", fmt.Errorf("memory device %v already exists", name)
+	}
+	memoryDevices[name] = &memoryDevice{data: make([]byte, size)}
+	return MEMORY_DEVICE_PREFIX + name, nil
+}
+
+// Remove an in-memory device, freeing its memory once all handles are closed.
+func RemoveMemoryDevice(name string) error {
+	memoryDevicesMu.Lock()
+	defer memoryDevicesMu.Unlock()
+	if _, ok := memoryDevices[strings.TrimPrefix(name, MEMORY_DEVICE_PREFIX)]; !ok {
+		return fmt.Errorf("memory device %v not found", name)
+	}
+	delete(memoryDevices, strings.TrimPrefix(name, MEMORY_DEVICE_PREFIX))
+	return nil
+}
+
+// Handle to an in-memory device. Each handle takes the device lock independently, like file descriptors.
+type memoryFile struct {
+	*processLock
+	md   *memoryDevice
+	name string
+}
+
+func openMemoryFile(device string) (*memoryFile, error) {
+	memoryDevicesMu.Lock()
+	defer memoryDevicesMu.Unlock()
+	md, ok := memoryDevices[strings.TrimPrefix(device, MEMORY_DEVICE_PREFIX)]
+	if !ok {
+		return nil, fmt.Errorf("memory device %v not found", device)
+	}
+	return &memoryFile{processLock: &processLock{lock: &md.lock}, md: md, name: device}, nil
+}
+
+func (mf *memoryFile) ReadAt(data []byte, offset uint64) (int, error) {
+	mf.md.mu.RLock()
+	defer mf.md.mu.RUnlock()
+	if offset+uint64(len(data)) > uint64(len(mf.md.data)) {
+		return 0, fmt.Errorf("read beyond end of %v", mf.name)
+	}
+	return copy(data, mf.md.data[offset:]), nil
+}
+
+func (mf *memoryFile) WriteAt(data []byte, offset uint64) (int, error) {
+	mf.md.mu.Lock()
+	defer mf.md.mu.Unlock()
+	if offset+uint64(len(data)) > uint64(len(mf.md.data)) {
+		return 0, fmt.Errorf("write beyond end of %v", mf.name)
+	}
+	return copy(mf.md.data[offset:], data), nil
+}
+
+func (mf *memoryFile) Size() (int64, error) {
+	return int64(len(mf.md.data)), nil
+}
+
+// Discard data by zeroing it.
+func (mf *memoryFile) Trim(offset uint64, length uint64) error {
+	mf.md.mu.Lock()
+	defer mf.md.mu.Unlock()
+	if offset+length > uint64(len(mf.md.data)) {
+		return fmt.Errorf("trim beyond end of %v", mf.name)
+	}
+	clear(mf.md.data[offset : offset+length])
+	return nil
+}
+
+func (mf *memoryFile) ZeroRange(offset uint64, length uint64) (bool, error) {
+	return true, mf.Trim(offset, length)
+}
+
+func (mf *memoryFile) DirectIO() bool { return true }
+func (mf *memoryFile) Flush() error   { return nil }
+func (mf *memoryFile) Sync() error    { return nil }
+
+func (mf *memoryFile) Close() error {
+	return mf.Unlock()
+}
@@ -0,0 +1,82 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync"
+)
+
+// Metadata of a device as last read or written by the process, so that contexts opened while it is unchanged,
+// as by queries polling a device, do not read and deserialize the whole metadata area. The superblock, which
+// is read on each open, identifies the metadata by the device UUID, the generation, and the checksum of the
+// active copy, so updates by other processes or reinitialization invalidate the entry.
+type cachedMetadata struct {
+	key       metadataKey
+	volumes   [MAX_VOLUMES]VolumeMetadata
+	snapshots [MAX_SNAPSHOTS]SnapshotMetadata
+	groups    [MAX_GROUPS]GroupMetadata
+	retention [MAX_VOLUMES]uint32
+	labels    []Label
+}
+
+type metadataKey struct {
+	uuid       [16]byte
+	generation uint64
+	checksum   uint32
+}
+
+var (
+	metadataCacheMu sync.Mutex
+	metadataCache   = make(map[string]*cachedMetadata)
+)
+
+func (dc *DeviceContext) metadataKey() metadataKey {
+	return metadataKey{
+		uuid:       dc.superblock.UUID,
+		generation: dc.superblock.Generation,
+		checksum:   dc.superblock.MetadataChecksums[dc.superblock.ActiveMetadata],
+	}
+}
+
+// Load the metadata from the cache, returning false if it has no entry matching the superblock.
+func (dc *DeviceContext) loadCachedMetadata() bool {
+	metadataCacheMu.Lock()
+	cm := metadataCache[dc.device]
+	metadataCacheMu.Unlock()
+	if cm == nil || cm.key != dc.metadataKey() {
+		return false
+	}
+	dc.volumes = cm.volumes
+	dc.snapshots = cm.snapshots
+	dc.groups = cm.groups
+	dc.retention = cm.retention
+	dc.labels = append([]Label(nil), cm.labels...)
+	return true
+}
+
+// Store the metadata just read or written in the cache.
+func (dc *DeviceContext) cacheMetadata() {
+	cm := &cachedMetadata{
+		key:       dc.metadataKey(),
+		volumes:   dc.volumes,
+		snapshots: dc.snapshots,
+		groups:    dc.groups,
+		retention: dc.retention,
+		labels:    append([]Label(nil), dc.labels...),
+	}
+	metadataCacheMu.Lock()
+	metadataCache[dc.device] = cm
+	metadataCacheMu.Unlock()
+}
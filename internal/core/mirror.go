@@ -0,0 +1,304 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Prefix of device names referring to a pair of mirrored devices, as mirror://DEVICE,MIRROR.
+const MIRROR_DEVICE_PREFIX = "mirror://"
+
+// State of a mirrored pair, shared by all handles that open it in the process.
+type mirrorState struct {
+	mu        sync.RWMutex // Held shared by writes, and exclusively while resyncing a range
+	failed    atomic.Int32 // Copy that failed and is no longer written, -1 if both are in sync
+	resyncing atomic.Bool  // Set while the failed copy is resynced, so that writes go to both copies
+	stale     atomic.Bool  // Set if a write to the failed copy failed while resyncing
+}
+
+var (
+	mirrorStatesMu sync.Mutex
+	mirrorStates   = make(map[string]*mirrorState)
+)
+
+// Backend writing all data and metadata to two devices, reading from the first. When a copy fails, the other
+// one is used alone until ResyncMirror copies it over to the failed one. Which copy failed is only known
+// within the process, but when a mirror is first opened, a copy with a superblock behind the other is taken
+// to have failed.
+type mirrorBackend struct {
+	device string
+	paths  [2]string
+	copies [2]*deviceBackend
+	state  *mirrorState
+	logger *slog.Logger
+}
+
+func openMirrorBackend(device string, opts *Options) (BlockBackend, error) {
+	paths := strings.Split(strings.TrimPrefix(device, MIRROR_DEVICE_PREFIX), ",")
+	if len(paths) != 2 || paths[0] == "" || paths[1] == "" || paths[0] == paths[1] {
+		return nil, fmt.Errorf("invalid mirrored device %v, expected %vDEVICE,MIRROR", device, MIRROR_DEVICE_PREFIX)
+	}
+	mb := &mirrorBackend{device: device, paths: [2]string{paths[0], paths[1]}, logger: opts.Logger}
+	for i, path := range paths {
+		b, err := openBackend(path, opts)
+		if err != nil {
+			mb.Close()
+			return nil, err
+		}
+		mb.copies[i] = b
+	}
+	mirrorStatesMu.Lock()
+	defer mirrorStatesMu.Unlock()
+	if mb.state = mirrorStates[device]; mb.state == nil {
+		failed, err := mb.staleCopy()
+		if err != nil {
+			mb.Close()
+			return nil, err
+		}
+		mb.state = &mirrorState{}
+		mb.state.failed.Store(int32(failed))
+		mirrorStates[device] = mb.state
+	}
+	return mb, nil
+}
+
+// Return the copy whose superblock is missing or behind the other's, -1 if they match. Copies are in sync if
+// neither is initialized, as when the mirror is about to be. If neither is behind, but they differ, the second
+// is taken to have failed, as the first is the one read.
+func (mb *mirrorBackend) staleCopy() (int, error) {
+	var sb [2]Superblock
+	abuf := AlignedBlock(BLOCK_SIZE)
+	for i := range mb.copies {
+		if _, err := mb.copies[i].ReadAt(abuf, 0); err != nil {
+			return 0, fmt.Errorf("failed to read superblock of %v: %w", mb.paths[i], err)
+		}
+		format.Unmarshal(abuf, &sb[i])
+	}
+	valid := [2]bool{string(sb[0].Magic[:]) == MAGIC, string(sb[1].Magic[:]) == MAGIC}
+	behind := func(i int) bool {
+		return sb[i].Generation < sb[1-i].Generation ||
+			sb[i].Generation == sb[1-i].Generation && sb[i].AllocatedDeviceExtents < sb[1-i].AllocatedDeviceExtents
+	}
+	switch {
+	case !valid[0] && !valid[1] || sb[0] == sb[1]:
+		return -1, nil
+	case !valid[0] || valid[1] && behind(0):
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// Stop using a copy after an error, if the other is in sync. Returns false if it is the only copy left.
+func (mb *mirrorBackend) fail(i int, err error) bool {
+	if mb.state.resyncing.Load() && int(mb.state.failed.Load()) == i {
+		mb.state.stale.Store(true)
+		return true
+	}
+	if !mb.state.failed.CompareAndSwap(-1, int32(i)) {
+		return int(mb.state.failed.Load()) == i
+	}
+	mb.logger.Warn("mirrored copy failed, using the other one", "device", mb.device, "copy", mb.paths[i], "error", err)
+	notify(mb.device, Event{Type: EVENT_MIRROR_DEGRADED, Detail: fmt.Sprintf("%v: %v", mb.paths[i], err)})
+	return true
+}
+
+// Return true if a copy is written, which the failed one only is while resyncing.
+func (mb *mirrorBackend) writable(i int) bool {
+	return int(mb.state.failed.Load()) != i || mb.state.resyncing.Load()
+}
+
+func (mb *mirrorBackend) ReadAt(data []byte, offset uint64) (int, error) {
+	i := 0
+	if mb.state.failed.Load() == 0 {
+		i = 1
+	}
+	n, err := mb.copies[i].ReadAt(data, offset)
+	if err != nil && mb.state.failed.Load() == -1 && mb.fail(i, err) {
+		return mb.copies[1-i].ReadAt(data, offset)
+	}
+	return n, err
+}
+
+func (mb *mirrorBackend) WriteAt(data []byte, offset uint64) (int, error) {
+	mb.state.mu.RLock()
+	defer mb.state.mu.RUnlock()
+	return len(data), mb.each(func(b *deviceBackend) error {
+		_, err := b.WriteAt(data, offset)
+		return err
+	})
+}
+
+// Apply an operation to the copies written, failing over from a copy it fails on.
+func (mb *mirrorBackend) each(fn func(b *deviceBackend) error) error {
+	var errs [2]error
+	for i, b := range mb.copies {
+		if mb.writable(i) {
+			errs[i] = fn(b)
+		}
+	}
+	for i, err := range errs {
+		if err != nil && (!mb.writable(1-i) || !mb.fail(i, err)) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mb *mirrorBackend) Size() (int64, error) {
+	var size int64
+	for i, b := range mb.copies {
+		s, err := b.Size()
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || s < size {
+			size = s
+		}
+	}
+	return size, nil
+}
+
+func (mb *mirrorBackend) Sync() error {
+	return mb.each(func(b *deviceBackend) error { return b.Sync() })
+}
+
+func (mb *mirrorBackend) Flush() error {
+	return mb.each(func(b *deviceBackend) error { return b.Flush() })
+}
+
+func (mb *mirrorBackend) DirectIO() bool {
+	return mb.copies[0].DirectIO() && mb.copies[1].DirectIO()
+}
+
+func (mb *mirrorBackend) Trim(offset uint64, length uint64) error {
+	return mb.each(func(b *deviceBackend) error { return b.Trim(offset, length) })
+}
+
+// Zero a range of both copies, if both can do it without writing zeroes.
+func (mb *mirrorBackend) ZeroRange(offset uint64, length uint64) (bool, error) {
+	zeroed := true
+	err := mb.each(func(b *deviceBackend) error {
+		ok, err := b.ZeroRange(offset, length)
+		zeroed = zeroed && ok
+		return err
+	})
+	return zeroed, err
+}
+
+// Lock through the first copy, so that processes sharing the mirror exclude each other.
+func (mb *mirrorBackend) Lock(exclusive bool) error {
+	return mb.copies[0].Lock(exclusive)
+}
+
+func (mb *mirrorBackend) Unlock() error {
+	return mb.copies[0].Unlock()
+}
+
+func (mb *mirrorBackend) Close() error {
+	var err error
+	for _, b := range mb.copies {
+		if b != nil {
+			if cerr := b.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Return the copy of a mirrored device that failed, empty if the device is not mirrored or the copies are in
+// sync.
+func (dc *DeviceContext) mirrorFailed() string {
+	if mb, ok := dc.f.BlockBackend.(*mirrorBackend); ok {
+		if i := mb.state.failed.Load(); i >= 0 {
+			return mb.paths[i]
+		}
+	}
+	return ""
+}
+
+// Copy a mirrored device over to the copy that failed, once it is replaced or repaired, so that both are
+// written again. Volumes may stay open, as writes during the resync go to both copies, but metadata cannot be
+// changed. The extent time table, if in use, is copied as well, but not the reserved region, if any.
+func ResyncMirror(device string) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	mb, ok := dc.f.BlockBackend.(*mirrorBackend)
+	if !ok {
+		return fmt.Errorf("device %v is not mirrored", device)
+	}
+	failed := int(mb.state.failed.Load())
+	if failed < 0 {
+		return dc.Close()
+	}
+	mb.state.stale.Store(false)
+	mb.state.resyncing.Store(true)
+	defer mb.state.resyncing.Store(false)
+	// Extents past the allocation mark are unused, and cannot be allocated while the metadata is locked, except
+	// for those of the extent time table at the end of the data area
+	end := uint64(dc.dataOffset) + uint64(min(uint(dc.superblock.AllocatedDeviceExtents), dc.totalDeviceExtents))*EXTENT_SIZE
+	abuf := AlignedBlock(EXTENT_SIZE)
+	if err := mb.resyncArea(abuf, 0, end, failed); err != nil {
+		return err
+	}
+	if dc.extentTimeOffset != 0 {
+		layout := format.NewReservedLayout(dc.superblock.DeviceSize, dc.superblock.ReservedSize)
+		extents, offset := layout.ExtentTimeTable()
+		if err := mb.resyncArea(abuf, offset, offset+extents*EXTENT_SIZE, failed); err != nil {
+			return err
+		}
+	}
+	if err := mb.copies[failed].Flush(); err != nil {
+		return fmt.Errorf("cannot resync %v: %w", mb.paths[failed], err)
+	}
+	if mb.state.stale.Load() {
+		return fmt.Errorf("cannot resync %v: writes to it failed meanwhile", mb.paths[failed])
+	}
+	mb.state.failed.Store(-1)
+	dc.opts.Logger.Info("resynced mirrored copy", "device", device, "copy", mb.paths[failed])
+	notify(device, Event{Type: EVENT_MIRROR_RESYNCED, Detail: mb.paths[failed]})
+	return dc.Close()
+}
+
+// Copy an area of the device from the copy in sync to the failed one, an extent at a time.
+func (mb *mirrorBackend) resyncArea(abuf []byte, start uint64, end uint64, failed int) error {
+	for offset := start; offset < end; offset += EXTENT_SIZE {
+		if err := mb.resyncRange(abuf[:min(EXTENT_SIZE, end-offset)], offset, failed); err != nil {
+			return fmt.Errorf("cannot resync %v: %w", mb.paths[failed], err)
+		}
+	}
+	return nil
+}
+
+// Copy a range from the copy in sync to the failed one, excluding writes to it meanwhile.
+func (mb *mirrorBackend) resyncRange(buf []byte, offset uint64, failed int) error {
+	mb.state.mu.Lock()
+	defer mb.state.mu.Unlock()
+	if _, err := mb.copies[1-failed].ReadAt(buf, offset); err != nil {
+		return err
+	}
+	_, err := mb.copies[failed].WriteAt(buf, offset)
+	return err
+}
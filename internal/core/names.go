@@ -0,0 +1,86 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidVolumeName = errors.New("invalid volume name")
+	ErrVolumeExists      = errors.New("volume already exists")
+	ErrInvalidGroupName  = errors.New("invalid group name")
+
+	ErrInvalidSnapshotName = errors.New("invalid snapshot name")
+	ErrSnapshotExists      = errors.New("snapshot already exists")
+)
+
+// Longest snapshot name.
+const MAX_SNAPSHOT_NAME_SIZE = 63
+
+// Check that a volume name is usable. Names are up to MAX_VOLUME_NAME_SIZE bytes of letters, digits, '.', '_'
+// and '-', starting with a letter or digit, so they are safe as file names and NBD export names.
+func ValidateVolumeName(volumeName string) error {
+	return validateName(volumeName, MAX_VOLUME_NAME_SIZE, ErrInvalidVolumeName)
+}
+
+// Check that a group name is usable. Names follow the rules of volume names, up to MAX_GROUP_NAME_SIZE bytes.
+func ValidateGroupName(groupName string) error {
+	return validateName(groupName, MAX_GROUP_NAME_SIZE, ErrInvalidGroupName)
+}
+
+// Check that a snapshot name is usable. Names follow the rules of volume names, up to MAX_SNAPSHOT_NAME_SIZE
+// bytes, but must not be all digits, so they are told apart from snapshot ids.
+func ValidateSnapshotName(name string) error {
+	if err := validateName(name, MAX_SNAPSHOT_NAME_SIZE, ErrInvalidSnapshotName); err != nil {
+		return err
+	}
+	if strings.Trim(name, "0123456789") == "" {
+		return fmt.Errorf("%w: only digits", ErrInvalidSnapshotName)
+	}
+	return nil
+}
+
+func validateName(name string, maxSize int, errInvalid error) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty name", errInvalid)
+	}
+	if len(name) > maxSize {
+		return fmt.Errorf("%w: longer than %v bytes", errInvalid, maxSize)
+	}
+	for i, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return fmt.Errorf("%w: %q not allowed at position %v", errInvalid, c, i)
+		}
+	}
+	return nil
+}
+
+// Check that a volume can be given a name. The name must be valid and not used by another volume, except v,
+// which may be nil. Volumes in the trash are ignored, as they are checked when undeleted.
+func (dc *DeviceContext) checkVolumeName(volumeName string, v *VolumeMetadata) error {
+	if err := ValidateVolumeName(volumeName); err != nil {
+		return err
+	}
+	if other := dc.FindVolume(volumeName); other != nil && other != v {
+		return fmt.Errorf("%w: %v", ErrVolumeExists, volumeName)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"io"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Settings for opening a device or volume. Set through Option functions passed to InitDevice, GetDeviceContext,
+// OpenVolume and OpenSnapshot.
+type Options struct {
+	Logger       *slog.Logger // Logs open, close and reload events (discarded by default)
+	ReadCache    uint         // Number of blocks cached in memory per open volume (zero disables caching)
+	CacheDevice  string       // Local device caching extents read by open volumes (none by default)
+	BufferedIO   bool         // Use buffered instead of direct I/O
+	SectorSize   uint         // Logical sector size of open volumes (BLOCK_SIZE by default)
+	SyncPolicy   uint         // When metadata updates are made durable (SYNC_POLICY_STRICT by default)
+	Coalesce     bool         // Coalesce writes to parts of a block
+	BlockCoW     bool         // Copy only overwritten blocks of extents of previous snapshots
+	Force        bool         // Initialize devices already holding volumes
+	DeviceUUID   string       // Expected identity of the device (not checked if empty)
+	ReservedSize uint64       // Bytes at the end of the device left out by InitDevice (none by default)
+	Zeroed       bool         // Zero extents of volumes made by CreateVolume when allocated
+	Retry        RetryPolicy  // Retries of block I/O and escalation of media errors (none by default)
+
+	TracerProvider trace.TracerProvider // Traces volume operations (the global provider by default)
+	MeterProvider  metric.MeterProvider // Times volume and device operations (the global provider by default)
+
+	ExtentBatch    uint // Extents read or written at once when scanning extent metadata (tuned to the device by default)
+	ScanReaders    uint // Batches of extent metadata read at once when scanning (SCAN_READERS by default)
+	CopyBufferSize uint // Bytes read and written at once when copying extent data (EXTENT_SIZE by default)
+}
+
+type Option func(*Options)
+
+// Log events to the given logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// Trace volume operations with the given provider, instead of the global one.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *Options) {
+		o.TracerProvider = tp
+	}
+}
+
+// Record operation durations with the given provider, instead of the global one.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(o *Options) {
+		o.MeterProvider = mp
+	}
+}
+
+// Retry block reads and writes that fail with transient errors, and make volumes read-only after repeated
+// media errors, as set in the policy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *Options) {
+		o.Retry = policy
+	}
+}
+
+// Cache recently read blocks of open volumes in memory. Blocks written through other contexts of the same
+// volume are not seen until its metadata is reloaded.
+func WithReadCache(blocks uint) Option {
+	return func(o *Options) {
+		o.ReadCache = blocks
+	}
+}
+
+// Cache extents read by an open volume on a local device, like a file on a faster disk, for devices on remote
+// or slow backends. The cache device is opened with the same backends as devices, and holds as many extents as
+// fit in it. Writes go through to the device and to cached extents. As the cache starts empty whenever the
+// volume is opened, its contents need not survive, but each open volume needs a cache device of its own.
+func WithCacheDevice(device string) Option {
+	return func(o *Options) {
+		o.CacheDevice = device
+	}
+}
+
+// Use buffered I/O, for devices on filesystems without direct I/O support, like tmpfs. Metadata updates are
+// synced explicitly and data writes on VolumeContext.Sync. Buffered I/O is also used when opening the device
+// for direct I/O fails with EINVAL.
+func WithBufferedIO() Option {
+	return func(o *Options) {
+		o.BufferedIO = true
+	}
+}
+
+// Expose open volumes with a logical sector size smaller than BLOCK_SIZE, down to MIN_SECTOR_SIZE, for clients
+// that assume 512-byte sectors. Sectors are written with read-modify-write of the block holding them, and
+// unmapping sectors that do not cover a whole block zeroes them.
+func WithSectorSize(size uint) Option {
+	return func(o *Options) {
+		o.SectorSize = size
+	}
+}
+
+// Set when metadata updates are made durable, to trade durability for performance. Data written with direct
+// I/O reaches the device regardless, while with buffered I/O it is made durable by VolumeContext.Sync.
+func WithSyncPolicy(policy uint) Option {
+	return func(o *Options) {
+		o.SyncPolicy = policy
+	}
+}
+
+// Keep a block written in parts in memory, so that later writes to it are coalesced, instead of reading and
+// writing the whole block for each part. The block is written to the volume when another block is written in
+// part, once it is written in full, and on Sync, Refresh and close, so writes may be lost on a crash until
+// the volume is synced, as with buffered I/O.
+func WithWriteCoalescing() Option {
+	return func(o *Options) {
+		o.Coalesce = true
+	}
+}
+
+// Copy only the blocks written to an extent of a previous snapshot, instead of the whole extent. The new extent
+// is marked partial, and its other blocks are read from the extents of previous snapshots. Partial extents are
+// copied in full when a block is unmapped from them or the volume is cloned.
+func WithBlockCoW() Option {
+	return func(o *Options) {
+		o.BlockCoW = true
+	}
+}
+
+// Let InitDevice initialize a device that already is, deleting all its volumes and snapshots. Without it,
+// InitDevice fails with ErrDeviceInitialized.
+func WithForce() Option {
+	return func(o *Options) {
+		o.Force = true
+	}
+}
+
+// Fail with ErrWrongDevice if the device does not have the given UUID, as shown by GetDeviceInfo, so that a
+// device path pointing to another device, as may happen when raw devices are renamed on boot, is not used.
+// InitDevice gives the UUID to the device, instead of a random one.
+func WithDeviceUUID(uuid string) Option {
+	return func(o *Options) {
+		o.DeviceUUID = uuid
+	}
+}
+
+// Let InitDevice leave a region of the given size at the end of the device, rounded up to a multiple of
+// EXTENT_SIZE, out of the data area, for a small foreign partition, like boot data, to share the device. The
+// region is recorded in the superblock, never allocated or written, and reported by GetDeviceInfo.
+func WithReservedRegion(size uint64) Option {
+	return func(o *Options) {
+		o.ReservedSize = size
+	}
+}
+
+// Let CreateVolume make a volume whose extents are zeroed when allocated, so that none of the data they held for
+// volumes since deleted remains on the device, even in blocks not written yet. Blocks not written read as zeroes
+// anyway, but this also holds for exports of the raw extents and for callers reading the device directly. Later
+// snapshots of the volume keep the setting, and partial copies on write are zeroed as well.
+func WithZeroedExtents() Option {
+	return func(o *Options) {
+		o.Zeroed = true
+	}
+}
+
+// Read or write the given number of extents at once when scanning extent metadata, as when opening volumes or
+// initializing the device. By default, batches are tuned to the device size. Can also be set with the
+// DBS_EXTENT_BATCH environment variable.
+func WithExtentBatch(extents uint) Option {
+	return func(o *Options) {
+		o.ExtentBatch = extents
+	}
+}
+
+// Read the given number of batches of extent metadata at once when scanning the whole table, as when opening
+// volumes or vacuuming. One reader scans sequentially. Can also be set with the DBS_SCAN_READERS environment
+// variable.
+func WithScanReaders(readers uint) Option {
+	return func(o *Options) {
+		o.ScanReaders = readers
+	}
+}
+
+// Copy extent data in parts of the given size, a power of two from BLOCK_SIZE to EXTENT_SIZE, instead of a
+// whole extent at once. Can also be set with the DBS_COPY_BUFFER_SIZE environment variable.
+func WithCopyBufferSize(size uint) Option {
+	return func(o *Options) {
+		o.CopyBufferSize = size
+	}
+}
+
+func newOptions(opts []Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.Logger == nil {
+		o.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return o
+}
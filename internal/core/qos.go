@@ -0,0 +1,113 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Token bucket holding up to one second worth of tokens. Requests larger than the bucket are allowed to
+// overdraw it, and wait until the debt is paid off.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Return the configured rate, zero for a nil (unlimited) bucket.
+func (tb *tokenBucket) limit() uint64 {
+	if tb == nil {
+		return 0
+	}
+	return uint64(tb.rate)
+}
+
+// Take n tokens, blocking until they are available. A nil bucket never blocks.
+func (tb *tokenBucket) take(n uint64) {
+	if tb == nil {
+		return
+	}
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens = min(tb.rate, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	tb.tokens -= float64(n)
+	wait := time.Duration(0)
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Per-volume limits on I/O operations and bytes transferred per second.
+type volumeQoS struct {
+	iops      *tokenBucket
+	bandwidth *tokenBucket
+}
+
+func newVolumeQoS(v *VolumeMetadata) volumeQoS {
+	return volumeQoS{
+		iops:      newTokenBucket(uint64(v.MaxIops)),
+		bandwidth: newTokenBucket(v.MaxBandwidth),
+	}
+}
+
+// Account for an operation transferring the given number of bytes, blocking if over the limits.
+func (q *volumeQoS) throttle(length uint64) {
+	q.iops.take(1)
+	if length > 0 {
+		q.bandwidth.take(length)
+	}
+}
+
+// Set the I/O limits of a volume. Zero means unlimited. Volumes already open pick up the limits on their next
+// reload of the metadata.
+func SetVolumeQoS(device string, volumeName string, maxIops uint, maxBandwidth uint64) error {
+	if maxIops > 1<<32-1 {
+		return fmt.Errorf("IOPS limit too large")
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	v.MaxIops = uint32(maxIops)
+	v.MaxBandwidth = maxBandwidth
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
@@ -0,0 +1,160 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// Number of snapshots fetched at a time by EachSnapshot.
+const SNAPSHOT_PAGE_SIZE = 1024
+
+// Filters and pages a snapshot listing. Snapshots must match all criteria set, so the zero value lists all
+// snapshots on the device.
+type SnapshotQuery struct {
+	VolumeName string            // In the chain of this volume, if not empty
+	Labels     map[string]string // Having all these labels, with the same values
+	After      time.Time         // Created at or after this time, if not zero
+	Before     time.Time         // Created before this time, if not zero
+	StartId    uint              // With this id or higher, to continue a previous listing
+	Limit      uint              // At most this many, if not zero
+}
+
+// Return the snapshots matching a query, ordered by id, along with the StartId that continues the listing, or
+// zero if there are no more. Snapshots are reported with volumes as in ListAllSnapshots.
+func ListSnapshots(device string, q *SnapshotQuery) ([]SnapshotInfo, uint, error) {
+	if q == nil {
+		q = &SnapshotQuery{}
+	}
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer dc.Close()
+	si, next, err := dc.listSnapshots(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	return si, next, dc.Close()
+}
+
+func (dc *DeviceContext) listSnapshots(q *SnapshotQuery) ([]SnapshotInfo, uint, error) {
+	var chain []bool
+	if q.VolumeName != "" {
+		v := dc.FindVolume(q.VolumeName)
+		if v == nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrVolumeNotFound, q.VolumeName)
+		}
+		chain = make([]bool, MAX_SNAPSHOTS)
+		for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+			chain[sid-1] = true
+		}
+	}
+	// Count the matching labels of each snapshot in one pass, instead of collecting labels per snapshot.
+	var matches map[uint16]int
+	if len(q.Labels) > 0 {
+		matches = make(map[uint16]int)
+		for _, l := range dc.labels {
+			if value, ok := q.Labels[l.Key]; ok && !reservedLabel(l.Key) && l.Value == value {
+				matches[l.SnapshotId]++
+			}
+		}
+	}
+	owners := dc.snapshotOwners()
+	var si []SnapshotInfo
+	start := uint(1)
+	if q.StartId > start {
+		start = q.StartId
+	}
+	for i := int(start) - 1; i < MAX_SNAPSHOTS; i++ {
+		createdAt := dc.snapshots[i].CreatedAt
+		if createdAt == 0 ||
+			chain != nil && !chain[i] ||
+			matches != nil && matches[uint16(i+1)] != len(q.Labels) ||
+			!q.After.IsZero() && createdAt < q.After.Unix() ||
+			!q.Before.IsZero() && createdAt >= q.Before.Unix() {
+			continue
+		}
+		if q.Limit != 0 && uint(len(si)) == q.Limit {
+			return si, uint(i + 1), nil
+		}
+		si = append(si, dc.snapshotInfo(uint16(i+1), owners[i]))
+	}
+	return si, 0, nil
+}
+
+// Call fn with each snapshot matching a query, ordered by id, until it returns false. Snapshots are fetched in
+// pages, so the device is not locked while fn runs and it may call into the library, but a listing that spans
+// pages is not a consistent view of a device being modified. The signature follows range-over-func iterators.
+func EachSnapshot(device string, q *SnapshotQuery, fn func(SnapshotInfo) bool) error {
+	page := SnapshotQuery{}
+	if q != nil {
+		page = *q
+	}
+	remaining := page.Limit
+	for {
+		page.Limit = SNAPSHOT_PAGE_SIZE
+		if remaining != 0 && remaining < page.Limit {
+			page.Limit = remaining
+		}
+		si, next, err := ListSnapshots(device, &page)
+		if err != nil {
+			return err
+		}
+		for i := range si {
+			if !fn(si[i]) {
+				return nil
+			}
+		}
+		if remaining != 0 {
+			remaining -= uint(len(si))
+			if remaining == 0 {
+				return nil
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		page.StartId = next
+	}
+}
+
+// Return the snapshot in the chain of a volume created last at or before a time, to find the state of the volume
+// as of that time. Fails with ErrSnapshotNotFound if all snapshots in the chain are newer.
+func FindSnapshotAt(device string, volumeName string, t time.Time) (*SnapshotInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	// Creation times may be set by callers, so they are not assumed to increase along the chain
+	found := uint16(0)
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		createdAt := dc.snapshots[sid-1].CreatedAt
+		if createdAt <= t.Unix() && (found == 0 || createdAt > dc.snapshots[found-1].CreatedAt) {
+			found = sid
+		}
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("%w: no snapshot of %v at or before %v", ErrSnapshotNotFound, volumeName, t.Format(time.RFC3339))
+	}
+	si := dc.snapshotInfo(found, v)
+	return &si, dc.Close()
+}
@@ -0,0 +1,351 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kelindar/bitmap"
+)
+
+// Part of a volume set by a snapshot. Zeroed ranges read as zeroes, hiding data of previous snapshots.
+type VolumeRange struct {
+	Offset     uint64
+	Length     uint64
+	Zeroed     bool
+	ModifiedAt time.Time // Of the last write to the extents holding the range, zero if not kept (ignored by clones)
+}
+
+// Return true if a block is in the extent of the map, or inherited by it.
+func (em *ExtentMap) hasBlock(eidx uint32, bidx uint32) bool {
+	e := em.get(eidx)
+	if bitmap.FromBytes(e.BlockBitmap[:]).Contains(bidx) {
+		return true
+	}
+	if e.Flags&EXTENT_FLAG_PARTIAL == 0 {
+		return false
+	}
+	_, ok := em.inheritedBlock(eidx, bidx)
+	return ok
+}
+
+// Return the parts of the volume set by a snapshot itself, rather than inherited from previous snapshots, in
+// order. Blocks copied along with extents of previous snapshots on write are included, although they may
+// hold the same data as before. If the device keeps extent times, ranges are split where these differ.
+func GetSnapshotRanges(device string, snapshotId uint) ([]VolumeRange, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	sem, err := GetSnapshotExtentMap(dc, v.VolumeSize, uint16(snapshotId))
+	if err != nil {
+		return nil, err
+	}
+	// Blocks missing from extents that are not partial were unmapped, which hides blocks of previous snapshots
+	var pem *ExtentMap
+	if parentId := dc.snapshots[snapshotId-1].ParentSnapshotId; parentId != 0 {
+		if pem, err = GetVolumeExtentMap(dc, v.VolumeSize, parentId); err != nil {
+			return nil, err
+		}
+	}
+	var ranges []VolumeRange
+	add := func(offset uint64, zeroed bool, modifiedAt time.Time) {
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == offset &&
+			ranges[n-1].Zeroed == zeroed && ranges[n-1].ModifiedAt.Equal(modifiedAt) {
+			ranges[n-1].Length += BLOCK_SIZE
+			return
+		}
+		ranges = append(ranges, VolumeRange{Offset: offset, Length: BLOCK_SIZE, Zeroed: zeroed, ModifiedAt: modifiedAt})
+	}
+	times := extentTimeReader{dc: dc}
+	var cbErr error
+	sem.extentBitmap.Range(func(eidx uint32) {
+		if cbErr != nil {
+			return
+		}
+		e := sem.get(eidx)
+		modifiedAt, err := times.time(e.ExtentPos)
+		if err != nil {
+			cbErr = err
+			return
+		}
+		bb := bitmap.FromBytes(e.BlockBitmap[:])
+		for bidx := uint32(0); bidx <= BLOCK_MASK_IN_EXTENT; bidx++ {
+			offset := uint64(eidx)*EXTENT_SIZE + uint64(bidx)*BLOCK_SIZE
+			if bb.Contains(bidx) {
+				add(offset, false, modifiedAt)
+			} else if e.Flags&EXTENT_FLAG_PARTIAL == 0 && pem != nil && pem.hasBlock(eidx, bidx) {
+				add(offset, true, modifiedAt)
+			}
+		}
+	})
+	if cbErr != nil {
+		return nil, cbErr
+	}
+	dc.Close()
+	return ranges, nil
+}
+
+// Create a volume from parts of a snapshot, placed one after the other, and return its information. Offsets
+// and lengths must be multiples of BLOCK_SIZE, and the volume size is their total length rounded up to a
+// multiple of EXTENT_SIZE. Only blocks holding data are copied, so that, for example, a partition can be taken
+// out of a disk image without copying the rest. The volume is destroyed if copying fails.
+func CloneSnapshotRanges(device string, newVolumeName string, snapshotId uint, ranges []VolumeRange) (*VolumeInfo, error) {
+	src, err := OpenSnapshot(device, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	defer src.CloseVolume()
+	p, err := planCopy(src, ranges)
+	if err != nil {
+		return nil, err
+	}
+	vi, err := createClone(device, newVolumeName, uint16(snapshotId), p.volumeSize(), p.extents)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyRuns(device, newVolumeName, src, p, nil, nil); err != nil {
+		if derr := destroyVolume(device, newVolumeName); derr != nil {
+			return nil, fmt.Errorf("%w (cannot destroy volume %v: %v)", err, newVolumeName, derr)
+		}
+		return nil, err
+	}
+	return vi, src.CloseVolume()
+}
+
+// Limits of a clone made in the background.
+type CloneOptions struct {
+	MaxBandwidth uint64 // Bytes copied per second, unlimited if zero
+	MaxIops      uint   // Reads and writes per second, unlimited if zero
+}
+
+// Clone a snapshot, or parts of it as with CloneSnapshotRanges if ranges are given, copying the data in the
+// background within the given limits, so that the device is not saturated. The volume is created before
+// returning, but holds the data of the snapshot only once the returned JOB_CLONE job completes, and is destroyed
+// if the job fails or is cancelled. Options may be nil.
+func CloneSnapshotJob(device string, newVolumeName string, snapshotId uint, ranges []VolumeRange, opts *CloneOptions) (*VolumeInfo, *JobInfo, error) {
+	if opts == nil {
+		opts = &CloneOptions{}
+	}
+	src, err := OpenSnapshot(device, snapshotId)
+	if err != nil {
+		return nil, nil, err
+	}
+	partial := len(ranges) != 0
+	if !partial {
+		ranges = []VolumeRange{{Offset: 0, Length: src.VolumeSize()}}
+	}
+	p, err := planCopy(src, ranges)
+	if err != nil {
+		src.CloseVolume()
+		return nil, nil, err
+	}
+	vi, err := createClone(device, newVolumeName, uint16(snapshotId), p.volumeSize(), p.extents)
+	if err != nil {
+		src.CloseVolume()
+		return nil, nil, err
+	}
+	rec, err := volumeJobRecord(device, JOB_TYPE_CLONE, newVolumeName)
+	if err == nil {
+		rec.SnapshotId = uint16(snapshotId)
+		rec.Total = p.length
+		rec.MaxBandwidth = opts.MaxBandwidth
+		rec.MaxIops = uint32(opts.MaxIops)
+		if partial {
+			rec.Flags |= JOB_FLAG_RANGES
+		}
+	}
+	var ji *JobInfo
+	if err == nil {
+		ji, err = startJob(device, rec, newVolumeName, nil, func(j *job) error {
+			return cloneRuns(j, newVolumeName, src, p, opts)
+		})
+	}
+	if err != nil {
+		src.CloseVolume()
+		if derr := destroyVolume(device, newVolumeName); derr != nil {
+			return nil, nil, fmt.Errorf("%w (cannot destroy volume %v: %v)", err, newVolumeName, derr)
+		}
+		return nil, nil, err
+	}
+	return vi, ji, nil
+}
+
+// Copy the data of a clone in a job, destroying the volume if the copy fails or is cancelled.
+func cloneRuns(j *job, volumeName string, src *VolumeContext, p *copyPlan, opts *CloneOptions) error {
+	defer src.CloseVolume()
+	q := &volumeQoS{iops: newTokenBucket(uint64(opts.MaxIops)), bandwidth: newTokenBucket(opts.MaxBandwidth)}
+	if err := copyRuns(j.device, volumeName, src, p, j, q); err != nil {
+		if derr := destroyVolume(j.device, volumeName); derr != nil {
+			return fmt.Errorf("%w (cannot destroy volume %v: %v)", err, volumeName, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Continue an interrupted clone of a whole snapshot, skipping the data already copied.
+func resumeClone(j *job, volumeName string, snapshotId uint, done uint64, opts *CloneOptions) error {
+	src, err := OpenSnapshot(j.device, snapshotId)
+	if err != nil {
+		return err
+	}
+	p, err := planCopy(src, []VolumeRange{{Offset: 0, Length: src.VolumeSize()}})
+	if err != nil {
+		src.CloseVolume()
+		return err
+	}
+	p.skip(done)
+	return cloneRuns(j, volumeName, src, p, opts)
+}
+
+// Blocks of a snapshot to copy into a new volume.
+type copyPlan struct {
+	runs       []VolumeRange // Offset in the snapshot, length of data
+	dstOffsets []uint64      // Offset of each run in the new volume
+	extents    uint          // Extents of the new volume written to
+	size       uint64        // Total length of the ranges copied
+	length     uint64        // Total length of the runs
+}
+
+// Return the size of the new volume, a multiple of EXTENT_SIZE.
+func (p *copyPlan) volumeSize() uint64 {
+	return (p.size + EXTENT_SIZE - 1) / EXTENT_SIZE * EXTENT_SIZE
+}
+
+// Drop the leading runs holding the first n bytes of data, as copied before a job was interrupted.
+func (p *copyPlan) skip(n uint64) {
+	i := 0
+	for ; i < len(p.runs) && n >= p.runs[i].Length; i++ {
+		n -= p.runs[i].Length
+	}
+	p.runs = p.runs[i:]
+	p.dstOffsets = p.dstOffsets[i:]
+}
+
+// Find the blocks of ranges of a snapshot holding data, and the extents they need in the new volume.
+func planCopy(src *VolumeContext, ranges []VolumeRange) (*copyPlan, error) {
+	p := &copyPlan{}
+	dstExtents := &bitmap.Bitmap{}
+	for _, r := range ranges {
+		if r.Offset%BLOCK_SIZE != 0 || r.Length%BLOCK_SIZE != 0 || r.Length == 0 || r.Offset+r.Length > src.VolumeSize() {
+			return nil, fmt.Errorf("invalid range at %v of %v bytes, not block aligned or beyond the volume", r.Offset, r.Length)
+		}
+		for offset := uint64(0); offset < r.Length; offset += BLOCK_SIZE {
+			_, ok, err := src.DeviceOffset(r.Offset + offset)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			dstOffset := p.size + offset
+			dstExtents.Set(uint32(dstOffset / EXTENT_SIZE))
+			p.length += BLOCK_SIZE
+			// Runs stay within an extent of the new volume, so each is written in one go
+			if n := len(p.runs); n > 0 && p.runs[n-1].Offset+p.runs[n-1].Length == r.Offset+offset &&
+				p.dstOffsets[n-1]+p.runs[n-1].Length == dstOffset && dstOffset%EXTENT_SIZE != 0 {
+				p.runs[n-1].Length += BLOCK_SIZE
+				continue
+			}
+			p.runs = append(p.runs, VolumeRange{Offset: r.Offset + offset, Length: BLOCK_SIZE})
+			p.dstOffsets = append(p.dstOffsets, dstOffset)
+		}
+		p.size += r.Length
+	}
+	if p.size == 0 {
+		return nil, fmt.Errorf("no ranges to clone")
+	}
+	p.extents = uint(dstExtents.Count())
+	return p, nil
+}
+
+// Add a volume for a clone of a snapshot, if the given number of extents can be allocated for it.
+func createClone(device string, volumeName string, snapshotId uint16, volumeSize uint64, extents uint) (*VolumeInfo, error) {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	if err := dc.checkCloneSpace(extents); err != nil {
+		return nil, err
+	}
+	v, err := dc.AddVolume(volumeName, volumeSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	dc.notify(EVENT_VOLUME_CLONED, volumeName, snapshotId)
+	vi := dc.volumeInfo(v)
+	return &vi, dc.Close()
+}
+
+// Copy the runs of blocks of an open snapshot to a volume, as planned. In a job, progress is reported, copying
+// stops if cancelled, and I/O is throttled within the given limits.
+func copyRuns(device string, volumeName string, src *VolumeContext, p *copyPlan, j *job, q *volumeQoS) error {
+	dst, err := OpenVolume(device, volumeName)
+	if err != nil {
+		return err
+	}
+	data := AlignedBlock(EXTENT_SIZE)
+	for i, r := range p.runs {
+		if j != nil {
+			if j.cancelled() {
+				dst.CloseVolume()
+				return ErrJobCancelled
+			}
+			q.iops.take(2)
+			q.bandwidth.take(r.Length)
+		}
+		if err := src.ReadAt(data[:r.Length], r.Offset); err != nil {
+			dst.CloseVolume()
+			return err
+		}
+		if err := dst.WriteAt(data[:r.Length], p.dstOffsets[i], true); err != nil {
+			dst.CloseVolume()
+			return err
+		}
+		j.advance(r.Length)
+	}
+	return dst.CloseVolume()
+}
+
+// Destroy a volume without moving it to the trash, as when its creation failed.
+func destroyVolume(device string, volumeName string) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if err := dc.DestroyVolume(v); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
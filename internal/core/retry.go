@@ -0,0 +1,146 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrMediaError = errors.New("media error")
+
+// How block reads and writes failing with transient errors are retried, and when a volume is given up on.
+// Transient errors are I/O errors, and errors asking for the request to be repeated, like EAGAIN. I/O errors
+// left after the retries are media errors, which fail with ErrMediaError. They are counted per volume, in
+// VolumeInfo, and per extent of the device, in VolumeContext.ExtentErrors.
+type RetryPolicy struct {
+	Attempts  uint          // Retries after a failed attempt, zero to fail on the first error
+	Backoff   time.Duration // Wait before the first retry, doubled before each next one
+	MaxErrors uint          // Media errors after which a volume is made read-only, zero to never
+}
+
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// Media errors of a device context, by position of the extent on the device.
+type extentErrors struct {
+	mu     sync.Mutex
+	counts map[uint]uint64
+}
+
+func (ee *extentErrors) add(epos uint) {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+	if ee.counts == nil {
+		ee.counts = make(map[uint]uint64)
+	}
+	ee.counts[epos]++
+}
+
+func (ee *extentErrors) get() map[uint]uint64 {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+	counts := make(map[uint]uint64, len(ee.counts))
+	for epos, n := range ee.counts {
+		counts[epos] = n
+	}
+	return counts
+}
+
+// Run a read or write of the data of an extent, retrying transient errors as set in the retry policy. An I/O
+// error left is recorded against the extent and returned as a media error.
+func (dc *DeviceContext) retryIO(name string, epos uint, fn func() error) error {
+	err := fn()
+	backoff := dc.opts.Retry.Backoff
+	for i := uint(0); err != nil && i < dc.opts.Retry.Attempts && isTransient(err); i++ {
+		dc.telemetry.count(dc.telemetry.retries, name)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	if err != nil && errors.Is(err, syscall.EIO) {
+		dc.extentErrors.add(epos)
+		dc.telemetry.count(dc.telemetry.mediaErrors, name)
+		return fmt.Errorf("%w: %w", ErrMediaError, err)
+	}
+	return err
+}
+
+// Count a media error of a volume operation, and make the volume read-only once there are as many as allowed
+// by the retry policy. Called without the metadata lock held. Snapshots are not counted.
+func (vc *VolumeContext) countMediaError(err error) {
+	if err == nil || vc.stats == nil || !errors.Is(err, ErrMediaError) {
+		return
+	}
+	vc.stats.mediaError()
+	n := vc.mediaErrors.Add(1)
+	limit := uint64(vc.dc.opts.Retry.MaxErrors)
+	if limit == 0 || n < limit || !vc.failed.CompareAndSwap(false, true) {
+		return
+	}
+	vc.dc.opts.Logger.Error("volume made read-only after media errors", "volume", vc.volumeName, "errors", n)
+	vc.stats.fail()
+	if err := vc.syncStats(); err != nil {
+		vc.dc.opts.Logger.Warn("cannot write volume stats", "volume", vc.volumeName, "error", err)
+	}
+	notify(vc.dc.device, Event{
+		Type:       EVENT_VOLUME_FAILED,
+		VolumeName: vc.volumeName,
+		Detail:     fmt.Sprintf("read-only after %v media errors", n),
+	})
+}
+
+// Return an error if the volume cannot be written.
+func (vc *VolumeContext) checkWritable() error {
+	if vc.readOnly {
+		return ErrReadOnly
+	}
+	if vc.failed.Load() {
+		return fmt.Errorf("%w: made read-only after media errors", ErrReadOnly)
+	}
+	return nil
+}
+
+// Return the media errors met through this context, by position of the extent on the device.
+func (vc *VolumeContext) ExtentErrors() map[uint]uint64 {
+	return vc.dc.extentErrors.get()
+}
+
+// Clear the media errors of a volume, making it writable again if it was made read-only because of them.
+// Contexts of the volume already open stay read-only until reopened.
+func ResetVolumeErrors(device string, volumeName string) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	err = dc.updateVolumeStats(dc.volumeIndex(v), func(vs *VolumeStats) {
+		vs.MediaErrors = 0
+		vs.FailedAt = 0
+	})
+	if err != nil {
+		return err
+	}
+	return dc.Close()
+}
@@ -0,0 +1,61 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync/atomic"
+)
+
+// Read the extent metadata of all allocated device positions, handing each batch to fn with the position of its
+// first extent. Batches are read by several readers at once, so fn is called concurrently, for disjoint ranges
+// and in no particular order, and must not keep the slice. The scan stops at the first error, which is returned.
+func (dc *DeviceContext) scanExtents(fn func(offset uint, eb []ExtentMetadata) error) error {
+	allocated := min(dc.totalDeviceExtents, uint(dc.superblock.AllocatedDeviceExtents))
+	batches := (allocated + dc.extentBatch - 1) / dc.extentBatch
+	readers := min(dc.opts.scanReaders(), batches)
+	var next atomic.Uint64
+	var failed atomic.Bool
+	errs := make(chan error, readers)
+	for i := uint(0); i < readers; i++ {
+		go func() {
+			eb := make([]ExtentMetadata, dc.extentBatch)
+			for !failed.Load() {
+				b := uint(next.Add(1) - 1)
+				if b >= batches {
+					break
+				}
+				offset := b * dc.extentBatch
+				size := min(allocated-offset, dc.extentBatch)
+				err := dc.ReadExtents(eb[:size], offset)
+				if err == nil {
+					err = fn(offset, eb[:size])
+				}
+				if err != nil {
+					failed.Store(true)
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	var err error
+	for i := uint(0); i < readers; i++ {
+		if rerr := <-errs; rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
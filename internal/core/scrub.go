@@ -0,0 +1,227 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Progress and findings of scrubbing a device, the running or last pass in this process.
+type ScrubStatus struct {
+	Running         bool
+	StartedAt       time.Time // Of the running or last pass
+	CompletedAt     time.Time // Of the last pass, zero while running or if it failed
+	ExtentsScrubbed uint      // Allocated extents read so far
+	MediaErrors     uint      // Extents that could not be read
+	ChecksumErrors  uint      // Copies of the metadata area not matching their checksum
+}
+
+var (
+	scrubStatusesMu sync.Mutex
+	scrubStatuses   = make(map[string]*ScrubStatus)
+)
+
+// Return the status of scrubbing a device, nil if it was not scrubbed in this process.
+func scrubStatus(device string) *ScrubStatus {
+	scrubStatusesMu.Lock()
+	defer scrubStatusesMu.Unlock()
+	if s := scrubStatuses[device]; s != nil {
+		status := *s
+		return &status
+	}
+	return nil
+}
+
+// Update the status of the scrub of a device in progress.
+func updateScrubStatus(device string, fn func(s *ScrubStatus)) {
+	scrubStatusesMu.Lock()
+	defer scrubStatusesMu.Unlock()
+	fn(scrubStatuses[device])
+}
+
+// Read all allocated extents of a device, and check the checksums of the metadata area, to find media errors
+// before the data is needed. At most rate bytes are read per second, or as fast as possible if zero. Extents
+// are listed in batches under a shared lock, but read without it, so the device is not held up, and changes
+// made meanwhile may be missed until the next pass. Problems are sent to watchers as EVENT_SCRUB_ERROR,
+// and media errors are counted in the "dbs.io.media_errors" metric, as OP_SCRUB. EVENT_SCRUB_COMPLETED is sent
+// at the end of the pass, which returns the final status, also seen in DeviceInfo.
+func ScrubDevice(device string, rate uint64, opts ...Option) (*ScrubStatus, error) {
+	return scrubDevice(device, rate, opts, nil)
+}
+
+// Scrub a device, stopping between extents if the job is cancelled.
+func scrubDevice(device string, rate uint64, opts []Option, j *job) (*ScrubStatus, error) {
+	scrubStatusesMu.Lock()
+	if s := scrubStatuses[device]; s != nil && s.Running {
+		scrubStatusesMu.Unlock()
+		return nil, fmt.Errorf("device %v is already being scrubbed", device)
+	}
+	scrubStatuses[device] = &ScrubStatus{Running: true, StartedAt: time.Now()}
+	scrubStatusesMu.Unlock()
+
+	err := scrub(device, newTokenBucket(rate), opts, j)
+	updateScrubStatus(device, func(s *ScrubStatus) {
+		s.Running = false
+		if err == nil {
+			s.CompletedAt = time.Now()
+		}
+	})
+	status := scrubStatus(device)
+	if err != nil {
+		return status, err
+	}
+	notify(device, Event{
+		Type: EVENT_SCRUB_COMPLETED,
+		Detail: fmt.Sprintf("%v extents scrubbed, %v media errors, %v checksum errors",
+			status.ExtentsScrubbed, status.MediaErrors, status.ChecksumErrors),
+	})
+	return status, nil
+}
+
+func scrub(device string, bucket *tokenBucket, opts []Option, j *job) (err error) {
+	dc, err := NewDeviceContext(device, opts...)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	op := dc.startOp(context.Background(), OP_SCRUB)
+	defer func() { op.end(err) }()
+
+	// Metadata copies never written have no checksum
+	if err := dc.lockShared(); err != nil {
+		return err
+	}
+	abuf := AlignedBlock(int(dc.metadataSize))
+	for copy := uint8(0); copy < 2; copy++ {
+		if dc.superblock.MetadataChecksums[copy] == 0 {
+			continue
+		}
+		valid, err := dc.readMetadataCopy(abuf, copy)
+		if err != nil {
+			dc.f.Unlock()
+			return err
+		}
+		if !valid {
+			updateScrubStatus(device, func(s *ScrubStatus) { s.ChecksumErrors++ })
+			notify(device, Event{Type: EVENT_SCRUB_ERROR, Detail: fmt.Sprintf("checksum mismatch in metadata copy %v", copy)})
+		}
+	}
+	if err := dc.f.Unlock(); err != nil {
+		return err
+	}
+
+	size := dc.opts.copyBufferSize()
+	dbuf := AlignedBlock(int(size))
+	eb := make([]ExtentMetadata, dc.extentBatch)
+	for offset := uint(0); ; offset += dc.extentBatch {
+		if err := dc.lockShared(); err != nil {
+			return err
+		}
+		allocated := min(dc.totalDeviceExtents, uint(dc.superblock.AllocatedDeviceExtents))
+		j.setTotal(uint64(allocated) * EXTENT_SIZE)
+		if offset >= allocated {
+			return dc.f.Unlock()
+		}
+		batch := eb[:min(allocated-offset, dc.extentBatch)]
+		err := dc.ReadExtents(batch, offset)
+		dc.f.Unlock()
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			j.advance(EXTENT_SIZE)
+			if batch[i].SnapshotId == 0 {
+				continue
+			}
+			if j.cancelled() {
+				return ErrJobCancelled
+			}
+			epos := offset + uint(i)
+			if err := dc.scrubExtent(dbuf, epos, bucket); err != nil {
+				updateScrubStatus(device, func(s *ScrubStatus) { s.MediaErrors++ })
+				notify(device, Event{
+					Type:   EVENT_SCRUB_ERROR,
+					Detail: fmt.Sprintf("extent %v at device offset %v: %v", epos, dc.blockOffset(epos, 0), err),
+				})
+			}
+			updateScrubStatus(device, func(s *ScrubStatus) { s.ExtentsScrubbed++ })
+		}
+	}
+}
+
+// Take a shared lock and reload the superblock, which others may have changed.
+func (dc *DeviceContext) lockShared() error {
+	if err := dc.f.Lock(false); err != nil {
+		return err
+	}
+	if err := dc.ReadSuperblock(); err != nil {
+		dc.f.Unlock()
+		return err
+	}
+	if err := checkFeatures(dc.superblock, false); err != nil {
+		dc.f.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Read the data of an extent, in pieces the size of the buffer.
+func (dc *DeviceContext) scrubExtent(abuf []byte, epos uint, bucket *tokenBucket) error {
+	for offset := uint(0); offset < EXTENT_SIZE; offset += uint(len(abuf)) {
+		bucket.take(uint64(len(abuf)))
+		err := dc.retryIO(OP_SCRUB, epos, func() error {
+			_, err := dc.f.ReadAt(abuf, uint64(dc.dataOffset+(epos*EXTENT_SIZE)+offset))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		dc.telemetry.countBytes(dc.telemetry.scrubbed, uint64(len(abuf)))
+	}
+	return nil
+}
+
+// Scrub a device every interval, at most at the given rate, until the returned function is called, which waits
+// for a pass in progress to end. The first pass starts after an interval. Errors of whole passes, like failing to open the device, are sent to
+// watchers as EVENT_ERROR, and the next pass is tried as usual.
+func StartScrubber(device string, interval time.Duration, rate uint64, opts ...Option) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if _, err := ScrubDevice(device, rate, opts...); err != nil {
+				notify(device, Event{Type: EVENT_ERROR, Detail: fmt.Sprintf("scrub failed: %v", err)})
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Extents overwritten at once by a secure deletion, each batch under a short hold of the metadata lock.
+const SHRED_STEP_EXTENTS = 16
+
+// An extent of a snapshot, which keeps its volume extent index when moved on the device.
+type shredKey struct {
+	snapshotId uint16
+	eidx       uint32
+}
+
+// Delete a volume, overwriting the data of its extents, including those of its snapshots, with zeroes, or random
+// data if random is set, before releasing them, for data sanitization. The volume is moved to the trash right
+// away, where it cannot be restored, and destroyed once the returned JOB_SHRED job has overwritten its extents.
+// Until then, extents are also overwritten if the volume is purged, or when vacuuming moves them. Cancelling the
+// job leaves the volume in the trash.
+func DeleteVolumeSecure(device string, volumeName string, random bool) (*JobInfo, error) {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if err := dc.checkRetention(v); err != nil {
+		return nil, err
+	}
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		dc.markShred(sid, random)
+	}
+	v.DeletedAt = time.Now().Unix()
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	dc.markDestroyed(volumeName)
+	dc.notify(EVENT_VOLUME_DELETED, volumeName, 0)
+	rec := JobRecord{
+		Type:           JOB_TYPE_SHRED,
+		VolumeSlot:     uint16(dc.volumeIndex(v) + 1),
+		RootSnapshotId: dc.rootSnapshot(v.SnapshotId),
+	}
+	if err := dc.Close(); err != nil {
+		return nil, err
+	}
+	return startJob(device, rec, volumeName, nil, func(j *job) error {
+		return shred(device, rec, j)
+	})
+}
+
+// Delete a snapshot that is not current as with DeleteSnapshot, overwriting the data of the extents released
+// with zeroes, or random data if random is set. The snapshot is deleted once the returned JOB_SHRED job has
+// overwritten the extents replaced by the following snapshot. Blocks that partial extents of the following
+// snapshot still read from them, as written with block copy on write, are first merged into these. The snapshot
+// should not be read or cloned meanwhile. Cancelling the job leaves the snapshot in place, with part of its data
+// lost.
+func DeleteSnapshotSecure(device string, snapshotId uint, random bool) (*JobInfo, error) {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v := dc.FindVolumeWithSnapshot(uint16(snapshotId))
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, snapshotId)
+	}
+	if v.SnapshotId == uint16(snapshotId) {
+		return nil, fmt.Errorf("cannot delete current snapshot")
+	}
+	if err := dc.checkSnapshotRetention(uint16(snapshotId)); err != nil {
+		return nil, err
+	}
+	dc.markShred(uint16(snapshotId), random)
+	if err := dc.WriteMetadata(); err != nil {
+		return nil, err
+	}
+	volumeName := v.Name()
+	rec := JobRecord{
+		Type:           JOB_TYPE_SHRED,
+		VolumeSlot:     uint16(dc.volumeIndex(v) + 1),
+		RootSnapshotId: dc.rootSnapshot(v.SnapshotId),
+		SnapshotId:     uint16(snapshotId),
+	}
+	if err := dc.Close(); err != nil {
+		return nil, err
+	}
+	return startJob(device, rec, volumeName, nil, func(j *job) error {
+		return shred(device, rec, j)
+	})
+}
+
+func (dc *DeviceContext) markShred(snapshotId uint16, random bool) {
+	dc.snapshots[snapshotId-1].Flags |= SNAPSHOT_FLAG_SHRED
+	if random {
+		dc.snapshots[snapshotId-1].Flags |= SNAPSHOT_FLAG_SHRED_RANDOM
+	}
+}
+
+// Return true if a secure deletion of a volume is in progress.
+func (dc *DeviceContext) shredding(v *VolumeMetadata) bool {
+	return dc.snapshots[v.SnapshotId-1].Flags&SNAPSHOT_FLAG_SHRED != 0
+}
+
+// Overwrite the data of an extent of a snapshot with zeroes, or random data as set for the snapshot.
+func (dc *DeviceContext) shredExtent(pos uint32, snapshotId uint16) error {
+	abuf := AlignedBlock(EXTENT_SIZE)
+	if dc.snapshots[snapshotId-1].Flags&SNAPSHOT_FLAG_SHRED_RANDOM != 0 {
+		if _, err := rand.Read(abuf); err != nil {
+			return fmt.Errorf("failed to generate random data: %w", err)
+		}
+	}
+	if _, err := dc.f.WriteAt(abuf, uint64(dc.dataOffset)+uint64(pos)*EXTENT_SIZE); err != nil {
+		return fmt.Errorf("failed to overwrite extent: %w", err)
+	}
+	return nil
+}
+
+// Overwrite the data of an extent about to be released or left behind by a move, if its snapshot is being
+// securely deleted.
+func (dc *DeviceContext) maybeShredExtent(pos uint32, snapshotId uint16) error {
+	if snapshotId == 0 || dc.snapshots[snapshotId-1].Flags&SNAPSHOT_FLAG_SHRED == 0 {
+		return nil
+	}
+	return dc.shredExtent(pos, snapshotId)
+}
+
+// Return the volume of a secure deletion, which may be in the trash, or nil if it is gone.
+func (dc *DeviceContext) shredVolume(rec *JobRecord) *VolumeMetadata {
+	if rec.VolumeSlot == 0 || rec.VolumeSlot > MAX_VOLUMES {
+		return nil
+	}
+	v := &dc.volumes[rec.VolumeSlot-1]
+	if v.SnapshotId == 0 || dc.rootSnapshot(v.SnapshotId) != rec.RootSnapshotId {
+		return nil
+	}
+	return v
+}
+
+// Merge the blocks that partial extents of the child of a snapshot being securely deleted read from extents of
+// the snapshot into them, so that those extents are only read by the snapshot and can be overwritten. Extents
+// already overwritten are skipped. The maps of volumes open in this process are patched, while others rebuild
+// theirs as the generation changes.
+func (dc *DeviceContext) mergeShredExtents(v *VolumeMetadata, snapshotId uint16, child uint16, done map[shredKey]bool) error {
+	sem, err := GetSnapshotExtentMap(dc, v.VolumeSize, snapshotId)
+	if err != nil {
+		return err
+	}
+	cem, err := GetSnapshotExtentMap(dc, v.VolumeSize, child)
+	if err != nil {
+		return err
+	}
+	generation := dc.superblock.Generation
+	merged := false
+	var cbErr error
+	cem.extentBitmap.Range(func(x uint32) {
+		if cbErr != nil || cem.get(x).Flags&EXTENT_FLAG_PARTIAL == 0 || !sem.extentBitmap.Contains(x) || done[shredKey{snapshotId, x}] {
+			return
+		}
+		if cbErr = sem.mergeBlocksInto(cem, x); cbErr != nil {
+			return
+		}
+		dc.mergeOpenExtent(x, cem.get(x))
+		merged = true
+	})
+	if cbErr != nil || !merged {
+		return cbErr
+	}
+	dc.superblock.Generation++
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	dc.advanceOpenVolumes(generation)
+	return nil
+}
+
+// Overwrite the extents of a secure deletion a few at a time, then delete the volume or snapshot. Extents are
+// looked up again on each step, as the device may change in between.
+func shred(device string, rec JobRecord, j *job) error {
+	done := make(map[shredKey]bool)
+	for {
+		if j.cancelled() {
+			return ErrJobCancelled
+		}
+		finished, err := shredStep(device, &rec, done, j)
+		if err != nil || finished {
+			return err
+		}
+	}
+}
+
+// Overwrite up to SHRED_STEP_EXTENTS extents not done yet, and delete the volume or snapshot if none are left.
+// Returns true once deleted, or if it no longer exists.
+func shredStep(device string, rec *JobRecord, done map[shredKey]bool, j *job) (bool, error) {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return false, err
+	}
+	defer dc.Close()
+	v := dc.shredVolume(rec)
+	if v == nil {
+		return true, dc.Close()
+	}
+	// Extents released by deleting a snapshot are those replaced by its child, while the rest are merged into it
+	owners := make(map[uint16]bool)
+	var child uint16
+	if rec.SnapshotId != 0 {
+		if dc.snapshots[rec.SnapshotId-1].Flags&SNAPSHOT_FLAG_SHRED == 0 {
+			return true, dc.Close()
+		}
+		owners[rec.SnapshotId] = true
+		child = dc.FindChildSnapshot(rec.SnapshotId)
+	} else {
+		for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+			owners[sid] = true
+		}
+	}
+	extents, err := dc.ReadAllExtents()
+	if err != nil {
+		return false, err
+	}
+	replaced := make(map[uint32]bool)
+	partial := false
+	for _, e := range extents {
+		if child != 0 && e.SnapshotId == child {
+			replaced[e.ExtentPos] = true
+			partial = partial || e.Flags&EXTENT_FLAG_PARTIAL != 0
+		}
+	}
+	if partial {
+		if err := dc.mergeShredExtents(v, rec.SnapshotId, child, done); err != nil {
+			return false, err
+		}
+	}
+	var pending []uint32
+	for pos, e := range extents {
+		if !owners[e.SnapshotId] || (child != 0 && !replaced[e.ExtentPos]) {
+			continue
+		}
+		if !done[shredKey{e.SnapshotId, e.ExtentPos}] {
+			pending = append(pending, uint32(pos))
+		}
+	}
+	j.setTotal(uint64(len(done)+len(pending)) * EXTENT_SIZE)
+	for _, pos := range pending[:min(len(pending), SHRED_STEP_EXTENTS)] {
+		e := extents[pos]
+		if err := dc.shredExtent(pos, e.SnapshotId); err != nil {
+			return false, err
+		}
+		done[shredKey{e.SnapshotId, e.ExtentPos}] = true
+		j.advance(EXTENT_SIZE)
+	}
+	if len(pending) > SHRED_STEP_EXTENTS {
+		return false, dc.Close()
+	}
+
+	// All extents are overwritten, so they are released as usual once that is durable
+	if dc.inMaintenance() {
+		return false, ErrMaintenance
+	}
+	if err := dc.f.Sync(); err != nil {
+		return false, fmt.Errorf("failed to sync overwritten extents: %w", err)
+	}
+	for sid := range owners {
+		dc.snapshots[sid-1].Flags &^= SNAPSHOT_FLAG_SHRED | SNAPSHOT_FLAG_SHRED_RANDOM
+	}
+	volumeName := v.Name()
+	if rec.SnapshotId == 0 {
+		if err := dc.DestroyVolume(v); err != nil {
+			return false, err
+		}
+	} else if child == 0 {
+		return false, fmt.Errorf("cannot delete top-level snapshot")
+	} else if _, err := dc.deleteSnapshot(v, rec.SnapshotId); err != nil {
+		return false, err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return false, err
+	}
+	if rec.SnapshotId == 0 {
+		dc.notify(EVENT_VOLUME_PURGED, volumeName, 0)
+	} else {
+		dc.notify(EVENT_SNAPSHOT_DELETED, volumeName, rec.SnapshotId)
+	}
+	return true, dc.Close()
+}
@@ -0,0 +1,74 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned when closing would lose writes not yet on the device, or leave jobs of this process running.
+var ErrShutdownPending = errors.New("writes or jobs pending")
+
+// Check that a process can exit without losing work on a device, waiting up to timeout for the jobs it runs on
+// the device to finish. Volumes still open in the process may hold writes in memory, so they must be closed
+// first. Returns ErrShutdownPending, listing what remains, if volumes are open or jobs are running. Jobs left
+// running when the process exits are taken as interrupted, and can be resumed later.
+func QuiesceDevice(device string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	var running []string
+	jobsMu.Lock()
+	local := make([]*job, 0, len(jobs[device]))
+	for _, j := range jobs[device] {
+		local = append(local, j)
+	}
+	jobsMu.Unlock()
+	sort.Slice(local, func(a, b int) bool { return local[a].info.JobId < local[b].info.JobId })
+	for _, j := range local {
+		select {
+		case <-j.done:
+			continue
+		default:
+		}
+		select {
+		case <-j.done:
+		case <-deadline:
+			running = append(running, fmt.Sprint(j.info.JobId))
+		}
+	}
+
+	openVolumesMu.Lock()
+	var open []string
+	for _, vc := range openVolumes[device] {
+		open = append(open, vc.volumeName)
+	}
+	openVolumesMu.Unlock()
+	sort.Strings(open)
+
+	var pending []string
+	if len(open) > 0 {
+		pending = append(pending, "volumes open: "+strings.Join(open, ", "))
+	}
+	if len(running) > 0 {
+		pending = append(pending, "jobs running: "+strings.Join(running, ", "))
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %v", ErrShutdownPending, strings.Join(pending, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+// Time after which the counters of an open volume are written to the stats region on its next write. They
+// are also written by VolumeContext.Sync and when the volume is closed.
+const STATS_FLUSH_INTERVAL = time.Minute
+
+type VolumeStats = format.VolumeStats
+
+// Return the slot of a volume in the volume table.
+func (dc *DeviceContext) volumeIndex(v *VolumeMetadata) uint {
+	for i := range dc.volumes {
+		if &dc.volumes[i] == v {
+			return uint(i)
+		}
+	}
+	panic("volume metadata not in the volume table")
+}
+
+// Read the stats of all volume slots.
+func (dc *DeviceContext) ReadAllVolumeStats() ([]VolumeStats, error) {
+	size := uint64(SIZEOF_VOLUME_STATS * MAX_VOLUMES)
+	abuf := AlignedBlock(int((size + BLOCK_SIZE - 1) / BLOCK_SIZE * BLOCK_SIZE))
+	if _, err := dc.f.ReadAt(abuf, uint64(dc.statsOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read volume stats: %w", err)
+	}
+	vs := make([]VolumeStats, MAX_VOLUMES)
+	if err := format.Unmarshal(abuf, vs); err != nil {
+		return nil, fmt.Errorf("failed to deserialize volume stats: %w", err)
+	}
+	return vs, nil
+}
+
+// Read the blocks holding the stats of a volume slot. Returns the blocks, the offset of the stats in them and
+// the offset of the blocks on the device.
+func (dc *DeviceContext) readVolumeStats(vidx uint) (*VolumeStats, []byte, uint64, uint64, error) {
+	offset := uint64(dc.statsOffset + vidx*SIZEOF_VOLUME_STATS)
+	start := (offset / BLOCK_SIZE) * BLOCK_SIZE
+	end := (offset + SIZEOF_VOLUME_STATS + BLOCK_SIZE - 1) / BLOCK_SIZE * BLOCK_SIZE
+	abuf := AlignedBlock(int(end - start))
+	if _, err := dc.f.ReadAt(abuf, start); err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("failed to read volume stats: %w", err)
+	}
+	var vs VolumeStats
+	if err := format.Unmarshal(abuf[offset-start:], &vs); err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("failed to deserialize volume stats: %w", err)
+	}
+	return &vs, abuf, offset - start, start, nil
+}
+
+// Read-modify-write the stats of a volume slot. Must be called with the metadata lock held.
+func (dc *DeviceContext) updateVolumeStats(vidx uint, fn func(vs *VolumeStats)) error {
+	vs, abuf, offset, start, err := dc.readVolumeStats(vidx)
+	if err != nil {
+		return err
+	}
+	fn(vs)
+	buf, err := format.Marshal(vs)
+	if err != nil {
+		return fmt.Errorf("failed to serialize volume stats: %w", err)
+	}
+	copy(abuf[offset:], buf)
+	if _, err := dc.f.WriteAt(abuf, start); err != nil {
+		return fmt.Errorf("failed to write volume stats: %w", err)
+	}
+	return dc.flushMetadata()
+}
+
+// Reset the stats of a volume slot, for a new volume.
+func (dc *DeviceContext) resetVolumeStats(vidx uint) error {
+	return dc.updateVolumeStats(vidx, func(vs *VolumeStats) {
+		*vs = VolumeStats{}
+	})
+}
+
+func (vi *VolumeInfo) setStats(vs *VolumeStats) {
+	vi.BytesWritten = vs.BytesWritten
+	vi.BytesRead = vs.BytesRead
+	vi.CopiedExtents = vs.CopiedExtents
+	if vs.LastWriteTime != 0 {
+		vi.LastWriteTime = time.Unix(vs.LastWriteTime, 0)
+	}
+	if vs.LastReadTime != 0 {
+		vi.LastReadTime = time.Unix(vs.LastReadTime, 0)
+	}
+	vi.MediaErrors = vs.MediaErrors
+	if vs.FailedAt != 0 {
+		vi.FailedAt = time.Unix(vs.FailedAt, 0)
+	}
+}
+
+// Counters of an open volume not yet written to the stats region. Reads may run in parallel, so updates are
+// locked. Nil for snapshots, which are not counted.
+type volumeStats struct {
+	mu        sync.Mutex
+	pending   VolumeStats
+	modified  map[uint32]int64 // Times of the last writes to volume extents, by extent index
+	flushedAt time.Time
+	flushing  sync.Mutex // Serializes flushes outside writes
+}
+
+func newVolumeStats() *volumeStats {
+	return &volumeStats{flushedAt: time.Now()}
+}
+
+func (s *volumeStats) read(n uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.BytesRead += n
+	s.pending.LastReadTime = time.Now().Unix()
+}
+
+func (s *volumeStats) write(n uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.BytesWritten += n
+	s.pending.LastWriteTime = time.Now().Unix()
+}
+
+// Note that a volume extent was written, for the extent time table.
+func (s *volumeStats) modify(eidx uint32) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.modified == nil {
+		s.modified = make(map[uint32]int64)
+	}
+	s.modified[eidx] = time.Now().Unix()
+}
+
+func (s *volumeStats) copied() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.CopiedExtents++
+}
+
+func (s *volumeStats) mediaError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.MediaErrors++
+}
+
+// Note that the volume was made read-only.
+func (s *volumeStats) fail() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.FailedAt = time.Now().Unix()
+}
+
+// Return true if there are counters or extent times to write, and either force is set or they are older than
+// STATS_FLUSH_INTERVAL.
+func (s *volumeStats) due(force bool) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return (s.pending != VolumeStats{} || len(s.modified) > 0) &&
+		(force || time.Since(s.flushedAt) >= STATS_FLUSH_INTERVAL)
+}
+
+// Remove and return the pending counters and extent times.
+func (s *volumeStats) take() (VolumeStats, map[uint32]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, m := s.pending, s.modified
+	s.pending = VolumeStats{}
+	s.modified = nil
+	s.flushedAt = time.Now()
+	return p, m
+}
+
+// Add counters and extent times back, when they could not be written.
+func (s *volumeStats) restore(p VolumeStats, m map[uint32]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addStats(&s.pending, &p)
+	for eidx, t := range m {
+		if s.modified == nil {
+			s.modified = make(map[uint32]int64)
+		}
+		s.modified[eidx] = max(s.modified[eidx], t)
+	}
+}
+
+func addStats(vs *VolumeStats, p *VolumeStats) {
+	vs.BytesWritten += p.BytesWritten
+	vs.BytesRead += p.BytesRead
+	vs.CopiedExtents += p.CopiedExtents
+	vs.LastWriteTime = max(vs.LastWriteTime, p.LastWriteTime)
+	vs.LastReadTime = max(vs.LastReadTime, p.LastReadTime)
+	vs.MediaErrors += p.MediaErrors
+	vs.FailedAt = max(vs.FailedAt, p.FailedAt)
+}
+
+// Note that open contexts of a volume refer to one that no longer exists, even if another is created with the
+// same name.
+func (dc *DeviceContext) markDestroyed(volumeName string) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	for _, vc := range openVolumes[dc.device] {
+		if vc.volumeName == volumeName {
+			vc.destroyed.Store(true)
+		}
+	}
+}
+
+// Add the counters not yet written by contexts of a volume open in this process, so that a process serving
+// volumes reports up to date stats.
+func (dc *DeviceContext) addPendingStats(vs *VolumeStats, volumeName string) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	for _, vc := range openVolumes[dc.device] {
+		if vc.stats == nil || vc.volumeName != volumeName || vc.destroyed.Load() {
+			continue
+		}
+		vc.stats.mu.Lock()
+		addStats(vs, &vc.stats.pending)
+		vc.stats.mu.Unlock()
+	}
+}
+
+// Write pending counters to the stats region. Must be called with the metadata lock held. Counters are kept
+// if the volume table changed since the extent map was built, as the slot may hold another volume by now.
+func (vc *VolumeContext) flushStats() error {
+	if vc.dc.superblock.Generation != vc.generation {
+		return nil
+	}
+	p, m := vc.stats.take()
+	err := vc.writeExtentTimes(m)
+	if err == nil {
+		err = vc.dc.updateVolumeStats(vc.dc.volumeIndex(vc.volume), func(vs *VolumeStats) {
+			vs.BytesWritten += p.BytesWritten
+			vs.BytesRead += p.BytesRead
+			vs.CopiedExtents += p.CopiedExtents
+			vs.LastWriteTime = max(vs.LastWriteTime, p.LastWriteTime)
+			vs.LastReadTime = max(vs.LastReadTime, p.LastReadTime)
+			vs.MediaErrors += p.MediaErrors
+			vs.FailedAt = max(vs.FailedAt, p.FailedAt)
+		})
+	}
+	if err != nil {
+		vc.stats.restore(p, m)
+	}
+	return err
+}
+
+// Write the times of the last writes to volume extents to the extent time table. Extents since released are
+// skipped, as their positions may have been reused.
+func (vc *VolumeContext) writeExtentTimes(m map[uint32]int64) error {
+	times := make(map[uint32]int64, len(m))
+	for eidx, t := range m {
+		if uint(eidx) >= vc.vem.totalVolumeExtents {
+			continue
+		}
+		if e := vc.vem.get(eidx); e.SnapshotId != 0 {
+			times[e.ExtentPos] = t
+		}
+	}
+	return vc.dc.writeExtentTimes(times)
+}
+
+// Write pending counters outside a write. The extent map is not reloaded, so reads may run meanwhile.
+func (vc *VolumeContext) syncStats() error {
+	if !vc.stats.due(true) {
+		return nil
+	}
+	if err := vc.waitMap(); err != nil {
+		return err
+	}
+	vc.stats.flushing.Lock()
+	defer vc.stats.flushing.Unlock()
+	if err := vc.dc.LockMetadata(); err != nil {
+		return err
+	}
+	defer vc.dc.UnlockMetadata()
+	return vc.flushStats()
+}
@@ -0,0 +1,87 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	SYNC_POLICY_STRICT  = 0 // Flush after every metadata update
+	SYNC_POLICY_RELAXED = 1 // Flush metadata updates at most every SYNC_INTERVAL, and on sync and close
+	SYNC_POLICY_UNSAFE  = 2 // Only flush on sync and close, without ordering metadata updates
+
+	SYNC_INTERVAL = time.Second
+)
+
+var syncPolicyNames = []string{"strict", "relaxed", "unsafe"}
+
+// Return the name of a sync policy.
+func SyncPolicyName(policy uint) string {
+	if policy >= uint(len(syncPolicyNames)) {
+		return "unknown"
+	}
+	return syncPolicyNames[policy]
+}
+
+// Return the sync policy with the given name.
+func ParseSyncPolicy(name string) (uint, error) {
+	for i, n := range syncPolicyNames {
+		if n == name {
+			return uint(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %v", name)
+}
+
+// Make a metadata update durable, according to the sync policy. Updates not flushed are flushed by a later
+// update, or by flush.
+func (dc *DeviceContext) flushMetadata() error {
+	switch dc.opts.SyncPolicy {
+	case SYNC_POLICY_RELAXED:
+		if time.Since(dc.flushedAt) < SYNC_INTERVAL {
+			dc.unflushed = true
+			return nil
+		}
+	case SYNC_POLICY_UNSAFE:
+		dc.unflushed = true
+		return nil
+	}
+	return dc.flush()
+}
+
+// Make all writes durable, regardless of the sync policy.
+func (dc *DeviceContext) flush() error {
+	if err := dc.f.Flush(); err != nil {
+		return err
+	}
+	dc.unflushed = false
+	dc.flushedAt = time.Now()
+	return nil
+}
+
+// Order the copy of the metadata area written before the superblock pointing to it. Skipped by the unsafe
+// policy, at the risk of a torn update going unnoticed.
+func (dc *DeviceContext) barrier() error {
+	if dc.opts.SyncPolicy == SYNC_POLICY_UNSAFE {
+		dc.unflushed = true
+		return nil
+	}
+	if err := dc.f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync device: %w", err)
+	}
+	return nil
+}
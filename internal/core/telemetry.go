@@ -0,0 +1,157 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation scope of spans and metrics.
+const TELEMETRY_SCOPE = "github.com/Kampadais/dbs"
+
+// Operations timed in the "dbs.operation.duration" histogram, by the "dbs.operation" attribute. Volume
+// operations called with a context holding a span, through the ...Context methods of VolumeContext, are traced
+// as child spans, as are the extent copies and metadata and superblock writes of writes and unmaps. Block
+// reads, which are many, are only timed. Retries and media errors of block reads and writes and of extent
+// copies are counted in "dbs.io.retries" and "dbs.io.media_errors", by the same attribute. Scrubbing is timed
+// per pass, and the bytes it reads are counted in "dbs.scrub.bytes".
+const (
+	OP_READ             = "read"
+	OP_WRITE            = "write"
+	OP_UNMAP            = "unmap"
+	OP_BLOCK_READ       = "block_read"
+	OP_BLOCK_WRITE      = "block_write"
+	OP_EXTENT_COPY      = "extent_copy"
+	OP_METADATA_WRITE   = "metadata_write"
+	OP_SUPERBLOCK_WRITE = "superblock_write"
+	OP_SCRUB            = "scrub"
+)
+
+type telemetry struct {
+	tracer      trace.Tracer
+	duration    metric.Float64Histogram
+	retries     metric.Int64Counter
+	mediaErrors metric.Int64Counter
+	scrubbed    metric.Int64Counter
+}
+
+// Return the instruments of the providers in the options, or the global providers, which do nothing unless
+// the application sets them.
+func newTelemetry(o *Options) *telemetry {
+	tp, mp := o.TracerProvider, o.MeterProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	t := &telemetry{tracer: tp.Tracer(TELEMETRY_SCOPE)}
+	meter := mp.Meter(TELEMETRY_SCOPE)
+	var err error
+	t.duration, err = meter.Float64Histogram("dbs.operation.duration",
+		metric.WithDescription("Duration of volume and device operations"),
+		metric.WithUnit("s"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	t.retries, err = meter.Int64Counter("dbs.io.retries",
+		metric.WithDescription("Retries of device reads and writes after transient errors"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	t.mediaErrors, err = meter.Int64Counter("dbs.io.media_errors",
+		metric.WithDescription("Device reads and writes failed with I/O errors after retries"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	t.scrubbed, err = meter.Int64Counter("dbs.scrub.bytes",
+		metric.WithDescription("Device data read by scrubbing"),
+		metric.WithUnit("By"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return t
+}
+
+// Add a number of bytes to a counter.
+func (t *telemetry) countBytes(counter metric.Int64Counter, n uint64) {
+	if counter != nil {
+		counter.Add(context.Background(), int64(n))
+	}
+}
+
+// Add one to a counter of an operation.
+func (t *telemetry) count(counter metric.Int64Counter, name string) {
+	if counter != nil {
+		counter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("dbs.operation", name)))
+	}
+}
+
+// Operation being timed.
+type operation struct {
+	t     *telemetry
+	name  string
+	start time.Time
+	span  trace.Span // Nil if not traced
+}
+
+// Start timing an operation, traced as a child of the span in the context, if any.
+func (t *telemetry) start(ctx context.Context, name string) (context.Context, operation) {
+	op := operation{t: t, name: name, start: time.Now()}
+	if trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		ctx, op.span = t.tracer.Start(ctx, "dbs."+name)
+	}
+	return ctx, op
+}
+
+func (op operation) end(err error) {
+	if op.t.duration != nil {
+		op.t.duration.Record(context.Background(), time.Since(op.start).Seconds(),
+			metric.WithAttributes(attribute.String("dbs.operation", op.name)))
+	}
+	if op.span != nil {
+		if err != nil {
+			op.span.RecordError(err)
+			op.span.SetStatus(codes.Error, err.Error())
+		}
+		op.span.End()
+	}
+}
+
+// Start timing a device operation, traced as part of the span in the context, if any.
+func (dc *DeviceContext) startOp(ctx context.Context, name string) operation {
+	_, op := dc.telemetry.start(ctx, name)
+	return op
+}
+
+// Start timing an operation on a range of the volume.
+func (vc *VolumeContext) startOp(ctx context.Context, name string, offset uint64, length uint64) (context.Context, operation) {
+	ctx, op := vc.dc.telemetry.start(ctx, name)
+	if op.span != nil {
+		op.span.SetAttributes(
+			attribute.String("dbs.volume", vc.volume.Name()),
+			attribute.Int64("dbs.offset", int64(offset)),
+			attribute.Int64("dbs.length", int64(length)),
+		)
+	}
+	return ctx, op
+}
@@ -0,0 +1,210 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/Kampadais/dbs/pkg/format"
+)
+
+const (
+	TIER_ANY  = format.TIER_ANY
+	TIER_FAST = format.TIER_FAST
+	TIER_SLOW = format.TIER_SLOW
+)
+
+var tierNames = []string{"any", "fast", "slow"}
+
+// Return the name of a tier.
+func TierName(tier uint) string {
+	if tier >= uint(len(tierNames)) {
+		return "unknown"
+	}
+	return tierNames[tier]
+}
+
+// Return the tier with the given name.
+func ParseTier(name string) (uint, error) {
+	for i, n := range tierNames {
+		if n == name {
+			return uint(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tier %v", name)
+}
+
+// Set the size of the fast region of a device, at the start of its data area, as with the outer tracks of a
+// disk or the first device of a concatenation. Extents of volumes in the fast tier are allocated there if
+// possible, and those of volumes in the slow tier elsewhere. A zero size disables tiering.
+func SetDeviceFastRegion(device string, size uint64) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	extents := size / EXTENT_SIZE
+	if extents > uint64(dc.totalDeviceExtents) {
+		return fmt.Errorf("fast region of %v bytes is larger than the data area", size)
+	}
+	dc.superblock.FastExtents = uint32(extents)
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Set the tier of a volume. Extents already allocated are moved to the region of the tier by RebalanceTiers.
+func SetVolumeTier(device string, volumeName string, tier uint) error {
+	if tier >= uint(len(tierNames)) {
+		return fmt.Errorf("unknown tier %v", tier)
+	}
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	v.Tier = uint8(tier)
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// Return true if a device position is in the region of a tier.
+func (dc *DeviceContext) inTier(pos uint32, tier uint8) bool {
+	switch tier {
+	case TIER_FAST:
+		return pos < dc.superblock.FastExtents
+	case TIER_SLOW:
+		return pos >= dc.superblock.FastExtents
+	}
+	return true
+}
+
+// Find a free extent in the region of a tier. Returns false if the device is not tiered, or the region is full.
+func (dc *DeviceContext) tierExtent(tier uint8) (uint32, bool, error) {
+	if dc.superblock.FastExtents == 0 || tier == TIER_ANY {
+		return 0, false, nil
+	}
+	if err := dc.loadFreeExtents(); err != nil {
+		return 0, false, err
+	}
+	start := uint32(0)
+	if tier == TIER_SLOW {
+		start = dc.superblock.FastExtents
+	}
+	if pos, ok := dc.findFreeExtent(start); ok && dc.inTier(pos, tier) {
+		return pos, true, nil
+	}
+	return 0, false, nil
+}
+
+// Return the tier of each snapshot, as the fastest tier of the volumes whose chain includes it.
+func (dc *DeviceContext) snapshotTiers() map[uint16]uint8 {
+	tiers := make(map[uint16]uint8)
+	for i := range dc.volumes {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || v.Tier == TIER_ANY {
+			continue
+		}
+		for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+			if t, ok := tiers[sid]; !ok || v.Tier < t {
+				tiers[sid] = v.Tier
+			}
+		}
+	}
+	return tiers
+}
+
+// Move extents into the region of the tier of the volumes using them. Extents are moved a few at a time, as when
+// vacuuming, so volumes can stay open. Extents are only moved to free positions, so volumes in the fast tier may
+// be left partly outside a full fast region. Returns the number of extents moved.
+func RebalanceTiers(device string) (uint, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+	if err := dc.UnlockMetadata(); err != nil {
+		return 0, err
+	}
+	total := uint(0)
+	for {
+		moved, err := dc.rebalanceStep()
+		total += moved
+		if err != nil {
+			return total, err
+		}
+		if moved == 0 {
+			return total, dc.Close()
+		}
+	}
+}
+
+// Move up to VACUUM_STEP_EXTENTS extents into the region of their tier under the metadata lock. Extents of slow
+// volumes are moved first, to make room for those of fast volumes.
+func (dc *DeviceContext) rebalanceStep() (uint, error) {
+	if err := dc.LockMetadata(); err != nil {
+		return 0, err
+	}
+	defer dc.UnlockMetadata()
+	if dc.superblock.FastExtents == 0 {
+		return 0, nil
+	}
+	// Tiers may have been changed since the last step
+	if err := dc.ReadMetadata(); err != nil {
+		return 0, err
+	}
+	if err := dc.loadExtentIndex(); err != nil {
+		return 0, err
+	}
+	generation := dc.superblock.Generation
+	tiers := dc.snapshotTiers()
+	allocated := uint32(min(dc.totalDeviceExtents, uint(dc.superblock.AllocatedDeviceExtents)))
+	moved := uint(0)
+	for _, tier := range []uint8{TIER_SLOW, TIER_FAST} {
+		for pos := uint32(0); pos < allocated && moved < VACUUM_STEP_EXTENTS; pos++ {
+			sid := dc.index.owners[pos]
+			if sid == 0 || tiers[sid] != tier || dc.inTier(pos, tier) {
+				continue
+			}
+			target, ok, err := dc.tierExtent(tier)
+			if err != nil {
+				return moved, err
+			}
+			if !ok {
+				break
+			}
+			if err := dc.relocateExtent(uint(pos), uint(target)); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		return 0, nil
+	}
+	dc.superblock.Generation++
+	if err := dc.WriteSuperblock(); err != nil {
+		return moved, err
+	}
+	dc.advanceOpenVolumes(generation)
+	return moved, nil
+}
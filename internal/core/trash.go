@@ -0,0 +1,171 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// Release all extents and snapshots of a volume and clear its metadata. Metadata is not written to the device.
+func (dc *DeviceContext) DestroyVolume(v *VolumeMetadata) error {
+	if err := dc.checkRetention(v); err != nil {
+		return err
+	}
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		sem, err := GetSnapshotExtentMap(dc, v.VolumeSize, sid)
+		if err != nil {
+			return err
+		}
+		if err := sem.ClearAll(); err != nil {
+			return err
+		}
+		dc.snapshots[sid-1].CreatedAt = 0
+		dc.snapshots[sid-1].Flags = 0
+		dc.removeSnapshotLabels(sid)
+	}
+	dc.markDestroyed(v.Name())
+	if dc.retainUntil(v) != 0 {
+		dc.setRetainUntil(v, 0)
+	}
+	*v = VolumeMetadata{}
+	return nil
+}
+
+// Destroy all volumes in the trash deleted before the given time, except those a secure deletion is working on.
+// Returns the names of the volumes destroyed.
+func (dc *DeviceContext) reapDeletedVolumes(before time.Time) ([]string, error) {
+	var names []string
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || v.DeletedAt == 0 || v.DeletedAt > before.Unix() || dc.shredding(v) {
+			continue
+		}
+		name := v.Name()
+		if err := dc.DestroyVolume(v); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Set how long deleted volumes are kept in the trash before being destroyed. Zero disables the trash.
+func SetTrashRetention(device string, retention time.Duration) error {
+	if retention < 0 || retention.Seconds() > 1<<32-1 {
+		return fmt.Errorf("invalid trash retention %v", retention)
+	}
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	dc.superblock.TrashRetention = uint32(retention.Seconds())
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
+
+// List the volumes in the trash.
+func ListDeletedVolumes(device string) ([]VolumeInfo, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	stats, err := dc.ReadAllVolumeStats()
+	if err != nil {
+		return nil, err
+	}
+	var vi []VolumeInfo
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || v.DeletedAt == 0 {
+			continue
+		}
+		vi = append(vi, dc.volumeInfo(v))
+		vi[len(vi)-1].setStats(&stats[i])
+	}
+	dc.Close()
+	return vi, nil
+}
+
+// Restore the most recently deleted volume with the given name from the trash.
+func UndeleteVolume(device string, volumeName string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindDeletedVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("deleted %w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if dc.FindVolume(volumeName) != nil {
+		return fmt.Errorf("%w: %v", ErrVolumeExists, volumeName)
+	}
+	if dc.shredding(v) {
+		return fmt.Errorf("cannot restore volume %v: being securely deleted", volumeName)
+	}
+	v.DeletedAt = 0
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	dc.notify(EVENT_VOLUME_UNDELETED, volumeName, 0)
+	return dc.Close()
+}
+
+// Destroy the most recently deleted volume with the given name, without waiting for the retention period to pass.
+func PurgeDeletedVolume(device string, volumeName string) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindDeletedVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("deleted %w: %v", ErrVolumeNotFound, volumeName)
+	}
+	if err := dc.DestroyVolume(v); err != nil {
+		return err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	dc.notify(EVENT_VOLUME_PURGED, volumeName, 0)
+	return dc.Close()
+}
+
+// Destroy all volumes in the trash whose retention period has passed. Returns the number of volumes destroyed.
+func ReapDeletedVolumes(device string) (uint, error) {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+	retention := time.Duration(dc.superblock.TrashRetention) * time.Second
+	names, err := dc.reapDeletedVolumes(time.Now().Add(-retention))
+	if err != nil {
+		return uint(len(names)), err
+	}
+	if err := dc.WriteMetadata(); err != nil {
+		return uint(len(names)), err
+	}
+	for _, name := range names {
+		dc.notify(EVENT_VOLUME_PURGED, name, 0)
+	}
+	return uint(len(names)), dc.Close()
+}
@@ -0,0 +1,83 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	MAX_EXTENT_BATCH = 1048576 // Largest automatic extent batch, about 40 MB of metadata
+	SCAN_READERS     = 4       // Concurrent readers of extent metadata when scanning, unless set
+
+	// Environment variables setting tunables not given as options, for programs that do not expose them
+	ENV_EXTENT_BATCH     = "DBS_EXTENT_BATCH"
+	ENV_SCAN_READERS     = "DBS_SCAN_READERS"
+	ENV_COPY_BUFFER_SIZE = "DBS_COPY_BUFFER_SIZE"
+)
+
+// Fill in tunables not given as options from the environment, and check them.
+func (o *Options) tune() error {
+	for _, t := range []struct {
+		name  string
+		value *uint
+	}{
+		{ENV_EXTENT_BATCH, &o.ExtentBatch},
+		{ENV_SCAN_READERS, &o.ScanReaders},
+		{ENV_COPY_BUFFER_SIZE, &o.CopyBufferSize},
+	} {
+		s := os.Getenv(t.name)
+		if *t.value != 0 || s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", t.name, s)
+		}
+		*t.value = uint(v)
+	}
+	if size := o.CopyBufferSize; size != 0 && (size < BLOCK_SIZE || size > EXTENT_SIZE || size&(size-1) != 0) {
+		return fmt.Errorf("invalid copy buffer size %v", size)
+	}
+	return nil
+}
+
+// Return the number of extents read or written at once when scanning extent metadata. Unless set, the whole
+// table of small devices is read at once, while for large devices batches grow, so that the table is read in
+// a bounded number of I/Os.
+func (o *Options) extentBatch(totalDeviceExtents uint) uint {
+	if o.ExtentBatch != 0 {
+		return min(o.ExtentBatch, totalDeviceExtents)
+	}
+	return min(max(totalDeviceExtents/256, EXTENT_BATCH), MAX_EXTENT_BATCH, totalDeviceExtents)
+}
+
+// Return the size of the buffer used to copy extent data, a whole extent unless set.
+func (o *Options) copyBufferSize() uint {
+	if o.CopyBufferSize != 0 {
+		return o.CopyBufferSize
+	}
+	return EXTENT_SIZE
+}
+
+// Return the number of concurrent readers when scanning extent metadata.
+func (o *Options) scanReaders() uint {
+	if o.ScanReaders != 0 {
+		return o.ScanReaders
+	}
+	return SCAN_READERS
+}
@@ -0,0 +1,80 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/kelindar/bitmap"
+)
+
+type SnapshotUsage struct {
+	SnapshotId    uint
+	Extents       uint // Allocated to the snapshot
+	UniqueExtents uint // Replaced in the child snapshot, so they are freed if the snapshot is deleted
+	SharedExtents uint // Read through the child snapshot, which takes them over if the snapshot is deleted
+}
+
+// Return how many extents each snapshot of a volume holds, starting from the current one, and how many of them
+// deleting the snapshot would free. Extents that the child snapshot replaced, even in part, are unique, while
+// those it still reads are shared. All extents of the current snapshot are unique, as no other snapshot reads
+// them.
+func GetSnapshotUsage(device string, volumeName string) ([]SnapshotUsage, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	extents, err := dc.ReadAllExtents()
+	if err != nil {
+		return nil, err
+	}
+	su := dc.snapshotUsage(v, extents)
+	dc.Close()
+	return su, nil
+}
+
+func (dc *DeviceContext) snapshotUsage(v *VolumeMetadata, extents []ExtentMetadata) []SnapshotUsage {
+	// Volume extents of each snapshot in the chain
+	owned := make(map[uint16]*bitmap.Bitmap)
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		owned[sid] = &bitmap.Bitmap{}
+	}
+	for i := range extents {
+		if bm, ok := owned[extents[i].SnapshotId]; ok {
+			bm.Set(extents[i].ExtentPos)
+		}
+	}
+	var su []SnapshotUsage
+	child := uint16(0)
+	for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+		u := SnapshotUsage{SnapshotId: uint(sid), Extents: uint(owned[sid].Count())}
+		if child == 0 {
+			u.UniqueExtents = u.Extents
+		} else {
+			shared := owned[sid].Clone(nil)
+			shared.AndNot(*owned[child])
+			u.SharedExtents = uint(shared.Count())
+			u.UniqueExtents = u.Extents - u.SharedExtents
+		}
+		su = append(su, u)
+		child = sid
+	}
+	return su
+}
@@ -0,0 +1,399 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Extents moved per hold of the metadata lock when vacuuming, so writers are not blocked for long.
+const VACUUM_STEP_EXTENTS = 16
+
+var ErrInvalidExtent = errors.New("invalid extent position")
+
+var (
+	openVolumesMu sync.Mutex
+	openVolumes   = make(map[string][]*VolumeContext) // Volumes and snapshots open in this process, by device
+)
+
+// Register a volume context, so its extent map follows extents moved by vacuuming. Must be called before the
+// metadata lock taken to build the map is released.
+func registerVolume(vc *VolumeContext) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	openVolumes[vc.dc.device] = append(openVolumes[vc.dc.device], vc)
+}
+
+func unregisterVolume(vc *VolumeContext) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	vcs := openVolumes[vc.dc.device]
+	for i := range vcs {
+		if vcs[i] == vc {
+			openVolumes[vc.dc.device] = append(vcs[:i:i], vcs[i+1:]...)
+			break
+		}
+	}
+	if len(openVolumes[vc.dc.device]) == 0 {
+		delete(openVolumes, vc.dc.device)
+	}
+}
+
+// Point the extent maps of volumes open in this process at the new position of a moved extent. Each map is
+// patched under the relocation lock of its context, which waits for reads in progress, as they may be using
+// the old position. Writes are excluded by the metadata lock, held while moving. Free extents known to the
+// contexts are forgotten, as the destination is no longer free.
+func (dc *DeviceContext) relocateOpenExtent(e *ExtentMetadata, psrc uint32, pdst uint32) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	for _, vc := range openVolumes[dc.device] {
+		vc.relocation.Lock()
+		vc.vem.relocate(e.ExtentPos, psrc, pdst)
+		vc.relocation.Unlock()
+		vc.dc.free = freeExtents{}
+	}
+}
+
+// Update the extent maps of volumes open in this process for blocks merged into an extent, given with its device
+// position, as when relocating.
+func (dc *DeviceContext) mergeOpenExtent(eidx uint32, e ExtentMetadata) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	for _, vc := range openVolumes[dc.device] {
+		vc.relocation.Lock()
+		vc.vem.merged(eidx, e)
+		vc.relocation.Unlock()
+	}
+}
+
+// Advance the metadata generation of volumes open in this process that were current before a vacuum step, as
+// their extent maps were patched and need no rebuild.
+func (dc *DeviceContext) advanceOpenVolumes(generation uint64) {
+	openVolumesMu.Lock()
+	defer openVolumesMu.Unlock()
+	for _, vc := range openVolumes[dc.device] {
+		if vc.generation == generation {
+			vc.generation = dc.superblock.Generation
+		}
+	}
+}
+
+// Read the metadata of all allocated device extents. The result is indexed by device position.
+func (dc *DeviceContext) ReadAllExtents() ([]ExtentMetadata, error) {
+	extents := make([]ExtentMetadata, min(dc.totalDeviceExtents, uint(dc.superblock.AllocatedDeviceExtents)))
+	err := dc.scanExtents(func(offset uint, eb []ExtentMetadata) error {
+		copy(extents[offset:], eb)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// Move an extent to a free device position, copying over data and metadata. The source position is released.
+// The metadata is written at the destination before the source is cleared, so a crash in between leaves a
+// duplicate entry, but never loses the extent. Volumes open in this process are pointed at the destination.
+func (dc *DeviceContext) MoveExtent(extents []ExtentMetadata, psrc uint, pdst uint) error {
+	if err := dc.moveExtent(&extents[psrc], psrc, pdst); err != nil {
+		return err
+	}
+	extents[pdst] = extents[psrc]
+	extents[psrc] = ExtentMetadata{}
+	return nil
+}
+
+func (dc *DeviceContext) moveExtent(e *ExtentMetadata, psrc uint, pdst uint) error {
+	if err := dc.CopyExtentData(psrc, pdst); err != nil {
+		return err
+	}
+	if err := dc.WriteExtent(e, pdst); err != nil {
+		return err
+	}
+	if err := dc.moveExtentTime(uint32(psrc), uint32(pdst)); err != nil {
+		return err
+	}
+	if err := dc.maybeShredExtent(uint32(psrc), e.SnapshotId); err != nil {
+		return err
+	}
+	dc.relocateOpenExtent(e, uint32(psrc), uint32(pdst))
+	return dc.WriteExtent(&ExtentMetadata{}, psrc)
+}
+
+// Move the allocated extent at a device position to a free one, copying over its data and metadata, and release
+// the source position. The target may be past the allocation mark, which is moved up to it. Volumes open in
+// this process follow the extent, while those open in other processes rebuild their maps on their next write,
+// but must be refreshed before reading again.
+func RelocateExtent(device string, psrc uint, pdst uint) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	generation := dc.superblock.Generation
+	if err := dc.relocateExtent(psrc, pdst); err != nil {
+		return err
+	}
+	dc.superblock.Generation++
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	dc.advanceOpenVolumes(generation)
+	return dc.Close()
+}
+
+// Move an extent after checking that the source is allocated and the target free. Must be called with the
+// metadata lock held.
+func (dc *DeviceContext) relocateExtent(psrc uint, pdst uint) error {
+	if psrc >= min(dc.totalDeviceExtents, uint(dc.superblock.AllocatedDeviceExtents)) {
+		return fmt.Errorf("%w: %v is not allocated", ErrInvalidExtent, psrc)
+	}
+	if pdst >= dc.totalDeviceExtents {
+		return fmt.Errorf("%w: %v is past the end of the device", ErrInvalidExtent, pdst)
+	}
+	if err := dc.loadFreeExtents(); err != nil {
+		return err
+	}
+	if !dc.isFreeExtent(uint32(pdst)) {
+		return fmt.Errorf("%w: %v is not free", ErrInvalidExtent, pdst)
+	}
+	var e [1]ExtentMetadata
+	if err := dc.ReadExtents(e[:], psrc); err != nil {
+		return err
+	}
+	if e[0].SnapshotId == 0 {
+		return fmt.Errorf("%w: %v is not allocated", ErrInvalidExtent, psrc)
+	}
+	dc.takeExtent(uint32(pdst))
+	if err := dc.moveExtent(&e[0], psrc, pdst); err != nil {
+		return err
+	}
+	dc.ReleaseExtent(uint32(psrc))
+	return nil
+}
+
+// Move allocated extents from the end of the device into free positions, so that all allocated extents are
+// contiguous at the start of the data area. Updates the allocation count in memory and returns the new
+// extent table. Volumes open in this process follow the moved extents, while those open in other processes
+// must be refreshed before reading again.
+func (dc *DeviceContext) CompactExtents(extents []ExtentMetadata) ([]ExtentMetadata, error) {
+	extents, _, err := dc.compactExtents(extents, dc.totalDeviceExtents)
+	return extents, err
+}
+
+// Compact extents, moving at most the given number of them. Returns the new extent table, and true if the
+// allocated extents are contiguous.
+func (dc *DeviceContext) compactExtents(extents []ExtentMetadata, limit uint) ([]ExtentMetadata, bool, error) {
+	lo := uint(0)
+	hi := uint(len(extents))
+	done := false
+	for moved := uint(0); ; moved++ {
+		for lo < hi && extents[lo].SnapshotId != 0 {
+			lo++
+		}
+		for hi > lo && extents[hi-1].SnapshotId == 0 {
+			hi--
+		}
+		if lo >= hi {
+			done = true
+			break
+		}
+		if moved == limit {
+			break
+		}
+		if err := dc.MoveExtent(extents, hi-1, lo); err != nil {
+			return nil, false, err
+		}
+	}
+	dc.trimExtents(hi, uint(len(extents))-hi)
+	dc.superblock.AllocatedDeviceExtents = uint32(hi)
+	dc.superblock.Generation++
+	dc.free = freeExtents{}
+	return extents[:hi], done, nil
+}
+
+// Swap the extents at two allocated device positions, using a free position as scratch space.
+func (dc *DeviceContext) swapExtents(extents []ExtentMetadata, pa uint, pb uint, pscratch uint) error {
+	if err := dc.MoveExtent(extents, pa, pscratch); err != nil {
+		return err
+	}
+	if err := dc.MoveExtent(extents, pb, pa); err != nil {
+		return err
+	}
+	return dc.MoveExtent(extents, pscratch, pb)
+}
+
+// Vacuum the device, destroying expired volumes in the trash, removing labels left by deleted snapshots, and
+// releasing all free extents at the end of the data area. Extents are moved a few at a time, each batch under a short hold of the metadata lock, so volumes
+// can stay open and keep serving I/O. Volumes open in this process follow the moved extents, and writers
+// elsewhere rebuild their maps, but readers in other processes must be refreshed before reading again.
+func VacuumDevice(device string) error {
+	return vacuumDevice(device, nil)
+}
+
+// Vacuum a device, stopping between steps if the job is cancelled.
+func vacuumDevice(device string, j *job) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	retention := time.Duration(dc.superblock.TrashRetention) * time.Second
+	names, err := dc.reapDeletedVolumes(time.Now().Add(-retention))
+	pruned := 0
+	if err == nil {
+		pruned = dc.pruneLabels()
+	}
+	if err == nil && (len(names) > 0 || pruned > 0) {
+		err = dc.WriteMetadata()
+	}
+	if err == nil && pruned > 0 {
+		dc.opts.Logger.Info("removed labels of deleted snapshots", "labels", pruned)
+	}
+	if uerr := dc.UnlockMetadata(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		dc.notify(EVENT_VOLUME_PURGED, name, 0)
+	}
+	for done := false; !done; {
+		if j.cancelled() {
+			return ErrJobCancelled
+		}
+		if done, err = dc.vacuumStep(); err != nil {
+			return err
+		}
+	}
+	return dc.Close()
+}
+
+// Move up to VACUUM_STEP_EXTENTS extents towards the start of the data area under the metadata lock. Returns
+// true if the allocated extents are contiguous.
+func (dc *DeviceContext) vacuumStep() (bool, error) {
+	if err := dc.LockMetadata(); err != nil {
+		return false, err
+	}
+	defer dc.UnlockMetadata()
+	generation := dc.superblock.Generation
+	extents, err := dc.ReadAllExtents()
+	if err != nil {
+		return false, err
+	}
+	_, done, err := dc.compactExtents(extents, VACUUM_STEP_EXTENTS)
+	if err != nil {
+		return false, err
+	}
+	if err := dc.WriteSuperblock(); err != nil {
+		return false, err
+	}
+	dc.advanceOpenVolumes(generation)
+	return done, nil
+}
+
+// Relocate the extents of a volume, so that they are contiguous and in volume order on the device. Only extents
+// visible from the current snapshot are considered. The device is vacuumed in the process.
+func DefragmentVolume(device string, volumeName string) error {
+	return defragmentVolume(device, volumeName, nil)
+}
+
+// Defragment a volume, stopping between moves of extents if the job is cancelled. Progress counts the extents
+// visited in volume order.
+func defragmentVolume(device string, volumeName string, j *job) error {
+	dc, err := GetDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	extents, err := dc.ReadAllExtents()
+	if err != nil {
+		return err
+	}
+	if extents, err = dc.CompactExtents(extents); err != nil {
+		return err
+	}
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	vem, err := GetVolumeExtentMap(dc, v.VolumeSize, v.SnapshotId)
+	if err != nil {
+		return err
+	}
+
+	// Current device position of each extent, in volume order
+	var positions []uint
+	vem.extentBitmap.Range(func(x uint32) {
+		if vem.get(x).SnapshotId != 0 {
+			positions = append(positions, uint(vem.get(x).ExtentPos))
+		}
+	})
+	if len(positions) == 0 {
+		return dc.Close()
+	}
+	owner := make(map[uint]int, len(positions))
+	start := positions[0]
+	for i, p := range positions {
+		owner[p] = i
+		start = min(start, p)
+	}
+	allocated := uint(len(extents))
+	start = min(start, allocated-uint(len(positions)))
+	scratch := allocated
+	extents = append(extents[:allocated:allocated], ExtentMetadata{})
+
+	j.setTotal(uint64(len(positions)) * EXTENT_SIZE)
+	for i := range positions {
+		slot := start + uint(i)
+		p := positions[i]
+		j.advance(EXTENT_SIZE)
+		if p == slot {
+			continue
+		}
+		if j.cancelled() {
+			break
+		}
+		if scratch >= dc.totalDeviceExtents {
+			return ErrNoSpace
+		}
+		if err := dc.swapExtents(extents, slot, p, scratch); err != nil {
+			return err
+		}
+		if j, ok := owner[slot]; ok {
+			positions[j] = p
+			owner[p] = j
+		} else {
+			delete(owner, p)
+		}
+		positions[i] = slot
+		owner[slot] = i
+	}
+	dc.superblock.Generation++
+	if err := dc.WriteSuperblock(); err != nil {
+		return err
+	}
+	if j.cancelled() {
+		return ErrJobCancelled
+	}
+	return dc.Close()
+}
@@ -0,0 +1,85 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Outcome of comparing a clone with the snapshot it was cloned from.
+type CloneVerification struct {
+	Extents    uint          // Extents compared, allocated in the snapshot or the clone
+	Mismatches []VolumeRange // Parts of the volume whose data differs from the snapshot, in order
+}
+
+// Compare the data of a volume with the snapshot it was cloned from as a whole, by reading both back from the
+// device, to check a copy end to end. Only extents allocated in either are read, as others read as zeroes in
+// both. The volume should not be written until verified, as changes are reported as mismatches.
+func VerifyClone(device string, volumeName string, snapshotId uint) (*CloneVerification, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		dc.Close()
+		return nil, fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	cloneSnapshotId := uint(v.SnapshotId)
+	if err := dc.Close(); err != nil {
+		return nil, err
+	}
+	src, err := OpenSnapshot(device, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	defer src.CloseVolume()
+	dst, err := OpenSnapshot(device, cloneSnapshotId)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.CloseVolume()
+	if src.VolumeSize() != dst.VolumeSize() {
+		return nil, fmt.Errorf("volume %v has %v bytes, snapshot %v has %v", volumeName, dst.VolumeSize(), snapshotId, src.VolumeSize())
+	}
+	result := &CloneVerification{}
+	sbuf := make([]byte, EXTENT_SIZE)
+	dbuf := make([]byte, EXTENT_SIZE)
+	for eidx := uint32(0); uint(eidx) < src.vem.totalVolumeExtents; eidx++ {
+		if !src.vem.extentBitmap.Contains(eidx) && !dst.vem.extentBitmap.Contains(eidx) {
+			continue
+		}
+		offset := uint64(eidx) * EXTENT_SIZE
+		if err := src.ReadAt(sbuf, offset); err != nil {
+			return nil, err
+		}
+		if err := dst.ReadAt(dbuf, offset); err != nil {
+			return nil, err
+		}
+		result.Extents++
+		for boffset := uint64(0); boffset < EXTENT_SIZE; boffset += BLOCK_SIZE {
+			if bytes.Equal(sbuf[boffset:boffset+BLOCK_SIZE], dbuf[boffset:boffset+BLOCK_SIZE]) {
+				continue
+			}
+			if n := len(result.Mismatches); n > 0 && result.Mismatches[n-1].Offset+result.Mismatches[n-1].Length == offset+boffset {
+				result.Mismatches[n-1].Length += BLOCK_SIZE
+			} else {
+				result.Mismatches = append(result.Mismatches, VolumeRange{Offset: offset + boffset, Length: BLOCK_SIZE})
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,70 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+// Metadata of a device as of one moment, gathered under a single shared lock, so that reports combining volumes,
+// snapshots and usage do not mix states from before and after concurrent changes. Device.Generation identifies
+// the moment.
+type DeviceSnapshotView struct {
+	Device         *DeviceInfo
+	Volumes        []VolumeInfo               // As returned by GetVolumeInfo
+	DeletedVolumes []VolumeInfo               // As returned by ListDeletedVolumes
+	Snapshots      []SnapshotInfo             // As returned by ListAllSnapshots
+	Usage          map[string][]SnapshotUsage // Of each volume not in the trash, by name, as returned by GetSnapshotUsage
+	Groups         []GroupInfo
+}
+
+// Return a consistent view of the metadata of a device, in place of calls to GetDeviceInfo, GetVolumeInfo,
+// ListAllSnapshots, GetSnapshotUsage and others, which may each see a different state. The extent metadata is
+// read once for the usage of all volumes.
+func GetDeviceSnapshotView(device string) (*DeviceSnapshotView, error) {
+	dc, err := GetSharedDeviceContext(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	stats, err := dc.ReadAllVolumeStats()
+	if err != nil {
+		return nil, err
+	}
+	extents, err := dc.ReadAllExtents()
+	if err != nil {
+		return nil, err
+	}
+	view := &DeviceSnapshotView{
+		Device:    dc.deviceInfo(),
+		Snapshots: dc.listAllSnapshots(),
+		Usage:     make(map[string][]SnapshotUsage),
+		Groups:    dc.groupInfo(),
+	}
+	for i := 0; i < MAX_VOLUMES; i++ {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 {
+			continue
+		}
+		vi := dc.volumeInfo(v)
+		if v.DeletedAt != 0 {
+			vi.setStats(&stats[i])
+			view.DeletedVolumes = append(view.DeletedVolumes, vi)
+			continue
+		}
+		dc.addPendingStats(&stats[i], vi.VolumeName)
+		vi.setStats(&stats[i])
+		view.Volumes = append(view.Volumes, vi)
+		view.Usage[vi.VolumeName] = dc.snapshotUsage(v, extents)
+	}
+	dc.Close()
+	return view, nil
+}
@@ -0,0 +1,132 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/kelindar/bitmap"
+)
+
+var ErrRetained = errors.New("data under retention")
+
+// Return the time a volume is write once (WORM) until, as seconds since the epoch, zero if not write once.
+func (dc *DeviceContext) retainUntil(v *VolumeMetadata) int64 {
+	return int64(dc.retention[dc.volumeIndex(v)])
+}
+
+// Return true if a volume is write once (WORM) and its retention period has not passed.
+func (dc *DeviceContext) retained(v *VolumeMetadata) bool {
+	retainUntil := dc.retainUntil(v)
+	return retainUntil != 0 && time.Now().Unix() < retainUntil
+}
+
+// Set the time a volume is write once until, zero to turn write once off. The retention table is only kept in
+// the metadata area while a time is set in it, flagged by FEATURE_RO_COMPAT_RETENTION, so that devices without
+// write once volumes can still be changed by versions that do not know of retention. Metadata is not written to
+// the device.
+func (dc *DeviceContext) setRetainUntil(v *VolumeMetadata, retainUntil uint32) {
+	dc.retention[dc.volumeIndex(v)] = retainUntil
+	dc.superblock.FeatureRoCompat &^= FEATURE_RO_COMPAT_RETENTION
+	for _, t := range dc.retention {
+		if t != 0 {
+			dc.superblock.FeatureRoCompat |= FEATURE_RO_COMPAT_RETENTION
+			break
+		}
+	}
+}
+
+// Return an error if a volume cannot be deleted, or its data moved to another volume, because of retention.
+func (dc *DeviceContext) checkRetention(v *VolumeMetadata) error {
+	if dc.retained(v) {
+		return fmt.Errorf("%w: volume %v until %v", ErrRetained, v.Name(), time.Unix(dc.retainUntil(v), 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Return an error if a snapshot is in the chain of a volume under retention, so it cannot be deleted.
+func (dc *DeviceContext) checkSnapshotRetention(snapshotId uint16) error {
+	for i := range dc.volumes {
+		v := &dc.volumes[i]
+		if v.SnapshotId == 0 || !dc.retained(v) {
+			continue
+		}
+		for sid := v.SnapshotId; sid > 0; sid = dc.snapshots[sid-1].ParentSnapshotId {
+			if sid == snapshotId {
+				return dc.checkRetention(v)
+			}
+		}
+	}
+	return nil
+}
+
+// Return an error if a block of the volume holds data under retention, which may not be overwritten or unmapped.
+// Blocks not written yet can be written once.
+func (vc *VolumeContext) checkRetainedBlock(block uint64) error {
+	if !vc.dc.retained(vc.volume) {
+		return nil
+	}
+	eidx := uint32(block >> BLOCK_BITS_IN_EXTENT)
+	bidx := uint32(block & BLOCK_MASK_IN_EXTENT)
+	if uint(eidx) >= vc.vem.totalVolumeExtents {
+		return nil
+	}
+	e := vc.vem.get(eidx)
+	if e.SnapshotId == 0 {
+		return nil
+	}
+	written := bitmap.FromBytes(e.BlockBitmap[:]).Contains(bidx)
+	if !written && e.Flags&EXTENT_FLAG_PARTIAL != 0 {
+		_, written = vc.vem.inheritedBlock(eidx, bidx)
+	}
+	if written {
+		return fmt.Errorf("%w: block %v of volume %v", ErrRetained, block, vc.volumeName)
+	}
+	return nil
+}
+
+// Make a volume write once (WORM) until a time: blocks already written, and those written from now on, cannot be
+// overwritten or unmapped, and the volume and its snapshots cannot be deleted, until then. The retention can
+// be extended but not shortened while it lasts. Once it has passed, the volume can be changed again, and a zero
+// time turns write once off. Times are kept to the second, up to the year 2106.
+func SetVolumeRetention(device string, volumeName string, until time.Time) error {
+	dc, err := getMutableDeviceContext(device)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	v := dc.FindVolume(volumeName)
+	if v == nil {
+		return fmt.Errorf("%w: %v", ErrVolumeNotFound, volumeName)
+	}
+	retainUntil := int64(0)
+	if !until.IsZero() {
+		retainUntil = until.Unix()
+		if retainUntil <= 0 || retainUntil > math.MaxUint32 {
+			return fmt.Errorf("invalid retention time %v", until)
+		}
+	}
+	if dc.retained(v) && retainUntil < dc.retainUntil(v) {
+		return fmt.Errorf("cannot shorten retention: %w", dc.checkRetention(v))
+	}
+	dc.setRetainUntil(v, uint32(retainUntil))
+	if err := dc.WriteMetadata(); err != nil {
+		return err
+	}
+	return dc.Close()
+}
@@ -0,0 +1,113 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Types and states of jobs.
+const (
+	JOB_CLONE      = core.JOB_CLONE
+	JOB_VACUUM     = core.JOB_VACUUM
+	JOB_DEFRAGMENT = core.JOB_DEFRAGMENT
+	JOB_SCRUB      = core.JOB_SCRUB
+	JOB_SHRED      = core.JOB_SHRED
+
+	JOB_RUNNING     = core.JOB_RUNNING
+	JOB_COMPLETED   = core.JOB_COMPLETED
+	JOB_FAILED      = core.JOB_FAILED
+	JOB_CANCELLED   = core.JOB_CANCELLED
+	JOB_INTERRUPTED = core.JOB_INTERRUPTED // Was running in a process that exited, and may be resumed or cancelled
+
+	MAX_FINISHED_JOBS   = core.MAX_FINISHED_JOBS   // Finished jobs kept in memory per device, dropping the oldest
+	JOB_UPDATE_INTERVAL = core.JOB_UPDATE_INTERVAL // Progress of running jobs is written to the job table this often
+	JOB_STALE_AFTER     = core.JOB_STALE_AFTER     // Running jobs not updated for this long were interrupted
+)
+
+var (
+	ErrJobNotFound     = core.ErrJobNotFound
+	ErrJobCancelled    = core.ErrJobCancelled
+	ErrJobNotResumable = core.ErrJobNotResumable
+	ErrTooManyJobs     = core.ErrTooManyJobs
+)
+
+const (
+	JOB_TYPE_CLONE      = core.JOB_TYPE_CLONE
+	JOB_TYPE_VACUUM     = core.JOB_TYPE_VACUUM
+	JOB_TYPE_DEFRAGMENT = core.JOB_TYPE_DEFRAGMENT
+	JOB_TYPE_SCRUB      = core.JOB_TYPE_SCRUB
+	JOB_TYPE_SHRED      = core.JOB_TYPE_SHRED
+
+	JOB_STATE_RUNNING   = core.JOB_STATE_RUNNING
+	JOB_STATE_COMPLETED = core.JOB_STATE_COMPLETED
+	JOB_STATE_FAILED    = core.JOB_STATE_FAILED
+	JOB_STATE_CANCELLED = core.JOB_STATE_CANCELLED
+
+	JOB_FLAG_RANGES = core.JOB_FLAG_RANGES
+	JOB_FLAG_CANCEL = core.JOB_FLAG_CANCEL
+
+	MAX_JOB_RECORDS = core.MAX_JOB_RECORDS
+)
+
+type JobRecord = core.JobRecord
+
+// Progress of an operation running in the background. Jobs are kept in the job table of the device, so they
+// can be listed by other processes, and resumed or cancelled if the process running them exits.
+type JobInfo = core.JobInfo
+
+// Return the jobs of a device, as kept in its job table, along with those run by this process whose records
+// were reused since. Jobs are ordered by id.
+func ListJobs(device string) ([]JobInfo, error) {
+	return core.ListJobs(device)
+}
+
+func GetJob(device string, jobId uint64) (*JobInfo, error) {
+	return core.GetJob(device, jobId)
+}
+
+// Wait for a job to stop running and return its final state. Jobs run by other processes are polled.
+func WaitJob(device string, jobId uint64) (*JobInfo, error) {
+	return core.WaitJob(device, jobId)
+}
+
+// Ask a job to stop, without waiting for it. Jobs run by other processes are flagged in the job table, and
+// stop on their next update. Interrupted jobs are cancelled right away, destroying the volume of a clone.
+// Cancelling a finished job has no effect.
+func CancelJob(device string, jobId uint64) error {
+	return core.CancelJob(device, jobId)
+}
+
+// Continue an interrupted job in this process, with the limits it was started with. Clones carry on from the
+// data already copied, except for clones of parts of a snapshot, which cannot be resumed, while other jobs
+// start over, overwriting again any extents a secure deletion had. Options apply to the device, as when starting the job.
+func ResumeJob(device string, jobId uint64, opts ...Option) (*JobInfo, error) {
+	return core.ResumeJob(device, jobId, opts...)
+}
+
+// Vacuum a device in the background, as with VacuumDevice.
+func VacuumDeviceJob(device string) (*JobInfo, error) {
+	return core.VacuumDeviceJob(device)
+}
+
+// Defragment a volume in the background, as with DefragmentVolume.
+func DefragmentVolumeJob(device string, volumeName string) (*JobInfo, error) {
+	return core.DefragmentVolumeJob(device, volumeName)
+}
+
+// Scrub a device in the background, as with ScrubDevice.
+func ScrubDeviceJob(device string, rate uint64, opts ...Option) (*JobInfo, error) {
+	return core.ScrubDeviceJob(device, rate, opts...)
+}
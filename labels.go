@@ -0,0 +1,65 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+const (
+	// Labels holding the name and description of a snapshot. They are not returned with the other labels, and
+	// cannot be set as ones.
+	SNAPSHOT_NAME_LABEL        = core.SNAPSHOT_NAME_LABEL
+	SNAPSHOT_DESCRIPTION_LABEL = core.SNAPSHOT_DESCRIPTION_LABEL
+
+	MAX_SNAPSHOT_DESCRIPTION_SIZE = core.MAX_SNAPSHOT_DESCRIPTION_SIZE
+
+	LABEL_REGION_SIZE    = core.LABEL_REGION_SIZE
+	MAX_LABEL_KEY_SIZE   = core.MAX_LABEL_KEY_SIZE
+	MAX_LABEL_VALUE_SIZE = core.MAX_LABEL_VALUE_SIZE
+
+	// Part of the label region only snapshot names may use, so that snapshots can still be named once other
+	// labels fill the rest. Enough for over 200 names of the largest size.
+	LABEL_NAME_RESERVE = core.LABEL_NAME_RESERVE
+)
+
+var (
+	ErrInvalidLabel        = core.ErrInvalidLabel
+	ErrLabelSpaceExhausted = core.ErrLabelSpaceExhausted
+)
+
+// Check that labels can be set. Keys must be valid UTF-8 of up to MAX_LABEL_KEY_SIZE bytes, without control
+// characters or '=', which separates keys from values on the command line and in queries. Values may be
+// empty, and up to MAX_LABEL_VALUE_SIZE bytes.
+func ValidateLabels(labels map[string]string) error {
+	return core.ValidateLabels(labels)
+}
+
+// Name a snapshot, or remove its name if empty. Names can be used instead of snapshot ids, which are reused once
+// snapshots are deleted, by resolving them with ResolveSnapshot.
+func SetSnapshotName(device string, snapshotId uint, name string) error {
+	return core.SetSnapshotName(device, snapshotId, name)
+}
+
+// Describe a snapshot, to record why it was taken, or remove its description if empty.
+func SetSnapshotDescription(device string, snapshotId uint, description string) error {
+	return core.SetSnapshotDescription(device, snapshotId, description)
+}
+
+// Return the id of a snapshot given as a name or a numeric id, as accepted by commands taking snapshots.
+// Fails with ErrSnapshotNotFound if no snapshot has the name or id.
+func ResolveSnapshot(device string, snapshot string) (uint, error) {
+	return core.ResolveSnapshot(device, snapshot)
+}
@@ -0,0 +1,28 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+var ErrVolumeClosed = core.ErrVolumeClosed
+
+// Open a volume for I/O, returning before its extent map is built. The map is built in the background, while
+// holding a shared lock on the device metadata. Reads of extents of the current snapshot proceed as soon as
+// they are found, and other reads wait for the map to be built, as do writes, unmaps and refreshes.
+func OpenVolumeLazy(device string, volumeName string, opts ...Option) (*VolumeContext, error) {
+	return core.OpenVolumeLazy(device, volumeName, opts...)
+}
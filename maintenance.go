@@ -0,0 +1,30 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+var ErrMaintenance = core.ErrMaintenance
+
+// Put a device in maintenance, or take it out of it. While in maintenance, volumes and snapshots cannot be
+// created, changed or deleted, and open volumes fail writes that need new extents, preallocations and unmaps
+// with ErrMaintenance, as checked when they next update metadata. Blocks already allocated can still be
+// overwritten. Device-wide operations, like vacuuming, defragmenting and setting device policies, are allowed,
+// so the device can be quiesced before them, or before it is expanded or migrated.
+func SetDeviceMaintenance(device string, maintenance bool) error {
+	return core.SetDeviceMaintenance(device, maintenance)
+}
@@ -0,0 +1,33 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Prefix of device names referring to in-memory devices.
+const MEMORY_DEVICE_PREFIX = core.MEMORY_DEVICE_PREFIX
+
+// Create an in-memory device of the given size and return its device name, to be passed to any API call in the
+// same process. Intended for testing, as contents are lost on exit. The device is not initialized.
+func CreateMemoryDevice(name string, size uint64) (string, error) {
+	return core.CreateMemoryDevice(name, size)
+}
+
+// Remove an in-memory device, freeing its memory once all handles are closed.
+func RemoveMemoryDevice(name string) error {
+	return core.RemoveMemoryDevice(name)
+}
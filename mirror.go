@@ -0,0 +1,29 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Prefix of device names referring to a pair of mirrored devices, as mirror://DEVICE,MIRROR.
+const MIRROR_DEVICE_PREFIX = core.MIRROR_DEVICE_PREFIX
+
+// Copy a mirrored device over to the copy that failed, once it is replaced or repaired, so that both are
+// written again. Volumes may stay open, as writes during the resync go to both copies, but metadata cannot be
+// changed. The extent time table, if in use, is copied as well, but not the reserved region, if any.
+func ResyncMirror(device string) error {
+	return core.ResyncMirror(device)
+}
@@ -0,0 +1,48 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+var (
+	ErrInvalidVolumeName = core.ErrInvalidVolumeName
+	ErrVolumeExists      = core.ErrVolumeExists
+	ErrInvalidGroupName  = core.ErrInvalidGroupName
+
+	ErrInvalidSnapshotName = core.ErrInvalidSnapshotName
+	ErrSnapshotExists      = core.ErrSnapshotExists
+)
+
+// Longest snapshot name.
+const MAX_SNAPSHOT_NAME_SIZE = core.MAX_SNAPSHOT_NAME_SIZE
+
+// Check that a volume name is usable. Names are up to MAX_VOLUME_NAME_SIZE bytes of letters, digits, '.', '_'
+// and '-', starting with a letter or digit, so they are safe as file names and NBD export names.
+func ValidateVolumeName(volumeName string) error {
+	return core.ValidateVolumeName(volumeName)
+}
+
+// Check that a group name is usable. Names follow the rules of volume names, up to MAX_GROUP_NAME_SIZE bytes.
+func ValidateGroupName(groupName string) error {
+	return core.ValidateGroupName(groupName)
+}
+
+// Check that a snapshot name is usable. Names follow the rules of volume names, up to MAX_SNAPSHOT_NAME_SIZE
+// bytes, but must not be all digits, so they are told apart from snapshot ids.
+func ValidateSnapshotName(name string) error {
+	return core.ValidateSnapshotName(name)
+}
@@ -0,0 +1,200 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Changed block tracking for backup applications, in the style of the VMware VDDK: a backup takes a snapshot,
+// reads the areas changed since the snapshot of the previous backup, identified by its change id, and keeps the
+// new snapshot for the next one.
+package cbt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Change id matching all areas ever written, for full backups.
+const ALL_CHANGES = "*"
+
+var ErrInvalidChangeId = errors.New("invalid change id")
+
+// Part of a volume, in bytes.
+type Area struct {
+	Offset uint64
+	Length uint64
+}
+
+// Snapshot taken for a backup.
+type Snapshot struct {
+	SnapshotId uint
+	ChangeId   string // Identifies the state of the volume at the snapshot, for QueryChangedAreas
+}
+
+// Volume with changed block tracking.
+type Disk struct {
+	device     string
+	volumeName string
+	opts       []dbs.Option
+}
+
+// Enable changed block tracking for a volume. As every snapshot records the blocks written while it was
+// current, tracking needs no setup and this only checks the volume. Options apply to mounted snapshots.
+func EnableCBT(device string, volumeName string, opts ...dbs.Option) (*Disk, error) {
+	if _, err := dbs.GetSnapshotInfo(device, volumeName); err != nil {
+		return nil, err
+	}
+	return &Disk{device: device, volumeName: volumeName, opts: opts}, nil
+}
+
+// Return the change id of a snapshot. It includes the device UUID and the creation time of the snapshot, so it
+// is invalid on another device, or once the snapshot is deleted and its id reused.
+func (d *Disk) changeId(uuid string, si *dbs.SnapshotInfo) string {
+	return fmt.Sprintf("%v:%v:%v", uuid, si.SnapshotId, si.CreatedAt.Unix())
+}
+
+// Return the snapshots of the volume, current first, and the device UUID.
+func (d *Disk) chain() ([]dbs.SnapshotInfo, string, error) {
+	di, err := dbs.GetDeviceInfo(d.device)
+	if err != nil {
+		return nil, "", err
+	}
+	si, err := dbs.GetSnapshotInfo(d.device, d.volumeName)
+	if err != nil {
+		return nil, "", err
+	}
+	return si, di.UUID, nil
+}
+
+// Freeze the current state of the volume in a snapshot, which is returned, for a backup to read. Writes to the
+// volume continue in a new snapshot.
+func (d *Disk) CreateSnapshot(labels map[string]string) (*Snapshot, error) {
+	si, _, err := d.chain()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dbs.CreateSnapshot(d.device, d.volumeName, &dbs.SnapshotOptions{Labels: labels}); err != nil {
+		return nil, err
+	}
+	return d.Snapshot(si[0].SnapshotId)
+}
+
+// Return a snapshot of the volume with its change id.
+func (d *Disk) Snapshot(snapshotId uint) (*Snapshot, error) {
+	si, uuid, err := d.chain()
+	if err != nil {
+		return nil, err
+	}
+	for i := range si {
+		if si[i].SnapshotId == snapshotId {
+			return &Snapshot{SnapshotId: snapshotId, ChangeId: d.changeId(uuid, &si[i])}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v of volume %v", dbs.ErrSnapshotNotFound, snapshotId, d.volumeName)
+}
+
+// Delete a snapshot no longer needed for backups. Its changes are kept by the next snapshot, so change ids
+// of later snapshots stay valid, while its own becomes invalid.
+func (d *Disk) DeleteSnapshot(snapshotId uint) error {
+	if _, err := d.Snapshot(snapshotId); err != nil {
+		return err
+	}
+	return dbs.DeleteSnapshot(d.device, snapshotId)
+}
+
+// Open a snapshot of the volume for reading. Unmount it with CloseVolume.
+func (d *Disk) MountSnapshot(snapshotId uint) (*dbs.VolumeContext, error) {
+	if _, err := d.Snapshot(snapshotId); err != nil {
+		return nil, err
+	}
+	return dbs.OpenSnapshot(d.device, snapshotId, d.opts...)
+}
+
+// Return the areas of the volume that may differ at a snapshot from the state with the given change id, in
+// order. With ALL_CHANGES, return the areas written up to the snapshot. The change id must be of a previous
+// snapshot of the volume, or ErrInvalidChangeId is returned, and a full backup is needed.
+func (d *Disk) QueryChangedAreas(snapshotId uint, since string) ([]Area, error) {
+	si, uuid, err := d.chain()
+	if err != nil {
+		return nil, err
+	}
+	start := -1
+	for i := range si {
+		if si[i].SnapshotId == snapshotId {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("%w: %v of volume %v", dbs.ErrSnapshotNotFound, snapshotId, d.volumeName)
+	}
+	// Snapshots from the given one back to the one of the change id, excluding it
+	end := len(si)
+	if since != ALL_CHANGES {
+		end = -1
+		for i := start + 1; i < len(si); i++ {
+			if d.changeId(uuid, &si[i]) == since {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidChangeId, since)
+		}
+	}
+	var areas []Area
+	for i := start; i < end; i++ {
+		ranges, err := dbs.GetSnapshotRanges(d.device, si[i].SnapshotId)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranges {
+			// Zeroed ranges only matter over data of snapshots included in the backup
+			if r.Zeroed && since == ALL_CHANGES {
+				continue
+			}
+			areas = append(areas, Area{Offset: r.Offset, Length: r.Length})
+		}
+	}
+	return mergeAreas(areas), nil
+}
+
+// Sort areas and merge those overlapping or adjacent.
+func mergeAreas(areas []Area) []Area {
+	sort.Slice(areas, func(i, j int) bool { return areas[i].Offset < areas[j].Offset })
+	var merged []Area
+	for _, a := range areas {
+		if n := len(merged); n > 0 && a.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			merged[n-1].Length = max(merged[n-1].Length, a.Offset+a.Length-merged[n-1].Offset)
+			continue
+		}
+		merged = append(merged, a)
+	}
+	return merged
+}
+
+// Return the snapshot id in a change id, for snapshots of a backup to be found from it.
+func ParseChangeId(changeId string) (uint, error) {
+	parts := strings.Split(changeId, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidChangeId, changeId)
+	}
+	sid, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidChangeId, changeId)
+	}
+	return uint(sid), nil
+}
@@ -0,0 +1,108 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbt_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/cbt"
+)
+
+const (
+	MEGABYTE = 1024 * 1024
+	GIGABYTE = MEGABYTE * 1024
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type CBTSuite struct{}
+
+var _ = Suite(&CBTSuite{})
+
+func write(c *C, device string, offsets ...uint64) {
+	vc, err := dbs.OpenVolume(device, "vol1")
+	c.Assert(err, IsNil)
+	for _, offset := range offsets {
+		c.Assert(vc.WriteAt(bytes.Repeat([]byte{byte(offset / dbs.BLOCK_SIZE)}, dbs.BLOCK_SIZE), offset, true), IsNil)
+	}
+	c.Assert(vc.CloseVolume(), IsNil)
+}
+
+func (s *CBTSuite) TestBackups(c *C) {
+	device, err := dbs.CreateMemoryDevice("cbt", 100*MEGABYTE)
+	c.Assert(err, IsNil)
+	defer dbs.RemoveMemoryDevice("cbt")
+	c.Assert(dbs.InitDevice(device), IsNil)
+	_, err = cbt.EnableCBT(device, "vol1")
+	c.Assert(errors.Is(err, dbs.ErrVolumeNotFound), Equals, true)
+	_, err = dbs.CreateVolume(device, "vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	disk, err := cbt.EnableCBT(device, "vol1")
+	c.Assert(err, IsNil)
+
+	// Full backup
+	write(c, device, 0, 2*dbs.EXTENT_SIZE)
+	full, err := disk.CreateSnapshot(map[string]string{"backup": "full"})
+	c.Assert(err, IsNil)
+	areas, err := disk.QueryChangedAreas(full.SnapshotId, cbt.ALL_CHANGES)
+	c.Assert(err, IsNil)
+	c.Assert(areas, DeepEquals, []cbt.Area{{0, dbs.BLOCK_SIZE}, {2 * dbs.EXTENT_SIZE, dbs.BLOCK_SIZE}})
+	vc, err := disk.MountSnapshot(full.SnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(vc.ReadOnly(), Equals, true)
+	c.Assert(vc.CloseVolume(), IsNil)
+
+	// Incremental backups see the blocks written since
+	write(c, device, 4*dbs.EXTENT_SIZE)
+	incr1, err := disk.CreateSnapshot(nil)
+	c.Assert(err, IsNil)
+	areas, err = disk.QueryChangedAreas(incr1.SnapshotId, full.ChangeId)
+	c.Assert(err, IsNil)
+	c.Assert(areas, DeepEquals, []cbt.Area{{4 * dbs.EXTENT_SIZE, dbs.BLOCK_SIZE}})
+	write(c, device, dbs.EXTENT_SIZE)
+	incr2, err := disk.CreateSnapshot(nil)
+	c.Assert(err, IsNil)
+	areas, err = disk.QueryChangedAreas(incr2.SnapshotId, full.ChangeId)
+	c.Assert(err, IsNil)
+	c.Assert(areas, DeepEquals, []cbt.Area{{dbs.EXTENT_SIZE, dbs.BLOCK_SIZE}, {4 * dbs.EXTENT_SIZE, dbs.BLOCK_SIZE}})
+	write(c, device, 0)
+	incr3, err := disk.CreateSnapshot(nil)
+	c.Assert(err, IsNil)
+	areas, err = disk.QueryChangedAreas(incr3.SnapshotId, incr2.ChangeId)
+	c.Assert(err, IsNil)
+	c.Assert(areas, DeepEquals, []cbt.Area{{0, dbs.BLOCK_SIZE}})
+
+	// Deleting a backup snapshot invalidates only its own change id
+	c.Assert(disk.DeleteSnapshot(incr1.SnapshotId), IsNil)
+	_, err = disk.QueryChangedAreas(incr3.SnapshotId, incr1.ChangeId)
+	c.Assert(errors.Is(err, cbt.ErrInvalidChangeId), Equals, true)
+	areas, err = disk.QueryChangedAreas(incr2.SnapshotId, full.ChangeId)
+	c.Assert(err, IsNil)
+	c.Assert(areas, HasLen, 2)
+	sid, err := cbt.ParseChangeId(full.ChangeId)
+	c.Assert(err, IsNil)
+	c.Assert(sid, Equals, full.SnapshotId)
+
+	// Change ids are only valid for earlier snapshots
+	_, err = disk.QueryChangedAreas(full.SnapshotId, incr2.ChangeId)
+	c.Assert(errors.Is(err, cbt.ErrInvalidChangeId), Equals, true)
+	_, err = disk.QueryChangedAreas(incr3.SnapshotId, "bogus")
+	c.Assert(errors.Is(err, cbt.ErrInvalidChangeId), Equals, true)
+}
@@ -0,0 +1,626 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Management of DBS devices, either embedded or through the management daemon, with the same calls.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+// Management API of a device. The methods match the functions of the dbs package, without the device argument.
+type Manager interface {
+	GetDeviceInfo() (*dbs.DeviceInfo, error)
+	GetDeviceSnapshotView() (*dbs.DeviceSnapshotView, error)
+	GetVolumeInfo() ([]dbs.VolumeInfo, error)
+	GetSnapshotInfo(volumeName string) ([]dbs.SnapshotInfo, error)
+	ListAllSnapshots() ([]dbs.SnapshotInfo, error)
+	ListSnapshots(q *dbs.SnapshotQuery) ([]dbs.SnapshotInfo, uint, error)
+	ExportCatalog() (*dbs.SnapshotCatalog, error)
+	ImportCatalog(catalog *dbs.SnapshotCatalog) (*dbs.CatalogImport, error)
+	CreateVolume(volumeName string, volumeSize uint64) (*dbs.VolumeInfo, error)
+	RenameVolume(volumeName string, newVolumeName string) error
+	DeleteVolume(volumeName string) error
+	CreateSnapshot(volumeName string, opts *dbs.SnapshotOptions) (uint, error)
+	CloneSnapshot(newVolumeName string, snapshotId uint) (*dbs.VolumeInfo, error)
+	CloneSnapshotJob(newVolumeName string, snapshotId uint, ranges []dbs.VolumeRange, opts *dbs.CloneOptions) (*dbs.VolumeInfo, *dbs.JobInfo, error)
+	ListJobs() ([]dbs.JobInfo, error)
+	GetJob(jobId uint64) (*dbs.JobInfo, error)
+	CancelJob(jobId uint64) error
+	ResumeJob(jobId uint64) (*dbs.JobInfo, error)
+	DeleteSnapshot(snapshotId uint) error
+	OpenVolume(volumeName string) (Volume, error)
+	OpenSnapshot(snapshotId uint) (Volume, error)
+	Watch(opts *dbs.WatchOptions) (<-chan dbs.Event, func(), error)
+	VacuumDevice() error
+}
+
+// Block API of an open volume, implemented by dbs.VolumeContext.
+type Volume interface {
+	ReadAt(data []byte, offset uint64) error
+	WriteAt(data []byte, offset uint64, updateMetadata bool) error
+	UnmapAt(length uint64, offset uint64) error
+	Sync() error
+	Refresh() error
+	CloseVolume() error
+	VolumeName() string
+	VolumeSize() uint64
+	SnapshotId() uint
+	ReadOnly() bool
+}
+
+// Manager of a device accessed directly.
+type Local struct {
+	device string
+	opts   []dbs.Option
+}
+
+// Return a manager calling the dbs package. Options apply to opened volumes.
+func NewLocal(device string, opts ...dbs.Option) *Local {
+	return &Local{device: device, opts: opts}
+}
+
+func (l *Local) GetDeviceInfo() (*dbs.DeviceInfo, error) {
+	return dbs.GetDeviceInfo(l.device)
+}
+
+func (l *Local) GetDeviceSnapshotView() (*dbs.DeviceSnapshotView, error) {
+	return dbs.GetDeviceSnapshotView(l.device)
+}
+
+func (l *Local) GetVolumeInfo() ([]dbs.VolumeInfo, error) {
+	return dbs.GetVolumeInfo(l.device)
+}
+
+func (l *Local) GetSnapshotInfo(volumeName string) ([]dbs.SnapshotInfo, error) {
+	return dbs.GetSnapshotInfo(l.device, volumeName)
+}
+
+func (l *Local) ListAllSnapshots() ([]dbs.SnapshotInfo, error) {
+	return dbs.ListAllSnapshots(l.device)
+}
+
+func (l *Local) ListSnapshots(q *dbs.SnapshotQuery) ([]dbs.SnapshotInfo, uint, error) {
+	return dbs.ListSnapshots(l.device, q)
+}
+
+func (l *Local) ExportCatalog() (*dbs.SnapshotCatalog, error) {
+	return dbs.ExportCatalog(l.device)
+}
+
+func (l *Local) ImportCatalog(catalog *dbs.SnapshotCatalog) (*dbs.CatalogImport, error) {
+	return dbs.ImportCatalog(l.device, catalog)
+}
+
+func (l *Local) CreateVolume(volumeName string, volumeSize uint64) (*dbs.VolumeInfo, error) {
+	return dbs.CreateVolume(l.device, volumeName, volumeSize)
+}
+
+func (l *Local) RenameVolume(volumeName string, newVolumeName string) error {
+	return dbs.RenameVolume(l.device, volumeName, newVolumeName)
+}
+
+func (l *Local) DeleteVolume(volumeName string) error {
+	return dbs.DeleteVolume(l.device, volumeName)
+}
+
+func (l *Local) CreateSnapshot(volumeName string, opts *dbs.SnapshotOptions) (uint, error) {
+	return dbs.CreateSnapshot(l.device, volumeName, opts)
+}
+
+func (l *Local) CloneSnapshot(newVolumeName string, snapshotId uint) (*dbs.VolumeInfo, error) {
+	return dbs.CloneSnapshot(l.device, newVolumeName, snapshotId)
+}
+
+func (l *Local) CloneSnapshotJob(newVolumeName string, snapshotId uint, ranges []dbs.VolumeRange, opts *dbs.CloneOptions) (*dbs.VolumeInfo, *dbs.JobInfo, error) {
+	return dbs.CloneSnapshotJob(l.device, newVolumeName, snapshotId, ranges, opts)
+}
+
+// Return the jobs of the device, including those of other processes.
+func (l *Local) ListJobs() ([]dbs.JobInfo, error) {
+	return dbs.ListJobs(l.device)
+}
+
+func (l *Local) GetJob(jobId uint64) (*dbs.JobInfo, error) {
+	return dbs.GetJob(l.device, jobId)
+}
+
+func (l *Local) CancelJob(jobId uint64) error {
+	return dbs.CancelJob(l.device, jobId)
+}
+
+func (l *Local) ResumeJob(jobId uint64) (*dbs.JobInfo, error) {
+	return dbs.ResumeJob(l.device, jobId)
+}
+
+func (l *Local) DeleteSnapshot(snapshotId uint) error {
+	return dbs.DeleteSnapshot(l.device, snapshotId)
+}
+
+func (l *Local) OpenVolume(volumeName string) (Volume, error) {
+	return dbs.OpenVolume(l.device, volumeName, l.opts...)
+}
+
+func (l *Local) OpenSnapshot(snapshotId uint) (Volume, error) {
+	return dbs.OpenSnapshot(l.device, snapshotId, l.opts...)
+}
+
+func (l *Local) VacuumDevice() error {
+	return dbs.VacuumDevice(l.device)
+}
+
+// Receive events for changes made by this process, as with dbs.Watch.
+func (l *Local) Watch(opts *dbs.WatchOptions) (<-chan dbs.Event, func(), error) {
+	events, cancel := dbs.Watch(l.device, opts)
+	return events, cancel, nil
+}
+
+// Manager of a device served by the management daemon.
+type Client struct {
+	url     string
+	http    *http.Client
+	apiKey  string
+	mu      sync.Mutex
+	version uint // Negotiated protocol version, zero until known
+}
+
+type ClientOption func(*Client)
+
+// Identify to the daemon with an API key.
+func WithAPIKey(key string) ClientOption {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// Send requests with the given HTTP client, for example one presenting a TLS client certificate.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// Return a manager for the daemon at the given base URL (e.g. "http://localhost:10810").
+func New(baseURL string, opts ...ClientOption) *Client {
+	c := &Client{url: strings.TrimSuffix(baseURL, "/") + API_PREFIX, http: &http.Client{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Return the protocol version used with the daemon, asking it on first use. Daemons predating negotiation
+// speak version 1.
+func (c *Client) ProtocolVersion() (uint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != 0 {
+		return c.version, nil
+	}
+	var vr VersionResponse
+	var re *RemoteError
+	if _, err := c.request(http.MethodGet, "/version", nil, nil, &vr); errors.As(err, &re) && re.Code == "no_route" {
+		vr = VersionResponse{ProtocolVersion: 1, MinProtocolVersion: 1}
+	} else if err != nil {
+		return 0, err
+	}
+	if vr.MinProtocolVersion > PROTOCOL_VERSION {
+		return 0, fmt.Errorf("%w: daemon serves versions %v to %v, client speaks %v", ErrUnsupportedProtocol, vr.MinProtocolVersion, vr.ProtocolVersion, PROTOCOL_VERSION)
+	}
+	c.version = min(vr.ProtocolVersion, PROTOCOL_VERSION)
+	return c.version, nil
+}
+
+// Fail with dbs.ErrUnsupportedFeature if the daemon does not speak the given protocol version, needed for what.
+func (c *Client) requireVersion(version uint, what string) error {
+	v, err := c.ProtocolVersion()
+	if err != nil {
+		return err
+	}
+	if v < version {
+		return fmt.Errorf("%w: %v need protocol version %v, daemon speaks %v", dbs.ErrUnsupportedFeature, what, version, v)
+	}
+	return nil
+}
+
+// Send a request, with the protocol version and the API key if set.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set(PROTOCOL_HEADER, strconv.Itoa(PROTOCOL_VERSION))
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	return c.http.Do(req)
+}
+
+// Send a request and decode the response into out, which may be nil. A []byte body is sent as is, other
+// non-nil bodies as JSON.
+func (c *Client) call(method string, path string, query url.Values, body any, out any) error {
+	_, err := c.request(method, path, query, body, out)
+	return err
+}
+
+// Send a request as with call, also returning the headers of the response.
+func (c *Client) request(method string, path string, query url.Values, body any, out any) (http.Header, error) {
+	var r io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		r = bytes.NewReader(b)
+		contentType = "application/octet-stream"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	u := c.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, responseError(resp)
+	}
+	switch o := out.(type) {
+	case nil:
+		return resp.Header, nil
+	case []byte:
+		if _, err := io.ReadFull(resp.Body, o); err != nil {
+			return nil, fmt.Errorf("short read: %w", err)
+		}
+		return resp.Header, nil
+	default:
+		return resp.Header, json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+// Return the error in a failed response.
+func responseError(resp *http.Response) error {
+	var er ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
+		return fmt.Errorf("request failed: %v", resp.Status)
+	}
+	re := &RemoteError{Message: er.Error, Code: er.Code}
+	// Bare library errors are returned as is, for callers comparing them directly
+	if err := re.Unwrap(); err != nil && err.Error() == re.Message {
+		return err
+	}
+	return re
+}
+
+func (c *Client) GetDeviceInfo() (*dbs.DeviceInfo, error) {
+	di := &dbs.DeviceInfo{}
+	if err := c.call(http.MethodGet, "/device", nil, nil, di); err != nil {
+		return nil, err
+	}
+	return di, nil
+}
+
+// Return a consistent view of the metadata of the device. Needs protocol version 5.
+func (c *Client) GetDeviceSnapshotView() (*dbs.DeviceSnapshotView, error) {
+	if err := c.requireVersion(5, "device views"); err != nil {
+		return nil, err
+	}
+	view := &dbs.DeviceSnapshotView{}
+	if err := c.call(http.MethodGet, "/device/view", nil, nil, view); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+func (c *Client) GetVolumeInfo() ([]dbs.VolumeInfo, error) {
+	var vi []dbs.VolumeInfo
+	if err := c.call(http.MethodGet, "/volumes", nil, nil, &vi); err != nil {
+		return nil, err
+	}
+	return vi, nil
+}
+
+func (c *Client) GetSnapshotInfo(volumeName string) ([]dbs.SnapshotInfo, error) {
+	var si []dbs.SnapshotInfo
+	if err := c.call(http.MethodGet, "/volumes/"+url.PathEscape(volumeName)+"/snapshots", nil, nil, &si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+func (c *Client) ListAllSnapshots() ([]dbs.SnapshotInfo, error) {
+	var si []dbs.SnapshotInfo
+	if err := c.call(http.MethodGet, "/snapshots", nil, nil, &si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// List snapshots matching a query on the daemon. Needs protocol version 2.
+func (c *Client) ListSnapshots(q *dbs.SnapshotQuery) ([]dbs.SnapshotInfo, uint, error) {
+	if err := c.requireVersion(2, "snapshot queries"); err != nil {
+		return nil, 0, err
+	}
+	if q == nil {
+		q = &dbs.SnapshotQuery{}
+	}
+	// Always send a query, so that the daemon does not take it for a listing of all snapshots
+	query := url.Values{"start": {strconv.FormatUint(uint64(q.StartId), 10)}}
+	if q.VolumeName != "" {
+		query.Set("volume", q.VolumeName)
+	}
+	for key, value := range q.Labels {
+		query.Add("label", key+"="+value)
+	}
+	if !q.After.IsZero() {
+		query.Set("after", q.After.Format(time.RFC3339))
+	}
+	if !q.Before.IsZero() {
+		query.Set("before", q.Before.Format(time.RFC3339))
+	}
+	if q.Limit != 0 {
+		query.Set("limit", strconv.FormatUint(uint64(q.Limit), 10))
+	}
+	var si []dbs.SnapshotInfo
+	header, err := c.request(http.MethodGet, "/snapshots", query, nil, &si)
+	if err != nil {
+		return nil, 0, err
+	}
+	var next uint64
+	if h := header.Get(NEXT_START_HEADER); h != "" {
+		if next, err = strconv.ParseUint(h, 10, 64); err != nil {
+			return nil, 0, fmt.Errorf("invalid %v: %v", NEXT_START_HEADER, h)
+		}
+	}
+	return si, uint(next), nil
+}
+
+func (c *Client) ExportCatalog() (*dbs.SnapshotCatalog, error) {
+	catalog := &dbs.SnapshotCatalog{}
+	if err := c.call(http.MethodGet, "/catalog", nil, nil, catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func (c *Client) ImportCatalog(catalog *dbs.SnapshotCatalog) (*dbs.CatalogImport, error) {
+	result := &dbs.CatalogImport{}
+	if err := c.call(http.MethodPost, "/catalog", nil, catalog, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) CreateVolume(volumeName string, volumeSize uint64) (*dbs.VolumeInfo, error) {
+	vi := &dbs.VolumeInfo{}
+	req := &CreateVolumeRequest{VolumeName: volumeName, VolumeSize: volumeSize}
+	if err := c.call(http.MethodPost, "/volumes", nil, req, vi); err != nil {
+		return nil, err
+	}
+	return vi, nil
+}
+
+func (c *Client) RenameVolume(volumeName string, newVolumeName string) error {
+	req := &RenameVolumeRequest{NewVolumeName: newVolumeName}
+	return c.call(http.MethodPost, "/volumes/"+url.PathEscape(volumeName)+"/rename", nil, req, nil)
+}
+
+// Vacuum the device on the daemon. Volumes it has open, including NBD exports, are kept open meanwhile.
+func (c *Client) VacuumDevice() error {
+	return c.call(http.MethodPost, "/device/vacuum", nil, nil, nil)
+}
+
+func (c *Client) DeleteVolume(volumeName string) error {
+	return c.call(http.MethodDelete, "/volumes/"+url.PathEscape(volumeName), nil, nil, nil)
+}
+
+func (c *Client) CreateSnapshot(volumeName string, opts *dbs.SnapshotOptions) (uint, error) {
+	if opts == nil {
+		opts = &dbs.SnapshotOptions{}
+	}
+	var sr SnapshotResponse
+	if err := c.call(http.MethodPost, "/volumes/"+url.PathEscape(volumeName)+"/snapshots", nil, opts, &sr); err != nil {
+		return 0, err
+	}
+	return sr.SnapshotId, nil
+}
+
+func (c *Client) CloneSnapshot(newVolumeName string, snapshotId uint) (*dbs.VolumeInfo, error) {
+	vi := &dbs.VolumeInfo{}
+	req := &CloneSnapshotRequest{NewVolumeName: newVolumeName}
+	if err := c.call(http.MethodPost, "/snapshots/"+strconv.Itoa(int(snapshotId))+"/clone", nil, req, vi); err != nil {
+		return nil, err
+	}
+	return vi, nil
+}
+
+// Clone a snapshot in the background on the daemon. Needs protocol version 3.
+func (c *Client) CloneSnapshotJob(newVolumeName string, snapshotId uint, ranges []dbs.VolumeRange, opts *dbs.CloneOptions) (*dbs.VolumeInfo, *dbs.JobInfo, error) {
+	if err := c.requireVersion(3, "background clones"); err != nil {
+		return nil, nil, err
+	}
+	req := &CloneJobRequest{NewVolumeName: newVolumeName, Ranges: ranges}
+	if opts != nil {
+		req.Options = *opts
+	}
+	var resp CloneJobResponse
+	if err := c.call(http.MethodPost, "/snapshots/"+strconv.Itoa(int(snapshotId))+"/clone_job", nil, req, &resp); err != nil {
+		return nil, nil, err
+	}
+	return &resp.Volume, &resp.Job, nil
+}
+
+// Return the jobs of the device, as seen by the daemon. Needs protocol version 3.
+func (c *Client) ListJobs() ([]dbs.JobInfo, error) {
+	if err := c.requireVersion(3, "jobs"); err != nil {
+		return nil, err
+	}
+	var ji []dbs.JobInfo
+	if err := c.call(http.MethodGet, "/jobs", nil, nil, &ji); err != nil {
+		return nil, err
+	}
+	return ji, nil
+}
+
+func (c *Client) GetJob(jobId uint64) (*dbs.JobInfo, error) {
+	if err := c.requireVersion(3, "jobs"); err != nil {
+		return nil, err
+	}
+	ji := &dbs.JobInfo{}
+	if err := c.call(http.MethodGet, "/jobs/"+strconv.FormatUint(jobId, 10), nil, nil, ji); err != nil {
+		return nil, err
+	}
+	return ji, nil
+}
+
+func (c *Client) CancelJob(jobId uint64) error {
+	if err := c.requireVersion(3, "jobs"); err != nil {
+		return err
+	}
+	return c.call(http.MethodDelete, "/jobs/"+strconv.FormatUint(jobId, 10), nil, nil, nil)
+}
+
+// Continue an interrupted job on the daemon. Needs protocol version 4.
+func (c *Client) ResumeJob(jobId uint64) (*dbs.JobInfo, error) {
+	if err := c.requireVersion(4, "resuming jobs"); err != nil {
+		return nil, err
+	}
+	ji := &dbs.JobInfo{}
+	if err := c.call(http.MethodPost, "/jobs/"+strconv.FormatUint(jobId, 10)+"/resume", nil, nil, ji); err != nil {
+		return nil, err
+	}
+	return ji, nil
+}
+
+func (c *Client) DeleteSnapshot(snapshotId uint) error {
+	return c.call(http.MethodDelete, "/snapshots/"+strconv.Itoa(int(snapshotId)), nil, nil, nil)
+}
+
+func (c *Client) OpenVolume(volumeName string) (Volume, error) {
+	return c.open("/volumes/" + url.PathEscape(volumeName) + "/open")
+}
+
+func (c *Client) OpenSnapshot(snapshotId uint) (Volume, error) {
+	return c.open("/snapshots/" + strconv.Itoa(int(snapshotId)) + "/open")
+}
+
+func (c *Client) open(path string) (Volume, error) {
+	rv := &remoteVolume{c: c}
+	if err := c.call(http.MethodPost, path, nil, nil, &rv.h); err != nil {
+		return nil, err
+	}
+	rv.path = "/handles/" + strconv.FormatUint(rv.h.Handle, 10)
+	return rv, nil
+}
+
+// Issue a token for attaching an NBD export of the daemon, as NAME#TOKEN. A zero TTL means the token does not
+// expire. Only available on daemons checking export tokens.
+func (c *Client) CreateExportToken(export string, once bool, ttl time.Duration) (*ExportToken, error) {
+	et := &ExportToken{}
+	req := &CreateTokenRequest{Export: export, Once: once, TTL: ttl}
+	if err := c.call(http.MethodPost, "/tokens", nil, req, et); err != nil {
+		return nil, err
+	}
+	return et, nil
+}
+
+func (c *Client) RevokeExportToken(token string) error {
+	return c.call(http.MethodDelete, "/tokens/"+url.PathEscape(token), nil, nil, nil)
+}
+
+// List the NBD connections to the daemon, with their request statistics. Needs protocol version 6.
+func (c *Client) ListConnections() ([]ConnectionStats, error) {
+	if err := c.requireVersion(6, "connections"); err != nil {
+		return nil, err
+	}
+	var cs []ConnectionStats
+	if err := c.call(http.MethodGet, "/connections", nil, nil, &cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Receive the events of the device on the daemon, for changes made by it, until the returned function is called.
+// The channel is also closed if the connection to the daemon is lost.
+func (c *Client) Watch(opts *dbs.WatchOptions) (<-chan dbs.Event, func(), error) {
+	if opts == nil {
+		opts = &dbs.WatchOptions{}
+	}
+	query := url.Values{"space_threshold": {strconv.FormatUint(uint64(opts.SpaceThreshold), 10)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/events?"+query.Encode(), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer cancel()
+		defer resp.Body.Close()
+		return nil, nil, responseError(resp)
+	}
+	buffer := opts.Buffer
+	if buffer == 0 {
+		buffer = dbs.DEFAULT_WATCH_BUFFER
+	}
+	events := make(chan dbs.Event, buffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(events)
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var e dbs.Event
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, func() {
+		cancel()
+		<-done
+	}, nil
+}
@@ -0,0 +1,301 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/client"
+	"github.com/Kampadais/dbs/pkg/server"
+)
+
+const (
+	MEGABYTE = 1024 * 1024
+	GIGABYTE = MEGABYTE * 1024
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+// Run the same calls through a manager, checking that both modes behave alike.
+func exerciseManager(c *C, m client.Manager) {
+	events, cancel, err := m.Watch(nil)
+	c.Assert(err, IsNil)
+	_, err = m.CreateVolume("vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, err = m.CreateVolume("vol1", GIGABYTE)
+	c.Assert(errors.Is(err, dbs.ErrVolumeExists), Equals, true)
+	err = m.DeleteVolume("vol2")
+	c.Assert(errors.Is(err, dbs.ErrVolumeNotFound), Equals, true)
+
+	// Write, snapshot and read back
+	vol, err := m.OpenVolume("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(vol.VolumeSize(), Equals, uint64(GIGABYTE))
+	data := bytes.Repeat([]byte{0xab}, 2*dbs.BLOCK_SIZE)
+	c.Assert(vol.WriteAt(data, dbs.EXTENT_SIZE-dbs.BLOCK_SIZE, true), IsNil)
+	c.Assert(vol.Sync(), IsNil)
+	snapshotId, err := m.CreateSnapshot("vol1", &dbs.SnapshotOptions{Labels: map[string]string{"k": "v"}})
+	c.Assert(err, IsNil)
+	c.Assert(vol.Refresh(), IsNil)
+	c.Assert(vol.SnapshotId(), Equals, snapshotId)
+	buf := make([]byte, len(data))
+	c.Assert(vol.ReadAt(buf, dbs.EXTENT_SIZE-dbs.BLOCK_SIZE), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(vol.WriteAt(data, 0, false), Equals, dbs.ErrMetadataNeedsUpdate)
+	c.Assert(vol.UnmapAt(dbs.BLOCK_SIZE, dbs.EXTENT_SIZE-dbs.BLOCK_SIZE), IsNil)
+	c.Assert(vol.CloseVolume(), IsNil)
+
+	si, err := m.GetSnapshotInfo("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(si, HasLen, 2)
+	c.Assert(si[0].Labels, DeepEquals, map[string]string{"k": "v"})
+	catalog, err := m.ExportCatalog()
+	c.Assert(err, IsNil)
+	c.Assert(catalog.Snapshots, HasLen, 2)
+	catalog.Snapshots[1].Name = "daily"
+	result, err := m.ImportCatalog(catalog)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, HasLen, 2)
+	c.Assert(result.Skipped, HasLen, 0)
+
+	// The clone holds the data as of the snapshot
+	_, err = m.CloneSnapshot("vol2", si[1].SnapshotId)
+	c.Assert(err, IsNil)
+	snap, err := m.OpenSnapshot(si[1].SnapshotId)
+	c.Assert(err, IsNil)
+	c.Assert(snap.ReadOnly(), Equals, true)
+	c.Assert(snap.ReadAt(buf, dbs.EXTENT_SIZE-dbs.BLOCK_SIZE), IsNil)
+	c.Assert(buf, DeepEquals, data)
+	c.Assert(snap.CloseVolume(), IsNil)
+	c.Assert(m.RenameVolume("vol2", "vol3"), IsNil)
+	vi, err := m.GetVolumeInfo()
+	c.Assert(err, IsNil)
+	c.Assert(vi, HasLen, 2)
+	c.Assert(vi[1].VolumeName, Equals, "vol3")
+	all, err := m.ListAllSnapshots()
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 3)
+	view, err := m.GetDeviceSnapshotView()
+	c.Assert(err, IsNil)
+	c.Assert(view.Volumes, DeepEquals, vi)
+	c.Assert(view.Snapshots, DeepEquals, all)
+	c.Assert(view.Usage, HasLen, 2)
+	c.Assert(view.Usage["vol1"], HasLen, 2)
+	page, next, err := m.ListSnapshots(&dbs.SnapshotQuery{Labels: map[string]string{"k": "v"}})
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, uint(0))
+	c.Assert(page, HasLen, 1)
+	c.Assert(page[0].SnapshotId, Equals, si[0].SnapshotId)
+	page, next, err = m.ListSnapshots(&dbs.SnapshotQuery{Limit: 2})
+	c.Assert(err, IsNil)
+	c.Assert(page, DeepEquals, all[:2])
+	c.Assert(next, Equals, all[2].SnapshotId)
+
+	// Background clones are followed as jobs
+	_, job, err := m.CloneSnapshotJob("vol4", si[1].SnapshotId, nil, &dbs.CloneOptions{MaxIops: 1000})
+	c.Assert(err, IsNil)
+	for job.State == dbs.JOB_RUNNING {
+		time.Sleep(10 * time.Millisecond)
+		job, err = m.GetJob(job.JobId)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(job.State, Equals, dbs.JOB_COMPLETED)
+	jobs, err := m.ListJobs()
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(m.CancelJob(job.JobId), IsNil)
+	_, err = m.ResumeJob(job.JobId)
+	c.Assert(errors.Is(err, dbs.ErrJobNotResumable), Equals, true)
+	_, err = m.GetJob(job.JobId + 1)
+	c.Assert(errors.Is(err, dbs.ErrJobNotFound), Equals, true)
+
+	c.Assert(m.DeleteSnapshot(si[1].SnapshotId), IsNil)
+	c.Assert(m.DeleteVolume("vol1"), IsNil)
+	c.Assert(m.DeleteVolume("vol3"), IsNil)
+	c.Assert(m.DeleteVolume("vol4"), IsNil)
+	c.Assert(m.VacuumDevice(), IsNil)
+	di, err := m.GetDeviceInfo()
+	c.Assert(err, IsNil)
+	c.Assert(di.VolumeCount, Equals, uint(0))
+	c.Assert(di.AllocatedDeviceExtents, Equals, uint(0))
+
+	// Changes are seen by watchers
+	expected := []string{
+		dbs.EVENT_VOLUME_CREATED,
+		dbs.EVENT_SNAPSHOT_CREATED,
+		dbs.EVENT_VOLUME_CLONED,
+		dbs.EVENT_VOLUME_RENAMED,
+		dbs.EVENT_VOLUME_CLONED,
+		dbs.EVENT_SNAPSHOT_DELETED,
+		dbs.EVENT_VOLUME_DELETED,
+		dbs.EVENT_VOLUME_DELETED,
+		dbs.EVENT_VOLUME_DELETED,
+	}
+	for _, eventType := range expected {
+		select {
+		case e := <-events:
+			c.Assert(e.Type, Equals, eventType)
+		case <-time.After(time.Second):
+			c.Fatalf("no %v event", eventType)
+		}
+	}
+	cancel()
+}
+
+func newDevice(c *C, name string) string {
+	device, err := dbs.CreateMemoryDevice(name, 100*MEGABYTE)
+	c.Assert(err, IsNil)
+	c.Assert(dbs.InitDevice(device), IsNil)
+	return device
+}
+
+func (s *ClientSuite) TestLocal(c *C) {
+	device := newDevice(c, "local")
+	defer dbs.RemoveMemoryDevice("local")
+	exerciseManager(c, client.NewLocal(device))
+}
+
+func (s *ClientSuite) TestRemote(c *C) {
+	device := newDevice(c, "remote")
+	defer dbs.RemoveMemoryDevice("remote")
+	srv := server.New(device)
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	m := client.New(ts.URL)
+	exerciseManager(c, m)
+
+	// Handles are gone once closed
+	vol, err := m.CreateVolume("vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	v, err := m.OpenVolume(vol.VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(v.CloseVolume(), IsNil)
+	c.Assert(errors.Is(v.Sync(), dbs.ErrVolumeClosed), Equals, true)
+	_, err = m.CreateVolume("", GIGABYTE)
+	c.Assert(errors.Is(err, dbs.ErrInvalidVolumeName), Equals, true)
+}
+
+func (s *ClientSuite) TestPolicy(c *C) {
+	device := newDevice(c, "policy")
+	defer dbs.RemoveMemoryDevice("policy")
+	p := server.NewPolicy()
+	p.AddKey("view", server.ROLE_VIEWER)
+	p.AddKey("operate", server.ROLE_OPERATOR)
+	p.AddKey("admin", server.ROLE_ADMIN)
+	srv := server.New(device)
+	srv.SetPolicy(p)
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	_, err := client.New(ts.URL).GetVolumeInfo()
+	c.Assert(errors.Is(err, client.ErrUnauthorized), Equals, true)
+	// The version is negotiated before identifying
+	_, err = client.New(ts.URL).ProtocolVersion()
+	c.Assert(err, IsNil)
+	_, err = client.New(ts.URL, client.WithAPIKey("wrong")).GetVolumeInfo()
+	c.Assert(errors.Is(err, client.ErrUnauthorized), Equals, true)
+
+	// Viewers may only query, operators may not delete
+	viewer := client.New(ts.URL, client.WithAPIKey("view"))
+	operator := client.New(ts.URL, client.WithAPIKey("operate"))
+	admin := client.New(ts.URL, client.WithAPIKey("admin"))
+	_, err = viewer.CreateVolume("vol1", GIGABYTE)
+	c.Assert(errors.Is(err, client.ErrForbidden), Equals, true)
+	_, err = operator.CreateVolume("vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	vi, err := viewer.GetVolumeInfo()
+	c.Assert(err, IsNil)
+	c.Assert(vi, HasLen, 1)
+	_, err = viewer.OpenVolume("vol1")
+	c.Assert(errors.Is(err, client.ErrForbidden), Equals, true)
+	_, cancel, err := viewer.Watch(nil)
+	c.Assert(err, IsNil)
+	cancel()
+	err = operator.DeleteVolume("vol1")
+	c.Assert(errors.Is(err, client.ErrForbidden), Equals, true)
+	c.Assert(admin.DeleteVolume("vol1"), IsNil)
+	err = operator.VacuumDevice()
+	c.Assert(errors.Is(err, client.ErrForbidden), Equals, true)
+	c.Assert(admin.VacuumDevice(), IsNil)
+}
+
+func (s *ClientSuite) TestExportTokens(c *C) {
+	device := newDevice(c, "tokens")
+	defer dbs.RemoveMemoryDevice("tokens")
+	srv := server.New(device)
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	m := client.New(ts.URL)
+	// Not served unless the daemon checks tokens
+	_, err := m.CreateExportToken("vol1", true, 0)
+	c.Assert(err, NotNil)
+
+	// One-time tokens are only consumed when redeemed
+	tokens := server.NewTokens()
+	srv.SetTokens(tokens)
+	et, err := m.CreateExportToken("vol1", true, 0)
+	c.Assert(err, IsNil)
+	c.Assert(tokens.Check("vol2", et.Token, true), Equals, false)
+	c.Assert(tokens.Check("vol1", et.Token, false), Equals, true)
+	c.Assert(tokens.Check("vol1", et.Token, true), Equals, true)
+	c.Assert(tokens.Check("vol1", et.Token, true), Equals, false)
+
+	et, err = m.CreateExportToken("vol1", false, time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(tokens.Check("vol1", et.Token, true), Equals, true)
+	c.Assert(tokens.Check("vol1", et.Token, true), Equals, true)
+	c.Assert(m.RevokeExportToken(et.Token), IsNil)
+	c.Assert(tokens.Check("vol1", et.Token, true), Equals, false)
+	c.Assert(errors.Is(m.RevokeExportToken(et.Token), client.ErrTokenNotFound), Equals, true)
+}
+
+func (s *ClientSuite) TestConnections(c *C) {
+	device := newDevice(c, "connections")
+	defer dbs.RemoveMemoryDevice("connections")
+	srv := server.New(device)
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	m := client.New(ts.URL)
+	// Not served unless the daemon serves NBD
+	_, err := m.ListConnections()
+	c.Assert(err, NotNil)
+
+	connectedAt := time.Now().UTC()
+	srv.SetConnections(func() []client.ConnectionStats {
+		return []client.ConnectionStats{{Id: 1, RemoteAddr: "10.0.0.1:40000", Export: "vol1", ConnectedAt: connectedAt, Reads: 2, BytesRead: 8192, ReadLatency: time.Millisecond}}
+	})
+	cs, err := m.ListConnections()
+	c.Assert(err, IsNil)
+	c.Assert(cs, HasLen, 1)
+	c.Assert(cs[0].RemoteAddr, Equals, "10.0.0.1:40000")
+	c.Assert(cs[0].ConnectedAt.Equal(connectedAt), Equals, true)
+	c.Assert(cs[0].BytesRead, Equals, uint64(8192))
+	c.Assert(cs[0].ReadLatency, Equals, time.Millisecond)
+}
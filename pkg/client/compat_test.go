@@ -0,0 +1,171 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/client"
+	"github.com/Kampadais/dbs/pkg/server"
+)
+
+// Request of an older client, with the fields it relies on in the response.
+type compatRequest struct {
+	method string
+	path   string
+	body   string
+	status int
+	fields []string
+}
+
+// Requests of version 1 clients, which daemons must keep serving as is.
+var compatV1 = []compatRequest{
+	{"GET", "/device", "", 200, []string{"Version", "DeviceSize", "VolumeCount", "AllocatedDeviceExtents", "TotalDeviceExtents"}},
+	{"POST", "/volumes", `{"VolumeName":"vol1","VolumeSize":1073741824}`, 200, []string{"VolumeName", "VolumeSize", "SnapshotId", "CreatedAt"}},
+	{"POST", "/volumes", `{"VolumeName":"vol1","VolumeSize":1073741824}`, 409, []string{"Error", "Code"}},
+	{"GET", "/volumes", "", 200, []string{"VolumeName", "VolumeSize", "SnapshotId", "SnapshotCount"}},
+	{"POST", "/volumes/vol1/snapshots", `{"Labels":{"k":"v"},"Name":"daily"}`, 200, []string{"SnapshotId"}},
+	{"GET", "/volumes/vol1/snapshots", "", 200, []string{"SnapshotId", "ParentSnapshotId", "CreatedAt", "Labels", "Name"}},
+	{"GET", "/snapshots", "", 200, []string{"SnapshotId", "VolumeName"}},
+	{"GET", "/snapshots?volume=vol2", "", 200, []string{"SnapshotId"}},
+	{"POST", "/snapshots/daily/clone", `{"NewVolumeName":"vol2"}`, 200, []string{"VolumeName", "SnapshotId"}},
+	{"POST", "/volumes/vol2/rename", `{"NewVolumeName":"vol3"}`, 200, nil},
+	{"POST", "/volumes/vol1/open", "", 200, []string{"Handle", "VolumeName", "VolumeSize", "SnapshotId", "ReadOnly"}},
+	{"GET", "/catalog", "", 200, []string{"CatalogVersion", "Snapshots"}},
+	{"DELETE", "/volumes/vol3", "", 200, nil},
+	{"DELETE", "/volumes/vol4", "", 404, []string{"Error", "Code"}},
+	{"POST", "/device/vacuum", "", 200, nil},
+}
+
+// Send a request as a client speaking the given version, with no header for zero, and return the response fields.
+func compatCall(c *C, url string, version string, req compatRequest) map[string]any {
+	var body io.Reader
+	if req.body != "" {
+		body = strings.NewReader(req.body)
+	}
+	r, err := http.NewRequest(req.method, url+client.API_PREFIX+req.path, body)
+	c.Assert(err, IsNil)
+	if version != "" {
+		r.Header.Set(client.PROTOCOL_HEADER, version)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, req.status, Commentf("%v %v", req.method, req.path))
+	data, err := io.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	if len(data) == 0 {
+		return nil
+	}
+	// Lists are checked through their first element
+	var v any
+	c.Assert(json.Unmarshal(data, &v), IsNil)
+	if list, ok := v.([]any); ok {
+		c.Assert(list, Not(HasLen), 0, Commentf("%v %v", req.method, req.path))
+		v = list[0]
+	}
+	fields, ok := v.(map[string]any)
+	c.Assert(ok, Equals, true, Commentf("%v %v", req.method, req.path))
+	return fields
+}
+
+func (s *ClientSuite) TestCompatV1(c *C) {
+	// Clients predating negotiation send no version header
+	for _, version := range []string{"", "1"} {
+		device := newDevice(c, "compat")
+		srv := server.New(device)
+		ts := httptest.NewServer(srv)
+		for _, req := range compatV1 {
+			fields := compatCall(c, ts.URL, version, req)
+			for _, field := range req.fields {
+				_, ok := fields[field]
+				c.Assert(ok, Equals, true, Commentf("%v %v: no %v", req.method, req.path, field))
+			}
+		}
+		ts.Close()
+		srv.Close()
+		dbs.RemoveMemoryDevice("compat")
+	}
+}
+
+func (s *ClientSuite) TestProtocolNegotiation(c *C) {
+	device := newDevice(c, "negotiation")
+	defer dbs.RemoveMemoryDevice("negotiation")
+	srv := server.New(device)
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// Requests are served at the lower version, and versions no longer served are refused
+	for version, expected := range map[string]string{"": "1", "1": "1", "2": "2", "99": strconv.Itoa(client.PROTOCOL_VERSION)} {
+		r, err := http.NewRequest("GET", ts.URL+client.API_PREFIX+"/volumes", nil)
+		c.Assert(err, IsNil)
+		if version != "" {
+			r.Header.Set(client.PROTOCOL_HEADER, version)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get(client.PROTOCOL_HEADER), Equals, expected)
+	}
+	fields := compatCall(c, ts.URL, "0", compatRequest{"GET", "/volumes", "", 400, nil})
+	c.Assert(fields["Code"], Equals, "unsupported_protocol")
+	compatCall(c, ts.URL, "x", compatRequest{"GET", "/volumes", "", 400, nil})
+
+	m := client.New(ts.URL)
+	version, err := m.ProtocolVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, uint(client.PROTOCOL_VERSION))
+}
+
+func (s *ClientSuite) TestOlderDaemon(c *C) {
+	device := newDevice(c, "older")
+	defer dbs.RemoveMemoryDevice("older")
+	srv := server.New(device)
+	defer srv.Close()
+	// A daemon predating negotiation, which has no version endpoint and ignores the header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == client.API_PREFIX+"/version" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&client.ErrorResponse{Error: "no such endpoint", Code: "no_route"})
+			return
+		}
+		r.Header.Del(client.PROTOCOL_HEADER)
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	m := client.New(ts.URL)
+	version, err := m.ProtocolVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, uint(1))
+	_, err = m.CreateVolume("vol1", GIGABYTE)
+	c.Assert(err, IsNil)
+	_, _, err = m.ListSnapshots(&dbs.SnapshotQuery{VolumeName: "vol1"})
+	c.Assert(errors.Is(err, dbs.ErrUnsupportedFeature), Equals, true)
+	all, err := m.ListAllSnapshots()
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 1)
+}
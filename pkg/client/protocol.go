@@ -0,0 +1,239 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Kampadais/dbs"
+)
+
+// HTTP API of the management daemon. Requests and responses are JSON, except for volume data, which is sent
+// as is. Paths are relative to API_PREFIX, and snapshots in them are given by id or name:
+//
+//	GET    /device                         DeviceInfo
+//	POST   /device/vacuum
+//	GET    /volumes                        []VolumeInfo
+//	POST   /volumes                        CreateVolumeRequest -> VolumeInfo
+//	DELETE /volumes/NAME
+//	POST   /volumes/NAME/rename            RenameVolumeRequest
+//	GET    /volumes/NAME/snapshots         []SnapshotInfo
+//	POST   /volumes/NAME/snapshots         SnapshotOptions -> SnapshotResponse
+//	POST   /volumes/NAME/open              -> VolumeHandle
+//	GET    /version                        VersionResponse, served to any client
+//	GET    /snapshots                      []SnapshotInfo, of all volumes
+//	GET    /snapshots?volume=&label=&...   []SnapshotInfo matching a SnapshotQuery (version 2)
+//	DELETE /snapshots/ID
+//	POST   /snapshots/ID/clone             CloneSnapshotRequest -> VolumeInfo
+//	POST   /snapshots/ID/open              -> VolumeHandle
+//	POST   /snapshots/ID/clone_job         CloneJobRequest -> CloneJobResponse (version 3)
+//	GET    /jobs                           []JobInfo (version 3)
+//	GET    /jobs/ID                        JobInfo (version 3)
+//	DELETE /jobs/ID                        Cancel the job (version 3)
+//	POST   /jobs/ID/resume                 -> JobInfo (version 4)
+//	GET    /catalog                        SnapshotCatalog
+//	POST   /catalog                        SnapshotCatalog -> CatalogImport
+//	GET    /handles/ID/data?offset=&length=
+//	PUT    /handles/ID/data?offset=&update_metadata=
+//	POST   /handles/ID/unmap?offset=&length=
+//	POST   /handles/ID/sync
+//	POST   /handles/ID/refresh             -> VolumeHandle
+//	DELETE /handles/ID
+//	GET    /events?space_threshold=        Event stream, one JSON object per line
+//	POST   /tokens                         CreateTokenRequest -> ExportToken
+//	DELETE /tokens/TOKEN
+//	GET    /connections                    []ConnectionStats (version 6)
+//
+// Failures are returned as ErrorResponse, with a status matching the error code.
+//
+// If the daemon has an authorization policy, clients send an API key as a bearer token in the Authorization header, or
+// present a TLS client certificate. Each identity has a role: viewers may make GET requests, except for volume data,
+// operators may also create, rename, clone, open, write, import catalogs and cancel jobs, and admins may also delete volumes and
+// snapshots, and vacuum the device. Token endpoints, only served if the daemon checks NBD export tokens, need an operator.
+// Connections are only served by daemons exporting volumes over NBD.
+// Unidentified clients get ErrUnauthorized, others ErrForbidden for requests beyond their role.
+const API_PREFIX = "/v1"
+
+// Clients send the highest protocol version they speak in the PROTOCOL_HEADER of each request, and the daemon
+// serves it at the lower of that and its own version, returned in the same header. Requests without the header
+// come from clients predating negotiation and are served at version 1. Daemons keep serving all versions from
+// MIN_PROTOCOL_VERSION, as clients are often upgraded later than the daemons they use. Versions are:
+//
+//	1  Initial API
+//	2  GET /snapshots takes the filters of a dbs.SnapshotQuery: volume=, label=KEY=VALUE (repeatable), after=
+//	   and before= (RFC 3339), start= and limit=, and returns the start of the next page in NEXT_START_HEADER,
+//	   if there are more snapshots
+//	3  Clones in the background, and the jobs endpoints
+//	4  Jobs are kept on the device and listed with those of other processes, and interrupted ones are resumed
+//	   with POST /jobs/ID/resume
+//	5  GET /device/view returns a consistent dbs.DeviceSnapshotView
+//	6  GET /connections lists the NBD connections of the daemon, with their statistics
+const (
+	PROTOCOL_VERSION     = 6
+	MIN_PROTOCOL_VERSION = 1
+	PROTOCOL_HEADER      = "Dbs-Protocol-Version"
+	NEXT_START_HEADER    = "Dbs-Next-Start"
+)
+
+var (
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden")
+	ErrTokenNotFound       = errors.New("token not found")
+	ErrUnsupportedProtocol = errors.New("unsupported protocol version")
+)
+
+type VersionResponse struct {
+	ProtocolVersion    uint // Highest version spoken by the daemon
+	MinProtocolVersion uint // Lowest version still served
+}
+
+type CreateVolumeRequest struct {
+	VolumeName string
+	VolumeSize uint64
+}
+
+type RenameVolumeRequest struct {
+	NewVolumeName string
+}
+
+type CloneSnapshotRequest struct {
+	NewVolumeName string
+}
+
+type CloneJobRequest struct {
+	NewVolumeName string
+	Ranges        []dbs.VolumeRange // Parts of the snapshot to clone, all of it if empty
+	Options       dbs.CloneOptions
+}
+
+type CloneJobResponse struct {
+	Volume dbs.VolumeInfo
+	Job    dbs.JobInfo
+}
+
+type SnapshotResponse struct {
+	SnapshotId uint
+}
+
+// A volume or snapshot opened on the daemon for I/O.
+type VolumeHandle struct {
+	Handle     uint64
+	VolumeName string
+	VolumeSize uint64
+	SnapshotId uint
+	ReadOnly   bool
+}
+
+// Token for attaching an NBD export, by asking for NAME#TOKEN as the export name.
+type ExportToken struct {
+	Token     string
+	Export    string    // Volume name, or volume@snapshotId
+	Once      bool      // Redeemed on first attach
+	ExpiresAt time.Time // Zero if it does not expire
+}
+
+type CreateTokenRequest struct {
+	Export string
+	Once   bool
+	TTL    time.Duration // Zero for no expiry
+}
+
+// NBD connection to the daemon, with the requests served on it since it was accepted. Latencies include the
+// time waiting for overlapping requests of other connections.
+type ConnectionStats struct {
+	Id           uint64
+	RemoteAddr   string
+	Export       string // Last export used, empty before the first request
+	ConnectedAt  time.Time
+	Reads        uint64
+	Writes       uint64
+	Flushes      uint64
+	Errors       uint64 // Failed requests
+	BytesRead    uint64
+	BytesWritten uint64
+	ReadLatency  time.Duration // Mean
+	WriteLatency time.Duration // Mean
+	FlushLatency time.Duration // Mean
+	MaxLatency   time.Duration // Of any request
+}
+
+type ErrorResponse struct {
+	Error string
+	Code  string
+}
+
+// Library and authorization errors with a code, so they can be matched with errors.Is on the client.
+var errorCodes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{dbs.ErrVolumeNotFound, "volume_not_found", http.StatusNotFound},
+	{dbs.ErrSnapshotNotFound, "snapshot_not_found", http.StatusNotFound},
+	{dbs.ErrVolumeExists, "volume_exists", http.StatusConflict},
+	{dbs.ErrInvalidVolumeName, "invalid_volume_name", http.StatusBadRequest},
+	{dbs.ErrSnapshotExists, "snapshot_exists", http.StatusConflict},
+	{dbs.ErrInvalidSnapshotName, "invalid_snapshot_name", http.StatusBadRequest},
+	{dbs.ErrNoSpace, "no_space", http.StatusInsufficientStorage},
+	{dbs.ErrCorrupted, "corrupted", http.StatusInternalServerError},
+	{dbs.ErrReadOnly, "read_only", http.StatusForbidden},
+	{dbs.ErrRetained, "retained", http.StatusForbidden},
+	{dbs.ErrMetadataNeedsUpdate, "metadata_needs_update", http.StatusConflict},
+	{dbs.ErrVolumeClosed, "volume_closed", http.StatusGone},
+	{dbs.ErrMediaError, "media_error", http.StatusInternalServerError},
+	{dbs.ErrMaintenance, "maintenance", http.StatusServiceUnavailable},
+	{dbs.ErrUnsupportedFeature, "unsupported_feature", http.StatusNotImplemented},
+	{dbs.ErrJobNotFound, "job_not_found", http.StatusNotFound},
+	{dbs.ErrJobNotResumable, "job_not_resumable", http.StatusConflict},
+	{dbs.ErrTooManyJobs, "too_many_jobs", http.StatusConflict},
+	{dbs.ErrShutdownPending, "shutdown_pending", http.StatusConflict},
+	{dbs.ErrInvalidLabel, "invalid_label", http.StatusBadRequest},
+	{dbs.ErrLabelSpaceExhausted, "label_space_exhausted", http.StatusInsufficientStorage},
+	{ErrUnauthorized, "unauthorized", http.StatusUnauthorized},
+	{ErrForbidden, "forbidden", http.StatusForbidden},
+	{ErrTokenNotFound, "token_not_found", http.StatusNotFound},
+	{ErrUnsupportedProtocol, "unsupported_protocol", http.StatusBadRequest},
+}
+
+// Return the code and HTTP status for an error.
+func ErrorCode(err error) (string, int) {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code, ec.status
+		}
+	}
+	return "internal", http.StatusInternalServerError
+}
+
+// Error returned by the daemon. It matches the library error with the same code.
+type RemoteError struct {
+	Message string
+	Code    string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+func (e *RemoteError) Unwrap() error {
+	for _, ec := range errorCodes {
+		if ec.code == e.Code {
+			return ec.err
+		}
+	}
+	return nil
+}
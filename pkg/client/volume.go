@@ -0,0 +1,80 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Volume opened on the daemon. Data is transferred with each call, so reads and writes should be large.
+type remoteVolume struct {
+	c    *Client
+	h    VolumeHandle
+	path string
+}
+
+func rangeQuery(offset uint64, length uint64) url.Values {
+	return url.Values{
+		"offset": {strconv.FormatUint(offset, 10)},
+		"length": {strconv.FormatUint(length, 10)},
+	}
+}
+
+func (rv *remoteVolume) ReadAt(data []byte, offset uint64) error {
+	return rv.c.call(http.MethodGet, rv.path+"/data", rangeQuery(offset, uint64(len(data))), nil, data)
+}
+
+func (rv *remoteVolume) WriteAt(data []byte, offset uint64, updateMetadata bool) error {
+	query := url.Values{
+		"offset":          {strconv.FormatUint(offset, 10)},
+		"update_metadata": {strconv.FormatBool(updateMetadata)},
+	}
+	return rv.c.call(http.MethodPut, rv.path+"/data", query, data, nil)
+}
+
+func (rv *remoteVolume) UnmapAt(length uint64, offset uint64) error {
+	return rv.c.call(http.MethodPost, rv.path+"/unmap", rangeQuery(offset, length), nil, nil)
+}
+
+func (rv *remoteVolume) Sync() error {
+	return rv.c.call(http.MethodPost, rv.path+"/sync", nil, nil, nil)
+}
+
+// Pick up snapshots taken since the volume was opened.
+func (rv *remoteVolume) Refresh() error {
+	return rv.c.call(http.MethodPost, rv.path+"/refresh", nil, nil, &rv.h)
+}
+
+func (rv *remoteVolume) CloseVolume() error {
+	return rv.c.call(http.MethodDelete, rv.path, nil, nil, nil)
+}
+
+func (rv *remoteVolume) VolumeName() string {
+	return rv.h.VolumeName
+}
+
+func (rv *remoteVolume) VolumeSize() uint64 {
+	return rv.h.VolumeSize
+}
+
+func (rv *remoteVolume) SnapshotId() uint {
+	return rv.h.SnapshotId
+}
+
+func (rv *remoteVolume) ReadOnly() bool {
+	return rv.h.ReadOnly
+}
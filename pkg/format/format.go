@@ -0,0 +1,471 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// On-disk structures of a DBS device and routines to (de)serialize them.
+//
+// All structures are stored in little endian byte order, without padding. The package has no
+// dependencies on the rest of DBS, so it can be used by external tools to parse DBS devices.
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+const (
+	MAGIC   = "DBS@393!"
+	VERSION = 0x00010F00
+
+	MAX_VOLUMES          = 256
+	MAX_SNAPSHOTS        = 65535
+	MAX_VOLUME_NAME_SIZE = 255
+	MAX_GROUPS           = 255
+	MAX_GROUP_NAME_SIZE  = 63
+
+	BLOCK_SIZE         = 4096
+	EXTENT_SIZE        = 1048576 // 1 MB
+	EXTENT_BITMAP_SIZE = 32
+
+	ALLOCATION_POLICY_DEFAULT    = 0 // Append for devices, device policy for volumes
+	ALLOCATION_POLICY_NEXT       = 1 // Append after the last allocated extent, reuse free extents when full
+	ALLOCATION_POLICY_FIRST_FIT  = 2 // Lowest free extent
+	ALLOCATION_POLICY_CONTIGUOUS = 3 // Next to the neighboring extents of the same volume
+	ALLOCATION_POLICY_STRIPED    = 4 // Spread over the device in proportion to the position in the volume
+
+	TIER_ANY  = 0 // Extents anywhere on the device
+	TIER_FAST = 1 // Extents in the fast region, at the start of the data area
+	TIER_SLOW = 2 // Extents past the fast region
+
+	SNAPSHOT_FLAG_USER_CREATED = 0x01 // Taken on user request, as opposed to by automation
+	SNAPSHOT_FLAG_ZEROED       = 0x02 // Extents are zeroed when allocated, kept by the following snapshots
+	SNAPSHOT_FLAG_SHRED        = 0x04 // Being securely deleted, so extents are overwritten when released or moved
+	SNAPSHOT_FLAG_SHRED_RANDOM = 0x08 // Extents are overwritten with random data instead of zeroes
+
+	SUPERBLOCK_FLAG_MAINTENANCE = 0x01 // Volumes may not be changed, nor extents allocated
+
+	// Features in use by a device. Code that does not know of a compatible feature may still use the device,
+	// of a read-only compatible feature only read it, and of an incompatible feature not open it at all.
+	FEATURE_INCOMPAT_RESERVED_REGION = 0x01 // A region at the end of the device is left out of the data area
+	FEATURE_COMPAT_JOB_TABLE         = 0x01 // The job table after the volume stats is initialized
+	FEATURE_RO_COMPAT_EXTENT_TIMES   = 0x01 // The last extents of the data area hold the extent time table
+	FEATURE_RO_COMPAT_RETENTION      = 0x02 // The metadata area holds the retention table, with a time set
+
+	FEATURE_COMPAT_SUPPORTED    = FEATURE_COMPAT_JOB_TABLE
+	FEATURE_RO_COMPAT_SUPPORTED = FEATURE_RO_COMPAT_EXTENT_TIMES | FEATURE_RO_COMPAT_RETENTION
+	FEATURE_INCOMPAT_SUPPORTED  = FEATURE_INCOMPAT_RESERVED_REGION
+
+	EXTENT_FLAG_PARTIAL = 0x01 // Blocks not in the bitmap are inherited from the extent of a previous snapshot
+
+	JOB_TYPE_CLONE      = 1
+	JOB_TYPE_VACUUM     = 2
+	JOB_TYPE_DEFRAGMENT = 3
+	JOB_TYPE_SCRUB      = 4
+	JOB_TYPE_SHRED      = 5
+
+	JOB_STATE_RUNNING   = 1
+	JOB_STATE_COMPLETED = 2
+	JOB_STATE_FAILED    = 3
+	JOB_STATE_CANCELLED = 4
+
+	JOB_FLAG_RANGES = 0x01 // Clone of parts of a snapshot, which cannot be resumed
+	JOB_FLAG_CANCEL = 0x02 // Cancellation requested, possibly by another process
+
+	MAX_JOB_RECORDS = 31
+
+	LABEL_REGION_SIZE    = 262144 // 256 KB
+	MAX_LABEL_KEY_SIZE   = 255
+	MAX_LABEL_VALUE_SIZE = 65535
+
+	SIZEOF_SUPERBLOCK        = 87
+	SIZEOF_VOLUME_METADATA   = 33 + MAX_VOLUME_NAME_SIZE + 1
+	SIZEOF_SNAPSHOT_METADATA = 11
+	SIZEOF_GROUP_METADATA    = 8 + MAX_GROUP_NAME_SIZE + 1
+	SIZEOF_EXTENT_METADATA   = 7 + EXTENT_BITMAP_SIZE
+	SIZEOF_LABEL_HEADER      = 5
+	SIZEOF_VOLUME_STATS      = 56
+	SIZEOF_JOB_RECORD        = 61
+	SIZEOF_EXTENT_TIME       = 4 // Seconds since the epoch, as uint32
+	SIZEOF_RETENTION_TIME    = 4 // Seconds since the epoch, as uint32
+)
+
+type Superblock struct {
+	Magic                  [8]byte
+	Version                uint32 // 16-bit major, 8-bit minor, 8-bit patch
+	AllocatedDeviceExtents uint32
+	DeviceSize             uint64
+	AllocationPolicy       uint8
+	TrashRetention         uint32    // Seconds to keep deleted volumes, zero to delete immediately
+	Generation             uint64    // Incremented whenever volume, snapshot, or extent placement changes
+	ActiveMetadata         uint8     // Copy of the metadata area holding the current metadata (0 or 1)
+	MetadataChecksums      [2]uint32 // CRC-32C of each copy of the metadata area
+	UUID                   [16]byte  // Identity of the device, set when initialized
+	Flags                  uint8
+	FastExtents            uint32 // Extents at the start of the data area on faster media, zero if not tiered
+	ReservedSize           uint64 // Bytes at the end of the device not managed by DBS, zero if none
+	FeatureCompat          uint32
+	FeatureRoCompat        uint32
+	FeatureIncompat        uint32
+}
+
+type VolumeMetadata struct {
+	SnapshotId       uint16 // Index in snapshots table + 1
+	VolumeSize       uint64
+	AllocationPolicy uint8
+	MaxIops          uint32 // Zero for unlimited
+	MaxBandwidth     uint64 // Bytes per second, zero for unlimited
+	DeletedAt        int64  // Zero unless in the trash
+	VolumeName       [MAX_VOLUME_NAME_SIZE + 1]byte
+	GroupId          uint8 // Index in groups table + 1, zero if not in a group
+	Tier             uint8
+}
+
+type SnapshotMetadata struct {
+	ParentSnapshotId uint16
+	CreatedAt        int64
+	Flags            uint8
+}
+
+// A named set of volumes, as used to separate tenants sharing a device. Free slots have an empty name.
+type GroupMetadata struct {
+	Quota     uint64 // Total size of the volumes in the group, zero for unlimited
+	GroupName [MAX_GROUP_NAME_SIZE + 1]byte
+}
+
+type ExtentMetadata struct {
+	SnapshotId  uint16
+	ExtentPos   uint32 // Position in volume
+	BlockBitmap [EXTENT_BITMAP_SIZE]byte
+	Flags       uint8
+}
+
+// Cumulative counters of the volume in the same slot of the volume metadata, kept in the stats region. They
+// are updated lazily, outside the double-buffered metadata area, so the latest changes may be lost on a crash.
+type VolumeStats struct {
+	BytesWritten  uint64 // Since the volume was created
+	BytesRead     uint64
+	CopiedExtents uint64 // Extents copied from a previous snapshot on write
+	LastWriteTime int64  // Zero if never written
+	LastReadTime  int64  // Zero if never read
+	MediaErrors   uint64 // Block reads and writes that failed with I/O errors, after retries
+	FailedAt      int64  // When the volume was made read-only after media errors, zero if not
+}
+
+// A long operation, kept in the job table so that it can be listed and resumed from other processes. Like the
+// volume stats, records are updated outside the double-buffered metadata area. Free entries have a zero id.
+type JobRecord struct {
+	JobId          uint64
+	Type           uint8
+	State          uint8
+	Flags          uint8
+	VolumeSlot     uint16 // Index in volumes table + 1 of the volume worked on, zero if none
+	RootSnapshotId uint16 // Oldest snapshot of that volume, to tell if the slot was reused
+	SnapshotId     uint16 // Snapshot worked from, as the source of a clone
+	Done           uint64 // Bytes processed
+	Total          uint64 // Bytes to process, zero if not known
+	MaxBandwidth   uint64 // Bytes per second, zero for unlimited
+	MaxIops        uint32 // Zero for unlimited
+	StartedAt      int64
+	UpdatedAt      int64 // Last progress update of a running job, or when it finished
+}
+
+// Header of a label entry in the label region, followed by the key and value bytes. The region holds a
+// sequence of entries, terminated by a header with a zero snapshot id or the end of the region.
+type LabelHeader struct {
+	SnapshotId uint16
+	KeySize    uint8
+	ValueSize  uint16
+}
+
+// A key-value pair attached to a snapshot.
+type Label struct {
+	SnapshotId uint16
+	Key        string
+	Value      string
+}
+
+// Return the volume name as a string.
+func (v *VolumeMetadata) Name() string {
+	if n := bytes.IndexByte(v.VolumeName[:], 0); n >= 0 {
+		return string(v.VolumeName[:n])
+	}
+	return string(v.VolumeName[:])
+}
+
+// Set the volume name, truncating it if longer than MAX_VOLUME_NAME_SIZE.
+func (v *VolumeMetadata) SetName(volumeName string) {
+	v.VolumeName = [MAX_VOLUME_NAME_SIZE + 1]byte{}
+	copy(v.VolumeName[:MAX_VOLUME_NAME_SIZE], volumeName)
+}
+
+// Return the group name as a string.
+func (g *GroupMetadata) Name() string {
+	if n := bytes.IndexByte(g.GroupName[:], 0); n >= 0 {
+		return string(g.GroupName[:n])
+	}
+	return string(g.GroupName[:])
+}
+
+// Set the group name, truncating it if longer than MAX_GROUP_NAME_SIZE.
+func (g *GroupMetadata) SetName(groupName string) {
+	g.GroupName = [MAX_GROUP_NAME_SIZE + 1]byte{}
+	copy(g.GroupName[:MAX_GROUP_NAME_SIZE], groupName)
+}
+
+// Serialize any of the on-disk structures (or a pointer, array, or slice of them).
+func Marshal(v any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize any of the on-disk structures (or an array or slice of them) from data. The
+// argument must be a pointer or a slice. Trailing data is ignored.
+func Unmarshal(data []byte, v any) error {
+	size := binary.Size(v)
+	if size < 0 {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	if len(data) < size {
+		return fmt.Errorf("short buffer: %d bytes, need %d", len(data), size)
+	}
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, v)
+}
+
+func (sb *Superblock) MarshalBinary() ([]byte, error)    { return Marshal(sb) }
+func (sb *Superblock) UnmarshalBinary(data []byte) error { return Unmarshal(data, sb) }
+
+func (v *VolumeMetadata) MarshalBinary() ([]byte, error)    { return Marshal(v) }
+func (v *VolumeMetadata) UnmarshalBinary(data []byte) error { return Unmarshal(data, v) }
+
+func (s *SnapshotMetadata) MarshalBinary() ([]byte, error)    { return Marshal(s) }
+func (s *SnapshotMetadata) UnmarshalBinary(data []byte) error { return Unmarshal(data, s) }
+
+func (g *GroupMetadata) MarshalBinary() ([]byte, error)    { return Marshal(g) }
+func (g *GroupMetadata) UnmarshalBinary(data []byte) error { return Unmarshal(data, g) }
+
+func (e *ExtentMetadata) MarshalBinary() ([]byte, error)    { return Marshal(e) }
+func (e *ExtentMetadata) UnmarshalBinary(data []byte) error { return Unmarshal(data, e) }
+
+func (vs *VolumeStats) MarshalBinary() ([]byte, error)    { return Marshal(vs) }
+func (vs *VolumeStats) UnmarshalBinary(data []byte) error { return Unmarshal(data, vs) }
+
+func (j *JobRecord) MarshalBinary() ([]byte, error)    { return Marshal(j) }
+func (j *JobRecord) UnmarshalBinary(data []byte) error { return Unmarshal(data, j) }
+
+// Return the bytes labels take in the label region.
+func LabelsSize(labels []Label) int {
+	size := 0
+	for _, l := range labels {
+		size += SIZEOF_LABEL_HEADER + len(l.Key) + len(l.Value)
+	}
+	return size
+}
+
+// Serialize labels into the format of the label region. Fails if they do not fit in the region.
+func MarshalLabels(labels []Label) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, l := range labels {
+		if l.SnapshotId == 0 {
+			return nil, fmt.Errorf("label %v without snapshot", l.Key)
+		}
+		if len(l.Key) == 0 || len(l.Key) > MAX_LABEL_KEY_SIZE {
+			return nil, fmt.Errorf("invalid label key size %d", len(l.Key))
+		}
+		if len(l.Value) > MAX_LABEL_VALUE_SIZE {
+			return nil, fmt.Errorf("invalid label value size %d", len(l.Value))
+		}
+		h := LabelHeader{SnapshotId: l.SnapshotId, KeySize: uint8(len(l.Key)), ValueSize: uint16(len(l.Value))}
+		if err := binary.Write(buf, binary.LittleEndian, &h); err != nil {
+			return nil, err
+		}
+		buf.WriteString(l.Key)
+		buf.WriteString(l.Value)
+	}
+	if buf.Len() > LABEL_REGION_SIZE {
+		return nil, fmt.Errorf("labels need %d bytes, region holds %d", buf.Len(), LABEL_REGION_SIZE)
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize the label region.
+func UnmarshalLabels(data []byte) ([]Label, error) {
+	var labels []Label
+	for offset := 0; offset+SIZEOF_LABEL_HEADER <= len(data); {
+		var h LabelHeader
+		if err := Unmarshal(data[offset:], &h); err != nil {
+			return nil, err
+		}
+		if h.SnapshotId == 0 {
+			break
+		}
+		offset += SIZEOF_LABEL_HEADER
+		end := offset + int(h.KeySize) + int(h.ValueSize)
+		if end > len(data) {
+			return nil, fmt.Errorf("label at offset %d overflows region", offset-SIZEOF_LABEL_HEADER)
+		}
+		labels = append(labels, Label{
+			SnapshotId: h.SnapshotId,
+			Key:        string(data[offset : offset+int(h.KeySize)]),
+			Value:      string(data[offset+int(h.KeySize) : end]),
+		})
+		offset = end
+	}
+	return labels, nil
+}
+
+// Checksum of a copy of the metadata area, as stored in the superblock.
+func MetadataChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+}
+
+// Return the version as a "major.minor.patch" string.
+func HumanVersion(version uint32) string {
+	return fmt.Sprintf("%d.%d.%d", version>>16, (version&0xFF00)>>8, version&0xFF)
+}
+
+// Return a UUID in its canonical string form.
+func FormatUUID(uuid [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// Parse a UUID in its canonical string form.
+func ParseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+	h := strings.ReplaceAll(s, "-", "")
+	if len(s) != 36 || len(h) != 32 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return uuid, fmt.Errorf("invalid UUID %v", s)
+	}
+	if _, err := hex.Decode(uuid[:], []byte(h)); err != nil {
+		return uuid, fmt.Errorf("invalid UUID %v", s)
+	}
+	return uuid, nil
+}
+
+// Layout of a device of a given size:
+//   - Bytes [0, 4096) contain the the superblock
+//   - Bytes [4096, StatsOffset) hold two copies of the metadata area, each MetadataSize bytes long
+//   - Bytes [StatsOffset, JobOffset) hold the volume stats
+//   - Bytes [JobOffset, ExtentOffset) hold the job table, if FEATURE_COMPAT_JOB_TABLE is set (ExtentOffset is
+//     block aligned)
+//   - Bytes [ExtentOffset, DataOffset) hold the extent metadata (DataOffset is extent aligned)
+//   - Bytes [DataOffset, ReservedOffset) hold the data, except for the extent time table in its last extents, if
+//     FEATURE_RO_COMPAT_EXTENT_TIMES is set
+//   - Bytes [ReservedOffset, DeviceSize) are reserved, never touched by DBS (ReservedOffset is extent aligned)
+//
+// Each copy of the metadata area holds the volume and snapshot metadata, then the group metadata at
+// GroupOffset, the retention table at RetentionOffset, if FEATURE_RO_COMPAT_RETENTION is set, followed by the
+// snapshot labels at LabelOffset from its start (LabelOffset is block aligned). Updates are written to the copy
+// not in use, which then becomes active through the superblock, so a torn write never damages the current
+// metadata.
+type Layout struct {
+	DeviceSize         uint64
+	MetadataOffset     uint64
+	MetadataSize       uint64
+	GroupOffset        uint64
+	RetentionOffset    uint64
+	LabelOffset        uint64
+	StatsOffset        uint64
+	JobOffset          uint64
+	ExtentOffset       uint64
+	DataOffset         uint64
+	TotalDeviceExtents uint64
+	ReservedOffset     uint64
+}
+
+func divRoundUp(x uint64, y uint64) uint64 {
+	return 1 + ((x - 1) / y)
+}
+
+// Compute the layout of a device with the given size.
+func NewLayout(deviceSize uint64) Layout {
+	return NewReservedLayout(deviceSize, 0)
+}
+
+// Compute the layout of a device with the given size, leaving a region of reservedSize bytes at its end,
+// rounded up to a multiple of EXTENT_SIZE, out of the data area.
+func NewReservedLayout(deviceSize uint64, reservedSize uint64) Layout {
+	l := Layout{
+		DeviceSize:     deviceSize,
+		MetadataOffset: BLOCK_SIZE,
+		ReservedOffset: deviceSize,
+	}
+	if reservedSize > 0 {
+		reservedSize = divRoundUp(reservedSize, EXTENT_SIZE) * EXTENT_SIZE
+		if reservedSize > deviceSize {
+			reservedSize = deviceSize
+		}
+		l.ReservedOffset = (deviceSize - reservedSize) / EXTENT_SIZE * EXTENT_SIZE
+	}
+	l.GroupOffset = uint64(SIZEOF_VOLUME_METADATA*MAX_VOLUMES + SIZEOF_SNAPSHOT_METADATA*MAX_SNAPSHOTS)
+	l.RetentionOffset = l.GroupOffset + SIZEOF_GROUP_METADATA*MAX_GROUPS
+	// The retention table fits in the space left in the last block of the group metadata, so it did not change
+	// the layout
+	metadataSize := l.RetentionOffset + SIZEOF_RETENTION_TIME*MAX_VOLUMES
+	l.LabelOffset = divRoundUp(metadataSize, BLOCK_SIZE) * BLOCK_SIZE
+	l.MetadataSize = l.LabelOffset + LABEL_REGION_SIZE
+	l.StatsOffset = l.MetadataOffset + 2*l.MetadataSize
+	l.JobOffset = l.StatsOffset + SIZEOF_VOLUME_STATS*MAX_VOLUMES
+	// The job table fits in the space left in the last block of the stats, so it did not change the layout
+	l.ExtentOffset = l.StatsOffset + divRoundUp(SIZEOF_VOLUME_STATS*MAX_VOLUMES+SIZEOF_JOB_RECORD*MAX_JOB_RECORDS, BLOCK_SIZE)*BLOCK_SIZE
+	if l.ReservedOffset < l.ExtentOffset {
+		return l
+	}
+	l.TotalDeviceExtents = (l.ReservedOffset - l.ExtentOffset) / EXTENT_SIZE
+	l.DataOffset = divRoundUp(l.ExtentOffset+l.TotalDeviceExtents*SIZEOF_EXTENT_METADATA, EXTENT_SIZE) * EXTENT_SIZE
+	// Account for storage of extent metadata
+	l.TotalDeviceExtents -= (l.TotalDeviceExtents * SIZEOF_EXTENT_METADATA) / EXTENT_SIZE
+	return l
+}
+
+// Offset in the device of the given copy of the metadata area.
+func (l *Layout) MetadataCopyOffset(copy uint8) uint64 {
+	return l.MetadataOffset + uint64(copy)*l.MetadataSize
+}
+
+// Offset in the device of the stats of the volume in the given slot.
+func (l *Layout) VolumeStatsOffset(vidx uint64) uint64 {
+	return l.StatsOffset + (vidx * SIZEOF_VOLUME_STATS)
+}
+
+// Offset in the device of the job record in the given slot.
+func (l *Layout) JobRecordOffset(slot uint64) uint64 {
+	return l.JobOffset + (slot * SIZEOF_JOB_RECORD)
+}
+
+// Return the number of extents at the end of the data area taken by the extent time table, which holds the time
+// of the last write to the extent at each position, and the offset of the table in the device. The data area
+// shrinks by as many extents when the table is in use.
+func (l *Layout) ExtentTimeTable() (uint64, uint64) {
+	extents := divRoundUp(l.TotalDeviceExtents*SIZEOF_EXTENT_TIME, EXTENT_SIZE)
+	if extents > l.TotalDeviceExtents {
+		return 0, 0
+	}
+	return extents, l.ExtentDataOffset(l.TotalDeviceExtents - extents)
+}
+
+// Offset in the device of the metadata of the extent at the given position.
+func (l *Layout) ExtentMetadataOffset(epos uint64) uint64 {
+	return l.ExtentOffset + (epos * SIZEOF_EXTENT_METADATA)
+}
+
+// Offset in the device of the data of the extent at the given position.
+func (l *Layout) ExtentDataOffset(epos uint64) uint64 {
+	return l.DataOffset + (epos * EXTENT_SIZE)
+}
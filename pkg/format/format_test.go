@@ -0,0 +1,120 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/binary"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type FormatSuite struct{}
+
+var _ = Suite(&FormatSuite{})
+
+func (s *FormatSuite) TestSizes(c *C) {
+	c.Assert(binary.Size(Superblock{}), Equals, SIZEOF_SUPERBLOCK)
+	c.Assert(binary.Size(VolumeMetadata{}), Equals, SIZEOF_VOLUME_METADATA)
+	c.Assert(binary.Size(SnapshotMetadata{}), Equals, SIZEOF_SNAPSHOT_METADATA)
+	c.Assert(binary.Size(GroupMetadata{}), Equals, SIZEOF_GROUP_METADATA)
+	c.Assert(binary.Size(ExtentMetadata{}), Equals, SIZEOF_EXTENT_METADATA)
+	c.Assert(binary.Size(LabelHeader{}), Equals, SIZEOF_LABEL_HEADER)
+	c.Assert(binary.Size(VolumeStats{}), Equals, SIZEOF_VOLUME_STATS)
+	c.Assert(binary.Size(JobRecord{}), Equals, SIZEOF_JOB_RECORD)
+}
+
+func (s *FormatSuite) TestRoundTrip(c *C) {
+	sb := Superblock{Version: VERSION, AllocatedDeviceExtents: 7, DeviceSize: 1 << 30}
+	copy(sb.Magic[:], MAGIC)
+	data, err := sb.MarshalBinary()
+	c.Assert(err, IsNil)
+	var sb2 Superblock
+	c.Assert(sb2.UnmarshalBinary(data), IsNil)
+	c.Assert(sb2, DeepEquals, sb)
+
+	vm := []VolumeMetadata{{SnapshotId: 1, VolumeSize: EXTENT_SIZE}, {SnapshotId: 2, VolumeSize: 2 * EXTENT_SIZE}}
+	vm[0].SetName("vol1")
+	vm[1].SetName("vol2")
+	data, err = Marshal(vm)
+	c.Assert(err, IsNil)
+	vm2 := make([]VolumeMetadata, 2)
+	c.Assert(Unmarshal(data, vm2), IsNil)
+	c.Assert(vm2, DeepEquals, vm)
+	c.Assert(vm2[1].Name(), Equals, "vol2")
+
+	c.Assert(Unmarshal(data[:10], vm2), NotNil)
+}
+
+func (s *FormatSuite) TestUUID(c *C) {
+	uuid, err := ParseUUID("0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e04")
+	c.Assert(err, IsNil)
+	c.Assert(uuid[0], Equals, byte(0x0f))
+	c.Assert(uuid[15], Equals, byte(0x04))
+	c.Assert(FormatUUID(uuid), Equals, "0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e04")
+	for _, s := range []string{"", "0f2b1c4e8d3a4b6f9e215a7c3d9b1e04", "0f2b1c4e-8d3a-4b6f-9e21-5a7c3d9b1e0g", "0f2b1c4e8-d3a-4b6f-9e21-5a7c3d9b1e04"} {
+		_, err = ParseUUID(s)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *FormatSuite) TestLabels(c *C) {
+	labels := []Label{{SnapshotId: 1, Key: "app", Value: "db"}, {SnapshotId: 3, Key: "empty", Value: ""}}
+	data, err := MarshalLabels(labels)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 2*SIZEOF_LABEL_HEADER+len("appdbempty"))
+	region := make([]byte, LABEL_REGION_SIZE)
+	copy(region, data)
+	labels2, err := UnmarshalLabels(region)
+	c.Assert(err, IsNil)
+	c.Assert(labels2, DeepEquals, labels)
+
+	_, err = MarshalLabels([]Label{{SnapshotId: 1, Key: ""}})
+	c.Assert(err, NotNil)
+	_, err = UnmarshalLabels(data[:len(data)-1])
+	c.Assert(err, NotNil)
+}
+
+func (s *FormatSuite) TestLayout(c *C) {
+	l := NewLayout(100 * EXTENT_SIZE)
+	c.Assert(l.LabelOffset%BLOCK_SIZE, Equals, uint64(0))
+	c.Assert(l.RetentionOffset, Equals, l.GroupOffset+SIZEOF_GROUP_METADATA*MAX_GROUPS)
+	c.Assert(l.RetentionOffset+SIZEOF_RETENTION_TIME*MAX_VOLUMES <= l.LabelOffset, Equals, true)
+	// The retention table was added without moving the labels
+	c.Assert(l.LabelOffset, Equals, (l.RetentionOffset+BLOCK_SIZE-1)/BLOCK_SIZE*BLOCK_SIZE)
+	c.Assert(l.MetadataSize-l.LabelOffset, Equals, uint64(LABEL_REGION_SIZE))
+	c.Assert(l.MetadataCopyOffset(1), Equals, l.MetadataOffset+l.MetadataSize)
+	c.Assert(l.StatsOffset, Equals, l.MetadataCopyOffset(1)+l.MetadataSize)
+	c.Assert(l.VolumeStatsOffset(MAX_VOLUMES), Equals, l.JobOffset)
+	c.Assert(l.JobRecordOffset(MAX_JOB_RECORDS) <= l.ExtentOffset, Equals, true)
+	c.Assert(l.ExtentOffset%BLOCK_SIZE, Equals, uint64(0))
+	// The job table was added without moving the extent metadata
+	c.Assert(l.ExtentOffset, Equals, l.StatsOffset+(SIZEOF_VOLUME_STATS*MAX_VOLUMES+BLOCK_SIZE-1)/BLOCK_SIZE*BLOCK_SIZE)
+	c.Assert(l.DataOffset%EXTENT_SIZE, Equals, uint64(0))
+	c.Assert(l.ExtentMetadataOffset(l.TotalDeviceExtents) <= l.DataOffset, Equals, true)
+	c.Assert(l.ExtentDataOffset(l.TotalDeviceExtents) <= l.DeviceSize, Equals, true)
+	c.Assert(l.ReservedOffset, Equals, l.DeviceSize)
+	extents, offset := l.ExtentTimeTable()
+	c.Assert(extents, Equals, uint64(1))
+	c.Assert(offset+l.TotalDeviceExtents*SIZEOF_EXTENT_TIME <= l.ExtentDataOffset(l.TotalDeviceExtents), Equals, true)
+
+	r := NewReservedLayout(100*EXTENT_SIZE+BLOCK_SIZE, 10*EXTENT_SIZE-BLOCK_SIZE)
+	c.Assert(r.ReservedOffset, Equals, uint64(90*EXTENT_SIZE))
+	c.Assert(r.DataOffset, Equals, l.DataOffset)
+	c.Assert(r.ExtentDataOffset(r.TotalDeviceExtents) <= r.ReservedOffset, Equals, true)
+	c.Assert(r.TotalDeviceExtents < l.TotalDeviceExtents, Equals, true)
+}
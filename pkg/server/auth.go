@@ -0,0 +1,177 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Roles of API clients. Each role may also do everything allowed to the roles before it.
+type Role uint8
+
+const (
+	ROLE_NONE     Role = iota
+	ROLE_VIEWER        // Query the device, volumes and snapshots, and watch events
+	ROLE_OPERATOR      // Create volumes and snapshots, clone, rename, and do I/O on volumes
+	ROLE_ADMIN         // Delete volumes and snapshots, and vacuum the device
+)
+
+var roleNames = []string{"none", "viewer", "operator", "admin"}
+
+func (r Role) String() string {
+	if int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+	return "unknown"
+}
+
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if i > 0 && n == name {
+			return Role(i), nil
+		}
+	}
+	return ROLE_NONE, fmt.Errorf("unknown role %q", name)
+}
+
+// Identities allowed to use the API, with their roles. Clients are identified by an API key, sent as a bearer
+// token, or by the common name of a verified TLS client certificate. An API key takes precedence.
+type Policy struct {
+	keys     map[[sha256.Size]byte]Role
+	subjects map[string]Role
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		keys:     make(map[[sha256.Size]byte]Role),
+		subjects: make(map[string]Role),
+	}
+}
+
+func (p *Policy) AddKey(key string, role Role) {
+	p.keys[sha256.Sum256([]byte(key))] = role
+}
+
+// Add an API key by its SHA-256 hash, in hex, so that policy files need not hold the keys themselves.
+func (p *Policy) AddKeyHash(hash string, role Role) error {
+	var h [sha256.Size]byte
+	if n, err := hex.Decode(h[:], []byte(hash)); err != nil || n != sha256.Size {
+		return fmt.Errorf("invalid key hash %q", hash)
+	}
+	p.keys[h] = role
+	return nil
+}
+
+func (p *Policy) AddSubject(commonName string, role Role) {
+	p.subjects[commonName] = role
+}
+
+// Policy file contents. For example:
+//
+//	keys:
+//	  - key_sha256: 5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//	    role: viewer
+//	  - key: s3cret
+//	    role: admin
+//	subjects:
+//	  - name: backup.example.com   # client certificate common name
+//	    role: operator
+type policyFile struct {
+	Keys []struct {
+		Key       string `yaml:"key"`
+		KeySha256 string `yaml:"key_sha256"`
+		Role      string `yaml:"role"`
+	} `yaml:"keys"`
+	Subjects []struct {
+		Name string `yaml:"name"`
+		Role string `yaml:"role"`
+	} `yaml:"subjects"`
+}
+
+// Load a policy from a YAML file.
+func LoadPolicy(name string) (*Policy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var pf policyFile
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("cannot parse policy: %w", err)
+	}
+	p := NewPolicy()
+	for i, k := range pf.Keys {
+		role, err := ParseRole(k.Role)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %w", i, err)
+		}
+		switch {
+		case k.Key != "" && k.KeySha256 == "":
+			p.AddKey(k.Key, role)
+		case k.Key == "" && k.KeySha256 != "":
+			if err := p.AddKeyHash(k.KeySha256, role); err != nil {
+				return nil, fmt.Errorf("key %v: %w", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("key %v: exactly one of key and key_sha256 must be set", i)
+		}
+	}
+	for _, s := range pf.Subjects {
+		role, err := ParseRole(s.Role)
+		if err != nil {
+			return nil, fmt.Errorf("subject %v: %w", s.Name, err)
+		}
+		if s.Name == "" {
+			return nil, fmt.Errorf("subject without a name")
+		}
+		p.AddSubject(s.Name, role)
+	}
+	return p, nil
+}
+
+// Return the role of the client sending a request, false if it is not identified.
+func (p *Policy) role(r *http.Request) (Role, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		role, ok := p.keys[sha256.Sum256([]byte(token))]
+		return role, ok
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		role, ok := p.subjects[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+		return role, ok
+	}
+	return ROLE_NONE, false
+}
+
+// Return the role needed for a request, with the path split after the API prefix. Queries need a viewer, except
+// for reading volume data, which needs an open handle anyway, and deletions of volumes and snapshots an admin,
+// as does vacuuming, which purges expired volumes from the trash.
+func requiredRole(method string, parts []string) Role {
+	switch {
+	case method == http.MethodGet && parts[0] != "handles":
+		return ROLE_VIEWER
+	case method == http.MethodDelete && (parts[0] == "volumes" || parts[0] == "snapshots"):
+		return ROLE_ADMIN
+	case method == http.MethodPost && parts[0] == "device":
+		return ROLE_ADMIN
+	default:
+		return ROLE_OPERATOR
+	}
+}
@@ -0,0 +1,672 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// HTTP server for the management API of a device, used by the client package.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kampadais/dbs"
+	"github.com/Kampadais/dbs/pkg/client"
+)
+
+const (
+	MAX_TRANSFER     = 32 * 1024 * 1024 // Largest data transfer in a request
+	MAX_REQUEST_SIZE = 1024 * 1024      // Largest JSON request, other than a catalog
+	MAX_CATALOG_SIZE = 64 * 1024 * 1024 // Largest catalog imported, enough for all snapshots with full labels
+)
+
+var (
+	errBadRequest = errors.New("bad request")
+	errNoRoute    = errors.New("no such endpoint")
+)
+
+// Handler of API requests for a device.
+type Server struct {
+	device  string
+	opts    []dbs.Option
+	mu      sync.Mutex
+	handles map[uint64]*handle
+	next    uint64
+	done    chan struct{}                   // Closed on Close, to end event streams
+	policy  *Policy                         // Authorization of clients, nil to allow all requests
+	tokens  *Tokens                         // NBD export tokens issued through the API, nil if not in use
+	conns   func() []client.ConnectionStats // NBD connections of the daemon, nil if it does not serve any
+}
+
+// Volume opened by a client. Requests to it are serialized, as volume contexts are not safe for concurrent use.
+type handle struct {
+	sync.Mutex
+	vc *dbs.VolumeContext
+}
+
+// Return a server for a device. Options apply to volumes opened by clients.
+func New(device string, opts ...dbs.Option) *Server {
+	return &Server{
+		device:  device,
+		opts:    opts,
+		handles: make(map[uint64]*handle),
+		done:    make(chan struct{}),
+	}
+}
+
+// Require clients to be identified by the policy, and allow them requests as per their role. Must be called
+// before serving.
+func (s *Server) SetPolicy(p *Policy) {
+	s.policy = p
+}
+
+// Serve the endpoints issuing and revoking NBD export tokens, stored in the given tokens. Must be called before
+// serving.
+func (s *Server) SetTokens(t *Tokens) {
+	s.tokens = t
+}
+
+// Serve the endpoint listing NBD connections, as returned by the given function. Must be called before serving.
+func (s *Server) SetConnections(conns func() []client.ConnectionStats) {
+	s.conns = conns
+}
+
+// Check that the client sending a request may make it.
+func (s *Server) authorize(r *http.Request, parts []string) error {
+	if s.policy == nil {
+		return nil
+	}
+	role, ok := s.policy.role(r)
+	if !ok {
+		return client.ErrUnauthorized
+	}
+	if required := requiredRole(r.Method, parts); role < required {
+		return fmt.Errorf("%w: %v role required", client.ErrForbidden, required)
+	}
+	return nil
+}
+
+// Close the volumes left open by clients, and end event streams.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	var errs []error
+	for id, h := range s.handles {
+		h.Lock()
+		if h.vc != nil {
+			if err := h.vc.CloseVolume(); err != nil {
+				// Kept, as closing can be retried
+				errs = append(errs, err)
+				h.Unlock()
+				continue
+			}
+			h.vc = nil
+		}
+		h.Unlock()
+		delete(s.handles, id)
+	}
+	return errors.Join(errs...)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code, status := client.ErrorCode(err)
+	switch {
+	case errors.Is(err, errBadRequest):
+		code, status = "bad_request", http.StatusBadRequest
+	case errors.Is(err, errNoRoute):
+		code, status = "no_route", http.StatusNotFound
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&client.ErrorResponse{Error: err.Error(), Code: code})
+}
+
+func readJSON(r *http.Request, v any) error {
+	return readJSONLimit(r, v, MAX_REQUEST_SIZE)
+}
+
+func readJSONLimit(r *http.Request, v any, limit int64) error {
+	if err := json.NewDecoder(io.LimitReader(r.Body, limit)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", errBadRequest, err)
+	}
+	return nil
+}
+
+func parseUint(query url.Values, key string) (uint64, error) {
+	v, err := strconv.ParseUint(query.Get(key), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %v", errBadRequest, key)
+	}
+	return v, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.EscapedPath(), client.API_PREFIX+"/")
+	if !ok {
+		writeError(w, notFound(r))
+		return
+	}
+	parts := strings.Split(path, "/")
+	for i := range parts {
+		p, err := url.PathUnescape(parts[i])
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %w", errBadRequest, err))
+			return
+		}
+		parts[i] = p
+	}
+	version, err := protocolVersion(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(client.PROTOCOL_HEADER, strconv.FormatUint(uint64(version), 10))
+	// Clients negotiate the version before identifying
+	if len(parts) == 1 && parts[0] == "version" && r.Method == http.MethodGet {
+		writeJSON(w, &client.VersionResponse{ProtocolVersion: client.PROTOCOL_VERSION, MinProtocolVersion: client.MIN_PROTOCOL_VERSION})
+		return
+	}
+	if err := s.authorize(r, parts); err != nil {
+		writeError(w, err)
+		return
+	}
+	switch parts[0] {
+	case "device":
+		err = s.serveDevice(w, r, parts[1:])
+	case "volumes":
+		err = s.serveVolumes(w, r, parts[1:])
+	case "snapshots":
+		err = s.serveSnapshots(w, r, parts[1:])
+	case "catalog":
+		err = s.serveCatalog(w, r, parts[1:])
+	case "handles":
+		err = s.serveHandles(w, r, parts[1:])
+	case "events":
+		err = s.serveEvents(w, r, parts[1:])
+	case "tokens":
+		err = s.serveTokens(w, r, parts[1:])
+	case "jobs":
+		err = s.serveJobs(w, r, parts[1:], version)
+	case "connections":
+		err = s.serveConnections(w, r, parts[1:])
+	default:
+		err = notFound(r)
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// Return the protocol version a request is served at.
+func protocolVersion(r *http.Request) (uint, error) {
+	header := r.Header.Get(client.PROTOCOL_HEADER)
+	if header == "" {
+		return client.MIN_PROTOCOL_VERSION, nil
+	}
+	v, err := strconv.ParseUint(header, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %v", errBadRequest, client.PROTOCOL_HEADER)
+	}
+	if v < client.MIN_PROTOCOL_VERSION {
+		return 0, fmt.Errorf("%w: %v, oldest served is %v", client.ErrUnsupportedProtocol, v, client.MIN_PROTOCOL_VERSION)
+	}
+	return uint(min(v, client.PROTOCOL_VERSION)), nil
+}
+
+func notFound(r *http.Request) error {
+	return fmt.Errorf("%w: %v %v", errNoRoute, r.Method, r.URL.Path)
+}
+
+func (s *Server) serveDevice(w http.ResponseWriter, r *http.Request, parts []string) error {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		di, err := dbs.GetDeviceInfo(s.device)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, di)
+	case len(parts) == 1 && parts[0] == "view" && r.Method == http.MethodGet:
+		view, err := dbs.GetDeviceSnapshotView(s.device)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, view)
+	case len(parts) == 1 && parts[0] == "vacuum" && r.Method == http.MethodPost:
+		return dbs.VacuumDevice(s.device)
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+func (s *Server) serveVolumes(w http.ResponseWriter, r *http.Request, parts []string) error {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		vi, err := dbs.GetVolumeInfo(s.device)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, vi)
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var req client.CreateVolumeRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		vi, err := dbs.CreateVolume(s.device, req.VolumeName, req.VolumeSize)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, vi)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return dbs.DeleteVolume(s.device, parts[0])
+	case len(parts) == 2 && parts[1] == "rename" && r.Method == http.MethodPost:
+		var req client.RenameVolumeRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		return dbs.RenameVolume(s.device, parts[0], req.NewVolumeName)
+	case len(parts) == 2 && parts[1] == "snapshots" && r.Method == http.MethodGet:
+		si, err := dbs.GetSnapshotInfo(s.device, parts[0])
+		if err != nil {
+			return err
+		}
+		writeJSON(w, si)
+	case len(parts) == 2 && parts[1] == "snapshots" && r.Method == http.MethodPost:
+		var opts dbs.SnapshotOptions
+		if err := readJSON(r, &opts); err != nil {
+			return err
+		}
+		sid, err := dbs.CreateSnapshot(s.device, parts[0], &opts)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, &client.SnapshotResponse{SnapshotId: sid})
+	case len(parts) == 2 && parts[1] == "open" && r.Method == http.MethodPost:
+		vc, err := dbs.OpenVolume(s.device, parts[0], s.opts...)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, s.addHandle(vc))
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+func (s *Server) serveCatalog(w http.ResponseWriter, r *http.Request, parts []string) error {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		catalog, err := dbs.ExportCatalog(s.device)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, catalog)
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var catalog dbs.SnapshotCatalog
+		if err := readJSONLimit(r, &catalog, MAX_CATALOG_SIZE); err != nil {
+			return err
+		}
+		result, err := dbs.ImportCatalog(s.device, &catalog)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, result)
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+func (s *Server) serveSnapshotQuery(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	q := &dbs.SnapshotQuery{VolumeName: query.Get("volume")}
+	for _, label := range query["label"] {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("%w: invalid label %q", errBadRequest, label)
+		}
+		if q.Labels == nil {
+			q.Labels = make(map[string]string)
+		}
+		q.Labels[key] = value
+	}
+	for key, t := range map[string]*time.Time{"after": &q.After, "before": &q.Before} {
+		if query.Has(key) {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, query.Get(key)); err != nil {
+				return fmt.Errorf("%w: invalid %v", errBadRequest, key)
+			}
+		}
+	}
+	for key, v := range map[string]*uint{"start": &q.StartId, "limit": &q.Limit} {
+		if query.Has(key) {
+			n, err := parseUint(query, key)
+			if err != nil {
+				return err
+			}
+			*v = uint(n)
+		}
+	}
+	si, next, err := dbs.ListSnapshots(s.device, q)
+	if err != nil {
+		return err
+	}
+	if next != 0 {
+		w.Header().Set(client.NEXT_START_HEADER, strconv.FormatUint(uint64(next), 10))
+	}
+	writeJSON(w, si)
+	return nil
+}
+
+func (s *Server) serveSnapshots(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			return notFound(r)
+		}
+		// Version 1 clients never send a query, but are still served all snapshots if they do
+		if version, _ := protocolVersion(r); version >= 2 && r.URL.RawQuery != "" {
+			return s.serveSnapshotQuery(w, r)
+		}
+		si, err := dbs.ListAllSnapshots(s.device)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, si)
+		return nil
+	}
+	snapshotId, err := dbs.ResolveSnapshot(s.device, parts[0])
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return dbs.DeleteSnapshot(s.device, snapshotId)
+	case len(parts) == 2 && parts[1] == "clone" && r.Method == http.MethodPost:
+		var req client.CloneSnapshotRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		vi, err := dbs.CloneSnapshot(s.device, req.NewVolumeName, snapshotId)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, vi)
+	case len(parts) == 2 && parts[1] == "clone_job" && r.Method == http.MethodPost:
+		if version, _ := protocolVersion(r); version < 3 {
+			return notFound(r)
+		}
+		var req client.CloneJobRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		vi, ji, err := dbs.CloneSnapshotJob(s.device, req.NewVolumeName, snapshotId, req.Ranges, &req.Options)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, &client.CloneJobResponse{Volume: *vi, Job: *ji})
+	case len(parts) == 2 && parts[1] == "open" && r.Method == http.MethodPost:
+		vc, err := dbs.OpenSnapshot(s.device, snapshotId, s.opts...)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, s.addHandle(vc))
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+func (s *Server) serveJobs(w http.ResponseWriter, r *http.Request, parts []string, version uint) error {
+	if version < 3 {
+		return notFound(r)
+	}
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			return notFound(r)
+		}
+		ji, err := dbs.ListJobs(s.device)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, ji)
+		return nil
+	}
+	jobId, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", dbs.ErrJobNotFound, parts[0])
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		ji, err := dbs.GetJob(s.device, jobId)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, ji)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return dbs.CancelJob(s.device, jobId)
+	case len(parts) == 2 && parts[1] == "resume" && r.Method == http.MethodPost && version >= 4:
+		ji, err := dbs.ResumeJob(s.device, jobId)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, ji)
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+func volumeHandle(id uint64, vc *dbs.VolumeContext) *client.VolumeHandle {
+	return &client.VolumeHandle{
+		Handle:     id,
+		VolumeName: vc.VolumeName(),
+		VolumeSize: vc.VolumeSize(),
+		SnapshotId: vc.SnapshotId(),
+		ReadOnly:   vc.ReadOnly(),
+	}
+}
+
+func (s *Server) addHandle(vc *dbs.VolumeContext) *client.VolumeHandle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	s.handles[s.next] = &handle{vc: vc}
+	return volumeHandle(s.next, vc)
+}
+
+func (s *Server) serveHandles(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) == 0 || len(parts) > 2 {
+		return notFound(r)
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid handle %v", errBadRequest, parts[0])
+	}
+	s.mu.Lock()
+	h, ok := s.handles[id]
+	if ok && len(parts) == 1 && r.Method == http.MethodDelete {
+		delete(s.handles, id)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: handle %v", dbs.ErrVolumeClosed, id)
+	}
+	h.Lock()
+	defer h.Unlock()
+	// Closed by a concurrent request
+	if h.vc == nil {
+		return fmt.Errorf("%w: handle %v", dbs.ErrVolumeClosed, id)
+	}
+	query := r.URL.Query()
+	op := ""
+	if len(parts) == 2 {
+		op = parts[1]
+	}
+	switch {
+	case op == "" && r.Method == http.MethodDelete:
+		if err := h.vc.CloseVolume(); err != nil {
+			// Still open, so the client can sync and retry
+			s.mu.Lock()
+			s.handles[id] = h
+			s.mu.Unlock()
+			return err
+		}
+		h.vc = nil
+	case op == "data" && r.Method == http.MethodGet:
+		offset, err := parseUint(query, "offset")
+		if err != nil {
+			return err
+		}
+		length, err := parseUint(query, "length")
+		if err != nil {
+			return err
+		}
+		if length > MAX_TRANSFER {
+			return fmt.Errorf("%w: length over %v", errBadRequest, MAX_TRANSFER)
+		}
+		data := make([]byte, length)
+		if err := h.vc.ReadAt(data, offset); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case op == "data" && r.Method == http.MethodPut:
+		offset, err := parseUint(query, "offset")
+		if err != nil {
+			return err
+		}
+		updateMetadata, _ := strconv.ParseBool(query.Get("update_metadata"))
+		data, err := io.ReadAll(io.LimitReader(r.Body, MAX_TRANSFER+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > MAX_TRANSFER {
+			return fmt.Errorf("%w: length over %v", errBadRequest, MAX_TRANSFER)
+		}
+		return h.vc.WriteAt(data, offset, updateMetadata)
+	case op == "unmap" && r.Method == http.MethodPost:
+		offset, err := parseUint(query, "offset")
+		if err != nil {
+			return err
+		}
+		length, err := parseUint(query, "length")
+		if err != nil {
+			return err
+		}
+		return h.vc.UnmapAt(length, offset)
+	case op == "sync" && r.Method == http.MethodPost:
+		return h.vc.Sync()
+	case op == "refresh" && r.Method == http.MethodPost:
+		if err := h.vc.Refresh(); err != nil {
+			return err
+		}
+		writeJSON(w, volumeHandle(id, h.vc))
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+// Stream events of the device until the client disconnects or the server is closed.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) != 0 || r.Method != http.MethodGet {
+		return notFound(r)
+	}
+	opts := &dbs.WatchOptions{}
+	if r.URL.Query().Has("space_threshold") {
+		threshold, err := parseUint(r.URL.Query(), "space_threshold")
+		if err != nil {
+			return err
+		}
+		if threshold > 100 {
+			return fmt.Errorf("%w: space_threshold over 100", errBadRequest)
+		}
+		opts.SpaceThreshold = uint(threshold)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("event streaming not supported")
+	}
+	events, cancel := dbs.Watch(s.device, opts)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-events:
+			if err := enc.Encode(&e); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+func (s *Server) serveTokens(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if s.tokens == nil {
+		return notFound(r)
+	}
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var req client.CreateTokenRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		et, err := s.tokens.Issue(req.Export, req.Once, req.TTL)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errBadRequest, err)
+		}
+		writeJSON(w, et)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !s.tokens.Revoke(parts[0]) {
+			return client.ErrTokenNotFound
+		}
+	default:
+		return notFound(r)
+	}
+	return nil
+}
+
+func (s *Server) serveConnections(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if s.conns == nil || len(parts) != 0 || r.Method != http.MethodGet {
+		return notFound(r)
+	}
+	writeJSON(w, s.conns())
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Kampadais/dbs/pkg/client"
+)
+
+// Tokens granting access to single NBD exports, so that clients can attach a volume without access to the
+// others. Tokens are either one-time, redeemed when a client attaches, or valid until they expire or are
+// revoked. They are kept in memory, except for those loaded from a file.
+type Tokens struct {
+	mu     sync.Mutex
+	tokens map[string]*client.ExportToken
+}
+
+func NewTokens() *Tokens {
+	return &Tokens{tokens: make(map[string]*client.ExportToken)}
+}
+
+// Issue a token for an export. A zero TTL means the token does not expire.
+func (t *Tokens) Issue(export string, once bool, ttl time.Duration) (*client.ExportToken, error) {
+	if export == "" {
+		return nil, fmt.Errorf("no export given")
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("invalid token lifetime %v", ttl)
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	et := &client.ExportToken{Token: hex.EncodeToString(b[:]), Export: export, Once: once}
+	if ttl > 0 {
+		et.ExpiresAt = time.Now().Add(ttl)
+	}
+	t.add(et)
+	return et, nil
+}
+
+func (t *Tokens) add(et *client.ExportToken) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[et.Token] = et
+}
+
+// Revoke a token, returning false if it does not exist.
+func (t *Tokens) Revoke(token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.tokens[token]
+	delete(t.tokens, token)
+	return ok
+}
+
+// Check that a token grants access to an export. One-time tokens are consumed if redeem is set.
+func (t *Tokens) Check(export string, token string, redeem bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	et, ok := t.tokens[token]
+	if !ok {
+		return false
+	}
+	if !et.ExpiresAt.IsZero() && time.Now().After(et.ExpiresAt) {
+		delete(t.tokens, token)
+		return false
+	}
+	if et.Export != export {
+		return false
+	}
+	if et.Once && redeem {
+		delete(t.tokens, token)
+	}
+	return true
+}
+
+// Tokens file contents. For example:
+//
+//	tokens:
+//	  - token: 6f1c2a...
+//	    export: db1            # volume, or snapshot as volume@id
+//	    expires: 2025-01-01T00:00:00Z
+type tokensFile struct {
+	Tokens []struct {
+		Token   string    `yaml:"token"`
+		Export  string    `yaml:"export"`
+		Expires time.Time `yaml:"expires"`
+	} `yaml:"tokens"`
+}
+
+// Add the long-lived tokens in a YAML file.
+func (t *Tokens) Load(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var tf tokensFile
+	if err := yaml.Unmarshal(data, &tf); err != nil {
+		return fmt.Errorf("cannot parse tokens: %w", err)
+	}
+	for i, ft := range tf.Tokens {
+		if ft.Token == "" || ft.Export == "" {
+			return fmt.Errorf("token %v: both token and export must be set", i)
+		}
+		t.add(&client.ExportToken{Token: ft.Token, Export: ft.Export, ExpiresAt: ft.Expires})
+	}
+	return nil
+}
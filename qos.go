@@ -0,0 +1,25 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Set the I/O limits of a volume. Zero means unlimited. Volumes already open pick up the limits on their next
+// reload of the metadata.
+func SetVolumeQoS(device string, volumeName string, maxIops uint, maxBandwidth uint64) error {
+	return core.SetVolumeQoS(device, volumeName, maxIops, maxBandwidth)
+}
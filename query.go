@@ -0,0 +1,47 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"time"
+
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Number of snapshots fetched at a time by EachSnapshot.
+const SNAPSHOT_PAGE_SIZE = core.SNAPSHOT_PAGE_SIZE
+
+// Filters and pages a snapshot listing. Snapshots must match all criteria set, so the zero value lists all
+// snapshots on the device.
+type SnapshotQuery = core.SnapshotQuery
+
+// Return the snapshots matching a query, ordered by id, along with the StartId that continues the listing, or
+// zero if there are no more. Snapshots are reported with volumes as in ListAllSnapshots.
+func ListSnapshots(device string, q *SnapshotQuery) ([]SnapshotInfo, uint, error) {
+	return core.ListSnapshots(device, q)
+}
+
+// Call fn with each snapshot matching a query, ordered by id, until it returns false. Snapshots are fetched in
+// pages, so the device is not locked while fn runs and it may call into the library, but a listing that spans
+// pages is not a consistent view of a device being modified. The signature follows range-over-func iterators.
+func EachSnapshot(device string, q *SnapshotQuery, fn func(SnapshotInfo) bool) error {
+	return core.EachSnapshot(device, q, fn)
+}
+
+// Return the snapshot in the chain of a volume created last at or before a time, to find the state of the volume
+// as of that time. Fails with ErrSnapshotNotFound if all snapshots in the chain are newer.
+func FindSnapshotAt(device string, volumeName string, t time.Time) (*SnapshotInfo, error) {
+	return core.FindSnapshotAt(device, volumeName, t)
+}
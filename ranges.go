@@ -0,0 +1,48 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Part of a volume set by a snapshot. Zeroed ranges read as zeroes, hiding data of previous snapshots.
+type VolumeRange = core.VolumeRange
+
+// Return the parts of the volume set by a snapshot itself, rather than inherited from previous snapshots, in
+// order. Blocks copied along with extents of previous snapshots on write are included, although they may
+// hold the same data as before. If the device keeps extent times, ranges are split where these differ.
+func GetSnapshotRanges(device string, snapshotId uint) ([]VolumeRange, error) {
+	return core.GetSnapshotRanges(device, snapshotId)
+}
+
+// Create a volume from parts of a snapshot, placed one after the other, and return its information. Offsets
+// and lengths must be multiples of BLOCK_SIZE, and the volume size is their total length rounded up to a
+// multiple of EXTENT_SIZE. Only blocks holding data are copied, so that, for example, a partition can be taken
+// out of a disk image without copying the rest. The volume is destroyed if copying fails.
+func CloneSnapshotRanges(device string, newVolumeName string, snapshotId uint, ranges []VolumeRange) (*VolumeInfo, error) {
+	return core.CloneSnapshotRanges(device, newVolumeName, snapshotId, ranges)
+}
+
+// Limits of a clone made in the background.
+type CloneOptions = core.CloneOptions
+
+// Clone a snapshot, or parts of it as with CloneSnapshotRanges if ranges are given, copying the data in the
+// background within the given limits, so that the device is not saturated. The volume is created before
+// returning, but holds the data of the snapshot only once the returned JOB_CLONE job completes, and is destroyed
+// if the job fails or is cancelled. Options may be nil.
+func CloneSnapshotJob(device string, newVolumeName string, snapshotId uint, ranges []VolumeRange, opts *CloneOptions) (*VolumeInfo, *JobInfo, error) {
+	return core.CloneSnapshotJob(device, newVolumeName, snapshotId, ranges, opts)
+}
@@ -0,0 +1,33 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+var ErrMediaError = core.ErrMediaError
+
+// How block reads and writes failing with transient errors are retried, and when a volume is given up on.
+// Transient errors are I/O errors, and errors asking for the request to be repeated, like EAGAIN. I/O errors
+// left after the retries are media errors, which fail with ErrMediaError. They are counted per volume, in
+// VolumeInfo, and per extent of the device, in VolumeContext.ExtentErrors.
+type RetryPolicy = core.RetryPolicy
+
+// Clear the media errors of a volume, making it writable again if it was made read-only because of them.
+// Contexts of the volume already open stay read-only until reopened.
+func ResetVolumeErrors(device string, volumeName string) error {
+	return core.ResetVolumeErrors(device, volumeName)
+}
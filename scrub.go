@@ -0,0 +1,41 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"time"
+
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Progress and findings of scrubbing a device, the running or last pass in this process.
+type ScrubStatus = core.ScrubStatus
+
+// Read all allocated extents of a device, and check the checksums of the metadata area, to find media errors
+// before the data is needed. At most rate bytes are read per second, or as fast as possible if zero. Extents
+// are listed in batches under a shared lock, but read without it, so the device is not held up, and changes
+// made meanwhile may be missed until the next pass. Problems are sent to watchers as EVENT_SCRUB_ERROR,
+// and media errors are counted in the "dbs.io.media_errors" metric, as OP_SCRUB. EVENT_SCRUB_COMPLETED is sent
+// at the end of the pass, which returns the final status, also seen in DeviceInfo.
+func ScrubDevice(device string, rate uint64, opts ...Option) (*ScrubStatus, error) {
+	return core.ScrubDevice(device, rate, opts...)
+}
+
+// Scrub a device every interval, at most at the given rate, until the returned function is called, which waits
+// for a pass in progress to end. The first pass starts after an interval. Errors of whole passes, like failing to open the device, are sent to
+// watchers as EVENT_ERROR, and the next pass is tried as usual.
+func StartScrubber(device string, interval time.Duration, rate uint64, opts ...Option) func() {
+	return core.StartScrubber(device, interval, rate, opts...)
+}
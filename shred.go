@@ -0,0 +1,41 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Extents overwritten at once by a secure deletion, each batch under a short hold of the metadata lock.
+const SHRED_STEP_EXTENTS = core.SHRED_STEP_EXTENTS
+
+// Delete a volume, overwriting the data of its extents, including those of its snapshots, with zeroes, or random
+// data if random is set, before releasing them, for data sanitization. The volume is moved to the trash right
+// away, where it cannot be restored, and destroyed once the returned JOB_SHRED job has overwritten its extents.
+// Until then, extents are also overwritten if the volume is purged, or when vacuuming moves them. Cancelling the
+// job leaves the volume in the trash.
+func DeleteVolumeSecure(device string, volumeName string, random bool) (*JobInfo, error) {
+	return core.DeleteVolumeSecure(device, volumeName, random)
+}
+
+// Delete a snapshot that is not current as with DeleteSnapshot, overwriting the data of the extents released
+// with zeroes, or random data if random is set. The snapshot is deleted once the returned JOB_SHRED job has
+// overwritten the extents replaced by the following snapshot. Blocks that partial extents of the following
+// snapshot still read from them, as written with block copy on write, are first merged into these. The snapshot
+// should not be read or cloned meanwhile. Cancelling the job leaves the snapshot in place, with part of its data
+// lost.
+func DeleteSnapshotSecure(device string, snapshotId uint, random bool) (*JobInfo, error) {
+	return core.DeleteSnapshotSecure(device, snapshotId, random)
+}
@@ -0,0 +1,32 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"time"
+
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Returned when closing would lose writes not yet on the device, or leave jobs of this process running.
+var ErrShutdownPending = core.ErrShutdownPending
+
+// Check that a process can exit without losing work on a device, waiting up to timeout for the jobs it runs on
+// the device to finish. Volumes still open in the process may hold writes in memory, so they must be closed
+// first. Returns ErrShutdownPending, listing what remains, if volumes are open or jobs are running. Jobs left
+// running when the process exits are taken as interrupted, and can be resumed later.
+func QuiesceDevice(device string, timeout time.Duration) error {
+	return core.QuiesceDevice(device, timeout)
+}
@@ -0,0 +1,25 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Time after which the counters of an open volume are written to the stats region on its next write. They
+// are also written by VolumeContext.Sync and when the volume is closed.
+const STATS_FLUSH_INTERVAL = core.STATS_FLUSH_INTERVAL
+
+type VolumeStats = core.VolumeStats
@@ -0,0 +1,37 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+const (
+	SYNC_POLICY_STRICT  = core.SYNC_POLICY_STRICT  // Flush after every metadata update
+	SYNC_POLICY_RELAXED = core.SYNC_POLICY_RELAXED // Flush metadata updates at most every SYNC_INTERVAL, and on sync and close
+	SYNC_POLICY_UNSAFE  = core.SYNC_POLICY_UNSAFE  // Only flush on sync and close, without ordering metadata updates
+
+	SYNC_INTERVAL = core.SYNC_INTERVAL
+)
+
+// Return the name of a sync policy.
+func SyncPolicyName(policy uint) string {
+	return core.SyncPolicyName(policy)
+}
+
+// Return the sync policy with the given name.
+func ParseSyncPolicy(name string) (uint, error) {
+	return core.ParseSyncPolicy(name)
+}
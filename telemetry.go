@@ -0,0 +1,40 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Name of the instrumentation scope of spans and metrics.
+const TELEMETRY_SCOPE = core.TELEMETRY_SCOPE
+
+// Operations timed in the "dbs.operation.duration" histogram, by the "dbs.operation" attribute. Volume
+// operations called with a context holding a span, through the ...Context methods of VolumeContext, are traced
+// as child spans, as are the extent copies and metadata and superblock writes of writes and unmaps. Block
+// reads, which are many, are only timed. Retries and media errors of block reads and writes and of extent
+// copies are counted in "dbs.io.retries" and "dbs.io.media_errors", by the same attribute. Scrubbing is timed
+// per pass, and the bytes it reads are counted in "dbs.scrub.bytes".
+const (
+	OP_READ             = core.OP_READ
+	OP_WRITE            = core.OP_WRITE
+	OP_UNMAP            = core.OP_UNMAP
+	OP_BLOCK_READ       = core.OP_BLOCK_READ
+	OP_BLOCK_WRITE      = core.OP_BLOCK_WRITE
+	OP_EXTENT_COPY      = core.OP_EXTENT_COPY
+	OP_METADATA_WRITE   = core.OP_METADATA_WRITE
+	OP_SUPERBLOCK_WRITE = core.OP_SUPERBLOCK_WRITE
+	OP_SCRUB            = core.OP_SCRUB
+)
@@ -0,0 +1,54 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+const (
+	TIER_ANY  = core.TIER_ANY
+	TIER_FAST = core.TIER_FAST
+	TIER_SLOW = core.TIER_SLOW
+)
+
+// Return the name of a tier.
+func TierName(tier uint) string {
+	return core.TierName(tier)
+}
+
+// Return the tier with the given name.
+func ParseTier(name string) (uint, error) {
+	return core.ParseTier(name)
+}
+
+// Set the size of the fast region of a device, at the start of its data area, as with the outer tracks of a
+// disk or the first device of a concatenation. Extents of volumes in the fast tier are allocated there if
+// possible, and those of volumes in the slow tier elsewhere. A zero size disables tiering.
+func SetDeviceFastRegion(device string, size uint64) error {
+	return core.SetDeviceFastRegion(device, size)
+}
+
+// Set the tier of a volume. Extents already allocated are moved to the region of the tier by RebalanceTiers.
+func SetVolumeTier(device string, volumeName string, tier uint) error {
+	return core.SetVolumeTier(device, volumeName, tier)
+}
+
+// Move extents into the region of the tier of the volumes using them. Extents are moved a few at a time, as when
+// vacuuming, so volumes can stay open. Extents are only moved to free positions, so volumes in the fast tier may
+// be left partly outside a full fast region. Returns the number of extents moved.
+func RebalanceTiers(device string) (uint, error) {
+	return core.RebalanceTiers(device)
+}
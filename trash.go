@@ -0,0 +1,46 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"time"
+
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Set how long deleted volumes are kept in the trash before being destroyed. Zero disables the trash.
+func SetTrashRetention(device string, retention time.Duration) error {
+	return core.SetTrashRetention(device, retention)
+}
+
+// List the volumes in the trash.
+func ListDeletedVolumes(device string) ([]VolumeInfo, error) {
+	return core.ListDeletedVolumes(device)
+}
+
+// Restore the most recently deleted volume with the given name from the trash.
+func UndeleteVolume(device string, volumeName string) error {
+	return core.UndeleteVolume(device, volumeName)
+}
+
+// Destroy the most recently deleted volume with the given name, without waiting for the retention period to pass.
+func PurgeDeletedVolume(device string, volumeName string) error {
+	return core.PurgeDeletedVolume(device, volumeName)
+}
+
+// Destroy all volumes in the trash whose retention period has passed. Returns the number of volumes destroyed.
+func ReapDeletedVolumes(device string) (uint, error) {
+	return core.ReapDeletedVolumes(device)
+}
@@ -0,0 +1,29 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+const (
+	MAX_EXTENT_BATCH = core.MAX_EXTENT_BATCH // Largest automatic extent batch, about 40 MB of metadata
+	SCAN_READERS     = core.SCAN_READERS     // Concurrent readers of extent metadata when scanning, unless set
+
+	// Environment variables setting tunables not given as options, for programs that do not expose them
+	ENV_EXTENT_BATCH     = core.ENV_EXTENT_BATCH
+	ENV_SCAN_READERS     = core.ENV_SCAN_READERS
+	ENV_COPY_BUFFER_SIZE = core.ENV_COPY_BUFFER_SIZE
+)
@@ -0,0 +1,29 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+type SnapshotUsage = core.SnapshotUsage
+
+// Return how many extents each snapshot of a volume holds, starting from the current one, and how many of them
+// deleting the snapshot would free. Extents that the child snapshot replaced, even in part, are unique, while
+// those it still reads are shared. All extents of the current snapshot are unique, as no other snapshot reads
+// them.
+func GetSnapshotUsage(device string, volumeName string) ([]SnapshotUsage, error) {
+	return core.GetSnapshotUsage(device, volumeName)
+}
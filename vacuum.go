@@ -0,0 +1,46 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Extents moved per hold of the metadata lock when vacuuming, so writers are not blocked for long.
+const VACUUM_STEP_EXTENTS = core.VACUUM_STEP_EXTENTS
+
+var ErrInvalidExtent = core.ErrInvalidExtent
+
+// Move the allocated extent at a device position to a free one, copying over its data and metadata, and release
+// the source position. The target may be past the allocation mark, which is moved up to it. Volumes open in
+// this process follow the extent, while those open in other processes rebuild their maps on their next write,
+// but must be refreshed before reading again.
+func RelocateExtent(device string, psrc uint, pdst uint) error {
+	return core.RelocateExtent(device, psrc, pdst)
+}
+
+// Vacuum the device, destroying expired volumes in the trash, removing labels left by deleted snapshots, and
+// releasing all free extents at the end of the data area. Extents are moved a few at a time, each batch under a short hold of the metadata lock, so volumes
+// can stay open and keep serving I/O. Volumes open in this process follow the moved extents, and writers
+// elsewhere rebuild their maps, but readers in other processes must be refreshed before reading again.
+func VacuumDevice(device string) error {
+	return core.VacuumDevice(device)
+}
+
+// Relocate the extents of a volume, so that they are contiguous and in volume order on the device. Only extents
+// visible from the current snapshot are considered. The device is vacuumed in the process.
+func DefragmentVolume(device string, volumeName string) error {
+	return core.DefragmentVolume(device, volumeName)
+}
@@ -0,0 +1,29 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Outcome of comparing a clone with the snapshot it was cloned from.
+type CloneVerification = core.CloneVerification
+
+// Compare the data of a volume with the snapshot it was cloned from as a whole, by reading both back from the
+// device, to check a copy end to end. Only extents allocated in either are read, as others read as zeroes in
+// both. The volume should not be written until verified, as changes are reported as mismatches.
+func VerifyClone(device string, volumeName string, snapshotId uint) (*CloneVerification, error) {
+	return core.VerifyClone(device, volumeName, snapshotId)
+}
@@ -0,0 +1,31 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+// Metadata of a device as of one moment, gathered under a single shared lock, so that reports combining volumes,
+// snapshots and usage do not mix states from before and after concurrent changes. Device.Generation identifies
+// the moment.
+type DeviceSnapshotView = core.DeviceSnapshotView
+
+// Return a consistent view of the metadata of a device, in place of calls to GetDeviceInfo, GetVolumeInfo,
+// ListAllSnapshots, GetSnapshotUsage and others, which may each see a different state. The extent metadata is
+// read once for the usage of all volumes.
+func GetDeviceSnapshotView(device string) (*DeviceSnapshotView, error) {
+	return core.GetDeviceSnapshotView(device)
+}
@@ -0,0 +1,31 @@
+// Copyright © 2024 FORTH-ICS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbs
+
+import (
+	"time"
+
+	"github.com/Kampadais/dbs/internal/core"
+)
+
+var ErrRetained = core.ErrRetained
+
+// Make a volume write once (WORM) until a time: blocks already written, and those written from now on, cannot be
+// overwritten or unmapped, and the volume and its snapshots cannot be deleted, until then. The retention can
+// be extended but not shortened while it lasts. Once it has passed, the volume can be changed again, and a zero
+// time turns write once off. Times are kept to the second, up to the year 2106.
+func SetVolumeRetention(device string, volumeName string, until time.Time) error {
+	return core.SetVolumeRetention(device, volumeName, until)
+}